@@ -58,6 +58,7 @@ Logging Options:
 JetStream Options:
     -js, --jetstream                 Enable JetStream functionality
     -sd, --store_dir <dir>           Set the storage directory
+        --js_rebuild_state           Rebuild stream state from message block files on startup
 
 Authorization Options:
         --user <user>                User required for connections
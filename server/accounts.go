@@ -92,6 +92,7 @@ type Account struct {
 	tags         jwt.TagList
 	nameTag      string
 	lastLimErr   int64
+	sstats       *subjectStats
 }
 
 // Account based limits.
@@ -969,6 +969,26 @@ func getTLSAuthDCs(rdns *pkix.RDNSequence) string {
 
 type tlsMapAuthFn func(string, *ldap.DN, bool) (string, bool)
 
+// userMatchingCertDN returns the user whose name, as a distinguished name, is
+// the one of the certificate. An exact match is preferred over one where the
+// RDNs are in a different order.
+func userMatchingCertDN(users []*User, certDN *ldap.DN) *User {
+	var reordered *User
+	for _, u := range users {
+		dn, err := ldap.ParseDN(u.Username)
+		if err != nil {
+			continue
+		}
+		if dn.Equal(certDN) {
+			return u
+		}
+		if reordered == nil && dn.RDNsMatch(certDN) {
+			reordered = u
+		}
+	}
+	return reordered
+}
+
 func checkClientTLSCertSubject(c *client, fn tlsMapAuthFn) bool {
 	tlsState := c.GetTLSConnectionState()
 	if tlsState == nil {
@@ -1195,25 +1215,44 @@ func (s *Server) registerLeafWithAccount(c *client, account string) bool {
 func (s *Server) isLeafNodeAuthorized(c *client) bool {
 	opts := s.getOpts()
 
-	isAuthorized := func(username, password, account string) bool {
+	isAuthorized := func(username, password, account string, perms *Permissions) bool {
 		if username != c.opts.Username {
 			return false
 		}
 		if !comparePasswords(password, c.opts.Password) {
 			return false
 		}
-		return s.registerLeafWithAccount(c, account)
+		if !s.registerLeafWithAccount(c, account) {
+			return false
+		}
+		// Permissions are from the soliciting leafnode's point of view
+		// and reversed once the CONNECT is processed.
+		if perms != nil {
+			c.mu.Lock()
+			c.setPermissions(perms)
+			c.mu.Unlock()
+		}
+		return true
 	}
 
 	// If leafnodes config has an authorization{} stanza, this takes precedence.
 	// The user in CONNECT must match. We will bind to the account associated
 	// with that user (from the leafnode's authorization{} config).
 	if opts.LeafNode.Username != _EMPTY_ {
-		return isAuthorized(opts.LeafNode.Username, opts.LeafNode.Password, opts.LeafNode.Account)
+		return isAuthorized(opts.LeafNode.Username, opts.LeafNode.Password, opts.LeafNode.Account, nil)
 	} else if len(opts.LeafNode.Users) > 0 {
 		if opts.LeafNode.TLSMap {
 			var user *User
-			found := checkClientTLSCertSubject(c, func(u string, _ *ldap.DN, _ bool) (string, bool) {
+			found := checkClientTLSCertSubject(c, func(u string, certDN *ldap.DN, _ bool) (string, bool) {
+				if u == _EMPTY_ {
+					if certDN == nil {
+						return _EMPTY_, false
+					}
+					if user = userMatchingCertDN(opts.LeafNode.Users, certDN); user != nil {
+						return user.Username, true
+					}
+					return _EMPTY_, false
+				}
 				// This is expected to be a very small array.
 				for _, usr := range opts.LeafNode.Users {
 					if u == usr.Username {
@@ -1237,7 +1276,7 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 			}
 			// This will authorize since are using an existing user,
 			// but it will also register with proper account.
-			return isAuthorized(user.Username, user.Password, accName)
+			return isAuthorized(user.Username, user.Password, accName, user.Permissions)
 		}
 
 		// This is expected to be a very small array.
@@ -1247,7 +1286,7 @@ func (s *Server) isLeafNodeAuthorized(c *client) bool {
 				if u.Account != nil {
 					accName = u.Account.Name
 				}
-				return isAuthorized(u.Username, u.Password, accName)
+				return isAuthorized(u.Username, u.Password, accName, u.Permissions)
 			}
 		}
 		return false
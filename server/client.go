@@ -207,6 +207,9 @@ const (
 	DuplicateServerName
 	MinimumVersionRequired
 	ClusterNamesIdentical
+	ConnectionAddrNotAllowed
+	CredentialsChanged
+	LeafNodeLoopDetected
 )
 
 // Some flags passed to processMsgResults
@@ -256,6 +259,7 @@ type client struct {
 	headers    bool
 
 	rtt      time.Duration
+	rttVar   time.Duration
 	rttStart time.Time
 
 	route *route
@@ -276,6 +280,14 @@ type client struct {
 	nameTag string
 
 	tlsTo *time.Timer
+
+	// Rate limits permission violation events.
+	pviol    map[string]*permViolation
+	pviolTmr *time.Timer
+
+	// Set when the connection counts against a per address connection limit.
+	connLimiter *connLimiter
+	connLimitIP net.IP
 }
 
 type rrTracking struct {
@@ -286,9 +298,10 @@ type rrTracking struct {
 
 // Struct for PING initiation from the server.
 type pinfo struct {
-	tmr  *time.Timer
-	last time.Time
-	out  int
+	tmr    *time.Timer
+	last   time.Time
+	out    int
+	missed uint64
 }
 
 // outbound holds pending data for a socket.
@@ -379,6 +392,10 @@ type readCache struct {
 
 	prand *rand.Rand
 
+	// For JetStream internal clients, the client id of the local
+	// queue subscriber that received the last message delivered.
+	qcid uint64
+
 	// These are all temporary totals for an invocation of a read in readloop.
 	msgs  int32
 	bytes int32
@@ -1965,6 +1982,40 @@ func (c *client) maxConnExceeded() {
 	c.closeConnection(MaxConnectionsExceeded)
 }
 
+func (c *client) connLimitExceeded(err error) {
+	c.sendErrAndErr(err.Error())
+	if err == ErrConnectionAddrNotAllowed {
+		c.closeConnection(ConnectionAddrNotAllowed)
+	} else {
+		c.closeConnection(MaxConnectionsExceeded)
+	}
+}
+
+// Registers the connection against the given per address connection limiter.
+// Lock should be held.
+func (c *client) acquireConnLimit(cl *connLimiter) error {
+	if cl == nil {
+		return nil
+	}
+	ip, err := cl.acquire(c.nc.RemoteAddr())
+	if err != nil {
+		return err
+	}
+	c.connLimiter, c.connLimitIP = cl, ip
+	return nil
+}
+
+// Releases the slot held against a per address connection limit, if any.
+func (c *client) releaseConnLimit() {
+	c.mu.Lock()
+	cl, ip := c.connLimiter, c.connLimitIP
+	c.connLimiter, c.connLimitIP = nil, nil
+	c.mu.Unlock()
+	if cl != nil {
+		cl.release(ip)
+	}
+}
+
 func (c *client) maxSubsExceeded() {
 	if c.acc.shouldLogMaxSubErr() {
 		c.Errorf(ErrTooManySubs.Error())
@@ -2234,7 +2285,16 @@ func (c *client) processPing() {
 func (c *client) processPong() {
 	c.mu.Lock()
 	c.ping.out = 0
-	c.rtt = computeRTT(c.rttStart)
+	rtt := computeRTT(c.rttStart)
+	if c.rtt > 0 {
+		// Smoothed mean deviation of the RTT.
+		delta := rtt - c.rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar = (3*c.rttVar + delta) / 4
+	}
+	c.rtt = rtt
 	srv := c.srv
 	reorderGWs := c.kind == GATEWAY && c.gw.outbound
 	c.mu.Unlock()
@@ -3161,6 +3221,9 @@ func (c *client) deliverMsg(prodIsMQTT bool, sub *subscription, acc *Account, su
 	// need to update payload.
 	if c.pa.hdr > 0 && !sub.client.headers {
 		msg = msg[c.pa.hdr:]
+		if client.kind == LEAF {
+			client.leaf.hdrsDropped++
+		}
 	}
 
 	// Update statistics
@@ -3545,9 +3608,11 @@ func (c *client) processInboundClientMsg(msg []byte) (bool, bool) {
 	}
 
 	// Check pub permissions
-	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) && !c.pubAllowed(string(c.pa.subject)) {
-		c.pubPermissionViolation(c.pa.subject)
-		return false, true
+	if c.perms != nil && (c.perms.pub.allow != nil || c.perms.pub.deny != nil) {
+		if !c.pubAllowed(string(c.pa.subject)) {
+			c.pubPermissionViolation(c.pa.subject)
+			return false, true
+		}
 	}
 
 	// Now check for reserved replies. These are used for service imports.
@@ -3565,6 +3630,10 @@ func (c *client) processInboundClientMsg(msg []byte) (bool, bool) {
 		c.mqttHandlePubRetain()
 	}
 
+	if ss := c.acc.sstats; ss != nil {
+		ss.track(c.pa.subject, c.pa.size)
+	}
+
 	// Doing this inline as opposed to create a function (which otherwise has a measured
 	// performance impact reported in our bench)
 	var isGWRouted bool
@@ -3883,6 +3952,19 @@ func (c *client) processServiceImport(si *serviceImport, acc *Account, msg []byt
 		return
 	}
 
+	// JetStream API requests are rate limited per account on the server they came in on,
+	// before being sent to the rest of the cluster, so all servers see the same requests.
+	if !isResponse && si.to == jsAllAPI && si.se != nil && si.se.acc == c.srv.SystemAccount() {
+		if s := c.srv; !s.jsAPILimiter.allow(acc.Name) {
+			s.RateLimitWarnf("JetStream API rate limit reached for account %q, dropping request on %q", acc.Name, c.pa.subject)
+			if len(c.pa.reply) > 0 {
+				resp := ApiResponse{Error: NewJSAPIRateLimitExceededError()}
+				s.sendInternalAccountMsg(acc, string(c.pa.reply), s.jsonResponse(&resp))
+			}
+			return
+		}
+	}
+
 	var nrr []byte
 	var rsi *serviceImport
 
@@ -4094,6 +4176,62 @@ func (c *client) addSubToRouteTargets(sub *subscription) {
 	}
 }
 
+// Will decide if a queue message should go to a leafnode member instead of one of the
+// other members. The chance is the summed queue weight of the leafnode connections of
+// the members compared to all eligible members. Returns nil if there are no weighted
+// leafnode members or nothing else to choose from, in which case normal selection applies.
+func (c *client) selectLeafQSub(qsubs []*subscription) *subscription {
+	eligible := func(sub *subscription) bool {
+		dc := sub.client
+		if dc == c || dc.leaf.queueWeight <= 0 {
+			return false
+		}
+		// Do not send back to the cluster the message came from.
+		if c.kind == ROUTER && len(c.pa.origin) > 0 && string(c.pa.origin) == dc.remoteCluster() {
+			return false
+		}
+		if c.kind == LEAF && c.remoteCluster() != _EMPTY_ && c.remoteCluster() == dc.remoteCluster() {
+			return false
+		}
+		return true
+	}
+	var lw float64
+	var no int
+	for _, sub := range qsubs {
+		if sub == nil {
+			continue
+		}
+		switch sub.client.kind {
+		case LEAF:
+			if eligible(sub) {
+				lw += sub.client.leaf.queueWeight
+			}
+		case ROUTER:
+			// Messages from a route are never sent to another route.
+			if c.kind != ROUTER {
+				no++
+			}
+		default:
+			no++
+		}
+	}
+	if lw == 0 || no == 0 {
+		return nil
+	}
+	n := c.in.prand.Float64() * (lw + float64(no))
+	if n >= lw {
+		return nil
+	}
+	for _, sub := range qsubs {
+		if sub != nil && sub.client.kind == LEAF && eligible(sub) {
+			if n -= sub.client.leaf.queueWeight; n < 0 {
+				return sub
+			}
+		}
+	}
+	return nil
+}
+
 // This processes the sublist results for a given message.
 // Returns if the message was delivered to at least target and queue filters.
 func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, deliver, subject, reply []byte, flags int) (bool, [][]byte) {
@@ -4311,6 +4449,18 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, deliver,
 			qsubs = ql
 		}
 
+		// If leafnode members have a queue weight let them compete with the
+		// other members, otherwise they are only used as a last resort.
+		if c.srv.leafNodeOpts.weighted {
+			if lsub := c.selectLeafQSub(r.qsubs[i]); lsub != nil {
+				c.addSubToRouteTargets(lsub)
+				if flags&pmrCollectQueueNames != 0 {
+					queues = append(queues, lsub.queue)
+				}
+				continue
+			}
+		}
+
 		sindex := 0
 		lqs := len(qsubs)
 		if lqs > 1 {
@@ -4380,6 +4530,9 @@ func (c *client) processMsgResults(acc *Account, r *SublistResult, msg, deliver,
 				if sub.icb == nil {
 					dlvMsgs++
 				}
+				if c.kind == JETSTREAM && sub.client.kind == CLIENT {
+					c.in.qcid = sub.client.cid
+				}
 				didDeliver = true
 				// Clear rsub
 				rsub = nil
@@ -4504,6 +4657,7 @@ func (c *client) checkLeafClientInfoHeader(msg []byte) (dmsg []byte, setHdr bool
 func (c *client) pubPermissionViolation(subject []byte) {
 	c.sendErr(fmt.Sprintf("Permissions Violation for Publish to %q", subject))
 	c.Errorf("Publish Violation - %s, Subject %q", c.getAuthUser(), subject)
+	c.permissionViolationEvent(PermViolationPublish, string(subject), _EMPTY_)
 }
 
 func (c *client) subPermissionViolation(sub *subscription) {
@@ -4519,11 +4673,13 @@ func (c *client) subPermissionViolation(sub *subscription) {
 
 	c.sendErr(errTxt)
 	c.Errorf(logTxt)
+	c.permissionViolationEvent(PermViolationSubscribe, string(sub.subject), string(sub.queue))
 }
 
 func (c *client) replySubjectViolation(reply []byte) {
 	c.sendErr(fmt.Sprintf("Permissions Violation for Publish with Reply of %q", reply))
 	c.Errorf("Publish Violation - %s, Reply %q", c.getAuthUser(), reply)
+	c.permissionViolationEvent(PermViolationReply, string(reply), _EMPTY_)
 }
 
 func (c *client) maxTokensViolation(sub *subscription) {
@@ -4547,10 +4703,7 @@ func (c *client) processPingTimer() {
 
 	var sendPing bool
 
-	pingInterval := c.srv.getOpts().PingInterval
-	if c.kind == GATEWAY {
-		pingInterval = adjustPingIntervalForGateway(pingInterval)
-	}
+	pingInterval, maxPingsOut := c.pingSettings()
 	now := time.Now()
 	needRTT := c.rtt == 0 || now.Sub(c.rttStart) > DEFAULT_RTT_MEASUREMENT_INTERVAL
 
@@ -4571,8 +4724,12 @@ func (c *client) processPingTimer() {
 	}
 
 	if sendPing {
+		// Track PINGs that were not answered in time.
+		if c.ping.out > 0 {
+			c.ping.missed++
+		}
 		// Check for violation
-		if c.ping.out+1 > c.srv.getOpts().MaxPingsOut {
+		if c.ping.out+1 > maxPingsOut {
 			c.Debugf("Stale Client Connection - Closing")
 			c.enqueueProto([]byte(fmt.Sprintf(errProto, "Stale Connection")))
 			c.mu.Unlock()
@@ -4602,11 +4759,27 @@ func (c *client) setPingTimer() {
 	if c.srv == nil {
 		return
 	}
-	d := c.srv.getOpts().PingInterval
-	if c.kind == GATEWAY {
+	d, _ := c.pingSettings()
+	c.ping.tmr = time.AfterFunc(d, c.processPingTimer)
+}
+
+// Returns the ping interval and maximum outstanding pings for this connection.
+// Leafnodes can override the server defaults.
+func (c *client) pingSettings() (time.Duration, int) {
+	opts := c.srv.getOpts()
+	d, max := opts.PingInterval, opts.MaxPingsOut
+	switch c.kind {
+	case GATEWAY:
 		d = adjustPingIntervalForGateway(d)
+	case LEAF:
+		if opts.LeafNode.PingInterval > 0 {
+			d = opts.LeafNode.PingInterval
+		}
+		if opts.LeafNode.MaxPingsOut > 0 {
+			max = opts.LeafNode.MaxPingsOut
+		}
 	}
-	c.ping.tmr = time.AfterFunc(d, c.processPingTimer)
+	return d, max
 }
 
 // Lock should be held
@@ -4913,6 +5086,11 @@ func (c *client) closeConnection(reason ClosedState) {
 			if prev := acc.removeClient(c); prev == 1 {
 				srv.decActiveAccounts()
 			}
+			// Let any JetStream push consumers bound to a deliver group
+			// know this member is gone so they can redeliver right away.
+			if kind == CLIENT && len(qsubs) > 0 {
+				acc.queueMemberClosed(c.cid, qsubs)
+			}
 		}
 	}
 
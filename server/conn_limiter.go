@@ -0,0 +1,201 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync"
+)
+
+// ConnLimitOpts are limits applied to connections accepted on a listener
+// based on the remote address of the connection.
+type ConnLimitOpts struct {
+	// Maximum number of connections from a single IP. Zero means unlimited.
+	PerIP int `json:"per_ip,omitempty"`
+	// Maximum number of connections from all the IPs within a CIDR block.
+	PerCIDR map[string]int `json:"per_cidr,omitempty"`
+	// If not empty, only connections from these CIDR blocks are accepted.
+	Allow []string `json:"allow,omitempty"`
+	// Connections from these CIDR blocks are rejected. Takes precedence over Allow.
+	Deny []string `json:"deny,omitempty"`
+}
+
+type cidrConnLimit struct {
+	ipnet *net.IPNet
+	max   int
+	count int
+}
+
+// connLimiter tracks the connections per remote IP and CIDR block for a listener.
+// Connections are tracked even when no limit is set, so that limits added by a
+// config reload account for the connections that already exist.
+type connLimiter struct {
+	mu    sync.Mutex
+	perIP int
+	cidrs []*cidrConnLimit
+	allow []*net.IPNet
+	deny  []*net.IPNet
+	ips   map[string]int
+}
+
+func parseCIDRList(field string, list []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, cidr := range list {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q in %s: %v", cidr, field, err)
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+func newConnLimiter(o *ConnLimitOpts) (*connLimiter, error) {
+	l := &connLimiter{ips: make(map[string]int)}
+	if err := l.setLimits(o); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// setLimits replaces the limits of the limiter. Connections that are already
+// tracked count against the new limits but are not closed.
+func (l *connLimiter) setLimits(o *ConnLimitOpts) error {
+	var (
+		perIP       int
+		cidrs       []*cidrConnLimit
+		allow, deny []*net.IPNet
+		err         error
+	)
+	if o != nil {
+		if o.PerIP < 0 {
+			return fmt.Errorf("per_ip connection limit can not be negative")
+		}
+		perIP = o.PerIP
+		for cidr, max := range o.PerCIDR {
+			_, ipnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid CIDR %q in per_cidr: %v", cidr, err)
+			}
+			if max <= 0 {
+				return fmt.Errorf("per_cidr connection limit for %q must be positive", cidr)
+			}
+			cidrs = append(cidrs, &cidrConnLimit{ipnet: ipnet, max: max})
+		}
+		if allow, err = parseCIDRList("allow", o.Allow); err != nil {
+			return err
+		}
+		if deny, err = parseCIDRList("deny", o.Deny); err != nil {
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for key, n := range l.ips {
+		ip := net.ParseIP(key)
+		for _, cl := range cidrs {
+			if cl.ipnet.Contains(ip) {
+				cl.count += n
+			}
+		}
+	}
+	l.perIP, l.cidrs, l.allow, l.deny = perIP, cidrs, allow, deny
+	return nil
+}
+
+func ipInNets(ip net.IP, nets []*net.IPNet) bool {
+	for _, ipnet := range nets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// acquire registers a connection from the given address. On success the
+// returned IP must be passed to release when the connection goes away.
+func (l *connLimiter) acquire(addr net.Addr) (net.IP, error) {
+	ip := addrIP(addr)
+	if ip == nil {
+		// Not an IP based connection, nothing to enforce.
+		return nil, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if ipInNets(ip, l.deny) || (len(l.allow) > 0 && !ipInNets(ip, l.allow)) {
+		return nil, ErrConnectionAddrNotAllowed
+	}
+
+	key := ip.String()
+	if l.perIP > 0 && l.ips[key] >= l.perIP {
+		return nil, ErrTooManyConnectionsFromAddr
+	}
+	for _, cl := range l.cidrs {
+		if cl.ipnet.Contains(ip) && cl.count >= cl.max {
+			return nil, ErrTooManyConnectionsFromAddr
+		}
+	}
+	l.ips[key]++
+	for _, cl := range l.cidrs {
+		if cl.ipnet.Contains(ip) {
+			cl.count++
+		}
+	}
+	return ip, nil
+}
+
+func (l *connLimiter) release(ip net.IP) {
+	if ip == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	key := ip.String()
+	if n := l.ips[key]; n <= 1 {
+		delete(l.ips, key)
+	} else {
+		l.ips[key] = n - 1
+	}
+	for _, cl := range l.cidrs {
+		if cl.ipnet.Contains(ip) && cl.count > 0 {
+			cl.count--
+		}
+	}
+}
+
+// Returns the number of tracked connections for the given IP.
+func (l *connLimiter) count(ip string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.ips[ip]
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
@@ -208,4 +208,13 @@ const (
 
 	// DEFAULT_FETCH_TIMEOUT is the default time that the system will wait for an account fetch to return.
 	DEFAULT_ACCOUNT_FETCH_TIMEOUT = 1900 * time.Millisecond
+
+	// DEFAULT_MSG_INTERCEPT_TIMEOUT is the default time budget for each message interceptor.
+	DEFAULT_MSG_INTERCEPT_TIMEOUT = 100 * time.Millisecond
+
+	// DEFAULT_MSG_INTERCEPT_WORKERS is the default number of Go routines running message interceptors.
+	DEFAULT_MSG_INTERCEPT_WORKERS = 4
+
+	// DEFAULT_JS_MAX_CLOCK_SKEW is the default for how far ahead of our clock a message timestamp may move it.
+	DEFAULT_JS_MAX_CLOCK_SKEW = time.Minute
 )
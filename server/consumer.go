@@ -51,6 +51,10 @@ type ConsumerInfo struct {
 	NumPending     uint64          `json:"num_pending"`
 	Cluster        *ClusterInfo    `json:"cluster,omitempty"`
 	PushBound      bool            `json:"push_bound,omitempty"`
+	// Set while delivery is paused because MaxAckPending was reached.
+	MaxAckPendingSince *time.Time `json:"max_ack_pending_since,omitempty"`
+	// Pending counts for the requested subsets of the filter.
+	NumPendingFiltered map[string]uint64 `json:"num_pending_filtered,omitempty"`
 }
 
 type ConsumerConfig struct {
@@ -75,6 +79,9 @@ type ConsumerConfig struct {
 	FlowControl     bool            `json:"flow_control,omitempty"`
 	HeadersOnly     bool            `json:"headers_only,omitempty"`
 
+	// Maximum bytes in flight to a flow controlled push consumer.
+	FlowControlWindow int `json:"flow_control_window,omitempty"`
+
 	// Pull based options.
 	MaxRequestBatch    int           `json:"max_batch,omitempty"`
 	MaxRequestExpires  time.Duration `json:"max_expires,omitempty"`
@@ -266,6 +273,7 @@ type consumer struct {
 	rdq               []uint64
 	rdqi              map[uint64]struct{}
 	rdc               map[uint64]uint64
+	qdm               map[uint64]uint64
 	maxdc             uint64
 	waiting           *waitQueue
 	cfg               ConsumerConfig
@@ -284,6 +292,9 @@ type consumer struct {
 	ackEventT         string
 	nakEventT         string
 	deliveryExcEventT string
+	mapEventT         string
+	mapSince          time.Time
+	mapNotified       bool
 	created           time.Time
 	ldt               time.Time
 	lat               time.Time
@@ -294,8 +305,11 @@ type consumer struct {
 	node      RaftNode
 	infoSub   *subscription
 	lqsent    time.Time
-	prm       map[string]struct{}
+	prm       map[string]*pendingRequest
 	prOk      bool
+	prSt      bool
+	prUpd     map[string]*waitingRequest
+	prTmr     *time.Timer
 	uch       chan struct{}
 	retention RetentionPolicy
 
@@ -307,6 +321,9 @@ type consumer struct {
 	// Ack queue
 	ackMsgs *ipQueue
 
+	// Set when deliveries run on the shared scheduler.
+	sd *schedDelivery
+
 	// For stream signaling.
 	sigSub *subscription
 }
@@ -322,6 +339,8 @@ const (
 	// JsDeleteWaitTimeDefault is the default amount of time we will wait for non-durable
 	// consumers to be in an inactive state before deleting them.
 	JsDeleteWaitTimeDefault = 5 * time.Second
+	// JsFlowControlMinWindow is the smallest flow control window a consumer can configure.
+	JsFlowControlMinWindow = 1024
 	// JsFlowControlMaxPending specifies default pending bytes during flow control that can be
 	// outstanding.
 	JsFlowControlMaxPending = 32 * 1024 * 1024
@@ -547,6 +566,14 @@ func checkConsumerCfg(
 	if config.FlowControl && config.Heartbeat == 0 {
 		return NewJSConsumerWithFlowControlNeedsHeartbeatsError()
 	}
+	if config.FlowControlWindow != 0 {
+		if !config.FlowControl {
+			return NewJSConsumerFlowControlWindowRequiresFCError()
+		}
+		if config.FlowControlWindow < JsFlowControlMinWindow {
+			return NewJSConsumerFlowControlWindowTooSmallError()
+		}
+	}
 
 	if config.Durable != _EMPTY_ && config.Name != _EMPTY_ {
 		if config.Name != config.Durable {
@@ -558,10 +585,11 @@ func checkConsumerCfg(
 }
 
 func (mset *stream) addConsumer(config *ConsumerConfig) (*consumer, error) {
-	return mset.addConsumerWithAssignment(config, _EMPTY_, nil, false)
+	return mset.addConsumerWithAssignment(config, _EMPTY_, nil, false, nil)
 }
 
-func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname string, ca *consumerAssignment, isRecovering bool) (*consumer, error) {
+// The client info, if any, is the client that requested the consumer and is reported in the create advisory.
+func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname string, ca *consumerAssignment, isRecovering bool, ci *ClientInfo) (*consumer, error) {
 	mset.mu.RLock()
 	s, jsa, tierName, cfg, acc := mset.srv, mset.jsa, mset.tier, mset.cfg, mset.acc
 	retention := cfg.Retention
@@ -742,6 +770,9 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	}
 	// Create ackMsgs queue now that we have a consumer name
 	o.ackMsgs = s.newIPQueue(fmt.Sprintf("[ACC:%s] consumer '%s' on stream '%s' ackMsgs", accName, o.name, mset.cfg.Name))
+	if js := mset.js; js != nil && js.dsched != nil {
+		o.sd = &schedDelivery{ds: js.dsched, o: o}
+	}
 
 	// Create our request waiting queue.
 	if o.isPullMode() {
@@ -758,6 +789,7 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 	o.ackEventT = JSMetricConsumerAckPre + "." + o.stream + "." + o.name
 	o.nakEventT = JSAdvisoryConsumerMsgNakPre + "." + o.stream + "." + o.name
 	o.deliveryExcEventT = JSAdvisoryConsumerMaxDeliveryExceedPre + "." + o.stream + "." + o.name
+	o.mapEventT = JSAdvisoryConsumerMaxAckPendingPre + "." + o.stream + "." + o.name
 
 	if !isValidName(o.name) {
 		mset.mu.Unlock()
@@ -867,7 +899,7 @@ func (mset *stream) addConsumerWithAssignment(config *ConsumerConfig, oname stri
 			suppress = ca.responded
 		}
 		if !suppress {
-			o.sendCreateAdvisory()
+			o.sendCreateAdvisory(ci)
 		}
 	}
 
@@ -1026,7 +1058,7 @@ func (o *consumer) setLeader(isLeader bool) {
 
 		// Check on flow control settings.
 		if o.cfg.FlowControl {
-			o.setMaxPendingBytes(JsFlowControlMaxPending)
+			o.setMaxPendingBytes(o.cfg.flowControlWindow())
 			fcsubj := fmt.Sprintf(jsFlowControl, stream, o.name)
 			if o.fcSub, err = o.subscribeInternal(fcsubj, o.processFlowControl); err != nil {
 				o.mu.Unlock()
@@ -1035,9 +1067,21 @@ func (o *consumer) setLeader(isLeader bool) {
 			}
 		}
 
+		// If a previous leader delivered, pace from an empty bucket.
+		if o.dseq > 1 {
+			o.resetRateLimit()
+		}
+
 		// If push mode, register for notifications on interest.
 		if o.isPushMode() {
+			if o.inch != nil && o.sd != nil {
+				o.acc.sl.setNotificationWake(o.inch, nil)
+			}
 			o.inch = make(chan bool, 8)
+			// On the shared scheduler interest changes schedule us.
+			if sd := o.sd; sd != nil {
+				o.acc.sl.setNotificationWake(o.inch, func() { sd.ds.schedule(sd) })
+			}
 			o.acc.sl.registerNotification(o.cfg.DeliverSubject, o.cfg.DeliverGroup, o.inch)
 			if o.active = <-o.inch; o.active {
 				o.checkQueueInterest()
@@ -1078,11 +1122,16 @@ func (o *consumer) setLeader(isLeader bool) {
 		// Register as a leader with our parent stream.
 		mset.setConsumerAsLeader(o)
 
-		// Now start up Go routine to deliver msgs.
-		go o.loopAndGatherMsgs(qch)
+		if o.sd != nil {
+			// Deliver msgs and process acks on the shared scheduler.
+			o.startScheduled(qch)
+		} else {
+			// Now start up Go routine to deliver msgs.
+			go o.loopAndGatherMsgs(qch)
 
-		// Now start up Go routine to process acks.
-		go o.processInboundAcks(qch)
+			// Now start up Go routine to process acks.
+			go o.processInboundAcks(qch)
+		}
 
 		// If we are R>1 spin up our proposal loop.
 		if node != nil {
@@ -1100,10 +1149,14 @@ func (o *consumer) setLeader(isLeader bool) {
 			close(o.qch)
 			o.qch = nil
 		}
+		if o.sd != nil {
+			o.sd.ds.unregister(o.sd)
+		}
+		o.mapSince, o.mapNotified = time.Time{}, false
 		// Make sure to clear out any re delivery queues
-		stopAndClearTimer(&o.ptmr)
+		o.stopPendingTimer()
 		o.rdq, o.rdqi = nil, nil
-		o.pending = nil
+		o.pending, o.qdm = nil, nil
 		// ok if they are nil, we protect inside unsubscribe()
 		o.unsubscribe(o.ackSub)
 		o.unsubscribe(o.reqSub)
@@ -1115,6 +1168,7 @@ func (o *consumer) setLeader(isLeader bool) {
 		}
 		// Reset waiting if we are in pull mode.
 		if o.isPullMode() {
+			o.trackPendingRequests()
 			o.waiting = newWaitQueue(o.cfg.MaxWaiting)
 			if !o.isDurable() {
 				stopAndClearTimer(&o.dtmr)
@@ -1122,8 +1176,14 @@ func (o *consumer) setLeader(isLeader bool) {
 		} else if o.srv.gateway.enabled {
 			stopAndClearTimer(&o.gwdtmr)
 		}
+		store := o.store
 		o.mu.Unlock()
 
+		// Make sure the state we had as leader is written out.
+		if store != nil {
+			store.Flush()
+		}
+
 		// Unregister as a leader with our parent stream.
 		if mset != nil {
 			mset.removeConsumerAsLeader(o)
@@ -1169,7 +1229,7 @@ func (o *consumer) sendAdvisory(subj string, msg []byte) {
 	o.outq.sendMsg(subj, msg)
 }
 
-func (o *consumer) sendDeleteAdvisoryLocked() {
+func (o *consumer) sendDeleteAdvisoryLocked(ci *ClientInfo) {
 	e := JSConsumerActionAdvisory{
 		TypedEvent: TypedEvent{
 			Type: JSConsumerActionAdvisoryType,
@@ -1180,6 +1240,7 @@ func (o *consumer) sendDeleteAdvisoryLocked() {
 		Consumer: o.name,
 		Action:   DeleteEvent,
 		Domain:   o.srv.getOpts().JetStreamDomain,
+		Client:   ci,
 	}
 
 	j, err := json.Marshal(e)
@@ -1191,7 +1252,7 @@ func (o *consumer) sendDeleteAdvisoryLocked() {
 	o.sendAdvisory(subj, j)
 }
 
-func (o *consumer) sendCreateAdvisory() {
+func (o *consumer) sendCreateAdvisory(ci *ClientInfo) {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
@@ -1205,6 +1266,7 @@ func (o *consumer) sendCreateAdvisory() {
 		Consumer: o.name,
 		Action:   CreateEvent,
 		Domain:   o.srv.getOpts().JetStreamDomain,
+		Client:   ci,
 	}
 
 	j, err := json.Marshal(e)
@@ -1440,7 +1502,7 @@ func (o *consumer) forceExpirePending() {
 				p.Timestamp += off
 			}
 		}
-		o.ptmr.Reset(o.ackWait(0))
+		o.resetPendingTimer(o.ackWait(0))
 	}
 	o.signalNewMessages()
 }
@@ -1487,9 +1549,28 @@ func (o *consumer) setRateLimit(bps uint64) {
 		burst = int(s.getOpts().MaxPayload)
 	}
 
+	// On a config update keep the current pacing instead of starting over.
+	if o.rlimit != nil {
+		o.rlimit.SetLimit(rl)
+		o.rlimit.SetBurst(burst)
+		return
+	}
 	o.rlimit = rate.NewLimiter(rl, burst)
 }
 
+// Takes all tokens from the rate limiter. A new limiter allows a full burst
+// right away, which for slow rates and large bursts means a lot of data can
+// go out well above the configured rate, e.g. when we take over as leader.
+// Lock should be held.
+func (o *consumer) resetRateLimit() {
+	if o.rlimit == nil {
+		return
+	}
+	rl := rate.NewLimiter(o.rlimit.Limit(), o.rlimit.Burst())
+	rl.AllowN(time.Now(), rl.Burst())
+	o.rlimit = rl
+}
+
 // Check if new consumer config allowed vs old.
 func (acc *Account) checkNewConsumerConfig(cfg, ncfg *ConsumerConfig) error {
 	if reflect.DeepEqual(cfg, ncfg) {
@@ -1571,8 +1652,8 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 	}
 	// AckWait
 	if cfg.AckWait != o.cfg.AckWait {
-		if o.ptmr != nil {
-			o.ptmr.Reset(100 * time.Millisecond)
+		if o.pendingTimerSet() {
+			o.resetPendingTimer(100 * time.Millisecond)
 		}
 	}
 	// Rate Limit
@@ -1591,6 +1672,11 @@ func (o *consumer) updateConfig(cfg *ConsumerConfig) error {
 	if cfg.MaxDeliver != o.cfg.MaxDeliver {
 		o.maxdc = uint64(cfg.MaxDeliver)
 	}
+	// Flow control window, ramp up again to the new limit.
+	if cfg.FlowControl && cfg.FlowControlWindow != o.cfg.FlowControlWindow {
+		o.setMaxPendingBytes(cfg.flowControlWindow())
+		o.signalNewMessages()
+	}
 	// Set InactiveThreshold if changed.
 	if val := cfg.InactiveThreshold; val != o.cfg.InactiveThreshold {
 		o.updateInactiveThreshold(cfg)
@@ -1685,6 +1771,9 @@ func (am *jsAckMsg) returnToPool() {
 func (o *consumer) pushAck(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	atomic.AddInt64(&o.awl, 1)
 	o.ackMsgs.push(newJSAckMsg(subject, reply, c.pa.hdr, copyBytes(rmsg)))
+	if o.sd != nil {
+		o.sd.ds.schedule(o.sd)
+	}
 }
 
 // Processes a message for the ack reply subject delivered with a message.
@@ -1855,34 +1944,86 @@ func (o *consumer) updateAcks(dseq, sseq uint64) {
 	o.lat = time.Now()
 }
 
+// pendingRequest is what followers know about a pending pull request, so a
+// new leader can keep serving it. It is nil if only the reply is known.
+type pendingRequest struct {
+	n       int // Remaining batch.
+	b       int // Remaining max bytes.
+	expires time.Time
+	hb      time.Duration
+	noWait  bool
+}
+
 // Communicate to the cluster an addition of a pending request.
 // Lock should be held.
-func (o *consumer) addClusterPendingRequest(reply string) {
+func (o *consumer) addClusterPendingRequest(wr *waitingRequest) {
 	if o.node == nil || !o.pendingRequestsOk() {
 		return
 	}
-	b := make([]byte, len(reply)+1)
+	if o.prSt {
+		o.propose(encodePendingRequestAdd(wr))
+		return
+	}
+	b := make([]byte, len(wr.reply)+1)
 	b[0] = byte(addPendingRequest)
-	copy(b[1:], reply)
+	copy(b[1:], wr.reply)
 	o.propose(b)
 }
 
+// How often we let the cluster know what is left of partially served pending requests.
+const pendingRequestUpdateInterval = 250 * time.Millisecond
+
+// Communicate to the cluster what is left of a partially served pending request.
+// These are batched so we do not propose for every message delivered.
+// Lock should be held.
+func (o *consumer) updateClusterPendingRequest(wr *waitingRequest) {
+	if o.node == nil || !o.pendingRequestsOk() || !o.prSt {
+		return
+	}
+	if o.prUpd == nil {
+		o.prUpd = make(map[string]*waitingRequest)
+	}
+	o.prUpd[wr.reply] = wr
+	if o.prTmr == nil {
+		o.prTmr = time.AfterFunc(pendingRequestUpdateInterval, o.flushClusterPendingRequests)
+	}
+}
+
+// Proposes the latest state of the pending requests that were partially served.
+func (o *consumer) flushClusterPendingRequests() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	upd := o.prUpd
+	o.prUpd, o.prTmr = nil, nil
+	if o.node == nil || !o.node.Leader() || !o.pendingRequestsOk() || !o.prSt {
+		return
+	}
+	for reply, wr := range upd {
+		// Skip requests that are done and were recycled.
+		if wr.reply == reply {
+			o.propose(encodePendingRequestUpdate(wr))
+		}
+	}
+}
+
 // Communicate to the cluster a removal of a pending request.
 // Lock should be held.
 func (o *consumer) removeClusterPendingRequest(reply string) {
 	if o.node == nil || !o.pendingRequestsOk() {
 		return
 	}
+	delete(o.prUpd, reply)
 	b := make([]byte, len(reply)+1)
 	b[0] = byte(removePendingRequest)
 	copy(b[1:], reply)
 	o.propose(b)
 }
 
-// Set whether or not we can send pending requests to followers.
-func (o *consumer) setPendingRequestsOk(ok bool) {
+// Set whether or not we can send pending requests to followers, and
+// whether we can send the state of those requests as well.
+func (o *consumer) setPendingRequestsOk(ok, withState bool) {
 	o.mu.Lock()
-	o.prOk = ok
+	o.prOk, o.prSt = ok, ok && withState
 	o.mu.Unlock()
 }
 
@@ -1891,6 +2032,9 @@ func (o *consumer) pendingRequestsOk() bool {
 	return o.prOk
 }
 
+// First version that can take over the state of pending requests.
+const pendingRequestStateVersion = "2.9.12-RC.1"
+
 // Set whether or not we can send info about pending pull requests to our group.
 // Will require all peers have a minimum version.
 func (o *consumer) checkAndSetPendingRequestsOk() {
@@ -1901,6 +2045,7 @@ func (o *consumer) checkAndSetPendingRequestsOk() {
 		return
 	}
 
+	withState := true
 	if ca := o.consumerAssignment(); ca != nil && len(ca.Group.Peers) > 1 {
 		for _, pn := range ca.Group.Peers {
 			if si, ok := s.nodeToInfo.Load(pn); ok {
@@ -1908,16 +2053,21 @@ func (o *consumer) checkAndSetPendingRequestsOk() {
 					// We expect all of our peers to eventually be up to date.
 					// So check again in awhile.
 					time.AfterFunc(eventsHBInterval, func() { o.checkAndSetPendingRequestsOk() })
-					o.setPendingRequestsOk(false)
+					o.setPendingRequestsOk(false, false)
 					return
 				}
+				// Peers need to be able to take over the state of pending requests.
+				if !versionAtLeastPre(si.(nodeInfo).version, pendingRequestStateVersion) {
+					withState = false
+				}
 			}
 		}
 	}
-	o.setPendingRequestsOk(true)
+	o.setPendingRequestsOk(true, withState)
 }
 
-// On leadership change make sure we alert the pending requests that they are no longer valid.
+// On leadership change take over the pending requests we know the state of,
+// and alert the others that they are no longer valid.
 func (o *consumer) checkPendingRequests() {
 	o.mu.Lock()
 	defer o.mu.Unlock()
@@ -1925,10 +2075,55 @@ func (o *consumer) checkPendingRequests() {
 		return
 	}
 	hdr := []byte("NATS/1.0 409 Leadership Change\r\n\r\n")
-	for reply := range o.prm {
+	now := time.Now()
+	var adopted int
+	for reply, pr := range o.prm {
+		if pr != nil && o.waiting != nil && !o.waiting.isFull() {
+			// Expired requests are gone on the client side as well.
+			if !pr.expires.IsZero() && now.After(pr.expires) {
+				o.removeClusterPendingRequest(reply)
+				continue
+			}
+			acc, interest := trackDownAccountAndInterest(o.acc, reply)
+			wr := wrPool.Get().(*waitingRequest)
+			wr.acc, wr.interest, wr.reply, wr.n, wr.d, wr.b = acc, interest, reply, pr.n, 0, pr.b
+			wr.expires, wr.hb, wr.noWait, wr.received = pr.expires, pr.hb, pr.noWait, now
+			if wr.hb > 0 {
+				wr.hbt = now.Add(wr.hb)
+			} else {
+				wr.hbt = time.Time{}
+			}
+			if o.waiting.add(wr) == nil {
+				adopted++
+				continue
+			}
+			wr.recycle()
+		}
 		o.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 	}
 	o.prm = nil
+	if adopted > 0 {
+		o.signalNewMessages()
+	}
+}
+
+// When we lose leadership, remember our pending requests as followers do,
+// in case we become leader again.
+// Lock should be held.
+func (o *consumer) trackPendingRequests() {
+	if o.waiting == nil || o.waiting.isEmpty() || !o.prSt {
+		return
+	}
+	if o.prm == nil {
+		o.prm = make(map[string]*pendingRequest)
+	}
+	wq := o.waiting
+	for i, rp := 0, wq.rp; i < wq.n; i++ {
+		if wr := wq.reqs[rp]; wr != nil {
+			o.prm[wr.reply] = &pendingRequest{n: wr.n, b: wr.b, expires: wr.expires, hb: wr.hb, noWait: wr.noWait}
+		}
+		rp = (rp + 1) % cap(wq.reqs)
+	}
 }
 
 // This will release any pending pull requests if applicable.
@@ -1966,6 +2161,28 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 		}
 	}
 
+	// Check to see if we have delays attached.
+	var d time.Duration
+	if len(nak) > len(AckNak) {
+		arg := bytes.TrimSpace(nak[len(AckNak):])
+		if len(arg) > 0 {
+			var err error
+			if arg[0] == '{' {
+				var nd ConsumerNakOptions
+				if err = json.Unmarshal(arg, &nd); err == nil {
+					d = nd.Delay
+				}
+			} else {
+				d, err = time.ParseDuration(string(arg))
+			}
+			if err != nil {
+				// Treat this as normal NAK.
+				o.srv.Warnf("JetStream consumer '%s > %s > %s' bad NAK delay value: %q", o.acc.Name, o.stream, o.name, arg)
+				d = 0
+			}
+		}
+	}
+
 	// Deliver an advisory
 	e := JSConsumerDeliveryNakAdvisory{
 		TypedEvent: TypedEvent{
@@ -1978,6 +2195,7 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 		ConsumerSeq: dseq,
 		StreamSeq:   sseq,
 		Deliveries:  dc,
+		Delay:       d,
 		Domain:      o.srv.getOpts().JetStreamDomain,
 	}
 
@@ -1988,42 +2206,25 @@ func (o *consumer) processNak(sseq, dseq, dc uint64, nak []byte) {
 
 	o.sendAdvisory(o.nakEventT, j)
 
-	// Check to see if we have delays attached.
-	if len(nak) > len(AckNak) {
-		arg := bytes.TrimSpace(nak[len(AckNak):])
-		if len(arg) > 0 {
-			var d time.Duration
-			var err error
-			if arg[0] == '{' {
-				var nd ConsumerNakOptions
-				if err = json.Unmarshal(arg, &nd); err == nil {
-					d = nd.Delay
-				}
-			} else {
-				d, err = time.ParseDuration(string(arg))
-			}
-			if err != nil {
-				// Treat this as normal NAK.
-				o.srv.Warnf("JetStream consumer '%s > %s > %s' bad NAK delay value: %q", o.acc.Name, o.stream, o.name, arg)
-			} else {
-				// We have a parsed duration that the user wants us to wait before retrying.
-				// Make sure we are not on the rdq.
-				o.removeFromRedeliverQueue(sseq)
-				if p, ok := o.pending[sseq]; ok {
-					// now - ackWait is expired now, so offset from there.
-					p.Timestamp = time.Now().Add(-o.cfg.AckWait).Add(d).UnixNano()
-					// Update store system which will update followers as well.
-					o.updateDelivered(p.Sequence, sseq, dc, p.Timestamp)
-					if o.ptmr != nil {
-						// Want checkPending to run and figure out the next timer ttl.
-						// TODO(dlc) - We could optimize this maybe a bit more and track when we expect the timer to fire.
-						o.ptmr.Reset(10 * time.Millisecond)
-					}
-				}
-				// Nothing else for use to do now so return.
-				return
+	if d > 0 {
+		// We have a parsed duration that the user wants us to wait before retrying.
+		// Make sure we are not on the rdq.
+		o.removeFromRedeliverQueue(sseq)
+		if p, ok := o.pending[sseq]; ok {
+			// now - deadline is expired now, so offset from there.
+			// With a backoff the deadline depends on the number of deliveries.
+			deadline, _ := o.redeliveryDeadline(sseq)
+			p.Timestamp = time.Now().UnixNano() - deadline + int64(d)
+			// Update store system which will update followers as well.
+			o.updateDelivered(p.Sequence, sseq, dc, p.Timestamp)
+			if o.pendingTimerSet() {
+				// Want checkPending to run and figure out the next timer ttl.
+				// TODO(dlc) - We could optimize this maybe a bit more and track when we expect the timer to fire.
+				o.resetPendingTimer(10 * time.Millisecond)
 			}
 		}
+		// Nothing else for use to do now so return.
+		return
 	}
 
 	// If already queued up also ignore.
@@ -2132,7 +2333,7 @@ func (o *consumer) applyState(state *ConsumerState) {
 	o.rdc = state.Redelivered
 
 	// Setup tracking timer if we have restored pending.
-	if len(o.pending) > 0 && o.ptmr == nil {
+	if len(o.pending) > 0 && !o.pendingTimerSet() {
 		// This is on startup or leader change. We want to check pending
 		// sooner in case there are inconsistencies etc. Pick between 500ms - 1.5s
 		delay := 500*time.Millisecond + time.Duration(rand.Int63n(1000))*time.Millisecond
@@ -2140,7 +2341,7 @@ func (o *consumer) applyState(state *ConsumerState) {
 		if o.cfg.AckWait < delay {
 			delay = o.ackWait(0)
 		}
-		o.ptmr = time.AfterFunc(delay, o.checkPending)
+		o.resetPendingTimer(delay)
 	}
 }
 
@@ -2213,6 +2414,19 @@ func (o *consumer) infoWithSnap(snap bool) *ConsumerInfo {
 }
 
 func (o *consumer) infoWithSnapAndReply(snap bool, reply string) *ConsumerInfo {
+	// When delivered by the shared scheduler, interest changes are picked up
+	// lazily, so apply them here to report an accurate push bound status.
+	o.mu.RLock()
+	sd := o.sd
+	var inch chan bool
+	if sd != nil {
+		inch = sd.inch
+	}
+	o.mu.RUnlock()
+	if inch != nil {
+		o.applyInterestChanges(sd, inch)
+	}
+
 	o.mu.Lock()
 	mset := o.mset
 	if mset == nil || mset.srv == nil {
@@ -2259,6 +2473,10 @@ func (o *consumer) infoWithSnapAndReply(snap bool, reply string) *ConsumerInfo {
 		lat := o.lat.UTC() // This copies as well.
 		info.AckFloor.Last = &lat
 	}
+	if !o.mapSince.IsZero() && o.maxp > 0 && len(o.pending) >= o.maxp {
+		mapSince := o.mapSince
+		info.MaxAckPendingSince = &mapSince
+	}
 
 	// If we are a pull mode consumer, report on number of waiting requests.
 	if o.isPullMode() {
@@ -2292,6 +2510,9 @@ func (o *consumer) signalNewMessages() {
 	case o.mch <- struct{}{}:
 	default:
 	}
+	if o.sd != nil {
+		o.sd.ds.schedule(o.sd)
+	}
 }
 
 // shouldSample lets us know if we are sampling metrics on acks.
@@ -2305,7 +2526,7 @@ func (o *consumer) shouldSample() bool {
 
 	// TODO(ripienaar) this is a tad slow so we need to rethink here, however this will only
 	// hit for those with sampling enabled and its not the default
-	return rand.Int31n(100) <= o.sfreq
+	return rand.Int31n(100) < o.sfreq
 }
 
 func (o *consumer) sampleAck(sseq, dseq, dc uint64) {
@@ -2372,6 +2593,7 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 		}
 		// We do these regardless.
 		delete(o.rdc, sseq)
+		delete(o.qdm, sseq)
 		o.removeFromRedeliverQueue(sseq)
 	case AckAll:
 		// no-op
@@ -2382,11 +2604,16 @@ func (o *consumer) processAckMsg(sseq, dseq, dc uint64, doSample bool) {
 		if o.maxp > 0 && len(o.pending) >= o.maxp {
 			needSignal = true
 		}
+		// Sample the message that was acked, not the ones it implicitly acks.
+		if _, ok := o.pending[sseq]; ok && doSample {
+			o.sampleAck(sseq, dseq, dc)
+		}
 		sagap = sseq - o.asflr
 		o.adflr, o.asflr = dseq, sseq
 		for seq := sseq; seq > sseq-sagap; seq-- {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
+			delete(o.qdm, seq)
 			o.removeFromRedeliverQueue(seq)
 		}
 	case AckNone:
@@ -2877,7 +3104,7 @@ func (o *consumer) processNextMsgRequest(reply string, msg []byte) {
 	o.signalNewMessages()
 	// If we are clustered update our followers about this request.
 	if o.node != nil {
-		o.addClusterPendingRequest(wr.reply)
+		o.addClusterPendingRequest(wr)
 	}
 }
 
@@ -2934,6 +3161,34 @@ func (o *consumer) notifyDeliveryExceeded(sseq, dc uint64) {
 	o.sendAdvisory(o.deliveryExcEventT, j)
 }
 
+// Number of pending acks we need to get down to before we send another
+// max ack pending advisory.
+func maxAckPendingLowWater(maxp int) int {
+	return maxp * 3 / 4
+}
+
+// Lock should be held.
+func (o *consumer) notifyMaxAckPending() {
+	e := JSConsumerMaxAckPendingAdvisory{
+		TypedEvent: TypedEvent{
+			Type: JSConsumerMaxAckPendingAdvisoryType,
+			ID:   nuid.Next(),
+			Time: o.mapSince,
+		},
+		Stream:        o.stream,
+		Consumer:      o.name,
+		MaxAckPending: o.maxp,
+		Domain:        o.srv.getOpts().JetStreamDomain,
+	}
+
+	j, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+
+	o.sendAdvisory(o.mapEventT, j)
+}
+
 // Check to see if the candidate subject matches a filter if its present.
 // Lock should be held.
 func (o *consumer) isFilteredMatch(subj string) bool {
@@ -3006,8 +3261,22 @@ func (o *consumer) getNextMsg() (*jsPubMsg, uint64, error) {
 	if o.maxp > 0 && len(o.pending) >= o.maxp {
 		// maxp only set when ack policy != AckNone and user set MaxAckPending
 		// Stall if we have hit max pending.
+		if o.mapSince.IsZero() {
+			o.mapSince = time.Now().UTC()
+			// Only tell again once acks brought us below our low water mark,
+			// so a consumer hovering around the limit does not flood advisories.
+			if !o.mapNotified {
+				o.mapNotified = true
+				o.notifyMaxAckPending()
+			}
+		}
 		return nil, 0, errMaxAckPending
 	}
+	// Acks have made room for more.
+	o.mapSince = time.Time{}
+	if o.mapNotified && len(o.pending) <= maxAckPendingLowWater(o.maxp) {
+		o.mapNotified = false
+	}
 
 	// Grab next message applicable to us.
 	pmsg := getJSPubMsgFromPool()
@@ -3135,17 +3404,7 @@ func (o *consumer) processInboundAcks(qch chan struct{}) {
 	for {
 		select {
 		case <-o.ackMsgs.ch:
-			acks := o.ackMsgs.pop()
-			for _, acki := range acks {
-				ack := acki.(*jsAckMsg)
-				o.processAck(ack.subject, ack.reply, ack.hdr, ack.msg)
-				ack.returnToPool()
-			}
-			o.ackMsgs.recycle(&acks)
-			// If we have an inactiveThreshold set, mark our activity.
-			if hasInactiveThresh {
-				o.suppressDeletion()
-			}
+			o.processQueuedAcks(hasInactiveThresh)
 		case <-qch:
 			return
 		case <-s.quitCh:
@@ -3154,6 +3413,24 @@ func (o *consumer) processInboundAcks(qch chan struct{}) {
 	}
 }
 
+// Processes all acks in our queue.
+func (o *consumer) processQueuedAcks(hasInactiveThresh bool) {
+	acks := o.ackMsgs.pop()
+	if len(acks) == 0 {
+		return
+	}
+	for _, acki := range acks {
+		ack := acki.(*jsAckMsg)
+		o.processAck(ack.subject, ack.reply, ack.hdr, ack.msg)
+		ack.returnToPool()
+	}
+	o.ackMsgs.recycle(&acks)
+	// If we have an inactiveThreshold set, mark our activity.
+	if hasInactiveThresh {
+		o.suppressDeletion()
+	}
+}
+
 // Suppress auto cleanup on ack activity of any kind.
 func (o *consumer) suppressDeletion() {
 	o.mu.Lock()
@@ -3172,6 +3449,73 @@ func (o *consumer) suppressDeletion() {
 	}
 }
 
+// Will get the next message to deliver, along with where to deliver it.
+// Returns a nil message if there is nothing we can deliver right now.
+// Lock should be held.
+func (o *consumer) nextDelivery() (pmsg *jsPubMsg, dc uint64, dsubj, ackReply string, sz int, err error) {
+	// If we are in push mode and not active or under flowcontrol let's stop sending.
+	if o.isPushMode() {
+		if !o.active || (o.maxpb > 0 && o.pbytes > o.maxpb) {
+			return nil, 0, _EMPTY_, _EMPTY_, 0, nil
+		}
+	} else if o.waiting.isEmpty() {
+		// If we are in pull mode and no one is waiting already break and wait.
+		return nil, 0, _EMPTY_, _EMPTY_, 0, nil
+	}
+
+	// Grab our next msg.
+	pmsg, dc, err = o.getNextMsg()
+
+	// On error either wait or return.
+	if err != nil || pmsg == nil {
+		if err != ErrStoreMsgNotFound && err != ErrStoreEOF && err != errMaxAckPending && err != errPartialCache {
+			o.srv.Errorf("Received an error looking up message for consumer: %v", err)
+		}
+		return nil, 0, _EMPTY_, _EMPTY_, 0, err
+	}
+
+	// Update our cached num pending here first.
+	if dc == 1 && o.npcm > 0 {
+		o.npc--
+	}
+	// Pre-calculate ackReply
+	ackReply = o.ackReply(pmsg.seq, o.dseq, dc, pmsg.ts, o.numPending())
+
+	// If headers only do not send msg payload.
+	// Add in msg size itself as header.
+	if o.cfg.HeadersOnly {
+		convertToHeadersOnly(pmsg)
+	}
+	// Calculate payload size. This can be calculated on client side.
+	// We do not include transport subject here since not generally known on client.
+	sz = len(pmsg.subj) + len(ackReply) + len(pmsg.hdr) + len(pmsg.msg)
+
+	if o.isPushMode() {
+		dsubj = o.dsubj
+	} else if wr := o.nextWaiting(sz); wr != nil {
+		dsubj = wr.reply
+		if done := wr.recycleIfDone(); done && o.node != nil {
+			o.removeClusterPendingRequest(dsubj)
+		} else if !done {
+			if wr.hb > 0 {
+				wr.hbt = time.Now().Add(wr.hb)
+			}
+			if o.node != nil {
+				o.updateClusterPendingRequest(wr)
+			}
+		}
+	} else {
+		// We will redo this one.
+		o.sseq--
+		if dc == 1 && o.npcm > 0 {
+			o.npc++
+		}
+		pmsg.returnToPool()
+		return nil, 0, _EMPTY_, _EMPTY_, 0, nil
+	}
+	return pmsg, dc, dsubj, ackReply, sz, nil
+}
+
 func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 	// On startup check to see if we are in a a reply situation where replay policy is not instant.
 	var (
@@ -3192,7 +3536,6 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 	}
 
 	o.mu.Lock()
-	s := o.srv
 	// need to check again if consumer is closed
 	if o.mset == nil {
 		o.mu.Unlock()
@@ -3235,61 +3578,8 @@ func (o *consumer) loopAndGatherMsgs(qch chan struct{}) {
 		// Clear last error.
 		err = nil
 
-		// If we are in push mode and not active or under flowcontrol let's stop sending.
-		if o.isPushMode() {
-			if !o.active || (o.maxpb > 0 && o.pbytes > o.maxpb) {
-				goto waitForMsgs
-			}
-		} else if o.waiting.isEmpty() {
-			// If we are in pull mode and no one is waiting already break and wait.
-			goto waitForMsgs
-		}
-
-		// Grab our next msg.
-		pmsg, dc, err = o.getNextMsg()
-
-		// On error either wait or return.
-		if err != nil || pmsg == nil {
-			if err == ErrStoreMsgNotFound || err == ErrStoreEOF || err == errMaxAckPending || err == errPartialCache {
-				goto waitForMsgs
-			} else {
-				s.Errorf("Received an error looking up message for consumer: %v", err)
-				goto waitForMsgs
-			}
-		}
-
-		// Update our cached num pending here first.
-		if dc == 1 && o.npcm > 0 {
-			o.npc--
-		}
-		// Pre-calculate ackReply
-		ackReply = o.ackReply(pmsg.seq, o.dseq, dc, pmsg.ts, o.numPending())
-
-		// If headers only do not send msg payload.
-		// Add in msg size itself as header.
-		if o.cfg.HeadersOnly {
-			convertToHeadersOnly(pmsg)
-		}
-		// Calculate payload size. This can be calculated on client side.
-		// We do not include transport subject here since not generally known on client.
-		sz = len(pmsg.subj) + len(ackReply) + len(pmsg.hdr) + len(pmsg.msg)
-
-		if o.isPushMode() {
-			dsubj = o.dsubj
-		} else if wr := o.nextWaiting(sz); wr != nil {
-			dsubj = wr.reply
-			if done := wr.recycleIfDone(); done && o.node != nil {
-				o.removeClusterPendingRequest(dsubj)
-			} else if !done && wr.hb > 0 {
-				wr.hbt = time.Now().Add(wr.hb)
-			}
-		} else {
-			// We will redo this one.
-			o.sseq--
-			if dc == 1 && o.npcm > 0 {
-				o.npc++
-			}
-			pmsg.returnToPool()
+		// Grab our next msg and where it should go.
+		if pmsg, dc, dsubj, ackReply, sz, err = o.nextDelivery(); pmsg == nil {
 			goto waitForMsgs
 		}
 
@@ -3404,6 +3694,14 @@ func (o *consumer) ackReply(sseq, dseq, dc uint64, ts int64, pending uint64) str
 	return fmt.Sprintf(o.ackReplyT, dc, sseq, dseq, ts, pending)
 }
 
+// Returns the max pending bytes for flow control.
+func (cfg *ConsumerConfig) flowControlWindow() int {
+	if cfg.FlowControlWindow > 0 {
+		return cfg.FlowControlWindow
+	}
+	return JsFlowControlMaxPending
+}
+
 // Used mostly for testing. Sets max pending bytes for flow control setups.
 func (o *consumer) setMaxPendingBytes(limit int) {
 	o.pblimit = limit
@@ -3433,13 +3731,10 @@ func (o *consumer) streamNumPending() uint64 {
 		o.npc, o.npcm = 0, 0
 	} else if o.cfg.DeliverPolicy == DeliverLastPerSubject {
 		o.npc, o.npcm = 0, 0
-		for _, ss := range o.mset.store.SubjectsState(o.cfg.FilterSubject) {
-			if o.sseq <= ss.Last {
-				o.npc++
-				if ss.Last > o.npcm {
-					o.npcm = ss.Last
-				}
-			}
+		seqs := o.mset.store.LastSeqsPerSubject(o.cfg.FilterSubject)
+		// These are sorted so we can find where we are.
+		if i := sort.Search(len(seqs), func(i int) bool { return seqs[i] >= o.sseq }); i < len(seqs) {
+			o.npc, o.npcm = uint64(len(seqs)-i), seqs[len(seqs)-1]
 		}
 	} else {
 		ss := o.mset.store.FilteredState(o.sseq, o.cfg.FilterSubject)
@@ -3448,6 +3743,26 @@ func (o *consumer) streamNumPending() uint64 {
 	return o.npc
 }
 
+// Returns the number of messages yet to be delivered for each filter,
+// using the consumer store so the stream does not need to be walked.
+func (o *consumer) numPendingFiltered(filters []string) (map[string]uint64, error) {
+	o.mu.RLock()
+	store := o.store
+	o.mu.RUnlock()
+	if store == nil {
+		return nil, ErrStoreClosed
+	}
+	np := make(map[string]uint64, len(filters))
+	for _, filter := range filters {
+		n, err := store.NumPending(filter)
+		if err != nil {
+			return nil, err
+		}
+		np[filter] = n
+	}
+	return np, nil
+}
+
 func convertToHeadersOnly(pmsg *jsPubMsg) {
 	// If headers only do not send msg payload.
 	// Add in msg size itself as header.
@@ -3609,8 +3924,8 @@ func (o *consumer) trackPending(sseq, dseq uint64) {
 	if o.pending == nil {
 		o.pending = make(map[uint64]*Pending)
 	}
-	if o.ptmr == nil {
-		o.ptmr = time.AfterFunc(o.ackWait(0), o.checkPending)
+	if !o.pendingTimerSet() {
+		o.resetPendingTimer(o.ackWait(0))
 	}
 	if p, ok := o.pending[sseq]; ok {
 		p.Timestamp = time.Now().UnixNano()
@@ -3619,6 +3934,76 @@ func (o *consumer) trackPending(sseq, dseq uint64) {
 	}
 }
 
+// trackQueueDelivery records the local queue member, by client id, that
+// received a delivery for a push consumer bound to a deliver group.
+// This allows us to redeliver immediately if that member goes away.
+func (o *consumer) trackQueueDelivery(sseq, cid uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.cfg.DeliverGroup == _EMPTY_ || o.pending == nil {
+		return
+	}
+	if _, ok := o.pending[sseq]; !ok {
+		return
+	}
+	if o.qdm == nil {
+		o.qdm = make(map[uint64]uint64)
+	}
+	o.qdm[sseq] = cid
+}
+
+// queueMemberClosed is called when a local queue member of our deliver group
+// has disconnected. Anything still pending for that member will be queued up
+// for immediate redelivery to the remaining members instead of waiting on AckWait.
+func (o *consumer) queueMemberClosed(cid uint64) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.mset == nil || !o.isLeader() || len(o.qdm) == 0 {
+		return
+	}
+	var seqs []uint64
+	for sseq, qcid := range o.qdm {
+		if qcid != cid {
+			continue
+		}
+		delete(o.qdm, sseq)
+		if _, ok := o.pending[sseq]; ok && !o.onRedeliverQueue(sseq) {
+			seqs = append(seqs, sseq)
+		}
+	}
+	if len(seqs) == 0 {
+		return
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	o.addToRedeliverQueue(seqs...)
+	o.signalNewMessages()
+}
+
+// queueMemberClosed is called when a client with queue subscriptions disconnects.
+// We will look for push consumers whose deliver group matches and let them know.
+func (a *Account) queueMemberClosed(cid uint64, qsubs map[string]*qsub) {
+	for _, mset := range a.streams() {
+		for _, o := range mset.getConsumers() {
+			o.mu.RLock()
+			dsubj, dgroup, hasQDM := o.dsubj, o.cfg.DeliverGroup, len(o.qdm) > 0
+			if dsubj == _EMPTY_ {
+				dsubj = o.cfg.DeliverSubject
+			}
+			o.mu.RUnlock()
+
+			if dgroup == _EMPTY_ || !hasQDM {
+				continue
+			}
+			for _, esub := range qsubs {
+				if string(esub.sub.queue) == dgroup && matchLiteral(dsubj, string(esub.sub.subject)) {
+					o.queueMemberClosed(cid)
+					break
+				}
+			}
+		}
+	}
+}
+
 // didNotDeliver is called when a delivery for a consumer message failed.
 // Depending on our state, we will process the failure.
 func (o *consumer) didNotDeliver(seq uint64) {
@@ -3713,6 +4098,57 @@ func (o *consumer) removeFromRedeliverQueue(seq uint64) bool {
 	return false
 }
 
+// Returns how long after its last delivery a pending message is redelivered,
+// and with a backoff the deadline of the delivery after that.
+// Lock should be held.
+func (o *consumer) redeliveryDeadline(seq uint64) (int64, int64) {
+	if len(o.cfg.BackOff) == 0 {
+		return int64(o.cfg.AckWait), int64(o.cfg.AckWait)
+	}
+	// This is ok even if o.rdc is nil, we would get dc == 0, which is what we want.
+	dc := int(o.rdc[seq])
+	// This will be the index for the next backoff, will set to last element if needed.
+	nbi := dc + 1
+	if dc+1 >= len(o.cfg.BackOff) {
+		dc = len(o.cfg.BackOff) - 1
+		nbi = dc
+	}
+	return int64(o.cfg.BackOff[dc]), int64(o.cfg.BackOff[nbi])
+}
+
+// Arms the timer checking our pending messages for redelivery. Consumers on
+// the shared scheduler are woken up by it instead of having their own timer.
+// Lock should be held.
+func (o *consumer) resetPendingTimer(d time.Duration) {
+	if sd := o.sd; sd != nil {
+		sd.ptt = time.Now().Add(d)
+		sd.ds.wakeAt(sd, sd.ptt)
+		return
+	}
+	if o.ptmr == nil {
+		o.ptmr = time.AfterFunc(d, o.checkPending)
+	} else {
+		o.ptmr.Reset(d)
+	}
+}
+
+// Lock should be held.
+func (o *consumer) stopPendingTimer() {
+	if o.sd != nil {
+		o.sd.ptt = time.Time{}
+		return
+	}
+	stopAndClearTimer(&o.ptmr)
+}
+
+// Lock should be held.
+func (o *consumer) pendingTimerSet() bool {
+	if o.sd != nil {
+		return !o.sd.ptt.IsZero()
+	}
+	return o.ptmr != nil
+}
+
 // Checks the pending messages.
 func (o *consumer) checkPending() {
 	o.mu.Lock()
@@ -3720,7 +4156,7 @@ func (o *consumer) checkPending() {
 
 	mset := o.mset
 	// On stop, mset and timer will be nil.
-	if mset == nil || o.ptmr == nil {
+	if mset == nil || !o.pendingTimerSet() {
 		return
 	}
 
@@ -3744,30 +4180,24 @@ func (o *consumer) checkPending() {
 	check := len(o.pending) > 1024
 	for seq, p := range o.pending {
 		if check && atomic.LoadInt64(&o.awl) > 0 {
-			o.ptmr.Reset(100 * time.Millisecond)
+			o.resetPendingTimer(100 * time.Millisecond)
 			return
 		}
 		// Check if these are no longer valid.
 		if seq < fseq {
 			delete(o.pending, seq)
 			delete(o.rdc, seq)
+			delete(o.qdm, seq)
 			o.removeFromRedeliverQueue(seq)
 			shouldUpdateState = true
 			continue
 		}
 		elapsed, deadline := now-p.Timestamp, ttl
 		if len(o.cfg.BackOff) > 0 {
-			// This is ok even if o.rdc is nil, we would get dc == 0, which is what we want.
-			dc := int(o.rdc[seq])
-			// This will be the index for the next backoff, will set to last element if needed.
-			nbi := dc + 1
-			if dc+1 >= len(o.cfg.BackOff) {
-				dc = len(o.cfg.BackOff) - 1
-				nbi = dc
-			}
-			deadline = int64(o.cfg.BackOff[dc])
+			var nextBackoff int64
+			deadline, nextBackoff = o.redeliveryDeadline(seq)
 			// Set `next` to the next backoff (if smaller than current `next` value).
-			if nextBackoff := int64(o.cfg.BackOff[nbi]); nextBackoff < next {
+			if nextBackoff < next {
 				next = nextBackoff
 			}
 		}
@@ -3797,10 +4227,9 @@ func (o *consumer) checkPending() {
 	}
 
 	if len(o.pending) > 0 {
-		o.ptmr.Reset(o.ackWait(time.Duration(next)))
+		o.resetPendingTimer(o.ackWait(time.Duration(next)))
 	} else {
-		o.ptmr.Stop()
-		o.ptmr = nil
+		o.stopPendingTimer()
 	}
 
 	// Update our state if needed.
@@ -3894,16 +4323,6 @@ type lastSeqSkipList struct {
 	seqs   []uint64
 }
 
-// Will create a skip list for us from a store's subjects state.
-func createLastSeqSkipList(mss map[string]SimpleState) []uint64 {
-	seqs := make([]uint64, 0, len(mss))
-	for _, ss := range mss {
-		seqs = append(seqs, ss.Last)
-	}
-	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
-	return seqs
-}
-
 // Let's us know we have a skip list, which is for deliver last per subject and we are just starting.
 // Lock should be held.
 func (o *consumer) hasSkipListPending() bool {
@@ -3928,10 +4347,10 @@ func (o *consumer) selectStartingSeqNo() {
 					o.sseq = ss.Last
 				}
 			} else if o.cfg.DeliverPolicy == DeliverLastPerSubject {
-				if mss := o.mset.store.SubjectsState(o.cfg.FilterSubject); len(mss) > 0 {
+				if seqs := o.mset.store.LastSeqsPerSubject(o.cfg.FilterSubject); len(seqs) > 0 {
 					o.lss = &lastSeqSkipList{
 						resume: state.LastSeq,
-						seqs:   createLastSeqSkipList(mss),
+						seqs:   seqs,
 					}
 					o.sseq = o.lss.seqs[0]
 				} else {
@@ -4064,7 +4483,7 @@ func (o *consumer) purge(sseq uint64, slseq uint64) {
 			o.adflr = o.dseq - 1
 		}
 	}
-	o.pending = nil
+	o.pending, o.qdm = nil, nil
 
 	// We need to remove all those being queued for redelivery under o.rdq
 	if len(o.rdq) > 0 {
@@ -4093,19 +4512,24 @@ func stopAndClearTimer(tp **time.Timer) {
 
 // Stop will shutdown  the consumer for the associated stream.
 func (o *consumer) stop() error {
-	return o.stopWithFlags(false, false, true, false)
+	return o.stopWithFlags(false, false, true, false, nil)
 }
 
 func (o *consumer) deleteWithoutAdvisory() error {
-	return o.stopWithFlags(true, false, true, false)
+	return o.stopWithFlags(true, false, true, false, nil)
 }
 
 // Delete will delete the consumer for the associated stream and send advisories.
 func (o *consumer) delete() error {
-	return o.stopWithFlags(true, false, true, true)
+	return o.deleteByClient(nil)
+}
+
+// Delete the consumer on behalf of the given client, which is reported in the delete advisory.
+func (o *consumer) deleteByClient(ci *ClientInfo) error {
+	return o.stopWithFlags(true, false, true, true, ci)
 }
 
-func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
+func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool, ci *ClientInfo) error {
 	o.mu.Lock()
 	js := o.js
 
@@ -4122,7 +4546,7 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 			node.StepDown()
 		}
 		if advisory {
-			o.sendDeleteAdvisoryLocked()
+			o.sendDeleteAdvisoryLocked(ci)
 		}
 		if o.isPullMode() {
 			// Release any pending.
@@ -4134,6 +4558,9 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 		close(o.qch)
 		o.qch = nil
 	}
+	if o.sd != nil {
+		o.sd.ds.unregister(o.sd)
+	}
 
 	a := o.acc
 	store := o.store
@@ -4154,7 +4581,7 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 	o.client = nil
 	sysc := o.sysc
 	o.sysc = nil
-	stopAndClearTimer(&o.ptmr)
+	o.stopPendingTimer()
 	stopAndClearTimer(&o.dtmr)
 	stopAndClearTimer(&o.gwdtmr)
 	delivery := o.cfg.DeliverSubject
@@ -4183,6 +4610,9 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 
 	if delivery != _EMPTY_ {
 		a.sl.clearNotification(delivery, qgroup, o.inch)
+		if o.sd != nil {
+			a.sl.setNotificationWake(o.inch, nil)
+		}
 	}
 
 	mset.mu.Lock()
@@ -4216,9 +4646,7 @@ func (o *consumer) stopWithFlags(dflag, sdflag, doSignal, advisory bool) error {
 		}
 		mset.mu.RUnlock()
 
-		for _, seq := range rmseqs {
-			mset.store.RemoveMsg(seq)
-		}
+		mset.store.RemoveMsgs(rmseqs)
 	}
 
 	// Cluster cleanup.
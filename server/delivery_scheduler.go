@@ -0,0 +1,577 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Number of messages a consumer delivers before yielding to others.
+const dsQuantum = 64
+
+// Scheduling states of a consumer.
+const (
+	sdIdle int32 = iota
+	sdQueued
+	sdRunning
+	sdRerun
+)
+
+// deliveryScheduler runs message delivery and ack processing for consumers on
+// a fixed set of workers, instead of each consumer having its own Go routines
+// and timers. Each worker has a run queue, and workers that run out of work
+// steal from the others. A consumer delivers at most dsQuantum messages per
+// run before going to the back of the queue, so busy consumers can not starve
+// the others.
+type deliveryScheduler struct {
+	// These are here first because of atomics on 32bit systems.
+	runs   uint64
+	yields uint64
+	steals uint64
+	wakes  uint64
+
+	workers []*dsWorker
+	rr      uint32
+
+	// Wake ups for heartbeats, pull request expiration, redeliveries
+	// and delayed deliveries.
+	tmu sync.Mutex
+	th  dsTimerHeap
+	tmr *time.Timer
+
+	// Consumers currently delivered by the scheduler.
+	imu     sync.Mutex
+	watched map[*schedDelivery]struct{}
+
+	quit chan struct{}
+	wg   sync.WaitGroup
+}
+
+// DeliverySchedulerStats are the statistics of the shared delivery scheduler.
+type DeliverySchedulerStats struct {
+	Workers   int    `json:"workers"`
+	Consumers int    `json:"consumers"`
+	Runs      uint64 `json:"runs"`
+	Yields    uint64 `json:"yields"`
+	Steals    uint64 `json:"steals"`
+	Wakes     uint64 `json:"wakes"`
+	Queued    int    `json:"queued"`
+}
+
+type dsWorker struct {
+	mu   sync.Mutex
+	q    []*schedDelivery
+	sig  chan struct{}
+	busy int32
+}
+
+// schedDelivery is the state of a consumer delivered by the scheduler.
+// Fields other than state and w are protected by the consumer's lock.
+type schedDelivery struct {
+	state int32
+	w     uint32
+	ds    *deliveryScheduler
+	o     *consumer
+	qch   chan struct{}
+	inch  chan bool
+	lts   int64
+	lseq  uint64
+	hbd   time.Duration
+	hbt   time.Time
+	rp    RetentionPolicy
+	ith   bool
+	pend  *pendingDelivery
+	ptt   time.Time // When to check pending messages for redelivery.
+	wake  time.Time // Protected by the scheduler's timer lock.
+	// Serializes readers of the interest channel so changes apply in order.
+	imu sync.Mutex
+}
+
+// A message held back by replay timing or a rate limit.
+type pendingDelivery struct {
+	pmsg     *jsPubMsg
+	dc       uint64
+	dsubj    string
+	ackReply string
+	at       time.Time
+}
+
+func newDeliveryScheduler(n int) *deliveryScheduler {
+	ds := &deliveryScheduler{
+		workers: make([]*dsWorker, n),
+		watched: make(map[*schedDelivery]struct{}),
+		quit:    make(chan struct{}),
+	}
+	for i := range ds.workers {
+		ds.workers[i] = &dsWorker{sig: make(chan struct{}, 1)}
+	}
+	for i := range ds.workers {
+		ds.wg.Add(1)
+		go ds.work(i)
+	}
+	return ds
+}
+
+func (ds *deliveryScheduler) stop() {
+	if ds == nil {
+		return
+	}
+	close(ds.quit)
+	ds.tmu.Lock()
+	if ds.tmr != nil {
+		ds.tmr.Stop()
+	}
+	ds.tmu.Unlock()
+	ds.wg.Wait()
+}
+
+func (ds *deliveryScheduler) stats() *DeliverySchedulerStats {
+	if ds == nil {
+		return nil
+	}
+	st := &DeliverySchedulerStats{
+		Workers: len(ds.workers),
+		Runs:    atomic.LoadUint64(&ds.runs),
+		Yields:  atomic.LoadUint64(&ds.yields),
+		Steals:  atomic.LoadUint64(&ds.steals),
+		Wakes:   atomic.LoadUint64(&ds.wakes),
+	}
+	for _, w := range ds.workers {
+		w.mu.Lock()
+		st.Queued += len(w.q)
+		w.mu.Unlock()
+	}
+	ds.imu.Lock()
+	st.Consumers = len(ds.watched)
+	ds.imu.Unlock()
+	return st
+}
+
+// Will make sure the consumer runs soon. If it is running it will run again.
+func (ds *deliveryScheduler) schedule(sd *schedDelivery) {
+	for {
+		switch atomic.LoadInt32(&sd.state) {
+		case sdIdle:
+			if atomic.CompareAndSwapInt32(&sd.state, sdIdle, sdQueued) {
+				ds.push(sd)
+				return
+			}
+		case sdRunning:
+			if atomic.CompareAndSwapInt32(&sd.state, sdRunning, sdRerun) {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func (ds *deliveryScheduler) push(sd *schedDelivery) {
+	w := ds.workers[atomic.LoadUint32(&sd.w)]
+	w.mu.Lock()
+	w.q = append(w.q, sd)
+	w.mu.Unlock()
+	w.signal()
+
+	// If that worker is busy let an idle one steal it.
+	if atomic.LoadInt32(&w.busy) == 1 {
+		for _, ow := range ds.workers {
+			if ow != w && atomic.LoadInt32(&ow.busy) == 0 {
+				ow.signal()
+				break
+			}
+		}
+	}
+}
+
+func (w *dsWorker) signal() {
+	select {
+	case w.sig <- struct{}{}:
+	default:
+	}
+}
+
+func (w *dsWorker) pop() *schedDelivery {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.q) == 0 {
+		return nil
+	}
+	sd := w.q[0]
+	w.q[0] = nil
+	if w.q = w.q[1:]; len(w.q) == 0 {
+		w.q = nil
+	}
+	return sd
+}
+
+// Will take work from the back of another worker's queue.
+func (ds *deliveryScheduler) steal(i int) *schedDelivery {
+	for j := 1; j < len(ds.workers); j++ {
+		w := ds.workers[(i+j)%len(ds.workers)]
+		w.mu.Lock()
+		if n := len(w.q); n > 0 {
+			sd := w.q[n-1]
+			w.q[n-1] = nil
+			w.q = w.q[:n-1]
+			w.mu.Unlock()
+			// Keep running on the worker that took it.
+			atomic.StoreUint32(&sd.w, uint32(i))
+			atomic.AddUint64(&ds.steals, 1)
+			return sd
+		}
+		w.mu.Unlock()
+	}
+	return nil
+}
+
+func (ds *deliveryScheduler) work(i int) {
+	defer ds.wg.Done()
+	w := ds.workers[i]
+	atomic.StoreInt32(&w.busy, 1)
+	for {
+		sd := w.pop()
+		if sd == nil {
+			sd = ds.steal(i)
+		}
+		if sd == nil {
+			atomic.StoreInt32(&w.busy, 0)
+			select {
+			case <-w.sig:
+			case <-ds.quit:
+				return
+			}
+			atomic.StoreInt32(&w.busy, 1)
+			continue
+		}
+		ds.run(sd)
+	}
+}
+
+func (ds *deliveryScheduler) run(sd *schedDelivery) {
+	atomic.AddUint64(&ds.runs, 1)
+	atomic.StoreInt32(&sd.state, sdRunning)
+	if more := sd.o.runScheduled(sd); more {
+		// Go to the back of the line to be fair to the others.
+		atomic.AddUint64(&ds.yields, 1)
+		atomic.StoreInt32(&sd.state, sdQueued)
+		ds.push(sd)
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&sd.state, sdRunning, sdIdle) {
+		// We were signaled while running.
+		atomic.StoreInt32(&sd.state, sdQueued)
+		ds.push(sd)
+	}
+}
+
+// Assigns a worker to a consumer that is starting up.
+func (ds *deliveryScheduler) assign(sd *schedDelivery) {
+	n := atomic.AddUint32(&ds.rr, 1)
+	atomic.StoreUint32(&sd.w, n%uint32(len(ds.workers)))
+}
+
+// Register a consumer with the scheduler. Interest changes of push consumers
+// schedule them through the wake up set on their notification channel.
+func (ds *deliveryScheduler) register(sd *schedDelivery) {
+	ds.imu.Lock()
+	ds.watched[sd] = struct{}{}
+	ds.imu.Unlock()
+}
+
+func (ds *deliveryScheduler) unregister(sd *schedDelivery) {
+	ds.imu.Lock()
+	delete(ds.watched, sd)
+	ds.imu.Unlock()
+}
+
+// Will schedule the consumer at the given time, unless it already
+// has an earlier wake up pending.
+func (ds *deliveryScheduler) wakeAt(sd *schedDelivery, t time.Time) {
+	ds.tmu.Lock()
+	defer ds.tmu.Unlock()
+	if !sd.wake.IsZero() && !sd.wake.After(t) {
+		return
+	}
+	sd.wake = t
+	heap.Push(&ds.th, &dsTimer{when: t, sd: sd})
+	if ds.th[0].sd == sd && ds.th[0].when.Equal(t) {
+		ds.resetTimerLocked()
+	}
+}
+
+// Lock should be held.
+func (ds *deliveryScheduler) resetTimerLocked() {
+	if len(ds.th) == 0 {
+		return
+	}
+	d := time.Until(ds.th[0].when)
+	if ds.tmr == nil {
+		ds.tmr = time.AfterFunc(d, ds.fireTimers)
+	} else {
+		ds.tmr.Reset(d)
+	}
+}
+
+func (ds *deliveryScheduler) fireTimers() {
+	select {
+	case <-ds.quit:
+		return
+	default:
+	}
+	var due []*schedDelivery
+	now := time.Now()
+	ds.tmu.Lock()
+	for len(ds.th) > 0 && !ds.th[0].when.After(now) {
+		t := heap.Pop(&ds.th).(*dsTimer)
+		// Skip wake ups that were replaced by an earlier one.
+		if t.sd.wake.Equal(t.when) {
+			t.sd.wake = time.Time{}
+			due = append(due, t.sd)
+		}
+	}
+	ds.resetTimerLocked()
+	ds.tmu.Unlock()
+
+	for _, sd := range due {
+		atomic.AddUint64(&ds.wakes, 1)
+		ds.schedule(sd)
+	}
+}
+
+type dsTimer struct {
+	when time.Time
+	sd   *schedDelivery
+}
+
+type dsTimerHeap []*dsTimer
+
+func (h dsTimerHeap) Len() int            { return len(h) }
+func (h dsTimerHeap) Less(i, j int) bool  { return h[i].when.Before(h[j].when) }
+func (h dsTimerHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *dsTimerHeap) Push(x interface{}) { *h = append(*h, x.(*dsTimer)) }
+func (h *dsTimerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return t
+}
+
+// Will start delivering on the shared scheduler for a new leadership term.
+func (o *consumer) startScheduled(qch chan struct{}) {
+	o.mu.RLock()
+	mset, replay := o.mset, o.replay
+	o.mu.RUnlock()
+	// consumer is closed when mset is set to nil.
+	if mset == nil {
+		return
+	}
+	var lseq uint64
+	if replay {
+		lseq = mset.state().LastSeq
+	}
+	mset.mu.RLock()
+	rp := mset.cfg.Retention
+	mset.mu.RUnlock()
+
+	o.mu.Lock()
+	if o.mset == nil {
+		o.mu.Unlock()
+		return
+	}
+	sd := o.sd
+	sd.qch, sd.inch, sd.lts, sd.lseq, sd.rp = qch, o.inch, 0, lseq, rp
+	sd.ith = o.cfg.InactiveThreshold > 0
+	if sd.pend != nil {
+		sd.pend.pmsg.returnToPool()
+		sd.pend = nil
+	}
+	var hbt time.Time
+	if sd.hbd = o.cfg.Heartbeat; sd.hbd > 0 {
+		hbt = time.Now().Add(sd.hbd)
+		sd.hbt = hbt
+	}
+	o.mu.Unlock()
+
+	ds := sd.ds
+	ds.assign(sd)
+	ds.register(sd)
+	if !hbt.IsZero() {
+		ds.wakeAt(sd, hbt)
+	}
+	ds.schedule(sd)
+}
+
+// Applies any interest changes posted by the sublist.
+func (o *consumer) applyInterestChanges(sd *schedDelivery, inch chan bool) {
+	if inch == nil {
+		return
+	}
+	sd.imu.Lock()
+	for len(inch) > 0 {
+		o.updateDeliveryInterest(<-inch)
+	}
+	sd.imu.Unlock()
+}
+
+// Runs the consumer on the shared scheduler. Processes any queued acks and
+// interest changes, and delivers up to dsQuantum messages.
+// Returns true if we yielded with more messages to deliver.
+func (o *consumer) runScheduled(sd *schedDelivery) bool {
+	o.mu.RLock()
+	qch, inch, ith := sd.qch, sd.inch, sd.ith
+	closed := o.mset == nil || o.qch == nil || o.qch != qch
+	o.mu.RUnlock()
+	if closed {
+		return false
+	}
+
+	o.processQueuedAcks(ith)
+
+	o.checkScheduledPending(sd)
+
+	o.applyInterestChanges(sd, inch)
+
+	o.mu.Lock()
+	// Check that we were not stopped while processing the above.
+	if o.mset == nil || o.qch != qch {
+		o.mu.Unlock()
+		return false
+	}
+
+	// Deliver any message we held back first.
+	if pd := sd.pend; pd != nil {
+		if time.Now().Before(pd.at) {
+			o.mu.Unlock()
+			sd.ds.wakeAt(sd, pd.at)
+			return false
+		}
+		sd.pend = nil
+		o.deliverMsg(pd.dsubj, pd.ackReply, pd.pmsg, pd.dc, sd.rp)
+		sd.resetHeartbeat()
+	}
+
+	for n := 0; n < dsQuantum; n++ {
+		pmsg, dc, dsubj, ackReply, sz, err := o.nextDelivery()
+		if pmsg == nil {
+			return o.waitScheduled(sd, err)
+		}
+
+		// Check if we need to hold this one back because of replay timing or a rate limit.
+		var delay time.Duration
+		if o.replay && sd.lts > 0 {
+			if d := time.Duration(pmsg.ts - sd.lts); d > time.Millisecond {
+				delay = d
+			}
+		}
+		sd.lts = pmsg.ts
+		if o.rlimit != nil {
+			now := time.Now()
+			r := o.rlimit.ReserveN(now, sz)
+			if d := r.DelayFrom(now); d > delay {
+				delay = d
+			}
+		}
+		if delay > 0 {
+			at := time.Now().Add(delay)
+			sd.pend = &pendingDelivery{pmsg: pmsg, dc: dc, dsubj: dsubj, ackReply: ackReply, at: at}
+			o.mu.Unlock()
+			sd.ds.wakeAt(sd, at)
+			return false
+		}
+
+		// Do actual delivery.
+		o.deliverMsg(dsubj, ackReply, pmsg, dc, sd.rp)
+		sd.resetHeartbeat()
+	}
+	o.mu.Unlock()
+	return true
+}
+
+// Called when we have nothing to deliver. Will expire pull requests, send
+// idle heartbeats and arrange to be woken up for the next of those.
+// Lock should be held and will be released.
+func (o *consumer) waitScheduled(sd *schedDelivery, err error) bool {
+	// If we were in a replay state check to see if we are caught up. If so clear.
+	if o.replay && o.sseq > sd.lseq {
+		o.replay = false
+	}
+
+	var wake time.Time
+	now := time.Now()
+	if o.isPullMode() {
+		// Dont expire oneshots if we are here because of max ack pending limit.
+		if _, _, _, fexp := o.processWaiting(err != errMaxAckPending); !fexp.IsZero() {
+			wake = fexp
+		}
+	}
+	if sd.hbd > 0 {
+		if !now.Before(sd.hbt) {
+			if o.active && o.mset != nil {
+				o.sendIdleHeartbeat(o.cfg.DeliverSubject)
+			}
+			sd.hbt = now.Add(sd.hbd)
+		}
+		if wake.IsZero() || sd.hbt.Before(wake) {
+			wake = sd.hbt
+		}
+	}
+	o.mu.Unlock()
+
+	if !wake.IsZero() {
+		if min := now.Add(time.Millisecond); wake.Before(min) {
+			wake = min
+		}
+		sd.ds.wakeAt(sd, wake)
+	}
+	return false
+}
+
+// Checks our pending messages for redelivery if due, otherwise makes
+// sure we are woken up for it.
+func (o *consumer) checkScheduledPending(sd *schedDelivery) {
+	o.mu.RLock()
+	ptt := sd.ptt
+	o.mu.RUnlock()
+	if ptt.IsZero() {
+		return
+	}
+	if time.Now().Before(ptt) {
+		sd.ds.wakeAt(sd, ptt)
+		return
+	}
+	o.checkPending()
+}
+
+// Consumer lock should be held.
+func (sd *schedDelivery) resetHeartbeat() {
+	if sd.hbd > 0 {
+		sd.hbt = time.Now().Add(sd.hbd)
+	}
+}
+
+// DeliverySchedulerStats returns the statistics of the shared delivery
+// scheduler, or nil if consumers use their own Go routines.
+func (s *Server) DeliverySchedulerStats() *DeliverySchedulerStats {
+	js := s.getJetStream()
+	if js == nil {
+		return nil
+	}
+	return js.dsched.stats()
+}
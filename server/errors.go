@@ -56,6 +56,13 @@ var (
 	// server has been reached.
 	ErrTooManyConnections = errors.New("maximum connections exceeded")
 
+	// ErrTooManyConnectionsFromAddr signals a client that the maximum number of connections
+	// allowed from its IP address or CIDR block has been reached.
+	ErrTooManyConnectionsFromAddr = errors.New("maximum connections from address exceeded")
+
+	// ErrConnectionAddrNotAllowed signals a client that connections from its address are not allowed.
+	ErrConnectionAddrNotAllowed = errors.New("connections from address not allowed")
+
 	// ErrTooManyAccountConnections signals that an account has reached its maximum number of active
 	// connections.
 	ErrTooManyAccountConnections = errors.New("maximum account active connections exceeded")
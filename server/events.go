@@ -22,6 +22,7 @@ import (
 	"fmt"
 	"math/rand"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -43,6 +44,7 @@ const (
 
 	connectEventSubj    = "$SYS.ACCOUNT.%s.CONNECT"
 	disconnectEventSubj = "$SYS.ACCOUNT.%s.DISCONNECT"
+	permViolationSubj   = "$SYS.ACCOUNT.%s.PERMISSION.VIOLATION"
 	accDirectReqSubj    = "$SYS.REQ.ACCOUNT.%s.%s"
 	accPingReqSubj      = "$SYS.REQ.ACCOUNT.PING.%s" // atm. only used for STATZ and CONNZ import from system account
 	// kept for backward compatibility when using http resolver
@@ -57,8 +59,11 @@ const (
 	serverStatsSubj          = "$SYS.SERVER.%s.STATSZ"
 	serverDirectReqSubj      = "$SYS.REQ.SERVER.%s.%s"
 	serverPingReqSubj        = "$SYS.REQ.SERVER.PING.%s"
-	serverStatsPingReqSubj   = "$SYS.REQ.SERVER.PING"             // use $SYS.REQ.SERVER.PING.STATSZ instead
-	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT" // for internal use only
+	serverStatsPingReqSubj   = "$SYS.REQ.SERVER.PING" // use $SYS.REQ.SERVER.PING.STATSZ instead
+	serverStatsAggReqSubj    = "$SYS.REQ.SERVER.AGGREGATE.STATSZ"
+	leafNodeConnectEventSubj = "$SYS.ACCOUNT.%s.LEAFNODE.CONNECT"
+	leafNodeDisconnectSubj   = "$SYS.ACCOUNT.%s.LEAFNODE.DISCONNECT"
+	leafNodeConnErrEventSubj = "$SYS.SERVER.%s.LEAFNODE.CONNECT.ERR"
 	remoteLatencyEventSubj   = "$SYS.LATENCY.M2.%s"
 	inboxRespSubj            = "$SYS._INBOX.%s.%s"
 
@@ -82,6 +87,30 @@ const (
 // FIXME(dlc) - make configurable.
 var eventsHBInterval = 30 * time.Second
 
+// Default time we wait for all servers to respond to an aggregated statsz request.
+const defaultStatszAggregateTimeout = time.Second
+
+// Returns the statsz interval to use for the configured value.
+func statszInterval(d time.Duration) time.Duration {
+	if d <= 0 {
+		return eventsHBInterval
+	}
+	return d
+}
+
+// validateStatszOptions checks the statsz configuration.
+func validateStatszOptions(o *Options) error {
+	if o.Statsz.Interval < 0 {
+		return fmt.Errorf("statsz interval cannot be negative")
+	}
+	// Other servers consider us gone if they do not hear from us, so do not
+	// allow an interval that would get us removed from their view.
+	if max := 2 * eventsHBInterval; o.Statsz.Interval > max {
+		return fmt.Errorf("statsz interval (%v) cannot be higher than %v", o.Statsz.Interval, max)
+	}
+	return nil
+}
+
 // Used to send and receive messages from inside the server.
 type internal struct {
 	account  *Account
@@ -134,6 +163,75 @@ type DisconnectEventMsg struct {
 // DisconnectEventMsgType is the schema type for DisconnectEventMsg
 const DisconnectEventMsgType = "io.nats.server.advisory.v1.client_disconnect"
 
+// LeafNodeConnectEventMsg is sent when a leafnode connection, accepted or
+// solicited, is established.
+type LeafNodeConnectEventMsg struct {
+	TypedEvent
+	Server ServerInfo   `json:"server"`
+	Leaf   LeafNodeInfo `json:"leafnode"`
+	// Account is the same as Leaf.Account, kept at the top level for
+	// servers that only know of the older connect message.
+	Account string `json:"acc"`
+}
+
+// LeafNodeConnectEventMsgType is the schema type for LeafNodeConnectEventMsg
+const LeafNodeConnectEventMsgType = "io.nats.server.advisory.v1.leafnode_connect"
+
+// LeafNodeDisconnectEventMsg is sent when a leafnode connection is closed.
+// Connections that failed before being established, for instance because of
+// authentication or TLS errors, are reported on a server subject instead,
+// since they may not be bound to an account.
+type LeafNodeDisconnectEventMsg struct {
+	TypedEvent
+	Server   ServerInfo   `json:"server"`
+	Leaf     LeafNodeInfo `json:"leafnode"`
+	Sent     DataStats    `json:"sent"`
+	Received DataStats    `json:"received"`
+	Reason   string       `json:"reason"`
+}
+
+// LeafNodeDisconnectEventMsgType is the schema type for LeafNodeDisconnectEventMsg
+const LeafNodeDisconnectEventMsgType = "io.nats.server.advisory.v1.leafnode_disconnect"
+
+// LeafNodeInfo describes a leafnode connection in leafnode events.
+type LeafNodeInfo struct {
+	Start         *time.Time    `json:"start,omitempty"`
+	Stop          *time.Time    `json:"stop,omitempty"`
+	Host          string        `json:"host,omitempty"`
+	Port          int           `json:"port,omitempty"`
+	ID            uint64        `json:"id,omitempty"`
+	Name          string        `json:"name,omitempty"`
+	Cluster       string        `json:"cluster,omitempty"`
+	Domain        string        `json:"domain,omitempty"`
+	Account       string        `json:"acc"`
+	RemoteAccount string        `json:"remote_acc,omitempty"`
+	Solicited     bool          `json:"solicited,omitempty"`
+	RTT           time.Duration `json:"rtt,omitempty"`
+}
+
+// PermissionViolationEventMsg is sent when a client violates its publish or
+// subscribe permissions. Events are rate limited per client, subject and kind,
+// so Count holds the number of violations since the last event was sent.
+type PermissionViolationEventMsg struct {
+	TypedEvent
+	Server  ServerInfo `json:"server"`
+	Client  ClientInfo `json:"client"`
+	Kind    string     `json:"kind"`
+	Subject string     `json:"subject"`
+	Queue   string     `json:"queue,omitempty"`
+	Count   uint64     `json:"count"`
+}
+
+// PermissionViolationEventMsgType is the schema type for PermissionViolationEventMsg
+const PermissionViolationEventMsgType = "io.nats.server.advisory.v1.permission_violation"
+
+// Kinds of permission violations.
+const (
+	PermViolationPublish   = "publish"
+	PermViolationSubscribe = "subscribe"
+	PermViolationReply     = "reply"
+)
+
 // AccountNumConns is an event that will be sent from a server that is tracking
 // a given account when the number of connections changes. It will also HB
 // updates in the absence of any changes.
@@ -152,6 +250,16 @@ type AccountStat struct {
 	Sent          DataStats `json:"sent"`
 	Received      DataStats `json:"received"`
 	SlowConsumers int64     `json:"slow_consumers"`
+	// JetStream usage of the account on this server, if enabled.
+	JetStream *AccountJetStreamStat `json:"jetstream,omitempty"`
+}
+
+// AccountJetStreamStat is the JetStream usage of an account on a server.
+type AccountJetStreamStat struct {
+	Memory    uint64 `json:"memory"`
+	Store     uint64 `json:"storage"`
+	Streams   int    `json:"streams"`
+	Consumers int    `json:"consumers"`
 }
 
 const AccountNumConnsMsgType = "io.nats.server.advisory.v1.account_connections"
@@ -217,17 +325,28 @@ type ServerStats struct {
 	SlowConsumers    int64          `json:"slow_consumers"`
 	Routes           []*RouteStat   `json:"routes,omitempty"`
 	Gateways         []*GatewayStat `json:"gateways,omitempty"`
+	Leafnodes        int            `json:"leafnodes,omitempty"`
 	ActiveServers    int            `json:"active_servers,omitempty"`
 	JetStream        *JetStreamVarz `json:"jetstream,omitempty"`
+	JetStreamStorage *JSStorageStat `json:"jetstream_storage,omitempty"`
 }
 
 // RouteStat holds route statistics.
 type RouteStat struct {
-	ID       uint64    `json:"rid"`
-	Name     string    `json:"name,omitempty"`
-	Sent     DataStats `json:"sent"`
-	Received DataStats `json:"received"`
-	Pending  int       `json:"pending"`
+	ID       uint64        `json:"rid"`
+	Name     string        `json:"name,omitempty"`
+	Sent     DataStats     `json:"sent"`
+	Received DataStats     `json:"received"`
+	Pending  int           `json:"pending"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+}
+
+// JSStorageStat holds the totals of the JetStream assets stored on a server.
+type JSStorageStat struct {
+	Streams   int    `json:"streams"`
+	Consumers int    `json:"consumers"`
+	Messages  uint64 `json:"messages"`
+	Bytes     uint64 `json:"bytes"`
 }
 
 // GatewayStat holds gateway statistics.
@@ -608,7 +727,7 @@ func (s *Server) updateServerUsage(v *ServerStats) {
 }
 
 // Generate a route stat for our statz update.
-func routeStat(r *client) *RouteStat {
+func routeStat(r *client, rtt bool) *RouteStat {
 	if r == nil {
 		return nil
 	}
@@ -628,6 +747,9 @@ func routeStat(r *client) *RouteStat {
 	if r.route != nil {
 		rs.Name = r.route.remoteName
 	}
+	if rtt {
+		rs.RTT = r.rtt
+	}
 	r.mu.Unlock()
 	return rs
 }
@@ -635,6 +757,14 @@ func routeStat(r *client) *RouteStat {
 // Actual send method for statz updates.
 // Lock should be held.
 func (s *Server) sendStatsz(subj string) {
+	m := s.statszMsg()
+	// Send message.
+	s.sendInternalMsg(subj, _EMPTY_, &m.Server, m)
+}
+
+// Collects our current statsz. The server info is filled in when sent.
+// Lock should be held, it is released while collecting JetStream stats.
+func (s *Server) statszMsg() *ServerStatsMsg {
 	var m ServerStatsMsg
 	s.updateServerUsage(&m.Stats)
 	m.Stats.Start = s.start
@@ -647,9 +777,10 @@ func (s *Server) sendStatsz(subj string) {
 	m.Stats.Sent.Bytes = atomic.LoadInt64(&s.outBytes)
 	m.Stats.SlowConsumers = atomic.LoadInt64(&s.slowConsumers)
 	m.Stats.NumSubs = s.numSubscriptions()
+	sopts := s.getOpts().Statsz
 	// Routes
 	for _, r := range s.routes {
-		m.Stats.Routes = append(m.Stats.Routes, routeStat(r))
+		m.Stats.Routes = append(m.Stats.Routes, routeStat(r, sopts.RouteRTT))
 	}
 	// Gateways
 	if s.gateway.enabled {
@@ -679,6 +810,10 @@ func (s *Server) sendStatsz(subj string) {
 		}
 		gw.RUnlock()
 	}
+	// Leafnodes
+	if sopts.Leafnodes {
+		m.Stats.Leafnodes = len(s.leafs)
+	}
 	// Active Servers
 	m.Stats.ActiveServers = 1
 	if s.sys != nil {
@@ -729,10 +864,12 @@ func (s *Server) sendStatsz(subj string) {
 			}
 		}
 		m.Stats.JetStream = jStat
+		if sopts.JetStreamStorage {
+			m.Stats.JetStreamStorage = js.storageStats()
+		}
 		s.mu.Lock()
 	}
-	// Send message.
-	s.sendInternalMsg(subj, _EMPTY_, &m.Server, &m)
+	return &m
 }
 
 // Send out our statz update.
@@ -761,6 +898,9 @@ func (s *Server) sendStatszUpdate() {
 func (s *Server) startStatszTimer() {
 	// We will start by sending out more of these and trail off to the statsz being the max.
 	s.sys.cstatsz = 250 * time.Millisecond
+	if s.sys.cstatsz > s.sys.statsz {
+		s.sys.cstatsz = s.sys.statsz
+	}
 	// Send out the first one quickly, we will slowly back off.
 	s.sys.stmr = time.AfterFunc(s.sys.cstatsz, s.wrapChk(s.heartbeatStatsz))
 }
@@ -880,6 +1020,10 @@ func (s *Server) initEventTracking() {
 	if _, err := s.sysSubscribe(serverStatsPingReqSubj, s.statszReq); err != nil {
 		s.Errorf("Error setting up internal tracking: %v", err)
 	}
+	// Listen for aggregated statsz requests. Only one server needs to answer those.
+	if _, err := s.sysSubscribeQ(serverStatsAggReqSubj, "responder", s.statszAggregateReq); err != nil {
+		s.Errorf("Error setting up internal tracking: %v", err)
+	}
 	monSrvc := map[string]msgHandler{
 		"STATSZ": s.statszReq,
 		"VARZ": func(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
@@ -929,6 +1073,24 @@ func (s *Server) initEventTracking() {
 			s.Errorf("Error setting up internal tracking: %v", err)
 		}
 	}
+	// Store checks and corruption drills run against a single stream of this
+	// server, so they are only available as direct requests.
+	storeSrvc := map[string]msgHandler{
+		"STORE_CHECK": func(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+			optz := &StoreCheckEventOptions{}
+			s.zReq(c, reply, msg, &optz.EventFilterOptions, optz, func() (interface{}, error) { return s.StoreCheck(&optz.StoreCheckOptions) })
+		},
+		"STORE_DRILL": func(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+			optz := &CorruptionDrillEventOptions{}
+			s.zReq(c, reply, msg, &optz.EventFilterOptions, optz, func() (interface{}, error) { return s.CorruptionDrill(&optz.CorruptionDrillOptions) })
+		},
+	}
+	for name, req := range storeSrvc {
+		subject = fmt.Sprintf(serverDirectReqSubj, s.info.ID, name)
+		if _, err := s.sysSubscribe(subject, req); err != nil {
+			s.Errorf("Error setting up internal tracking: %v", err)
+		}
+	}
 	extractAccount := func(c *client, subject string, msg []byte) (string, error) {
 		if tk := strings.Split(subject, tsep); len(tk) != accReqTokens {
 			return _EMPTY_, fmt.Errorf("subject %q is malformed", subject)
@@ -1380,8 +1542,9 @@ func (s *Server) connsRequest(sub *subscription, c *client, _ *Account, subject,
 	}
 	// We know this is a local connection.
 	if nlc := acc.NumLocalConnections(); nlc > 0 {
+		jss := acc.jetStreamStat()
 		s.mu.Lock()
-		s.sendAccConnsUpdate(acc, reply)
+		s.sendAccConnsUpdate(acc, jss, reply)
 		s.mu.Unlock()
 	}
 }
@@ -1422,6 +1585,35 @@ type StatszEventOptions struct {
 	EventFilterOptions
 }
 
+// StatszAggregateOptions are options passed to an aggregated statsz request.
+type StatszAggregateOptions struct {
+	// Timeout is how long to wait for servers to respond.
+	Timeout time.Duration `json:"timeout,omitempty"`
+	EventFilterOptions
+}
+
+// ServerStatszAggregate is the response to an aggregated statsz request.
+type ServerStatszAggregate struct {
+	Servers  []*ServerStatsMsg  `json:"servers"`
+	Totals   ServerStatszTotals `json:"totals"`
+	Expected int                `json:"expected,omitempty"`
+	Time     time.Time          `json:"now"`
+}
+
+// ServerStatszTotals holds the sum of the stats of all servers that responded.
+type ServerStatszTotals struct {
+	Servers          int       `json:"servers"`
+	Connections      int       `json:"connections"`
+	TotalConnections uint64    `json:"total_connections"`
+	NumSubs          uint32    `json:"subscriptions"`
+	Sent             DataStats `json:"sent"`
+	Received         DataStats `json:"received"`
+	SlowConsumers    int64     `json:"slow_consumers"`
+	Leafnodes        int       `json:"leafnodes,omitempty"`
+	JetStreamMemory  uint64    `json:"jetstream_memory,omitempty"`
+	JetStreamStore   uint64    `json:"jetstream_storage,omitempty"`
+}
+
 // Options for account Info
 type AccInfoEventOptions struct {
 	// No actual options yet
@@ -1488,6 +1680,18 @@ type HealthzEventOptions struct {
 	EventFilterOptions
 }
 
+// In the context of system events, StoreCheckEventOptions are options passed to StoreCheck
+type StoreCheckEventOptions struct {
+	StoreCheckOptions
+	EventFilterOptions
+}
+
+// In the context of system events, CorruptionDrillEventOptions are options passed to CorruptionDrill
+type CorruptionDrillEventOptions struct {
+	CorruptionDrillOptions
+	EventFilterOptions
+}
+
 // returns true if the request does NOT apply to this server and can be ignored.
 // DO NOT hold the server lock when
 func (s *Server) filterRequest(fOpts *EventFilterOptions) bool {
@@ -1545,6 +1749,121 @@ type ServerAPIConnzResponse struct {
 	Error  *ApiError   `json:"error,omitempty"`
 }
 
+// statszAggregateReq is a request to collect the statsz of all servers and
+// respond with a single aggregated message.
+func (s *Server) statszAggregateReq(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if !s.EventsEnabled() || reply == _EMPTY_ {
+		return
+	}
+
+	opts := StatszAggregateOptions{}
+	if _, msg := c.msgParts(rmsg); len(msg) != 0 {
+		if err := json.Unmarshal(msg, &opts); err != nil {
+			response := &ServerAPIResponse{
+				Server: &ServerInfo{},
+				Error:  &ApiError{Code: http.StatusBadRequest, Description: err.Error()},
+			}
+			s.sendInternalMsgLocked(reply, _EMPTY_, response.Server, response)
+			return
+		}
+	}
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = defaultStatszAggregateTimeout
+	}
+	// With a filter we can not know how many servers will respond.
+	filtered := opts.EventFilterOptions.Name != _EMPTY_ || opts.EventFilterOptions.Host != _EMPTY_ ||
+		opts.EventFilterOptions.Cluster != _EMPTY_ || len(opts.EventFilterOptions.Tags) > 0 ||
+		opts.EventFilterOptions.Domain != _EMPTY_
+
+	// Check if we should be part of the response ourselves.
+	includeSelf := !s.filterRequest(&opts.EventFilterOptions)
+
+	var mu sync.Mutex
+	agg := &ServerStatszAggregate{}
+	done := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	if s.sys == nil || s.sys.replies == nil {
+		s.mu.Unlock()
+		return
+	}
+	if !filtered {
+		agg.Expected = 1 + len(s.sys.servers)
+	}
+	// Create direct reply inbox that we multiplex under the WC replies.
+	replySubj := s.newRespInbox()
+	s.sys.replies[replySubj] = func(sub *subscription, c *client, _ *Account, subject, _ string, rmsg []byte) {
+		_, msg := c.msgParts(rmsg)
+		var m ServerStatsMsg
+		if err := json.Unmarshal(msg, &m); err != nil || m.Server.ID == _EMPTY_ {
+			return
+		}
+		mu.Lock()
+		agg.Servers = append(agg.Servers, &m)
+		n := len(agg.Servers)
+		mu.Unlock()
+		if agg.Expected > 0 && n >= agg.Expected {
+			select {
+			case done <- struct{}{}:
+			default:
+			}
+		}
+	}
+	// Ping all other servers.
+	request := &StatszEventOptions{EventFilterOptions: opts.EventFilterOptions}
+	s.sendInternalMsg(fmt.Sprintf(serverPingReqSubj, "STATSZ"), replySubj, nil, request)
+	// Add ourselves. We echo this one so that our inbox handler receives it.
+	if includeSelf {
+		m := s.statszMsg()
+		if s.sys != nil && s.sys.sendq != nil {
+			s.sys.sendq.push(newPubMsg(nil, replySubj, _EMPTY_, &m.Server, nil, m, noCompression, true, false))
+		}
+	}
+	s.mu.Unlock()
+
+	go func() {
+		select {
+		case <-done:
+		case <-time.After(timeout):
+		}
+		// Cleanup the WC entry.
+		var sendResponse bool
+		s.mu.Lock()
+		if s.sys != nil && s.sys.replies != nil {
+			delete(s.sys.replies, replySubj)
+			sendResponse = true
+		}
+		s.mu.Unlock()
+		if !sendResponse {
+			return
+		}
+		mu.Lock()
+		sort.Slice(agg.Servers, func(i, j int) bool { return agg.Servers[i].Server.Name < agg.Servers[j].Server.Name })
+		t := &agg.Totals
+		for _, m := range agg.Servers {
+			st := &m.Stats
+			t.Servers++
+			t.Connections += st.Connections
+			t.TotalConnections += st.TotalConnections
+			t.NumSubs += st.NumSubs
+			t.Sent.Msgs += st.Sent.Msgs
+			t.Sent.Bytes += st.Sent.Bytes
+			t.Received.Msgs += st.Received.Msgs
+			t.Received.Bytes += st.Received.Bytes
+			t.SlowConsumers += st.SlowConsumers
+			t.Leafnodes += st.Leafnodes
+			if st.JetStream != nil && st.JetStream.Stats != nil {
+				t.JetStreamMemory += st.JetStream.Stats.Memory
+				t.JetStreamStore += st.JetStream.Stats.Store
+			}
+		}
+		agg.Time = time.Now().UTC()
+		mu.Unlock()
+		s.sendInternalAccountMsg(nil, reply, agg)
+	}()
+}
+
 // statszReq is a request for us to respond with current statsz.
 func (s *Server) statszReq(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	if !s.EventsEnabled() {
@@ -1719,7 +2038,8 @@ func (s *Server) enableAccountTracking(a *Account) {
 	s.sendInternalMsg(subj, reply, &m.Server, &m)
 }
 
-// Event on leaf node connect.
+// Event on leaf node connect. Other servers are told through the connect
+// event sent when the connection was added, see leafNodeConnectEvent.
 // Lock should NOT be held on entry.
 func (s *Server) sendLeafNodeConnect(a *Account) {
 	s.mu.Lock()
@@ -1728,7 +2048,6 @@ func (s *Server) sendLeafNodeConnect(a *Account) {
 		s.mu.Unlock()
 		return
 	}
-	s.sendLeafNodeConnectMsg(a.Name)
 	s.mu.Unlock()
 
 	s.switchAccountToInterestMode(a.Name)
@@ -1743,9 +2062,9 @@ func (s *Server) sendLeafNodeConnectMsg(accName string) {
 }
 
 // sendAccConnsUpdate is called to send out our information on the
-// account's local connections.
+// account's local connections, along with its JetStream usage if any.
 // Lock should be held on entry.
-func (s *Server) sendAccConnsUpdate(a *Account, subj ...string) {
+func (s *Server) sendAccConnsUpdate(a *Account, jss *AccountJetStreamStat, subj ...string) {
 	if !s.eventsEnabled() || a == nil {
 		return
 	}
@@ -1757,6 +2076,7 @@ func (s *Server) sendAccConnsUpdate(a *Account, subj ...string) {
 	eid := s.nextEventID()
 	a.mu.Lock()
 	stat := a.statz()
+	stat.JetStream = jss
 	m := AccountNumConns{
 		TypedEvent: TypedEvent{
 			Type: AccountNumConnsMsgType,
@@ -1805,12 +2125,17 @@ func (a *Account) statz() *AccountStat {
 // accConnsUpdate is called whenever there is a change to the account's
 // number of active connections, or during a heartbeat.
 func (s *Server) accConnsUpdate(a *Account) {
+	if a == nil {
+		return
+	}
+	// Collect JetStream usage before we grab the server lock.
+	jss := a.jetStreamStat()
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if !s.eventsEnabled() || a == nil {
+	if !s.eventsEnabled() {
 		return
 	}
-	s.sendAccConnsUpdate(a, fmt.Sprintf(accConnsEventSubjOld, a.Name), fmt.Sprintf(accConnsEventSubjNew, a.Name))
+	s.sendAccConnsUpdate(a, jss, fmt.Sprintf(accConnsEventSubjOld, a.Name), fmt.Sprintf(accConnsEventSubjNew, a.Name))
 }
 
 // server lock should be held
@@ -1929,6 +2254,103 @@ func (s *Server) accountDisconnectEvent(c *client, now time.Time, reason string)
 	s.sendInternalMsgLocked(subj, _EMPTY_, &m.Server, &m)
 }
 
+// Returns the leafnode information for events.
+// Client lock should be held.
+func (c *client) leafNodeEventInfo() LeafNodeInfo {
+	li := LeafNodeInfo{
+		Start:     &c.start,
+		Host:      c.host,
+		Port:      int(c.port),
+		ID:        c.cid,
+		Solicited: c.isSolicitedLeafNode(),
+		RTT:       c.rtt,
+	}
+	if c.acc != nil {
+		li.Account = c.acc.Name
+	}
+	if c.leaf != nil {
+		li.Name = c.leaf.remoteServer
+		li.Cluster = c.leaf.remoteCluster
+		li.Domain = c.leaf.remoteDomain
+		li.RemoteAccount = c.leaf.remoteAccName
+	}
+	return li
+}
+
+// leafNodeConnectEvent will send a leafnode connect event if there is interest.
+func (s *Server) leafNodeConnectEvent(c *client) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	eid := s.nextEventID()
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	if c.acc == nil {
+		c.mu.Unlock()
+		return
+	}
+	m := LeafNodeConnectEventMsg{
+		TypedEvent: TypedEvent{
+			Type: LeafNodeConnectEventMsgType,
+			ID:   eid,
+			Time: time.Now().UTC(),
+		},
+		Leaf: c.leafNodeEventInfo(),
+	}
+	m.Account = m.Leaf.Account
+	c.mu.Unlock()
+
+	subj := fmt.Sprintf(leafNodeConnectEventSubj, m.Account)
+	s.sendInternalMsgLocked(subj, _EMPTY_, &m.Server, &m)
+}
+
+// leafNodeDisconnectEvent will send a leafnode disconnect event if there is interest.
+func (s *Server) leafNodeDisconnectEvent(c *client, now time.Time, reason string) {
+	s.mu.Lock()
+	if !s.eventsEnabled() {
+		s.mu.Unlock()
+		return
+	}
+	eid := s.nextEventID()
+	sid := s.info.ID
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	// A connection that failed before being established may not be bound
+	// to an account, so report it on the server subject.
+	established := c.acc != nil && c.leaf != nil && c.leaf.established
+	m := LeafNodeDisconnectEventMsg{
+		TypedEvent: TypedEvent{
+			Type: LeafNodeDisconnectEventMsgType,
+			ID:   eid,
+			Time: now,
+		},
+		Leaf: c.leafNodeEventInfo(),
+		Sent: DataStats{
+			Msgs:  atomic.LoadInt64(&c.inMsgs),
+			Bytes: atomic.LoadInt64(&c.inBytes),
+		},
+		Received: DataStats{
+			Msgs:  c.outMsgs,
+			Bytes: c.outBytes,
+		},
+		Reason: reason,
+	}
+	m.Leaf.Stop = &now
+	c.mu.Unlock()
+
+	var subj string
+	if established {
+		subj = fmt.Sprintf(leafNodeDisconnectSubj, m.Leaf.Account)
+	} else {
+		subj = fmt.Sprintf(leafNodeConnErrEventSubj, sid)
+	}
+	s.sendInternalMsgLocked(subj, _EMPTY_, &m.Server, &m)
+}
+
 func (s *Server) sendAuthErrorEvent(c *client) {
 	s.mu.Lock()
 	if !s.eventsEnabled() {
@@ -1983,6 +2405,180 @@ func (s *Server) sendAuthErrorEvent(c *client) {
 	s.mu.Unlock()
 }
 
+const (
+	// Minimum time between permission violation events for the same client, subject and kind.
+	permViolationEventInterval = time.Second
+	// Maximum number of distinct violations we will track per client.
+	permViolationMaxTracked = 256
+	// Maximum number of permission violation events the server will send per interval.
+	permViolationMaxEvents = 1000
+)
+
+type permViolation struct {
+	kind    string
+	subject string
+	queue   string
+	// Violations not reported yet.
+	count uint64
+	// When we last sent an event.
+	last time.Time
+}
+
+// Will send a permission violation event for this client unless one was
+// recently sent for the same subject and kind, in which case it is counted
+// and reported once the interval has passed.
+func (c *client) permissionViolationEvent(kind, subject, queue string) {
+	s := c.srv
+	if s == nil || !s.EventsEnabled() {
+		return
+	}
+
+	now := time.Now().UTC()
+	key := kind + " " + subject + " " + queue
+
+	c.mu.Lock()
+	if c.acc == nil {
+		c.mu.Unlock()
+		return
+	}
+	if c.pviol == nil {
+		c.pviol = make(map[string]*permViolation)
+	}
+	pv := c.pviol[key]
+	if pv == nil {
+		if len(c.pviol) >= permViolationMaxTracked {
+			// Drop any we are no longer suppressing and have nothing to report for.
+			for k, v := range c.pviol {
+				if v.count == 0 && now.Sub(v.last) >= permViolationEventInterval {
+					delete(c.pviol, k)
+				}
+			}
+			if len(c.pviol) >= permViolationMaxTracked {
+				c.mu.Unlock()
+				return
+			}
+		}
+		pv = &permViolation{kind: kind, subject: subject, queue: queue}
+		c.pviol[key] = pv
+	}
+	pv.count++
+	if now.Sub(pv.last) < permViolationEventInterval || !s.allowPermViolationEvent(now) {
+		c.armPermViolationFlush()
+		c.mu.Unlock()
+		return
+	}
+	m := c.permViolationEventMsg(pv, now)
+	accName := c.acc.Name
+	c.mu.Unlock()
+
+	s.sendPermViolationEvent(accName, m)
+}
+
+// Will make sure we report any suppressed violations once the interval has passed.
+// Lock should be held.
+func (c *client) armPermViolationFlush() {
+	if c.pviolTmr == nil {
+		c.pviolTmr = time.AfterFunc(permViolationEventInterval, c.flushPermViolations)
+	}
+}
+
+// Sends events for violations that were suppressed during the last interval.
+func (c *client) flushPermViolations() {
+	s := c.srv
+	now := time.Now().UTC()
+
+	var msgs []*PermissionViolationEventMsg
+	var pending bool
+
+	c.mu.Lock()
+	c.pviolTmr = nil
+	if c.acc == nil {
+		c.mu.Unlock()
+		return
+	}
+	for k, pv := range c.pviol {
+		if pv.count == 0 {
+			if now.Sub(pv.last) >= permViolationEventInterval {
+				delete(c.pviol, k)
+			}
+			continue
+		}
+		if now.Sub(pv.last) < permViolationEventInterval || !s.allowPermViolationEvent(now) {
+			pending = true
+			continue
+		}
+		msgs = append(msgs, c.permViolationEventMsg(pv, now))
+	}
+	if pending {
+		c.armPermViolationFlush()
+	}
+	accName := c.acc.Name
+	c.mu.Unlock()
+
+	for _, m := range msgs {
+		s.sendPermViolationEvent(accName, m)
+	}
+}
+
+// Builds the event for the violations counted so far and resets the count.
+// Lock should be held.
+func (c *client) permViolationEventMsg(pv *permViolation, now time.Time) *PermissionViolationEventMsg {
+	count := pv.count
+	pv.count, pv.last = 0, now
+
+	return &PermissionViolationEventMsg{
+		TypedEvent: TypedEvent{
+			Type: PermissionViolationEventMsgType,
+			Time: now,
+		},
+		Client: ClientInfo{
+			Start:      &c.start,
+			Host:       c.host,
+			ID:         c.cid,
+			Account:    accForClient(c),
+			User:       c.getRawAuthUser(),
+			Name:       c.opts.Name,
+			Lang:       c.opts.Lang,
+			Version:    c.opts.Version,
+			Jwt:        c.opts.JWT,
+			IssuerKey:  issuerForClient(c),
+			Tags:       c.tags,
+			NameTag:    c.nameTag,
+			Kind:       c.kindString(),
+			ClientType: c.clientTypeString(),
+			MQTTClient: c.getMQTTClientID(),
+		},
+		Kind:    pv.kind,
+		Subject: pv.subject,
+		Queue:   pv.queue,
+		Count:   count,
+	}
+}
+
+// Returns true if we are still under the server wide limit of permission
+// violation events for the current interval.
+func (s *Server) allowPermViolationEvent(now time.Time) bool {
+	s.pviolMu.Lock()
+	defer s.pviolMu.Unlock()
+	if now.Sub(s.pviolStart) >= permViolationEventInterval {
+		s.pviolStart, s.pviolSent = now, 0
+	}
+	if s.pviolSent >= permViolationMaxEvents {
+		return false
+	}
+	s.pviolSent++
+	return true
+}
+
+func (s *Server) sendPermViolationEvent(accName string, m *PermissionViolationEventMsg) {
+	s.mu.Lock()
+	if s.eventsEnabled() {
+		m.ID = s.nextEventID()
+		s.sendInternalMsg(fmt.Sprintf(permViolationSubj, accName), _EMPTY_, &m.Server, m)
+	}
+	s.mu.Unlock()
+}
+
 // Internal message callback.
 // If the msg is needed past the callback it is required to be copied.
 // rmsg contains header and the message. use client.msgParts(rmsg) to split them apart
@@ -16,6 +16,7 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"container/list"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
@@ -26,9 +27,11 @@ import (
 	"errors"
 	"fmt"
 	"hash"
+	"hash/crc32"
 	"io"
 	"net"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -41,8 +44,10 @@ import (
 
 	"github.com/klauspost/compress/s2"
 	"github.com/minio/highwayhash"
+	"github.com/nats-io/nuid"
 	"golang.org/x/crypto/chacha20"
 	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/time/rate"
 )
 
 type FileStoreConfig struct {
@@ -50,14 +55,71 @@ type FileStoreConfig struct {
 	StoreDir string
 	// BlockSize is the file block size. This also represents the maximum overhead size.
 	BlockSize uint64
+	// AdaptiveBlockSize will size new blocks based on the observed ingest rate and
+	// average message size, starting with BlockSize.
+	AdaptiveBlockSize bool
 	// CacheExpire is how long with no activity until we expire the cache.
 	CacheExpire time.Duration
 	// SyncInterval is how often we sync to disk in the background.
 	SyncInterval time.Duration
 	// AsyncFlush allows async flush to batch write operations.
 	AsyncFlush bool
+	// CoalesceMinimum is the number of pending bytes the flusher will try to gather before writing.
+	CoalesceMinimum int
+	// MaxFlushWait is the maximum time the flusher will wait to gather pending bytes.
+	MaxFlushWait time.Duration
+	// SyncAlways will write and sync each message to disk before returning
+	// from a store call, bypassing the coalescing flush loop.
+	SyncAlways bool
+	// CacheBudget is the maximum number of bytes we will hold in block caches
+	// across the whole store. When exceeded the least recently used block caches
+	// are evicted. Zero means no limit.
+	CacheBudget uint64
 	// Cipher is the cipher to use when encrypting.
 	Cipher StoreCipher
+	// Checksum is the checksum algorithm used for new message records.
+	Checksum ChecksumType
+	// Clock is the clock source used for message timestamps. Defaults to the wall clock.
+	Clock ClockSource
+	// MaxClockSkew is how far ahead of the clock source an observed timestamp may
+	// move our clock. Zero means no limit.
+	MaxClockSkew time.Duration
+	// RebuildState will rebuild all state on recovery by scanning the message
+	// block files, only taking removed messages from intact index files.
+	RebuildState bool
+	// ErasePasses is the number of times an erased message record is overwritten.
+	// Defaults to a single pass.
+	ErasePasses int
+	// EraseZero will overwrite erased message records with zeros instead of random bytes.
+	EraseZero bool
+	// EraseSync will also sync the block file when an erased message was still pending
+	// a write. Erased messages already on disk are always synced after every pass.
+	EraseSync bool
+	// Archive, if set, is where cold message blocks are moved to, leaving a local stub.
+	// Archived blocks are fetched on demand when read.
+	Archive BlockArchive
+	// ArchiveAge will archive blocks whose last message is older than this.
+	ArchiveAge time.Duration
+	// ArchiveBytes will archive the oldest blocks while local blocks hold more than this.
+	ArchiveBytes uint64
+	// OrphanConsumerTTL is how long the state of an ephemeral consumer that is no longer
+	// running needs to be left untouched before it is removed.
+	OrphanConsumerTTL time.Duration
+
+	// Throttle for background disk I/O, shared by all stores of a server.
+	bgIO *ioThrottle
+	// Throttle for re-encrypting message blocks under a new key, shared by all stores of a server.
+	reKeyIO *ioThrottle
+	// Limits open file descriptors of message blocks, shared by all stores of a server.
+	// Nil if not limited.
+	blkFDs *fdManager
+}
+
+// BlockArchive is an object store that cold message blocks can be archived to.
+type BlockArchive interface {
+	Put(key string, data []byte) error
+	Get(key string) ([]byte, error)
+	Delete(key string) error
 }
 
 // FileStreamInfo allows us to remember created time.
@@ -84,6 +146,71 @@ func (cipher StoreCipher) String() string {
 	}
 }
 
+// ChecksumType determines how message records are protected.
+type ChecksumType int
+
+const (
+	// HighwayHash is the default, a keyed 64 bit hash.
+	HighwayHash ChecksumType = iota
+	// CRC32C uses the Castagnoli polynomial, which is hardware accelerated on most platforms.
+	CRC32C
+	// NoChecksum will not protect message records.
+	NoChecksum
+)
+
+func (ct ChecksumType) String() string {
+	switch ct {
+	case HighwayHash:
+		return "HighwayHash64"
+	case CRC32C:
+		return "CRC32C"
+	case NoChecksum:
+		return "None"
+	default:
+		return "Unknown ChecksumType"
+	}
+}
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// crc32cHash presents a CRC32C as a 64 bit hash so records keep the same layout.
+type crc32cHash struct {
+	hash.Hash32
+}
+
+func (h crc32cHash) Size() int     { return checksumSize }
+func (h crc32cHash) Sum64() uint64 { return uint64(h.Sum32()) }
+func (h crc32cHash) Sum(b []byte) []byte {
+	var buf [checksumSize]byte
+	binary.BigEndian.PutUint64(buf[:], h.Sum64())
+	return append(b, buf[:]...)
+}
+
+// noHash is used when records are not protected, the checksum is always zero.
+type noHash struct{}
+
+func (noHash) Write(p []byte) (int, error) { return len(p), nil }
+func (noHash) Sum(b []byte) []byte         { return append(b, make([]byte, checksumSize)...) }
+func (noHash) Reset()                      {}
+func (noHash) Size() int                   { return checksumSize }
+func (noHash) BlockSize() int              { return 1 }
+func (noHash) Sum64() uint64               { return 0 }
+
+// Create the hash for message records of the given block.
+func (fs *fileStore) newChecksumHash(ct ChecksumType, index uint32) (hash.Hash64, error) {
+	switch ct {
+	case HighwayHash:
+		key := sha256.Sum256(fs.hashKeyForBlock(index))
+		return highwayhash.New64(key[:])
+	case CRC32C:
+		return crc32cHash{crc32.New(crc32cTable)}, nil
+	case NoChecksum:
+		return noHash{}, nil
+	default:
+		return nil, fmt.Errorf("unknown checksum type %d", ct)
+	}
+}
+
 // File ConsumerInfo is used for creating consumer stores.
 type FileConsumerInfo struct {
 	Created time.Time
@@ -107,21 +234,37 @@ type fileStore struct {
 	mu      sync.RWMutex
 	state   StreamState
 	ld      *LostStreamData
+	dmu     sync.Mutex
+	damaged []DamagedBlock
+	amu     sync.Mutex
+	adel    map[string]struct{}
+	adch    chan struct{}
+	ctrs    *fileStoreCounters
 	scb     StorageUpdateHandler
+	sqc     StorageQuotaChecker
+	rmh     StorageRemovalHandler
+	och     ConsumerOrphanChecker
+	hist    []StreamConfigRevision
 	ageChk  *time.Timer
 	syncTmr *time.Timer
 	cfg     FileStreamInfo
 	fcfg    FileStoreConfig
 	prf     keyGen
+	oprf    keyGen
 	aek     cipher.AEAD
 	lmb     *msgBlock
 	blks    []*msgBlock
 	bim     map[uint32]*msgBlock
 	psim    map[string]*psi
 	hh      hash.Hash64
+	hlc     hlc
 	qch     chan struct{}
+	cch     chan struct{}
 	cfs     []ConsumerStore
 	sips    int
+	bsz     uint64
+	ibr     float64
+	ams     float64
 	closed  bool
 	fip     bool
 }
@@ -141,10 +284,15 @@ type msgBlock struct {
 	mfd     *os.File
 	ifn     string
 	ifd     *os.File
+	afn     string
+	arc     *archivedBlock
+	abuf    []byte // Archived block fetched before taking the lock.
 	liwsz   int64
 	index   uint32
+	tsz     uint64 // Size at which we roll to a new blk, zero means the configured block size.
 	bytes   uint64 // User visible bytes count.
 	rbytes  uint64 // Total bytes (raw) including deleted. Used for rolling to new blk.
+	cwp     uint64 // Commit write position, all records before this have been fully written.
 	msgs    uint64 // User visible message count.
 	fss     map[string]*SimpleState
 	sfn     string
@@ -167,7 +315,10 @@ type msgBlock struct {
 	loading bool
 	flusher bool
 	noTrack bool
+	syncAll bool
 	closed  bool
+	rekey   bool
+	keepBad bool // Keep a copy in the corrupt directory if a rebuild has to cut off committed messages.
 
 	// Used to mock write failures.
 	mockWriteErr bool
@@ -194,6 +345,24 @@ const (
 	magic = uint8(22)
 	// Version
 	version = uint8(1)
+	// Index file versions.
+	indexV1 = uint8(1)
+	// Added the commit write position.
+	indexV2 = uint8(2)
+	// Added the size the block rolls at.
+	indexV3 = uint8(3)
+	// Added the checksum type used for the block's records.
+	indexV4 = uint8(4)
+	// Version we write for index files.
+	indexVersion = indexV4
+	// Consumer state versions.
+	consumerStateV1 = uint8(1)
+	// Added delivered sequences to pending and changed timestamp encoding.
+	consumerStateV2 = uint8(2)
+	// Version we write, older versions are migrated on startup.
+	consumerStateVersion = consumerStateV2
+	// Consumer journal version.
+	consumerJournalVersion = uint8(1)
 	// hdrLen
 	hdrLen = 2
 	// This is where we keep the streams.
@@ -202,6 +371,10 @@ const (
 	msgDir = "msgs"
 	// This is where we temporarily move the messages dir.
 	purgeDir = "__msgs__"
+	// This is where we quarantine corrupt message blocks.
+	corruptDir = "corrupt"
+	// Report of all damaged blocks, kept in the corrupt directory.
+	damagedReport = "report.json"
 	// used to scan blk file names.
 	blkScan = "%d.blk"
 	// used for compacted blocks that are staged.
@@ -212,12 +385,24 @@ const (
 	fssScan = "%d.fss"
 	// used to store our block encryption key.
 	keyScan = "%d.key"
+	// used for the local stub of an archived block.
+	arcScan = "%d.arc"
+	// Archived blocks we still need to delete.
+	archiveDeletesFile = "archive.del"
+	// used for a block re-encrypted under a new key that is staged.
+	reKeyBlkScan = "%d.rkb"
+	// used for the new encryption key of a staged block.
+	reKeyKeyScan = "%d.rkk"
+	// Progress of re-encrypting message blocks under a new key.
+	reKeyProgressFile = "rekey.json"
 	// to look for orphans
 	keyScanAll = "*.key"
 	// This is where we keep state on consumers.
 	consumerDir = "obs"
 	// Index file for a consumer.
 	consumerState = "o.dat"
+	// Journal of consumer updates since the index file was written.
+	consumerJournal = "o.jnl"
 	// This is where we keep state on templates.
 	tmplsDir = "templates"
 	// Maximum size of a write buffer we may consider for re-use.
@@ -226,6 +411,8 @@ const (
 	defaultCacheBufferExpiration = 5 * time.Second
 	// default sync interval
 	defaultSyncInterval = 60 * time.Second
+	// default time before state of consumers no longer running is removed.
+	defaultOrphanConsumerTTL = time.Hour
 	// default idle timeout to close FDs.
 	closeFDsIdle = 30 * time.Second
 	// coalesceMinimum
@@ -237,6 +424,10 @@ const (
 	JetStreamMetaFile    = "meta.inf"
 	JetStreamMetaFileSum = "meta.sum"
 	JetStreamMetaFileKey = "meta.key"
+	// Previous good metafile along with its checksum.
+	JetStreamMetaFileBackup = "meta.bak"
+	// Stream config revision history.
+	JetStreamMetaFileHistory = "meta.hist"
 
 	// AEK key sizes
 	minMetaKeySize = 64
@@ -259,6 +450,12 @@ const (
 	FileStoreMinBlkSize = 32 * 1000 // 32kib
 	// FileStoreMaxBlkSize is maximum size we will do for a blk size.
 	FileStoreMaxBlkSize = maxBlockSize
+	// Adaptive block sizing targets a block filling in about this long at the observed ingest rate.
+	adaptiveBlkFillTime = 5 * time.Minute
+	// Adaptive block sizing will always allow this many messages of average size in a block.
+	adaptiveBlkMinMsgs = 1024
+	// Weight given to the last block when tracking ingest rate and average message size.
+	adaptiveBlkWeight = 0.5
 	// Check for bad record length value due to corrupt data.
 	rlBadThresh = 32 * 1024 * 1024
 	// Time threshold to write index info.
@@ -272,6 +469,12 @@ func newFileStore(fcfg FileStoreConfig, cfg StreamConfig) (*fileStore, error) {
 }
 
 func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf keyGen) (*fileStore, error) {
+	return newFileStoreWithKeys(fcfg, cfg, created, prf, nil)
+}
+
+// Create a filestore that will recover assets sealed under the previous key
+// generator oprf and re-encrypt them under prf in the background.
+func newFileStoreWithKeys(fcfg FileStoreConfig, cfg StreamConfig, created time.Time, prf, oprf keyGen) (*fileStore, error) {
 	if cfg.Name == _EMPTY_ {
 		return nil, fmt.Errorf("name required")
 	}
@@ -291,6 +494,21 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if fcfg.SyncInterval == 0 {
 		fcfg.SyncInterval = defaultSyncInterval
 	}
+	if fcfg.CoalesceMinimum == 0 {
+		fcfg.CoalesceMinimum = coalesceMinimum
+	}
+	if fcfg.MaxFlushWait == 0 {
+		fcfg.MaxFlushWait = maxFlushWait
+	}
+	if fcfg.OrphanConsumerTTL == 0 {
+		fcfg.OrphanConsumerTTL = defaultOrphanConsumerTTL
+	}
+	if cfg.SyncAlways {
+		fcfg.SyncAlways = true
+	}
+	if cfg.AdaptiveBlockSize {
+		fcfg.AdaptiveBlockSize = true
+	}
 
 	// Check the directory
 	if stat, err := os.Stat(fcfg.StoreDir); os.IsNotExist(err) {
@@ -313,11 +531,15 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 		bim:  make(map[uint32]*msgBlock),
 		cfg:  FileStreamInfo{Created: created, StreamConfig: cfg},
 		prf:  prf,
+		oprf: oprf,
+		hlc:  hlc{clock: fcfg.Clock, maxDrift: int64(fcfg.MaxClockSkew)},
 		qch:  make(chan struct{}),
+		ctrs: &fileStoreCounters{},
 	}
 
 	// Set flush in place to AsyncFlush which by default is false.
-	fs.fip = !fcfg.AsyncFlush
+	// If we are syncing always we will always flush in place.
+	fs.fip = !fcfg.AsyncFlush || fcfg.SyncAlways
 
 	// Check if this is a new setup.
 	mdir := filepath.Join(fcfg.StoreDir, msgDir)
@@ -340,6 +562,16 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 	if err := fs.recoverMsgs(); err != nil {
 		return nil, err
 	}
+	// If this is a brand new store, start at the configured first sequence.
+	if fs.state.LastSeq == 0 && cfg.FirstSeq > 1 {
+		if err := fs.SkipMsgs(1, cfg.FirstSeq-1); err != nil {
+			return nil, err
+		}
+	}
+	// Make sure new timestamps are always ahead of what we have stored.
+	if !fs.state.LastTime.IsZero() {
+		fs.hlc.observe(fs.state.LastTime.UnixNano())
+	}
 
 	// Write our meta data if it does not exist or is zero'd out.
 	meta := filepath.Join(fcfg.StoreDir, JetStreamMetaFile)
@@ -358,11 +590,41 @@ func newFileStoreWithCreated(fcfg FileStoreConfig, cfg StreamConfig, created tim
 			if err := fs.writeStreamMeta(); err != nil {
 				return nil, err
 			}
+		} else if fs.aek == nil {
+			// Keep using our existing key, our config history is sealed with it.
+			// If it can not be recovered a new one will be generated when needed.
+			fs.aek, _ = fs.recoverMetaKey(fs.cfg.Name, keyFile)
 		}
 	}
 
+	// Recover our config history if we have one.
+	fs.recoverConfigHistory()
+
+	// Remove state of consumers that could never be recovered.
+	fs.removeOrphanConsumers(true)
+
 	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
 
+	// Spin up our cache budget enforcement if configured.
+	if fs.fcfg.CacheBudget > 0 {
+		fs.cch = make(chan struct{}, 1)
+		go fs.cacheBudgetLoop(fs.cch, fs.qch)
+	}
+
+	// Spin up archiving of cold blocks if configured. We always need this to delete archived blocks.
+	if fs.fcfg.Archive != nil {
+		fs.adch = make(chan struct{}, 1)
+		fs.recoverArchiveDeletes()
+		go fs.archiveLoop(fs.adch, fs.qch)
+	}
+
+	// Re-encrypt any blocks still sealed under our previous key.
+	if fs.reKeyPending() > 0 {
+		go fs.reKeyBlocks(fs.qch)
+	} else {
+		os.Remove(filepath.Join(fs.fcfg.StoreDir, reKeyProgressFile))
+	}
+
 	return fs, nil
 }
 
@@ -410,6 +672,36 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 		return err
 	}
 
+	// Check if our sync behavior has changed.
+	if cfg.SyncAlways != old_cfg.SyncAlways {
+		fs.fcfg.SyncAlways = cfg.SyncAlways
+		fs.fip = !fs.fcfg.AsyncFlush || cfg.SyncAlways
+		for _, mb := range fs.blks {
+			mb.mu.Lock()
+			mb.syncAll = cfg.SyncAlways
+			mb.mu.Unlock()
+		}
+		// If we are no longer flushing in place make sure our last block can flush.
+		if !fs.fip && fs.lmb != nil {
+			fs.lmb.spinUpFlushLoop()
+		}
+	}
+
+	// Check if we should start or stop adapting block sizes.
+	if cfg.AdaptiveBlockSize != old_cfg.AdaptiveBlockSize {
+		fs.fcfg.AdaptiveBlockSize = cfg.AdaptiveBlockSize
+		if !cfg.AdaptiveBlockSize {
+			fs.bsz, fs.ibr, fs.ams = 0, 0, 0
+		}
+	}
+
+	// Once sealed nothing can be removed, so stop expiration and skip limits.
+	if fs.cfg.Sealed {
+		fs.cancelAgeChk()
+		fs.mu.Unlock()
+		return nil
+	}
+
 	// Limits checks and enforcement.
 	fs.enforceMsgLimit()
 	fs.enforceBytesLimit()
@@ -434,6 +726,54 @@ func (fs *fileStore) UpdateConfig(cfg *StreamConfig) error {
 	return nil
 }
 
+// Returns the size at which the block will be rolled.
+// Lock should be held.
+func (fs *fileStore) rollSize(mb *msgBlock) uint64 {
+	if mb.tsz > 0 {
+		return mb.tsz
+	}
+	return fs.fcfg.BlockSize
+}
+
+// Will update our observed ingest rate and average message size from a block we are
+// rolling from and pick the size for new blocks. We want a block to hold a few minutes
+// of ingest to keep block counts down, but no more than our max block size to keep
+// recovery time of the last block bounded.
+// Lock should be held.
+func (fs *fileStore) adaptBlockSize(rbytes, msgs uint64, dur time.Duration) {
+	if rbytes == 0 || msgs == 0 {
+		return
+	}
+	ewma := func(cur, v float64) float64 {
+		if cur == 0 {
+			return v
+		}
+		return adaptiveBlkWeight*v + (1-adaptiveBlkWeight)*cur
+	}
+	fs.ams = ewma(fs.ams, float64(rbytes)/float64(msgs))
+	if dur > 0 {
+		fs.ibr = ewma(fs.ibr, float64(rbytes)/dur.Seconds())
+	} else if msgs > 1 {
+		// Everything arrived at once, so assume we are ingesting as fast as we can.
+		fs.ibr = float64(maxBlockSize) / adaptiveBlkFillTime.Seconds()
+	}
+
+	sz := uint64(fs.ibr * adaptiveBlkFillTime.Seconds())
+	if min := uint64(fs.ams * adaptiveBlkMinMsgs); sz < min {
+		sz = min
+	}
+	// Round up to nearest 100
+	if m := sz % 100; m != 0 {
+		sz += 100 - m
+	}
+	if sz < FileStoreMinBlkSize {
+		sz = FileStoreMinBlkSize
+	} else if sz > maxBlockSize {
+		sz = maxBlockSize
+	}
+	fs.bsz = sz
+}
+
 func dynBlkSize(retention RetentionPolicy, maxBytes int64) uint64 {
 	if maxBytes > 0 {
 		blkSize := (maxBytes / 4) + 1 // (25% overhead)
@@ -565,210 +905,1024 @@ func (fs *fileStore) writeStreamMeta() error {
 		b = fs.aek.Seal(nonce, nonce, b, nil)
 	}
 
-	if err := os.WriteFile(meta, b, defaultFilePerms); err != nil {
+	return writeMetaFiles(fs.fcfg.StoreDir, b, fs.hh)
+}
+
+// Suffix used for metafiles that are being written.
+const metaTmpSuffix = ".tmp"
+
+var errMetaChecksumMismatch = errors.New("metafile checksum does not match")
+
+// Returns the hex encoded checksum for the metafile contents.
+func metaChecksum(hh hash.Hash64, b []byte) []byte {
+	hh.Reset()
+	hh.Write(b)
+	return []byte(hex.EncodeToString(hh.Sum(nil)))
+}
+
+// Writes the file to a temporary file and moves it into place
+// so readers will see either the old or the new contents.
+func writeFileAtomic(name string, b []byte) error {
+	tmp := name + metaTmpSuffix
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, defaultFilePerms)
+	if err != nil {
 		return err
 	}
-	fs.hh.Reset()
-	fs.hh.Write(b)
-	checksum := hex.EncodeToString(fs.hh.Sum(nil))
-	sum := filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileSum)
-	if err := os.WriteFile(sum, []byte(checksum), defaultFilePerms); err != nil {
+	_, err = fd.Write(b)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
 		return err
 	}
-	return nil
+	return os.Rename(tmp, name)
 }
 
-// Pools to recycle the blocks to help with memory pressure.
-var blkPoolBig sync.Pool    // 16MB
-var blkPoolMedium sync.Pool // 8MB
-var blkPoolSmall sync.Pool  // 2MB
-
-// Get a new msg block based on sz estimate.
-func getMsgBlockBuf(sz int) (buf []byte) {
-	var pb interface{}
-	if sz <= defaultSmallBlockSize {
-		pb = blkPoolSmall.Get()
-	} else if sz <= defaultMediumBlockSize {
-		pb = blkPoolMedium.Get()
-	} else {
-		pb = blkPoolBig.Get()
+// Reads the metafile from dir and validates it against its checksum.
+func readMetaFiles(dir string, hh hash.Hash64) ([]byte, []byte, error) {
+	b, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFile))
+	if err != nil {
+		return nil, nil, err
 	}
-	if pb != nil {
-		buf = *(pb.(*[]byte))
-	} else {
-		// Here we need to make a new blk.
-		// If small leave as is..
-		if sz > defaultSmallBlockSize && sz <= defaultMediumBlockSize {
-			sz = defaultMediumBlockSize
-		} else if sz > defaultMediumBlockSize {
-			sz = defaultLargeBlockSize
-		}
-		buf = make([]byte, sz)
+	sum, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFileSum))
+	if err != nil {
+		return nil, nil, err
 	}
-	return buf[:0]
+	if !bytes.Equal(metaChecksum(hh, b), sum) {
+		return nil, nil, errMetaChecksumMismatch
+	}
+	return b, sum, nil
 }
 
-// Recycle the msg block.
-func recycleMsgBlockBuf(buf []byte) {
-	if buf == nil || cap(buf) < defaultSmallBlockSize {
-		return
+// Writes out the metafile and its checksum into dir.
+// The checksum is staged first and the metafile moved into place before it,
+// so if we crash in between recoverMetaFiles can finish the job. The previous
+// good pair is kept as a backup in case the metafiles are later corrupted.
+func writeMetaFiles(dir string, b []byte, hh hash.Hash64) error {
+	if ob, osum, err := readMetaFiles(dir, hh); err == nil {
+		bak := make([]byte, 0, len(osum)+1+len(ob))
+		bak = append(append(append(bak, osum...), '\n'), ob...)
+		if err := writeFileAtomic(filepath.Join(dir, JetStreamMetaFileBackup), bak); err != nil {
+			return err
+		}
 	}
-	// Make sure to reset before placing back into pool.
-	buf = buf[:0]
-
-	// We need to make sure the load code gets a block that can fit the maximum for a size block.
-	// E.g. 8, 16 etc. otherwise we thrash and actually make things worse by pulling it out, and putting
-	// it right back in and making a new []byte.
-	// From above we know its already >= defaultSmallBlockSize
-	if sz := cap(buf); sz < defaultMediumBlockSize {
-		blkPoolSmall.Put(&buf)
-	} else if sz < defaultLargeBlockSize {
-		blkPoolMedium.Put(&buf)
-	} else {
-		blkPoolBig.Put(&buf)
+	sum := filepath.Join(dir, JetStreamMetaFileSum)
+	tsum := sum + metaTmpSuffix
+	if err := os.WriteFile(tsum, metaChecksum(hh, b), defaultFilePerms); err != nil {
+		return err
 	}
+	if err := writeFileAtomic(filepath.Join(dir, JetStreamMetaFile), b); err != nil {
+		os.Remove(tsum)
+		return err
+	}
+	return os.Rename(tsum, sum)
 }
 
-const (
-	msgHdrSize     = 22
-	checksumSize   = 8
-	emptyRecordLen = msgHdrSize + checksumSize
-)
-
-// This is the max room needed for index header.
-const indexHdrSize = 7*binary.MaxVarintLen64 + hdrLen + checksumSize
-
-// Lock should be held.
-func (fs *fileStore) noTrackSubjects() bool {
-	return !(len(fs.psim) > 0 || len(fs.cfg.Subjects) > 0 || fs.cfg.Mirror != nil || len(fs.cfg.Sources) > 0)
-}
-
-// Lock held on entry
-func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, error) {
-	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, noTrack: fs.noTrackSubjects()}
-
-	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
-	mb.mfn = filepath.Join(mdir, fi.Name())
-	mb.ifn = filepath.Join(mdir, fmt.Sprintf(indexScan, index))
-	mb.sfn = filepath.Join(mdir, fmt.Sprintf(fssScan, index))
+// Reads and validates the metafile in dir. If a write was interrupted it will
+// be completed, and if the metafiles are corrupt we fall back to the backup of
+// the previous good metafile. Returns the original error if neither worked.
+func recoverMetaFiles(dir string, hh hash.Hash64) ([]byte, error) {
+	meta := filepath.Join(dir, JetStreamMetaFile)
+	sum := filepath.Join(dir, JetStreamMetaFileSum)
+	tsum := sum + metaTmpSuffix
+	defer os.Remove(meta + metaTmpSuffix)
+	defer os.Remove(tsum)
 
-	if mb.hh == nil {
-		key := sha256.Sum256(fs.hashKeyForBlock(index))
-		mb.hh, _ = highwayhash.New64(key[:])
+	b, _, err := readMetaFiles(dir, hh)
+	if err == nil {
+		return b, nil
 	}
-
-	var createdKeys bool
-
-	// Check if encryption is enabled.
-	if fs.prf != nil {
-		ekey, err := os.ReadFile(filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index)))
-		if err != nil {
-			// We do not seem to have keys even though we should. Could be a plaintext conversion.
-			// Create the keys and we will double check below.
-			if err := fs.genEncryptionKeysForBlock(mb); err != nil {
-				return nil, err
-			}
-			createdKeys = true
-		} else {
-			if len(ekey) < minBlkKeySize {
-				return nil, errBadKeySize
-			}
-			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index)))
-			if err != nil {
-				return nil, err
-			}
-
-			sc := fs.fcfg.Cipher
-			kek, err := genEncryptionKey(sc, rb)
-			if err != nil {
-				return nil, err
-			}
-			ns := kek.NonceSize()
-			seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
-			if err != nil {
-				// We may be here on a cipher conversion, so attempt to convert.
-				if err = mb.convertCipher(); err != nil {
-					return nil, err
-				}
-			} else {
-				mb.seed, mb.nonce = seed, ekey[:ns]
-			}
-			mb.aek, err = genEncryptionKey(sc, mb.seed)
-			if err != nil {
-				return nil, err
-			}
-			if mb.bek, err = genBlockEncryptionKey(sc, mb.seed, mb.nonce); err != nil {
-				return nil, err
+	// We may have crashed after moving the metafile into place but before its checksum.
+	if nb, rerr := os.ReadFile(meta); rerr == nil {
+		if nsum, rerr := os.ReadFile(tsum); rerr == nil && bytes.Equal(metaChecksum(hh, nb), nsum) {
+			if rerr = os.Rename(tsum, sum); rerr == nil {
+				return nb, nil
 			}
 		}
 	}
-
-	// If we created keys here, let's check the data and if it is plaintext convert here.
-	if createdKeys {
-		if err := mb.convertToEncrypted(); err != nil {
-			return nil, err
-		}
+	// Fall back to the previous good metafile.
+	bak, rerr := os.ReadFile(filepath.Join(dir, JetStreamMetaFileBackup))
+	if rerr != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(bak, '\n')
+	if i <= 0 {
+		return nil, err
+	}
+	bsum, bb := bak[:i], bak[i+1:]
+	if !bytes.Equal(metaChecksum(hh, bb), bsum) {
+		return nil, err
+	}
+	if rerr := writeFileAtomic(meta, bb); rerr != nil {
+		return nil, rerr
 	}
+	if rerr := writeFileAtomic(sum, bsum); rerr != nil {
+		return nil, rerr
+	}
+	return bb, nil
+}
 
-	// Open up the message file, but we will try to recover from the index file.
-	// We will check that the last checksums match.
-	file, err := os.Open(mb.mfn)
+// Will recover the asset encryption key sealed in keyFile for the given context.
+// If it was sealed under our previous key encryption key it will be resealed
+// under our current one.
+func (fs *fileStore) recoverMetaKey(context, keyFile string) (cipher.AEAD, error) {
+	ekey, err := os.ReadFile(keyFile)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
-
-	if fi, err := file.Stat(); fi != nil {
-		mb.rbytes = uint64(fi.Size())
-	} else {
+	if len(ekey) < minMetaKeySize {
+		return nil, errBadKeySize
+	}
+	seed, nonce, old, err := fs.openKey(context, ekey)
+	if err != nil {
 		return nil, err
 	}
-	// Grab last checksum from main block file.
-	var lchk [8]byte
-	if mb.rbytes >= checksumSize {
-		if mb.bek != nil {
-			if buf, _ := mb.loadBlock(nil); len(buf) >= checksumSize {
-				mb.bek.XORKeyStream(buf, buf)
-				copy(lchk[0:], buf[len(buf)-checksumSize:])
-			}
-		} else {
-			file.ReadAt(lchk[:], fi.Size()-checksumSize)
+	if old {
+		if err := fs.resealKey(context, seed, nonce, keyFile); err != nil {
+			return nil, err
 		}
 	}
+	return genEncryptionKey(fs.fcfg.Cipher, seed)
+}
 
-	file.Close()
-
-	// Read our index file. Use this as source of truth if possible.
-	if err := mb.readIndexInfo(); err == nil {
-		// Quick sanity check here.
-		// Note this only checks that the message blk file is not newer then this file, or is empty and we expect empty.
-		if (mb.rbytes == 0 && mb.msgs == 0) || bytes.Equal(lchk[:], mb.lchk[:]) {
-			if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
-				fs.populateGlobalPerSubjectInfo(mb)
-				// Try to dump any state we needed on recovery.
-				mb.tryForceExpireCacheLocked()
-			}
-			fs.addMsgBlock(mb)
-			return mb, nil
+// Will open an encrypted asset key with the key encryption key for the context.
+// If we are rotating keys and this fails we will try our previous key, and will
+// report if that is the one that opened it.
+func (fs *fileStore) openKey(context string, ekey []byte) (seed, nonce []byte, old bool, err error) {
+	open := func(prf keyGen) ([]byte, []byte, error) {
+		rb, err := prf([]byte(context))
+		if err != nil {
+			return nil, nil, err
+		}
+		kek, err := genEncryptionKey(fs.fcfg.Cipher, rb)
+		if err != nil {
+			return nil, nil, err
+		}
+		ns := kek.NonceSize()
+		if len(ekey) < ns {
+			return nil, nil, errBadKeySize
 		}
+		seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
+		return seed, ekey[:ns], err
 	}
-
-	// If we get data loss rebuilding the message block state record that with the fs itself.
-	if ld, _ := mb.rebuildState(); ld != nil {
+	if seed, nonce, err = open(fs.prf); err != nil && fs.oprf != nil {
+		if oseed, ononce, oerr := open(fs.oprf); oerr == nil {
+			return oseed, ononce, true, nil
+		}
+	}
+	return seed, nonce, false, err
+}
+
+// Will seal the asset key again under our current key encryption key and write
+// it to the key file. The nonce is kept since it is also used by the asset.
+func (fs *fileStore) resealKey(context string, seed, nonce []byte, keyFile string) error {
+	rb, err := fs.prf([]byte(context))
+	if err != nil {
+		return err
+	}
+	kek, err := genEncryptionKey(fs.fcfg.Cipher, rb)
+	if err != nil {
+		return err
+	}
+	buf := append(make([]byte, 0, len(nonce)+len(seed)+kek.Overhead()), nonce...)
+	return writeFileAtomic(keyFile, kek.Seal(buf, nonce, seed, nil))
+}
+
+// Will recover our config revision history. This is best effort.
+func (fs *fileStore) recoverConfigHistory() {
+	buf, err := os.ReadFile(filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileHistory))
+	if err != nil {
+		return
+	}
+	if fs.prf != nil {
+		if fs.aek == nil {
+			return
+		}
+		ns := fs.aek.NonceSize()
+		if len(buf) < ns {
+			return
+		}
+		if buf, err = fs.aek.Open(nil, buf[:ns], buf[ns:], nil); err != nil {
+			return
+		}
+	}
+	var hist []StreamConfigRevision
+	if json.Unmarshal(buf, &hist) == nil {
+		fs.hist = hist
+	}
+}
+
+// RecordConfigRevision will add a revision to our config history and persist it.
+func (fs *fileStore) RecordConfigRevision(rev StreamConfigRevision) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	fs.hist = addConfigRevision(fs.hist, rev)
+
+	b, err := json.Marshal(fs.hist)
+	if err != nil {
+		return err
+	}
+	if fs.prf != nil {
+		// This will generate our meta key if we could not recover it.
+		if fs.aek == nil {
+			if err := fs.writeStreamMeta(); err != nil {
+				return err
+			}
+		}
+		nonce := make([]byte, fs.aek.NonceSize(), fs.aek.NonceSize()+len(b)+fs.aek.Overhead())
+		mrand.Read(nonce)
+		b = fs.aek.Seal(nonce, nonce, b, nil)
+	}
+	return writeFileAtomic(filepath.Join(fs.fcfg.StoreDir, JetStreamMetaFileHistory), b)
+}
+
+// ConfigHistory returns the config revisions we have, oldest first.
+func (fs *fileStore) ConfigHistory() []StreamConfigRevision {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return append([]StreamConfigRevision(nil), fs.hist...)
+}
+
+// archivedBlock is the local stub for a message block that has been archived.
+type archivedBlock struct {
+	Key      string       `json:"key"`
+	Size     uint64       `json:"size"`
+	Lchk     [8]byte      `json:"lchk"`
+	Checksum ChecksumType `json:"checksum"`
+}
+
+// How often we check for blocks to archive.
+var archiveInterval = time.Minute
+
+var (
+	errNoBlockArchive  = errors.New("message block is archived but no archive is configured")
+	errArchiveMismatch = errors.New("archived message block does not match")
+)
+
+func readArchiveStub(fn string) (*archivedBlock, error) {
+	buf, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	var ab archivedBlock
+	if err := json.Unmarshal(buf, &ab); err != nil {
+		return nil, err
+	}
+	return &ab, nil
+}
+
+// Returns the checksum type of the given hash.
+func checksumTypeOf(hh hash.Hash64) ChecksumType {
+	switch hh.(type) {
+	case crc32cHash:
+		return CRC32C
+	case noHash:
+		return NoChecksum
+	default:
+		return HighwayHash
+	}
+}
+
+// Will fetch the raw contents of an archived block and make sure it is the block
+// we archived. Seed and nonce are only needed if the block is encrypted.
+func (fs *fileStore) fetchArchived(ab *archivedBlock, seed, nonce []byte) ([]byte, error) {
+	arc := fs.fcfg.Archive
+	if arc == nil {
+		return nil, errNoBlockArchive
+	}
+	buf, err := arc.Get(ab.Key)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(buf)) != ab.Size {
+		return nil, errArchiveMismatch
+	}
+	if len(buf) < checksumSize {
+		return buf, nil
+	}
+	lchk := buf[len(buf)-checksumSize:]
+	if seed != nil {
+		bek, err := genBlockEncryptionKey(fs.fcfg.Cipher, seed, nonce)
+		if err != nil {
+			return nil, err
+		}
+		pbuf := make([]byte, len(buf))
+		bek.XORKeyStream(pbuf, buf)
+		lchk = pbuf[len(pbuf)-checksumSize:]
+	}
+	if !bytes.Equal(lchk, ab.Lchk[:]) {
+		return nil, errArchiveMismatch
+	}
+	return buf, nil
+}
+
+// Returns our seed and nonce if our block is encrypted.
+// Lock should be held.
+func (mb *msgBlock) archiveKeys() (seed, nonce []byte) {
+	if mb.bek == nil {
+		return nil, nil
+	}
+	return mb.seed, mb.nonce
+}
+
+// Will fetch our archived block, if we are about to load it, without holding
+// the lock so readers and writers are not held up by the archive.
+func (mb *msgBlock) prefetchArchived() {
+	mb.mu.RLock()
+	ab, needed := mb.arc, mb.abuf == nil && mb.cacheNotLoaded()
+	seed, nonce := mb.archiveKeys()
+	mb.mu.RUnlock()
+	if ab == nil || !needed {
+		return
+	}
+	// On an error we will try again once we hold the lock and report it then.
+	buf, err := mb.fs.fetchArchived(ab, seed, nonce)
+	if err != nil {
+		return
+	}
+	mb.mu.Lock()
+	if mb.arc == ab && mb.abuf == nil && mb.cacheNotLoaded() {
+		mb.abuf = buf
+	}
+	mb.mu.Unlock()
+}
+
+// Will return the raw contents of our archived block, using what was
+// prefetched if we have it.
+// Lock should be held.
+func (mb *msgBlock) fetchArchivedLocked() ([]byte, error) {
+	if buf := mb.abuf; buf != nil {
+		mb.abuf = nil
+		return buf, nil
+	}
+	seed, nonce := mb.archiveKeys()
+	return mb.fs.fetchArchived(mb.arc, seed, nonce)
+}
+
+// Will bring an archived block back to local disk before it is modified.
+// Lock should be held.
+func (mb *msgBlock) unarchive() error {
+	if mb.arc == nil {
+		return nil
+	}
+	buf, err := mb.fetchArchivedLocked()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(mb.mfn, buf, defaultFilePerms); err != nil {
+		return err
+	}
+	mb.dropArchive()
+	return nil
+}
+
+// Will remove the archived copy of this block, if any.
+// Lock should be held.
+func (mb *msgBlock) dropArchive() {
+	if mb.arc == nil {
+		return
+	}
+	key := mb.arc.Key
+	mb.arc, mb.abuf = nil, nil
+	if mb.afn != _EMPTY_ {
+		os.Remove(mb.afn)
+	}
+	mb.fs.deleteArchived(key)
+}
+
+// Will track archived blocks that need to be deleted until the archive confirms
+// they are. These are kept on disk so they are retried after a restart.
+func (fs *fileStore) deleteArchived(keys ...string) {
+	if fs.fcfg.Archive == nil || len(keys) == 0 {
+		return
+	}
+	fs.amu.Lock()
+	if fs.adel == nil {
+		fs.adel = make(map[string]struct{})
+	}
+	for _, key := range keys {
+		fs.adel[key] = struct{}{}
+	}
+	fs.writeArchiveDeletes()
+	fs.amu.Unlock()
+
+	select {
+	case fs.adch <- struct{}{}:
+	default:
+	}
+}
+
+// Will try to delete all archived blocks we are tracking, keeping any that fail.
+func (fs *fileStore) processArchiveDeletes() {
+	arc := fs.fcfg.Archive
+	fs.amu.Lock()
+	keys := make([]string, 0, len(fs.adel))
+	for key := range fs.adel {
+		keys = append(keys, key)
+	}
+	fs.amu.Unlock()
+	if len(keys) == 0 {
+		return
+	}
+
+	var deleted []string
+	for _, key := range keys {
+		if err := arc.Delete(key); err == nil {
+			deleted = append(deleted, key)
+		}
+	}
+
+	fs.amu.Lock()
+	for _, key := range deleted {
+		delete(fs.adel, key)
+	}
+	fs.writeArchiveDeletes()
+	fs.amu.Unlock()
+}
+
+// Lock for archive deletes should be held.
+func (fs *fileStore) writeArchiveDeletes() {
+	fn := filepath.Join(fs.fcfg.StoreDir, archiveDeletesFile)
+	if len(fs.adel) == 0 {
+		os.Remove(fn)
+		return
+	}
+	keys := make([]string, 0, len(fs.adel))
+	for key := range fs.adel {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if b, err := json.Marshal(keys); err == nil {
+		writeFileAtomic(fn, b)
+	}
+}
+
+// Will pick up any archived blocks we still need to delete.
+func (fs *fileStore) recoverArchiveDeletes() {
+	b, err := os.ReadFile(filepath.Join(fs.fcfg.StoreDir, archiveDeletesFile))
+	if err != nil {
+		return
+	}
+	var keys []string
+	if json.Unmarshal(b, &keys) != nil || len(keys) == 0 {
+		return
+	}
+	fs.amu.Lock()
+	fs.adel = make(map[string]struct{}, len(keys))
+	for _, key := range keys {
+		fs.adel[key] = struct{}{}
+	}
+	fs.amu.Unlock()
+	fs.adch <- struct{}{}
+}
+
+func (fs *fileStore) archiveLoop(adch, qch chan struct{}) {
+	t := time.NewTicker(archiveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			fs.processArchiveDeletes()
+			fs.archiveBlocks()
+		case <-adch:
+			fs.processArchiveDeletes()
+		case <-qch:
+			return
+		}
+	}
+}
+
+// Will archive the oldest blocks that are past our age threshold or while
+// our local blocks are over our size threshold. The last block is never archived.
+func (fs *fileStore) archiveBlocks() error {
+	fs.mu.RLock()
+	if fs.closed || fs.fcfg.Archive == nil {
+		fs.mu.RUnlock()
+		return nil
+	}
+	maxAge, maxBytes, qch := fs.fcfg.ArchiveAge, fs.fcfg.ArchiveBytes, fs.qch
+	var local uint64
+	var mbs []*msgBlock
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.arc == nil {
+			local += mb.rbytes
+			if mb != fs.lmb {
+				mbs = append(mbs, mb)
+			}
+		}
+		mb.mu.RUnlock()
+	}
+	fs.mu.RUnlock()
+
+	var cutoff int64
+	if maxAge > 0 {
+		cutoff = time.Now().Add(-maxAge).UnixNano()
+	}
+	for _, mb := range mbs {
+		mb.mu.RLock()
+		lts, rbytes := mb.last.ts, mb.rbytes
+		mb.mu.RUnlock()
+		// Blocks are in order so once one does not qualify none after it will.
+		if !(maxAge > 0 && lts < cutoff) && !(maxBytes > 0 && local > maxBytes) {
+			break
+		}
+		if err := fs.archiveBlock(mb, qch); err != nil {
+			return err
+		}
+		local -= rbytes
+	}
+	return nil
+}
+
+// Will upload a single block to our archive and replace it locally with a stub.
+func (fs *fileStore) archiveBlock(mb *msgBlock, qch chan struct{}) error {
+	arc := fs.fcfg.Archive
+
+	mb.mu.Lock()
+	if mb.arc != nil || mb.closed || mb.mfn == _EMPTY_ || mb.msgs == 0 {
+		mb.mu.Unlock()
+		return nil
+	}
+	buf, err := os.ReadFile(mb.mfn)
+	first, msgs, lchk, ct := mb.first.seq, mb.msgs, mb.lchk, checksumTypeOf(mb.hh)
+	mb.mu.Unlock()
+	if err != nil || len(buf) == 0 {
+		return err
+	}
+
+	// Pace our uploads as background I/O.
+	if !fs.fcfg.bgIO.wait(int64(len(buf)), qch) {
+		return ErrStoreClosed
+	}
+	key := fmt.Sprintf("%s/%d-%s.blk", fs.cfg.Name, mb.index, nuid.Next())
+	if err := arc.Put(key, buf); err != nil {
+		return err
+	}
+	ab := &archivedBlock{Key: key, Size: uint64(len(buf)), Lchk: lchk, Checksum: ct}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// Make sure the block did not change while we were uploading.
+	if mb.arc != nil || mb.closed || mb.mfn == _EMPTY_ || mb.rbytes != ab.Size || mb.lchk != lchk || mb.first.seq != first || mb.msgs != msgs {
+		fs.deleteArchived(key)
+		return nil
+	}
+	stub, err := json.Marshal(ab)
+	if err != nil {
+		return err
+	}
+	if mb.afn == _EMPTY_ {
+		mb.afn = filepath.Join(fs.fcfg.StoreDir, msgDir, fmt.Sprintf(arcScan, mb.index))
+	}
+	if err := os.WriteFile(mb.afn, stub, defaultFilePerms); err != nil {
+		fs.deleteArchived(key)
+		return err
+	}
+	// Make sure our index is current since recovery will rely on it.
+	mb.writeIndexInfoLocked()
+	if mb.mfd != nil {
+		mb.mfd.Close()
+		mb.mfd = nil
+		mb.trackFDs()
+	}
+	mb.arc = ab
+	os.Remove(mb.mfn)
+	return nil
+}
+
+// Pools to recycle the blocks to help with memory pressure.
+var blkPoolBig sync.Pool    // 16MB
+var blkPoolMedium sync.Pool // 8MB
+var blkPoolSmall sync.Pool  // 2MB
+
+// Get a new msg block based on sz estimate.
+func getMsgBlockBuf(sz int) (buf []byte) {
+	var pb interface{}
+	if sz <= defaultSmallBlockSize {
+		pb = blkPoolSmall.Get()
+	} else if sz <= defaultMediumBlockSize {
+		pb = blkPoolMedium.Get()
+	} else {
+		pb = blkPoolBig.Get()
+	}
+	if pb != nil {
+		buf = *(pb.(*[]byte))
+	} else {
+		// Here we need to make a new blk.
+		// If small leave as is..
+		if sz > defaultSmallBlockSize && sz <= defaultMediumBlockSize {
+			sz = defaultMediumBlockSize
+		} else if sz > defaultMediumBlockSize {
+			sz = defaultLargeBlockSize
+		}
+		buf = make([]byte, sz)
+	}
+	return buf[:0]
+}
+
+// Recycle the msg block.
+func recycleMsgBlockBuf(buf []byte) {
+	if buf == nil || cap(buf) < defaultSmallBlockSize {
+		return
+	}
+	// Make sure to reset before placing back into pool.
+	buf = buf[:0]
+
+	// We need to make sure the load code gets a block that can fit the maximum for a size block.
+	// E.g. 8, 16 etc. otherwise we thrash and actually make things worse by pulling it out, and putting
+	// it right back in and making a new []byte.
+	// From above we know its already >= defaultSmallBlockSize
+	if sz := cap(buf); sz < defaultMediumBlockSize {
+		blkPoolSmall.Put(&buf)
+	} else if sz < defaultLargeBlockSize {
+		blkPoolMedium.Put(&buf)
+	} else {
+		blkPoolBig.Put(&buf)
+	}
+}
+
+const (
+	msgHdrSize     = 22
+	checksumSize   = 8
+	emptyRecordLen = msgHdrSize + checksumSize
+)
+
+// This is the max room needed for index header.
+const indexHdrSize = 7*binary.MaxVarintLen64 + hdrLen + checksumSize
+
+// Lock should be held.
+func (fs *fileStore) noTrackSubjects() bool {
+	return !(len(fs.psim) > 0 || len(fs.cfg.Subjects) > 0 || fs.cfg.Mirror != nil || len(fs.cfg.Sources) > 0)
+}
+
+// Lock held on entry
+func (fs *fileStore) recoverMsgBlock(fi os.FileInfo, index uint32) (*msgBlock, error) {
+	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, noTrack: fs.noTrackSubjects(), syncAll: fs.fcfg.SyncAlways}
+
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	mb.mfn = filepath.Join(mdir, fmt.Sprintf(blkScan, index))
+	mb.ifn = filepath.Join(mdir, fmt.Sprintf(indexScan, index))
+	mb.sfn = filepath.Join(mdir, fmt.Sprintf(fssScan, index))
+	mb.afn = filepath.Join(mdir, fmt.Sprintf(arcScan, index))
+
+	// Check if this block has been archived. A local block always wins over the archived copy.
+	if stub, err := readArchiveStub(mb.afn); err == nil {
+		mb.arc = stub
+		if _, err := os.Stat(mb.mfn); err == nil {
+			mb.dropArchive()
+		} else {
+			mb.hh, _ = fs.newChecksumHash(stub.Checksum, index)
+		}
+	}
+
+	if mb.hh == nil {
+		mb.hh, _ = fs.newChecksumHash(fs.fcfg.Checksum, index)
+	}
+
+	var createdKeys bool
+
+	// Check if encryption is enabled.
+	if fs.prf != nil {
+		fs.recoverReKeyedBlock(mb)
+		ekey, err := os.ReadFile(filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index)))
+		if err != nil {
+			// We do not seem to have keys even though we should. Could be a plaintext conversion.
+			// Create the keys and we will double check below.
+			if err := fs.genEncryptionKeysForBlock(mb); err != nil {
+				return nil, err
+			}
+			createdKeys = true
+		} else {
+			if len(ekey) < minBlkKeySize {
+				return nil, errBadKeySize
+			}
+			// Recover key encryption key.
+			sc := fs.fcfg.Cipher
+			seed, nonce, old, err := fs.openKey(fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index), ekey)
+			if err != nil {
+				// We may be here on a cipher conversion, so attempt to convert.
+				if err = mb.convertCipher(); err != nil {
+					return nil, err
+				}
+			} else {
+				mb.seed, mb.nonce = seed, nonce
+				// Sealed under our previous key, will be re-encrypted in the background.
+				mb.rekey = old
+			}
+			mb.aek, err = genEncryptionKey(sc, mb.seed)
+			if err != nil {
+				return nil, err
+			}
+			if mb.bek, err = genBlockEncryptionKey(sc, mb.seed, mb.nonce); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// If we created keys here, let's check the data and if it is plaintext convert here.
+	if createdKeys {
+		if err := mb.convertToEncrypted(); err != nil {
+			return nil, err
+		}
+	}
+
+	// If archived trust our index if it matches the archived block, otherwise bring it back local.
+	if mb.arc != nil {
+		if !fs.fcfg.RebuildState && mb.readIndexInfo() == nil && mb.lchk == mb.arc.Lchk {
+			mb.rbytes, mb.cwp = mb.arc.Size, mb.arc.Size
+			if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
+				fs.populateGlobalPerSubjectInfo(mb)
+				mb.tryForceExpireCacheLocked()
+			}
+			fs.addMsgBlock(mb)
+			return mb, nil
+		}
+		if err := mb.unarchive(); err != nil {
+			return nil, err
+		}
+	}
+
+	// Open up the message file, but we will try to recover from the index file.
+	// We will check that the last checksums match.
+	file, err := os.Open(mb.mfn)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if fi, err := file.Stat(); fi != nil {
+		mb.rbytes = uint64(fi.Size())
+	} else {
+		return nil, err
+	}
+	// The block could have been written with a different checksum than configured.
+	// Index files record it and will override this, older ones need us to probe.
+	mb.detectChecksum(file)
+	// Grab last checksum from main block file.
+	var lchk [8]byte
+	if mb.rbytes >= checksumSize {
+		if mb.bek != nil {
+			if buf, _ := mb.loadBlock(nil); len(buf) >= checksumSize {
+				mb.bek.XORKeyStream(buf, buf)
+				copy(lchk[0:], buf[len(buf)-checksumSize:])
+			}
+		} else {
+			file.ReadAt(lchk[:], fi.Size()-checksumSize)
+		}
+	}
+
+	file.Close()
+
+	// If asked to rebuild, do not trust anything but the message block itself.
+	if fs.fcfg.RebuildState {
+		// Keep a copy of the block if committed messages have to be cut off.
+		mb.keepBad = true
+		ld, _ := mb.rebuildStateFromBlock()
+		mb.keepBad = false
+		if ld != nil {
+			fs.addLostData(ld)
+		}
+		if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
+			fs.populateGlobalPerSubjectInfo(mb)
+			mb.tryForceExpireCacheLocked()
+		}
+		// Index file will be written once we know our neighbors.
+		mb.closeFDs()
+		fs.addMsgBlock(mb)
+		return mb, nil
+	}
+
+	// Read our index file. Use this as source of truth if possible.
+	if err := mb.readIndexInfo(); err == nil {
+		// Quick sanity check here.
+		// Note this only checks that the message blk file is not newer then this file, or is empty and we expect empty.
+		if (mb.rbytes == 0 && mb.msgs == 0) || bytes.Equal(lchk[:], mb.lchk[:]) {
+			// Our last record matches so everything has been committed.
+			mb.cwp = mb.rbytes
+			if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
+				fs.populateGlobalPerSubjectInfo(mb)
+				// Try to dump any state we needed on recovery.
+				mb.tryForceExpireCacheLocked()
+			}
+			fs.addMsgBlock(mb)
+			return mb, nil
+		}
+	}
+
+	// Keep a copy of the block if committed messages have to be cut off.
+	mb.keepBad = true
+	// If we get data loss rebuilding the message block state record that with the fs itself.
+	ld, _ := mb.rebuildState()
+	mb.keepBad = false
+	if ld != nil {
 		fs.addLostData(ld)
 	}
-	if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
-		fs.populateGlobalPerSubjectInfo(mb)
-		// Try to dump any state we needed on recovery.
-		mb.tryForceExpireCacheLocked()
+	if mb.msgs > 0 && !mb.noTrack && fs.psim != nil {
+		fs.populateGlobalPerSubjectInfo(mb)
+		// Try to dump any state we needed on recovery.
+		mb.tryForceExpireCacheLocked()
+	}
+
+	// Rewrite this to make sure we are sync'd.
+	mb.writeIndexInfo()
+	mb.closeFDs()
+	fs.addMsgBlock(mb)
+	return mb, nil
+}
+
+// Returns true if the error recovering a block is due to its contents, and not
+// something that could be transient like missing files, file descriptors or permissions.
+func isDamagedBlockErr(err error) bool {
+	for _, derr := range []error{errBadMsg, errCorruptState, errBadKeySize, errBadBlockKey, errMsgBlkTooBig} {
+		if errors.Is(err, derr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Will move all files for a block we could not recover into the corrupt directory.
+// Lock should be held.
+func (fs *fileStore) moveDamagedBlock(index uint32, reason error) error {
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	cdir := filepath.Join(fs.fcfg.StoreDir, corruptDir)
+	if err := os.MkdirAll(cdir, defaultDirPerms); err != nil {
+		return err
+	}
+	db := DamagedBlock{Index: index, Reason: reason.Error(), Time: time.Now().UTC()}
+	for _, scan := range []string{blkScan, indexScan, fssScan, keyScan, arcScan} {
+		src := filepath.Join(mdir, fmt.Sprintf(scan, index))
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		dst := damagedFile(cdir, fmt.Sprintf(scan, index))
+		if err := os.Rename(src, dst); err != nil {
+			return err
+		}
+		db.Files = append(db.Files, filepath.Base(dst))
+	}
+	fs.addDamaged(db)
+	return nil
+}
+
+// Will copy our block file, and our encryption key if present, into the corrupt directory.
+// If ld is set the damaged block is also added to our report.
+// Lock should be held.
+func (mb *msgBlock) saveDamagedLocked(ld *LostStreamData, reason error) error {
+	cdir := filepath.Join(mb.fs.fcfg.StoreDir, corruptDir)
+	if err := os.MkdirAll(cdir, defaultDirPerms); err != nil {
+		return err
+	}
+	db := DamagedBlock{Index: mb.index, Reason: reason.Error(), Time: time.Now().UTC()}
+	if ld != nil && len(ld.Msgs) > 0 {
+		db.FirstSeq, db.LastSeq = ld.Msgs[0], ld.Msgs[len(ld.Msgs)-1]
+		db.Msgs, db.Bytes = uint64(len(ld.Msgs)), ld.Bytes
+	}
+	copyFile := func(src, name string) error {
+		sf, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer sf.Close()
+		dst := damagedFile(cdir, name)
+		df, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, defaultFilePerms)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(df, sf)
+		if cerr := df.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(dst)
+			return err
+		}
+		db.Files = append(db.Files, filepath.Base(dst))
+		return nil
+	}
+	if err := copyFile(mb.mfn, fmt.Sprintf(blkScan, mb.index)); err != nil {
+		return err
+	}
+	kfn := filepath.Join(mb.fs.fcfg.StoreDir, msgDir, fmt.Sprintf(keyScan, mb.index))
+	if _, err := os.Stat(kfn); err == nil {
+		if err := copyFile(kfn, fmt.Sprintf(keyScan, mb.index)); err != nil {
+			return err
+		}
+	}
+	if ld != nil {
+		mb.fs.addDamaged(db)
+	}
+	return nil
+}
+
+// Without index info a rebuild does not know which messages were cut off, so this
+// will walk the record headers of the plaintext block from the bad record on.
+// Lock should be held.
+func (mb *msgBlock) lostRecords(buf []byte, index uint32) []uint64 {
+	var seqs []uint64
+	le := binary.LittleEndian
+	for lbuf := uint32(len(buf)); index+msgHdrSize <= lbuf; {
+		rl := le.Uint32(buf[index:]) &^ hbit
+		if rl < msgHdrSize || rl > rlBadThresh || index+rl > lbuf {
+			break
+		}
+		if seq := le.Uint64(buf[index+4:]); seq != 0 && seq&ebit == 0 && seq > mb.last.seq {
+			seqs = append(seqs, seq)
+		}
+		index += rl
+	}
+	return seqs
+}
+
+// Returns a name in the corrupt directory that will not overwrite an earlier copy.
+func damagedFile(cdir, name string) string {
+	fn := filepath.Join(cdir, name)
+	if _, err := os.Stat(fn); err == nil {
+		fn = fmt.Sprintf("%s.%d", fn, time.Now().UnixNano())
+	}
+	return fn
+}
+
+// Records a damaged block and rewrites our report.
+func (fs *fileStore) addDamaged(db DamagedBlock) {
+	fs.dmu.Lock()
+	defer fs.dmu.Unlock()
+	fs.damaged = append(fs.damaged, db)
+	fs.writeDamagedReport()
+}
+
+// Drops any damaged blocks that match, along with their copies, since
+// the messages they held are no longer part of the stream.
+func (fs *fileStore) pruneDamaged(match func(db *DamagedBlock) bool) {
+	fs.dmu.Lock()
+	defer fs.dmu.Unlock()
+	var pruned bool
+	damaged := fs.damaged[:0]
+	for _, db := range fs.damaged {
+		if !match(&db) {
+			damaged = append(damaged, db)
+			continue
+		}
+		for _, fn := range db.Files {
+			os.Remove(filepath.Join(fs.fcfg.StoreDir, corruptDir, fn))
+		}
+		pruned = true
+	}
+	if !pruned {
+		return
 	}
+	if fs.damaged = damaged; len(fs.damaged) == 0 {
+		fs.damaged = nil
+	}
+	fs.writeDamagedReport()
+}
 
-	// Rewrite this to make sure we are sync'd.
-	mb.writeIndexInfo()
-	mb.closeFDs()
-	fs.addMsgBlock(mb)
-	return mb, nil
+// Will rewrite our report of damaged blocks, removing it when there are none.
+// Damaged lock should be held.
+func (fs *fileStore) writeDamagedReport() {
+	fn := filepath.Join(fs.fcfg.StoreDir, corruptDir, damagedReport)
+	if len(fs.damaged) == 0 {
+		os.Remove(fn)
+		return
+	}
+	if b, err := json.MarshalIndent(fs.damaged, _EMPTY_, "  "); err == nil {
+		os.WriteFile(fn, b, defaultFilePerms)
+	}
+}
+
+// Will load the report of damaged blocks if we have one.
+func (fs *fileStore) recoverDamaged() {
+	b, err := os.ReadFile(filepath.Join(fs.fcfg.StoreDir, corruptDir, damagedReport))
+	if err != nil {
+		return
+	}
+	var damaged []DamagedBlock
+	if err := json.Unmarshal(b, &damaged); err != nil {
+		return
+	}
+	fs.dmu.Lock()
+	fs.damaged = damaged
+	fs.dmu.Unlock()
+}
+
+// Returns a copy of all damaged blocks.
+func (fs *fileStore) damagedBlocks() []DamagedBlock {
+	fs.dmu.Lock()
+	defer fs.dmu.Unlock()
+	if len(fs.damaged) == 0 {
+		return nil
+	}
+	return append([]DamagedBlock(nil), fs.damaged...)
 }
 
 func (fs *fileStore) lostData() *LostStreamData {
@@ -825,6 +1979,9 @@ func (fs *fileStore) rebuildStateLocked(ld *LostStreamData) {
 
 // Attempt to convert the cipher used for this message block.
 func (mb *msgBlock) convertCipher() error {
+	if err := mb.unarchive(); err != nil {
+		return err
+	}
 	fs := mb.fs
 	sc := fs.fcfg.Cipher
 
@@ -856,7 +2013,7 @@ func (mb *msgBlock) convertCipher() error {
 	ns := kek.NonceSize()
 	seed, err := kek.Open(nil, ekey[:ns], ekey[ns:], nil)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", errBadBlockKey, err)
 	}
 	nonce := ekey[:ns]
 
@@ -892,11 +2049,243 @@ func (mb *msgBlock) convertCipher() error {
 	return nil
 }
 
+// Progress of re-encrypting message blocks under a new key. This is kept in
+// the store directory so it carries over restarts until we are done.
+type reKeyProgress struct {
+	Started time.Time `json:"started"`
+	Blocks  int       `json:"blocks"`
+	Done    int       `json:"done"`
+	Bytes   uint64    `json:"bytes"`
+}
+
+// Returns the number of message blocks still sealed under our previous key.
+func (fs *fileStore) reKeyPending() int {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	var n int
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.rekey {
+			n++
+		}
+		mb.mu.RUnlock()
+	}
+	return n
+}
+
+// Will re-encrypt all message blocks still sealed under our previous key,
+// bounded by the re-key I/O rate. Any blocks left when we are stopped will
+// be picked up again when the store is recovered.
+func (fs *fileStore) reKeyBlocks(qch chan struct{}) {
+	pfn := filepath.Join(fs.fcfg.StoreDir, reKeyProgressFile)
+	var rkp reKeyProgress
+	if buf, err := os.ReadFile(pfn); err == nil {
+		json.Unmarshal(buf, &rkp)
+	}
+	if rkp.Started.IsZero() {
+		rkp.Started = time.Now().UTC()
+	}
+	writeProgress := func() {
+		if b, err := json.Marshal(&rkp); err == nil {
+			writeFileAtomic(pfn, b)
+		}
+	}
+
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return
+	}
+	// Our last block can still take writes, so make sure it is sealed first.
+	if lmb := fs.lmb; lmb != nil {
+		lmb.mu.RLock()
+		rekey := lmb.rekey
+		lmb.mu.RUnlock()
+		if rekey {
+			fs.newMsgBlockForWrite()
+		}
+	}
+	var pending []*msgBlock
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.rekey {
+			pending = append(pending, mb)
+		}
+		mb.mu.RUnlock()
+	}
+	fs.mu.Unlock()
+
+	rkp.Blocks = rkp.Done + len(pending)
+	writeProgress()
+
+	for _, mb := range pending {
+		mb.mu.RLock()
+		n := mb.rbytes
+		mb.mu.RUnlock()
+		if !fs.fcfg.reKeyIO.wait(int64(n), qch) {
+			return
+		}
+		if err := mb.reKey(); err != nil {
+			return
+		}
+		rkp.Done++
+		rkp.Bytes += n
+		writeProgress()
+	}
+	os.Remove(pfn)
+}
+
+// Will re-encrypt this block with new keys generated from our current key.
+// The new block and key are staged without holding any locks, which are only
+// taken to swap them in. The key is swapped in first, which allows recovery to
+// tell if an interrupted swap needs to be completed.
+func (mb *msgBlock) reKey() error {
+	fs := mb.fs
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	keyFile := filepath.Join(mdir, fmt.Sprintf(keyScan, mb.index))
+	tkfn := filepath.Join(mdir, fmt.Sprintf(reKeyKeyScan, mb.index))
+	tmfn := filepath.Join(mdir, fmt.Sprintf(reKeyBlkScan, mb.index))
+	context := fmt.Sprintf("%s:%d", fs.cfg.Name, mb.index)
+	sc := fs.fcfg.Cipher
+
+	// The block could change while we are staging, e.g. compacted or erased,
+	// in which case we try again with what it has become.
+	for attempt := 0; attempt < 3; attempt++ {
+		mb.mu.Lock()
+		if !mb.rekey || mb.closed {
+			mb.mu.Unlock()
+			return nil
+		}
+		// Archived blocks keep their asset key, we only seal it under our current key.
+		if mb.arc != nil {
+			err := fs.resealKey(context, mb.seed, mb.nonce, keyFile)
+			if err == nil {
+				mb.rekey = false
+			}
+			mb.mu.Unlock()
+			return err
+		}
+		if buf, _ := mb.bytesPending(); len(buf) > 0 {
+			if _, err := mb.flushPendingMsgsLocked(); err != nil {
+				mb.mu.Unlock()
+				return err
+			}
+		}
+		oseed, ononce := mb.seed, mb.nonce
+		rbytes, lchk, first, msgs := mb.rbytes, mb.lchk, mb.first.seq, mb.msgs
+		mb.mu.Unlock()
+
+		buf, err := mb.loadBlock(nil)
+		if err != nil {
+			return err
+		}
+		obek, err := genBlockEncryptionKey(sc, oseed, ononce)
+		if err != nil {
+			recycleMsgBlockBuf(buf)
+			return err
+		}
+		obek.XORKeyStream(buf, buf)
+		aek, bek, seed, encrypted, err := fs.genEncryptionKeys(context)
+		if err != nil {
+			recycleMsgBlockBuf(buf)
+			return err
+		}
+		bek.XORKeyStream(buf, buf)
+		nonce := encrypted[:aek.NonceSize()]
+
+		err = writeFileAtomic(tkfn, encrypted)
+		if err == nil {
+			if err = writeFileAtomic(tmfn, buf); err != nil {
+				os.Remove(tkfn)
+			}
+		}
+		staged := uint64(len(buf))
+		recycleMsgBlockBuf(buf)
+		if err != nil {
+			return err
+		}
+
+		// Now swap in what we staged, as long as the block did not change.
+		fs.mu.Lock()
+		if fs.closed {
+			fs.mu.Unlock()
+			os.Remove(tkfn)
+			os.Remove(tmfn)
+			return ErrStoreClosed
+		}
+		mb.mu.Lock()
+		if fs.bim[mb.index] != mb || mb.closed || !mb.rekey || mb.arc != nil {
+			mb.mu.Unlock()
+			fs.mu.Unlock()
+			os.Remove(tkfn)
+			os.Remove(tmfn)
+			return nil
+		}
+		if mb.rbytes != rbytes || staged != rbytes || mb.lchk != lchk || mb.first.seq != first || mb.msgs != msgs {
+			mb.mu.Unlock()
+			fs.mu.Unlock()
+			os.Remove(tkfn)
+			os.Remove(tmfn)
+			continue
+		}
+		err = mb.swapReKeyedLocked(tkfn, tmfn, keyFile, aek, seed, nonce)
+		mb.mu.Unlock()
+		fs.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Will swap in a re-encrypted block and key that were staged.
+// Filestore lock and mb lock should be held.
+func (mb *msgBlock) swapReKeyedLocked(tkfn, tmfn, keyFile string, aek cipher.AEAD, seed, nonce []byte) error {
+	mb.closeFDsLockedNoCheck()
+	if err := os.Rename(tkfn, keyFile); err != nil {
+		os.Remove(tkfn)
+		os.Remove(tmfn)
+		return err
+	}
+	// From here on recovery will complete the swap if needed.
+	if err := os.Rename(tmfn, mb.mfn); err != nil {
+		return err
+	}
+
+	var err error
+	if mb.bek, err = genBlockEncryptionKey(mb.fs.fcfg.Cipher, seed, nonce); err != nil {
+		return err
+	}
+	mb.aek, mb.seed, mb.nonce, mb.kfn = aek, seed, nonce, keyFile
+	mb.rekey = false
+
+	// Our index is sealed with the asset key as well.
+	return mb.writeIndexInfoLocked()
+}
+
+// Will complete or discard re-encrypting a block that was interrupted.
+func (fs *fileStore) recoverReKeyedBlock(mb *msgBlock) {
+	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
+	tkfn := filepath.Join(mdir, fmt.Sprintf(reKeyKeyScan, mb.index))
+	tmfn := filepath.Join(mdir, fmt.Sprintf(reKeyBlkScan, mb.index))
+	if _, err := os.Stat(tkfn); err == nil {
+		// The key was not swapped in yet, so the block we have is still good.
+		os.Remove(tkfn)
+		os.Remove(tmfn)
+		return
+	}
+	if _, err := os.Stat(tmfn); err == nil {
+		// The key was swapped in, so we need the block that goes with it.
+		os.Rename(tmfn, mb.mfn)
+	}
+}
+
 // Convert a plaintext block to encrypted.
 func (mb *msgBlock) convertToEncrypted() error {
 	if mb.bek == nil {
 		return nil
 	}
+	if err := mb.unarchive(); err != nil {
+		return err
+	}
 	buf, err := mb.loadBlock(nil)
 	if err != nil {
 		return err
@@ -913,7 +2302,7 @@ func (mb *msgBlock) convertToEncrypted() error {
 		return err
 	}
 	if buf, err = os.ReadFile(mb.ifn); err == nil && len(buf) > 0 {
-		if err := checkHeader(buf); err != nil {
+		if _, err := checkIndexHeader(buf); err != nil {
 			return err
 		}
 		buf = mb.aek.Seal(buf[:0], mb.nonce, buf, nil)
@@ -930,9 +2319,117 @@ func (mb *msgBlock) rebuildState() (*LostStreamData, error) {
 	return mb.rebuildStateLocked()
 }
 
+// detectChecksum will determine the checksum used for this block by checking the
+// first record. If nothing matches we keep what we have.
+func (mb *msgBlock) detectChecksum(f *os.File) {
+	var le = binary.LittleEndian
+
+	readRecord := func(buf []byte) bool {
+		if _, err := f.ReadAt(buf, 0); err != nil {
+			return false
+		}
+		if mb.bek != nil {
+			bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+			if err != nil {
+				return false
+			}
+			bek.XORKeyStream(buf, buf)
+		}
+		return true
+	}
+
+	var hdr [msgHdrSize]byte
+	if !readRecord(hdr[:]) {
+		return
+	}
+	rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+	hasHeaders := rl&hbit != 0
+	rl &^= hbit
+	dlen := int(rl) - msgHdrSize
+	if dlen < checksumSize || int(slen) > dlen-checksumSize || rl > rlBadThresh {
+		return
+	}
+	buf := make([]byte, rl)
+	if !readRecord(buf) {
+		return
+	}
+	data := buf[msgHdrSize:]
+
+	for _, ct := range []ChecksumType{mb.fs.fcfg.Checksum, HighwayHash, CRC32C, NoChecksum} {
+		hh, err := mb.fs.newChecksumHash(ct, mb.index)
+		if err != nil {
+			continue
+		}
+		hh.Write(hdr[4:20])
+		hh.Write(data[:slen])
+		if hasHeaders && dlen-checksumSize >= int(slen)+4 {
+			hh.Write(data[slen+4 : dlen-checksumSize])
+		} else {
+			hh.Write(data[slen : dlen-checksumSize])
+		}
+		if bytes.Equal(hh.Sum(nil), data[dlen-checksumSize:]) {
+			mb.hh = hh
+			return
+		}
+	}
+}
+
+// rebuildStateFromBlock will rebuild all state by scanning the message block file,
+// only keeping what the block itself can not tell us from the index file. Removed
+// messages are only recorded there, in the delete map and the first sequence, so we
+// apply those if the index file is intact. Erased messages are marked in the block.
+func (mb *msgBlock) rebuildStateFromBlock() (*LostStreamData, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	// Per subject state will be regenerated from the block.
+	os.Remove(mb.sfn)
+
+	var first uint64
+	var last msgId
+	var dmap map[uint64]struct{}
+	if err := mb.readIndexInfo(); err == nil {
+		first, last, dmap = mb.first.seq, mb.last, mb.dmap
+	}
+	mb.first.seq, mb.first.ts = first, 0
+	mb.last.seq, mb.last.ts = 0, 0
+	mb.dmap = dmap
+
+	ld, err := mb.rebuildStateLocked()
+
+	if mb.msgs == 0 {
+		// Everything was removed, do not go back from what the index file knew.
+		if last.seq > mb.last.seq {
+			mb.last = last
+		}
+		mb.first.seq, mb.first.ts = mb.last.seq+1, 0
+		mb.dmap = nil
+	} else {
+		// Deletes outside of what we have are not tracked.
+		for seq := range mb.dmap {
+			if seq < mb.first.seq || seq > mb.last.seq {
+				delete(mb.dmap, seq)
+			}
+		}
+		if len(mb.dmap) == 0 {
+			mb.dmap = nil
+		}
+	}
+	return ld, err
+}
+
+// Rebuilds the block state from the block file, cutting off a bad record and
+// everything after it. Last is only moved past records that pass the checksum,
+// so a corrupt message is itself reported in the returned lost data.
+// Lock should be held.
 func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	startLastSeq := mb.last.seq
 
+	// We may truncate the block below so make sure it is local.
+	if err := mb.unarchive(); err != nil {
+		return nil, err
+	}
+
 	buf, err := mb.loadBlock(nil)
 	if err != nil || len(buf) == 0 {
 		var ld *LostStreamData
@@ -988,7 +2485,7 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 			fd = mb.mfd
 		} else {
 			fd, err = os.OpenFile(mb.mfn, os.O_RDWR, defaultFilePerms)
-			if err != nil {
+			if err == nil {
 				defer fd.Close()
 			}
 		}
@@ -1003,7 +2500,18 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 				copy(mb.lchk[0:], lchk[:])
 			}
 			fd.Sync()
+			mb.rbytes, mb.cwp = uint64(index), uint64(index)
+		}
+	}
+
+	// If we know how much we had committed, a bad record past that point is
+	// a torn write from a crash and not corruption of committed data.
+	cwp := mb.cwp
+	badRecord := func(index uint32) error {
+		if cwp > 0 && uint64(index) >= cwp {
+			return errTornWrite
 		}
+		return errBadMsg
 	}
 
 	gatherLost := func(lb uint32) *LostStreamData {
@@ -1015,10 +2523,28 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 		return &ld
 	}
 
+	// Cuts off a bad record and everything after it. If asked, a copy of the block is
+	// kept before committed messages are cut off, while the file is still intact.
+	cutOff := func(index uint32) (*LostStreamData, error) {
+		ld, err := gatherLost(uint32(len(buf))-index), badRecord(index)
+		if err == errBadMsg && mb.keepBad {
+			if len(ld.Msgs) == 0 {
+				ld.Msgs = mb.lostRecords(buf, index)
+			}
+			mb.saveDamagedLocked(ld, err)
+		}
+		truncate(index)
+		return ld, err
+	}
+
 	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
 		if index+msgHdrSize > lbuf {
 			truncate(index)
-			return gatherLost(lbuf - index), nil
+			var err error
+			if cwp > 0 {
+				err = badRecord(index)
+			}
+			return gatherLost(lbuf - index), err
 		}
 
 		hdr := buf[index : index+msgHdrSize]
@@ -1030,13 +2556,11 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 		dlen := int(rl) - msgHdrSize
 		// Do some quick sanity checks here.
 		if dlen < 0 || int(slen) > dlen || dlen > int(rl) || rl > rlBadThresh {
-			truncate(index)
-			return gatherLost(lbuf - index), errBadMsg
+			return cutOff(index)
 		}
 
 		if index+rl > lbuf {
-			truncate(index)
-			return gatherLost(lbuf - index), errBadMsg
+			return cutOff(index)
 		}
 
 		seq := le.Uint64(hdr[4:])
@@ -1067,10 +2591,6 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 			_, deleted = mb.dmap[seq]
 		}
 
-		// Always set last.
-		mb.last.seq = seq
-		mb.last.ts = ts
-
 		if !deleted {
 			data := buf[index+msgHdrSize : index+rl]
 			if hh := mb.hh; hh != nil {
@@ -1084,8 +2604,7 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 				}
 				checksum := hh.Sum(nil)
 				if !bytes.Equal(checksum, data[len(data)-8:]) {
-					truncate(index)
-					return gatherLost(lbuf - index), errBadMsg
+					return cutOff(index)
 				}
 				copy(mb.lchk[0:], checksum)
 			}
@@ -1114,6 +2633,10 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 				}
 			}
 		}
+		// Always set last, but only once the record has been validated above.
+		mb.last.seq = seq
+		mb.last.ts = ts
+
 		// Advance to next record.
 		index += rl
 	}
@@ -1122,6 +2645,8 @@ func (mb *msgBlock) rebuildStateLocked() (*LostStreamData, error) {
 	if mb.msgs == 0 && mb.first.seq > 0 {
 		mb.last.seq = mb.first.seq - 1
 	}
+	// Everything we have was valid.
+	mb.cwp = mb.rbytes
 
 	return nil, nil
 }
@@ -1142,11 +2667,31 @@ func (fs *fileStore) recoverMsgs() error {
 		return errNotReadable
 	}
 
+	// Pick up any blocks we could not recover before.
+	fs.recoverDamaged()
+
+	// Blocks we could not recover.
+	type failedBlock struct {
+		index uint32
+		err   error
+	}
+	var failed []failedBlock
+
 	// Recover all of the msg blocks.
 	// These can come in a random order, so account for that.
 	for _, fi := range fis {
 		var index uint32
-		if n, err := fmt.Sscanf(fi.Name(), blkScan, &index); err == nil && n == 1 {
+		n, err := fmt.Sscanf(fi.Name(), blkScan, &index)
+		if err != nil || n != 1 {
+			// Archived blocks only have a local stub.
+			if n, err = fmt.Sscanf(fi.Name(), arcScan, &index); err == nil && n == 1 {
+				if _, serr := os.Stat(filepath.Join(mdir, fmt.Sprintf(blkScan, index))); serr == nil {
+					// Will be picked up with the local block.
+					n = 0
+				}
+			}
+		}
+		if err == nil && n == 1 {
 			finfo, err := fi.Info()
 			if err != nil {
 				return err
@@ -1162,8 +2707,28 @@ func (fs *fileStore) recoverMsgs() error {
 				}
 				fs.state.Msgs += mb.msgs
 				fs.state.Bytes += mb.bytes
-			} else {
-				return err
+			} else if err != nil {
+				failed = append(failed, failedBlock{index, err})
+			}
+		}
+	}
+
+	// If no block could be recovered this is more likely a problem with our
+	// configuration, e.g. encryption keys, so fail. The same goes for errors that
+	// could be transient. Otherwise move the bad blocks aside and continue with
+	// the rest of the stream.
+	if len(failed) > 0 {
+		if len(fs.blks) == 0 {
+			return failed[0].err
+		}
+		for _, fb := range failed {
+			if !isDamagedBlockErr(fb.err) {
+				return fb.err
+			}
+		}
+		for _, fb := range failed {
+			if err := fs.moveDamagedBlock(fb.index, fb.err); err != nil {
+				return fb.err
 			}
 		}
 	}
@@ -1172,10 +2737,32 @@ func (fs *fileStore) recoverMsgs() error {
 	if len(fs.blks) > 0 {
 		sort.Slice(fs.blks, func(i, j int) bool { return fs.blks[i].index < fs.blks[j].index })
 		fs.lmb = fs.blks[len(fs.blks)-1]
+		// Pick up with the size we last chose.
+		if fs.fcfg.AdaptiveBlockSize {
+			fs.bsz = fs.lmb.tsz
+		}
 	} else {
 		_, err = fs.newMsgBlockForWrite()
 	}
 
+	// If we rebuilt from the message blocks alone, empty blocks will not know
+	// their sequences, so take them from the block before.
+	if fs.fcfg.RebuildState {
+		var prev *msgBlock
+		for _, mb := range fs.blks {
+			mb.mu.Lock()
+			if mb.rbytes == 0 && prev != nil {
+				mb.first.seq, mb.first.ts = prev.last.seq+1, 0
+				mb.last = prev.last
+			}
+			mb.writeIndexInfoLocked()
+			mb.closeFDsLocked()
+			mb.mu.Unlock()
+			prev = mb
+		}
+		fs.rebuildStateLocked(nil)
+	}
+
 	// Check if we encountered any lost data.
 	if fs.ld != nil {
 		var emptyBlks []*msgBlock
@@ -1694,6 +3281,99 @@ func (fs *fileStore) FilteredState(sseq uint64, subj string) SimpleState {
 	return ss
 }
 
+// SubjectsTotals returns the message totals for all matching subjects.
+// This only uses the global per subject index so no blocks need to be loaded.
+func (fs *fileStore) SubjectsTotals(filterSubject string) map[string]uint64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if len(fs.psim) == 0 {
+		return nil
+	}
+	// Fast path for a literal subject.
+	if filterSubject != _EMPTY_ && !subjectHasWildcard(filterSubject) {
+		if info := fs.psim[filterSubject]; info != nil {
+			return map[string]uint64{filterSubject: info.total}
+		}
+		return nil
+	}
+	isAll := filterSubject == _EMPTY_ || filterSubject == fwcs
+	fst := make(map[string]uint64)
+	for subj, info := range fs.psim {
+		if isAll || subjectIsSubsetMatch(subj, filterSubject) {
+			fst[subj] = info.total
+		}
+	}
+	return fst
+}
+
+// LastSeqsPerSubject returns the sequence of the last message for every subject
+// matching the filter in ascending order. The subject index tells us which block
+// holds the last message for a subject, so only those blocks are consulted.
+func (fs *fileStore) LastSeqsPerSubject(filterSubject string) []uint64 {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+
+	if len(fs.psim) == 0 {
+		return nil
+	}
+
+	// Group matching subjects by the block holding their last message.
+	byBlk := make(map[uint32][]string)
+	if filterSubject != _EMPTY_ && !subjectHasWildcard(filterSubject) {
+		if info := fs.psim[filterSubject]; info != nil {
+			byBlk[info.lblk] = []string{filterSubject}
+		}
+	} else {
+		isAll := filterSubject == _EMPTY_ || filterSubject == fwcs
+		for subj, info := range fs.psim {
+			if isAll || subjectIsSubsetMatch(subj, filterSubject) {
+				byBlk[info.lblk] = append(byBlk[info.lblk], subj)
+			}
+		}
+	}
+	if len(byBlk) == 0 {
+		return nil
+	}
+	lblks := make([]uint32, 0, len(byBlk))
+	for bi := range byBlk {
+		lblks = append(lblks, bi)
+	}
+	sort.Slice(lblks, func(i, j int) bool { return lblks[i] > lblks[j] })
+
+	// Walk blocks backwards. If a block no longer holds a subject, which can
+	// happen after removals, it carries over to the blocks before it.
+	var seqs []uint64
+	var active []string
+	for i, li := len(fs.blks)-1, 0; i >= 0; i-- {
+		mb := fs.blks[i]
+		for ; li < len(lblks) && lblks[li] >= mb.index; li++ {
+			active = append(active, byBlk[lblks[li]]...)
+		}
+		if len(active) == 0 {
+			if li == len(lblks) {
+				break
+			}
+			continue
+		}
+		mb.mu.Lock()
+		mb.ensurePerSubjectInfoLoaded()
+		remaining := active[:0]
+		for _, subj := range active {
+			if ss := mb.fss[subj]; ss != nil && ss.Msgs > 0 {
+				seqs = append(seqs, ss.Last)
+			} else {
+				remaining = append(remaining, subj)
+			}
+		}
+		active = remaining
+		mb.mu.Unlock()
+	}
+
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
 // SubjectsState returns a map of SimpleState for all matching subjects.
 func (fs *fileStore) SubjectsState(subject string) map[string]SimpleState {
 	fs.mu.RLock()
@@ -1763,6 +3443,44 @@ func (fs *fileStore) RegisterStorageUpdates(cb StorageUpdateHandler) {
 	}
 }
 
+// RegisterStorageQuotaCheck registers a check that is consulted before storing a new
+// message. Replicated raw stores are not checked so replicas can not diverge.
+func (fs *fileStore) RegisterStorageQuotaCheck(qc StorageQuotaChecker) {
+	fs.mu.Lock()
+	fs.sqc = qc
+	fs.mu.Unlock()
+}
+
+// RegisterStorageRemovals registers a handler that is given each message
+// right before it is removed because of limits or MaxAge.
+func (fs *fileStore) RegisterStorageRemovals(rh StorageRemovalHandler) {
+	fs.mu.Lock()
+	fs.rmh = rh
+	fs.mu.Unlock()
+}
+
+// RegisterConsumerOrphanCheck registers a callback that has to confirm an ephemeral
+// consumer is gone before we remove the state it left behind.
+func (fs *fileStore) RegisterConsumerOrphanCheck(och ConsumerOrphanChecker) {
+	fs.mu.Lock()
+	fs.och = och
+	fs.mu.Unlock()
+}
+
+// Removes a message because of limits, handing it to the removal handler first.
+// Lock should be held.
+func (fs *fileStore) removeMsgViaLimits(seq uint64) (bool, error) {
+	if fs.rmh != nil {
+		if mb := fs.selectMsgBlock(seq); mb != nil {
+			var smv StoreMsg
+			if sm, _, err := mb.fetchMsg(seq, &smv); err == nil && sm != nil {
+				fs.rmh(sm)
+			}
+		}
+	}
+	return fs.removeMsg(seq, false, false)
+}
+
 // Helper to get hash key for specific message block.
 // Lock should be held
 func (fs *fileStore) hashKeyForBlock(index uint32) []byte {
@@ -1800,6 +3518,16 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	if lmb := fs.lmb; lmb != nil {
 		index = lmb.index + 1
 
+		// Learn from the block we are rolling from.
+		if fs.fcfg.AdaptiveBlockSize {
+			lmb.mu.RLock()
+			rbytes, first, last := lmb.rbytes, lmb.first, lmb.last
+			lmb.mu.RUnlock()
+			if first.seq > 0 && last.seq >= first.seq {
+				fs.adaptBlockSize(rbytes, last.seq-first.seq+1, time.Duration(last.ts-first.ts))
+			}
+		}
+
 		// Make sure to write out our index file if needed.
 		if lmb.indexNeedsUpdate() {
 			lmb.writeIndexInfo()
@@ -1817,7 +3545,10 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 		}
 	}
 
-	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, noTrack: fs.noTrackSubjects()}
+	mb := &msgBlock{fs: fs, index: index, cexp: fs.fcfg.CacheExpire, noTrack: fs.noTrackSubjects(), syncAll: fs.fcfg.SyncAlways}
+	if fs.fcfg.AdaptiveBlockSize {
+		mb.tsz = fs.bsz
+	}
 
 	// Lock should be held to quiet race detector.
 	mb.mu.Lock()
@@ -1826,8 +3557,7 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	mb.mu.Unlock()
 
 	// Now do local hash.
-	key := sha256.Sum256(fs.hashKeyForBlock(index))
-	hh, err := highwayhash.New64(key[:])
+	hh, err := fs.newChecksumHash(fs.fcfg.Checksum, index)
 	if err != nil {
 		return nil, fmt.Errorf("could not create hash: %v", err)
 	}
@@ -1835,6 +3565,7 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 
 	mdir := filepath.Join(fs.fcfg.StoreDir, msgDir)
 	mb.mfn = filepath.Join(mdir, fmt.Sprintf(blkScan, mb.index))
+	mb.afn = filepath.Join(mdir, fmt.Sprintf(arcScan, mb.index))
 	mfd, err := os.OpenFile(mb.mfn, os.O_CREATE|os.O_RDWR, defaultFilePerms)
 	if err != nil {
 		mb.dirtyCloseWithRemove(true)
@@ -1864,6 +3595,7 @@ func (fs *fileStore) newMsgBlockForWrite() (*msgBlock, error) {
 	ts := time.Now().UnixNano()
 	// Race detector wants these protected.
 	mb.mu.Lock()
+	mb.trackFDs()
 	mb.llts, mb.lwts = 0, ts
 	// Remember our last sequence number.
 	mb.first.seq = fs.state.LastSeq + 1
@@ -1925,7 +3657,8 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		var asl bool
 		if psmax && psmc >= uint64(fs.cfg.MaxMsgsPer) {
 			// If we are instructed to discard new per subject, this is an error.
-			if fs.cfg.DiscardNewPer {
+			// Tombstones are always accepted and replace the oldest message instead.
+			if fs.cfg.DiscardNewPer && !isTombstone(hdr) {
 				return ErrMaxMsgsPerSubject
 			}
 			fseq, err = fs.firstSeqForSubj(subj)
@@ -1937,8 +3670,10 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		if fs.cfg.MaxMsgs > 0 && fs.state.Msgs >= uint64(fs.cfg.MaxMsgs) && !asl {
 			return ErrMaxMsgs
 		}
-		if fs.cfg.MaxBytes > 0 && fs.state.Bytes+uint64(len(msg)+len(hdr)) >= uint64(fs.cfg.MaxBytes) {
-			if !asl || fs.sizeForSeq(fseq) <= len(msg)+len(hdr) {
+		// Account for the full record, including subject and record overhead, the same way state.Bytes does.
+		if rl := fileStoreMsgSize(subj, hdr, msg); fs.cfg.MaxBytes > 0 && fs.state.Bytes+rl > uint64(fs.cfg.MaxBytes) {
+			// If we are at a subject maximum, determine if dropping the oldest message gives us enough room.
+			if !asl || fs.state.Bytes+rl-uint64(fs.sizeForSeq(fseq)) > uint64(fs.cfg.MaxBytes) {
 				return ErrMaxBytes
 			}
 		}
@@ -1990,7 +3725,7 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 		if fseq == 0 {
 			fseq, _ = fs.firstSeqForSubj(subj)
 		}
-		fs.removeMsg(fseq, false, false)
+		fs.removeMsgViaLimits(fseq)
 	}
 
 	// Limits checks and enforcement.
@@ -2008,8 +3743,15 @@ func (fs *fileStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 }
 
 // StoreRawMsg stores a raw message with expected sequence number and timestamp.
+// The sequence must be the next one for this store, or 0 to have one assigned.
+// If ts is 0 we will assign a timestamp as StoreMsg would.
 func (fs *fileStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	fs.mu.Lock()
+	if ts == 0 {
+		ts = fs.hlc.now()
+	} else {
+		fs.hlc.observe(ts)
+	}
 	err := fs.storeRawMsg(subj, hdr, msg, seq, ts)
 	cb := fs.scb
 	fs.mu.Unlock()
@@ -2023,8 +3765,25 @@ func (fs *fileStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts in
 
 // Store stores a message. We hold the main filestore lock for any write operation.
 func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	return fs.StoreMsgWithExpect(subj, hdr, msg, nil)
+}
+
+// StoreMsgWithExpect will store a message only if the expectations hold.
+func (fs *fileStore) StoreMsgWithExpect(subj string, hdr, msg []byte, exp *StoreExpect) (uint64, int64, error) {
 	fs.mu.Lock()
-	seq, ts := fs.state.LastSeq+1, time.Now().UnixNano()
+	if fs.cfg.Sealed {
+		fs.mu.Unlock()
+		return 0, 0, ErrStoreSealed
+	}
+	if err := fs.checkExpect(subj, exp); err != nil {
+		fs.mu.Unlock()
+		return 0, 0, err
+	}
+	if fs.sqc != nil && !fs.sqc(int64(fileStoreMsgSize(subj, hdr, msg))) {
+		fs.mu.Unlock()
+		return 0, 0, ErrStorageQuotaExceeded
+	}
+	seq, ts := fs.state.LastSeq+1, fs.hlc.now()
 	err := fs.storeRawMsg(subj, hdr, msg, seq, ts)
 	cb := fs.scb
 	fs.mu.Unlock()
@@ -2038,6 +3797,40 @@ func (fs *fileStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, erro
 	return seq, ts, err
 }
 
+// Check store expectations.
+// Lock should be held.
+func (fs *fileStore) checkExpect(subj string, exp *StoreExpect) error {
+	if exp == nil {
+		return nil
+	}
+	if exp.LastSeq != nil && *exp.LastSeq != fs.state.LastSeq {
+		return ErrStoreWrongLastSequence
+	}
+	if exp.LastSubjSeq != nil {
+		var lseq uint64
+		if sm, _ := fs.loadLastLocked(subj, nil); sm != nil {
+			lseq = sm.seq
+		}
+		if *exp.LastSubjSeq != lseq {
+			return ErrStoreWrongLastSubjectSequence
+		}
+	}
+	if exp.LastMsgId != _EMPTY_ {
+		var id string
+		if seq := fs.lastMsgSeqLocked(); seq > 0 {
+			if mb := fs.selectMsgBlock(seq); mb != nil {
+				if sm, _, _ := mb.fetchMsg(seq, nil); sm != nil {
+					id = string(getHeader(JSMsgId, sm.hdr))
+				}
+			}
+		}
+		if exp.LastMsgId != id {
+			return ErrStoreWrongLastMsgID
+		}
+	}
+	return nil
+}
+
 // skipMsg will update this message block for a skipped message.
 // If we do not have any messages, just update the metadata, otherwise
 // we will place and empty record marking the sequence as used. The
@@ -2097,6 +3890,104 @@ func (fs *fileStore) SkipMsg() uint64 {
 	return seq
 }
 
+// SkipMsgs will record a gap of num sequences starting at seq, which must be the
+// next sequence. If the last block already holds messages we start a new one so
+// the gap is kept in block metadata instead of writing a record per sequence.
+func (fs *fileStore) SkipMsgs(seq uint64, num uint64) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	if seq != fs.state.LastSeq+1 {
+		return ErrSequenceMismatch
+	}
+	if num == 0 {
+		return nil
+	}
+
+	// Grab time and last seq.
+	now, lseq := time.Now().UTC(), seq+num-1
+	fs.state.LastSeq, fs.state.LastTime = lseq, now
+	if fs.state.Msgs == 0 {
+		fs.state.FirstSeq, fs.state.FirstTime = lseq+1, now
+	}
+
+	mb := fs.lmb
+	mb.mu.RLock()
+	empty := mb.msgs == 0
+	mb.mu.RUnlock()
+
+	if !empty {
+		// This will pick up our new last sequence.
+		var err error
+		if mb, err = fs.newMsgBlockForWrite(); err != nil {
+			return err
+		}
+	}
+
+	nowts := now.UnixNano()
+	mb.mu.Lock()
+	mb.last.seq, mb.last.ts = lseq, nowts
+	mb.first.seq, mb.first.ts = lseq+1, nowts
+	err := mb.writeIndexInfoLocked()
+	mb.mu.Unlock()
+
+	return err
+}
+
+// UpdateFileStoreConfig will apply the parts of the file store config that can
+// be changed at runtime, CacheExpire, SyncInterval, CoalesceMinimum and MaxFlushWait.
+// Zero values will select the defaults.
+func (fs *fileStore) UpdateFileStoreConfig(fcfg FileStoreConfig) error {
+	if fcfg.CacheExpire < 0 || fcfg.SyncInterval < 0 || fcfg.CoalesceMinimum < 0 || fcfg.MaxFlushWait < 0 {
+		return fmt.Errorf("filestore timings can not be negative")
+	}
+	if fcfg.CacheExpire == 0 {
+		fcfg.CacheExpire = defaultCacheBufferExpiration
+	}
+	if fcfg.SyncInterval == 0 {
+		fcfg.SyncInterval = defaultSyncInterval
+	}
+	if fcfg.CoalesceMinimum == 0 {
+		fcfg.CoalesceMinimum = coalesceMinimum
+	}
+	if fcfg.MaxFlushWait == 0 {
+		fcfg.MaxFlushWait = maxFlushWait
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return ErrStoreClosed
+	}
+	fs.fcfg.CoalesceMinimum, fs.fcfg.MaxFlushWait = fcfg.CoalesceMinimum, fcfg.MaxFlushWait
+
+	if fcfg.SyncInterval != fs.fcfg.SyncInterval {
+		fs.fcfg.SyncInterval = fcfg.SyncInterval
+		// If the timer already fired syncBlocks will pick up the new interval.
+		if fs.syncTmr != nil && fs.syncTmr.Stop() {
+			fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+		}
+	}
+
+	if fcfg.CacheExpire != fs.fcfg.CacheExpire {
+		fs.fcfg.CacheExpire = fcfg.CacheExpire
+		for _, mb := range fs.blks {
+			mb.mu.Lock()
+			mb.cexp = fcfg.CacheExpire
+			if mb.ctmr != nil {
+				mb.resetCacheExpireTimer(mb.cexp)
+			}
+			mb.mu.Unlock()
+		}
+	}
+
+	return nil
+}
+
 // Lock should be held.
 func (fs *fileStore) rebuildFirst() {
 	if len(fs.blks) == 0 {
@@ -2209,55 +4100,224 @@ func (fs *fileStore) enforceMsgPerSubjectLimit() {
 	for subj, info := range needAttention {
 		total, start, stop := info.total, info.fblk, info.lblk
 
-		for i := start; i <= stop; i++ {
-			mb := fs.bim[i]
-			if mb == nil {
-				continue
+		for i := start; i <= stop; i++ {
+			mb := fs.bim[i]
+			if mb == nil {
+				continue
+			}
+			// Grab the ss entry for this subject in case sparse.
+			mb.mu.Lock()
+			mb.ensurePerSubjectInfoLoaded()
+			ss := mb.fss[subj]
+			mb.mu.Unlock()
+			if ss == nil {
+				continue
+			}
+			for seq := ss.First; seq <= ss.Last && total > maxMsgsPer; {
+				m, _, err := mb.firstMatching(subj, false, seq, &sm)
+				if err == nil {
+					seq = m.seq + 1
+					if removed, _ := fs.removeMsgViaLimits(m.seq); removed {
+						total--
+						blks[mb] = struct{}{}
+					}
+				} else {
+					// On error just do single increment.
+					seq++
+				}
+			}
+		}
+	}
+
+	// Now write updated index for all affected msgBlks.
+	for mb := range blks {
+		mb.writeIndexInfo()
+		mb.tryForceExpireCacheLocked()
+	}
+}
+
+// Only used when enforcing limits.
+// Lock should be held.
+func (fs *fileStore) deleteFirstMsg() (bool, error) {
+	return fs.removeMsgViaLimits(fs.state.FirstSeq)
+}
+
+// RemoveMsg will remove the message from this store.
+// Will return the number of bytes removed.
+func (fs *fileStore) RemoveMsg(seq uint64) (bool, error) {
+	if fs.isSealed() {
+		return false, ErrStoreSealed
+	}
+	return fs.removeMsg(seq, false, true)
+}
+
+func (fs *fileStore) EraseMsg(seq uint64) (bool, error) {
+	if fs.isSealed() {
+		return false, ErrStoreSealed
+	}
+	return fs.removeMsg(seq, true, true)
+}
+
+// Returns if the stream has been sealed, meaning no messages can be added or removed.
+func (fs *fileStore) isSealed() bool {
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	return fs.cfg.Sealed
+}
+
+// RemoveMsgs will remove all of the messages for the given sequences.
+// Sequences are grouped by message block so that each block touched is only
+// locked, checked for compaction and has its index updated once.
+// Will return the number of messages removed.
+func (fs *fileStore) RemoveMsgs(seqs []uint64) (uint64, error) {
+	if len(seqs) == 0 {
+		return 0, nil
+	}
+	if fs.isSealed() {
+		return 0, ErrStoreSealed
+	}
+	// Process in order so we can walk the blocks.
+	seqs = append([]uint64(nil), seqs...)
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+	type rmsg struct {
+		seq  uint64
+		subj string
+		sz   uint64
+	}
+	var removed []rmsg
+	var err error
+
+	fs.mu.Lock()
+	if fs.closed {
+		fs.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	if fs.sips > 0 {
+		fs.mu.Unlock()
+		return 0, ErrStoreSnapshotInProgress
+	}
+
+	var firstSeqNeedsUpdate bool
+	for i := 0; i < len(seqs); {
+		mb := fs.selectMsgBlock(seqs[i])
+		if mb == nil {
+			i++
+			continue
+		}
+
+		mb.mu.Lock()
+		if mb.cacheNotLoaded() {
+			if err = mb.loadMsgsWithLock(); err != nil {
+				mb.mu.Unlock()
+				break
+			}
+		}
+		mb.ensurePerSubjectInfoLoaded()
+
+		hadFirst := mb.first.seq == fs.state.FirstSeq
+		nr := len(removed)
+		var smv StoreMsg
+		for ; i < len(seqs) && seqs[i] <= mb.last.seq; i++ {
+			seq := seqs[i]
+			// Skip duplicates and anything already removed.
+			if seq < mb.first.seq || (i > 0 && seqs[i-1] == seq) {
+				continue
+			}
+			if _, ok := mb.dmap[seq]; ok {
+				continue
+			}
+			sm, err := mb.cacheLookup(seq, &smv)
+			if err != nil {
+				continue
+			}
+			msz := fileStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+			fs.state.Msgs--
+			fs.state.Bytes -= msz
+			mb.msgs--
+			mb.bytes -= msz
+			mb.removeSeqPerSubject(sm.subj, seq, &smv)
+			fs.removePerSubject(sm.subj)
+			removed = append(removed, rmsg{seq, sm.subj, msz})
+
+			if seq == mb.first.seq {
+				mb.selectNextFirst()
+			} else if mb.msgs > 0 {
+				if mb.dmap == nil {
+					mb.dmap = make(map[uint64]struct{})
+				}
+				mb.dmap[seq] = struct{}{}
+			}
+		}
+
+		// Nothing changed in this block.
+		if len(removed) == nr {
+			mb.mu.Unlock()
+			continue
+		}
+		mb.lrts = time.Now().UnixNano()
+
+		isLastBlock := mb == fs.lmb
+		if mb.msgs == 0 {
+			if isLastBlock {
+				mb.closeAndKeepIndex()
+			} else {
+				fs.removeMsgBlock(mb)
 			}
-			// Grab the ss entry for this subject in case sparse.
-			mb.mu.Lock()
-			mb.ensurePerSubjectInfoLoaded()
-			ss := mb.fss[subj]
+			firstSeqNeedsUpdate = firstSeqNeedsUpdate || hadFirst
 			mb.mu.Unlock()
-			if ss == nil {
-				continue
+			continue
+		}
+
+		if hadFirst {
+			fs.state.FirstSeq = mb.first.seq
+			fs.state.FirstTime = time.Unix(0, mb.first.ts).UTC()
+		}
+		// Check if <25% utilization and minimum size met.
+		if mb.rbytes > compactMinimum && !isLastBlock {
+			rbytes := mb.rbytes - uint64(len(mb.dmap)*emptyRecordLen)
+			if rbytes>>2 > mb.bytes && fs.fcfg.bgIO.allow(int64(mb.rbytes)) {
+				mb.compact()
 			}
-			for seq := ss.First; seq <= ss.Last && total > maxMsgsPer; {
-				m, _, err := mb.firstMatching(subj, false, seq, &sm)
-				if err == nil {
-					seq = m.seq + 1
-					if removed, _ := fs.removeMsg(m.seq, false, false); removed {
-						total--
-						blks[mb] = struct{}{}
-					}
-				} else {
-					// On error just do single increment.
-					seq++
-				}
+		}
+		if fs.fip {
+			mb.writeIndexInfoLocked()
+		}
+		fch := mb.fch
+		mb.mu.Unlock()
+
+		// Kick the flusher to write our index.
+		if !fs.fip {
+			if fch == nil {
+				mb.spinUpFlushLoop()
+				mb.mu.RLock()
+				fch = mb.fch
+				mb.mu.RUnlock()
+			}
+			select {
+			case fch <- struct{}{}:
+			default:
 			}
 		}
 	}
 
-	// Now write updated index for all affected msgBlks.
-	for mb := range blks {
-		mb.writeIndexInfo()
-		mb.tryForceExpireCacheLocked()
+	if firstSeqNeedsUpdate {
+		fs.selectNextFirst()
+		if len(fs.blks) > 0 {
+			fs.blks[0].writeIndexInfo()
+		}
 	}
-}
-
-// Lock should be held.
-func (fs *fileStore) deleteFirstMsg() (bool, error) {
-	return fs.removeMsg(fs.state.FirstSeq, false, false)
-}
+	cb := fs.scb
+	fs.mu.Unlock()
 
-// RemoveMsg will remove the message from this store.
-// Will return the number of bytes removed.
-func (fs *fileStore) RemoveMsg(seq uint64) (bool, error) {
-	return fs.removeMsg(seq, false, true)
-}
+	// Storage updates.
+	if cb != nil {
+		for _, rm := range removed {
+			cb(-1, -int64(rm.sz), rm.seq, rm.subj)
+		}
+	}
 
-func (fs *fileStore) EraseMsg(seq uint64) (bool, error) {
-	return fs.removeMsg(seq, true, true)
+	return uint64(len(removed)), err
 }
 
 // Convenience function to remove per subject tracking at the filestore level.
@@ -2401,9 +4461,10 @@ func (fs *fileStore) removeMsg(seq uint64, secure, needFSLock bool) (bool, error
 		mb.dmap[seq] = struct{}{}
 		// Check if <25% utilization and minimum size met.
 		if mb.rbytes > compactMinimum && !isLastBlock {
-			// Remove the interior delete records
+			// Remove the interior delete records, unless over our background I/O rate
+			// in which case a later removal will pick this up.
 			rbytes := mb.rbytes - uint64(len(mb.dmap)*emptyRecordLen)
-			if rbytes>>2 > mb.bytes {
+			if rbytes>>2 > mb.bytes && fs.fcfg.bgIO.allow(int64(mb.rbytes)) {
 				mb.compact()
 			}
 		}
@@ -2431,6 +4492,10 @@ func (fs *fileStore) removeMsg(seq uint64, secure, needFSLock bool) (bool, error
 		if ld, _ := mb.flushPendingMsgsLocked(); ld != nil {
 			fs.rebuildStateLocked(ld)
 		}
+		// Make sure an erased record that was still pending is synced as well.
+		if fs.fcfg.EraseSync && mb.mfd != nil {
+			mb.fs.syncFile(mb.mfd)
+		}
 	}
 	// Check if we need to write the index file and we are flush in place (fip).
 	if shouldWriteIndex && fs.fip {
@@ -2494,6 +4559,9 @@ func (fs *fileStore) removeMsg(seq uint64, secure, needFSLock bool) (bool, error
 // writing new messages. We will silently bail on any issues with the underlying block and let someone else detect.
 // Write lock needs to be held.
 func (mb *msgBlock) compact() {
+	if err := mb.unarchive(); err != nil {
+		return
+	}
 	wasLoaded := mb.cacheAlreadyLoaded()
 	if !wasLoaded {
 		if err := mb.loadMsgsWithLock(); err != nil {
@@ -2708,7 +4776,12 @@ func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 				ts := 1 * time.Millisecond
 				var waited time.Duration
 
-				for waiting < coalesceMinimum {
+				// These can be changed at runtime.
+				mb.fs.mu.RLock()
+				minPending, maxWait := mb.fs.fcfg.CoalesceMinimum, mb.fs.fcfg.MaxFlushWait
+				mb.fs.mu.RUnlock()
+
+				for waiting < minPending {
 					time.Sleep(ts)
 					select {
 					case <-qch:
@@ -2716,7 +4789,7 @@ func (mb *msgBlock) flushLoop(fch, qch chan struct{}) {
 					default:
 					}
 					newWaiting := mb.pendingWriteSize()
-					if waited = waited + ts; waited > maxFlushWait || newWaiting <= waiting {
+					if waited = waited + ts; waited > maxWait || newWaiting <= waiting {
 						break
 					}
 					waiting = newWaiting
@@ -2753,45 +4826,68 @@ func (mb *msgBlock) eraseMsg(seq uint64, ri, rl int) error {
 	le.PutUint64(hdr[12:], 0)
 	le.PutUint16(hdr[20:], 0)
 
-	// Randomize record
-	data := make([]byte, rl-emptyRecordLen)
-	mrand.Read(data)
+	fcfg := &mb.fs.fcfg
+	passes := fcfg.ErasePasses
+	if passes <= 0 {
+		passes = 1
+	}
+	// Only open the file if the record has already been written out.
+	// Otherwise it is still pending in our cache and will be flushed erased.
+	onDisk := mb.cache.off+mb.cache.wp > ri
 
-	// Now write to underlying buffer.
+	var mfd *os.File
+	if onDisk {
+		if err := mb.unarchive(); err != nil {
+			return err
+		}
+		var err error
+		if mfd, err = os.OpenFile(mb.mfn, os.O_RDWR, defaultFilePerms); err != nil {
+			return err
+		}
+		defer mfd.Close()
+	}
+
+	data := make([]byte, rl-emptyRecordLen)
 	var b bytes.Buffer
-	b.Write(hdr[:])
-	b.Write(data)
 
-	// Calculate hash.
-	mb.hh.Reset()
-	mb.hh.Write(hdr[4:20])
-	mb.hh.Write(data)
-	checksum := mb.hh.Sum(nil)
-	// Write to msg record.
-	b.Write(checksum)
+	for i := 0; i < passes; i++ {
+		// Randomize record unless asked to zero it out.
+		if !fcfg.EraseZero {
+			mrand.Read(data)
+		}
 
-	// Update both cache and disk.
-	nbytes := b.Bytes()
+		// Now write to underlying buffer.
+		b.Reset()
+		b.Write(hdr[:])
+		b.Write(data)
 
-	// Cache
-	if ri >= mb.cache.off {
-		li := ri - mb.cache.off
-		buf := mb.cache.buf[li : li+rl]
-		copy(buf, nbytes)
-	}
+		// Calculate hash.
+		mb.hh.Reset()
+		mb.hh.Write(hdr[4:20])
+		mb.hh.Write(data)
+		checksum := mb.hh.Sum(nil)
+		// Write to msg record.
+		b.Write(checksum)
 
-	// Disk
-	if mb.cache.off+mb.cache.wp > ri {
-		mfd, err := os.OpenFile(mb.mfn, os.O_RDWR, defaultFilePerms)
-		if err != nil {
-			return err
-		}
-		defer mfd.Close()
-		if _, err = mfd.WriteAt(nbytes, int64(ri)); err == nil {
-			mfd.Sync()
+		// Update both cache and disk.
+		nbytes := b.Bytes()
+
+		// Cache, which includes any pending writes.
+		if ri >= mb.cache.off {
+			li := ri - mb.cache.off
+			buf := mb.cache.buf[li : li+rl]
+			copy(buf, nbytes)
 		}
-		if err != nil {
-			return err
+
+		// Disk
+		if mfd != nil {
+			if _, err := mfd.WriteAt(nbytes, int64(ri)); err != nil {
+				return err
+			}
+			// Sync every pass, otherwise the writes can be merged and only the last one reaches the disk.
+			if err := mfd.Sync(); err != nil {
+				return err
+			}
 		}
 	}
 	return nil
@@ -2848,7 +4944,10 @@ func (mb *msgBlock) truncate(sm *StoreMsg) (nmsgs, nbytes uint64, err error) {
 	// Truncate our msgs and close file.
 	if mb.mfd != nil {
 		mb.mfd.Truncate(eof)
-		mb.mfd.Sync()
+		mb.fs.syncFile(mb.mfd)
+		if mb.cwp > uint64(eof) {
+			mb.cwp = uint64(eof)
+		}
 		// Update our checksum.
 		var lchk [8]byte
 		mb.mfd.ReadAt(lchk[:], eof-8)
@@ -3081,14 +5180,14 @@ func (mb *msgBlock) expireCacheLocked() {
 }
 
 func (fs *fileStore) startAgeChk() {
-	if fs.ageChk == nil && fs.cfg.MaxAge != 0 {
+	if fs.ageChk == nil && fs.cfg.MaxAge != 0 && !fs.cfg.Sealed {
 		fs.ageChk = time.AfterFunc(fs.cfg.MaxAge, fs.expireMsgs)
 	}
 }
 
 // Lock should be held.
 func (fs *fileStore) resetAgeChk(delta int64) {
-	if fs.cfg.MaxAge == 0 {
+	if fs.cfg.MaxAge == 0 || fs.cfg.Sealed {
 		return
 	}
 
@@ -3096,86 +5195,330 @@ func (fs *fileStore) resetAgeChk(delta int64) {
 	if delta > 0 && time.Duration(delta) < fireIn {
 		fireIn = time.Duration(delta)
 	}
-	if fs.ageChk != nil {
-		fs.ageChk.Reset(fireIn)
-	} else {
-		fs.ageChk = time.AfterFunc(fireIn, fs.expireMsgs)
+	if fs.ageChk != nil {
+		fs.ageChk.Reset(fireIn)
+	} else {
+		fs.ageChk = time.AfterFunc(fireIn, fs.expireMsgs)
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) cancelAgeChk() {
+	if fs.ageChk != nil {
+		fs.ageChk.Stop()
+		fs.ageChk = nil
+	}
+}
+
+// Will expire msgs that are too old.
+func (fs *fileStore) expireMsgs() {
+	// We need to delete one by one here and can not optimize for the time being.
+	// Reason is that we need more information to adjust ack pending in consumers.
+	var smv StoreMsg
+	var sm *StoreMsg
+	fs.mu.Lock()
+	// Sealed streams do not expire messages.
+	if fs.cfg.Sealed {
+		fs.cancelAgeChk()
+		fs.mu.Unlock()
+		return
+	}
+	minAge := time.Now().UnixNano() - int64(fs.cfg.MaxAge)
+	rmh := fs.rmh
+	fs.mu.Unlock()
+	for sm, _ = fs.msgForSeq(0, &smv); sm != nil && sm.ts <= minAge; sm, _ = fs.msgForSeq(0, &smv) {
+		if rmh != nil {
+			rmh(sm)
+		}
+		fs.removeMsg(sm.seq, false, true)
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Onky cancel if no message left, not on potential lookup error that would result in sm == nil.
+	if fs.state.Msgs == 0 {
+		fs.cancelAgeChk()
+	} else {
+		if sm == nil {
+			fs.resetAgeChk(0)
+		} else {
+			fs.resetAgeChk(sm.ts - minAge)
+		}
+	}
+}
+
+// Lock should be held.
+func (fs *fileStore) checkAndFlushAllBlocks() {
+	for _, mb := range fs.blks {
+		if mb.pendingWriteSize() > 0 {
+			// Since fs lock is held need to pull this apart in case we need to rebuild state.
+			mb.mu.Lock()
+			ld, _ := mb.flushPendingMsgsLocked()
+			mb.mu.Unlock()
+			if ld != nil {
+				fs.rebuildStateLocked(ld)
+			}
+		}
+		if mb.indexNeedsUpdate() {
+			mb.writeIndexInfo()
+		}
+	}
+}
+
+// This will check all the checksums on messages and report back any sequence numbers with errors.
+func (fs *fileStore) checkMsgs() *LostStreamData {
+	fs.mu.Lock()
+	fs.checkAndFlushAllBlocks()
+	blks, qch := copyMsgBlocks(fs.blks), fs.qch
+	fs.mu.Unlock()
+
+	var scanned uint64
+	for _, mb := range blks {
+		// Pace our scan of the last block as background I/O.
+		if !fs.fcfg.bgIO.wait(int64(scanned), qch) {
+			break
+		}
+		// We only hold the store lock for one block at a time.
+		fs.mu.Lock()
+		// Could have been removed while we were not holding the lock.
+		if fs.closed || fs.bim[mb.index] != mb {
+			fs.mu.Unlock()
+			continue
+		}
+		mb.mu.RLock()
+		scanned = mb.rbytes
+		mb.mu.RUnlock()
+		if ld, err := mb.rebuildState(); err != nil && ld != nil {
+			// Rebuild fs state too.
+			fs.rebuildStateLocked(ld)
+		}
+		fs.mu.Unlock()
+	}
+
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	// Regenerate any global subject state from the rebuilt blocks.
+	fs.psim = make(map[string]*psi)
+	for _, mb := range fs.blks {
+		fs.populateGlobalPerSubjectInfo(mb)
+	}
+
+	return fs.ld
+}
+
+// BlockHealth reports the result of verifying a single message block.
+type BlockHealth struct {
+	Index       uint32   `json:"index"`
+	Corrupt     []uint64 `json:"corrupt,omitempty"`
+	Quarantined bool     `json:"quarantined,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// FileStoreHealth is the result of a health check on the file store.
+type FileStoreHealth struct {
+	Checked int             `json:"checked"`
+	Blocks  []*BlockHealth  `json:"blocks,omitempty"`
+	Lost    *LostStreamData `json:"lost,omitempty"`
+}
+
+// Healthy returns true if no problems were found.
+func (h *FileStoreHealth) Healthy() bool {
+	return h != nil && len(h.Blocks) == 0
+}
+
+// HealthCheck will verify the checksums of all messages in the store, one block at a time,
+// and report back any corrupt sequences per block. If quarantine is true, a copy of each bad
+// block will be moved into the corrupt directory and the block state will be rebuilt from
+// the remaining data.
+func (fs *fileStore) HealthCheck(quarantine bool) *FileStoreHealth {
+	fs.mu.RLock()
+	blks := copyMsgBlocks(fs.blks)
+	qch := fs.qch
+	fs.mu.RUnlock()
+
+	var h FileStoreHealth
+	var rebuilt bool
+	var scanned uint64
+
+	for _, mb := range blks {
+		// Pace our scan of the last block as background I/O.
+		if !fs.fcfg.bgIO.wait(int64(scanned), qch) {
+			break
+		}
+		scanned = 0
+		// We only hold the store lock for one block at a time.
+		fs.mu.Lock()
+		if fs.closed {
+			fs.mu.Unlock()
+			break
+		}
+		// Could have been removed while we were not holding the lock.
+		if fs.bim[mb.index] != mb {
+			fs.mu.Unlock()
+			continue
+		}
+		h.Checked++
+
+		mb.mu.Lock()
+		scanned = mb.rbytes
+		ld, _ := mb.flushPendingMsgsLocked()
+		if ld != nil {
+			mb.mu.Unlock()
+			fs.rebuildStateLocked(ld)
+			mb.mu.Lock()
+		}
+		corrupt, err := mb.verifyLocked()
+		if err == nil && len(corrupt) == 0 {
+			mb.mu.Unlock()
+			fs.mu.Unlock()
+			continue
+		}
+		bh := &BlockHealth{Index: mb.index, Corrupt: corrupt}
+		if err != nil {
+			bh.Error = err.Error()
+		}
+		h.Blocks = append(h.Blocks, bh)
+
+		if !quarantine || len(corrupt) == 0 {
+			mb.mu.Unlock()
+			fs.mu.Unlock()
+			continue
+		}
+		if err := mb.quarantineLocked(corrupt); err != nil {
+			bh.Error = err.Error()
+			mb.mu.Unlock()
+			fs.mu.Unlock()
+			continue
+		}
+		bh.Quarantined = true
+		mb.clearCacheAndOffset()
+		ld, _ = mb.rebuildStateLocked()
+		mb.writeIndexInfoLocked()
+		mb.writePerSubjectInfo()
+		mb.mu.Unlock()
+		// Make sure we account for the corrupt messages even
+		// if the rebuild was not able to determine them.
+		if ld == nil || len(ld.Msgs) == 0 {
+			ld = &LostStreamData{Msgs: corrupt}
+		}
+		fs.rebuildStateLocked(ld)
+		rebuilt = true
+		fs.mu.Unlock()
+	}
+
+	fs.mu.Lock()
+	if rebuilt && !fs.closed {
+		// Subject state could have changed, so rebuild.
+		fs.psim = make(map[string]*psi)
+		for _, mb := range fs.blks {
+			fs.populateGlobalPerSubjectInfo(mb)
+		}
+	}
+	if fs.ld != nil {
+		ld := *fs.ld
+		h.Lost = &ld
 	}
+	fs.mu.Unlock()
+
+	return &h
 }
 
+// verifyLocked will check all records in the block without changing any state and will
+// return the sequences of any messages that are corrupt.
 // Lock should be held.
-func (fs *fileStore) cancelAgeChk() {
-	if fs.ageChk != nil {
-		fs.ageChk.Stop()
-		fs.ageChk = nil
+func (mb *msgBlock) verifyLocked() ([]uint64, error) {
+	buf, err := mb.loadBlock(nil)
+	if err != nil {
+		return nil, err
 	}
-}
+	defer recycleMsgBlockBuf(buf)
 
-// Will expire msgs that are too old.
-func (fs *fileStore) expireMsgs() {
-	// We need to delete one by one here and can not optimize for the time being.
-	// Reason is that we need more information to adjust ack pending in consumers.
-	var smv StoreMsg
-	var sm *StoreMsg
-	fs.mu.RLock()
-	minAge := time.Now().UnixNano() - int64(fs.cfg.MaxAge)
-	fs.mu.RUnlock()
-	for sm, _ = fs.msgForSeq(0, &smv); sm != nil && sm.ts <= minAge; sm, _ = fs.msgForSeq(0, &smv) {
-		fs.removeMsg(sm.seq, false, true)
+	if mb.bek != nil && len(buf) > 0 {
+		// Do not disturb our own key stream.
+		bek, err := genBlockEncryptionKey(mb.fs.fcfg.Cipher, mb.seed, mb.nonce)
+		if err != nil {
+			return nil, err
+		}
+		bek.XORKeyStream(buf, buf)
 	}
 
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
+	var corrupt []uint64
+	var le = binary.LittleEndian
+	var lseq uint64
 
-	// Onky cancel if no message left, not on potential lookup error that would result in sm == nil.
-	if fs.state.Msgs == 0 {
-		fs.cancelAgeChk()
-	} else {
-		if sm == nil {
-			fs.resetAgeChk(0)
-		} else {
-			fs.resetAgeChk(sm.ts - minAge)
+	// Everything live after the last good record is considered corrupt.
+	gatherRest := func() {
+		for seq := lseq + 1; seq <= mb.last.seq; seq++ {
+			if seq < mb.first.seq {
+				continue
+			}
+			if _, ok := mb.dmap[seq]; !ok {
+				corrupt = append(corrupt, seq)
+			}
 		}
 	}
-}
 
-// Lock should be held.
-func (fs *fileStore) checkAndFlushAllBlocks() {
-	for _, mb := range fs.blks {
-		if mb.pendingWriteSize() > 0 {
-			// Since fs lock is held need to pull this apart in case we need to rebuild state.
-			mb.mu.Lock()
-			ld, _ := mb.flushPendingMsgsLocked()
-			mb.mu.Unlock()
-			if ld != nil {
-				fs.rebuildStateLocked(ld)
-			}
+	for index, lbuf := uint32(0), uint32(len(buf)); index < lbuf; {
+		if index+msgHdrSize > lbuf {
+			gatherRest()
+			return corrupt, errBadMsg
 		}
-		if mb.indexNeedsUpdate() {
-			mb.writeIndexInfo()
+		hdr := buf[index : index+msgHdrSize]
+		rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < 0 || int(slen) > dlen || dlen > int(rl) || rl > rlBadThresh || index+rl > lbuf {
+			gatherRest()
+			return corrupt, errBadMsg
 		}
-	}
-}
-
-// This will check all the checksums on messages and report back any sequence numbers with errors.
-func (fs *fileStore) checkMsgs() *LostStreamData {
-	fs.mu.Lock()
-	defer fs.mu.Unlock()
-
-	fs.checkAndFlushAllBlocks()
-
-	// Clear any global subject state.
-	fs.psim = make(map[string]*psi)
+		seq := le.Uint64(hdr[4:])
+		index += rl
 
-	for _, mb := range fs.blks {
-		if ld, err := mb.rebuildState(); err != nil && ld != nil {
-			// Rebuild fs state too.
-			mb.fs.rebuildStateLocked(ld)
+		// Skip erased or deleted messages.
+		if seq == 0 || seq&ebit != 0 || seq < mb.first.seq {
+			lseq = seq &^ ebit
+			continue
 		}
-		fs.populateGlobalPerSubjectInfo(mb)
+		lseq = seq
+		if _, deleted := mb.dmap[seq]; deleted {
+			continue
+		}
+		if hh := mb.hh; hh != nil {
+			data := buf[index-rl+msgHdrSize : index]
+			hh.Reset()
+			hh.Write(hdr[4:20])
+			hh.Write(data[:slen])
+			if hasHeaders {
+				hh.Write(data[slen+4 : dlen-8])
+			} else {
+				hh.Write(data[slen : dlen-8])
+			}
+			if !bytes.Equal(hh.Sum(nil), data[len(data)-8:]) {
+				corrupt = append(corrupt, seq)
+			}
+		}
+	}
+	// Check if we are missing records from the end.
+	if lseq < mb.last.seq {
+		gatherRest()
 	}
+	if len(corrupt) > 0 {
+		return corrupt, errBadMsg
+	}
+	return nil, nil
+}
 
-	return fs.ld
+// quarantineLocked will place a copy of our block file, and our encryption key if
+// present, into the corrupt directory and add it to our report of damaged blocks.
+// Lock should be held.
+func (mb *msgBlock) quarantineLocked(corrupt []uint64) error {
+	if err := mb.unarchive(); err != nil {
+		return err
+	}
+	return mb.saveDamagedLocked(&LostStreamData{Msgs: corrupt}, errBadMsg)
 }
 
 // Lock should be held.
@@ -3191,6 +5534,7 @@ func (mb *msgBlock) enableForWriting(fip bool) error {
 		return fmt.Errorf("error opening msg block file [%q]: %v", mb.mfn, err)
 	}
 	mb.mfd = mfd
+	mb.trackFDs()
 
 	// Spin up our flusher loop if needed.
 	if !fip {
@@ -3215,6 +5559,9 @@ func (mb *msgBlock) writeMsgRecord(rl, seq uint64, subj string, mhdr, msg []byte
 		if err := mb.enableForWriting(flush); err != nil {
 			return err
 		}
+	} else {
+		// Mark us as most recently used.
+		mb.trackFDs()
 	}
 
 	// Check if we are tracking per subject for our simple state.
@@ -3309,6 +5656,13 @@ func (mb *msgBlock) writeMsgRecord(rl, seq uint64, subj string, mhdr, msg []byte
 		if err != nil {
 			return err
 		}
+		// If we are syncing always make sure this is on disk before we return.
+		if mb.syncAll && mb.mfd != nil {
+			if err := mb.fs.syncFile(mb.mfd); err != nil {
+				mb.werr = err
+				return err
+			}
+		}
 		if writeIndex {
 			// If this fails still proceed on since the write above succeeded.
 			// We can recover this condition.
@@ -3360,6 +5714,193 @@ func (mb *msgBlock) closeFDsLockedNoCheck() {
 		mb.ifd.Close()
 		mb.ifd = nil
 	}
+	mb.trackFDs()
+}
+
+// fdManager tracks message blocks with open file descriptors across all
+// filestores of a server. When over its maximum, the least recently used
+// blocks will have their descriptors closed. They will be lazily reopened.
+// A nil manager does not track or limit.
+type fdManager struct {
+	mu    sync.Mutex
+	max   int64
+	total int64
+	lru   *list.List
+	idx   map[*msgBlock]*list.Element
+}
+
+type fdEntry struct {
+	mb  *msgBlock
+	fds int64
+}
+
+// Returns a new fd manager that keeps at most max file descriptors open.
+func newFDManager(max int64) *fdManager {
+	return &fdManager{max: max, lru: list.New(), idx: make(map[*msgBlock]*list.Element)}
+}
+
+// Return number of open file descriptors being tracked.
+func (m *fdManager) open() int64 {
+	if m == nil {
+		return 0
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// update will record the number of open fds for this block and mark it as
+// most recently used. If we are over our limit it will return least recently
+// used blocks that should be closed.
+func (m *fdManager) update(mb *msgBlock, fds int64) []*msgBlock {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if e, ok := m.idx[mb]; ok {
+		fe := e.Value.(*fdEntry)
+		m.total += fds - fe.fds
+		if fds == 0 {
+			m.lru.Remove(e)
+			delete(m.idx, mb)
+			return nil
+		}
+		fe.fds = fds
+		m.lru.MoveToFront(e)
+	} else if fds > 0 {
+		m.idx[mb] = m.lru.PushFront(&fdEntry{mb, fds})
+		m.total += fds
+	}
+
+	max := m.max
+	if m.total <= max {
+		return nil
+	}
+	var evict []*msgBlock
+	for e, over := m.lru.Back(), m.total-max; e != nil && over > 0; e = e.Prev() {
+		if fe := e.Value.(*fdEntry); fe.mb != mb {
+			evict = append(evict, fe.mb)
+			over -= fe.fds
+		}
+	}
+	return evict
+}
+
+// Will update the tracking of open fds for this block and close
+// others if we are over our limit. Does nothing if we are not limited.
+// Lock should be held.
+func (mb *msgBlock) trackFDs() {
+	m := mb.fs.fcfg.blkFDs
+	if m == nil {
+		return
+	}
+	var fds int64
+	if mb.mfd != nil {
+		fds++
+	}
+	if mb.ifd != nil {
+		fds++
+	}
+	for _, omb := range m.update(mb, fds) {
+		// We can not block here since we hold our own lock.
+		if omb.mu.TryLock() {
+			omb.closeFDsLocked()
+			omb.mu.Unlock()
+		}
+	}
+}
+
+// ioThrottle limits the rate of background disk I/O, such as health check scans,
+// snapshot reads, compactions and purge deletions, across all filestores of a
+// server so they do not starve the write path. A nil throttle does not limit.
+type ioThrottle struct {
+	mu sync.RWMutex
+	rl *rate.Limiter
+}
+
+// Default bytes per second used to re-encrypt message blocks.
+const defaultReKeyRate = 32 * 1024 * 1024
+
+// Largest amount of I/O we will allow in a single burst.
+const maxBackgroundIOBurst = 8 * 1024 * 1024
+
+// Set the maximum bytes per second for background I/O.
+// Zero means no limit.
+func (t *ioThrottle) setRate(bps int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if bps <= 0 {
+		t.rl = nil
+		return
+	}
+	burst := bps
+	if burst > maxBackgroundIOBurst {
+		burst = maxBackgroundIOBurst
+	}
+	t.rl = rate.NewLimiter(rate.Limit(bps), int(burst))
+}
+
+// Will block until n bytes of background I/O are allowed or qch is closed.
+// Returns false if we were asked to quit.
+func (t *ioThrottle) wait(n int64, qch chan struct{}) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.RLock()
+	rl := t.rl
+	t.mu.RUnlock()
+	if rl == nil {
+		return true
+	}
+	for n > 0 {
+		c := n
+		if b := int64(rl.Burst()); c > b {
+			c = b
+		}
+		n -= c
+		r := rl.ReserveN(time.Now(), int(c))
+		if d := r.Delay(); d > 0 {
+			tm := time.NewTimer(d)
+			select {
+			case <-tm.C:
+			case <-qch:
+				tm.Stop()
+				r.Cancel()
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Will return if n bytes of background I/O are allowed right now, without blocking.
+// Used when locks are held, where the caller is expected to try again later.
+func (t *ioThrottle) allow(n int64) bool {
+	if t == nil {
+		return true
+	}
+	t.mu.RLock()
+	rl := t.rl
+	t.mu.RUnlock()
+	if rl == nil {
+		return true
+	}
+	if b := int64(rl.Burst()); n > b {
+		n = b
+	}
+	return rl.AllowN(time.Now(), int(n))
+}
+
+// Removes a purged directory, throttling the file deletions as background I/O.
+func removePurgeDir(pdir string, bgIO *ioThrottle) {
+	if entries, err := os.ReadDir(pdir); err == nil {
+		for _, e := range entries {
+			if fi, err := e.Info(); err == nil && !fi.IsDir() {
+				bgIO.wait(fi.Size(), nil)
+				os.Remove(filepath.Join(pdir, e.Name()))
+			}
+		}
+	}
+	os.RemoveAll(pdir)
 }
 
 // bytesPending returns the buffer to be used for writing to the underlying file.
@@ -3424,7 +5965,7 @@ func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg
 	}
 	// Grab our current last message block.
 	mb := fs.lmb
-	if mb == nil || mb.msgs > 0 && mb.blkSize()+rl > fs.fcfg.BlockSize {
+	if mb == nil || mb.msgs > 0 && mb.blkSize()+rl > fs.rollSize(mb) {
 		if mb, err = fs.newMsgBlockForWrite(); err != nil {
 			return 0, err
 		}
@@ -3438,10 +5979,23 @@ func (fs *fileStore) writeMsgRecord(seq uint64, ts int64, subj string, hdr, msg
 
 // Sync msg and index files as needed. This is called from a timer.
 func (fs *fileStore) syncBlocks() {
+	if !fs.syncMsgBlocks() {
+		return
+	}
+	fs.removeOrphanConsumers(false)
+
+	fs.mu.Lock()
+	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
+	fs.mu.Unlock()
+}
+
+// Flushes and syncs all of our message blocks.
+// Returns false if we are closed.
+func (fs *fileStore) syncMsgBlocks() bool {
 	fs.mu.RLock()
 	if fs.closed {
 		fs.mu.RUnlock()
-		return
+		return false
 	}
 	blks := append([]*msgBlock(nil), fs.blks...)
 	fs.mu.RUnlock()
@@ -3458,11 +6012,11 @@ func (fs *fileStore) syncBlocks() {
 		mb.mu.Lock()
 		if !mb.closed {
 			if mb.mfd != nil {
-				mb.mfd.Sync()
+				mb.fs.syncFile(mb.mfd)
 			}
 			if mb.ifd != nil {
 				mb.ifd.Truncate(mb.liwsz)
-				mb.ifd.Sync()
+				mb.fs.syncFile(mb.ifd)
 			}
 			// See if we can close FDs do to being idle.
 			if mb.ifd != nil || mb.mfd != nil && mb.sinceLastWriteActivity() > closeFDsIdle {
@@ -3471,19 +6025,105 @@ func (fs *fileStore) syncBlocks() {
 		}
 		mb.mu.Unlock()
 	}
+	return true
+}
+
+// ForceSync flushes and syncs all message blocks and writes out any pending
+// consumer state now, instead of waiting for the sync interval.
+func (fs *fileStore) ForceSync() error {
+	if !fs.syncMsgBlocks() {
+		return ErrStoreClosed
+	}
+	fs.mu.RLock()
+	cfs := append([]ConsumerStore(nil), fs.cfs...)
+	fs.mu.RUnlock()
+
+	for _, o := range cfs {
+		if err := o.Flush(); err != nil && err != ErrStoreClosed {
+			return err
+		}
+	}
+	return nil
+}
 
+// RollBlock will start a new message block for writes, so the current one
+// is no longer appended to. Returns the index of the block now taking writes.
+func (fs *fileStore) RollBlock() (uint32, error) {
 	fs.mu.Lock()
-	fs.syncTmr = time.AfterFunc(fs.fcfg.SyncInterval, fs.syncBlocks)
-	fs.mu.Unlock()
+	defer fs.mu.Unlock()
+
+	if fs.closed {
+		return 0, ErrStoreClosed
+	}
+	if lmb := fs.lmb; lmb != nil {
+		lmb.mu.Lock()
+		// Nothing to bound here.
+		if lmb.msgs == 0 {
+			lmb.mu.Unlock()
+			return lmb.index, nil
+		}
+		ld, err := lmb.flushPendingMsgsLocked()
+		lmb.mu.Unlock()
+		if ld != nil {
+			fs.rebuildStateLocked(ld)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	mb, err := fs.newMsgBlockForWrite()
+	if err != nil {
+		return 0, err
+	}
+	return mb.index, nil
+}
+
+// DropCaches releases the message caches held by our message blocks, regardless
+// of recent activity. Returns the number of blocks that released a cache.
+func (fs *fileStore) DropCaches() int {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return 0
+	}
+	blks := append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	var dropped int
+	for _, mb := range blks {
+		// Pending writes need to be flushed before the cache can go.
+		if mb.pendingWriteSize() > 0 {
+			mb.flushPendingMsgs()
+		}
+		mb.mu.Lock()
+		hadCache := mb.cache != nil && len(mb.cache.buf) > 0
+		// Clear activity so expiration does not hold on to the cache.
+		llts, lwts := mb.llts, mb.lwts
+		mb.llts, mb.lwts = 0, 0
+		mb.expireCacheLocked()
+		mb.llts, mb.lwts = llts, lwts
+		if hadCache && (mb.cache == nil || len(mb.cache.buf) == 0) {
+			dropped++
+		}
+		mb.mu.Unlock()
+	}
+	return dropped
 }
 
 // Select the message block where this message should be found.
 // Return nil if not in the set.
 // Read lock should be held.
 func (fs *fileStore) selectMsgBlock(seq uint64) *msgBlock {
+	_, mb := fs.selectMsgBlockWithIndex(seq)
+	return mb
+}
+
+// Same as selectMsgBlock but will also return the index of the block in fs.blks.
+// Lock should be held.
+func (fs *fileStore) selectMsgBlockWithIndex(seq uint64) (int, *msgBlock) {
 	// Check for out of range.
 	if seq < fs.state.FirstSeq || seq > fs.state.LastSeq {
-		return nil
+		return -1, nil
 	}
 
 	// Starting index, defaults to beginning.
@@ -3506,11 +6146,11 @@ func (fs *fileStore) selectMsgBlock(seq uint64) *msgBlock {
 	for i := si; i < len(fs.blks); i++ {
 		mb := fs.blks[i]
 		if seq <= atomic.LoadUint64(&mb.last.seq) {
-			return mb
+			return i, mb
 		}
 	}
 
-	return nil
+	return -1, nil
 }
 
 // Select the message block where this message should be found.
@@ -3665,6 +6305,7 @@ func (mb *msgBlock) flushPendingMsgsLocked() (*LostStreamData, error) {
 	}
 
 	// Append new data to the message block file.
+	start := time.Now()
 	for lbb := lob; lbb > 0; lbb = len(buf) {
 		n, err := mb.writeAt(buf, woff)
 		if err != nil {
@@ -3688,6 +6329,9 @@ func (mb *msgBlock) flushPendingMsgsLocked() (*LostStreamData, error) {
 
 	// Clear any error.
 	mb.werr = nil
+	// Pending is always whole records so we are on a record boundary.
+	mb.cwp = uint64(woff)
+	mb.fs.recordFlush(lob, time.Since(start))
 
 	// Cache may be gone.
 	if mb.cache == nil || mb.mfd == nil {
@@ -3736,6 +6380,7 @@ func (mb *msgBlock) clearLoading() {
 
 // Will load msgs from disk.
 func (mb *msgBlock) loadMsgs() error {
+	mb.prefetchArchived()
 	// We hold the lock here the whole time by design.
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
@@ -3759,6 +6404,9 @@ func (mb *msgBlock) cacheNotLoaded() bool {
 // Used to load in the block contents.
 // Lock should be held and all conditionals satisfied prior.
 func (mb *msgBlock) loadBlock(buf []byte) ([]byte, error) {
+	if mb.arc != nil {
+		return mb.fetchArchivedLocked()
+	}
 	f, err := os.Open(mb.mfn)
 	if err != nil {
 		return nil, err
@@ -3873,6 +6521,10 @@ checkCache:
 	if len(buf) > 0 {
 		mb.cloads++
 		mb.startCacheExpireTimer()
+		// Let the store check the cache budget.
+		if mb.fs != nil {
+			kickFlusher(mb.fs.cch)
+		}
 	}
 
 	return nil
@@ -3881,13 +6533,17 @@ checkCache:
 // Fetch a message from this block, possibly reading in and caching the messages.
 // We assume the block was selected and is correct, so we do not do range checks.
 func (mb *msgBlock) fetchMsg(seq uint64, sm *StoreMsg) (*StoreMsg, bool, error) {
+	mb.prefetchArchived()
 	mb.mu.Lock()
 	defer mb.mu.Unlock()
 
 	if mb.cacheNotLoaded() {
+		mb.fs.recordCacheLookup(false)
 		if err := mb.loadMsgsWithLock(); err != nil {
 			return nil, false, err
 		}
+	} else {
+		mb.fs.recordCacheLookup(true)
 	}
 	fsm, err := mb.cacheLookup(seq, sm)
 	if err != nil {
@@ -3900,6 +6556,7 @@ func (mb *msgBlock) fetchMsg(seq uint64, sm *StoreMsg) (*StoreMsg, bool, error)
 var (
 	errNoCache       = errors.New("no message cache")
 	errBadMsg        = errors.New("malformed or corrupt message")
+	errTornWrite     = errors.New("torn write at end of message block")
 	errDeletedMsg    = errors.New("deleted message")
 	errPartialCache  = errors.New("partial cache")
 	errNoPending     = errors.New("message block does not have pending data")
@@ -3908,6 +6565,7 @@ var (
 	errPendingData   = errors.New("pending data still present")
 	errNoEncryption  = errors.New("encryption not enabled")
 	errBadKeySize    = errors.New("encryption bad key size")
+	errBadBlockKey   = errors.New("message block key could not be opened")
 	errNoMsgBlk      = errors.New("no message block")
 	errMsgBlkTooBig  = errors.New("message block size exceeded int capacity")
 	errUnknownCipher = errors.New("unknown cipher")
@@ -4154,7 +6812,11 @@ func (fs *fileStore) LoadMsg(seq uint64, sm *StoreMsg) (*StoreMsg, error) {
 func (fs *fileStore) loadLast(subj string, sm *StoreMsg) (lsm *StoreMsg, err error) {
 	fs.mu.RLock()
 	defer fs.mu.RUnlock()
+	return fs.loadLastLocked(subj, sm)
+}
 
+// Lock should be held.
+func (fs *fileStore) loadLastLocked(subj string, sm *StoreMsg) (lsm *StoreMsg, err error) {
 	if fs.closed || fs.lmb == nil {
 		return nil, ErrStoreClosed
 	}
@@ -4207,7 +6869,16 @@ func (fs *fileStore) loadLast(subj string, sm *StoreMsg) (lsm *StoreMsg, err err
 // The subject can be a wildcard.
 func (fs *fileStore) LoadLastMsg(subject string, smv *StoreMsg) (sm *StoreMsg, err error) {
 	if subject == _EMPTY_ || subject == fwcs {
-		sm, err = fs.msgForSeq(fs.lastSeq(), smv)
+		fs.mu.RLock()
+		if fs.closed {
+			fs.mu.RUnlock()
+			return nil, ErrStoreClosed
+		}
+		seq := fs.lastMsgSeqLocked()
+		fs.mu.RUnlock()
+		if seq > 0 {
+			sm, err = fs.msgForSeq(seq, smv)
+		}
 	} else {
 		sm, err = fs.loadLast(subject, smv)
 	}
@@ -4224,16 +6895,34 @@ func (fs *fileStore) LoadNextMsg(filter string, wc bool, start uint64, sm *Store
 	if fs.closed {
 		return nil, 0, ErrStoreClosed
 	}
-	if start < fs.state.FirstSeq {
-		start = fs.state.FirstSeq
+	if start < fs.state.FirstSeq {
+		start = fs.state.FirstSeq
+	}
+
+	// For a literal subject we can use psim to know which blocks could hold it.
+	var fblk, lblk uint32
+	if filter != _EMPTY_ && !wc && fs.psim != nil {
+		info := fs.psim[filter]
+		if info == nil {
+			return nil, fs.state.LastSeq, ErrStoreEOF
+		}
+		fblk, lblk = info.fblk, info.lblk
+	}
+
+	// Skip ahead to the block holding our starting sequence.
+	si, _ := fs.selectMsgBlockWithIndex(start)
+	if si < 0 {
+		return nil, fs.state.LastSeq, ErrStoreEOF
 	}
 
-	// TODO(dlc) - If num blocks gets large maybe use selectMsgBlock but have it return index b/c
-	// we need to keep walking if no match found in first mb.
-	for _, mb := range fs.blks {
-		// Skip blocks that are less than our starting sequence.
-		if start > atomic.LoadUint64(&mb.last.seq) {
-			continue
+	for _, mb := range fs.blks[si:] {
+		if lblk > 0 {
+			if mb.index < fblk {
+				continue
+			}
+			if mb.index > lblk {
+				break
+			}
 		}
 		if sm, expireOk, err := mb.firstMatching(filter, wc, start, sm); err == nil {
 			if expireOk && mb != fs.lmb {
@@ -4312,6 +7001,7 @@ func (fs *fileStore) State() StreamState {
 	fs.mu.RUnlock()
 
 	state.Lost = fs.lostData()
+	state.Damaged = fs.damagedBlocks()
 
 	// Can not be guaranteed to be sorted.
 	if len(state.Deleted) > 0 {
@@ -4319,6 +7009,7 @@ func (fs *fileStore) State() StreamState {
 			return state.Deleted[i] < state.Deleted[j]
 		})
 		state.NumDeleted = len(state.Deleted)
+		state.DeletedRanges = deleteRanges(state.Deleted)
 	}
 	return state
 }
@@ -4390,7 +7081,10 @@ func (mb *msgBlock) writeIndexInfoLocked() error {
 
 	// Write header
 	hdr[0] = magic
-	hdr[1] = version
+	hdr[1] = indexVersion
+
+	// Generate the delete map first since this will prune entries below our first sequence.
+	dmap := mb.genDeleteMap()
 
 	n := hdrLen
 	n += binary.PutUvarint(hdr[n:], mb.msgs)
@@ -4403,9 +7097,17 @@ func (mb *msgBlock) writeIndexInfoLocked() error {
 	buf := append(hdr[:n], mb.lchk[:]...)
 
 	// Append a delete map if needed
-	if len(mb.dmap) > 0 {
-		buf = append(buf, mb.genDeleteMap()...)
-	}
+	if len(dmap) > 0 {
+		buf = append(buf, dmap...)
+	}
+	// Commit pointer so recovery can tell a torn write from corruption.
+	var cwp [binary.MaxVarintLen64]byte
+	buf = append(buf, cwp[:binary.PutUvarint(cwp[:], mb.cwp)]...)
+	// Size chosen for this block.
+	var tsz [binary.MaxVarintLen64]byte
+	buf = append(buf, tsz[:binary.PutUvarint(tsz[:], mb.tsz)]...)
+	// Checksum used for the records in this block.
+	buf = append(buf, byte(checksumTypeOf(mb.hh)))
 
 	// Open our FD if needed.
 	if mb.ifd == nil {
@@ -4414,6 +7116,7 @@ func (mb *msgBlock) writeIndexInfoLocked() error {
 			return err
 		}
 		mb.ifd = ifd
+		mb.trackFDs()
 	}
 
 	// Encrypt if needed.
@@ -4461,7 +7164,8 @@ func (mb *msgBlock) readIndexInfo() error {
 		}
 	}
 
-	if err := checkHeader(buf); err != nil {
+	iv, err := checkIndexHeader(buf)
+	if err != nil {
 		defer os.Remove(mb.ifn)
 		return fmt.Errorf("bad index file")
 	}
@@ -4522,11 +7226,38 @@ func (mb *msgBlock) readIndexInfo() error {
 	if dmapLen > 0 {
 		mb.dmap = make(map[uint64]struct{}, dmapLen)
 		for i := 0; i < int(dmapLen); i++ {
-			seq := readSeq()
-			if seq == 0 {
-				break
+			// Keep reading all entries so we stay positioned for what follows.
+			if seq := readSeq(); seq > 0 {
+				mb.dmap[seq+mb.first.seq] = struct{}{}
+			}
+		}
+	}
+
+	// Commit pointer was added in version 2.
+	if iv >= indexV2 {
+		mb.cwp = readSeq()
+	}
+	// Size this block was chosen to roll at was added in version 3.
+	if iv >= indexV3 {
+		mb.tsz = readSeq()
+	}
+	if bi < 0 {
+		os.Remove(mb.ifn)
+		return fmt.Errorf("short index file")
+	}
+	// Checksum type of the records was added in version 4.
+	if iv >= indexV4 {
+		if bi >= len(buf) {
+			os.Remove(mb.ifn)
+			return fmt.Errorf("short index file")
+		}
+		if ct := ChecksumType(buf[bi]); mb.hh == nil || checksumTypeOf(mb.hh) != ct {
+			hh, err := mb.fs.newChecksumHash(ct, mb.index)
+			if err != nil {
+				os.Remove(mb.ifn)
+				return fmt.Errorf("bad index file")
 			}
-			mb.dmap[seq+mb.first.seq] = struct{}{}
+			mb.hh = hh
 		}
 	}
 
@@ -4562,6 +7293,147 @@ func syncAndClose(mfd, ifd *os.File) {
 	}
 }
 
+// Counters for our stats, updated atomically.
+type fileStoreCounters struct {
+	chits   uint64
+	cmisses uint64
+	flushes uint64
+	fbytes  uint64
+	fnanos  uint64
+	fmax    uint64
+	syncs   uint64
+	snanos  uint64
+	smax    uint64
+}
+
+// FileStoreStats holds statistics for a file store.
+type FileStoreStats struct {
+	Blocks          int           `json:"blocks"`
+	CacheHits       uint64        `json:"cache_hits"`
+	CacheMisses     uint64        `json:"cache_misses"`
+	CacheHitRatio   float64       `json:"cache_hit_ratio"`
+	CacheLoads      uint64        `json:"cache_loads"`
+	CacheBytes      uint64        `json:"cache_bytes"`
+	DeleteMap       int           `json:"dmap_entries"`
+	Flushes         uint64        `json:"flushes"`
+	BytesFlushed    uint64        `json:"bytes_flushed"`
+	AvgFlushLatency time.Duration `json:"avg_flush_latency"`
+	MaxFlushLatency time.Duration `json:"max_flush_latency"`
+	Syncs           uint64        `json:"syncs"`
+	AvgSyncLatency  time.Duration `json:"avg_sync_latency"`
+	MaxSyncLatency  time.Duration `json:"max_sync_latency"`
+	BlockStats      []*BlockStats `json:"block_stats,omitempty"`
+}
+
+// BlockStats holds statistics for a single message block.
+type BlockStats struct {
+	Index       uint32  `json:"index"`
+	Msgs        uint64  `json:"msgs"`
+	Bytes       uint64  `json:"bytes"`
+	RawBytes    uint64  `json:"raw_bytes"`
+	Utilization float64 `json:"utilization"`
+	Deleted     int     `json:"deleted,omitempty"`
+	Cached      bool    `json:"cached,omitempty"`
+	Archived    bool    `json:"archived,omitempty"`
+}
+
+// Records if a message load was served from the cache.
+func (fs *fileStore) recordCacheLookup(hit bool) {
+	if fs == nil || fs.ctrs == nil {
+		return
+	}
+	if hit {
+		atomic.AddUint64(&fs.ctrs.chits, 1)
+	} else {
+		atomic.AddUint64(&fs.ctrs.cmisses, 1)
+	}
+}
+
+// Records a flush of pending data to disk.
+func (fs *fileStore) recordFlush(n int, d time.Duration) {
+	if fs == nil || fs.ctrs == nil {
+		return
+	}
+	atomic.AddUint64(&fs.ctrs.flushes, 1)
+	atomic.AddUint64(&fs.ctrs.fbytes, uint64(n))
+	atomic.AddUint64(&fs.ctrs.fnanos, uint64(d))
+	storeMaxUint64(&fs.ctrs.fmax, uint64(d))
+}
+
+// Will sync the file to disk and record how long it took.
+func (fs *fileStore) syncFile(fd *os.File) error {
+	if fs == nil || fs.ctrs == nil {
+		return fd.Sync()
+	}
+	start := time.Now()
+	err := fd.Sync()
+	d := uint64(time.Since(start))
+	atomic.AddUint64(&fs.ctrs.syncs, 1)
+	atomic.AddUint64(&fs.ctrs.snanos, d)
+	storeMaxUint64(&fs.ctrs.smax, d)
+	return err
+}
+
+func storeMaxUint64(addr *uint64, v uint64) {
+	for {
+		cur := atomic.LoadUint64(addr)
+		if v <= cur || atomic.CompareAndSwapUint64(addr, cur, v) {
+			return
+		}
+	}
+}
+
+// Stats returns cache, flush and sync statistics along with the utilization of each block.
+func (fs *fileStore) Stats() *FileStoreStats {
+	var st FileStoreStats
+	if c := fs.ctrs; c != nil {
+		st.CacheHits = atomic.LoadUint64(&c.chits)
+		st.CacheMisses = atomic.LoadUint64(&c.cmisses)
+		st.Flushes = atomic.LoadUint64(&c.flushes)
+		st.BytesFlushed = atomic.LoadUint64(&c.fbytes)
+		st.MaxFlushLatency = time.Duration(atomic.LoadUint64(&c.fmax))
+		st.Syncs = atomic.LoadUint64(&c.syncs)
+		st.MaxSyncLatency = time.Duration(atomic.LoadUint64(&c.smax))
+		if st.Flushes > 0 {
+			st.AvgFlushLatency = time.Duration(atomic.LoadUint64(&c.fnanos) / st.Flushes)
+		}
+		if st.Syncs > 0 {
+			st.AvgSyncLatency = time.Duration(atomic.LoadUint64(&c.snanos) / st.Syncs)
+		}
+	}
+	if total := st.CacheHits + st.CacheMisses; total > 0 {
+		st.CacheHitRatio = float64(st.CacheHits) / float64(total)
+	}
+
+	fs.mu.RLock()
+	defer fs.mu.RUnlock()
+	st.Blocks = len(fs.blks)
+	st.BlockStats = make([]*BlockStats, 0, len(fs.blks))
+	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		bs := &BlockStats{
+			Index:    mb.index,
+			Msgs:     mb.msgs,
+			Bytes:    mb.bytes,
+			RawBytes: mb.rbytes,
+			Deleted:  len(mb.dmap),
+			Cached:   mb.cache != nil && len(mb.cache.buf) > 0,
+			Archived: mb.arc != nil,
+		}
+		if mb.rbytes > 0 {
+			bs.Utilization = float64(mb.bytes) / float64(mb.rbytes)
+		}
+		st.CacheLoads += mb.cloads
+		if mb.cache != nil {
+			st.CacheBytes += uint64(len(mb.cache.buf))
+		}
+		st.DeleteMap += len(mb.dmap)
+		mb.mu.RUnlock()
+		st.BlockStats = append(st.BlockStats, bs)
+	}
+	return &st
+}
+
 // Will return total number of cache loads.
 func (fs *fileStore) cacheLoads() uint64 {
 	var tl uint64
@@ -4588,6 +7460,138 @@ func (fs *fileStore) cacheSize() uint64 {
 	return sz
 }
 
+// Watches for cache loads and enforces the cache budget for the store.
+func (fs *fileStore) cacheBudgetLoop(cch, qch chan struct{}) {
+	for {
+		select {
+		case <-cch:
+			fs.enforceCacheBudget()
+		case <-qch:
+			return
+		}
+	}
+}
+
+// Will evict block caches in least recently used order until we are
+// under our cache budget. The last message block is never evicted here
+// since it is the active write block.
+func (fs *fileStore) enforceCacheBudget() {
+	fs.mu.RLock()
+	if fs.closed || fs.fcfg.CacheBudget == 0 {
+		fs.mu.RUnlock()
+		return
+	}
+	budget := fs.fcfg.CacheBudget
+	fs.mu.RUnlock()
+
+	total, cbs := fs.cachedBlocks(nil)
+	if total <= budget {
+		return
+	}
+	sortCachedBlocks(cbs)
+	for _, cb := range cbs {
+		if total <= budget {
+			break
+		}
+		total -= cb.evict()
+	}
+}
+
+// cachedBlk is a message block holding a loaded cache, used for eviction.
+type cachedBlk struct {
+	mb *msgBlock
+	sz uint64
+	ts int64
+}
+
+// Will evict the block's cache and return the number of bytes released.
+// Nothing is released if the cache went away or could not be evicted.
+func (cb cachedBlk) evict() uint64 {
+	mb := cb.mb
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.cache == nil || len(mb.cache.buf) == 0 {
+		return 0
+	}
+	sz := uint64(len(mb.cache.buf))
+	mb.evictCacheLocked()
+	if mb.cache == nil || len(mb.cache.buf) == 0 {
+		return sz
+	}
+	return 0
+}
+
+// Returns the total bytes held in block caches for this store and the blocks
+// that are candidates for eviction, appended to cbs. The last message block is
+// never a candidate since it is the active write block.
+func (fs *fileStore) cachedBlocks(cbs []cachedBlk) (uint64, []cachedBlk) {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return 0, cbs
+	}
+	lmb := fs.lmb
+	blks := append([]*msgBlock(nil), fs.blks...)
+	fs.mu.RUnlock()
+
+	var total uint64
+	for _, mb := range blks {
+		mb.mu.RLock()
+		if mb.cache != nil && len(mb.cache.buf) > 0 {
+			sz := uint64(len(mb.cache.buf))
+			total += sz
+			if mb != lmb {
+				ts := mb.llts
+				if mb.lwts > ts {
+					ts = mb.lwts
+				}
+				cbs = append(cbs, cachedBlk{mb, sz, ts})
+			}
+		}
+		mb.mu.RUnlock()
+	}
+	return total, cbs
+}
+
+// Oldest activity first, ties broken by block index.
+func sortCachedBlocks(cbs []cachedBlk) {
+	sort.Slice(cbs, func(i, j int) bool {
+		if cbs[i].ts == cbs[j].ts {
+			return cbs[i].mb.index < cbs[j].mb.index
+		}
+		return cbs[i].ts < cbs[j].ts
+	})
+}
+
+// Will evict block caches across the given filestores, least recently loaded first,
+// until at least target bytes have been released. Returns the bytes released.
+func evictBlockCaches(fss []*fileStore, target uint64) uint64 {
+	var cbs []cachedBlk
+	for _, fs := range fss {
+		_, cbs = fs.cachedBlocks(cbs)
+	}
+	sortCachedBlocks(cbs)
+
+	var released uint64
+	for _, cb := range cbs {
+		if released >= target {
+			break
+		}
+		released += cb.evict()
+	}
+	return released
+}
+
+// Will expire our cache regardless of recent read or write activity.
+// Pending writes will still prevent the cache from being expired.
+// Lock should be held.
+func (mb *msgBlock) evictCacheLocked() {
+	llts, lwts := mb.llts, mb.lwts
+	mb.llts, mb.lwts = 0, 0
+	mb.expireCacheLocked()
+	mb.llts, mb.lwts = llts, lwts
+}
+
 // Will return total number of dmapEntries for all msg blocks.
 func (fs *fileStore) dmapEntries() int {
 	var total int
@@ -4624,6 +7628,9 @@ func (fs *fileStore) PurgeEx(subject string, sequence, keep uint64) (purged uint
 	if sequence > 1 && keep > 0 {
 		return 0, ErrPurgeArgMismatch
 	}
+	if fs.isSealed() {
+		return 0, ErrStoreSealed
+	}
 
 	if subject == _EMPTY_ || subject == fwcs {
 		if keep == 0 && (sequence == 0 || sequence == 1) {
@@ -4748,6 +7755,9 @@ func (fs *fileStore) PurgeEx(subject string, sequence, keep uint64) (purged uint
 // Purge will remove all messages from this store.
 // Will return the number of purged messages.
 func (fs *fileStore) Purge() (uint64, error) {
+	if fs.isSealed() {
+		return 0, ErrStoreSealed
+	}
 	return fs.purge(0)
 }
 
@@ -4767,13 +7777,22 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 	fs.state.Bytes = 0
 	fs.state.Msgs = 0
 
+	var akeys []string
 	for _, mb := range fs.blks {
+		mb.mu.RLock()
+		if mb.arc != nil {
+			akeys = append(akeys, mb.arc.Key)
+		}
+		mb.mu.RUnlock()
 		mb.dirtyClose()
 	}
+	// Archived blocks go with the purge.
+	fs.deleteArchived(akeys...)
 
 	fs.blks = nil
 	fs.lmb = nil
 	fs.bim = make(map[uint32]*msgBlock)
+	fs.pruneDamaged(func(*DamagedBlock) bool { return true })
 
 	// Move the msgs directory out of the way, will delete out of band.
 	// FIXME(dlc) - These can error and we need to change api above to propagate?
@@ -4785,7 +7804,7 @@ func (fs *fileStore) purge(fseq uint64) (uint64, error) {
 		os.RemoveAll(pdir)
 	}
 	os.Rename(mdir, pdir)
-	go os.RemoveAll(pdir)
+	go removePurgeDir(pdir, fs.fcfg.bgIO)
 	// Create new one.
 	os.MkdirAll(mdir, defaultDirPerms)
 
@@ -4932,11 +7951,13 @@ func (fs *fileStore) Compact(seq uint64) (uint64, error) {
 			if err = os.WriteFile(smb.mfn, nbuf, defaultFilePerms); err != nil {
 				goto SKIP
 			}
+			smb.dropArchive()
 			// Make sure to remove fss state.
 			smb.fss = nil
 			smb.removePerSubjectInfoLocked()
 			smb.clearCacheAndOffset()
 			smb.rbytes = uint64(len(nbuf))
+			smb.cwp = smb.rbytes
 		}
 	}
 
@@ -5055,6 +8076,50 @@ func (fs *fileStore) lastSeq() uint64 {
 	return seq
 }
 
+// Returns the sequence of the last message we still hold, which is not our
+// last sequence if that message has been removed.
+// Lock should be held.
+func (fs *fileStore) lastMsgSeqLocked() uint64 {
+	for i := len(fs.blks) - 1; i >= 0; i-- {
+		if seq := fs.blks[i].lastMsgSeq(); seq > 0 {
+			return seq
+		}
+	}
+	return 0
+}
+
+// Returns the sequence of the last message in this block, 0 if we have none.
+func (mb *msgBlock) lastMsgSeq() uint64 {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.msgs == 0 {
+		return 0
+	}
+	if _, deleted := mb.dmap[mb.last.seq]; !deleted {
+		return mb.last.seq
+	}
+	// Use our per subject info to find the highest last instead of walking the dmap.
+	var seq uint64
+	if err := mb.ensurePerSubjectInfoLoaded(); err == nil {
+		for _, ss := range mb.fss {
+			if ss.Last > seq {
+				seq = ss.Last
+			}
+		}
+	}
+	if seq > 0 {
+		return seq
+	}
+	// We are not tracking subjects.
+	for seq = mb.last.seq - 1; seq > mb.first.seq; seq-- {
+		if _, deleted := mb.dmap[seq]; !deleted {
+			return seq
+		}
+	}
+	return mb.first.seq
+}
+
 // Returns number of msg blks.
 func (fs *fileStore) numMsgBlocks() int {
 	fs.mu.RLock()
@@ -5073,6 +8138,7 @@ func (mb *msgBlock) removeIndexFileLocked() {
 	if mb.ifd != nil {
 		mb.ifd.Close()
 		mb.ifd = nil
+		mb.trackFDs()
 	}
 	if mb.ifn != _EMPTY_ {
 		os.Remove(mb.ifn)
@@ -5128,6 +8194,7 @@ func (mb *msgBlock) closeAndKeepIndex() {
 		// We were closed, so just write out an empty file.
 		os.WriteFile(mb.mfn, nil, defaultFilePerms)
 	}
+	mb.dropArchive()
 	// Make sure to write the index file so we can remember last seq and ts.
 	mb.writeIndexInfoLocked()
 	// Close
@@ -5185,7 +8252,12 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 		mb.ifd.Close()
 		mb.ifd = nil
 	}
+	mb.trackFDs()
 	if remove {
+		// Anything we kept from this block is no longer part of the stream.
+		if fs := mb.fs; fs != nil {
+			fs.pruneDamaged(func(db *DamagedBlock) bool { return db.Index == mb.index })
+		}
 		if mb.ifn != _EMPTY_ {
 			os.Remove(mb.ifn)
 			mb.ifn = _EMPTY_
@@ -5201,6 +8273,7 @@ func (mb *msgBlock) dirtyCloseWithRemove(remove bool) {
 		if mb.kfn != _EMPTY_ {
 			os.Remove(mb.kfn)
 		}
+		mb.dropArchive()
 	}
 }
 
@@ -5218,14 +8291,17 @@ func (mb *msgBlock) removeSeqPerSubject(subj string, seq uint64, smp *StoreMsg)
 	}
 
 	ss.Msgs--
-	if seq != ss.First {
+	if seq != ss.First && seq != ss.Last {
 		return
 	}
 
-	// Here what we are removing is the first message.
-	// If we only have one message left we can simply assign it to last.
+	// If we only have one message left we can simply assign first and last to it.
 	if ss.Msgs == 1 {
-		ss.First = ss.Last
+		if seq == ss.First {
+			ss.First = ss.Last
+		} else {
+			ss.Last = ss.First
+		}
 		return
 	}
 
@@ -5234,6 +8310,22 @@ func (mb *msgBlock) removeSeqPerSubject(subj string, seq uint64, smp *StoreMsg)
 	if smp == nil {
 		smp = &smv
 	}
+	if seq == ss.Last {
+		// Here what we are removing is the last message, so walk backwards.
+		for tseq := seq - 1; tseq > ss.First; tseq-- {
+			if sm, _ := mb.cacheLookup(tseq, smp); sm != nil {
+				if sm.subj == subj {
+					ss.Last = tseq
+					return
+				}
+			}
+		}
+		// Nothing in between, so first is also our last.
+		ss.Last = ss.First
+		return
+	}
+
+	// Here what we are removing is the first message.
 	for tseq := seq + 1; tseq <= ss.Last; tseq++ {
 		if sm, _ := mb.cacheLookup(tseq, smp); sm != nil {
 			if sm.subj == subj {
@@ -5517,6 +8609,7 @@ func (mb *msgBlock) close(sync bool) {
 	}
 	mb.mfd = nil
 	mb.ifd = nil
+	mb.trackFDs()
 }
 
 func (fs *fileStore) closeAllMsgBlocks(sync bool) {
@@ -5531,7 +8624,7 @@ func (fs *fileStore) Delete() error {
 		os.RemoveAll(fs.fcfg.StoreDir)
 		return ErrStoreClosed
 	}
-	fs.Purge()
+	fs.purge(0)
 
 	pdir := filepath.Join(fs.fcfg.StoreDir, purgeDir)
 	// If purge directory still exists then we need to wait
@@ -5580,6 +8673,7 @@ func (fs *fileStore) Stop() error {
 
 	fs.cancelSyncTimer()
 	fs.cancelAgeChk()
+	close(fs.qch)
 
 	var _cfs [256]ConsumerStore
 	cfs := append(_cfs[:0], fs.cfs...)
@@ -5596,10 +8690,11 @@ func (fs *fileStore) Stop() error {
 const errFile = "errors.txt"
 
 // Stream our snapshot through S2 compression and tar.
-func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includeConsumers bool) {
+func (fs *fileStore) streamSnapshot(h *SnapshotHandle, w io.WriteCloser, state *StreamState, includeConsumers bool) {
+	defer close(h.done)
 	defer w.Close()
 
-	enc := s2.NewWriter(w)
+	enc := s2.NewWriter(&snapshotWriter{w, h})
 	defer enc.Close()
 
 	tw := tar.NewWriter(enc)
@@ -5633,11 +8728,12 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 	}
 
 	writeErr := func(err string) {
+		h.setErr(errors.New(err))
 		writeFile(errFile, []byte(err))
 	}
 
 	fs.mu.Lock()
-	blks := fs.blks
+	blks, qch := fs.blks, fs.qch
 	// Grab our general meta data.
 	// We do this now instead of pulling from files since they could be encrypted.
 	meta, err := json.Marshal(fs.cfg)
@@ -5650,6 +8746,7 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 	fs.hh.Write(meta)
 	sum := []byte(hex.EncodeToString(fs.hh.Sum(nil)))
 	fs.mu.Unlock()
+	atomic.StoreInt64(&h.nblks, int64(len(blks)))
 
 	// Meta first.
 	if writeFile(JetStreamMetaFile, meta) != nil {
@@ -5723,6 +8820,12 @@ func (fs *fileStore) streamSnapshot(w io.WriteCloser, state *StreamState, includ
 		if writeFile(msgPre+fmt.Sprintf(blkScan, mb.index), bbuf) != nil {
 			return
 		}
+		atomic.AddInt64(&h.blks, 1)
+		// Pace our block reads as background I/O.
+		if !fs.fcfg.bgIO.wait(int64(len(bbuf)), qch) {
+			writeErr("Snapshot aborted, store closed")
+			return
+		}
 	}
 
 	// Bail if no consumers requested.
@@ -5793,25 +8896,234 @@ func (fs *fileStore) Snapshot(deadline time.Duration, checkMsgs, includeConsumer
 	if checkMsgs {
 		ld := fs.checkMsgs()
 		if ld != nil && len(ld.Msgs) > 0 {
+			fs.mu.Lock()
+			fs.sips--
+			fs.mu.Unlock()
 			return nil, fmt.Errorf("snapshot check detected %d bad messages", len(ld.Msgs))
 		}
 	}
-
-	pr, pw := net.Pipe()
-
-	// Set a write deadline here to protect ourselves.
-	if deadline > 0 {
-		pw.SetWriteDeadline(time.Now().Add(deadline))
-	}
-
-	// We can add to our stream while snapshotting but not delete anything.
-	var state StreamState
-	fs.FastState(&state)
-
-	// Stream in separate Go routine.
-	go fs.streamSnapshot(pw, &state, includeConsumers)
-
-	return &SnapshotResult{pr, state}, nil
+
+	pr, pw := net.Pipe()
+
+	// Set a write deadline here to protect ourselves.
+	if deadline > 0 {
+		pw.SetWriteDeadline(time.Now().Add(deadline))
+	}
+
+	// We can add to our stream while snapshotting but not delete anything.
+	var state StreamState
+	fs.FastState(&state)
+
+	// Stream in separate Go routine.
+	h := newSnapshotHandle(pw)
+	go fs.streamSnapshot(h, pw, &state, includeConsumers)
+
+	return &SnapshotResult{pr, state, h}, nil
+}
+
+// Will check the contents of a stream snapshot as produced by Snapshot without writing anything.
+// Any problems found are recorded in the check, an error is only returned if the archive itself
+// can not be read.
+func checkStreamSnapshot(r io.Reader, sc *StreamRestoreCheck) error {
+	problem := func(format string, args ...interface{}) {
+		sc.Problems = append(sc.Problems, fmt.Sprintf(format, args...))
+	}
+	type consumerFiles struct {
+		meta, sum, state []byte
+	}
+	var meta, sum []byte
+	consumers := make(map[string]*consumerFiles)
+
+	tr := tar.NewReader(s2.NewReader(r))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg && hdr.Typeflag != tar.TypeRegA {
+			problem("unexpected entry %q", hdr.Name)
+			continue
+		}
+		name := filepath.ToSlash(filepath.Clean(hdr.Name))
+		if strings.HasPrefix(name, "../") || filepath.IsAbs(name) {
+			problem("unexpected entry %q", hdr.Name)
+			continue
+		}
+		buf, err := io.ReadAll(tr)
+		if err != nil {
+			return err
+		}
+		sc.RequiredBytes += uint64(len(buf))
+
+		var index uint32
+		switch dir, fn := path.Split(name); {
+		case name == JetStreamMetaFile:
+			meta = buf
+		case name == JetStreamMetaFileSum:
+			sum = buf
+		case dir == msgDir+"/":
+			if n, err := fmt.Sscanf(fn, blkScan, &index); err == nil && n == 1 {
+				if meta == nil {
+					problem("message block %d precedes stream meta data", index)
+					continue
+				}
+				sc.Blocks++
+				if sz := uint64(len(buf)); sz > sc.MaxBlockSize {
+					sc.MaxBlockSize = sz
+				}
+				msgs, first, last, err := checkBlockRecords(sc.Config.Name, index, buf)
+				if err != nil {
+					problem("message block %d: %v", index, err)
+					continue
+				}
+				sc.Msgs += msgs
+				if first > 0 && (sc.FirstSeq == 0 || first < sc.FirstSeq) {
+					sc.FirstSeq = first
+				}
+				if last > sc.LastSeq {
+					sc.LastSeq = last
+				}
+			} else if n, err := fmt.Sscanf(fn, indexScan, &index); err == nil && n == 1 {
+				if _, err := checkIndexHeader(buf); err != nil {
+					problem("message block %d index has unsupported version", index)
+				}
+			} else if n, err := fmt.Sscanf(fn, fssScan, &index); err != nil || n != 1 {
+				problem("unexpected entry %q", hdr.Name)
+			}
+		case strings.HasPrefix(dir, consumerDir+"/") && strings.Count(dir, "/") == 2:
+			oname := path.Base(dir)
+			cf := consumers[oname]
+			if cf == nil {
+				cf = &consumerFiles{}
+				consumers[oname] = cf
+			}
+			switch fn {
+			case JetStreamMetaFile:
+				cf.meta = buf
+			case JetStreamMetaFileSum:
+				cf.sum = buf
+			case consumerState:
+				cf.state = buf
+			default:
+				problem("unexpected entry %q", hdr.Name)
+			}
+		default:
+			problem("unexpected entry %q", hdr.Name)
+		}
+		// Stream meta data is first, decode so we know how to check blocks.
+		if name == JetStreamMetaFile {
+			var fcfg FileStreamInfo
+			if err := json.Unmarshal(buf, &fcfg); err != nil {
+				problem("stream meta data is not valid: %v", err)
+				meta = nil
+				continue
+			}
+			sc.Config, sc.Created = fcfg.StreamConfig, fcfg.Created
+		}
+	}
+
+	if meta == nil {
+		problem("missing stream meta data")
+		return nil
+	}
+	key := sha256.Sum256([]byte(sc.Config.Name))
+	if hh, err := highwayhash.New64(key[:]); err == nil {
+		hh.Write(meta)
+		if sum == nil || hex.EncodeToString(hh.Sum(nil)) != string(sum) {
+			problem("stream meta data checksum does not match")
+		}
+	}
+	for oname, cf := range consumers {
+		sc.Consumers = append(sc.Consumers, oname)
+		if cf.meta == nil {
+			problem("consumer %q is missing meta data", oname)
+			continue
+		}
+		key := sha256.Sum256([]byte(sc.Config.Name + "/" + oname))
+		if hh, err := highwayhash.New64(key[:]); err == nil {
+			hh.Write(cf.meta)
+			if cf.sum == nil || hex.EncodeToString(hh.Sum(nil)) != string(cf.sum) {
+				problem("consumer %q meta data checksum does not match", oname)
+			}
+		}
+		if cf.state != nil {
+			if _, err := checkConsumerHeader(cf.state); err != nil {
+				problem("consumer %q state: %v", oname, err)
+			} else if _, err := decodeConsumerState(cf.state); err != nil {
+				problem("consumer %q state: %v", oname, err)
+			}
+		}
+	}
+	sort.Strings(sc.Consumers)
+	return nil
+}
+
+// Will verify the layout and checksums of all records in a plaintext message block.
+// Returns the number of messages that were not erased and the first and last sequences.
+func checkBlockRecords(name string, index uint32, buf []byte) (msgs, first, last uint64, err error) {
+	fs := &fileStore{cfg: FileStreamInfo{StreamConfig: StreamConfig{Name: name}}}
+	var hh hash.Hash64
+	var le = binary.LittleEndian
+
+	for ri, lbuf := 0, len(buf); ri < lbuf; {
+		if ri+msgHdrSize > lbuf {
+			return msgs, first, last, fmt.Errorf("short record at offset %d", ri)
+		}
+		hdr := buf[ri : ri+msgHdrSize]
+		rl, slen := le.Uint32(hdr[0:]), le.Uint16(hdr[20:])
+		hasHeaders := rl&hbit != 0
+		rl &^= hbit
+		dlen := int(rl) - msgHdrSize
+		if dlen < checksumSize || int(slen) > dlen-checksumSize || rl > rlBadThresh || ri+int(rl) > lbuf {
+			return msgs, first, last, fmt.Errorf("bad record at offset %d", ri)
+		}
+		seq := le.Uint64(hdr[4:])
+		data := buf[ri+msgHdrSize : ri+int(rl)]
+		ri += int(rl)
+
+		if seq == 0 || seq&ebit != 0 {
+			if seq &^= ebit; seq > last {
+				last = seq
+			}
+			continue
+		}
+		checksum := func(hh hash.Hash64) bool {
+			hh.Reset()
+			hh.Write(hdr[4:20])
+			hh.Write(data[:slen])
+			if hasHeaders && dlen-checksumSize >= int(slen)+4 {
+				hh.Write(data[slen+4 : dlen-checksumSize])
+			} else {
+				hh.Write(data[slen : dlen-checksumSize])
+			}
+			return bytes.Equal(hh.Sum(nil), data[dlen-checksumSize:])
+		}
+		// The first record tells us which checksum the block was written with.
+		if hh == nil {
+			for _, ct := range []ChecksumType{HighwayHash, CRC32C, NoChecksum} {
+				if chh, err := fs.newChecksumHash(ct, index); err == nil && checksum(chh) {
+					hh = chh
+					break
+				}
+			}
+			if hh == nil {
+				return msgs, first, last, fmt.Errorf("checksum mismatch for sequence %d", seq)
+			}
+		} else if !checksum(hh) {
+			return msgs, first, last, fmt.Errorf("checksum mismatch for sequence %d", seq)
+		}
+		msgs++
+		if first == 0 {
+			first = seq
+		}
+		if seq > last {
+			last = seq
+		}
+	}
+	return msgs, first, last, nil
 }
 
 // Helper to return the config.
@@ -5840,8 +9152,16 @@ type consumerFileStore struct {
 	qch     chan struct{}
 	flusher bool
 	writing bool
+	wcond   *sync.Cond // Signaled when a write completes or the store closes.
 	dirty   bool
 	closed  bool
+	// Journal of updates appended since the state file was written.
+	jfn    string
+	jbuf   []byte
+	jready bool
+	jfull  bool
+	jsize  int64
+	jbase  int64
 }
 
 func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerStore, error) {
@@ -5875,7 +9195,9 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 		name: name,
 		odir: odir,
 		ifn:  filepath.Join(odir, consumerState),
+		jfn:  filepath.Join(odir, consumerJournal),
 	}
+	o.wcond = sync.NewCond(&o.mu)
 	key := sha256.Sum256([]byte(fs.cfg.Name + "/" + name))
 	hh, err := highwayhash.New64(key[:])
 	if err != nil {
@@ -5885,31 +9207,13 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 
 	// Check for encryption.
 	if o.prf != nil {
-		if ekey, err := os.ReadFile(filepath.Join(odir, JetStreamMetaFileKey)); err == nil {
-			if len(ekey) < minBlkKeySize {
-				return nil, errBadKeySize
-			}
-			// Recover key encryption key.
-			rb, err := fs.prf([]byte(fs.cfg.Name + tsep + o.name))
-			if err != nil {
-				return nil, err
-			}
-
-			sc := fs.fcfg.Cipher
-			kek, err := genEncryptionKey(sc, rb)
-			if err != nil {
-				return nil, err
-			}
-			ns := kek.NonceSize()
-			nonce := ekey[:ns]
-			seed, err := kek.Open(nil, nonce, ekey[ns:], nil)
-			if err != nil {
+		keyFile := filepath.Join(odir, JetStreamMetaFileKey)
+		if _, err := os.Stat(keyFile); err == nil {
+			// Our state is sealed with the asset key, so only the key needs to move to our current key.
+			o.aek, err = fs.recoverMetaKey(fs.cfg.Name+tsep+o.name, keyFile)
+			if err != nil && err != errBadKeySize {
 				// We may be here on a cipher conversion, so attempt to convert.
-				if err = o.convertCipher(); err != nil {
-					return nil, err
-				}
-			} else {
-				o.aek, err = genEncryptionKey(sc, seed)
+				err = o.convertCipher()
 			}
 			if err != nil {
 				return nil, err
@@ -5920,14 +9224,16 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	// Track if we are creating the directory so that we can clean up if we encounter an error.
 	var didCreate bool
 
-	// Write our meta data iff does not exist.
+	// Write our meta data iff does not exist and we can not recover it from a backup.
 	meta := filepath.Join(odir, JetStreamMetaFile)
 	if _, err := os.Stat(meta); err != nil && os.IsNotExist(err) {
-		didCreate = true
-		csi.Created = time.Now().UTC()
-		if err := o.writeConsumerMeta(); err != nil {
-			os.RemoveAll(odir)
-			return nil, err
+		if _, err := recoverMetaFiles(odir, o.hh); err != nil {
+			didCreate = true
+			csi.Created = time.Now().UTC()
+			if err := o.writeConsumerMeta(); err != nil {
+				os.RemoveAll(odir)
+				return nil, err
+			}
 		}
 	}
 
@@ -5945,6 +9251,7 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 			// Redo the state file as well here if we have one and we can tell it was plaintext.
 			if buf, err := os.ReadFile(o.ifn); err == nil {
 				if _, err := decodeConsumerState(buf); err == nil {
+					buf = o.foldJournal(buf, nil)
 					if err := os.WriteFile(o.ifn, o.encryptState(buf), defaultFilePerms); err != nil {
 						if didCreate {
 							os.RemoveAll(odir)
@@ -5956,6 +9263,14 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 		}
 	}
 
+	// Rewrite any existing state in an older format with the current version.
+	if err := o.migrateState(); err != nil {
+		if didCreate {
+			os.RemoveAll(odir)
+		}
+		return nil, err
+	}
+
 	// Create channels to control our flush go routine.
 	o.fch = make(chan struct{}, 1)
 	o.qch = make(chan struct{})
@@ -5966,6 +9281,164 @@ func (fs *fileStore) ConsumerStore(name string, cfg *ConsumerConfig) (ConsumerSt
 	return o, nil
 }
 
+// Removes the state of consumers that are no longer running and have not been
+// touched for OrphanConsumerTTL. On recovery only consumers that can never be
+// recovered, i.e. missing their meta file and its backup, are removed. Otherwise ephemeral
+// consumers are removed once the orphan checker confirms they are gone.
+// Durable consumers are never removed. Returns the names of removed consumers.
+func (fs *fileStore) removeOrphanConsumers(recovery bool) []string {
+	fs.mu.RLock()
+	if fs.closed {
+		fs.mu.RUnlock()
+		return nil
+	}
+	odir, ttl, och := filepath.Join(fs.fcfg.StoreDir, consumerDir), fs.fcfg.OrphanConsumerTTL, fs.och
+	running := make(map[string]struct{}, len(fs.cfs))
+	for _, o := range fs.cfs {
+		if ofs, ok := o.(*consumerFileStore); ok {
+			running[ofs.name] = struct{}{}
+		}
+	}
+	fs.mu.RUnlock()
+
+	// We need someone to confirm unless on recovery.
+	if !recovery && och == nil {
+		return nil
+	}
+
+	ofis, _ := os.ReadDir(odir)
+	var removed []string
+	for _, ofi := range ofis {
+		name := ofi.Name()
+		if _, ok := running[name]; ok || !ofi.IsDir() {
+			continue
+		}
+		dir := filepath.Join(odir, name)
+		if time.Since(lastModified(dir)) < ttl {
+			continue
+		}
+		missing, durable, err := fs.consumerMetaDurable(dir, name)
+		if err != nil || durable || recovery && !missing {
+			continue
+		}
+		if !missing && !och(name) {
+			continue
+		}
+		// Check again in case the consumer was started in the meantime.
+		var started bool
+		fs.mu.RLock()
+		for _, o := range fs.cfs {
+			if ofs, ok := o.(*consumerFileStore); ok && ofs.name == name {
+				started = true
+				break
+			}
+		}
+		fs.mu.RUnlock()
+		if !started && os.RemoveAll(dir) == nil {
+			removed = append(removed, name)
+		}
+	}
+	return removed
+}
+
+// Returns the latest modification time of a directory and its files.
+func lastModified(dir string) time.Time {
+	var last time.Time
+	if fi, err := os.Stat(dir); err == nil {
+		last = fi.ModTime()
+	}
+	fis, _ := os.ReadDir(dir)
+	for _, fi := range fis {
+		if info, err := fi.Info(); err == nil && info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	return last
+}
+
+// Reads the meta file of a consumer that is not running to tell if it is a durable.
+// Will report if the meta file and its backup are missing, in which case the consumer can not be recovered.
+func (fs *fileStore) consumerMetaDurable(dir, name string) (missing, durable bool, err error) {
+	if _, err := os.Stat(filepath.Join(dir, JetStreamMetaFile)); os.IsNotExist(err) {
+		if _, err := os.Stat(filepath.Join(dir, JetStreamMetaFileBackup)); os.IsNotExist(err) {
+			return true, false, nil
+		}
+	}
+	key := sha256.Sum256([]byte(fs.cfg.Name + "/" + name))
+	hh, err := highwayhash.New64(key[:])
+	if err != nil {
+		return false, false, err
+	}
+	// This will also fall back to a previous good meta file, like recovery would.
+	buf, err := recoverMetaFiles(dir, hh)
+	if err != nil {
+		return false, false, err
+	}
+	// Check for encryption.
+	if ekey, err := os.ReadFile(filepath.Join(dir, JetStreamMetaFileKey)); err == nil {
+		if fs.prf == nil || len(ekey) < minBlkKeySize {
+			return false, false, errBadKeySize
+		}
+		seed, _, _, err := fs.openKey(fs.cfg.Name+tsep+name, ekey)
+		if err != nil {
+			return false, false, err
+		}
+		aek, err := genEncryptionKey(fs.fcfg.Cipher, seed)
+		if err != nil {
+			return false, false, err
+		}
+		ns := aek.NonceSize()
+		if len(buf) < ns {
+			return false, false, errCorruptState
+		}
+		if buf, err = aek.Open(nil, buf[:ns], buf[ns:], nil); err != nil {
+			return false, false, err
+		}
+	}
+	var cfg FileConsumerInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return false, false, err
+	}
+	return false, isDurableConsumer(&cfg.ConsumerConfig), nil
+}
+
+// Will check the version of our state file and if older than what
+// we currently write will decode it and write it back in the new format.
+func (o *consumerFileStore) migrateState() error {
+	buf, err := os.ReadFile(o.ifn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if len(buf) == 0 {
+		return nil
+	}
+	if o.aek != nil {
+		ns := o.aek.NonceSize()
+		if len(buf) < ns {
+			return errCorruptState
+		}
+		if buf, err = o.aek.Open(nil, buf[:ns], buf[ns:], nil); err != nil {
+			return err
+		}
+	}
+	version, err := checkConsumerHeader(buf)
+	if err != nil {
+		return err
+	}
+	if version == consumerStateVersion {
+		return nil
+	}
+	state, err := decodeConsumerState(buf)
+	if err != nil {
+		return err
+	}
+	// Do not rewrite in place, a crash here would leave us with a truncated state file.
+	return writeFileAtomic(o.ifn, o.encryptState(encodeConsumerState(state)))
+}
+
 func (o *consumerFileStore) convertCipher() error {
 	fs := o.fs
 	odir := filepath.Join(fs.fcfg.StoreDir, consumerDir, o.name)
@@ -6013,6 +9486,9 @@ func (o *consumerFileStore) convertCipher() error {
 		return err
 	}
 
+	// Any journaled updates were sealed with the old cipher as well.
+	buf = o.foldJournal(buf, aek)
+
 	// Since we are here we recovered our old state.
 	// Now write our meta, which will generate the new keys with the new cipher.
 	if err := o.writeConsumerMeta(); err != nil {
@@ -6032,95 +9508,418 @@ func (o *consumerFileStore) kickFlusher() {
 		default:
 		}
 	}
-	o.dirty = true
-}
+	o.dirty = true
+}
+
+// Set in flusher status
+func (o *consumerFileStore) setInFlusher() {
+	o.mu.Lock()
+	o.flusher = true
+	o.mu.Unlock()
+}
+
+// Clear in flusher status
+func (o *consumerFileStore) clearInFlusher() {
+	o.mu.Lock()
+	o.flusher = false
+	o.mu.Unlock()
+}
+
+// Report in flusher status
+func (o *consumerFileStore) inFlusher() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.flusher
+}
+
+const (
+	// Minimum time between two writes of the consumer state under load.
+	consumerMinFlushInterval = 100 * time.Millisecond
+	// Interval at which state that could not be written before is retried.
+	consumerFlushRetryInterval = time.Second
+)
+
+// flushLoop watches for consumer updates and the quit channel.
+func (o *consumerFileStore) flushLoop(fch, qch chan struct{}) {
+
+	o.setInFlusher()
+	defer o.clearInFlusher()
+
+	// Maintain approximately 10 updates per second per consumer under load.
+	const minTime = consumerMinFlushInterval
+	var lastWrite time.Time
+	var dt *time.Timer
+
+	setDelayTimer := func(addWait time.Duration) {
+		if dt == nil {
+			dt = time.NewTimer(addWait)
+			return
+		}
+		if !dt.Stop() {
+			select {
+			case <-dt.C:
+			default:
+			}
+		}
+		dt.Reset(addWait)
+	}
+
+	// A kick can be missed when a write was already in progress, or a write
+	// can fail, so periodically make sure a dirty state makes it to disk.
+	rt := time.NewTicker(consumerFlushRetryInterval)
+	defer rt.Stop()
+
+	flush := func() bool {
+		// TODO(dlc) - if we error should start failing upwards.
+		if _, err := o.writePending(); err == ErrStoreClosed {
+			return false
+		}
+		lastWrite = time.Now()
+		return true
+	}
+
+	for {
+		select {
+		case <-fch:
+			if ts := time.Since(lastWrite); ts < minTime {
+				setDelayTimer(minTime - ts)
+				select {
+				case <-dt.C:
+				case <-qch:
+					return
+				}
+			}
+			if !flush() {
+				return
+			}
+		case <-rt.C:
+			o.mu.Lock()
+			retry := o.dirty && !o.writing && time.Since(lastWrite) >= consumerFlushRetryInterval
+			o.mu.Unlock()
+			if retry && !flush() {
+				return
+			}
+		case <-qch:
+			return
+		}
+	}
+}
+
+// Flush writes out any consumer state that has not been written yet.
+// This waits for a write already in progress.
+func (o *consumerFileStore) Flush() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for {
+		for o.writing && !o.closed {
+			o.wcond.Wait()
+		}
+		if o.closed {
+			return ErrStoreClosed
+		}
+		if !o.dirty {
+			return nil
+		}
+		o.mu.Unlock()
+		wrote, err := o.writePending()
+		o.mu.Lock()
+		if wrote || err != nil {
+			return err
+		}
+	}
+}
+
+// writeDone clears the writing flag and wakes up any waiting flushers.
+// Lock should be held.
+func (o *consumerFileStore) writeDone() {
+	o.writing = false
+	if o.wcond != nil {
+		o.wcond.Broadcast()
+	}
+}
+
+// Writes out what changed since the last write. Updates are appended to the
+// journal, unless we need the full state written, or the journal has grown
+// larger than the full state, in which case the state file is rewritten and
+// the journal restarted. Returns if anything was written.
+func (o *consumerFileStore) writePending() (bool, error) {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return false, ErrStoreClosed
+	}
+	if o.writing {
+		o.mu.Unlock()
+		return false, nil
+	}
+
+	if o.jready && !o.jfull && (o.jsize < consumerJournalCompactMin || o.jsize < o.jbase) {
+		recs := o.jbuf
+		o.jbuf = nil
+		if len(recs) == 0 {
+			o.dirty = false
+			o.mu.Unlock()
+			return false, nil
+		}
+		if o.aek != nil {
+			recs = o.encryptState(recs)
+		}
+		chunk := make([]byte, 0, binary.MaxVarintLen64+len(recs)+8)
+		chunk = binary.AppendUvarint(chunk, uint64(len(recs)))
+		chunk = append(chunk, recs...)
+		o.hh.Reset()
+		o.hh.Write(recs)
+		chunk = o.hh.Sum(chunk)
+		o.writing, o.dirty = true, false
+		jfn := o.jfn
+		o.mu.Unlock()
+
+		<-dios
+		f, err := os.OpenFile(jfn, os.O_WRONLY|os.O_APPEND, defaultFilePerms)
+		if err == nil {
+			_, err = f.Write(chunk)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}
+		dios <- struct{}{}
+
+		o.mu.Lock()
+		if err != nil {
+			o.dirty, o.jfull = true, true
+		} else {
+			o.jsize += int64(len(chunk))
+		}
+		o.writeDone()
+		o.mu.Unlock()
+		return err == nil, err
+	}
+
+	// Write the full state and restart the journal from it.
+	buf := encodeConsumerState(&o.state)
+	o.jbuf, o.jfull = nil, false
+	hdr := o.journalHeader(buf)
+	if o.aek != nil {
+		buf = o.encryptState(buf)
+	}
+	o.writing, o.dirty = true, false
+	ifn, jfn := o.ifn, o.jfn
+	o.mu.Unlock()
+
+	<-dios
+	err := os.WriteFile(ifn, buf, defaultFilePerms)
+	if err == nil {
+		err = os.WriteFile(jfn, hdr, defaultFilePerms)
+	}
+	dios <- struct{}{}
 
-// Set in flusher status
-func (o *consumerFileStore) setInFlusher() {
 	o.mu.Lock()
-	o.flusher = true
+	if err != nil {
+		o.dirty, o.jfull = true, true
+	} else {
+		o.jready, o.jsize, o.jbase = true, int64(len(hdr)), int64(len(buf))
+	}
+	o.writeDone()
 	o.mu.Unlock()
-}
 
-// Clear in flusher status
-func (o *consumerFileStore) clearInFlusher() {
-	o.mu.Lock()
-	o.flusher = false
-	o.mu.Unlock()
+	return err == nil, err
 }
 
-// Report in flusher status
-func (o *consumerFileStore) inFlusher() bool {
-	o.mu.Lock()
-	defer o.mu.Unlock()
-	return o.flusher
+const (
+	// Journal size below which we do not bother compacting.
+	consumerJournalCompactMin = 64 * 1024
+	// Journal record types.
+	consumerJournalDelivered = uint8(1)
+	consumerJournalAck       = uint8(2)
+)
+
+// The journal header ties the journal to the exact state it was started from.
+// Lock should be held.
+func (o *consumerFileStore) journalHeader(state []byte) []byte {
+	o.hh.Reset()
+	o.hh.Write(state)
+	return o.hh.Sum([]byte{magic, consumerJournalVersion})
 }
 
-// flushLoop watches for consumer updates and the quit channel.
-func (o *consumerFileStore) flushLoop(fch, qch chan struct{}) {
+// Record a delivered update in the journal.
+// Lock should be held.
+func (o *consumerFileStore) journalDelivered(dseq, sseq, dc uint64, ts int64) {
+	if !o.jready || o.jfull {
+		// The next write will be the full state.
+		o.jbuf, o.jfull = nil, true
+		return
+	}
+	o.jbuf = append(o.jbuf, consumerJournalDelivered)
+	o.jbuf = binary.AppendUvarint(o.jbuf, dseq)
+	o.jbuf = binary.AppendUvarint(o.jbuf, sseq)
+	o.jbuf = binary.AppendUvarint(o.jbuf, dc)
+	o.jbuf = binary.AppendVarint(o.jbuf, ts)
+}
 
-	o.setInFlusher()
-	defer o.clearInFlusher()
+// Record an ack in the journal.
+// Lock should be held.
+func (o *consumerFileStore) journalAck(dseq, sseq uint64) {
+	if !o.jready || o.jfull {
+		o.jbuf, o.jfull = nil, true
+		return
+	}
+	o.jbuf = append(o.jbuf, consumerJournalAck)
+	o.jbuf = binary.AppendUvarint(o.jbuf, dseq)
+	o.jbuf = binary.AppendUvarint(o.jbuf, sseq)
+}
 
-	// Maintain approximately 10 updates per second per consumer under load.
-	const minTime = 100 * time.Millisecond
-	var lastWrite time.Time
-	var dt *time.Timer
+// Replays the journal on top of the state just read from the state file.
+// A journal started from a different state is ignored, and a torn tail is dropped.
+// Lock should be held.
+func (o *consumerFileStore) replayJournal(state []byte) error {
+	o.jready, o.jbase = false, int64(len(state))
+	buf, err := os.ReadFile(o.jfn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	hdr := o.journalHeader(state)
+	if len(buf) < len(hdr) || !bytes.Equal(buf[:len(hdr)], hdr) {
+		return nil
+	}
 
-	setDelayTimer := func(addWait time.Duration) {
-		if dt == nil {
-			dt = time.NewTimer(addWait)
-			return
+	bi := len(hdr)
+	for bi < len(buf) {
+		rl, n := binary.Uvarint(buf[bi:])
+		if n <= 0 || rl > uint64(len(buf)) {
+			break
 		}
-		if !dt.Stop() {
-			select {
-			case <-dt.C:
-			default:
+		end := bi + n + int(rl)
+		if end+8 > len(buf) {
+			break
+		}
+		recs := buf[bi+n : end]
+		o.hh.Reset()
+		o.hh.Write(recs)
+		if !bytes.Equal(o.hh.Sum(nil), buf[end:end+8]) {
+			break
+		}
+		if o.aek != nil {
+			ns := o.aek.NonceSize()
+			if len(recs) < ns {
+				break
+			}
+			if recs, err = o.aek.Open(nil, recs[:ns], recs[ns:], nil); err != nil {
+				break
 			}
 		}
-		dt.Reset(addWait)
+		if err := o.applyJournal(recs); err != nil {
+			// We may have applied part of these, so write the full state next.
+			o.jfull = true
+			break
+		}
+		bi = end + 8
+	}
+	if bi < len(buf) {
+		if err := os.Truncate(o.jfn, int64(bi)); err != nil {
+			return nil
+		}
 	}
+	o.jready, o.jsize = true, int64(bi)
+	return nil
+}
 
-	for {
-		select {
-		case <-fch:
-			if ts := time.Since(lastWrite); ts < minTime {
-				setDelayTimer(minTime - ts)
-				select {
-				case <-dt.C:
-				case <-qch:
-					return
-				}
+// Returns the state with any journaled updates applied and removes the journal.
+// Used when the state file is rewritten with a different key, aek being the key
+// the journal was written with.
+func (o *consumerFileStore) foldJournal(buf []byte, aek cipher.AEAD) []byte {
+	if state, err := decodeConsumerState(buf); err == nil {
+		saek := o.aek
+		o.aek, o.state = aek, *state
+		if err := o.replayJournal(buf); err == nil && o.jready {
+			buf = encodeConsumerState(&o.state)
+		}
+		o.aek, o.state, o.jready, o.jfull = saek, ConsumerState{}, false, false
+	}
+	os.Remove(o.jfn)
+	return buf
+}
+
+// Applies journal records to our state.
+// Lock should be held.
+func (o *consumerFileStore) applyJournal(buf []byte) error {
+	var bi int
+	readSeq := func() uint64 {
+		if bi < 0 {
+			return 0
+		}
+		seq, n := binary.Uvarint(buf[bi:])
+		if n <= 0 {
+			bi = -1
+			return 0
+		}
+		bi += n
+		return seq
+	}
+	for bi < len(buf) {
+		op := buf[bi]
+		bi++
+		switch op {
+		case consumerJournalDelivered:
+			dseq, sseq, dc := readSeq(), readSeq(), readSeq()
+			if bi < 0 {
+				return errCorruptState
 			}
-			o.mu.Lock()
-			if o.closed {
-				o.mu.Unlock()
-				return
+			ts, n := binary.Varint(buf[bi:])
+			if n <= 0 {
+				return errCorruptState
 			}
-			buf, err := o.encodeState()
-			o.mu.Unlock()
-			if err != nil {
-				return
+			bi += n
+			o.applyDelivered(dseq, sseq, dc, ts)
+		case consumerJournalAck:
+			dseq, sseq := readSeq(), readSeq()
+			if bi < 0 {
+				return errCorruptState
 			}
-			// TODO(dlc) - if we error should start failing upwards.
-			o.writeState(buf)
-			lastWrite = time.Now()
-		case <-qch:
-			return
+			o.applyAck(dseq, sseq)
+		default:
+			return errCorruptState
+		}
+	}
+	return nil
+}
+
+// NumPending returns the number of messages matching filter that have not been
+// delivered yet, using the stream's per subject state.
+func (o *consumerFileStore) NumPending(filter string) (uint64, error) {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	filter, err := consumerPendingFilter(o.cfg.FilterSubject, filter)
+	if err != nil {
+		o.mu.Unlock()
+		return 0, err
+	}
+	// Make sure we have our state.
+	if o.state.Delivered.Consumer == 0 && o.state.Delivered.Stream == 0 {
+		if err := o.loadState(); err != nil {
+			o.mu.Unlock()
+			return 0, err
 		}
 	}
+	sseq, fs := o.state.pendingStart(), o.fs
+	o.mu.Unlock()
+
+	return fs.FilteredState(sseq, filter).Msgs, nil
 }
 
 // SetStarting sets our starting stream sequence.
 func (o *consumerFileStore) SetStarting(sseq uint64) error {
 	o.mu.Lock()
 	o.state.Delivered.Stream = sseq
-	buf, err := o.encodeState()
+	o.jbuf, o.jfull, o.dirty = nil, true, true
 	o.mu.Unlock()
-	if err != nil {
-		return err
-	}
-	return o.writeState(buf)
+	_, err := o.writePending()
+	return err
 }
 
 // HasState returns if this store has a recorded state.
@@ -6136,13 +9935,26 @@ func (o *consumerFileStore) UpdateDelivered(dseq, sseq, dc uint64, ts int64) err
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
+	if updated, err := o.applyDelivered(dseq, sseq, dc, ts); !updated || err != nil {
+		return err
+	}
+	o.journalDelivered(dseq, sseq, dc, ts)
+	// Make sure we flush to disk.
+	o.kickFlusher()
+
+	return nil
+}
+
+// Applies a delivered update to our state, returns if the state was updated.
+// Lock should be held.
+func (o *consumerFileStore) applyDelivered(dseq, sseq, dc uint64, ts int64) (bool, error) {
 	if dc != 1 && o.cfg.AckPolicy == AckNone {
-		return ErrNoAckPolicy
+		return false, ErrNoAckPolicy
 	}
 
 	// On restarts the old leader may get a replay from the raft logs that are old.
 	if dseq <= o.state.AckFloor.Consumer {
-		return nil
+		return false, nil
 	}
 
 	// See if we expect an ack for this.
@@ -6182,10 +9994,7 @@ func (o *consumerFileStore) UpdateDelivered(dseq, sseq, dc uint64, ts int64) err
 		o.state.AckFloor.Consumer = dseq
 		o.state.AckFloor.Stream = sseq
 	}
-	// Make sure we flush to disk.
-	o.kickFlusher()
-
-	return nil
+	return true, nil
 }
 
 // UpdateAcks is called whenever a consumer with explicit ack or ack all acks a message.
@@ -6193,16 +10002,28 @@ func (o *consumerFileStore) UpdateAcks(dseq, sseq uint64) error {
 	o.mu.Lock()
 	defer o.mu.Unlock()
 
+	if updated, err := o.applyAck(dseq, sseq); !updated || err != nil {
+		return err
+	}
+	o.journalAck(dseq, sseq)
+	o.kickFlusher()
+
+	return nil
+}
+
+// Applies an ack to our state, returns if the state was updated.
+// Lock should be held.
+func (o *consumerFileStore) applyAck(dseq, sseq uint64) (bool, error) {
 	if o.cfg.AckPolicy == AckNone {
-		return ErrNoAckPolicy
+		return false, ErrNoAckPolicy
 	}
 	if len(o.state.Pending) == 0 || o.state.Pending[sseq] == nil {
-		return ErrStoreMsgNotFound
+		return false, ErrStoreMsgNotFound
 	}
 
 	// On restarts the old leader may get a replay from the raft logs that are old.
 	if dseq <= o.state.AckFloor.Consumer {
-		return nil
+		return false, nil
 	}
 
 	// Check for AckAll here.
@@ -6216,8 +10037,7 @@ func (o *consumerFileStore) UpdateAcks(dseq, sseq uint64) error {
 				delete(o.state.Redelivered, seq)
 			}
 		}
-		o.kickFlusher()
-		return nil
+		return true, nil
 	}
 
 	// AckExplicit
@@ -6252,9 +10072,7 @@ func (o *consumerFileStore) UpdateAcks(dseq, sseq uint64) error {
 			}
 		}
 	}
-
-	o.kickFlusher()
-	return nil
+	return true, nil
 }
 
 const seqsHdrSize = 6*binary.MaxVarintLen64 + hdrLen
@@ -6332,6 +10150,7 @@ func (o *consumerFileStore) Update(state *ConsumerState) error {
 	o.state.AckFloor = state.AckFloor
 	o.state.Pending = pending
 	o.state.Redelivered = redelivered
+	o.jbuf, o.jfull = nil, true
 	o.kickFlusher()
 
 	return nil
@@ -6370,11 +10189,18 @@ func init() {
 }
 
 func (o *consumerFileStore) writeState(buf []byte) error {
+	_, err := o.tryWriteState(buf)
+	return err
+}
+
+// Writes the state unless another write is in progress.
+// Returns if the state was written.
+func (o *consumerFileStore) tryWriteState(buf []byte) (bool, error) {
 	// Check if we have the index file open.
 	o.mu.Lock()
 	if o.writing || len(buf) == 0 {
 		o.mu.Unlock()
-		return nil
+		return false, nil
 	}
 
 	// Check on encryption.
@@ -6396,10 +10222,10 @@ func (o *consumerFileStore) writeState(buf []byte) error {
 	if err != nil {
 		o.dirty = true
 	}
-	o.writing = false
+	o.writeDone()
 	o.mu.Unlock()
 
-	return err
+	return err == nil, err
 }
 
 // Will upodate the config. Only used when recovering ephemerals.
@@ -6445,17 +10271,7 @@ func (cfs *consumerFileStore) writeConsumerMeta() error {
 		b = cfs.aek.Seal(nonce, nonce, b, nil)
 	}
 
-	if err := os.WriteFile(meta, b, defaultFilePerms); err != nil {
-		return err
-	}
-	cfs.hh.Reset()
-	cfs.hh.Write(b)
-	checksum := hex.EncodeToString(cfs.hh.Sum(nil))
-	sum := filepath.Join(cfs.odir, JetStreamMetaFileSum)
-	if err := os.WriteFile(sum, []byte(checksum), defaultFilePerms); err != nil {
-		return err
-	}
-	return nil
+	return writeMetaFiles(cfs.odir, b, cfs.hh)
 }
 
 // Make sure the header is correct.
@@ -6466,14 +10282,25 @@ func checkHeader(hdr []byte) error {
 	return nil
 }
 
+// Index file version.
+func checkIndexHeader(hdr []byte) (uint8, error) {
+	if hdr == nil || len(hdr) < 2 || hdr[0] != magic {
+		return 0, errCorruptState
+	}
+	version := hdr[1]
+	if version >= indexV1 && version <= indexVersion {
+		return version, nil
+	}
+	return 0, fmt.Errorf("unsupported version: %d", version)
+}
+
 // Consumer version.
 func checkConsumerHeader(hdr []byte) (uint8, error) {
 	if hdr == nil || len(hdr) < 2 || hdr[0] != magic {
 		return 0, errCorruptState
 	}
 	version := hdr[1]
-	switch version {
-	case 1, 2:
+	if version >= consumerStateV1 && version <= consumerStateVersion {
 		return version, nil
 	}
 	return 0, fmt.Errorf("unsupported version: %d", version)
@@ -6518,37 +10345,43 @@ func (o *consumerFileStore) stateWithCopy(doCopy bool) (*ConsumerState, error) {
 		return nil, ErrStoreClosed
 	}
 
-	state := &ConsumerState{}
-
 	// See if we have a running state or if we need to read in from disk.
-	if o.state.Delivered.Consumer != 0 || o.state.Delivered.Stream != 0 {
-		state.Delivered = o.state.Delivered
-		state.AckFloor = o.state.AckFloor
-		if len(o.state.Pending) > 0 {
-			if doCopy {
-				state.Pending = o.copyPending()
-			} else {
-				state.Pending = o.state.Pending
-			}
+	if o.state.Delivered.Consumer == 0 && o.state.Delivered.Stream == 0 {
+		if err := o.loadState(); err != nil {
+			return nil, err
 		}
-		if len(o.state.Redelivered) > 0 {
-			if doCopy {
-				state.Redelivered = o.copyRedelivered()
-			} else {
-				state.Redelivered = o.state.Redelivered
-			}
+	}
+
+	state := &ConsumerState{
+		Delivered: o.state.Delivered,
+		AckFloor:  o.state.AckFloor,
+	}
+	if len(o.state.Pending) > 0 {
+		if doCopy {
+			state.Pending = o.copyPending()
+		} else {
+			state.Pending = o.state.Pending
 		}
-		return state, nil
 	}
+	if len(o.state.Redelivered) > 0 {
+		if doCopy {
+			state.Redelivered = o.copyRedelivered()
+		} else {
+			state.Redelivered = o.state.Redelivered
+		}
+	}
+	return state, nil
+}
 
-	// Read the state in here from disk..
+// Reads in our state from the state file and replays the journal on top of it.
+// Lock should be held.
+func (o *consumerFileStore) loadState() error {
 	buf, err := os.ReadFile(o.ifn)
 	if err != nil && !os.IsNotExist(err) {
-		return nil, err
+		return err
 	}
-
 	if len(buf) == 0 {
-		return state, nil
+		return nil
 	}
 
 	// Check on encryption.
@@ -6556,40 +10389,17 @@ func (o *consumerFileStore) stateWithCopy(doCopy bool) (*ConsumerState, error) {
 		ns := o.aek.NonceSize()
 		buf, err = o.aek.Open(nil, buf[:ns], buf[ns:], nil)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
 
-	state, err = decodeConsumerState(buf)
+	state, err := decodeConsumerState(buf)
 	if err != nil {
-		return nil, err
-	}
-
-	// Copy this state into our own.
-	o.state.Delivered = state.Delivered
-	o.state.AckFloor = state.AckFloor
-	if len(state.Pending) > 0 {
-		if doCopy {
-			o.state.Pending = make(map[uint64]*Pending, len(state.Pending))
-			for seq, p := range state.Pending {
-				o.state.Pending[seq] = &Pending{p.Sequence, p.Timestamp}
-			}
-		} else {
-			o.state.Pending = state.Pending
-		}
-	}
-	if len(state.Redelivered) > 0 {
-		if doCopy {
-			o.state.Redelivered = make(map[uint64]uint64, len(state.Redelivered))
-			for seq, dc := range state.Redelivered {
-				o.state.Redelivered[seq] = dc
-			}
-		} else {
-			o.state.Redelivered = state.Redelivered
-		}
+		return err
 	}
+	o.state = *state
 
-	return state, nil
+	return o.replayJournal(buf)
 }
 
 // Decode consumer state.
@@ -6638,7 +10448,7 @@ func decodeConsumerState(buf []byte) (*ConsumerState, error) {
 	if bi == -1 {
 		return nil, errCorruptState
 	}
-	if version == 1 {
+	if version == consumerStateV1 {
 		// Adjust back. Version 1 also stored delivered as next to be delivered,
 		// so adjust that back down here.
 		if state.AckFloor.Consumer > 1 {
@@ -6656,7 +10466,7 @@ func decodeConsumerState(buf []byte) (*ConsumerState, error) {
 		for i := 0; i < int(numPending); i++ {
 			sseq := readSeq()
 			var dseq uint64
-			if version == 2 {
+			if version >= consumerStateV2 {
 				dseq = readSeq()
 			}
 			ts := readTimeStamp()
@@ -6669,11 +10479,11 @@ func decodeConsumerState(buf []byte) (*ConsumerState, error) {
 			if sseq == 0 {
 				return nil, errCorruptState
 			}
-			if version == 2 {
+			if version >= consumerStateV2 {
 				dseq += state.AckFloor.Consumer
 			}
 			// Adjust the timestamp back.
-			if version == 1 {
+			if version == consumerStateV1 {
 				ts = (ts + mints) * int64(time.Second)
 			} else {
 				ts = (mints - ts) * int64(time.Second)
@@ -6724,7 +10534,10 @@ func (o *consumerFileStore) Stop() error {
 
 	o.odir = _EMPTY_
 	o.closed = true
-	ifn, fs := o.ifn, o.fs
+	if o.wcond != nil {
+		o.wcond.Broadcast()
+	}
+	ifn, jfn, fs := o.ifn, o.jfn, o.fs
 	o.mu.Unlock()
 
 	fs.RemoveConsumer(o)
@@ -6733,6 +10546,10 @@ func (o *consumerFileStore) Stop() error {
 		o.waitOnFlusher()
 		<-dios
 		err = os.WriteFile(ifn, buf, defaultFilePerms)
+		if err == nil {
+			// The journal is folded into the state we just wrote.
+			os.Remove(jfn)
+		}
 		dios <- struct{}{}
 	}
 	return err
@@ -6846,20 +10663,44 @@ func (ts *templateFileStore) Store(t *streamTemplate) error {
 	if err != nil {
 		return err
 	}
-	if err := os.WriteFile(meta, b, defaultFilePerms); err != nil {
-		return err
-	}
-	// FIXME(dlc) - Do checksum
-	ts.hh.Reset()
-	ts.hh.Write(b)
-	checksum := hex.EncodeToString(ts.hh.Sum(nil))
-	sum := filepath.Join(dir, JetStreamMetaFileSum)
-	if err := os.WriteFile(sum, []byte(checksum), defaultFilePerms); err != nil {
-		return err
-	}
-	return nil
+	return writeMetaFiles(dir, b, ts.hh)
 }
 
 func (ts *templateFileStore) Delete(t *streamTemplate) error {
 	return os.RemoveAll(filepath.Join(ts.dir, t.Name))
 }
+
+// LoadAll reads back all persisted templates, verifying their checksums.
+// Templates that can not be recovered are skipped and reported in the
+// returned error alongside the ones that were loaded.
+func (ts *templateFileStore) LoadAll() ([]*StreamTemplateConfig, error) {
+	fis, err := os.ReadDir(ts.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var cfgs []*StreamTemplateConfig
+	var errs []string
+	for _, fi := range fis {
+		if !fi.IsDir() {
+			continue
+		}
+		buf, err := recoverMetaFiles(filepath.Join(ts.dir, fi.Name()), ts.hh)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %v", fi.Name(), err))
+			continue
+		}
+		var cfg StreamTemplateConfig
+		if err := json.Unmarshal(buf, &cfg); err != nil {
+			errs = append(errs, fmt.Sprintf("%q: %v", fi.Name(), err))
+			continue
+		}
+		cfgs = append(cfgs, &cfg)
+	}
+	if len(errs) > 0 {
+		return cfgs, fmt.Errorf("could not load templates %s", strings.Join(errs, ", "))
+	}
+	return cfgs, nil
+}
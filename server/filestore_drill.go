@@ -0,0 +1,247 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CorruptionDrill describes what to corrupt in a copy of a file store.
+type CorruptionDrill struct {
+	// Seq selects the message record to corrupt. The first byte after the record
+	// header will be flipped so that the checksum no longer matches.
+	Seq uint64 `json:"seq,omitempty"`
+	// Block and Offset select a byte in a message block file when Seq is not set.
+	Block  uint32 `json:"block,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	// Index will corrupt the index file of the selected block at Offset instead.
+	Index bool `json:"index,omitempty"`
+}
+
+// CorruptionDrillReport is what was detected and repaired during a corruption drill.
+type CorruptionDrillReport struct {
+	File      string           `json:"file"`
+	Offset    int64            `json:"offset"`
+	Before    StreamState      `json:"before"`
+	Recovered StreamState      `json:"recovered"`
+	Lost      *LostStreamData  `json:"lost,omitempty"`
+	Health    *FileStoreHealth `json:"health"`
+	After     StreamState      `json:"after"`
+}
+
+var (
+	errDrillEncrypted    = errors.New("corruption drills require an unencrypted store")
+	errStoreNoStream     = errors.New("an account and a stream are required")
+	errStoreNotFileBased = errors.New("stream is not file based")
+)
+
+// StoreCheckOptions are options passed to a store check of a stream.
+type StoreCheckOptions struct {
+	Account string `json:"account"`
+	Stream  string `json:"stream"`
+	// Quarantine will move damaged blocks into the corrupt directory and
+	// rebuild the stream state from the remaining data.
+	Quarantine bool `json:"quarantine,omitempty"`
+}
+
+// CorruptionDrillOptions are options passed to a corruption drill of a stream.
+type CorruptionDrillOptions struct {
+	Account string `json:"account"`
+	Stream  string `json:"stream"`
+	CorruptionDrill
+}
+
+// Returns the file store of the given stream.
+func (s *Server) lookupFileStore(account, stream string) (*fileStore, error) {
+	if account == _EMPTY_ || stream == _EMPTY_ {
+		return nil, errStoreNoStream
+	}
+	acc, err := s.LookupAccount(account)
+	if err != nil {
+		return nil, err
+	}
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		return nil, err
+	}
+	mset.mu.RLock()
+	fs, ok := mset.store.(*fileStore)
+	mset.mu.RUnlock()
+	if !ok {
+		return nil, errStoreNotFileBased
+	}
+	return fs, nil
+}
+
+// StoreCheck will verify the checksums of all messages of a file based stream.
+func (s *Server) StoreCheck(opts *StoreCheckOptions) (*FileStoreHealth, error) {
+	fs, err := s.lookupFileStore(opts.Account, opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	return fs.HealthCheck(opts.Quarantine), nil
+}
+
+// CorruptionDrill will run a corruption drill against a temporary copy of a file
+// based stream. The stream itself is not modified and keeps serving while copied.
+func (s *Server) CorruptionDrill(opts *CorruptionDrillOptions) (*CorruptionDrillReport, error) {
+	fs, err := s.lookupFileStore(opts.Account, opts.Stream)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure what we have pending is on disk before copying.
+	fs.mu.Lock()
+	fs.checkAndFlushAllBlocks()
+	storeDir := fs.fcfg.StoreDir
+	fs.mu.Unlock()
+
+	workDir, err := os.MkdirTemp(_EMPTY_, "nats-drill-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(workDir)
+	return RunCorruptionDrill(storeDir, workDir, opts.CorruptionDrill)
+}
+
+// RunCorruptionDrill will copy the file store at storeDir into workDir, corrupt the copy
+// as described by the drill and then run recovery and repair on it. The original store
+// is never modified. This is used to validate operational runbooks and repair paths.
+func RunCorruptionDrill(storeDir, workDir string, drill CorruptionDrill) (*CorruptionDrillReport, error) {
+	// Encrypted stores have a key file next to the meta file.
+	if _, err := os.Stat(filepath.Join(storeDir, JetStreamMetaFileKey)); err == nil {
+		return nil, errDrillEncrypted
+	}
+	buf, err := os.ReadFile(filepath.Join(storeDir, JetStreamMetaFile))
+	if err != nil {
+		return nil, err
+	}
+	var cfg FileStreamInfo
+	if err := json.Unmarshal(buf, &cfg); err != nil {
+		return nil, err
+	}
+	if err := copyDir(storeDir, workDir); err != nil {
+		return nil, err
+	}
+
+	fcfg := FileStoreConfig{StoreDir: workDir}
+	fs, err := newFileStoreWithCreated(fcfg, cfg.StreamConfig, cfg.Created, nil)
+	if err != nil {
+		return nil, err
+	}
+	report := &CorruptionDrillReport{Before: fs.State()}
+
+	// Locate what we need to corrupt.
+	fs.mu.RLock()
+	mb := fs.bim[drill.Block]
+	if drill.Seq > 0 {
+		mb = fs.selectMsgBlock(drill.Seq)
+	}
+	fs.mu.RUnlock()
+	if mb == nil {
+		fs.Stop()
+		return nil, ErrStoreMsgNotFound
+	}
+
+	mb.mu.Lock()
+	report.File, report.Offset = mb.mfn, drill.Offset
+	if drill.Index {
+		report.File = mb.ifn
+	} else if drill.Seq > 0 {
+		if mb.cacheNotLoaded() {
+			err = mb.loadMsgsWithLock()
+		}
+		var ri uint32
+		if err == nil {
+			ri, _, _, err = mb.slotInfo(int(drill.Seq - mb.cache.fseq))
+		}
+		report.Offset = int64(ri) + msgHdrSize
+	}
+	mb.mu.Unlock()
+	fs.Stop()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := flipByte(report.File, report.Offset); err != nil {
+		return nil, err
+	}
+
+	// Now run recovery, and then check and repair what recovery did not detect.
+	if fs, err = newFileStoreWithCreated(fcfg, cfg.StreamConfig, cfg.Created, nil); err != nil {
+		return nil, err
+	}
+	defer fs.Stop()
+
+	report.Recovered = fs.State()
+	report.Lost = fs.lostData()
+	report.Health = fs.HealthCheck(true)
+	report.After = fs.State()
+
+	return report, nil
+}
+
+// Flip all the bits of the byte at offset in the given file.
+func flipByte(fn string, offset int64) error {
+	f, err := os.OpenFile(fn, os.O_RDWR, defaultFilePerms)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset); err != nil {
+		return fmt.Errorf("could not read offset %d of %q: %v", offset, fn, err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b[:], offset); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Copy all files and directories from src to dst.
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			return os.MkdirAll(target, defaultDirPerms)
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, defaultFilePerms)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(out, in); err != nil {
+			out.Close()
+			return err
+		}
+		return out.Close()
+	})
+}
@@ -1750,6 +1750,9 @@ func (s *Server) removeRemoteGatewayConnection(c *client) {
 		// Update total count of qsubs in remote gateways.
 		atomic.AddInt64(&c.srv.gateway.totalQSubs, -qSubsRemoved)
 
+		// We no longer have an outbound connection to this gateway.
+		s.sendWebhookEvent(WebhookGatewayOutage, &WebhookEvent{Remote: gwName})
+
 	} else {
 		var subsa [1024]*subscription
 		var subs = subsa[:0]
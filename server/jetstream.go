@@ -17,12 +17,14 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/binary"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
 	"strconv"
 	"strings"
 	"sync"
@@ -114,6 +116,25 @@ type jetStream struct {
 	standAlone     bool
 	disabled       bool
 	oos            bool
+
+	// Where file based streams archive cold message blocks, if configured.
+	archive BlockArchive
+
+	// Throttle for background disk I/O of our file based streams.
+	bgIO *ioThrottle
+	// Throttle for re-encrypting message blocks of our file based streams.
+	reKeyIO *ioThrottle
+	// Limits open file descriptors of message blocks, if configured.
+	blkFDs *fdManager
+
+	// Runs consumer deliveries on shared workers, if configured.
+	dsched *deliveryScheduler
+
+	// Staged restores currently receiving chunks.
+	restores map[string]struct{}
+
+	// Progress recovering streams on startup.
+	recovery streamRecovery
 }
 
 type remoteUsage struct {
@@ -133,6 +154,14 @@ type jsaStorage struct {
 // an internal sub for a stream, so we will direct link to the stream
 // and walk backwards as needed vs multiple hash lookups and locks, etc.
 type jsAccount struct {
+	// These are here first because of atomics on 32bit systems.
+	// Local usage and object counts, reported in account events
+	// where we can not take the locks below.
+	lmem       int64
+	lstore     int64
+	nstreams   int64
+	nconsumers int64
+
 	mu        sync.RWMutex
 	js        *jetStream
 	account   *Account
@@ -141,6 +170,10 @@ type jsAccount struct {
 	templates map[string]*streamTemplate
 	store     TemplateStore
 
+	// Serializes adding streams, so that checking the limits and taking the
+	// reservation of a new stream can not race with another stream being added.
+	addMu sync.Mutex
+
 	// From server
 	sendq *ipQueue // of *pubMsg
 
@@ -212,22 +245,36 @@ type keyGen func(context []byte) ([]byte, error)
 // Return a key generation function or nil if encryption not enabled.
 // keyGen defined in filestore.go - keyGen func(iv, context []byte) []byte
 func (s *Server) jsKeyGen(info string) keyGen {
-	if ek := s.getOpts().JetStreamKey; ek != _EMPTY_ {
-		return func(context []byte) ([]byte, error) {
-			h := hmac.New(sha256.New, []byte(ek))
-			if _, err := h.Write([]byte(info)); err != nil {
-				return nil, err
-			}
-			if _, err := h.Write(context); err != nil {
-				return nil, err
-			}
-			return h.Sum(nil), nil
+	return jsKeyGenFor(s.getOpts().JetStreamKey, info)
+}
+
+// Return a key generation function for the previous encryption key, or nil if
+// we are not rotating keys. Assets sealed under it are re-encrypted on recovery.
+func (s *Server) jsPrevKeyGen(info string) keyGen {
+	if s.getOpts().JetStreamKey == _EMPTY_ {
+		return nil
+	}
+	return jsKeyGenFor(s.getOpts().JetStreamPrevKey, info)
+}
+
+func jsKeyGenFor(ek, info string) keyGen {
+	if ek == _EMPTY_ {
+		return nil
+	}
+	return func(context []byte) ([]byte, error) {
+		h := hmac.New(sha256.New, []byte(ek))
+		if _, err := h.Write([]byte(info)); err != nil {
+			return nil, err
 		}
+		if _, err := h.Write(context); err != nil {
+			return nil, err
+		}
+		return h.Sum(nil), nil
 	}
-	return nil
 }
 
 // Decode the encrypted metafile.
+// If we are rotating keys this will fall back to the previous key.
 func (s *Server) decryptMeta(sc StoreCipher, ekey, buf []byte, acc, context string) ([]byte, error) {
 	if len(ekey) < minMetaKeySize {
 		return nil, errBadKeySize
@@ -236,6 +283,18 @@ func (s *Server) decryptMeta(sc StoreCipher, ekey, buf []byte, acc, context stri
 	if prf == nil {
 		return nil, errNoEncryption
 	}
+	plain, err := decryptMetaWithKey(prf, sc, ekey, buf, context)
+	if err != nil {
+		if oprf := s.jsPrevKeyGen(acc); oprf != nil {
+			if oplain, oerr := decryptMetaWithKey(oprf, sc, ekey, buf, context); oerr == nil {
+				return oplain, nil
+			}
+		}
+	}
+	return plain, err
+}
+
+func decryptMetaWithKey(prf keyGen, sc StoreCipher, ekey, buf []byte, context string) ([]byte, error) {
 	rb, err := prf([]byte(context))
 	if err != nil {
 		return nil, err
@@ -324,17 +383,47 @@ func (s *Server) checkStoreDir(cfg *JetStreamConfig) error {
 
 // enableJetStream will start up the JetStream subsystem.
 func (s *Server) enableJetStream(cfg JetStreamConfig) error {
-	js := &jetStream{srv: s, config: cfg, accounts: make(map[string]*jsAccount), apiSubs: NewSublistNoCache()}
+	js := &jetStream{srv: s, config: cfg, accounts: make(map[string]*jsAccount), apiSubs: NewSublistNoCache(), bgIO: &ioThrottle{}, reKeyIO: &ioThrottle{}}
 	s.gcbMu.Lock()
 	if s.gcbOutMax = s.getOpts().JetStreamMaxCatchup; s.gcbOutMax == 0 {
 		s.gcbOutMax = defaultMaxTotalCatchupOutBytes
 	}
 	s.gcbMu.Unlock()
 
+	// Limit open file descriptors for our message blocks if requested.
+	if max := s.getOpts().JetStreamMaxOpenFiles; max > 0 {
+		js.blkFDs = newFDManager(max)
+	}
+	// Throttle background disk I/O if requested, in bytes per second.
+	js.bgIO.setRate(s.getOpts().JetStreamBackgroundIO)
+	// Bound the I/O used to re-encrypt message blocks when rotating keys.
+	if bps := s.getOpts().JetStreamReKeyRate; bps > 0 {
+		js.reKeyIO.setRate(bps)
+	} else {
+		js.reKeyIO.setRate(defaultReKeyRate)
+	}
+	// Run consumer deliveries on a shared set of workers if requested.
+	if n := s.getOpts().JetStreamSchedWorkers; n > 0 {
+		js.dsched = newDeliveryScheduler(n)
+	}
+	// Archive cold message blocks to object storage if requested.
+	if ao := s.getOpts().JetStreamArchive; ao != nil {
+		arc, err := newS3Archive(ao)
+		if err != nil {
+			return err
+		}
+		js.archive = arc
+	}
+
 	s.mu.Lock()
 	s.js = js
 	s.mu.Unlock()
 
+	// Evict block caches under process memory pressure if requested.
+	if budget := s.getOpts().JetStreamMemoryBudget; budget > 0 {
+		s.startGoRoutine(func() { s.monitorMemoryPressure(uint64(budget)) })
+	}
+
 	// FIXME(dlc) - Allow memory only operation?
 	if stat, err := os.Stat(cfg.StoreDir); os.IsNotExist(err) {
 		if err := os.MkdirAll(cfg.StoreDir, defaultDirPerms); err != nil {
@@ -376,6 +465,9 @@ func (s *Server) enableJetStream(cfg JetStreamConfig) error {
 	opts := s.getOpts()
 	if ek := opts.JetStreamKey; ek != _EMPTY_ {
 		s.Noticef("  Encryption:      %s", opts.JetStreamCipher)
+		if opts.JetStreamPrevKey != _EMPTY_ {
+			s.Noticef("  Key Rotation:    re-encrypting with new key")
+		}
 	}
 	s.Noticef("-------------------------------------------")
 
@@ -532,6 +624,10 @@ func (s *Server) handleOutOfSpace(mset *stream) {
 			Domain:   s.getOpts().JetStreamDomain,
 		}
 		s.publishAdvisory(nil, JSAdvisoryServerOutOfStorage, adv)
+		s.sendWebhookEvent(WebhookJetStreamStorageFault, &WebhookEvent{
+			Stream: stream,
+			Reason: "out of storage resources",
+		})
 	}
 }
 
@@ -581,6 +677,72 @@ func (s *Server) DisableJetStream() error {
 	return nil
 }
 
+const (
+	// How often we check process memory against the memory budget.
+	memPressureInterval = time.Second
+	// Percent of the memory budget at which we start evicting block caches.
+	memPressureHighPct = 90
+	// Percent of the memory budget we try to get back down to.
+	memPressureLowPct = 80
+)
+
+// Returns an approximation of the memory the Go runtime holds from the OS,
+// which is a close proxy for RSS.
+var processMemoryInUse = func() uint64 {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	if samples[0].Value.Kind() != metrics.KindUint64 || samples[1].Value.Kind() != metrics.KindUint64 {
+		return 0
+	}
+	return samples[0].Value.Uint64() - samples[1].Value.Uint64()
+}
+
+// monitorMemoryPressure will proactively evict block caches across all streams,
+// least recently used first, when the process approaches its memory budget.
+func (s *Server) monitorMemoryPressure(budget uint64) {
+	defer s.grWG.Done()
+
+	t := time.NewTicker(memPressureInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-t.C:
+			if !s.JetStreamEnabled() {
+				return
+			}
+			s.checkMemoryPressure(budget)
+		}
+	}
+}
+
+// Will evict block caches if we are over the high water mark of our memory budget.
+// Returns the number of bytes released.
+func (s *Server) checkMemoryPressure(budget uint64) uint64 {
+	inUse := processMemoryInUse()
+	if inUse <= budget/100*memPressureHighPct {
+		return 0
+	}
+	js := s.getJetStream()
+	if js == nil {
+		return 0
+	}
+	target := inUse - budget/100*memPressureLowPct
+	released := evictBlockCaches(js.fileStores(), target)
+	if released > 0 {
+		// Hand the released buffers back to the OS since the budget is on RSS.
+		debug.FreeOSMemory()
+		s.Debugf("JetStream memory pressure, %s in use with a budget of %s, evicted %s of block caches",
+			friendlyBytes(int64(inUse)), friendlyBytes(int64(budget)), friendlyBytes(int64(released)))
+	}
+	return released
+}
+
 func (s *Server) enableJetStreamAccounts() error {
 	// If we have no configured accounts setup then setup imports on global account.
 	if s.globalAccountOnly() {
@@ -893,6 +1055,9 @@ func (s *Server) shutdownJetStream() {
 		a.removeJetStream()
 	}
 
+	// All consumers are stopped, so stop our delivery workers.
+	js.dsched.stop()
+
 	s.mu.Lock()
 	s.js = nil
 	s.mu.Unlock()
@@ -1071,7 +1236,8 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 	}
 
 	// Clean up any old snapshots that were orphaned while staging.
-	os.RemoveAll(filepath.Join(js.config.StoreDir, snapStagingDir))
+	// Interrupted restores are kept for a while so they can be resumed.
+	removeStaleRestores(filepath.Join(js.config.StoreDir, snapStagingDir), restoreResumeExpire)
 
 	sdir := filepath.Join(jsa.storeDir, streamsDir)
 	if _, err := os.Stat(sdir); os.IsNotExist(err) {
@@ -1090,45 +1256,18 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 
 	// Check templates first since messsage sets will need proper ownership.
 	// FIXME(dlc) - Make this consistent.
-	tdir := filepath.Join(jsa.storeDir, tmplsDir)
-	if stat, err := os.Stat(tdir); err == nil && stat.IsDir() {
-		key := sha256.Sum256([]byte("templates"))
-		hh, err := highwayhash.New64(key[:])
+	if ts := newTemplateFileStore(jsa.storeDir); ts != nil {
+		cfgs, err := ts.LoadAll()
 		if err != nil {
-			return err
+			s.Warnf("  Error recovering StreamTemplates: %v", err)
 		}
-		fis, _ := os.ReadDir(tdir)
-		for _, fi := range fis {
-			metafile := filepath.Join(tdir, fi.Name(), JetStreamMetaFile)
-			metasum := filepath.Join(tdir, fi.Name(), JetStreamMetaFileSum)
-			buf, err := os.ReadFile(metafile)
-			if err != nil {
-				s.Warnf("  Error reading StreamTemplate metafile %q: %v", metasum, err)
-				continue
-			}
-			if _, err := os.Stat(metasum); os.IsNotExist(err) {
-				s.Warnf("  Missing StreamTemplate checksum for %q", metasum)
-				continue
-			}
-			sum, err := os.ReadFile(metasum)
-			if err != nil {
-				s.Warnf("  Error reading StreamTemplate checksum %q: %v", metasum, err)
-				continue
-			}
-			hh.Reset()
-			hh.Write(buf)
-			checksum := hex.EncodeToString(hh.Sum(nil))
-			if checksum != string(sum) {
-				s.Warnf("  StreamTemplate checksums do not match %q vs %q", sum, checksum)
-				continue
-			}
-			var cfg StreamTemplateConfig
-			if err := json.Unmarshal(buf, &cfg); err != nil {
-				s.Warnf("  Error unmarshalling StreamTemplate metafile: %v", err)
+		for _, cfg := range cfgs {
+			if cfg.Config == nil {
+				s.Warnf("  StreamTemplate %q is missing its stream config", cfg.Name)
 				continue
 			}
 			cfg.Config.Name = _EMPTY_
-			if _, err := a.addStreamTemplate(&cfg); err != nil {
+			if _, err := a.addStreamTemplate(cfg); err != nil {
 				s.Warnf("  Error recreating StreamTemplate %q: %v", cfg.Name, err)
 				continue
 			}
@@ -1151,7 +1290,9 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 	plaintext := true
 	sc := s.getOpts().JetStreamCipher
 
-	// Now recover the streams.
+	// Now recover the streams. We read and check all configs first and
+	// then recover the stores, which can take a while, concurrently.
+	var cfgs []*FileStreamInfo
 	fis, _ := os.ReadDir(sdir)
 	for _, fi := range fis {
 		mdir := filepath.Join(sdir, fi.Name())
@@ -1161,29 +1302,16 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			return err
 		}
 		metafile := filepath.Join(mdir, JetStreamMetaFile)
-		metasum := filepath.Join(mdir, JetStreamMetaFileSum)
 		if _, err := os.Stat(metafile); os.IsNotExist(err) {
-			s.Warnf("  Missing stream metafile for %q", metafile)
-			continue
-		}
-		buf, err := os.ReadFile(metafile)
-		if err != nil {
-			s.Warnf("  Error reading metafile %q: %v", metafile, err)
-			continue
-		}
-		if _, err := os.Stat(metasum); os.IsNotExist(err) {
-			s.Warnf("  Missing stream checksum file %q", metasum)
-			continue
+			if _, err := os.Stat(filepath.Join(mdir, JetStreamMetaFileBackup)); os.IsNotExist(err) {
+				s.Warnf("  Missing stream metafile for %q", metafile)
+				continue
+			}
 		}
-		sum, err := os.ReadFile(metasum)
+		// This will also complete an interrupted write or fall back to a previous good metafile.
+		buf, err := recoverMetaFiles(mdir, hh)
 		if err != nil {
-			s.Warnf("  Error reading Stream metafile checksum %q: %v", metasum, err)
-			continue
-		}
-		hh.Write(buf)
-		checksum := hex.EncodeToString(hh.Sum(nil))
-		if checksum != string(sum) {
-			s.Warnf("  Stream metafile %q: checksums do not match %q vs %q", metafile, sum, checksum)
+			s.Warnf("  Error recovering stream metafile %q: %v", metafile, err)
 			continue
 		}
 
@@ -1220,7 +1348,10 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			plaintext = false
 
 			// Remove the key file to have system regenerate with the new cipher.
-			os.Remove(keyFile)
+			// Otherwise keep it, our config history is sealed with it.
+			if convertingCiphers {
+				os.Remove(keyFile)
+			}
 		}
 
 		var cfg FileStreamInfo
@@ -1275,27 +1406,21 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			}
 		}
 
-		// Add in the stream.
-		mset, err := a.addStream(&cfg.StreamConfig)
-		if err != nil {
-			s.Warnf("  Error recreating stream %q: %v", cfg.Name, err)
+		cfgs = append(cfgs, &cfg)
+	}
+
+	for _, mset := range s.recoverStreams(a, cfgs) {
+		if mset == nil {
 			continue
 		}
-		if !cfg.Created.IsZero() {
-			mset.setCreatedTime(cfg.Created)
-		}
-
-		state := mset.state()
-		s.Noticef("  Restored %s messages for stream '%s > %s'", comma(int64(state.Msgs)), mset.accName(), mset.name())
-
 		// Collect to check for dangling messages.
 		// TODO(dlc) - Can be removed eventually.
-		if cfg.StreamConfig.Retention == InterestPolicy {
+		if mset.config().Retention == InterestPolicy {
 			ipstreams = append(ipstreams, mset)
 		}
 
 		// Now do the consumers.
-		odir := filepath.Join(sdir, fi.Name(), consumerDir)
+		odir := filepath.Join(sdir, mset.name(), consumerDir)
 		consumers = append(consumers, &ce{mset, odir})
 	}
 
@@ -1305,19 +1430,22 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 			s.Noticef("  Recovering %d consumers for stream - '%s > %s'", len(ofis), e.mset.accName(), e.mset.name())
 		}
 		for _, ofi := range ofis {
-			metafile := filepath.Join(e.odir, ofi.Name(), JetStreamMetaFile)
-			metasum := filepath.Join(e.odir, ofi.Name(), JetStreamMetaFileSum)
+			cdir := filepath.Join(e.odir, ofi.Name())
+			metafile := filepath.Join(cdir, JetStreamMetaFile)
 			if _, err := os.Stat(metafile); os.IsNotExist(err) {
-				s.Warnf("    Missing consumer metafile %q", metafile)
-				continue
+				if _, err := os.Stat(filepath.Join(cdir, JetStreamMetaFileBackup)); os.IsNotExist(err) {
+					s.Warnf("    Missing consumer metafile %q", metafile)
+					continue
+				}
 			}
-			buf, err := os.ReadFile(metafile)
+			key := sha256.Sum256([]byte(e.mset.name() + "/" + ofi.Name()))
+			hh, err := highwayhash.New64(key[:])
 			if err != nil {
-				s.Warnf("    Error reading consumer metafile %q: %v", metafile, err)
-				continue
+				return err
 			}
-			if _, err := os.Stat(metasum); os.IsNotExist(err) {
-				s.Warnf("    Missing consumer checksum for %q", metasum)
+			buf, err := recoverMetaFiles(cdir, hh)
+			if err != nil {
+				s.Warnf("    Error recovering consumer metafile %q: %v", metafile, err)
 				continue
 			}
 
@@ -1354,7 +1482,7 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 				// the consumer can reconnect. We will create it as a durable and switch it.
 				cfg.ConsumerConfig.Durable = ofi.Name()
 			}
-			obs, err := e.mset.addConsumerWithAssignment(&cfg.ConsumerConfig, _EMPTY_, nil, true)
+			obs, err := e.mset.addConsumerWithAssignment(&cfg.ConsumerConfig, _EMPTY_, nil, true, nil)
 			if err != nil {
 				s.Warnf("    Error adding consumer %q: %v", cfg.Name, err)
 				continue
@@ -1378,6 +1506,15 @@ func (a *Account) EnableJetStream(limits map[string]JetStreamAccountLimits) erro
 	// Make sure to cleanup any old remaining snapshots.
 	os.RemoveAll(filepath.Join(jsa.storeDir, snapsDir))
 
+	// Since all of the account's state lives under its own directory, check the
+	// on disk footprint against the account's storage limit.
+	if max := jsa.maxStore(); max > 0 {
+		if used := jsa.diskUsage(); used > max {
+			s.Warnf("  JetStream account %q is using %s on disk which exceeds its storage limit of %s",
+				a.Name, friendlyBytes(used), friendlyBytes(max))
+		}
+	}
+
 	// Check interest policy streams for auto cleanup.
 	for _, mset := range ipstreams {
 		mset.checkForOrphanMsgs()
@@ -1636,6 +1773,31 @@ func (a *Account) JetStreamUsage() JetStreamAccountStats {
 	return stats
 }
 
+// Returns the JetStream usage of the account on this server, or nil if
+// JetStream is not enabled for the account.
+// Account lock should not be held.
+func (a *Account) jetStreamStat() *AccountJetStreamStat {
+	a.mu.RLock()
+	jsa := a.js
+	a.mu.RUnlock()
+	if jsa == nil {
+		return nil
+	}
+
+	// This can be called while stream and account locks are held, so only atomics here.
+	stat := &AccountJetStreamStat{
+		Streams:   int(atomic.LoadInt64(&jsa.nstreams)),
+		Consumers: int(atomic.LoadInt64(&jsa.nconsumers)),
+	}
+	if mem := atomic.LoadInt64(&jsa.lmem); mem > 0 {
+		stat.Memory = uint64(mem)
+	}
+	if store := atomic.LoadInt64(&jsa.lstore); store > 0 {
+		stat.Store = uint64(store)
+	}
+	return stat
+}
+
 // DisableJetStream will disable JetStream for this account.
 func (a *Account) DisableJetStream() error {
 	return a.removeJetStream()
@@ -1797,10 +1959,12 @@ func (jsa *jsAccount) updateUsage(tierName string, storeType StorageType, delta
 		s.local.mem += delta
 		s.total.mem += delta
 		atomic.AddInt64(&js.memUsed, delta)
+		atomic.AddInt64(&jsa.lmem, delta)
 	} else {
 		s.local.store += delta
 		s.total.store += delta
 		atomic.AddInt64(&js.storeUsed, delta)
+		atomic.AddInt64(&jsa.lstore, delta)
 	}
 	// Publish our local updates if in clustered mode.
 	if isClustered {
@@ -1936,6 +2100,72 @@ func (jsa *jsAccount) storageTotals() (uint64, uint64) {
 	return mem, store
 }
 
+// Returns the total storage limit across all tiers, or -1 if unlimited.
+func (jsa *jsAccount) maxStore() int64 {
+	jsa.usageMu.RLock()
+	defer jsa.usageMu.RUnlock()
+
+	var max int64
+	for _, l := range jsa.limits {
+		if l.MaxStore < 0 {
+			return -1
+		}
+		max += l.MaxStore
+	}
+	return max
+}
+
+// Returns the number of bytes used on disk by this account.
+func (jsa *jsAccount) diskUsage() int64 {
+	return dirSize(jsa.storeDir)
+}
+
+// Returns the total size of all files under the given directory.
+func dirSize(dir string) int64 {
+	var total int64
+	filepath.WalkDir(dir, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			// Skip anything removed while we were walking.
+			return nil
+		}
+		if !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				total += fi.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// Returns true if adding bytes to the account's usage would exceed its limits.
+// If there are no limits for the tier we leave it to limitsExceeded to report.
+func (jsa *jsAccount) wouldExceedLimits(storeType StorageType, tierName string, bytes int64) bool {
+	jsa.usageMu.RLock()
+	defer jsa.usageMu.RUnlock()
+
+	selectedLimits, ok := jsa.limits[tierName]
+	if !ok {
+		return false
+	}
+	var total int64
+	if inUse := jsa.usage[tierName]; inUse != nil {
+		if storeType == MemoryStorage {
+			total = inUse.total.mem
+		} else {
+			total = inUse.total.store
+		}
+	}
+	total += bytes
+
+	if storeType == MemoryStorage {
+		return selectedLimits.MemoryMaxStreamBytes > 0 && total > selectedLimits.MemoryMaxStreamBytes ||
+			selectedLimits.MaxMemory >= 0 && total > selectedLimits.MaxMemory
+	}
+	return selectedLimits.StoreMaxStreamBytes > 0 && total > selectedLimits.StoreMaxStreamBytes ||
+		selectedLimits.MaxStore >= 0 && total > selectedLimits.MaxStore
+}
+
 func (jsa *jsAccount) limitsExceeded(storeType StorageType, tierName string) (bool, *ApiError) {
 	jsa.usageMu.RLock()
 	defer jsa.usageMu.RUnlock()
@@ -2068,7 +2298,7 @@ func (jsa *jsAccount) delete() {
 	jsa.mu.Unlock()
 
 	for _, ms := range streams {
-		ms.stop(false, false)
+		ms.stop(false, false, nil)
 	}
 
 	for _, t := range ts {
@@ -2105,6 +2335,83 @@ func (js *jetStream) usageStats() *JetStreamStats {
 	return &stats
 }
 
+// fileStores returns the file based stores of all streams on this server.
+func (js *jetStream) fileStores() []*fileStore {
+	js.mu.RLock()
+	accounts := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		accounts = append(accounts, jsa)
+	}
+	js.mu.RUnlock()
+
+	var streams []*stream
+	for _, jsa := range accounts {
+		jsa.mu.RLock()
+		for _, mset := range jsa.streams {
+			streams = append(streams, mset)
+		}
+		jsa.mu.RUnlock()
+	}
+
+	var fss []*fileStore
+	for _, mset := range streams {
+		mset.mu.RLock()
+		if fs, ok := mset.store.(*fileStore); ok {
+			fss = append(fss, fs)
+		}
+		mset.mu.RUnlock()
+	}
+	return fss
+}
+
+// storageStats returns the totals of the streams stored on this server.
+func (js *jetStream) storageStats() *JSStorageStat {
+	js.mu.RLock()
+	accounts := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		accounts = append(accounts, jsa)
+	}
+	js.mu.RUnlock()
+
+	var stats JSStorageStat
+	for _, jsa := range accounts {
+		jsa.mu.RLock()
+		streams := make([]*stream, 0, len(jsa.streams))
+		for _, mset := range jsa.streams {
+			streams = append(streams, mset)
+		}
+		jsa.mu.RUnlock()
+		for _, mset := range streams {
+			state := mset.state()
+			stats.Streams++
+			stats.Messages += state.Msgs
+			stats.Bytes += state.Bytes
+			stats.Consumers += state.Consumers
+		}
+	}
+	return &stats
+}
+
+// Marks a staged restore as active. Returns false if it already is.
+func (js *jetStream) startRestore(sfile string) bool {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	if _, ok := js.restores[sfile]; ok {
+		return false
+	}
+	if js.restores == nil {
+		js.restores = make(map[string]struct{})
+	}
+	js.restores[sfile] = struct{}{}
+	return true
+}
+
+func (js *jetStream) endRestore(sfile string) {
+	js.mu.Lock()
+	delete(js.restores, sfile)
+	js.mu.Unlock()
+}
+
 // Check to see if we have enough system resources for this account.
 // Lock should be held.
 func (js *jetStream) sufficientResources(limits map[string]JetStreamAccountLimits) error {
@@ -2214,6 +2521,8 @@ const (
 	JetStreamMaxMemDefault = 1024 * 1024 * 256
 	// snapshot staging for restores.
 	snapStagingDir = ".snap-staging"
+	// account backups requested through the API.
+	accountBackupsDir = ".backups"
 )
 
 // Dynamically create a config with a tmp based directory (repeatable) and 75% of system memory.
@@ -2695,9 +3004,171 @@ func validateJetStreamOptions(o *Options) error {
 	if o.JetStreamMaxCatchup < 0 {
 		return fmt.Errorf("jetstream max catchup cannot be negative")
 	}
+	if o.JetStreamMaxOpenFiles < 0 {
+		return fmt.Errorf("jetstream max open files cannot be negative")
+	}
+	if o.JetStreamMemoryBudget < 0 {
+		return fmt.Errorf("jetstream memory budget cannot be negative")
+	}
+	if o.JetStreamBackgroundIO < 0 {
+		return fmt.Errorf("jetstream max background io cannot be negative")
+	}
+	if o.JetStreamPrevKey != _EMPTY_ {
+		if o.JetStreamKey == _EMPTY_ {
+			return fmt.Errorf("jetstream previous encryption key requires an encryption key")
+		}
+		if o.JetStreamPrevKey == o.JetStreamKey {
+			return fmt.Errorf("jetstream previous encryption key must differ from the encryption key")
+		}
+	}
+	if o.JetStreamReKeyRate < 0 {
+		return fmt.Errorf("jetstream rekey rate cannot be negative")
+	}
+	if ao := o.JetStreamArchive; ao != nil {
+		if ao.MaxAge < 0 {
+			return fmt.Errorf("jetstream archive max age cannot be negative")
+		}
+		if ao.MaxLocalBytes < 0 {
+			return fmt.Errorf("jetstream archive max local bytes cannot be negative")
+		}
+		if _, err := newS3Archive(ao); err != nil {
+			return err
+		}
+	}
+	if o.JetStreamAPIWorkers < 0 {
+		return fmt.Errorf("jetstream api concurrency cannot be negative")
+	}
+	if o.JetStreamAPIQueueMax < 0 {
+		return fmt.Errorf("jetstream api queue limit cannot be negative")
+	}
+	if o.JetStreamAPIRateLimit < 0 {
+		return fmt.Errorf("jetstream api rate limit cannot be negative")
+	}
+	if o.JetStreamSchedWorkers < 0 {
+		return fmt.Errorf("jetstream delivery workers cannot be negative")
+	}
+	if o.JetStreamRecoveryJobs < 0 {
+		return fmt.Errorf("jetstream recovery concurrency cannot be negative")
+	}
+	if o.JetStreamMaxClockSkew < 0 {
+		return fmt.Errorf("jetstream max clock skew cannot be negative")
+	}
 	return nil
 }
 
+// Returns how far ahead of our clock an observed message timestamp may move it.
+func (s *Server) jsMaxClockSkew() time.Duration {
+	if d := s.getOpts().JetStreamMaxClockSkew; d > 0 {
+		return d
+	}
+	return DEFAULT_JS_MAX_CLOCK_SKEW
+}
+
+// How often we log progress when recovering streams.
+const streamRecoveryLogInterval = 10 * time.Second
+
+// streamRecovery tracks progress recovering streams when starting up.
+type streamRecovery struct {
+	mu    sync.Mutex
+	start time.Time
+	last  time.Time
+	total int
+	done  int
+}
+
+// Adds streams that are about to be recovered.
+func (sr *streamRecovery) add(n int) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.done == sr.total {
+		sr.start, sr.last, sr.total, sr.done = time.Now(), time.Now(), 0, 0
+	}
+	sr.total += n
+}
+
+// Marks a stream as recovered and returns if progress should be logged.
+func (sr *streamRecovery) streamDone() bool {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	sr.done++
+	if sr.done < sr.total && time.Since(sr.last) >= streamRecoveryLogInterval {
+		sr.last = time.Now()
+		return true
+	}
+	return false
+}
+
+// Returns the streams recovered, the total and the estimated time to finish.
+// Will return false if we are not recovering.
+func (sr *streamRecovery) progress() (int, int, time.Duration, bool) {
+	sr.mu.Lock()
+	defer sr.mu.Unlock()
+	if sr.done >= sr.total {
+		return sr.done, sr.total, 0, false
+	}
+	var eta time.Duration
+	if sr.done > 0 {
+		eta = time.Since(sr.start) / time.Duration(sr.done) * time.Duration(sr.total-sr.done)
+	}
+	return sr.done, sr.total, eta.Round(time.Second), true
+}
+
+// recoverStreams adds in the streams for the recovered configs, recovering up to
+// JetStreamRecoveryJobs stores at a time. The result holds the streams in the
+// same order as the configs, with nil for any that could not be recreated.
+func (s *Server) recoverStreams(a *Account, cfgs []*FileStreamInfo) []*stream {
+	msets := make([]*stream, len(cfgs))
+	if len(cfgs) == 0 {
+		return msets
+	}
+	var sr *streamRecovery
+	if js := s.getJetStream(); js != nil {
+		sr = &js.recovery
+		sr.add(len(cfgs))
+	}
+	workers := s.getOpts().JetStreamRecoveryJobs
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > len(cfgs) {
+		workers = len(cfgs)
+	}
+
+	work := make(chan int, len(cfgs))
+	for i := range cfgs {
+		work <- i
+	}
+	close(work)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				cfg := cfgs[i]
+				mset, err := a.addStream(&cfg.StreamConfig)
+				if err != nil {
+					s.Warnf("  Error recreating stream %q: %v", cfg.Name, err)
+				} else {
+					if !cfg.Created.IsZero() {
+						mset.setCreatedTime(cfg.Created)
+					}
+					state := mset.state()
+					s.Noticef("  Restored %s messages for stream '%s > %s'", comma(int64(state.Msgs)), mset.accName(), mset.name())
+					msets[i] = mset
+				}
+				if sr != nil && sr.streamDone() {
+					done, total, eta, _ := sr.progress()
+					s.Noticef("  Recovered %d of %d streams, estimated %v remaining", done, total, eta)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return msets
+}
+
 // We had a bug that set a default de dupe window on mirror, despite that being not a valid config
 func fixCfgMirrorWithDedupWindow(cfg *StreamConfig) {
 	if cfg == nil || cfg.Mirror == nil {
@@ -15,20 +15,26 @@ package server
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unicode"
 
 	"github.com/nats-io/nuid"
+	"golang.org/x/time/rate"
 )
 
 // Request API subjects for JetStream.
@@ -38,6 +44,8 @@ const (
 
 	// For constructing JetStream domain prefixes.
 	jsDomainAPI = "$JS.%s.API.>"
+	// jsDomainAPIPrefix is the API prefix for a given JetStream domain.
+	jsDomainAPIPrefix = "$JS.%s.API"
 
 	JSApiPrefix = "$JS.API"
 
@@ -117,6 +125,10 @@ const (
 	JSApiMsgGet  = "$JS.API.STREAM.MSG.GET.*"
 	JSApiMsgGetT = "$JS.API.STREAM.MSG.GET.%s"
 
+	// JSApiStreamMerge is the endpoint to read messages from several streams merged by their timestamps.
+	// Will return JSON response.
+	JSApiStreamMerge = "$JS.API.STREAM.MSG.MERGE"
+
 	// JSDirectMsgGet is the template for non-api layer direct requests for a message by its stream sequence number or last by subject.
 	// Will return the message similar to how a consumer receives the message, no JSON processing.
 	// If the message can not be found we will use a status header of 404. If the stream does not exist the client will get a no-responders or timeout.
@@ -174,6 +186,15 @@ const (
 	jsSnapshotAckT    = "$JS.SNAPSHOT.ACK.%s.%s"
 	jsRestoreDeliverT = "$JS.SNAPSHOT.RESTORE.%s.%s"
 
+	// JSRestoreOffset is an optional header on restore chunks with the offset of the chunk in the
+	// snapshot. Chunk acks carry the number of bytes staged so far, allowing clients to resume an
+	// interrupted transfer by resending from that offset.
+	JSRestoreOffset = "Nats-Restore-Offset"
+
+	// JSSnapshotDigest is the header on the last (empty) snapshot chunk with the SHA-256 digest of
+	// the snapshot. If present on the last chunk of a restore, the staged snapshot is verified against it.
+	JSSnapshotDigest = "Nats-Snapshot-Digest"
+
 	// JSApiStreamRemovePeer is the endpoint to remove a peer from a clustered stream and its consumers.
 	// Will return JSON response.
 	JSApiStreamRemovePeer  = "$JS.API.STREAM.PEER.REMOVE.*"
@@ -217,6 +238,20 @@ const (
 	JSApiServerStreamCancelMove  = "$JS.API.ACCOUNT.STREAM.CANCEL_MOVE.*.*"
 	JSApiServerStreamCancelMoveT = "$JS.API.ACCOUNT.STREAM.CANCEL_MOVE.%s.%s"
 
+	// JSApiStreamMaintenance is the endpoint to run storage maintenance on a stream.
+	// This is done by every server hosting the stream.
+	// Only works from system account.
+	// Will return JSON response.
+	JSApiStreamMaintenance  = "$JS.API.ACCOUNT.STREAM.MAINTENANCE.*.*"
+	JSApiStreamMaintenanceT = "$JS.API.ACCOUNT.STREAM.MAINTENANCE.%s.%s"
+
+	// JSApiAccountBackup is the endpoint to back up all streams of an account
+	// into an archive on the server's local storage.
+	// Only works from system account.
+	// Will return JSON response.
+	JSApiAccountBackup  = "$JS.API.ACCOUNT.BACKUP.*"
+	JSApiAccountBackupT = "$JS.API.ACCOUNT.BACKUP.%s"
+
 	// jsAckT is the template for the ack message stream coming back from a consumer
 	// when they ACK/NAK, etc a message.
 	jsAckT      = "$JS.ACK.%s.%s"
@@ -240,6 +275,10 @@ const (
 	// JSAdvisoryConsumerMaxDeliveryExceedPre is a notification published when a message exceeds its delivery threshold.
 	JSAdvisoryConsumerMaxDeliveryExceedPre = "$JS.EVENT.ADVISORY.CONSUMER.MAX_DELIVERIES"
 
+	// JSAdvisoryConsumerMaxAckPendingPre is a notification published when a consumer stops delivering
+	// because it reached its MaxAckPending limit.
+	JSAdvisoryConsumerMaxAckPendingPre = "$JS.EVENT.ADVISORY.CONSUMER.MAX_ACK_PENDING"
+
 	// JSAdvisoryConsumerMsgNakPre is a notification published when a message has been naked
 	JSAdvisoryConsumerMsgNakPre = "$JS.EVENT.ADVISORY.CONSUMER.MSG_NAKED"
 
@@ -404,6 +443,8 @@ type JSApiStreamInfoRequest struct {
 	ApiPagedRequest
 	DeletedDetails bool   `json:"deleted_details,omitempty"`
 	SubjectsFilter string `json:"subjects_filter,omitempty"`
+	// SubjectsDetail will also return the first and last sequence for each subject matching SubjectsFilter.
+	SubjectsDetail bool `json:"subjects_detail,omitempty"`
 }
 
 type JSApiStreamInfoResponse struct {
@@ -524,6 +565,10 @@ type JSApiStreamRestoreRequest struct {
 	Config StreamConfig `json:"config"`
 	// Current State for the given stream.
 	State StreamState `json:"state"`
+	// DryRun will only validate the snapshot, nothing is restored.
+	DryRun bool `json:"dry_run,omitempty"`
+	// Resume an interrupted restore of this stream if the server still has it staged.
+	Resume bool `json:"resume,omitempty"`
 }
 
 // JSApiStreamRestoreResponse is the direct response to the restore request.
@@ -531,8 +576,19 @@ type JSApiStreamRestoreResponse struct {
 	ApiResponse
 	// Subject to deliver the chunks to for the snapshot restore.
 	DeliverSubject string `json:"deliver_subject"`
+	// Offset in the snapshot to resume sending from, and the number of chunks already staged.
+	Offset int64 `json:"offset,omitempty"`
+	Chunks int   `json:"chunks,omitempty"`
+}
+
+// JSApiStreamRestoreCheckResponse is the final response to a dry run restore.
+type JSApiStreamRestoreCheckResponse struct {
+	ApiResponse
+	Check *StreamRestoreCheck `json:"check,omitempty"`
 }
 
+const JSApiStreamRestoreCheckResponseType = "io.nats.jetstream.api.v1.stream_restore_check_response"
+
 const JSApiStreamRestoreResponseType = "io.nats.jetstream.api.v1.stream_restore_response"
 
 // JSApiStreamRemovePeerRequest is the required remove peer request.
@@ -557,6 +613,49 @@ type JSApiStreamLeaderStepDownResponse struct {
 
 const JSApiStreamLeaderStepDownResponseType = "io.nats.jetstream.api.v1.stream_leader_stepdown_response"
 
+// JSApiStreamMaintenanceRequest selects the storage maintenance to run on a stream.
+// These only apply to file based streams.
+type JSApiStreamMaintenanceRequest struct {
+	// RollBlock starts a new message block so the current one is no longer written to.
+	RollBlock bool `json:"roll_block,omitempty"`
+	// ForceSync flushes and syncs all message blocks and consumer state.
+	ForceSync bool `json:"force_sync,omitempty"`
+	// DropCaches releases all cached message blocks.
+	DropCaches bool `json:"drop_caches,omitempty"`
+}
+
+// JSApiStreamMaintenanceResponse is the response to a stream maintenance request.
+type JSApiStreamMaintenanceResponse struct {
+	ApiResponse
+	Success bool `json:"success,omitempty"`
+	// Block is the index of the message block taking writes after a roll.
+	Block uint32 `json:"block,omitempty"`
+	// CachesDropped is the number of message block caches released.
+	CachesDropped int `json:"caches_dropped,omitempty"`
+}
+
+const JSApiStreamMaintenanceResponseType = "io.nats.jetstream.api.v1.stream_maintenance_response"
+
+// JSApiAccountBackupRequest is a request to back up all streams of an account.
+type JSApiAccountBackupRequest struct {
+	// Server taking the backup. Required when clustered, since each server
+	// only holds the streams it is a member of.
+	Server string `json:"server,omitempty"`
+	// CheckMsgs will check the integrity of the messages of each stream.
+	CheckMsgs bool `json:"check_msgs,omitempty"`
+}
+
+// JSApiAccountBackupResponse is the response to an account backup request.
+type JSApiAccountBackupResponse struct {
+	ApiResponse
+	Server string `json:"server,omitempty"`
+	// File is the path of the archive on the server.
+	File     string                 `json:"file,omitempty"`
+	Manifest *AccountBackupManifest `json:"manifest,omitempty"`
+}
+
+const JSApiAccountBackupResponseType = "io.nats.jetstream.api.v1.account_backup_response"
+
 // JSApiConsumerLeaderStepDownResponse is the response to a consumer leader stepdown request.
 type JSApiConsumerLeaderStepDownResponse struct {
 	ApiResponse
@@ -606,6 +705,9 @@ type JSApiMetaServerStreamMoveRequest struct {
 	Domain string `json:"domain,omitempty"`
 	// Ephemeral placement tags for the move
 	Tags []string `json:"tags,omitempty"`
+	// Server name of the peer to move to. Other peers needed
+	// to reach the replica count are selected from its cluster.
+	Target string `json:"target,omitempty"`
 }
 
 const JSApiAccountPurgeResponseType = "io.nats.jetstream.api.v1.account_purge_response"
@@ -621,6 +723,53 @@ type JSApiMsgGetRequest struct {
 	Seq     uint64 `json:"seq,omitempty"`
 	LastFor string `json:"last_by_subj,omitempty"`
 	NextFor string `json:"next_by_subj,omitempty"`
+	// First message at or after this time, optionally matching NextFor.
+	StartTime *time.Time `json:"start_time,omitempty"`
+	// Direct gets only. Return up to this many messages starting at Seq or StartTime,
+	// optionally matching NextFor, followed by an end of batch status.
+	Batch int `json:"batch,omitempty"`
+	// Direct gets only. Stop the batch once this many bytes have been sent.
+	MaxBytes int `json:"max_bytes,omitempty"`
+}
+
+// Returns true if the request selects exactly one way to find the message.
+func (req *JSApiMsgGetRequest) isValid() bool {
+	if req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ && req.StartTime == nil && req.Batch == 0 {
+		return false
+	}
+	if req.Seq > 0 && (req.LastFor != _EMPTY_ || req.StartTime != nil) {
+		return false
+	}
+	if req.LastFor != _EMPTY_ && (req.NextFor != _EMPTY_ || req.StartTime != nil || req.Batch > 0) {
+		return false
+	}
+	if req.Batch < 0 || req.MaxBytes < 0 || req.MaxBytes > 0 && req.Batch == 0 {
+		return false
+	}
+	return true
+}
+
+// Loads the message a get request asks for. Used for both API and direct gets.
+func loadMsgForGet(store StreamStore, req *JSApiMsgGetRequest, svp *StoreMsg) (sm *StoreMsg, err error) {
+	if req.StartTime != nil {
+		// A zero sequence means there is no message at or after that time.
+		seq := store.GetSeqFromTime(*req.StartTime)
+		if seq == 0 {
+			return nil, ErrStoreMsgNotFound
+		}
+		sm, _, err = store.LoadNextMsg(req.NextFor, subjectHasWildcard(req.NextFor), seq, svp)
+	} else if req.Seq > 0 && req.NextFor == _EMPTY_ {
+		sm, err = store.LoadMsg(req.Seq, svp)
+	} else if req.NextFor != _EMPTY_ {
+		sm, _, err = store.LoadNextMsg(req.NextFor, subjectHasWildcard(req.NextFor), req.Seq, svp)
+	} else {
+		sm, err = store.LoadLastMsg(req.LastFor, svp)
+		// The last message being a tombstone means the subject was deleted.
+		if err == nil && isTombstone(sm.hdr) {
+			sm, err = nil, ErrStoreMsgNotFound
+		}
+	}
+	return sm, err
 }
 
 type JSApiMsgGetResponse struct {
@@ -630,6 +779,45 @@ type JSApiMsgGetResponse struct {
 
 const JSApiMsgGetResponseType = "io.nats.jetstream.api.v1.stream_msg_get_response"
 
+// JSApiStreamMergeRequest reads messages from several streams merged by timestamp.
+type JSApiStreamMergeRequest struct {
+	Streams []string `json:"streams"`
+	// Filter optionally restricts the messages read from every stream to this subject.
+	Filter string `json:"filter,omitempty"`
+	// StartTime is where streams without a sequence in Next start reading.
+	StartTime *time.Time `json:"start_time,omitempty"`
+	// Next is the sequence to resume from per stream, as returned by a previous response.
+	Next  map[string]uint64 `json:"next,omitempty"`
+	Batch int               `json:"batch,omitempty"`
+	// MaxBytes optionally lowers the limit on the message bytes in a response.
+	MaxBytes int `json:"max_bytes,omitempty"`
+}
+
+// JSApiMergedMsg is a stored message along with the stream it was read from.
+type JSApiMergedMsg struct {
+	Stream  string     `json:"stream"`
+	Message *StoredMsg `json:"message"`
+}
+
+type JSApiStreamMergeResponse struct {
+	ApiResponse
+	Messages []*JSApiMergedMsg `json:"messages,omitempty"`
+	// Next is the sequence to resume from per stream.
+	Next map[string]uint64 `json:"next,omitempty"`
+}
+
+const JSApiStreamMergeResponseType = "io.nats.jetstream.api.v1.stream_msg_merge_response"
+
+const (
+	// JSStreamMergeDefaultBatch is the number of messages returned by a merge request without a batch.
+	JSStreamMergeDefaultBatch = 100
+	// JSStreamMergeMaxBatch is the most messages returned by a single merge request.
+	JSStreamMergeMaxBatch = 1000
+	// JSStreamMergeMaxBytes is the most message bytes returned by a single merge request.
+	// Message contents are base64 encoded in the response so this leaves room for that.
+	JSStreamMergeMaxBytes = 512 * 1024
+)
+
 // JSWaitQueueDefaultMax is the default max number of outstanding requests for pull consumers.
 const JSWaitQueueDefaultMax = 512
 
@@ -647,6 +835,14 @@ type JSApiConsumerDeleteResponse struct {
 
 const JSApiConsumerDeleteResponseType = "io.nats.jetstream.api.v1.consumer_delete_response"
 
+// JSMaxPendingFilters The limit of the number of pending filters we will report in a consumer info response.
+const JSMaxPendingFilters = 256
+
+// JSApiConsumerInfoRequest allows asking for pending counts of subsets of the consumer's filter.
+type JSApiConsumerInfoRequest struct {
+	PendingFilters []string `json:"pending_filters,omitempty"`
+}
+
 type JSApiConsumerInfoResponse struct {
 	ApiResponse
 	*ConsumerInfo
@@ -731,6 +927,10 @@ type jsAPIRoutedReq struct {
 	reply   string
 	msg     []byte
 	pa      pubArg
+	// The account that made the request, used to keep the queue fair.
+	reqAcc string
+	// Informational requests are processed after everything else.
+	low bool
 }
 
 func (js *jetStream) apiDispatch(sub *subscription, c *client, acc *Account, subject, reply string, rmsg []byte) {
@@ -757,9 +957,20 @@ func (js *jetStream) apiDispatch(sub *subscription, c *client, acc *Account, sub
 		return
 	}
 	jsub := rr.psubs[0]
+	isClient := c.kind != ROUTER && c.kind != GATEWAY && c.kind != LEAF
+
+	// The account that made the request, direct $SYS requests have none.
+	var reqAcc string
+	if len(hdr) > 0 && (!isClient || s.jsAPIWorkers > 0) {
+		var ci ClientInfo
+		if err := json.Unmarshal(getHeader(ClientInfoHdr, hdr), &ci); err == nil {
+			reqAcc = ci.serviceAccount()
+		}
+	}
 
-	// If this is directly from a client connection ok to do in place.
-	if c.kind != ROUTER && c.kind != GATEWAY && c.kind != LEAF {
+	// If this is directly from a client connection ok to do in place, unless
+	// we have been configured to bound the number of concurrent requests.
+	if isClient && s.jsAPIWorkers == 0 {
 		start := time.Now()
 		jsub.icb(sub, c, acc, subject, reply, rmsg)
 		if dur := time.Since(start); dur >= readLoopReportThreshold {
@@ -774,7 +985,212 @@ func (js *jetStream) apiDispatch(sub *subscription, c *client, acc *Account, sub
 
 	// Copy the state. Note the JSAPI only uses the hdr index to piece apart the
 	// header from the msg body. No other references are needed.
-	s.jsAPIRoutedReqs.push(&jsAPIRoutedReq{jsub, sub, acc, subject, reply, copyBytes(rmsg), c.pa})
+	r := &jsAPIRoutedReq{
+		jsub:    jsub,
+		sub:     sub,
+		acc:     acc,
+		subject: subject,
+		reply:   reply,
+		msg:     copyBytes(rmsg),
+		pa:      c.pa,
+		reqAcc:  reqAcc,
+		low:     isInfoAPIRequest(subject),
+	}
+	if !s.jsAPIRoutedReqs.push(r) {
+		s.RateLimitWarnf("JetStream API queue limit reached, dropping request on %q", subject)
+		// Let the requestor know we are too busy instead of having it time out.
+		if reply != _EMPTY_ {
+			resp := ApiResponse{Error: NewJSAPIQueueFullError()}
+			s.sendInternalAccountMsg(nil, reply, s.jsonResponse(&resp))
+		}
+	}
+}
+
+// API requests that only report on state, like stream and consumer info.
+var jsInfoAPISubjects = []string{
+	JSApiAccountInfo,
+	JSApiStreams,
+	JSApiStreamList,
+	JSApiStreamInfo,
+	JSApiConsumers,
+	JSApiConsumerList,
+	JSApiConsumerInfo,
+}
+
+// Returns true for informational requests, these are queued behind any other API request.
+func isInfoAPIRequest(subject string) bool {
+	for _, filter := range jsInfoAPISubjects {
+		if matchLiteral(subject, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+// Queue of JetStream API requests waiting to be processed. Requests are kept
+// per account and handed out in round robin order so that a burst of requests
+// from one account does not starve the others. Informational requests are
+// kept in a separate lane that is only served when the other one is empty.
+type jsAPIQueue struct {
+	mu      sync.Mutex
+	ch      chan struct{}
+	lanes   [2]jsAPIQueueLane
+	pending int
+	limit   int
+}
+
+type jsAPIQueueLane struct {
+	accs  map[string][]*jsAPIRoutedReq
+	order []string
+}
+
+func newJSAPIQueue(limit int) *jsAPIQueue {
+	q := &jsAPIQueue{
+		ch:    make(chan struct{}, 1),
+		limit: limit,
+	}
+	for i := range q.lanes {
+		q.lanes[i].accs = make(map[string][]*jsAPIRoutedReq)
+	}
+	return q
+}
+
+// Returns false if the request was dropped because we are at our limit.
+func (q *jsAPIQueue) push(r *jsAPIRoutedReq) bool {
+	name := r.reqAcc
+	if name == _EMPTY_ && r.acc != nil {
+		name = r.acc.Name
+	}
+	q.mu.Lock()
+	if q.limit > 0 && q.pending >= q.limit {
+		q.mu.Unlock()
+		return false
+	}
+	lane := &q.lanes[0]
+	if r.low {
+		lane = &q.lanes[1]
+	}
+	if len(lane.accs[name]) == 0 {
+		lane.order = append(lane.order, name)
+	}
+	lane.accs[name] = append(lane.accs[name], r)
+	q.pending++
+	q.mu.Unlock()
+	q.signal()
+	return true
+}
+
+// Returns the next request, or nil if the queue is empty.
+func (q *jsAPIQueue) pop() *jsAPIRoutedReq {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i := range q.lanes {
+		if r := q.lanes[i].pop(); r != nil {
+			q.pending--
+			// Wake up another worker if there is more to do.
+			if q.pending > 0 {
+				q.signal()
+			}
+			return r
+		}
+	}
+	return nil
+}
+
+// Lock should be held.
+func (lane *jsAPIQueueLane) pop() *jsAPIRoutedReq {
+	if len(lane.order) == 0 {
+		return nil
+	}
+	name := lane.order[0]
+	reqs := lane.accs[name]
+	r := reqs[0]
+	reqs[0] = nil
+	lane.order = lane.order[1:]
+	if reqs = reqs[1:]; len(reqs) == 0 {
+		delete(lane.accs, name)
+	} else {
+		// Put this account at the back of the line.
+		lane.accs[name] = reqs
+		lane.order = append(lane.order, name)
+	}
+	return r
+}
+
+// Per account rate limiter for JetStream API requests.
+type jsAPILimiter struct {
+	mu    sync.Mutex
+	limit int
+	accs  map[string]*jsAPIAccLimiter
+	swept time.Time
+}
+
+type jsAPIAccLimiter struct {
+	rl   *rate.Limiter
+	last time.Time
+}
+
+// How often we look for idle accounts to forget about.
+const jsAPILimiterSweepInterval = time.Minute
+
+func newJSAPILimiter(limit int) *jsAPILimiter {
+	return &jsAPILimiter{limit: limit, accs: make(map[string]*jsAPIAccLimiter), swept: time.Now()}
+}
+
+// Updates the limit, zero means no limit.
+func (l *jsAPILimiter) setLimit(limit int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	l.limit = limit
+	for _, al := range l.accs {
+		al.rl.SetLimit(rate.Limit(limit))
+		al.rl.SetBurst(limit)
+	}
+	l.mu.Unlock()
+}
+
+// Returns true if the account is allowed to make another request.
+func (l *jsAPILimiter) allow(acc string) bool {
+	if l == nil {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(l.swept) >= jsAPILimiterSweepInterval {
+		// A bucket idle for a second has refilled, so is the same as a new one.
+		for name, al := range l.accs {
+			if now.Sub(al.last) >= time.Second {
+				delete(l.accs, name)
+			}
+		}
+		l.swept = now
+	}
+	al := l.accs[acc]
+	if al == nil {
+		al = &jsAPIAccLimiter{rl: rate.NewLimiter(rate.Limit(l.limit), l.limit)}
+		l.accs[acc] = al
+	}
+	al.last = now
+	return al.rl.AllowN(now, 1)
+}
+
+func (q *jsAPIQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.pending
+}
+
+func (q *jsAPIQueue) signal() {
+	select {
+	case q.ch <- struct{}{}:
+	default:
+	}
 }
 
 func (s *Server) processJSAPIRoutedRequests() {
@@ -788,9 +1204,7 @@ func (s *Server) processJSAPIRoutedRequests() {
 	for {
 		select {
 		case <-queue.ch:
-			reqs := queue.pop()
-			for _, req := range reqs {
-				r := req.(*jsAPIRoutedReq)
+			for r := queue.pop(); r != nil; r = queue.pop() {
 				client.pa = r.pa
 				start := time.Now()
 				r.jsub.icb(r.sub, client, r.acc, r.subject, r.reply, r.msg)
@@ -798,7 +1212,6 @@ func (s *Server) processJSAPIRoutedRequests() {
 					s.Warnf("Internal subscription on %q took too long: %v", r.subject, dur)
 				}
 			}
-			queue.recycle(&reqs)
 		case <-s.quitCh:
 			return
 		}
@@ -811,16 +1224,36 @@ func (s *Server) setJetStreamExportSubs() error {
 		return NewJSNotEnabledError()
 	}
 
-	// Start the go routine that will process API requests received by the
+	// Start the go routines that will process API requests received by the
 	// subscription below when they are coming from routes, etc..
-	s.jsAPIRoutedReqs = s.newIPQueue("Routed JS API Requests")
-	s.startGoRoutine(s.processJSAPIRoutedRequests)
+	// If configured, all API requests will be processed by these go routines
+	// which will bound the number of concurrent requests.
+	opts := s.getOpts()
+	workers := opts.JetStreamAPIWorkers
+	s.jsAPIWorkers = workers
+	if workers == 0 {
+		workers = 1
+	}
+	s.jsAPIRoutedReqs = newJSAPIQueue(opts.JetStreamAPIQueueMax)
+	s.jsAPILimiter = newJSAPILimiter(opts.JetStreamAPIRateLimit)
+	for i := 0; i < workers; i++ {
+		s.startGoRoutine(s.processJSAPIRoutedRequests)
+	}
 
 	// This is the catch all now for all JetStream API calls.
 	if _, err := s.sysSubscribe(jsAllAPI, js.apiDispatch); err != nil {
 		return err
 	}
 
+	// Storage maintenance is done by every server hosting a stream, so all
+	// servers listen for it. Only the system account can make these requests.
+	if _, err := s.systemSubscribe(JSApiStreamMaintenance, _EMPTY_, false, nil, s.jsStreamMaintenanceRequest); err != nil {
+		return err
+	}
+	if _, err := s.systemSubscribe(JSApiAccountBackup, _EMPTY_, false, nil, s.jsAccountBackupRequest); err != nil {
+		return err
+	}
+
 	if err := s.SystemAccount().AddServiceExport(jsAllAPI, nil); err != nil {
 		s.Warnf("Error setting up jetstream service exports: %v", err)
 		return err
@@ -850,6 +1283,7 @@ func (s *Server) setJetStreamExportSubs() error {
 		{JSApiConsumerLeaderStepDown, s.jsConsumerLeaderStepDownRequest},
 		{JSApiMsgDelete, s.jsMsgDeleteRequest},
 		{JSApiMsgGet, s.jsMsgGetRequest},
+		{JSApiStreamMerge, s.jsStreamMergeRequest},
 		{JSApiConsumerCreateEx, s.jsConsumerCreateRequest},
 		{JSApiConsumerCreate, s.jsConsumerCreateRequest},
 		{JSApiDurableCreate, s.jsConsumerCreateRequest},
@@ -1352,7 +1786,7 @@ func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, _ *Account,
 		return
 	}
 
-	mset, err := acc.addStream(&cfg)
+	mset, err := acc.addStreamWithAssignment(&cfg, nil, nil, ci)
 	if err != nil {
 		if IsNatsErr(err, JSStreamStoreFailedF) {
 			s.Warnf("Stream create failed for '%s > %s': %v", acc, streamName, err)
@@ -1362,6 +1796,9 @@ func (s *Server) jsStreamCreateRequest(sub *subscription, c *client, _ *Account,
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if len(mset.configHistory()) == 0 {
+		mset.recordConfigRevision(ci, nil)
+	}
 	resp.StreamInfo = &StreamInfo{
 		Created: mset.createdTime(),
 		State:   mset.state(),
@@ -1444,7 +1881,7 @@ func (s *Server) jsStreamUpdateRequest(sub *subscription, c *client, _ *Account,
 		return
 	}
 
-	if err := mset.update(&cfg); err != nil {
+	if err := mset.updateWithAdvisory(&cfg, true, ci); err != nil {
 		resp.Error = NewJSStreamUpdateError(err, Unless(err))
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
@@ -1803,7 +2240,7 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 		return
 	}
 
-	var details bool
+	var details, subjectsDetail bool
 	var subjects string
 	var offset int
 	if !isEmptyRequest(msg) {
@@ -1814,6 +2251,7 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 			return
 		}
 		details, subjects = req.DeletedDetails, req.SubjectsFilter
+		subjectsDetail = req.SubjectsDetail
 		offset = req.Offset
 	}
 
@@ -1836,6 +2274,8 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 		Mirror:     mset.mirrorInfo(),
 		Sources:    mset.sourcesInfo(),
 		Alternates: js.streamAlternates(ci, config.Name),
+		Intake:     mset.intakeInfo(),
+		History:    mset.configHistory(),
 	}
 	if clusterWideConsCount > 0 {
 		resp.StreamInfo.State.Consumers = clusterWideConsCount
@@ -1843,13 +2283,24 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 
 	// Check if they have asked for subject details.
 	if subjects != _EMPTY_ {
-		if mss := mset.store.SubjectsState(subjects); len(mss) > 0 {
+		// Totals come from the subject index, only grab full state if asked.
+		var mss map[string]SimpleState
+		var sst map[string]uint64
+		if subjectsDetail {
+			mss = mset.store.SubjectsState(subjects)
+		} else {
+			sst = mset.store.SubjectsTotals(subjects)
+		}
+		if total := len(mss) + len(sst); total > 0 {
 			// As go iterates over map in a non-consistent order, no choice but to buffer it a slice
 
-			buffer := make([]string, 0, len(mss))
+			buffer := make([]string, 0, total)
 			for subj := range mss {
 				buffer = append(buffer, subj)
 			}
+			for subj := range sst {
+				buffer = append(buffer, subj)
+			}
 
 			// Sort it
 			sort.Strings(buffer)
@@ -1865,18 +2316,28 @@ func (s *Server) jsStreamInfoRequest(sub *subscription, c *client, a *Account, s
 
 			actualSize := end - offset
 			var sd map[string]uint64
+			var sdd map[string]SimpleState
 
 			if actualSize > 0 {
 				sd = make(map[string]uint64, actualSize)
+				if subjectsDetail {
+					sdd = make(map[string]SimpleState, actualSize)
+				}
 				for _, ss := range buffer[offset:end] {
-					sd[ss] = mss[ss].Msgs
+					if sdd != nil {
+						sd[ss] = mss[ss].Msgs
+						sdd[ss] = mss[ss]
+					} else {
+						sd[ss] = sst[ss]
+					}
 				}
 			}
 
 			resp.StreamInfo.State.Subjects = sd
+			resp.StreamInfo.State.SubjectsDetail = sdd
 			resp.Offset = offset
 			resp.Limit = JSMaxSubjectDetails
-			resp.Total = len(mss)
+			resp.Total = total
 		}
 
 	}
@@ -1980,8 +2441,8 @@ func (s *Server) jsStreamLeaderStepDownRequest(sub *subscription, c *client, _ *
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
-// Request to have a consumer leader stepdown.
-func (s *Server) jsConsumerLeaderStepDownRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+// Request from the system account to run storage maintenance on a stream.
+func (s *Server) jsStreamMaintenanceRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	if c == nil || !s.JetStreamEnabled() {
 		return
 	}
@@ -1990,91 +2451,284 @@ func (s *Server) jsConsumerLeaderStepDownRequest(sub *subscription, c *client, _
 		s.Warnf(badAPIRequestT, msg)
 		return
 	}
-
-	var resp = JSApiConsumerLeaderStepDownResponse{ApiResponse: ApiResponse{Type: JSApiConsumerLeaderStepDownResponseType}}
-
-	// If we are not in clustered mode this is a failed request.
-	if !s.JetStreamIsClustered() {
-		resp.Error = NewJSClusterRequiredError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
-	}
-
-	// If we are here we are clustered. See if we are the stream leader in order to proceed.
-	js, cc := s.getJetStreamCluster()
-	if js == nil || cc == nil {
-		return
-	}
-	if js.isLeaderless() {
-		resp.Error = NewJSClusterNotAvailError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+	// Only works from system account. Requests from other accounts come in
+	// through their JetStream service import and carry their account.
+	sacc := s.SystemAccount()
+	if reqAcc := ci.serviceAccount(); reqAcc != _EMPTY_ && reqAcc != sacc.Name {
 		return
 	}
+	acc = sacc
 
-	// Have extra token for this one.
-	stream := tokenAt(subject, 6)
-	consumer := tokenAt(subject, 7)
+	accName := tokenAt(subject, 6)
+	stream := tokenAt(subject, 7)
 
-	js.mu.RLock()
-	isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
-	js.mu.RUnlock()
+	var resp = JSApiStreamMaintenanceResponse{ApiResponse: ApiResponse{Type: JSApiStreamMaintenanceResponseType}}
 
-	if isLeader && sa == nil {
-		resp.Error = NewJSStreamNotFoundError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
-	} else if sa == nil {
-		return
-	}
-	var ca *consumerAssignment
-	if sa.consumers != nil {
-		ca = sa.consumers[consumer]
-	}
-	if ca == nil {
-		resp.Error = NewJSConsumerNotFoundError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
+	// In clustered mode every server hosting the stream does the maintenance on
+	// its own store, but only the stream leader answers.
+	isLeader := true
+	var isMetaLeader bool
+	var sa *streamAssignment
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		js.mu.RLock()
+		isMetaLeader, sa = cc.isLeader(), js.streamAssignment(accName, stream)
+		js.mu.RUnlock()
 	}
-	// Check to see if we are a member of the group and if the group has no leader.
-	if js.isGroupLeaderless(ca.Group) {
-		resp.Error = NewJSClusterNotAvailError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+
+	targetAcc, err := s.lookupAccount(accName)
+	if err != nil {
+		if !s.JetStreamIsClustered() || isMetaLeader {
+			resp.Error = NewJSNoAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
 		return
 	}
 
-	if !acc.JetStreamIsConsumerLeader(stream, consumer) {
-		return
+	if s.JetStreamIsClustered() {
+		js, _ := s.getJetStreamCluster()
+		if isMetaLeader && sa == nil {
+			if hasJS, doErr := targetAcc.checkJetStream(); !hasJS {
+				if doErr {
+					resp.Error = NewJSNotEnabledForAccountError()
+					s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				}
+				return
+			}
+			resp.Error = NewJSStreamNotFoundError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if sa == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(sa.Group) {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		isLeader = targetAcc.JetStreamIsStreamLeader(stream)
 	}
 
-	if hasJS, doErr := acc.checkJetStream(); !hasJS {
-		if doErr {
+	if hasJS, doErr := targetAcc.checkJetStream(); !hasJS {
+		if doErr && isLeader {
 			resp.Error = NewJSNotEnabledForAccountError()
 			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		}
 		return
 	}
+
+	var req JSApiStreamMaintenanceRequest
 	if !isEmptyRequest(msg) {
-		resp.Error = NewJSBadRequestError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		if err := json.Unmarshal(msg, &req); err != nil {
+			if isLeader {
+				resp.Error = NewJSInvalidJSONError()
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			}
+			return
+		}
+	}
+	// Need at least one operation.
+	if !req.RollBlock && !req.ForceSync && !req.DropCaches {
+		if isLeader {
+			resp.Error = NewJSBadRequestError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
 		return
 	}
 
-	mset, err := acc.lookupStream(stream)
+	mset, err := targetAcc.lookupStream(stream)
 	if err != nil {
-		resp.Error = NewJSStreamNotFoundError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		if isLeader {
+			resp.Error = NewJSStreamNotFoundError(Unless(err))
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
 		return
 	}
-	o := mset.lookupConsumer(consumer)
-	if o == nil {
-		resp.Error = NewJSConsumerNotFoundError()
+
+	block, dropped, err := mset.storeMaintenance(&req)
+	if err != nil {
+		s.Warnf("JetStream stream '%s > %s' maintenance failed: %v", accName, stream, err)
+	}
+	if !isLeader {
+		return
+	}
+	if err != nil {
+		resp.Error = NewJSStreamGeneralError(err, Unless(err))
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	resp.Success, resp.Block, resp.CachesDropped = true, block, dropped
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
 
-	// Call actual stepdown.
-	if n := o.raftNode(); n != nil {
-		o.setLeader(false)
+// Request from the system account to back up all streams of an account.
+func (s *Server) jsAccountBackupRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+	// Only works from system account.
+	sacc := s.SystemAccount()
+	if reqAcc := ci.serviceAccount(); reqAcc != _EMPTY_ && reqAcc != sacc.Name {
+		return
+	}
+	acc = sacc
+
+	accName := tokenAt(subject, 5)
+
+	var resp = JSApiAccountBackupResponse{ApiResponse: ApiResponse{Type: JSApiAccountBackupResponseType}, Server: s.Name()}
+
+	// When clustered only the meta leader answers requests that do not select a server.
+	isClustered := s.JetStreamIsClustered()
+	shouldRespond := !isClustered || s.JetStreamIsLeader()
+
+	var req JSApiAccountBackupRequest
+	if !isEmptyRequest(msg) {
+		if err := json.Unmarshal(msg, &req); err != nil {
+			if shouldRespond {
+				resp.Error = NewJSInvalidJSONError()
+				s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			}
+			return
+		}
+	}
+	if req.Server == _EMPTY_ && isClustered {
+		if shouldRespond {
+			resp.Error = NewJSBadRequestError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	} else if req.Server != _EMPTY_ && req.Server != s.Name() {
+		return
+	}
+
+	targetAcc, err := s.lookupAccount(accName)
+	if err != nil {
+		resp.Error = NewJSNoAccountError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// This can take a while, so do not hold up the caller.
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		file, manifest, err := s.backupAccount(targetAcc, req.CheckMsgs)
+		if err != nil {
+			s.Warnf("JetStream backup of account %q failed: %v", accName, err)
+			resp.Error = NewJSStreamGeneralError(err, Unless(err))
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		s.Noticef("JetStream backup of account %q written to %q", accName, file)
+		resp.File, resp.Manifest = file, manifest
+		s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+	})
+}
+
+// Request to have a consumer leader stepdown.
+func (s *Server) jsConsumerLeaderStepDownRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiConsumerLeaderStepDownResponse{ApiResponse: ApiResponse{Type: JSApiConsumerLeaderStepDownResponseType}}
+
+	// If we are not in clustered mode this is a failed request.
+	if !s.JetStreamIsClustered() {
+		resp.Error = NewJSClusterRequiredError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// If we are here we are clustered. See if we are the stream leader in order to proceed.
+	js, cc := s.getJetStreamCluster()
+	if js == nil || cc == nil {
+		return
+	}
+	if js.isLeaderless() {
+		resp.Error = NewJSClusterNotAvailError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Have extra token for this one.
+	stream := tokenAt(subject, 6)
+	consumer := tokenAt(subject, 7)
+
+	js.mu.RLock()
+	isLeader, sa := cc.isLeader(), js.streamAssignment(acc.Name, stream)
+	js.mu.RUnlock()
+
+	if isLeader && sa == nil {
+		resp.Error = NewJSStreamNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	} else if sa == nil {
+		return
+	}
+	var ca *consumerAssignment
+	if sa.consumers != nil {
+		ca = sa.consumers[consumer]
+	}
+	if ca == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	// Check to see if we are a member of the group and if the group has no leader.
+	if js.isGroupLeaderless(ca.Group) {
+		resp.Error = NewJSClusterNotAvailError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if !acc.JetStreamIsConsumerLeader(stream, consumer) {
+		return
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if !isEmptyRequest(msg) {
+		resp.Error = NewJSBadRequestError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	mset, err := acc.lookupStream(stream)
+	if err != nil {
+		resp.Error = NewJSStreamNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+	o := mset.lookupConsumer(consumer)
+	if o == nil {
+		resp.Error = NewJSConsumerNotFoundError()
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	// Call actual stepdown.
+	if n := o.raftNode(); n != nil {
+		o.setLeader(false)
 		// TODO (mh) eventually make sure all go routines exited and all channels are cleared
 		time.Sleep(250 * time.Millisecond)
 		n.StepDown()
@@ -2291,6 +2945,40 @@ func (s *Server) nameToPeer(js *jetStream, serverName, clusterName, domainName s
 	return _EMPTY_
 }
 
+// Returns the peer set for moving a stream to the target server of the move request.
+// The current peers are kept and the ones to move to appended, the stream monitor
+// will drop the current ones from the left once the new ones have caught up.
+func (s *Server) streamMoveTargetPeers(js *jetStream, cc *jetStreamCluster, req *JSApiMetaServerStreamMoveRequest, cfg *StreamConfig, currPeers []string, currCluster string) ([]string, *ApiError) {
+	tgtPeer := s.nameToPeer(js, req.Target, _EMPTY_, req.Domain)
+	if tgtPeer == _EMPTY_ {
+		return nil, NewJSStreamMoveTargetInvalidError(fmt.Errorf("server %q is not a member of the cluster", req.Target))
+	}
+	for _, p := range currPeers {
+		if p == tgtPeer {
+			return nil, NewJSStreamMoveTargetInvalidError(fmt.Errorf("server %q already hosts the stream", req.Target))
+		}
+	}
+	si, ok := s.nodeToInfo.Load(tgtPeer)
+	if !ok || si == nil {
+		return nil, NewJSStreamMoveTargetInvalidError(fmt.Errorf("server %q is unknown", req.Target))
+	}
+	ni := si.(nodeInfo)
+	if ni.offline || ni.cfg == nil {
+		return nil, NewJSStreamMoveTargetInvalidError(fmt.Errorf("server %q is offline", req.Target))
+	}
+	peers := append([]string{}, currPeers...)
+	// Within the same cluster we replace a single peer.
+	if ni.cluster == currCluster {
+		return append(peers, tgtPeer), nil
+	}
+	// Otherwise the whole peer group moves to the target's cluster.
+	newPeers, errs := cc.selectPeerGroup(cfg.Replicas, ni.cluster, cfg, []string{tgtPeer}, 0, currPeers)
+	if len(newPeers) < cfg.Replicas {
+		return nil, NewJSClusterNoPeersError(errs)
+	}
+	return append(peers, newPeers[:cfg.Replicas]...), nil
+}
+
 // Request to have the metaleader move a stream on a peer to another
 func (s *Server) jsLeaderServerStreamMoveRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	if c == nil || !s.JetStreamEnabled() {
@@ -2406,6 +3094,21 @@ func (s *Server) jsLeaderServerStreamMoveRequest(sub *subscription, c *client, _
 		cfg.Placement.Tags = append(cfg.Placement.Tags, req.Tags...)
 	}
 
+	// If a target server was picked we move to it directly.
+	if req.Target != _EMPTY_ {
+		peers, apiErr := s.streamMoveTargetPeers(js, cc, &req, &cfg, currPeers, currCluster)
+		if apiErr != nil {
+			resp.Error = apiErr
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		cfg.Placement = origPlacement
+		s.Noticef("Requested move for stream '%s > %s' R=%d from %+v to target %q with %+v",
+			streamName, accName, cfg.Replicas, s.peerSetToNames(currPeers), req.Target, s.peerSetToNames(peers))
+		s.jsClusteredStreamUpdateRequest(&ciNew, targetAcc.(*Account), subject, reply, rmsg, &cfg, peers)
+		return
+	}
+
 	peers, e := cc.selectPeerGroup(cfg.Replicas+1, currCluster, &cfg, currPeers, 1, nil)
 	if len(peers) <= cfg.Replicas {
 		// since expanding in the same cluster did not yield a result, try in different cluster
@@ -2787,7 +3490,7 @@ func (s *Server) jsStreamDeleteRequest(sub *subscription, c *client, _ *Account,
 		return
 	}
 
-	if err := mset.delete(); err != nil {
+	if err := mset.deleteByClient(ci); err != nil {
 		resp.Error = NewJSStreamDeleteError(err, Unless(err))
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
@@ -2997,14 +3700,8 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 		return
 	}
 
-	// Check that we do not have both options set.
-	if req.Seq > 0 && req.LastFor != _EMPTY_ || req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ {
-		resp.Error = NewJSBadRequestError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
-	}
-	// Check that both last and next not both set.
-	if req.LastFor != _EMPTY_ && req.NextFor != _EMPTY_ {
+	// Check that we have exactly one way to select the message. Batches are for direct gets only.
+	if !req.isValid() || req.Batch > 0 {
 		resp.Error = NewJSBadRequestError()
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
@@ -3018,15 +3715,7 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 	}
 
 	var svp StoreMsg
-	var sm *StoreMsg
-
-	if req.Seq > 0 && req.NextFor == _EMPTY_ {
-		sm, err = mset.store.LoadMsg(req.Seq, &svp)
-	} else if req.NextFor != _EMPTY_ {
-		sm, _, err = mset.store.LoadNextMsg(req.NextFor, subjectHasWildcard(req.NextFor), req.Seq, &svp)
-	} else {
-		sm, err = mset.store.LoadLastMsg(req.LastFor, &svp)
-	}
+	sm, err := loadMsgForGet(mset.store, &req, &svp)
 	if err != nil {
 		resp.Error = NewJSNoMessageFoundError()
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
@@ -3044,6 +3733,164 @@ func (s *Server) jsMsgGetRequest(sub *subscription, c *client, _ *Account, subje
 	s.sendInternalAccountMsg(nil, reply, s.jsonResponse(resp))
 }
 
+// Request to read messages from several streams merged by timestamp.
+func (s *Server) jsStreamMergeRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
+	if c == nil || !s.JetStreamEnabled() {
+		return
+	}
+	ci, acc, _, msg, err := s.getRequestInfo(c, rmsg)
+	if err != nil {
+		s.Warnf(badAPIRequestT, msg)
+		return
+	}
+
+	var resp = JSApiStreamMergeResponse{ApiResponse: ApiResponse{Type: JSApiStreamMergeResponseType}}
+
+	// We need the request to know which stream leader should answer.
+	var req JSApiStreamMergeRequest
+	var reqErr *ApiError
+	if isEmptyRequest(msg) {
+		reqErr = NewJSBadRequestError()
+	} else if err := json.Unmarshal(msg, &req); err != nil {
+		reqErr = NewJSInvalidJSONError()
+	} else if len(req.Streams) == 0 || req.Batch < 0 || req.MaxBytes < 0 || req.Filter != _EMPTY_ && !IsValidSubject(req.Filter) {
+		reqErr = NewJSBadRequestError()
+	}
+
+	// If we are in clustered mode the leader of the first stream answers,
+	// which requires all the other streams to be hosted on the same server.
+	if s.JetStreamIsClustered() {
+		js, cc := s.getJetStreamCluster()
+		if js == nil || cc == nil {
+			return
+		}
+		if js.isLeaderless() {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		js.mu.RLock()
+		isLeader := cc.isLeader()
+		var sa *streamAssignment
+		if reqErr == nil {
+			sa = js.streamAssignment(acc.Name, req.Streams[0])
+		}
+		js.mu.RUnlock()
+
+		if isLeader && sa == nil {
+			if hasJS, doErr := acc.checkJetStream(); !hasJS {
+				if doErr {
+					resp.Error = NewJSNotEnabledForAccountError()
+					s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+				}
+				return
+			}
+			if resp.Error = reqErr; resp.Error == nil {
+				resp.Error = NewJSStreamNotFoundError()
+			}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		} else if sa == nil {
+			return
+		}
+
+		// Check to see if we are a member of the group and if the group has no leader.
+		if js.isGroupLeaderless(sa.Group) {
+			resp.Error = NewJSClusterNotAvailError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+
+		// We have the stream assigned and a leader, so only the stream leader should answer.
+		if !acc.JetStreamIsStreamLeader(req.Streams[0]) {
+			return
+		}
+	}
+
+	if hasJS, doErr := acc.checkJetStream(); !hasJS {
+		if doErr {
+			resp.Error = NewJSNotEnabledForAccountError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		}
+		return
+	}
+	if reqErr != nil {
+		resp.Error = reqErr
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	if name, ok := c.streamMergeAllowed(req.Streams); !ok {
+		resp.Error = NewJSStreamMergeNotPermittedError(name)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
+
+	var msets []*stream
+	seen := make(map[string]struct{}, len(req.Streams))
+	for _, name := range req.Streams {
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		mset, err := acc.lookupStream(name)
+		if err != nil {
+			resp.Error = NewJSStreamNotFoundError(Unless(err))
+			// The stream may exist but not be hosted on this server.
+			if js, cc := s.getJetStreamCluster(); js != nil && cc != nil {
+				js.mu.RLock()
+				sa := js.streamAssignment(acc.Name, name)
+				js.mu.RUnlock()
+				if sa != nil {
+					resp.Error = NewJSStreamGeneralError(fmt.Errorf("stream %q is not hosted with stream %q", name, req.Streams[0]))
+				}
+			}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		// Replicas may be behind, so we only read streams we lead.
+		if s.JetStreamIsClustered() && !mset.isLeader() {
+			resp.Error = NewJSStreamGeneralError(fmt.Errorf("stream %q is not led by the same server as stream %q", name, req.Streams[0]))
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		msets = append(msets, mset)
+	}
+
+	batch := req.Batch
+	if batch == 0 {
+		batch = JSStreamMergeDefaultBatch
+	} else if batch > JSStreamMergeMaxBatch {
+		batch = JSStreamMergeMaxBatch
+	}
+	maxBytes := req.MaxBytes
+	if maxBytes == 0 || maxBytes > JSStreamMergeMaxBytes {
+		maxBytes = JSStreamMergeMaxBytes
+	}
+	var startTime time.Time
+	if req.StartTime != nil {
+		startTime = *req.StartTime
+	}
+	resp.Messages, resp.Next = mergeStreamMsgs(msets, req.Filter, startTime, req.Next, batch, maxBytes)
+	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
+}
+
+// Merged reads name their streams in the request and not in the subject, so subject
+// permissions alone can not restrict them. This checks the requesting client is allowed
+// to get messages from each of the streams. Returns the first stream that is not allowed.
+func (c *client) streamMergeAllowed(streams []string) (string, bool) {
+	if c.kind != CLIENT {
+		return _EMPTY_, true
+	}
+	for _, name := range streams {
+		if !c.pubAllowed(fmt.Sprintf(JSApiMsgGetT, name)) {
+			return name, false
+		}
+	}
+	return _EMPTY_, true
+}
+
 // Request to purge a stream.
 func (s *Server) jsStreamPurgeRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	if c == nil || !s.JetStreamEnabled() {
@@ -3226,6 +4073,12 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, _ *Account
 		return
 	}
 
+	// A dry run only validates the snapshot, so any server can process it.
+	if req.DryRun {
+		s.processStreamRestoreCheck(ci, acc, &cfg, subject, reply, string(msg))
+		return
+	}
+
 	if s.JetStreamIsClustered() {
 		s.jsClusteredStreamRestoreRequest(ci, acc, &req, stream, subject, reply, rmsg)
 		return
@@ -3251,10 +4104,10 @@ func (s *Server) jsStreamRestoreRequest(sub *subscription, c *client, _ *Account
 		return
 	}
 
-	s.processStreamRestore(ci, acc, &req.Config, subject, reply, string(msg))
+	s.processStreamRestore(ci, acc, &req.Config, req.Resume, subject, reply, string(msg))
 }
 
-func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamConfig, subject, reply, msg string) <-chan error {
+func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamConfig, resume bool, subject, reply, msg string) <-chan error {
 	js := s.getJetStream()
 
 	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
@@ -3268,15 +4121,40 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 		}
 	}
 
-	tfile, err := os.CreateTemp(snapDir, "js-restore-")
-	if err != nil {
-		resp.Error = NewJSTempStorageFailedError()
+	// Staging is keyed by account and stream so an interrupted restore can be resumed.
+	sfile := restoreStagingFile(snapDir, acc.Name, cfg.Name)
+	if !js.startRestore(sfile) {
+		resp.Error = NewJSStreamRestoreError(fmt.Errorf("restore already in progress"))
 		s.sendAPIErrResponse(ci, acc, subject, reply, msg, s.jsonResponse(&resp))
 		return nil
 	}
+	removeStaleRestores(snapDir, restoreResumeExpire)
+
+	var tfile *os.File
+	var offset int64
+	var chunks int
+	var h hash.Hash
+	if resume {
+		tfile, offset, chunks, h = resumeRestoreStaging(sfile, acc.Name, cfg.Name)
+	}
+	if tfile == nil {
+		h = sha256.New()
+		removeRestoreStaging(sfile)
+		var err error
+		if tfile, err = os.OpenFile(sfile, os.O_CREATE|os.O_RDWR|os.O_TRUNC, defaultFilePerms); err != nil {
+			js.endRestore(sfile)
+			resp.Error = NewJSTempStorageFailedError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, msg, s.jsonResponse(&resp))
+			return nil
+		}
+	}
 
 	streamName := cfg.Name
-	s.Noticef("Starting restore for stream '%s > %s'", acc.Name, streamName)
+	if offset > 0 {
+		s.Noticef("Resuming restore for stream '%s > %s' at %s", acc.Name, streamName, friendlyBytes(offset))
+	} else {
+		s.Noticef("Starting restore for stream '%s > %s'", acc.Name, streamName)
+	}
 
 	start := time.Now().UTC()
 	domain := s.getOpts().JetStreamDomain
@@ -3303,35 +4181,26 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 	resultCh := make(chan result, 1)
 	activeQ := s.newIPQueue(fmt.Sprintf("[ACC:%s] stream '%s' restore", acc.Name, streamName)) // of int
 
-	var total int
+	total := int(offset)
 
 	// FIXM(dlc) - Probably take out of network path eventually due to disk I/O?
 	processChunk := func(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
-		// We require reply subjects to communicate back failures, flow etc. If they do not have one log and cancel.
-		if reply == _EMPTY_ {
+		chunk, err := s.parseRestoreChunk(acc, c, streamName, reply, msg, total)
+		if err != nil {
 			sub.client.processUnsub(sub.sid)
-			resultCh <- result{
-				fmt.Errorf("restore for stream '%s > %s' requires reply subject for each chunk", acc.Name, streamName),
-				reply,
-			}
+			resultCh <- result{err: err, reply: reply}
 			return
 		}
-		// Account client messages have \r\n on end. This is an error.
-		if len(msg) < LEN_CR_LF {
-			sub.client.processUnsub(sub.sid)
-			resultCh <- result{
-				fmt.Errorf("restore for stream '%s > %s' received short chunk", acc.Name, streamName),
-				reply,
-			}
+		if chunk == nil {
 			return
 		}
-		// Adjust.
-		msg = msg[:len(msg)-LEN_CR_LF]
+		msg = chunk.data
 
 		// This means we are complete with our transfer from the client.
 		if len(msg) == 0 {
 			s.Debugf("Finished staging restore for stream '%s > %s'", acc.Name, streamName)
-			resultCh <- result{err, reply}
+			// Make sure we staged what the client snapshotted, if it told us.
+			resultCh <- result{checkSnapshotDigest(chunk.hdr, h), reply}
 			return
 		}
 
@@ -3340,45 +4209,56 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 		total += len(msg)
 		if js.wouldExceedLimits(FileStorage, total) {
 			s.resourcesExeededError()
-			resultCh <- result{NewJSInsufficientResourcesError(), reply}
+			resultCh <- result{err: NewJSInsufficientResourcesError(), reply: reply}
 			return
 		}
 
 		// Append chunk to temp file. Mark as issue if we encounter an error.
 		if n, err := tfile.Write(msg); n != len(msg) || err != nil {
-			resultCh <- result{err, reply}
+			resultCh <- result{err: err, reply: reply}
 			if reply != _EMPTY_ {
 				s.sendInternalAccountMsg(acc, reply, "-ERR 'storage failure during restore'")
 			}
 			return
 		}
+		h.Write(msg)
 
+		// Progress for resume is recorded from the monitoring Go routine.
 		activeQ.push(len(msg))
 
-		s.sendInternalAccountMsg(acc, reply, nil)
+		s.sendInternalAccountMsgWithReply(acc, reply, _EMPTY_, restoreOffsetHdr(total), nil, false)
 	}
 
 	sub, err := acc.subscribeInternal(restoreSubj, processChunk)
 	if err != nil {
 		tfile.Close()
-		os.Remove(tfile.Name())
+		removeRestoreStaging(sfile)
+		js.endRestore(sfile)
 		resp.Error = NewJSRestoreSubscribeFailedError(err, restoreSubj)
 		s.sendAPIErrResponse(ci, acc, subject, reply, msg, s.jsonResponse(&resp))
 		return nil
 	}
 
-	// Mark the subject so the end user knows where to send the snapshot chunks.
+	// Mark the subject so the end user knows where to send the snapshot chunks,
+	// and where to resume from.
 	resp.DeliverSubject = restoreSubj
+	resp.Offset, resp.Chunks = offset, chunks
 	s.sendAPIResponse(ci, acc, subject, reply, msg, s.jsonResponse(resp))
 
 	doneCh := make(chan error, 1)
 
 	// Monitor the progress from another Go routine.
 	s.startGoRoutine(func() {
+		// Whether to keep what we staged so far for a later resume.
+		var keep bool
+
 		defer s.grWG.Done()
 		defer func() {
 			tfile.Close()
-			os.Remove(tfile.Name())
+			if !keep {
+				removeRestoreStaging(sfile)
+			}
+			js.endRestore(sfile)
 			sub.client.processUnsub(sub.sid)
 			activeQ.unregister()
 		}()
@@ -3387,7 +4267,21 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 		notActive := time.NewTimer(activityInterval)
 		defer notActive.Stop()
 
-		total := 0
+		// Record what was staged so the transfer can be resumed if it gets interrupted.
+		// Not fatal if this fails, the restore would just have to start over from an
+		// earlier offset, so we only do this periodically.
+		total, lpw := int(offset), time.Now()
+		recordProgress := func() {
+			writeRestoreProgress(sfile, &restoreProgress{
+				Account: acc.Name,
+				Stream:  streamName,
+				Chunks:  chunks,
+				Offset:  int64(total),
+				Updated: time.Now().UTC(),
+			})
+			lpw = time.Now()
+		}
+
 		for {
 			select {
 			case result := <-resultCh:
@@ -3441,11 +4335,25 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 				doneCh <- err
 				return
 			case <-activeQ.ch:
-				n := activeQ.popOne().(int)
-				total += n
+				ns := activeQ.pop()
+				for _, n := range ns {
+					total += n.(int)
+					chunks++
+				}
+				activeQ.recycle(&ns)
+				if time.Since(lpw) >= restoreProgressInterval {
+					recordProgress()
+				}
 				notActive.Reset(activityInterval)
 			case <-notActive.C:
 				err := fmt.Errorf("restore for stream '%s > %s' is stalled", acc, streamName)
+				// Keep what was staged, the client can resume the transfer with a new restore request.
+				keep = total > 0
+				if keep {
+					recordProgress()
+					s.Noticef("Restore for stream '%s > %s' stalled, keeping %s staged for resume",
+						acc.Name, streamName, friendlyBytes(int64(total)))
+				}
 				doneCh <- err
 				return
 			}
@@ -3455,6 +4363,312 @@ func (s *Server) processStreamRestore(ci *ClientInfo, acc *Account, cfg *StreamC
 	return doneCh
 }
 
+// Process a dry run restore. Chunks are validated as they arrive and never staged to disk.
+func (s *Server) processStreamRestoreCheck(ci *ClientInfo, acc *Account, cfg *StreamConfig, subject, reply, msg string) {
+	var resp = JSApiStreamRestoreResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreResponseType}}
+
+	streamName := cfg.Name
+	restoreSubj := fmt.Sprintf(jsRestoreDeliverT, streamName, nuid.Next())
+
+	// A chunk for the checker, or the end of the transfer if done is set.
+	type checkChunk struct {
+		data  []byte
+		reply string
+		total int
+		err   error
+		done  bool
+	}
+
+	pr, pw := io.Pipe()
+	chunkQ := s.newIPQueue(fmt.Sprintf("[ACC:%s] stream '%s' restore check", acc.Name, streamName)) // of *checkChunk
+	doneReply := make(chan string, 1)
+	qch := make(chan struct{})
+	var total int
+	h := sha256.New()
+
+	processChunk := func(sub *subscription, c *client, _ *Account, subject, reply string, msg []byte) {
+		chunk, err := s.parseRestoreChunk(acc, c, streamName, reply, msg, total)
+		if err != nil {
+			sub.client.processUnsub(sub.sid)
+			chunkQ.push(&checkChunk{err: err, done: true})
+			return
+		}
+		if chunk == nil {
+			return
+		}
+		// This means we are complete with our transfer from the client.
+		if len(chunk.data) == 0 {
+			sub.client.processUnsub(sub.sid)
+			chunkQ.push(&checkChunk{reply: reply, err: checkSnapshotDigest(chunk.hdr, h), done: true})
+			return
+		}
+		total += len(chunk.data)
+		h.Write(chunk.data)
+		// The checker is fed from another Go routine so we do not block here, it will ack the chunk.
+		chunkQ.push(&checkChunk{data: append([]byte(nil), chunk.data...), reply: reply, total: total})
+	}
+
+	sub, err := acc.subscribeInternal(restoreSubj, processChunk)
+	if err != nil {
+		chunkQ.unregister()
+		resp.Error = NewJSRestoreSubscribeFailedError(err, restoreSubj)
+		s.sendAPIErrResponse(ci, acc, subject, reply, msg, s.jsonResponse(&resp))
+		return
+	}
+
+	resp.DeliverSubject = restoreSubj
+	s.sendAPIResponse(ci, acc, subject, reply, msg, s.jsonResponse(resp))
+
+	// Feed the chunks to the checker, acking each once it has been taken.
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer chunkQ.unregister()
+
+		for {
+			select {
+			case <-qch:
+				return
+			case <-s.quitCh:
+				pw.CloseWithError(ErrServerNotRunning)
+				return
+			case <-chunkQ.ch:
+				ccs := chunkQ.pop()
+				for _, cci := range ccs {
+					cc := cci.(*checkChunk)
+					if cc.done {
+						if cc.reply != _EMPTY_ {
+							doneReply <- cc.reply
+						}
+						pw.CloseWithError(cc.err)
+						return
+					}
+					if _, err := pw.Write(cc.data); err != nil {
+						sub.client.processUnsub(sub.sid)
+						s.sendInternalAccountMsg(acc, cc.reply, "-ERR 'restore check failed'")
+						return
+					}
+					s.sendInternalAccountMsgWithReply(acc, cc.reply, _EMPTY_, restoreOffsetHdr(cc.total), nil, false)
+				}
+				chunkQ.recycle(&ccs)
+			}
+		}
+	})
+
+	// The check runs from another Go routine since chunks are fed through the pipe.
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		defer close(qch)
+
+		const activityInterval = 5 * time.Second
+		stalled := time.AfterFunc(activityInterval, func() {
+			pw.CloseWithError(fmt.Errorf("restore check for stream '%s > %s' is stalled", acc.Name, streamName))
+		})
+		defer stalled.Stop()
+
+		ar := &activityReader{pr, func() { stalled.Reset(activityInterval) }}
+		check, err := acc.CheckStreamRestore(cfg, ar)
+		// Drain anything left so the client can finish sending.
+		io.Copy(io.Discard, ar)
+		sub.client.processUnsub(sub.sid)
+
+		var creply string
+		select {
+		case creply = <-doneReply:
+		default:
+			s.Warnf("Restore check for stream '%s > %s' did not complete", acc.Name, streamName)
+			return
+		}
+
+		var cresp = JSApiStreamRestoreCheckResponse{ApiResponse: ApiResponse{Type: JSApiStreamRestoreCheckResponseType}}
+		if err != nil {
+			cresp.Error = NewJSStreamRestoreError(err, Unless(err))
+			s.Warnf("Restore check failed for stream '%s > %s': %v", acc.Name, streamName, err)
+		} else {
+			cresp.Check = check
+		}
+		s.sendInternalAccountMsg(acc, creply, s.jsonResponse(&cresp))
+	})
+}
+
+// restoreChunk is a chunk of a snapshot sent to a restore subscription.
+// No data means the client is done with the transfer.
+type restoreChunk struct {
+	hdr  []byte
+	data []byte
+}
+
+// Will parse a chunk sent to a restore subscription, for restores and restore checks.
+// If the chunk has an offset we drop what we already have below total, which allows
+// clients to resend chunks after a timeout or reconnect. Returns nil if there is nothing
+// new, in which case the chunk has been answered here. Errors should cancel the transfer.
+func (s *Server) parseRestoreChunk(acc *Account, c *client, streamName, reply string, msg []byte, total int) (*restoreChunk, error) {
+	// We require reply subjects to communicate back failures, flow etc.
+	if reply == _EMPTY_ {
+		return nil, fmt.Errorf("restore for stream '%s > %s' requires reply subject for each chunk", acc.Name, streamName)
+	}
+	hdr, msg := c.msgParts(msg)
+	// Account client messages have \r\n on end. This is an error.
+	if len(msg) < LEN_CR_LF {
+		return nil, fmt.Errorf("restore for stream '%s > %s' received short chunk", acc.Name, streamName)
+	}
+	// Adjust.
+	msg = msg[:len(msg)-LEN_CR_LF]
+	if len(msg) == 0 {
+		return &restoreChunk{hdr: hdr}, nil
+	}
+
+	if off := getHeader(JSRestoreOffset, hdr); len(off) > 0 {
+		offset := int(parseInt64(off))
+		if offset < 0 || offset > total {
+			s.sendInternalAccountMsgWithReply(acc, reply, _EMPTY_, restoreOffsetHdr(total),
+				fmt.Sprintf("-ERR 'restore chunk offset %d does not match staged bytes %d'", offset, total), false)
+			return nil, nil
+		}
+		if offset+len(msg) <= total {
+			s.sendInternalAccountMsgWithReply(acc, reply, _EMPTY_, restoreOffsetHdr(total), nil, false)
+			return nil, nil
+		}
+		msg = msg[total-offset:]
+	}
+	return &restoreChunk{hdr: hdr, data: msg}, nil
+}
+
+// Will check the snapshot digest sent with the last chunk, if any, against what we received.
+func checkSnapshotDigest(hdr []byte, h hash.Hash) error {
+	if digest := string(getHeader(JSSnapshotDigest, hdr)); digest != _EMPTY_ && digest != snapshotDigest(h) {
+		return errSnapshotDigestMismatch
+	}
+	return nil
+}
+
+// Wraps a reader and signals any progress.
+type activityReader struct {
+	r      io.Reader
+	active func()
+}
+
+func (ar *activityReader) Read(p []byte) (int, error) {
+	n, err := ar.r.Read(p)
+	if n > 0 {
+		ar.active()
+	}
+	return n, err
+}
+
+var (
+	errSnapshotDigestMismatch = errors.New("snapshot digest mismatch")
+	errSnapshotInterestLost   = errors.New("snapshot interest lost")
+)
+
+// Returns the snapshot digest as sent in the JSSnapshotDigest header.
+func snapshotDigest(h hash.Hash) string {
+	return objDigestPrefix + base64.URLEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Header for restore chunk acks with the number of bytes staged.
+func restoreOffsetHdr(total int) map[string]string {
+	return map[string]string{JSRestoreOffset: strconv.Itoa(total)}
+}
+
+const (
+	// How long an interrupted restore is kept staged for resume.
+	restoreResumeExpire = time.Hour
+	// Extension of the file that records the progress of a staged restore.
+	restoreProgressExt = ".progress"
+	// How often the progress of a staged restore is recorded.
+	restoreProgressInterval = time.Second
+)
+
+// restoreProgress is recorded next to a staged restore while chunks arrive
+// so an interrupted transfer can be resumed by a later restore request.
+type restoreProgress struct {
+	Account string    `json:"account"`
+	Stream  string    `json:"stream"`
+	Chunks  int       `json:"chunks"`
+	Offset  int64     `json:"offset"`
+	Updated time.Time `json:"updated"`
+}
+
+// Returns the staging file for a restore of the given stream.
+func restoreStagingFile(snapDir, account, stream string) string {
+	return filepath.Join(snapDir, "js-restore-"+getHash(account+"/"+stream))
+}
+
+func writeRestoreProgress(sfile string, rp *restoreProgress) error {
+	b, err := json.Marshal(rp)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(sfile+restoreProgressExt, b, defaultFilePerms)
+}
+
+func readRestoreProgress(sfile string) (*restoreProgress, error) {
+	b, err := os.ReadFile(sfile + restoreProgressExt)
+	if err != nil {
+		return nil, err
+	}
+	var rp restoreProgress
+	if err := json.Unmarshal(b, &rp); err != nil {
+		return nil, err
+	}
+	return &rp, nil
+}
+
+// Opens a staged restore for resume. Anything past the last acked offset is dropped.
+// Returns a nil file if there is nothing to resume.
+func resumeRestoreStaging(sfile, account, stream string) (*os.File, int64, int, hash.Hash) {
+	rp, err := readRestoreProgress(sfile)
+	if err != nil || rp.Account != account || rp.Stream != stream {
+		return nil, 0, 0, nil
+	}
+	f, err := os.OpenFile(sfile, os.O_RDWR, defaultFilePerms)
+	if err != nil {
+		return nil, 0, 0, nil
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() < rp.Offset {
+		f.Close()
+		return nil, 0, 0, nil
+	}
+	if err := f.Truncate(rp.Offset); err != nil {
+		f.Close()
+		return nil, 0, 0, nil
+	}
+	// Hash what we already staged so we can keep hashing new chunks as they arrive.
+	// This also leaves us positioned at the end for appending.
+	h := sha256.New()
+	if n, err := io.Copy(h, f); err != nil || n != rp.Offset {
+		f.Close()
+		return nil, 0, 0, nil
+	}
+	return f, rp.Offset, rp.Chunks, h
+}
+
+func removeRestoreStaging(sfile string) {
+	os.Remove(sfile)
+	os.Remove(sfile + restoreProgressExt)
+}
+
+// Removes staged restores that have not been resumed in time, along with
+// anything else left in the staging directory that has not been touched.
+func removeStaleRestores(snapDir string, expire time.Duration) {
+	entries, err := os.ReadDir(snapDir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || time.Since(fi.ModTime()) <= expire {
+			continue
+		}
+		name := e.Name()
+		if strings.HasSuffix(name, restoreProgressExt) {
+			removeRestoreStaging(filepath.Join(snapDir, strings.TrimSuffix(name, restoreProgressExt)))
+		} else if _, err := os.Stat(filepath.Join(snapDir, name+restoreProgressExt)); os.IsNotExist(err) {
+			os.RemoveAll(filepath.Join(snapDir, name))
+		}
+	}
+}
+
 // Process a snapshot request.
 func (s *Server) jsStreamSnapshotRequest(sub *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	if c == nil || !s.JetStreamEnabled() {
@@ -3555,7 +4769,7 @@ func (s *Server) jsStreamSnapshotRequest(sub *subscription, c *client, _ *Accoun
 
 		end := time.Now().UTC()
 
-		s.publishAdvisory(acc, JSAdvisoryStreamSnapshotCompletePre+"."+mset.name(), &JSSnapshotCompleteAdvisory{
+		adv := &JSSnapshotCompleteAdvisory{
 			TypedEvent: TypedEvent{
 				Type: JSSnapshotCompleteAdvisoryType,
 				ID:   nuid.Next(),
@@ -3566,8 +4780,22 @@ func (s *Server) jsStreamSnapshotRequest(sub *subscription, c *client, _ *Accoun
 			End:    end,
 			Client: ci,
 			Domain: s.getOpts().JetStreamDomain,
-		})
+		}
+		var serr error
+		if h := sr.Handle; h != nil {
+			<-h.Done()
+			p := h.Progress()
+			adv.Blocks, adv.Bytes = p.BlksDone, p.Bytes
+			if serr = h.Err(); serr != nil {
+				adv.Error = serr.Error()
+			}
+		}
+		s.publishAdvisory(acc, JSAdvisoryStreamSnapshotCompletePre+"."+mset.name(), adv)
 
+		if serr != nil {
+			s.Warnf("Snapshot of stream '%s > %s' failed: %v", mset.jsa.account.Name, mset.name(), serr)
+			return
+		}
 		s.Noticef("Completed snapshot of %s for stream '%s > %s' in %v",
 			friendlyBytes(int64(sr.State.Bytes)),
 			mset.jsa.account.Name,
@@ -3627,15 +4855,27 @@ func (s *Server) streamSnapshot(ci *ClientInfo, acc *Account, mset *stream, sr *
 	})
 	defer mset.unsubscribeUnlocked(ackSub)
 
-	// TODO(dlc) - Add in NATS-Chunked-Sequence header
+	// Chunks carry their offset in the snapshot so they can be fed as is to a restore,
+	// and the last one the digest of the whole snapshot.
+	h := sha256.New()
+	var offset int
+	var serr error
 
 	for index := 1; ; index++ {
 		chunk := make([]byte, chunkSize)
 		n, err := r.Read(chunk)
 		chunk = chunk[:n]
+		if n > 0 {
+			h.Write(chunk)
+		}
 		if err != nil {
 			if n > 0 {
-				mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, nil, chunk, nil, 0))
+				hdr := genHeader(nil, JSRestoreOffset, strconv.Itoa(offset))
+				mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, chunk, nil, 0))
+			}
+			if err != io.EOF {
+				s.Warnf("Snapshot for stream '%s > %s' failed: %v", acc.Name, mset.name(), err)
+				serr = err
 			}
 			break
 		}
@@ -3646,18 +4886,31 @@ func (s *Server) streamSnapshot(ci *ClientInfo, acc *Account, mset *stream, sr *
 			select {
 			case <-acks:
 			case <-inch: // Lost interest
+				// Make sure the store unwinds the snapshot.
+				if sr.Handle != nil {
+					sr.Handle.Cancel()
+				}
+				serr = errSnapshotInterestLost
 				goto done
 			case <-time.After(10 * time.Millisecond):
 			}
 		}
 		ackReply := fmt.Sprintf("%s.%d.%d", ackSubj, len(chunk), index)
-		mset.outq.send(newJSPubMsg(reply, _EMPTY_, ackReply, nil, chunk, nil, 0))
+		hdr := genHeader(nil, JSRestoreOffset, strconv.Itoa(offset))
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, ackReply, hdr, chunk, nil, 0))
 		atomic.AddInt32(&out, int32(len(chunk)))
+		offset += len(chunk)
 	}
 done:
-	// Send last EOF
-	// TODO(dlc) - place hash in header
-	mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, nil, nil, nil, 0))
+	// Send last EOF. Only a complete snapshot carries the digest, so a partial
+	// one can never be verified as complete.
+	var hdr []byte
+	if serr != nil {
+		hdr = []byte("NATS/1.0 500 Snapshot Failed\r\n\r\n")
+	} else {
+		hdr = genHeader(nil, JSSnapshotDigest, snapshotDigest(h))
+	}
+	mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 }
 
 // For determining consumer request type.
@@ -3845,7 +5098,7 @@ func (s *Server) jsConsumerCreateRequest(sub *subscription, c *client, a *Accoun
 		return
 	}
 
-	o, err := stream.addConsumer(&req.Config)
+	o, err := stream.addConsumerWithAssignment(&req.Config, _EMPTY_, nil, false, ci)
 
 	if err != nil {
 		if IsNatsErr(err, JSConsumerStoreFailedErrF) {
@@ -4094,10 +5347,13 @@ func (s *Server) jsConsumerInfoRequest(sub *subscription, c *client, _ *Account,
 
 	var resp = JSApiConsumerInfoResponse{ApiResponse: ApiResponse{Type: JSApiConsumerInfoResponseType}}
 
+	var req JSApiConsumerInfoRequest
 	if !isEmptyRequest(msg) {
-		resp.Error = NewJSNotEmptyRequestError()
-		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
-		return
+		if err := json.Unmarshal(msg, &req); err != nil {
+			resp.Error = NewJSInvalidJSONError()
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
 	}
 
 	// If we are in clustered mode we need to be the stream leader to proceed.
@@ -4222,7 +5478,26 @@ func (s *Server) jsConsumerInfoRequest(sub *subscription, c *client, _ *Account,
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
+	if len(req.PendingFilters) > JSMaxPendingFilters {
+		resp.Error = NewJSConsumerTooManyPendingFiltersError(JSMaxPendingFilters)
+		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+		return
+	}
 	resp.ConsumerInfo = obs.info()
+	if len(req.PendingFilters) > 0 && resp.ConsumerInfo != nil {
+		np, err := obs.numPendingFiltered(req.PendingFilters)
+		if err != nil {
+			resp.ConsumerInfo = nil
+			if err == ErrConsumerFilterNotSubset {
+				resp.Error = NewJSConsumerFilterNotSubsetError()
+			} else {
+				resp.Error = NewJSStreamGeneralError(err, Unless(err))
+			}
+			s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
+			return
+		}
+		resp.ConsumerInfo.NumPendingFiltered = np
+	}
 	s.sendAPIResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(resp))
 }
 
@@ -4289,7 +5564,7 @@ func (s *Server) jsConsumerDeleteRequest(sub *subscription, c *client, _ *Accoun
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
 	}
-	if err := obs.delete(); err != nil {
+	if err := obs.deleteByClient(ci); err != nil {
 		resp.Error = NewJSStreamGeneralError(err, Unless(err))
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(msg), s.jsonResponse(&resp))
 		return
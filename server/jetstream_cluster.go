@@ -102,6 +102,9 @@ const (
 	removePendingRequest
 	// For sending compressed streams, either through RAFT or catchup.
 	compressedStreamMsgOp
+	// For pending pull requests along with their state.
+	addPendingRequestState
+	updatePendingRequest
 )
 
 // raftGroups are controlled by the metagroup controller.
@@ -126,6 +129,7 @@ type streamAssignment struct {
 	Subject string        `json:"subject"`
 	Reply   string        `json:"reply"`
 	Restore *StreamState  `json:"restore_state,omitempty"`
+	Resume  bool          `json:"restore_resume,omitempty"`
 	// Internal
 	consumers map[string]*consumerAssignment
 	responded bool
@@ -439,7 +443,7 @@ func (cc *jetStreamCluster) isStreamHealthy(account, stream string) bool {
 		if err != nil {
 			return false
 		}
-		if mset.isCatchingUp() {
+		if mset.isCatchingUp() || mset.failure() != nil {
 			return false
 		}
 		// Success.
@@ -618,11 +622,12 @@ func (js *jetStream) setupMetaGroup() error {
 	sysAcc := s.SystemAccount()
 	storeDir := filepath.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, defaultMetaGroupName)
 
-	fs, err := newFileStoreWithCreated(
+	fs, err := newFileStoreWithKeys(
 		FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMetaFSBlkSize, AsyncFlush: false},
 		StreamConfig{Name: defaultMetaGroupName, Storage: FileStorage},
 		time.Now().UTC(),
 		s.jsKeyGen(defaultMetaGroupName),
+		s.jsPrevKeyGen(defaultMetaGroupName),
 	)
 	if err != nil {
 		s.Errorf("Error creating filestore: %v", err)
@@ -1719,11 +1724,12 @@ func (js *jetStream) createRaftGroup(accName string, rg *raftGroup, storage Stor
 	storeDir := filepath.Join(js.config.StoreDir, sysAcc.Name, defaultStoreDirName, rg.Name)
 	var store StreamStore
 	if storage == FileStorage {
-		fs, err := newFileStoreWithCreated(
+		fs, err := newFileStoreWithKeys(
 			FileStoreConfig{StoreDir: storeDir, BlockSize: defaultMediumBlockSize, AsyncFlush: false, SyncInterval: 5 * time.Minute},
 			StreamConfig{Name: rg.Name, Storage: FileStorage},
 			time.Now().UTC(),
 			s.jsKeyGen(rg.Name),
+			s.jsPrevKeyGen(rg.Name),
 		)
 		if err != nil {
 			s.Errorf("Error creating filestore WAL: %v", err)
@@ -1994,7 +2000,7 @@ func (js *jetStream) monitorStream(mset *stream, sa *streamAssignment, sendSnaps
 				}
 				if isRestore {
 					acc, _ := s.LookupAccount(sa.Client.serviceAccount())
-					restoreDoneCh = s.processStreamRestore(sa.Client, acc, sa.Config, _EMPTY_, sa.Reply, _EMPTY_)
+					restoreDoneCh = s.processStreamRestore(sa.Client, acc, sa.Config, sa.Resume, _EMPTY_, sa.Reply, _EMPTY_)
 					continue
 				} else if n.NeedSnapshot() {
 					doSnapshot()
@@ -2324,7 +2330,7 @@ func (mset *stream) resetClusteredState(err error) bool {
 
 	// Preserve our current state and messages unless we have a first sequence mismatch.
 	shouldDelete := err == errFirstSequenceMismatch
-	mset.stop(shouldDelete, false)
+	mset.stop(shouldDelete, false, nil)
 
 	if sa != nil {
 		s.Warnf("Resetting stream cluster state for '%s > %s'", sa.Client.serviceAccount(), sa.Config.Name)
@@ -2563,7 +2569,7 @@ func (js *jetStream) applyStreamEntries(mset *stream, ce *CommittedEntry, isReco
 					js.mu.RUnlock()
 				}
 				if shouldRemove {
-					mset.stop(true, false)
+					mset.stop(true, false, nil)
 				}
 			}
 			return nil
@@ -2665,7 +2671,7 @@ func (js *jetStream) processStreamLeaderChange(mset *stream, isLeader bool) {
 		resp.DidCreate = true
 		s.sendAPIResponse(client, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
 		if node := mset.raftNode(); node != nil {
-			mset.sendCreateAdvisory()
+			mset.sendCreateAdvisory(client)
 		}
 	}
 }
@@ -2945,7 +2951,7 @@ func (s *Server) removeStream(ourID string, mset *stream, nsa *streamAssignment)
 
 	// wait for monitor to be shut down
 	mset.monitorWg.Wait()
-	mset.stop(true, false)
+	mset.stop(true, false, nil)
 }
 
 // processClusterUpdateStream is called when we have a stream assignment that
@@ -2988,7 +2994,7 @@ func (js *jetStream) processClusterUpdateStream(acc *Account, osa, sa *streamAss
 			js.mu.Unlock()
 		}
 		// Call update.
-		if err = mset.update(cfg); err != nil {
+		if err = mset.updateWithAdvisory(cfg, true, sa.Client); err != nil {
 			s.Warnf("JetStream cluster error updating stream %q for account %q: %v", cfg.Name, acc.Name, err)
 		}
 		// Set the new stream assignment.
@@ -3128,7 +3134,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 				}
 			}
 			mset.setStreamAssignment(sa)
-			if err = mset.updateWithAdvisory(sa.Config, false); err != nil {
+			if err = mset.updateWithAdvisory(sa.Config, false, sa.Client); err != nil {
 				s.Warnf("JetStream cluster error updating stream %q for account %q: %v", sa.Config.Name, acc.Name, err)
 				// Process the raft group and make sure it's running if needed.
 				js.createRaftGroup(acc.GetName(), osa.Group, storage)
@@ -3140,7 +3146,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 			}
 		} else if err == NewJSStreamNotFoundError() {
 			// Add in the stream here.
-			mset, err = acc.addStreamWithAssignment(sa.Config, nil, sa)
+			mset, err = acc.addStreamWithAssignment(sa.Config, nil, sa, sa.Client)
 		}
 		if mset != nil {
 			mset.setCreatedTime(sa.Created)
@@ -3198,7 +3204,7 @@ func (js *jetStream) processClusterCreateStream(acc *Account, sa *streamAssignme
 		// If we are restoring, process that first.
 		if sa.Restore != nil {
 			// We are restoring a stream here.
-			restoreDoneCh := s.processStreamRestore(sa.Client, acc, sa.Config, _EMPTY_, sa.Reply, _EMPTY_)
+			restoreDoneCh := s.processStreamRestore(sa.Client, acc, sa.Config, sa.Resume, _EMPTY_, sa.Reply, _EMPTY_)
 			s.startGoRoutine(func() {
 				defer s.grWG.Done()
 				select {
@@ -3344,7 +3350,7 @@ func (js *jetStream) processClusterDeleteStream(sa *streamAssignment, isMember,
 			}
 			// wait for monitor to be shut down
 			mset.monitorWg.Wait()
-			err = mset.stop(true, wasLeader)
+			err = mset.stop(true, wasLeader, sa.Client)
 			stopped = true
 		}
 	}
@@ -3627,7 +3633,7 @@ func (js *jetStream) processClusterCreateConsumer(ca *consumerAssignment, state
 	var didCreate, isConfigUpdate bool
 	if o == nil {
 		// Add in the consumer if needed.
-		o, err = mset.addConsumerWithAssignment(ca.Config, ca.Name, ca, false)
+		o, err = mset.addConsumerWithAssignment(ca.Config, ca.Name, ca, false, ca.Client)
 		didCreate = true
 	} else {
 		if err := o.updateConfig(ca.Config); err != nil {
@@ -3802,7 +3808,7 @@ func (js *jetStream) processClusterDeleteConsumer(ca *consumerAssignment, isMemb
 	if acc, _ = s.LookupAccount(ca.Client.serviceAccount()); acc != nil {
 		if mset, _ := acc.lookupStream(ca.Stream); mset != nil {
 			if o := mset.lookupConsumer(ca.Name); o != nil {
-				err = o.stopWithFlags(true, false, true, wasLeader)
+				err = o.stopWithFlags(true, false, true, wasLeader, ca.Client)
 				stopped = true
 			}
 		}
@@ -4196,7 +4202,7 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 					}
 				}
 				if shouldRemove {
-					o.stopWithFlags(true, false, false, false)
+					o.stopWithFlags(true, false, false, false, nil)
 				}
 			}
 			return nil
@@ -4250,9 +4256,31 @@ func (js *jetStream) applyConsumerEntries(o *consumer, ce *CommittedEntry, isLea
 				o.mu.Lock()
 				if !o.isLeader() {
 					if o.prm == nil {
-						o.prm = make(map[string]struct{})
+						o.prm = make(map[string]*pendingRequest)
+					}
+					o.prm[string(buf[1:])] = nil
+				}
+				o.mu.Unlock()
+			case addPendingRequestState, updatePendingRequest:
+				reply, pr, err := decodePendingRequest(entryOp(buf[0]), buf[1:])
+				if err != nil {
+					if mset, node := o.streamAndNode(); mset != nil && node != nil {
+						s := js.srv
+						s.Errorf("JetStream cluster could not decode pending request for '%s > %s > %s' [%s]",
+							mset.account(), mset.name(), o, node.Group())
+					}
+					continue
+				}
+				o.mu.Lock()
+				if !o.isLeader() {
+					if o.prm == nil {
+						o.prm = make(map[string]*pendingRequest)
+					}
+					if cpr, ok := o.prm[reply]; ok && cpr != nil && entryOp(buf[0]) == updatePendingRequest {
+						cpr.n, cpr.b = pr.n, pr.b
+					} else if !ok && entryOp(buf[0]) == addPendingRequestState {
+						o.prm[reply] = pr
 					}
-					o.prm[string(buf[1:])] = struct{}{}
 				}
 				o.mu.Unlock()
 			case removePendingRequest:
@@ -4345,6 +4373,75 @@ func decodeDeliveredUpdate(buf []byte) (dseq, sseq, dc uint64, ts int64, err err
 	return dseq, sseq, dc, ts, nil
 }
 
+var errBadPendingRequest = errors.New("jetstream cluster bad pending request")
+
+// Encodes a pending pull request along with its state.
+func encodePendingRequestAdd(wr *waitingRequest) []byte {
+	var expires int64
+	if !wr.expires.IsZero() {
+		expires = wr.expires.UnixNano()
+	}
+	var noWait byte
+	if wr.noWait {
+		noWait = 1
+	}
+	b := make([]byte, 1, 4*binary.MaxVarintLen64+2+len(wr.reply))
+	b[0] = byte(addPendingRequestState)
+	b = binary.AppendUvarint(b, uint64(wr.n))
+	b = binary.AppendUvarint(b, uint64(wr.b))
+	b = binary.AppendVarint(b, expires)
+	b = binary.AppendVarint(b, int64(wr.hb))
+	b = append(b, noWait)
+	return append(b, wr.reply...)
+}
+
+// Encodes what is left of a pending pull request.
+func encodePendingRequestUpdate(wr *waitingRequest) []byte {
+	b := make([]byte, 1, 2*binary.MaxVarintLen64+1+len(wr.reply))
+	b[0] = byte(updatePendingRequest)
+	b = binary.AppendUvarint(b, uint64(wr.n))
+	b = binary.AppendUvarint(b, uint64(wr.b))
+	return append(b, wr.reply...)
+}
+
+func decodePendingRequest(op entryOp, buf []byte) (string, *pendingRequest, error) {
+	var pr pendingRequest
+	var bi, n int
+	var v uint64
+	if v, n = binary.Uvarint(buf); n <= 0 {
+		return _EMPTY_, nil, errBadPendingRequest
+	}
+	pr.n, bi = int(v), n
+	if v, n = binary.Uvarint(buf[bi:]); n <= 0 {
+		return _EMPTY_, nil, errBadPendingRequest
+	}
+	pr.b, bi = int(v), bi+n
+	if op == addPendingRequestState {
+		var expires, hb int64
+		if expires, n = binary.Varint(buf[bi:]); n <= 0 {
+			return _EMPTY_, nil, errBadPendingRequest
+		}
+		bi += n
+		if expires > 0 {
+			pr.expires = time.Unix(0, expires)
+		}
+		if hb, n = binary.Varint(buf[bi:]); n <= 0 {
+			return _EMPTY_, nil, errBadPendingRequest
+		}
+		bi += n
+		pr.hb = time.Duration(hb)
+		if bi >= len(buf) {
+			return _EMPTY_, nil, errBadPendingRequest
+		}
+		pr.noWait = buf[bi] == 1
+		bi++
+	}
+	if bi >= len(buf) {
+		return _EMPTY_, nil, errBadPendingRequest
+	}
+	return string(buf[bi:]), &pr, nil
+}
+
 func (js *jetStream) processConsumerLeaderChange(o *consumer, isLeader bool) error {
 	stepDownIfLeader := func() error {
 		if node := o.raftNode(); node != nil && isLeader {
@@ -4402,7 +4499,7 @@ func (js *jetStream) processConsumerLeaderChange(o *consumer, isLeader bool) err
 		resp.ConsumerInfo = o.initialInfo()
 		s.sendAPIResponse(client, acc, subject, reply, _EMPTY_, s.jsonResponse(&resp))
 		if node := o.raftNode(); node != nil {
-			o.sendCreateAdvisory()
+			o.sendCreateAdvisory(client)
 		}
 	}
 
@@ -5385,7 +5482,7 @@ func (s *Server) jsClusteredStreamUpdateRequest(ci *ClientInfo, acc *Account, su
 		return
 	}
 	// Check for mirror changes which are not allowed.
-	if !reflect.DeepEqual(newCfg.Mirror, osa.Config.Mirror) {
+	if !reflect.DeepEqual(newCfg.Mirror, osa.Config.Mirror) && !isMirrorPromotion(osa.Config, newCfg) {
 		resp.Error = NewJSStreamMirrorNotUpdatableError()
 		s.sendAPIErrResponse(ci, acc, subject, reply, string(rmsg), s.jsonResponse(&resp))
 		return
@@ -5737,7 +5834,7 @@ func (s *Server) jsClusteredStreamRestoreRequest(
 	rg.setPreferred()
 	sa := &streamAssignment{Group: rg, Sync: syncSubjForStream(), Config: cfg, Subject: subject, Reply: reply, Client: ci, Created: time.Now().UTC()}
 	// Now add in our restore state and pre-select a peer to handle the actual receipt of the snapshot.
-	sa.Restore = &req.State
+	sa.Restore, sa.Resume = &req.State, req.Resume
 	cc.meta.Propose(encodeAddStreamAssignment(sa))
 }
 
@@ -6720,6 +6817,7 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 	name, stype, store := mset.cfg.Name, mset.cfg.Storage, mset.store
 	s, js, jsa, st, rf, tierName, outq, node := mset.srv, mset.js, mset.jsa, mset.cfg.Storage, mset.cfg.Replicas, mset.tier, mset.outq, mset.node
 	maxMsgSize, lseq, clfs := int(mset.cfg.MaxMsgSize), mset.lseq, mset.clfs
+	msgOverhead := mset.cfg.MsgOverhead
 	isLeader := mset.isLeader()
 	mset.mu.RUnlock()
 
@@ -6769,7 +6867,11 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 		jsa.usage[tierName] = t
 	}
 	if st == MemoryStorage {
-		total := t.total.store + int64(memStoreMsgSize(subject, hdr, msg)*uint64(rf))
+		sz := memStoreMsgSize(subject, hdr, msg)
+		if msgOverhead {
+			sz = fileStoreMsgSize(subject, hdr, msg)
+		}
+		total := t.total.store + int64(sz*uint64(rf))
 		if jsaLimits.MaxMemory > 0 && total > jsaLimits.MaxMemory {
 			exceeded = true
 		}
@@ -6867,7 +6969,7 @@ func (mset *stream) processClusteredInboundMsg(subject, reply string, hdr, msg [
 		mset.clseq = lseq + clfs
 	}
 
-	esm := encodeStreamMsgAllowCompress(subject, reply, hdr, msg, mset.clseq, time.Now().UnixNano(), mset.compressOK)
+	esm := encodeStreamMsgAllowCompress(subject, reply, hdr, msg, mset.clseq, mset.hlc.now(), mset.compressOK)
 	mset.clseq++
 
 	// Do proposal.
@@ -7553,6 +7655,8 @@ func (mset *stream) handleClusterStreamInfoRequest(sub *subscription, c *client,
 		Cluster: js.clusterInfo(mset.raftGroup()),
 		Sources: mset.sourcesInfo(),
 		Mirror:  mset.mirrorInfo(),
+		Intake:  mset.intakeInfo(),
+		History: mset.configHistory(),
 	}
 
 	// Check for out of band catchups.
@@ -3944,13 +3944,41 @@ func TestJetStreamClusterPullConsumerLeaderChange(t *testing.T) {
 	time.Sleep(100 * time.Millisecond)
 	checkSubsPending(t, sub, 0)
 
-	// Now have consumer leader change and make sure we get signaled that our request is not valid.
+	// Now have consumer leader change and make sure the new leader takes over our request.
 	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
 	require_NoError(t, err)
 	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	time.Sleep(100 * time.Millisecond)
+	checkSubsPending(t, sub, 0)
+	_, err = js.Publish("foo", []byte("HELLO"))
+	require_NoError(t, err)
 	checkSubsPending(t, sub, 1)
 	m, err := sub.NextMsg(0)
 	require_NoError(t, err)
+	require_True(t, m.Header.Get("Status") == _EMPTY_)
+	require_NoError(t, m.AckSync())
+	checkSubsPending(t, sub, 0)
+
+	// With peers that can not take over the state of pending requests, as in a
+	// mixed version cluster, make sure we get signaled that our request is not valid.
+	for _, s := range c.servers {
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		if o := mset.lookupConsumer("dlc"); o != nil {
+			o.setPendingRequestsOk(true, false)
+		}
+	}
+	err = nc.PublishRequest(rsubj, "reply", jreq)
+	require_NoError(t, err)
+	time.Sleep(100 * time.Millisecond)
+	checkSubsPending(t, sub, 0)
+
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+	checkSubsPending(t, sub, 1)
+	m, err = sub.NextMsg(0)
+	require_NoError(t, err)
 	// Make sure this is an alert that tells us our request is no longer valid.
 	if m.Header.Get("Status") != "409" {
 		t.Fatalf("Expected a 409 status code, got %q", m.Header.Get("Status"))
@@ -3994,6 +4022,82 @@ func TestJetStreamClusterPullConsumerLeaderChange(t *testing.T) {
 	checkSubsPending(t, sub, 1)
 }
 
+func TestJetStreamClusterPullConsumerLeaderChangePartialBatch(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "JSC", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Replicas: 3,
+		Subjects: []string{"foo"},
+	})
+	require_NoError(t, err)
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:   "dlc",
+		AckPolicy: nats.AckExplicitPolicy,
+	})
+	require_NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err := js.Publish("foo", []byte("HELLO"))
+		require_NoError(t, err)
+	}
+
+	sub, err := nc.SubscribeSync("reply")
+	require_NoError(t, err)
+	defer sub.Unsubscribe()
+
+	// Ask for more than we have, so the request stays pending after two messages.
+	rsubj := fmt.Sprintf(JSApiRequestNextT, "TEST", "dlc")
+	jreq, err := json.Marshal(&JSApiConsumerGetNextRequest{Batch: 5, Expires: 10 * time.Second})
+	require_NoError(t, err)
+	require_NoError(t, nc.PublishRequest(rsubj, "reply", jreq))
+	checkSubsPending(t, sub, 2)
+
+	// Make sure followers know about what is left of the request.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			o := mset.lookupConsumer("dlc")
+			if o == nil || o.isLeader() {
+				continue
+			}
+			o.mu.RLock()
+			pr := o.prm["reply"]
+			o.mu.RUnlock()
+			if pr == nil || pr.n != 3 {
+				return fmt.Errorf("pending request not updated on %s", s)
+			}
+		}
+		return nil
+	})
+
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader("$G", "TEST", "dlc")
+
+	// The new leader should only fill the rest of the batch.
+	for i := 0; i < 5; i++ {
+		_, err := js.Publish("foo", []byte("HELLO"))
+		require_NoError(t, err)
+	}
+	checkSubsPending(t, sub, 5)
+	time.Sleep(100 * time.Millisecond)
+	checkSubsPending(t, sub, 5)
+	for i := 0; i < 5; i++ {
+		m, err := sub.NextMsg(0)
+		require_NoError(t, err)
+		require_True(t, m.Header.Get("Status") == _EMPTY_)
+	}
+}
+
 func TestJetStreamClusterEphemeralPullConsumerServerShutdown(t *testing.T) {
 	c := createJetStreamClusterExplicit(t, "JSC", 3)
 	defer c.shutdown()
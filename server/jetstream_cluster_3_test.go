@@ -2620,3 +2620,326 @@ func TestJetStreamClusterActiveActiveSourcedStreams(t *testing.T) {
 	})
 	require_NoError(t, err)
 }
+
+func TestJetStreamClusterStreamMaintenance(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3})
+	require_NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+	c.waitOnAllCurrent()
+
+	sysnc := natsConnect(t, c.randomServer().ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	defer sysnc.Close()
+
+	req, _ := json.Marshal(&JSApiStreamMaintenanceRequest{RollBlock: true})
+	rmsg, err := sysnc.Request(fmt.Sprintf(JSApiStreamMaintenanceT, globalAccountName, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamMaintenanceResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	require_True(t, resp.Error == nil)
+	require_True(t, resp.Success)
+	require_True(t, resp.Block == 2)
+
+	// Every replica rolled its own store.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		for _, s := range c.servers {
+			mset, err := s.GlobalAccount().lookupStream("TEST")
+			if err != nil {
+				return err
+			}
+			fs := mset.store.(*fileStore)
+			fs.mu.RLock()
+			nblks := len(fs.blks)
+			fs.mu.RUnlock()
+			if nblks != 2 {
+				return fmt.Errorf("expected 2 blocks on %s, got %d", s, nblks)
+			}
+		}
+		return nil
+	})
+}
+
+func TestJetStreamClusterStreamStampOrigin(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, _ := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage, Replicas: 3, StampOrigin: true})
+	c.waitOnStreamLeader(globalAccountName, "TEST")
+
+	// Publish through a server that is not the stream leader.
+	ingress := c.randomNonStreamLeader(globalAccountName, "TEST")
+	nc2, js2 := jsClientConnect(t, ingress)
+	defer nc2.Close()
+	_, err := js2.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+	c.waitOnAllCurrent()
+
+	// All replicas stored the same origin.
+	for _, s := range c.servers {
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		sm, err := mset.store.LoadMsg(1, nil)
+		require_NoError(t, err)
+		require_True(t, string(getHeader(JSOriginAccount, sm.hdr)) == globalAccountName)
+		require_True(t, string(getHeader(JSOriginServer, sm.hdr)) == ingress.Name())
+	}
+}
+
+func TestJetStreamClusterMirrorPromotion(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "SOURCE", Subjects: []string{"foo"}, Replicas: 3, AllowDirect: true})
+	require_NoError(t, err)
+
+	cfg := &nats.StreamConfig{Name: "M", Mirror: &nats.StreamSource{Name: "SOURCE"}, Replicas: 3}
+	_, err = js.AddStream(cfg)
+	require_NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		_, err = js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		si, err := js.StreamInfo("M")
+		if err != nil {
+			return err
+		}
+		if si.State.Msgs != 5 {
+			return fmt.Errorf("expected 5 msgs, got %d", si.State.Msgs)
+		}
+		return nil
+	})
+
+	cfg.Mirror = nil
+	cfg.Subjects = []string{"bar"}
+	si, err := js.UpdateStream(cfg)
+	require_NoError(t, err)
+	require_True(t, si.Config.Mirror == nil)
+
+	pa, err := js.Publish("bar", []byte("NEW"))
+	require_NoError(t, err)
+	require_True(t, pa.Sequence == 6)
+	c.waitOnAllCurrent()
+
+	// No replica is still mirroring.
+	for _, s := range c.servers {
+		mset, err := s.GlobalAccount().lookupStream("M")
+		require_NoError(t, err)
+		mset.mu.RLock()
+		mirror := mset.mirror
+		mset.mu.RUnlock()
+		require_True(t, mirror == nil)
+	}
+}
+
+func TestJetStreamClusterConsumerRateLimitLeaderChange(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	// Burst is bound to the max msg size, so 4 msgs.
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3, MaxMsgSize: 4096})
+	require_NoError(t, err)
+
+	msg := make([]byte, 1000)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+
+	sub, err := nc.SubscribeSync("d")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	// 8KB/s, so well below the burst allowed by the max payload.
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      nats.AckNonePolicy,
+		RateLimit:      64 * 1024,
+		Replicas:       3,
+	})
+	require_NoError(t, err)
+
+	checkRate := func(max int) {
+		t.Helper()
+		time.Sleep(500 * time.Millisecond)
+		n, _, err := sub.Pending()
+		require_NoError(t, err)
+		if n > max {
+			t.Fatalf("Expected deliveries to be paced, got %d msgs", n)
+		}
+		for i := 0; i < n; i++ {
+			_, err := sub.NextMsg(0)
+			require_NoError(t, err)
+		}
+	}
+	// A new consumer starts with a full burst.
+	checkRate(10)
+
+	// A new leader should not start with a full burst.
+	_, err = nc.Request(fmt.Sprintf(JSApiConsumerLeaderStepDownT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	c.waitOnConsumerLeader(globalAccountName, "TEST", "dlc")
+	checkRate(6)
+}
+
+func TestJetStreamClusterActionAdvisoriesClientInfo(t *testing.T) {
+	test := func(t *testing.T, s *Server, replicas int) {
+		nc, js := jsClientConnect(t, s)
+		defer nc.Close()
+
+		sub := natsSubSync(t, nc, "$JS.EVENT.ADVISORY.*.*.>")
+		natsFlush(t, nc)
+
+		checkAdv := func(subj string, action ActionAdvisoryType) {
+			t.Helper()
+			for {
+				m := natsNexMsg(t, sub, 5*time.Second)
+				if m.Subject != subj {
+					// Skip leader elections and the like.
+					continue
+				}
+				var adv struct {
+					Action ActionAdvisoryType `json:"action"`
+					Client *ClientInfo        `json:"client"`
+				}
+				require_NoError(t, json.Unmarshal(m.Data, &adv))
+				require_True(t, adv.Action == action)
+				if adv.Client == nil {
+					t.Fatalf("Expected client info in %q advisory: %s", subj, m.Data)
+				}
+				if adv.Client.Account != globalAccountName || adv.Client.Server == _EMPTY_ {
+					t.Fatalf("Unexpected client info in %q advisory: %s", subj, m.Data)
+				}
+				return
+			}
+		}
+
+		_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: replicas})
+		require_NoError(t, err)
+		checkAdv(JSAdvisoryStreamCreatedPre+".TEST", CreateEvent)
+
+		_, err = js.UpdateStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}, Replicas: replicas})
+		require_NoError(t, err)
+		checkAdv(JSAdvisoryStreamUpdatedPre+".TEST", ModifyEvent)
+
+		_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+		require_NoError(t, err)
+		checkAdv(JSAdvisoryConsumerCreatedPre+".TEST.dlc", CreateEvent)
+
+		require_NoError(t, js.DeleteConsumer("TEST", "dlc"))
+		checkAdv(JSAdvisoryConsumerDeletedPre+".TEST.dlc", DeleteEvent)
+
+		require_NoError(t, js.DeleteStream("TEST"))
+		checkAdv(JSAdvisoryStreamDeletedPre+".TEST", DeleteEvent)
+	}
+
+	t.Run("Single", func(t *testing.T) {
+		s := RunBasicJetStreamServer(t)
+		defer s.Shutdown()
+		test(t, s, 1)
+	})
+
+	t.Run("Clustered", func(t *testing.T) {
+		c := createJetStreamClusterExplicit(t, "JSC", 3)
+		defer c.shutdown()
+		test(t, c.randomServer(), 3)
+	})
+}
+
+func TestJetStreamClusterStreamMoveToTarget(t *testing.T) {
+	c := createJetStreamClusterExplicit(t, "R3S", 3)
+	defer c.shutdown()
+
+	nc, js := jsClientConnect(t, c.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 1})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "DUR", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", []byte("ok"))
+		require_NoError(t, err)
+	}
+
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	from := si.Cluster.Leader
+	var target string
+	for _, s := range c.servers {
+		if s.Name() != from {
+			target = s.Name()
+			break
+		}
+	}
+
+	ncsys, err := nats.Connect(c.randomServer().ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	require_NoError(t, err)
+	defer ncsys.Close()
+
+	move := func(req *JSApiMetaServerStreamMoveRequest) *ApiError {
+		t.Helper()
+		b, err := json.Marshal(req)
+		require_NoError(t, err)
+		rmsg, err := ncsys.Request(fmt.Sprintf(JSApiServerStreamMoveT, "$G", "TEST"), b, 5*time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamUpdateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return resp.Error
+	}
+
+	// Unknown targets or targets already hosting the stream are rejected.
+	for _, tgt := range []string{"BOGUS", from} {
+		if apiErr := move(&JSApiMetaServerStreamMoveRequest{Target: tgt}); apiErr == nil || ErrorIdentifier(apiErr.ErrCode) != JSStreamMoveTargetInvalidF {
+			t.Fatalf("Expected invalid target error for %q, got %+v", tgt, apiErr)
+		}
+	}
+
+	if apiErr := move(&JSApiMetaServerStreamMoveRequest{Server: from, Target: target}); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+
+	checkFor(t, 20*time.Second, 250*time.Millisecond, func() error {
+		si, err := js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.Cluster.Leader != target || len(si.Cluster.Replicas) != 0 {
+			return fmt.Errorf("expected stream on %q only, got leader %q with %d replicas", target, si.Cluster.Leader, len(si.Cluster.Replicas))
+		}
+		if si.State.Msgs != 100 {
+			return fmt.Errorf("expected 100 msgs, got %d", si.State.Msgs)
+		}
+		return nil
+	})
+	checkFor(t, 20*time.Second, 250*time.Millisecond, func() error {
+		ci, err := js.ConsumerInfo("TEST", "DUR")
+		if err != nil {
+			return err
+		}
+		if ci.Cluster.Leader != target {
+			return fmt.Errorf("expected consumer on %q, got %q", target, ci.Cluster.Leader)
+		}
+		return nil
+	})
+}
@@ -5,6 +5,12 @@ package server
 import "strings"
 
 const (
+	// JSAPIQueueFullErr JetStream API queue limit reached
+	JSAPIQueueFullErr ErrorIdentifier = 10140
+
+	// JSAPIRateLimitExceededErr JetStream API rate limit exceeded
+	JSAPIRateLimitExceededErr ErrorIdentifier = 10138
+
 	// JSAccountResourcesExceededErr resource limits exceeded for account
 	JSAccountResourcesExceededErr ErrorIdentifier = 10002
 
@@ -98,6 +104,12 @@ const (
 	// JSConsumerFilterNotSubsetErr consumer filter subject is not a valid subset of the interest subjects
 	JSConsumerFilterNotSubsetErr ErrorIdentifier = 10093
 
+	// JSConsumerFlowControlWindowRequiresFCErr consumer flow control window requires flow control
+	JSConsumerFlowControlWindowRequiresFCErr ErrorIdentifier = 10136
+
+	// JSConsumerFlowControlWindowTooSmallErr consumer flow control window must be at least 1KB
+	JSConsumerFlowControlWindowTooSmallErr ErrorIdentifier = 10137
+
 	// JSConsumerHBRequiresPushErr consumer idle heartbeat requires a push based consumer
 	JSConsumerHBRequiresPushErr ErrorIdentifier = 10088
 
@@ -176,6 +188,9 @@ const (
 	// JSConsumerStoreFailedErrF error creating store for consumer: {err}
 	JSConsumerStoreFailedErrF ErrorIdentifier = 10104
 
+	// JSConsumerTooManyPendingFiltersErrF consumer info pending filters exceed maximum of {max}
+	JSConsumerTooManyPendingFiltersErrF ErrorIdentifier = 10141
+
 	// JSConsumerWQConsumerNotDeliverAllErr consumer must be deliver all on workqueue stream
 	JSConsumerWQConsumerNotDeliverAllErr ErrorIdentifier = 10101
 
@@ -206,6 +221,9 @@ const (
 	// JSMemoryResourcesExceededErr insufficient memory resources available
 	JSMemoryResourcesExceededErr ErrorIdentifier = 10028
 
+	// JSMessageRejectedByInterceptorErrF message rejected by interceptor {name}: {err}
+	JSMessageRejectedByInterceptorErrF ErrorIdentifier = 10135
+
 	// JSMirrorConsumerSetupFailedErrF generic mirror consumer setup failure string ({err})
 	JSMirrorConsumerSetupFailedErrF ErrorIdentifier = 10029
 
@@ -311,6 +329,9 @@ const (
 	// JSStreamMaxStreamBytesExceeded stream max bytes exceeds account limit max stream bytes
 	JSStreamMaxStreamBytesExceeded ErrorIdentifier = 10122
 
+	// JSStreamMergeNotPermittedErrF not permitted to read stream {stream}
+	JSStreamMergeNotPermittedErrF ErrorIdentifier = 10142
+
 	// JSStreamMessageExceedsMaximumErr message size exceeds maximum allowed
 	JSStreamMessageExceedsMaximumErr ErrorIdentifier = 10054
 
@@ -329,6 +350,9 @@ const (
 	// JSStreamMoveNotInProgress stream move not in progress
 	JSStreamMoveNotInProgress ErrorIdentifier = 10129
 
+	// JSStreamMoveTargetInvalidF stream move target is not valid: {err}
+	JSStreamMoveTargetInvalidF ErrorIdentifier = 10139
+
 	// JSStreamMsgDeleteFailedF Generic message deletion failure error string ({err})
 	JSStreamMsgDeleteFailedF ErrorIdentifier = 10057
 
@@ -407,6 +431,8 @@ const (
 
 var (
 	ApiErrors = map[ErrorIdentifier]*ApiError{
+		JSAPIQueueFullErr:                          {Code: 503, ErrCode: 10140, Description: "JetStream API queue limit reached"},
+		JSAPIRateLimitExceededErr:                  {Code: 429, ErrCode: 10138, Description: "JetStream API rate limit exceeded"},
 		JSAccountResourcesExceededErr:              {Code: 400, ErrCode: 10002, Description: "resource limits exceeded for account"},
 		JSBadRequestErr:                            {Code: 400, ErrCode: 10003, Description: "bad request"},
 		JSClusterIncompleteErr:                     {Code: 503, ErrCode: 10004, Description: "incomplete results"},
@@ -438,6 +464,8 @@ var (
 		JSConsumerExistingActiveErr:                {Code: 400, ErrCode: 10105, Description: "consumer already exists and is still active"},
 		JSConsumerFCRequiresPushErr:                {Code: 400, ErrCode: 10089, Description: "consumer flow control requires a push based consumer"},
 		JSConsumerFilterNotSubsetErr:               {Code: 400, ErrCode: 10093, Description: "consumer filter subject is not a valid subset of the interest subjects"},
+		JSConsumerFlowControlWindowRequiresFCErr:   {Code: 400, ErrCode: 10136, Description: "consumer flow control window requires flow control"},
+		JSConsumerFlowControlWindowTooSmallErr:     {Code: 400, ErrCode: 10137, Description: "consumer flow control window must be at least 1KB"},
 		JSConsumerHBRequiresPushErr:                {Code: 400, ErrCode: 10088, Description: "consumer idle heartbeat requires a push based consumer"},
 		JSConsumerInvalidDeliverSubject:            {Code: 400, ErrCode: 10112, Description: "invalid push consumer deliver subject"},
 		JSConsumerInvalidPolicyErrF:                {Code: 400, ErrCode: 10094, Description: "{err}"},
@@ -464,6 +492,7 @@ var (
 		JSConsumerReplicasShouldMatchStream:        {Code: 400, ErrCode: 10134, Description: "consumer config replicas must match interest retention stream's replicas"},
 		JSConsumerSmallHeartbeatErr:                {Code: 400, ErrCode: 10083, Description: "consumer idle heartbeat needs to be >= 100ms"},
 		JSConsumerStoreFailedErrF:                  {Code: 500, ErrCode: 10104, Description: "error creating store for consumer: {err}"},
+		JSConsumerTooManyPendingFiltersErrF:        {Code: 400, ErrCode: 10141, Description: "consumer info pending filters exceed maximum of {max}"},
 		JSConsumerWQConsumerNotDeliverAllErr:       {Code: 400, ErrCode: 10101, Description: "consumer must be deliver all on workqueue stream"},
 		JSConsumerWQConsumerNotUniqueErr:           {Code: 400, ErrCode: 10100, Description: "filtered consumer not unique on workqueue stream"},
 		JSConsumerWQMultipleUnfilteredErr:          {Code: 400, ErrCode: 10099, Description: "multiple non-filtered consumers not allowed on workqueue stream"},
@@ -474,6 +503,7 @@ var (
 		JSMaximumConsumersLimitErr:                 {Code: 400, ErrCode: 10026, Description: "maximum consumers limit reached"},
 		JSMaximumStreamsLimitErr:                   {Code: 400, ErrCode: 10027, Description: "maximum number of streams reached"},
 		JSMemoryResourcesExceededErr:               {Code: 500, ErrCode: 10028, Description: "insufficient memory resources available"},
+		JSMessageRejectedByInterceptorErrF:         {Code: 400, ErrCode: 10135, Description: "message rejected by interceptor {name}: {err}"},
 		JSMirrorConsumerSetupFailedErrF:            {Code: 500, ErrCode: 10029, Description: "{err}"},
 		JSMirrorMaxMessageSizeTooBigErr:            {Code: 400, ErrCode: 10030, Description: "stream mirror must have max message size >= source"},
 		JSMirrorWithSourcesErr:                     {Code: 400, ErrCode: 10031, Description: "stream mirrors can not also contain other sources"},
@@ -509,12 +539,14 @@ var (
 		JSStreamLimitsErrF:                         {Code: 500, ErrCode: 10053, Description: "{err}"},
 		JSStreamMaxBytesRequired:                   {Code: 400, ErrCode: 10113, Description: "account requires a stream config to have max bytes set"},
 		JSStreamMaxStreamBytesExceeded:             {Code: 400, ErrCode: 10122, Description: "stream max bytes exceeds account limit max stream bytes"},
+		JSStreamMergeNotPermittedErrF:              {Code: 403, ErrCode: 10142, Description: "not permitted to read stream {stream}"},
 		JSStreamMessageExceedsMaximumErr:           {Code: 400, ErrCode: 10054, Description: "message size exceeds maximum allowed"},
 		JSStreamMirrorNotUpdatableErr:              {Code: 400, ErrCode: 10055, Description: "stream mirror configuration can not be updated"},
 		JSStreamMismatchErr:                        {Code: 400, ErrCode: 10056, Description: "stream name in subject does not match request"},
 		JSStreamMoveAndScaleErr:                    {Code: 400, ErrCode: 10123, Description: "can not move and scale a stream in a single update"},
 		JSStreamMoveInProgressF:                    {Code: 400, ErrCode: 10124, Description: "stream move already in progress: {msg}"},
 		JSStreamMoveNotInProgress:                  {Code: 400, ErrCode: 10129, Description: "stream move not in progress"},
+		JSStreamMoveTargetInvalidF:                 {Code: 400, ErrCode: 10139, Description: "stream move target is not valid: {err}"},
 		JSStreamMsgDeleteFailedF:                   {Code: 500, ErrCode: 10057, Description: "{err}"},
 		JSStreamNameContainsPathSeparatorsErr:      {Code: 400, ErrCode: 10128, Description: "Stream name can not contain path separators"},
 		JSStreamNameExistErr:                       {Code: 400, ErrCode: 10058, Description: "stream name already in use with a different configuration"},
@@ -565,6 +597,26 @@ var (
 	ErrReplicasNotSupported = ApiErrors[JSStreamReplicasNotSupportedErr]
 )
 
+// NewJSAPIQueueFullError creates a new JSAPIQueueFullErr error: "JetStream API queue limit reached"
+func NewJSAPIQueueFullError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAPIQueueFullErr]
+}
+
+// NewJSAPIRateLimitExceededError creates a new JSAPIRateLimitExceededErr error: "JetStream API rate limit exceeded"
+func NewJSAPIRateLimitExceededError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSAPIRateLimitExceededErr]
+}
+
 // NewJSAccountResourcesExceededError creates a new JSAccountResourcesExceededErr error: "resource limits exceeded for account"
 func NewJSAccountResourcesExceededError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -893,6 +945,26 @@ func NewJSConsumerFilterNotSubsetError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSConsumerFilterNotSubsetErr]
 }
 
+// NewJSConsumerFlowControlWindowRequiresFCError creates a new JSConsumerFlowControlWindowRequiresFCErr error: "consumer flow control window requires flow control"
+func NewJSConsumerFlowControlWindowRequiresFCError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerFlowControlWindowRequiresFCErr]
+}
+
+// NewJSConsumerFlowControlWindowTooSmallError creates a new JSConsumerFlowControlWindowTooSmallErr error: "consumer flow control window must be at least 1KB"
+func NewJSConsumerFlowControlWindowTooSmallError(opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	return ApiErrors[JSConsumerFlowControlWindowTooSmallErr]
+}
+
 // NewJSConsumerHBRequiresPushError creates a new JSConsumerHBRequiresPushErr error: "consumer idle heartbeat requires a push based consumer"
 func NewJSConsumerHBRequiresPushError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1189,6 +1261,22 @@ func NewJSConsumerStoreFailedError(err error, opts ...ErrorOption) *ApiError {
 	}
 }
 
+// NewJSConsumerTooManyPendingFiltersError creates a new JSConsumerTooManyPendingFiltersErrF error: "consumer info pending filters exceed maximum of {max}"
+func NewJSConsumerTooManyPendingFiltersError(max interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSConsumerTooManyPendingFiltersErrF]
+	args := e.toReplacerArgs([]interface{}{"{max}", max})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSConsumerWQConsumerNotDeliverAllError creates a new JSConsumerWQConsumerNotDeliverAllErr error: "consumer must be deliver all on workqueue stream"
 func NewJSConsumerWQConsumerNotDeliverAllError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1289,6 +1377,22 @@ func NewJSMemoryResourcesExceededError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSMemoryResourcesExceededErr]
 }
 
+// NewJSMessageRejectedByInterceptorError creates a new JSMessageRejectedByInterceptorErrF error: "message rejected by interceptor {name}: {err}"
+func NewJSMessageRejectedByInterceptorError(err error, name interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSMessageRejectedByInterceptorErrF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err, "{name}", name})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSMirrorConsumerSetupFailedError creates a new JSMirrorConsumerSetupFailedErrF error: "{err}"
 func NewJSMirrorConsumerSetupFailedError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1723,6 +1827,22 @@ func NewJSStreamMaxStreamBytesExceededError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamMaxStreamBytesExceeded]
 }
 
+// NewJSStreamMergeNotPermittedError creates a new JSStreamMergeNotPermittedErrF error: "not permitted to read stream {stream}"
+func NewJSStreamMergeNotPermittedError(stream interface{}, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamMergeNotPermittedErrF]
+	args := e.toReplacerArgs([]interface{}{"{stream}", stream})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamMessageExceedsMaximumError creates a new JSStreamMessageExceedsMaximumErr error: "message size exceeds maximum allowed"
 func NewJSStreamMessageExceedsMaximumError(opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -1789,6 +1909,22 @@ func NewJSStreamMoveNotInProgressError(opts ...ErrorOption) *ApiError {
 	return ApiErrors[JSStreamMoveNotInProgress]
 }
 
+// NewJSStreamMoveTargetInvalidError creates a new JSStreamMoveTargetInvalidF error: "stream move target is not valid: {err}"
+func NewJSStreamMoveTargetInvalidError(err error, opts ...ErrorOption) *ApiError {
+	eopts := parseOpts(opts)
+	if ae, ok := eopts.err.(*ApiError); ok {
+		return ae
+	}
+
+	e := ApiErrors[JSStreamMoveTargetInvalidF]
+	args := e.toReplacerArgs([]interface{}{"{err}", err})
+	return &ApiError{
+		Code:        e.Code,
+		ErrCode:     e.ErrCode,
+		Description: strings.NewReplacer(args...).Replace(e.Description),
+	}
+}
+
 // NewJSStreamMsgDeleteFailedError creates a new JSStreamMsgDeleteFailedF error: "{err}"
 func NewJSStreamMsgDeleteFailedError(err error, opts ...ErrorOption) *ApiError {
 	eopts := parseOpts(opts)
@@ -65,6 +65,7 @@ type JSStreamActionAdvisory struct {
 	Action   ActionAdvisoryType `json:"action"`
 	Template string             `json:"template,omitempty"`
 	Domain   string             `json:"domain,omitempty"`
+	Client   *ClientInfo        `json:"client,omitempty"`
 }
 
 const JSStreamActionAdvisoryType = "io.nats.jetstream.advisory.v1.stream_action"
@@ -76,6 +77,7 @@ type JSConsumerActionAdvisory struct {
 	Consumer string             `json:"consumer"`
 	Action   ActionAdvisoryType `json:"action"`
 	Domain   string             `json:"domain,omitempty"`
+	Client   *ClientInfo        `json:"client,omitempty"`
 }
 
 const JSConsumerActionAdvisoryType = "io.nats.jetstream.advisory.v1.consumer_action"
@@ -110,16 +112,30 @@ type JSConsumerDeliveryExceededAdvisory struct {
 // JSConsumerDeliveryExceededAdvisoryType is the schema type for JSConsumerDeliveryExceededAdvisory
 const JSConsumerDeliveryExceededAdvisoryType = "io.nats.jetstream.advisory.v1.max_deliver"
 
+// JSConsumerMaxAckPendingAdvisory is an advisory informing that a consumer
+// paused delivery because it has MaxAckPending messages waiting for an ack
+type JSConsumerMaxAckPendingAdvisory struct {
+	TypedEvent
+	Stream        string `json:"stream"`
+	Consumer      string `json:"consumer"`
+	MaxAckPending int    `json:"max_ack_pending"`
+	Domain        string `json:"domain,omitempty"`
+}
+
+// JSConsumerMaxAckPendingAdvisoryType is the schema type for JSConsumerMaxAckPendingAdvisory
+const JSConsumerMaxAckPendingAdvisoryType = "io.nats.jetstream.advisory.v1.max_ack_pending"
+
 // JSConsumerDeliveryNakAdvisory is an advisory informing that a message was
 // naked by the consumer
 type JSConsumerDeliveryNakAdvisory struct {
 	TypedEvent
-	Stream      string `json:"stream"`
-	Consumer    string `json:"consumer"`
-	ConsumerSeq uint64 `json:"consumer_seq"`
-	StreamSeq   uint64 `json:"stream_seq"`
-	Deliveries  uint64 `json:"deliveries"`
-	Domain      string `json:"domain,omitempty"`
+	Stream      string        `json:"stream"`
+	Consumer    string        `json:"consumer"`
+	ConsumerSeq uint64        `json:"consumer_seq"`
+	StreamSeq   uint64        `json:"stream_seq"`
+	Deliveries  uint64        `json:"deliveries"`
+	Delay       time.Duration `json:"delay,omitempty"`
+	Domain      string        `json:"domain,omitempty"`
 }
 
 // JSConsumerDeliveryNakAdvisoryType is the schema type for JSConsumerDeliveryNakAdvisory
@@ -152,12 +168,16 @@ type JSSnapshotCreateAdvisory struct {
 // JSSnapshotCreatedAdvisoryType is the schema type for JSSnapshotCreateAdvisory
 const JSSnapshotCreatedAdvisoryType = "io.nats.jetstream.advisory.v1.snapshot_create"
 
-// JSSnapshotCompleteAdvisory is an advisory sent after a snapshot is successfully started
+// JSSnapshotCompleteAdvisory is an advisory sent after a snapshot has finished.
+// Error will be set if the snapshot failed or was canceled.
 type JSSnapshotCompleteAdvisory struct {
 	TypedEvent
 	Stream string      `json:"stream"`
 	Start  time.Time   `json:"start"`
 	End    time.Time   `json:"end"`
+	Blocks int         `json:"blocks,omitempty"`
+	Bytes  uint64      `json:"bytes,omitempty"`
+	Error  string      `json:"error,omitempty"`
 	Client *ClientInfo `json:"client"`
 	Domain string      `json:"domain,omitempty"`
 }
@@ -17,6 +17,7 @@
 package server
 
 import (
+	"encoding/json"
 	"fmt"
 	"os"
 	"strings"
@@ -1242,3 +1243,78 @@ func TestJetStreamLeafNodeSvcImportExportCycle(t *testing.T) {
 	_, err = js.Publish("foo", []byte("msg"))
 	require_NoError(t, err)
 }
+
+func TestJetStreamLeafNodeMirrorFromDomain(t *testing.T) {
+	tmpl := `
+		listen: -1
+		server_name: %s
+		jetstream { store_dir: '%s', domain: %s }
+		accounts {
+			JSY { users = [ { user: "y", pass: "p" } ]; jetstream: true }
+			$SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] }
+		}
+		leaf { %s }
+	`
+	confH := createConfFile(t, []byte(fmt.Sprintf(tmpl, "HUB", t.TempDir(), "HUB", "port: -1")))
+	sH, oH := RunServerWithConfig(confH)
+	defer sH.Shutdown()
+
+	remotes := fmt.Sprintf(`remotes [ { urls: [ "nats://y:p@127.0.0.1:%d" ], account: "JSY" } ]`, oH.LeafNode.Port)
+	confL := createConfFile(t, []byte(fmt.Sprintf(tmpl, "LEAF", t.TempDir(), "LEAF", remotes)))
+	sL, _ := RunServerWithConfig(confL)
+	defer sL.Shutdown()
+
+	checkLeafNodeConnectedCount(t, sH, 1)
+	checkLeafNodeConnectedCount(t, sL, 1)
+
+	ncH, jsH := jsClientConnect(t, sH, nats.UserInfo("y", "p"))
+	defer ncH.Close()
+	_, err := jsH.AddStream(&nats.StreamConfig{Name: "ORDERS", Subjects: []string{"orders.*"}})
+	require_NoError(t, err)
+
+	ncL, jsL := jsClientConnect(t, sL, nats.UserInfo("y", "p"))
+	defer ncL.Close()
+
+	create := func(cfg *StreamConfig) *JSApiStreamCreateResponse {
+		t.Helper()
+		req, err := json.Marshal(cfg)
+		require_NoError(t, err)
+		rmsg, err := ncL.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, 2*time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	// A domain that is not a valid name or conflicts with the external API prefix is rejected.
+	if resp := create(&StreamConfig{Name: "M", Storage: FileStorage, Mirror: &StreamSource{Name: "ORDERS", Domain: "H.B"}}); resp.Error == nil {
+		t.Fatalf("Expected an error for an invalid domain")
+	}
+	if resp := create(&StreamConfig{Name: "M", Storage: FileStorage, Mirror: &StreamSource{
+		Name: "ORDERS", Domain: "HUB", External: &ExternalStream{ApiPrefix: "$JS.OTHER.API"}}}); resp.Error == nil {
+		t.Fatalf("Expected an error for a conflicting external api prefix")
+	}
+
+	resp := create(&StreamConfig{Name: "M", Storage: FileStorage, Mirror: &StreamSource{Name: "ORDERS", Domain: "HUB"}})
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	if m := resp.Config.Mirror; m.Domain != _EMPTY_ || m.External == nil || m.External.ApiPrefix != "$JS.HUB.API" {
+		t.Fatalf("Expected the domain to be resolved into an external api prefix, got %+v", m)
+	}
+
+	for i := 0; i < 10; i++ {
+		_, err := jsH.Publish(fmt.Sprintf("orders.%d", i), []byte("ok"))
+		require_NoError(t, err)
+	}
+	checkFor(t, 5*time.Second, 100*time.Millisecond, func() error {
+		si, err := jsL.StreamInfo("M")
+		if err != nil {
+			return err
+		}
+		if si.State.Msgs != 10 {
+			return fmt.Errorf("expected 10 msgs, got %d", si.State.Msgs)
+		}
+		return nil
+	})
+}
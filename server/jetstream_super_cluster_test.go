@@ -3957,3 +3957,55 @@ func TestJetStreamSuperClusterGWOfflineSatus(t *testing.T) {
 		return nil
 	})
 }
+
+func TestJetStreamSuperClusterStreamMoveToTarget(t *testing.T) {
+	sc := createJetStreamSuperCluster(t, 3, 2)
+	defer sc.shutdown()
+
+	nc, js := jsClientConnect(t, sc.randomServer())
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Replicas: 3, Placement: &nats.Placement{Cluster: "C1"}})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", []byte("ok"))
+		require_NoError(t, err)
+	}
+
+	ncsys, err := nats.Connect(sc.randomServer().ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	require_NoError(t, err)
+	defer ncsys.Close()
+
+	// Moving to a server in another cluster moves the whole peer group there.
+	target := sc.clusterForName("C2").servers[0].Name()
+	b, err := json.Marshal(&JSApiMetaServerStreamMoveRequest{Target: target})
+	require_NoError(t, err)
+	rmsg, err := ncsys.Request(fmt.Sprintf(JSApiServerStreamMoveT, "$G", "TEST"), b, 5*time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+
+	checkFor(t, 30*time.Second, 250*time.Millisecond, func() error {
+		si, err := js.StreamInfo("TEST")
+		if err != nil {
+			return err
+		}
+		if si.Cluster.Name != "C2" || len(si.Cluster.Replicas) != 2 {
+			return fmt.Errorf("expected stream in C2 with 2 replicas, got %q with %d", si.Cluster.Name, len(si.Cluster.Replicas))
+		}
+		hosted := si.Cluster.Leader == target
+		for _, r := range si.Cluster.Replicas {
+			hosted = hosted || r.Name == target
+		}
+		if !hosted {
+			return fmt.Errorf("expected stream to be hosted on %q", target)
+		}
+		if si.State.Msgs != 100 {
+			return fmt.Errorf("expected 100 msgs, got %d", si.State.Msgs)
+		}
+		return nil
+	})
+}
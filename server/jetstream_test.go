@@ -17,8 +17,10 @@
 package server
 
 import (
+	"archive/tar"
 	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
@@ -41,6 +43,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/klauspost/compress/s2"
 	"github.com/nats-io/jwt/v2"
 	"github.com/nats-io/nats-server/v2/server/sysmem"
 	"github.com/nats-io/nats.go"
@@ -10312,6 +10315,114 @@ func TestJetStreamConsumerMaxAckPending(t *testing.T) {
 	}
 }
 
+func TestJetStreamConsumerMaxAckPendingStall(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 20; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	asub, err := nc.SubscribeSync(JSAdvisoryConsumerMaxAckPendingPre + ".TEST.dlc")
+	require_NoError(t, err)
+	sub, err := nc.SubscribeSync("d")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        time.Hour,
+		MaxAckPending:  5,
+	})
+	require_NoError(t, err)
+	checkSubsPending(t, sub, 5)
+
+	// We should be told once that delivery stopped.
+	m, err := asub.NextMsg(time.Second)
+	require_NoError(t, err)
+	var adv JSConsumerMaxAckPendingAdvisory
+	require_NoError(t, json.Unmarshal(m.Data, &adv))
+	require_True(t, adv.Type == JSConsumerMaxAckPendingAdvisoryType)
+	require_True(t, adv.Stream == "TEST" && adv.Consumer == "dlc")
+	require_True(t, adv.MaxAckPending == 5)
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.NumAckPending == 5)
+	resp, err := nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	var cir JSApiConsumerInfoResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &cir))
+	require_True(t, cir.ConsumerInfo.MaxAckPendingSince != nil)
+
+	// The pending count survives a restart, so we stay paused.
+	nc.Close()
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+	sub, err = nc.SubscribeSync("d")
+	require_NoError(t, err)
+	asub, err = nc.SubscribeSync(JSAdvisoryConsumerMaxAckPendingPre + ".TEST.dlc")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	time.Sleep(250 * time.Millisecond)
+	checkSubsPending(t, sub, 0)
+	ci, err = js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.NumAckPending == 5)
+	// Told once more after the restart.
+	_, err = asub.NextMsg(time.Second)
+	require_NoError(t, err)
+
+	// Acks resume delivery.
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	for seq := uint64(1); seq <= 2; seq++ {
+		o.processAckMsg(seq, seq, 1, false)
+	}
+	o.signalNewMessages()
+	checkSubsPending(t, sub, 2)
+
+	// We are paused again, with a new advisory.
+	_, err = asub.NextMsg(time.Second)
+	require_NoError(t, err)
+
+	// Hovering around the limit does not send more until we drop below the low water mark.
+	o.processAckMsg(3, 3, 1, false)
+	o.signalNewMessages()
+	checkSubsPending(t, sub, 3)
+	_, err = asub.NextMsg(250 * time.Millisecond)
+	require_Error(t, err, nats.ErrTimeout)
+	for seq := uint64(4); seq <= 5; seq++ {
+		o.processAckMsg(seq, seq, 1, false)
+	}
+	o.signalNewMessages()
+	checkSubsPending(t, sub, 5)
+	_, err = asub.NextMsg(time.Second)
+	require_NoError(t, err)
+	resp, err = nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "dlc"), nil, time.Second)
+	require_NoError(t, err)
+	cir = JSApiConsumerInfoResponse{}
+	require_NoError(t, json.Unmarshal(resp.Data, &cir))
+	require_True(t, cir.ConsumerInfo.MaxAckPendingSince != nil)
+	require_True(t, cir.ConsumerInfo.NumAckPending == 5)
+}
+
 func TestJetStreamPullConsumerMaxAckPending(t *testing.T) {
 	cases := []struct {
 		name    string
@@ -11575,6 +11686,85 @@ func TestJetStreamMirrorUpdatePreventsSubjects(t *testing.T) {
 	}
 }
 
+func TestJetStreamSourceCursorsSurviveRestart(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "ORIGIN", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 2; i++ {
+		_, err = js.Publish("foo", []byte("SKIP"))
+		require_NoError(t, err)
+	}
+	// A configured start sequence would otherwise be used again on recovery.
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:    "S",
+		Storage: nats.FileStorage,
+		Sources: []*nats.StreamSource{{Name: "ORIGIN", OptStartSeq: 3}},
+	})
+	require_NoError(t, err)
+
+	sendAndCheck := func(n int, expected uint64) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			_, err := js.Publish("foo", []byte("OK"))
+			require_NoError(t, err)
+		}
+		checkFor(t, 5*time.Second, 50*time.Millisecond, func() error {
+			si, err := js.StreamInfo("S")
+			if err != nil {
+				return err
+			}
+			if si.State.Msgs != expected {
+				return fmt.Errorf("expected %d msgs, got %d", expected, si.State.Msgs)
+			}
+			return nil
+		})
+	}
+	sendAndCheck(10, 10)
+
+	// Our sourced messages go away, so there is nothing to scan on recovery.
+	require_NoError(t, js.PurgeStream("S"))
+
+	mset, err := s.GlobalAccount().lookupStream("S")
+	require_NoError(t, err)
+	iname := mset.config().Sources[0].iname
+	require_True(t, mset.scur.get(iname) == 12)
+
+	// Restart.
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	// The cursor was written out on shutdown.
+	b, err := os.ReadFile(filepath.Join(sd, globalAccountName, streamsDir, "S", sourceCursorsFile))
+	require_NoError(t, err)
+	var seqs map[string]uint64
+	require_NoError(t, json.Unmarshal(b, &seqs))
+	require_True(t, seqs[iname] == 12)
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Only new messages are sourced, nothing is redelivered.
+	sendAndCheck(5, 5)
+	si, err := js.StreamInfo("S")
+	require_NoError(t, err)
+	require_True(t, si.Sources[0].Lag == 0)
+
+	// Removing the source drops its cursor.
+	_, err = js.UpdateStream(&nats.StreamConfig{Name: "S", Storage: nats.FileStorage, Subjects: []string{"bar"}})
+	require_NoError(t, err)
+	mset, err = s.GlobalAccount().lookupStream("S")
+	require_NoError(t, err)
+	require_True(t, mset.scur.get(iname) == 0)
+}
+
 func TestJetStreamSourceBasics(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
@@ -13079,6 +13269,39 @@ func TestJetStreamPublishExpectNoMsg(t *testing.T) {
 	}
 }
 
+func TestJetStreamPublishExpectLastSubjSeqAfterDelete(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "KV", Subjects: []string{"KV.>"}})
+	require_NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		_, err = js.Publish("KV.22", []byte("hello world"))
+		require_NoError(t, err)
+	}
+	// Remove the last message for the subject, the store should now report seq 1.
+	require_NoError(t, js.DeleteMsg("KV", 2))
+
+	m := nats.NewMsg("KV.22")
+	m.Header.Set(JSExpectedLastSubjSeq, "2")
+	_, err = js.PublishMsg(m)
+	require_Error(t, err)
+	var apiErr *nats.APIError
+	if !errors.As(err, &apiErr) || apiErr.ErrorCode != nats.ErrorCode(JSStreamWrongLastSequenceErrF) {
+		t.Fatalf("Expected wrong last sequence error, got %v", err)
+	}
+	require_Contains(t, apiErr.Description, "wrong last sequence: 1")
+
+	m.Header.Set(JSExpectedLastSubjSeq, "1")
+	pa, err := js.PublishMsg(m)
+	require_NoError(t, err)
+	require_True(t, pa.Sequence == 3)
+}
+
 func TestJetStreamPullLargeBatchExpired(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
@@ -13598,6 +13821,46 @@ func TestJetStreamRecoverBadStreamSubjects(t *testing.T) {
 	}
 }
 
+func TestJetStreamRecoverMetaFromBackup(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Updates keep the previous good meta files as a backup.
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.UpdateStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}})
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+	_, err = js.UpdateConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy, Description: "updated"})
+	require_NoError(t, err)
+	nc.Close()
+
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+
+	// Corrupt the stream meta file and lose the consumer's.
+	sdir := filepath.Join(sd, globalAccountName, streamsDir, "TEST")
+	require_NoError(t, os.WriteFile(filepath.Join(sdir, JetStreamMetaFile), []byte("garbage"), defaultFilePerms))
+	require_NoError(t, os.Remove(filepath.Join(sdir, consumerDir, "dlc", JetStreamMetaFile)))
+
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, len(si.Config.Subjects) == 1)
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.Config.Description == _EMPTY_)
+}
+
 func TestJetStreamRecoverBadMirrorConfigWithSubjects(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
@@ -14577,6 +14840,62 @@ func TestJetStreamNakRedeliveryWithNoWait(t *testing.T) {
 	t.Fatalf("Did not get the message in time")
 }
 
+func TestJetStreamNakAdvisoryWithDelay(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     "TEST",
+		Subjects: []string{"foo"},
+	})
+	require_NoError(t, err)
+
+	_, err = js.Publish("foo", []byte("NAK"))
+	require_NoError(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc", nats.AckWait(time.Minute))
+	require_NoError(t, err)
+
+	asub, err := nc.SubscribeSync(JSAdvisoryConsumerMsgNakPre + ".TEST.dlc")
+	require_NoError(t, err)
+	defer asub.Unsubscribe()
+
+	checkAdvisory := func(expected time.Duration) {
+		t.Helper()
+		am, err := asub.NextMsg(time.Second)
+		require_NoError(t, err)
+		var adv JSConsumerDeliveryNakAdvisory
+		require_NoError(t, json.Unmarshal(am.Data, &adv))
+		if adv.StreamSeq != 1 {
+			t.Fatalf("Expected stream sequence of 1, got %d", adv.StreamSeq)
+		}
+		if adv.Delay != expected {
+			t.Fatalf("Expected delay of %v, got %v", expected, adv.Delay)
+		}
+	}
+
+	msgs, err := sub.Fetch(1)
+	require_NoError(t, err)
+	// Plain NAK has no delay.
+	msgs[0].Nak()
+	checkAdvisory(0)
+
+	msgs, err = sub.Fetch(1)
+	require_NoError(t, err)
+	msgs[0].Respond([]byte(fmt.Sprintf("%s 250ms", AckNak)))
+	checkAdvisory(250 * time.Millisecond)
+
+	msgs, err = sub.Fetch(1)
+	require_NoError(t, err)
+	delay, err := json.Marshal(&ConsumerNakOptions{Delay: 100 * time.Millisecond})
+	require_NoError(t, err)
+	msgs[0].Respond([]byte(fmt.Sprintf("%s %s", AckNak, delay)))
+	checkAdvisory(100 * time.Millisecond)
+}
+
 // Test that we properly enforce per subject msg limits when DiscardNew is set.
 // DiscardNew should only apply to stream limits, subject based limits should always be DiscardOld.
 func TestJetStreamMaxMsgsPerSubjectWithDiscardNew(t *testing.T) {
@@ -14926,6 +15245,114 @@ func TestJetStreamFlowControlStall(t *testing.T) {
 	checkSubsPending(t, sub, 3)
 }
 
+func TestJetStreamFlowControlWindow(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "FC"})
+	require_NoError(t, err)
+
+	mset, err := s.GlobalAccount().lookupStream("FC")
+	require_NoError(t, err)
+
+	// The window needs flow control and a sane size.
+	_, err = mset.addConsumer(&ConsumerConfig{
+		DeliverSubject:    "d",
+		Heartbeat:         time.Second,
+		FlowControlWindow: 4096,
+	})
+	require_Error(t, err, NewJSConsumerFlowControlWindowRequiresFCError())
+	_, err = mset.addConsumer(&ConsumerConfig{
+		DeliverSubject:    "d",
+		Heartbeat:         time.Second,
+		FlowControl:       true,
+		FlowControlWindow: 100,
+	})
+	require_Error(t, err, NewJSConsumerFlowControlWindowTooSmallError())
+
+	msg := []byte(strings.Repeat("X", 512))
+	const toSend = 100
+	for i := 0; i < toSend; i++ {
+		_, err := js.Publish("FC", msg)
+		require_NoError(t, err)
+	}
+
+	// Do not respond to flow control at first.
+	sub, err := nc.SubscribeSync("d")
+	require_NoError(t, err)
+
+	cfg := &ConsumerConfig{
+		Durable:           "dlc",
+		DeliverSubject:    "d",
+		AckPolicy:         AckNone,
+		Heartbeat:         100 * time.Millisecond,
+		FlowControl:       true,
+		FlowControlWindow: 4096,
+	}
+	o, err := mset.addConsumer(cfg)
+	require_NoError(t, err)
+
+	// We should stall well before sending everything, and heartbeats should tell us.
+	var received int
+	for stalled := false; !stalled; {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		switch {
+		case m.Header.Get(JSConsumerStalled) != _EMPTY_:
+			stalled = true
+		case m.Header.Get("Status") == _EMPTY_:
+			received++
+		}
+	}
+	if received*len(msg) > 4096 {
+		t.Fatalf("Expected to stall within the window, got %d msgs", received)
+	}
+
+	// Now respond to flow control and make sure we get everything.
+	for received < toSend {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		if m.Header.Get("Status") == _EMPTY_ {
+			received++
+		} else if m.Reply != _EMPTY_ {
+			m.Respond(nil)
+		} else if fc := m.Header.Get(JSConsumerStalled); fc != _EMPTY_ {
+			nc.Publish(fc, nil)
+		}
+	}
+
+	o.mu.RLock()
+	pblimit, maxpb := o.pblimit, o.maxpb
+	o.mu.RUnlock()
+	require_True(t, pblimit == 4096)
+	require_True(t, maxpb <= 4096)
+
+	// The window can be updated.
+	ncfg := *cfg
+	ncfg.FlowControlWindow = 64 * 1024
+	_, err = mset.addConsumer(&ncfg)
+	require_NoError(t, err)
+	o.mu.RLock()
+	pblimit = o.pblimit
+	o.mu.RUnlock()
+	require_True(t, pblimit == 64*1024)
+
+	// Make sure the window is persisted with the consumer.
+	nc.Close()
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+	mset, err = s.GlobalAccount().lookupStream("FC")
+	require_NoError(t, err)
+	o = mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	require_True(t, o.config().FlowControlWindow == 64*1024)
+}
+
 func TestJetStreamConsumerPendingCountWithRedeliveries(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
@@ -15549,7 +15976,7 @@ func TestJetStreamConsumerAckSamplingSpecifiedUsingUpdateConsumer(t *testing.T)
 	}
 }
 
-func TestJetStreamConsumerMaxDeliverUpdate(t *testing.T) {
+func TestJetStreamConsumerAckSamplingAckAll(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
 
@@ -15559,10 +15986,70 @@ func TestJetStreamConsumerMaxDeliverUpdate(t *testing.T) {
 	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
 	require_NoError(t, err)
 
-	maxDeliver := 2
 	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
-		Durable:       "ard",
-		AckPolicy:     nats.AckExplicitPolicy,
+		Durable:         "dlc",
+		AckPolicy:       nats.AckAllPolicy,
+		SampleFrequency: "100%",
+	})
+	require_NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err = js.Publish("foo", []byte("Hello"))
+		require_NoError(t, err)
+	}
+
+	msub, err := nc.SubscribeSync(JSMetricConsumerAckPre + ".TEST.dlc")
+	require_NoError(t, err)
+
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	msgs := fetchMsgs(t, sub, 3, time.Second)
+	require_NoError(t, msgs[2].AckSync())
+
+	// Only the acked message is sampled.
+	m, err := msub.NextMsg(time.Second)
+	require_NoError(t, err)
+	var am JSConsumerAckMetric
+	require_NoError(t, json.Unmarshal(m.Data, &am))
+	if am.Stream != "TEST" || am.Consumer != "dlc" || am.ConsumerSeq != 3 || am.StreamSeq != 3 || am.Deliveries != 1 {
+		t.Fatalf("Not a proper ack metric: %+v", am)
+	}
+	require_True(t, am.Delay > 0)
+	checkSubsPending(t, msub, 0)
+
+	// Make sure low frequencies are honored, 1% should not sample 2%.
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("dlc")
+	require_True(t, o != nil)
+	o.mu.Lock()
+	o.sfreq = 1
+	var sampled int
+	for i := 0; i < 100_000; i++ {
+		if o.shouldSample() {
+			sampled++
+		}
+	}
+	o.mu.Unlock()
+	if sampled < 700 || sampled > 1300 {
+		t.Fatalf("Expected about 1000 samples, got %d", sampled)
+	}
+}
+
+func TestJetStreamConsumerMaxDeliverUpdate(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	maxDeliver := 2
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:       "ard",
+		AckPolicy:     nats.AckExplicitPolicy,
 		FilterSubject: "foo",
 		MaxDeliver:    maxDeliver,
 	})
@@ -15876,6 +16363,92 @@ func TestJetStreamBackOffCheckPending(t *testing.T) {
 	}
 }
 
+func TestJetStreamNakDelayWithBackOff(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+
+	sub, err := nc.SubscribeSync("d")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      nats.AckExplicitPolicy,
+		MaxDeliver:     10,
+		BackOff:        []time.Duration{100 * time.Millisecond, 5 * time.Second},
+	})
+	require_NoError(t, err)
+
+	// Let the first delivery expire so we are on the second backoff.
+	natsNexMsg(t, sub, time.Second)
+	m := natsNexMsg(t, sub, time.Second)
+
+	// The delay should be honored and not be stretched to the current backoff.
+	start := time.Now()
+	require_NoError(t, m.NakWithDelay(250*time.Millisecond))
+	natsNexMsg(t, sub, 2*time.Second)
+	if dur := time.Since(start); dur < 200*time.Millisecond || dur > time.Second {
+		t.Fatalf("Expected redelivery after ~250ms, took: %v", dur)
+	}
+}
+
+func TestJetStreamNakDelaySurvivesRestart(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+
+	sub, err := nc.SubscribeSync("d")
+	require_NoError(t, err)
+	require_NoError(t, nc.Flush())
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "d",
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        time.Minute,
+	})
+	require_NoError(t, err)
+
+	m := natsNexMsg(t, sub, time.Second)
+	require_NoError(t, m.NakWithDelay(time.Second))
+	require_NoError(t, nc.Flush())
+	// Make sure the nak was processed.
+	time.Sleep(100 * time.Millisecond)
+
+	nc.Close()
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	nc, _ = jsClientConnect(t, s)
+	defer nc.Close()
+	sub, err = nc.SubscribeSync("d")
+	require_NoError(t, err)
+
+	// Redelivered after the nak delay, not the ack wait.
+	m = natsNexMsg(t, sub, 3*time.Second)
+	md, err := m.Metadata()
+	require_NoError(t, err)
+	require_True(t, md.NumDelivered == 2)
+}
+
 func TestJetStreamCrossAccounts(t *testing.T) {
 	conf := createConfFile(t, []byte(`
 		listen: 127.0.0.1:-1
@@ -17157,6 +17730,263 @@ func TestJetStreamStreamRepublishHeadersOnly(t *testing.T) {
 	}
 }
 
+func TestJetStreamStreamRepublishTimeStamp(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:      "RPC",
+		Subjects:  []string{"foo"},
+		RePublish: &nats.RePublish{Destination: "RP.>"},
+	})
+	require_NoError(t, err)
+
+	sub := natsSubSync(t, nc, "RP.>")
+	natsFlush(t, nc)
+
+	// Without and with headers of its own.
+	_, err = js.Publish("foo", []byte("ok"))
+	require_NoError(t, err)
+	m := nats.NewMsg("foo")
+	m.Header.Set("X-Custom", "yes")
+	m.Data = []byte("ok")
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+
+	for seq := uint64(1); seq <= 2; seq++ {
+		rm := natsNexMsg(t, sub, time.Second)
+		require_True(t, rm.Header.Get(JSSequence) == strconv.FormatUint(seq, 10))
+		ts, err := time.Parse(time.RFC3339Nano, rm.Header.Get(JSTimeStamp))
+		require_NoError(t, err)
+		sm, err := js.GetMsg("RPC", seq)
+		require_NoError(t, err)
+		if !ts.Equal(sm.Time) {
+			t.Fatalf("Expected time stamp %v, got %v", sm.Time, ts)
+		}
+	}
+}
+
+func TestJetStreamStreamSubjectTransform(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	addStream := func(cfg *StreamConfig) *ApiError {
+		t.Helper()
+		req, err := json.Marshal(cfg)
+		require_NoError(t, err)
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return resp.Error
+	}
+
+	// Invalid configurations.
+	for _, cfg := range []*StreamConfig{
+		{Name: "T", Subjects: []string{"orders.*"}, Storage: MemoryStorage,
+			SubjectTransform: &SubjectTransformConfig{Source: "orders.*"}},
+		{Name: "T", Subjects: []string{"orders.*"}, Storage: MemoryStorage,
+			SubjectTransform: &SubjectTransformConfig{Source: "bar.*", Destination: "bar.{{wildcard(1)}}"}},
+		{Name: "T", Subjects: []string{"orders.*"}, Storage: MemoryStorage,
+			SubjectTransform: &SubjectTransformConfig{Source: "orders.*", Destination: "orders.{{wildcard(2)}}"}},
+		{Name: "T", Storage: MemoryStorage, Mirror: &StreamSource{Name: "O"},
+			SubjectTransform: &SubjectTransformConfig{Destination: "orders.>"}},
+		// The destination is not within the stream's subjects.
+		{Name: "T", Subjects: []string{"orders.*"}, Storage: MemoryStorage,
+			SubjectTransform: &SubjectTransformConfig{Source: "orders.*", Destination: "orders.{{partition(10,1)}}.{{wildcard(1)}}"}},
+		{Name: "T", Subjects: []string{"orders.*", "bar"}, Storage: MemoryStorage,
+			SubjectTransform: &SubjectTransformConfig{Source: "orders.*", Destination: "baz.{{wildcard(1)}}"}},
+		{Name: "T", Subjects: []string{"orders.*.*"}, Storage: MemoryStorage,
+			SubjectTransform: &SubjectTransformConfig{Source: "orders.*.*", Destination: "orders.{{split(1,-)}}.{{wildcard(2)}}"}},
+	} {
+		if apiErr := addStream(cfg); apiErr == nil || apiErr.ErrCode != uint16(JSStreamInvalidConfigF) {
+			t.Fatalf("Expected invalid config error for %+v, got %+v", cfg.SubjectTransform, apiErr)
+		}
+	}
+
+	cfg := &StreamConfig{
+		Name:     "O",
+		Subjects: []string{"orders.>"},
+		Storage:  MemoryStorage,
+		SubjectTransform: &SubjectTransformConfig{
+			Source:      "orders.*",
+			Destination: "orders.{{partition(10,1)}}.{{wildcard(1)}}",
+		},
+	}
+	// Checking the configuration does not change the caller's.
+	ncfg, apiErr := s.checkStreamCfg(&StreamConfig{Name: "O", Subjects: []string{"orders.>"}, Storage: MemoryStorage,
+		SubjectTransform: &SubjectTransformConfig{Destination: "orders.>"}}, s.GlobalAccount())
+	require_True(t, apiErr == nil && ncfg.SubjectTransform.Source == fwcs)
+	if apiErr := addStream(cfg); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+
+	tr, err := newTransform("orders.*", "orders.{{partition(10,1)}}.{{wildcard(1)}}")
+	require_NoError(t, err)
+	for i, id := range []string{"a", "b", "c"} {
+		subj := "orders." + id
+		_, err := js.Publish(subj, []byte("ok"))
+		require_NoError(t, err)
+		sm, err := js.GetMsg("O", uint64(i+1))
+		require_NoError(t, err)
+		expected, err := tr.Match(subj)
+		require_NoError(t, err)
+		if sm.Subject != expected {
+			t.Fatalf("Expected stored subject %q, got %q", expected, sm.Subject)
+		}
+	}
+	// Subjects not matching the source are stored as is.
+	_, err = js.Publish("orders.x.y", []byte("ok"))
+	require_NoError(t, err)
+	sm, err := js.GetMsg("O", 4)
+	require_NoError(t, err)
+	require_Equal(t, sm.Subject, "orders.x.y")
+	// Consumers can filter on the transformed subjects.
+	_, err = js.AddConsumer("O", &nats.ConsumerConfig{Durable: "C", FilterSubject: "orders.*.a", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	// The transform can not be changed.
+	cfg.SubjectTransform = &SubjectTransformConfig{Source: "orders.*", Destination: "orders.{{wildcard(1)}}"}
+	req, err := json.Marshal(cfg)
+	require_NoError(t, err)
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "O"), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error == nil || resp.Error.ErrCode != uint16(JSStreamInvalidConfigF) {
+		t.Fatalf("Expected invalid config error, got %+v", resp.Error)
+	}
+}
+
+func TestJetStreamMemoryStreamSpillOver(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	addStream := func(cfg *StreamConfig) *ApiError {
+		t.Helper()
+		req, err := json.Marshal(cfg)
+		require_NoError(t, err)
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return resp.Error
+	}
+
+	// Only memory streams can spill over and need a memory cap.
+	for _, cfg := range []*StreamConfig{
+		{Name: "S", Storage: FileStorage, SpillOver: &SpillOver{MaxMem: 1024}},
+		{Name: "S", Storage: MemoryStorage, SpillOver: &SpillOver{}},
+	} {
+		if apiErr := addStream(cfg); apiErr == nil || apiErr.ErrCode != uint16(JSStreamInvalidConfigF) {
+			t.Fatalf("Expected invalid config error, got %+v", apiErr)
+		}
+	}
+
+	if apiErr := addStream(&StreamConfig{Name: "S", Storage: MemoryStorage, SpillOver: &SpillOver{MaxMem: 10 * 1024}}); apiErr != nil {
+		t.Fatalf("Unexpected error: %+v", apiErr)
+	}
+
+	toSend := 100
+	for i := 0; i < toSend; i++ {
+		_, err := js.Publish("S", []byte(fmt.Sprintf("%04d%s", i, strings.Repeat("Z", 1020))))
+		require_NoError(t, err)
+	}
+
+	mset, err := s.GlobalAccount().lookupStream("S")
+	require_NoError(t, err)
+	ms := mset.store.(*memStore)
+	ms.mu.RLock()
+	inMem, spilled := ms.state.Bytes-ms.spbytes, len(ms.spsz)
+	ms.mu.RUnlock()
+	if inMem > 10*1024 || spilled == 0 {
+		t.Fatalf("Expected messages to spill over, got %d bytes in memory and %d spilled", inMem, spilled)
+	}
+	// Spilled messages count against file storage.
+	ms.mu.RLock()
+	spbytes := ms.spbytes
+	ms.mu.RUnlock()
+	ai, err := js.AccountInfo()
+	require_NoError(t, err)
+	if ai.Memory != inMem || ai.Store != spbytes {
+		t.Fatalf("Expected usage of %d memory and %d store, got %d and %d", inMem, spbytes, ai.Memory, ai.Store)
+	}
+
+	sub, err := js.SubscribeSync("S")
+	require_NoError(t, err)
+	for i := 0; i < toSend; i++ {
+		m, err := sub.NextMsg(time.Second)
+		require_NoError(t, err)
+		if string(m.Data[:4]) != fmt.Sprintf("%04d", i) {
+			t.Fatalf("Expected message %d, got %q", i, m.Data[:4])
+		}
+	}
+
+	sd := filepath.Join(s.JetStreamConfig().StoreDir, globalAccountName, streamsDir, "S", memSpillDir)
+	if _, err := os.Stat(sd); err != nil {
+		t.Fatalf("Expected spill directory: %v", err)
+	}
+	require_NoError(t, js.DeleteStream("S"))
+	if _, err := os.Stat(sd); !os.IsNotExist(err) {
+		t.Fatalf("Expected spill directory to be removed, got %v", err)
+	}
+	ai, err = js.AccountInfo()
+	require_NoError(t, err)
+	if ai.Memory != 0 || ai.Store != 0 {
+		t.Fatalf("Expected no usage, got %d memory and %d store", ai.Memory, ai.Store)
+	}
+}
+
+func TestJetStreamMemoryStreamSpillOverEncrypted(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {key: "s3cr3t", store_dir: %q}
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{Name: "S", Storage: MemoryStorage, SpillOver: &SpillOver{MaxMem: 1024}})
+	for i := 0; i < 20; i++ {
+		_, err := js.Publish("S", []byte(strings.Repeat("PLAINTEXT", 20)))
+		require_NoError(t, err)
+	}
+
+	sd := filepath.Join(s.JetStreamConfig().StoreDir, globalAccountName, streamsDir, "S", memSpillDir)
+	var found int
+	err := filepath.Walk(sd, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() || filepath.Ext(path) != ".blk" {
+			return err
+		}
+		found++
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(buf, []byte("PLAINTEXT")) {
+			return fmt.Errorf("spilled messages not encrypted in %q", path)
+		}
+		return nil
+	})
+	require_NoError(t, err)
+	require_True(t, found > 0)
+
+	m, err := js.GetMsg("S", 1)
+	require_NoError(t, err)
+	require_True(t, string(m.Data) == strings.Repeat("PLAINTEXT", 20))
+}
+
 func TestJetStreamConsumerDeliverNewNotConsumingBeforeRestart(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
@@ -17305,29 +18135,178 @@ func TestJetStreamMsgGetNoAdvisory(t *testing.T) {
 	checkSubsPending(t, sub, 0)
 }
 
-func TestJetStreamDirectMsgGet(t *testing.T) {
+func TestJetStreamMsgGetByStartTime(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
 
-	nc, _ := jsClientConnect(t, s)
+	nc, js := jsClientConnect(t, s)
 	defer nc.Close()
 
-	// Do by hand for now.
-	cfg := &StreamConfig{
-		Name:        "DSMG",
-		Storage:     MemoryStorage,
-		Subjects:    []string{"foo", "bar", "baz"},
-		MaxMsgsPer:  1,
-		AllowDirect: true,
-	}
-	addStream(t, nc, cfg)
+	for _, st := range []nats.StorageType{nats.FileStorage, nats.MemoryStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo.*"}, Storage: st, AllowDirect: true})
+			require_NoError(t, err)
+			defer js.DeleteStream("TEST")
 
-	sendStreamMsg(t, nc, "foo", "foo")
-	sendStreamMsg(t, nc, "bar", "bar")
-	sendStreamMsg(t, nc, "baz", "baz")
+			sendStreamMsg(t, nc, "foo.a", "1")
+			sendStreamMsg(t, nc, "foo.b", "2")
+			time.Sleep(50 * time.Millisecond)
+			start := time.Now()
+			sendStreamMsg(t, nc, "foo.b", "3")
+			sendStreamMsg(t, nc, "foo.a", "4")
 
-	getSubj := fmt.Sprintf(JSDirectMsgGetT, "DSMG")
-	getMsg := func(req *JSApiMsgGetRequest) *nats.Msg {
+			getMsg := func(req *JSApiMsgGetRequest) *JSApiMsgGetResponse {
+				t.Helper()
+				b, _ := json.Marshal(req)
+				m, err := nc.Request(fmt.Sprintf(JSApiMsgGetT, "TEST"), b, time.Second)
+				require_NoError(t, err)
+				var resp JSApiMsgGetResponse
+				require_NoError(t, json.Unmarshal(m.Data, &resp))
+				return &resp
+			}
+
+			resp := getMsg(&JSApiMsgGetRequest{StartTime: &start})
+			require_True(t, resp.Error == nil)
+			require_True(t, resp.Message.Sequence == 3)
+
+			// Combined with a subject filter.
+			resp = getMsg(&JSApiMsgGetRequest{StartTime: &start, NextFor: "foo.a"})
+			require_True(t, resp.Error == nil)
+			require_True(t, resp.Message.Sequence == 4)
+
+			// Nothing after the last message.
+			after := time.Now().Add(time.Second)
+			resp = getMsg(&JSApiMsgGetRequest{StartTime: &after})
+			require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSNoMessageFoundErr))
+
+			// Can not be combined with a sequence or last by subject.
+			resp = getMsg(&JSApiMsgGetRequest{StartTime: &start, Seq: 1})
+			require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSBadRequestErr))
+			resp = getMsg(&JSApiMsgGetRequest{StartTime: &start, LastFor: "foo.a"})
+			require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSBadRequestErr))
+
+			// Direct gets support it too.
+			b, _ := json.Marshal(&JSApiMsgGetRequest{StartTime: &start, NextFor: "foo.b"})
+			m, err := nc.Request(fmt.Sprintf(JSDirectMsgGetT, "TEST"), b, time.Second)
+			require_NoError(t, err)
+			require_True(t, m.Header.Get(JSSequence) == "3")
+			require_True(t, string(m.Data) == "3")
+		})
+	}
+}
+
+func TestJetStreamDirectGetBatch(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, limits: {max_request_batch: 4}}
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "KV", Subjects: []string{"kv.*"}, AllowDirect: true})
+	require_NoError(t, err)
+	// kv.a gets 1, 3, 5, 7, 9 and kv.b the even ones.
+	for i := 1; i <= 10; i++ {
+		subj := "kv.a"
+		if i%2 == 0 {
+			subj = "kv.b"
+		}
+		sendStreamMsg(t, nc, subj, strconv.Itoa(i))
+	}
+
+	getBatch := func(req *JSApiMsgGetRequest) ([]*nats.Msg, *nats.Msg) {
+		t.Helper()
+		inbox := nats.NewInbox()
+		sub := natsSubSync(t, nc, inbox)
+		defer sub.Unsubscribe()
+		b, _ := json.Marshal(req)
+		require_NoError(t, nc.PublishRequest(fmt.Sprintf(JSDirectMsgGetT, "KV"), inbox, b))
+		var msgs []*nats.Msg
+		for {
+			m := natsNexMsg(t, sub, time.Second)
+			if len(m.Data) == 0 && m.Header.Get("Status") != _EMPTY_ {
+				return msgs, m
+			}
+			msgs = append(msgs, m)
+		}
+	}
+
+	msgs, eob := getBatch(&JSApiMsgGetRequest{NextFor: "kv.a", Seq: 2, Batch: 3})
+	require_True(t, len(msgs) == 3)
+	for i, m := range msgs {
+		require_True(t, m.Header.Get(JSSequence) == strconv.Itoa(3+2*i))
+		require_True(t, m.Header.Get(JSNumPending) == strconv.Itoa(3-i))
+		require_True(t, m.Header.Get(JSSubject) == "kv.a")
+	}
+	require_True(t, eob.Header.Get("Status") == "204")
+	require_True(t, eob.Header.Get(JSLastSequence) == "7")
+	require_True(t, eob.Header.Get(JSNumPending) == "1")
+
+	// Continue from where we left off after more were stored, asking for more than there is.
+	sendStreamMsg(t, nc, "kv.a", "11")
+	msgs, eob = getBatch(&JSApiMsgGetRequest{NextFor: "kv.a", Seq: 8, Batch: 4})
+	require_True(t, len(msgs) == 2)
+	require_True(t, string(msgs[0].Data) == "9")
+	require_True(t, string(msgs[1].Data) == "11")
+	require_True(t, msgs[1].Header.Get(JSNumPending) == "0")
+	require_True(t, eob.Header.Get(JSNumPending) == "0")
+
+	// Batches are capped by the server's max request batch.
+	msgs, eob = getBatch(&JSApiMsgGetRequest{Seq: 1, Batch: 100})
+	require_True(t, len(msgs) == 4)
+	require_True(t, eob.Header.Get(JSLastSequence) == "4")
+	require_True(t, eob.Header.Get(JSNumPending) == "7")
+
+	// Max bytes stops the batch, but we always get at least one message.
+	msgs, eob = getBatch(&JSApiMsgGetRequest{Batch: 10, MaxBytes: 1})
+	require_True(t, len(msgs) == 1)
+	require_True(t, eob.Header.Get(JSLastSequence) == "1")
+	require_True(t, eob.Header.Get(JSNumPending) == "10")
+
+	// Nothing to return.
+	msgs, eob = getBatch(&JSApiMsgGetRequest{NextFor: "kv.c", Batch: 10})
+	require_True(t, len(msgs) == 0)
+	require_True(t, eob.Header.Get("Status") == "404")
+
+	// Batches can not be combined with last by subject.
+	_, eob = getBatch(&JSApiMsgGetRequest{LastFor: "kv.a", Batch: 10})
+	require_True(t, eob.Header.Get("Status") == "408")
+
+	// And are not supported by the regular get.
+	b, _ := json.Marshal(&JSApiMsgGetRequest{Batch: 2})
+	m, err := nc.Request(fmt.Sprintf(JSApiMsgGetT, "KV"), b, time.Second)
+	require_NoError(t, err)
+	var resp JSApiMsgGetResponse
+	require_NoError(t, json.Unmarshal(m.Data, &resp))
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSBadRequestErr))
+}
+
+func TestJetStreamDirectMsgGet(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// Do by hand for now.
+	cfg := &StreamConfig{
+		Name:        "DSMG",
+		Storage:     MemoryStorage,
+		Subjects:    []string{"foo", "bar", "baz"},
+		MaxMsgsPer:  1,
+		AllowDirect: true,
+	}
+	addStream(t, nc, cfg)
+
+	sendStreamMsg(t, nc, "foo", "foo")
+	sendStreamMsg(t, nc, "bar", "bar")
+	sendStreamMsg(t, nc, "baz", "baz")
+
+	getSubj := fmt.Sprintf(JSDirectMsgGetT, "DSMG")
+	getMsg := func(req *JSApiMsgGetRequest) *nats.Msg {
 		var b []byte
 		var err error
 		if req != nil {
@@ -18061,7 +19040,73 @@ func TestJetStreamMirrorUpdatesNotSupported(t *testing.T) {
 	_, err = js.AddStream(cfg)
 	require_NoError(t, err)
 
+	_, err = js.AddStream(&nats.StreamConfig{Name: "OTHER"})
+	require_NoError(t, err)
+
+	cfg.Mirror = &nats.StreamSource{Name: "OTHER"}
+	_, err = js.UpdateStream(cfg)
+	require_Error(t, err, NewJSStreamMirrorNotUpdatableError())
+}
+
+func TestJetStreamMirrorPromotion(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "SOURCE", Subjects: []string{"foo"}, AllowDirect: true})
+	require_NoError(t, err)
+
+	cfg := &nats.StreamConfig{
+		Name:   "M",
+		Mirror: &nats.StreamSource{Name: "SOURCE"},
+	}
+	_, err = js.AddStream(cfg)
+	require_NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err = js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		si, err := js.StreamInfo("M")
+		if err != nil {
+			return err
+		}
+		if si.State.Msgs != 10 {
+			return fmt.Errorf("expected 10 msgs, got %d", si.State.Msgs)
+		}
+		return nil
+	})
+
+	// Remove the mirror and take over the subjects.
+	_, err = js.UpdateStream(&nats.StreamConfig{Name: "SOURCE", Subjects: []string{"old"}, AllowDirect: true})
+	require_NoError(t, err)
 	cfg.Mirror = nil
+	cfg.Subjects = []string{"foo"}
+	si, err := js.UpdateStream(cfg)
+	require_NoError(t, err)
+	require_True(t, si.Config.Mirror == nil)
+	require_True(t, si.Mirror == nil)
+
+	mset, err := s.GlobalAccount().lookupStream("M")
+	require_NoError(t, err)
+	mset.mu.RLock()
+	mirror, md := mset.mirror, mset.cfg.MirrorDirect
+	mset.mu.RUnlock()
+	require_True(t, mirror == nil)
+	require_False(t, md)
+
+	// Sequences continue from the mirrored messages.
+	pa, err := js.Publish("foo", []byte("NEW"))
+	require_NoError(t, err)
+	require_True(t, pa.Stream == "M")
+	require_True(t, pa.Sequence == 11)
+
+	// Can not become a mirror again.
+	cfg.Mirror = &nats.StreamSource{Name: "SOURCE"}
+	cfg.Subjects = nil
 	_, err = js.UpdateStream(cfg)
 	require_Error(t, err, NewJSStreamMirrorNotUpdatableError())
 }
@@ -18285,6 +19330,87 @@ func TestJetStreamServerCipherConvert(t *testing.T) {
 	}
 }
 
+func TestJetStreamServerKeyRotation(t *testing.T) {
+	tmpl := `
+		listen: 127.0.0.1:-1
+		jetstream: {key: %s, %s store_dir: '%s'}
+	`
+	storeDir := t.TempDir()
+
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, "s3cr3t", _EMPTY_, storeDir)))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	for i := 0; i < 1000; i++ {
+		msg := []byte(fmt.Sprintf("TOP SECRET DOCUMENT #%d", i+1))
+		_, err := js.Publish("foo", msg)
+		require_NoError(t, err)
+	}
+	sub, err := js.PullSubscribe("foo", "dlc")
+	require_NoError(t, err)
+	for _, m := range fetchMsgs(t, sub, 100, 5*time.Second) {
+		m.AckSync()
+	}
+	nc.Close()
+	s.Shutdown()
+
+	// Restart with a new key, the previous one is only used to re-encrypt what we have.
+	conf = createConfFile(t, []byte(fmt.Sprintf(tmpl, "n3wk3y", "prev_key: s3cr3t,", storeDir)))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	fs := mset.store.(*fileStore)
+	checkFor(t, 10*time.Second, 100*time.Millisecond, func() error {
+		if n := fs.reKeyPending(); n > 0 {
+			return fmt.Errorf("still %d blocks to re-encrypt", n)
+		}
+		if _, err := os.Stat(filepath.Join(fs.fcfg.StoreDir, reKeyProgressFile)); err == nil {
+			return fmt.Errorf("re-key progress file still present")
+		}
+		return nil
+	})
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+	_, err = js.Publish("foo", []byte("NEW SECRET"))
+	require_NoError(t, err)
+	nc.Close()
+	s.Shutdown()
+
+	// Now everything should be readable without the previous key.
+	conf = createConfFile(t, []byte(fmt.Sprintf(tmpl, "n3wk3y", _EMPTY_, storeDir)))
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 1001)
+
+	for _, seq := range []uint64{1, 500, 1000} {
+		m, err := js.GetMsg("TEST", seq)
+		require_NoError(t, err)
+		require_True(t, string(m.Data) == fmt.Sprintf("TOP SECRET DOCUMENT #%d", seq))
+	}
+	m, err := js.GetMsg("TEST", 1001)
+	require_NoError(t, err)
+	require_True(t, string(m.Data) == "NEW SECRET")
+
+	ci, err := js.ConsumerInfo("TEST", "dlc")
+	require_NoError(t, err)
+	require_True(t, ci.AckFloor.Stream == 100)
+}
+
 func TestJetStreamConsumerDeliverNewMaxRedeliveriesAndServerRestart(t *testing.T) {
 	s := RunBasicJetStreamServer(t)
 	defer s.Shutdown()
@@ -19294,3 +20420,2537 @@ func TestJetStreamMsgBlkFailOnKernelFault(t *testing.T) {
 			friendlyBytes(si.Config.MaxBytes), friendlyBytes(int64(si.State.Bytes)))
 	}
 }
+
+func TestJetStreamPushConsumerQueueMemberCloseRedelivers(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "dlc",
+		DeliverSubject: "dsubj",
+		DeliverGroup:   "dg",
+		AckPolicy:      nats.AckExplicitPolicy,
+		AckWait:        time.Minute,
+	})
+	require_NoError(t, err)
+
+	nc1, err := nats.Connect(s.ClientURL())
+	require_NoError(t, err)
+	defer nc1.Close()
+	sub1, err := nc1.QueueSubscribeSync("dsubj", "dg")
+	require_NoError(t, err)
+	require_NoError(t, nc1.Flush())
+
+	nc2, err := nats.Connect(s.ClientURL())
+	require_NoError(t, err)
+	defer nc2.Close()
+	sub2, err := nc2.QueueSubscribeSync("dsubj", "dg")
+	require_NoError(t, err)
+	require_NoError(t, nc2.Flush())
+
+	toSend := 20
+	for i := 0; i < toSend; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	// Wait for everything to be delivered between our two members.
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		n1, _, _ := sub1.Pending()
+		n2, _, _ := sub2.Pending()
+		if n1+n2 != toSend {
+			return fmt.Errorf("Expected %d delivered, got %d", toSend, n1+n2)
+		}
+		return nil
+	})
+	n1, _, _ := sub1.Pending()
+	if n1 == 0 {
+		t.Fatalf("Expected first member to have received messages")
+	}
+
+	// Second member acks everything it has.
+	seen := make(map[uint64]struct{})
+	for n2, _, _ := sub2.Pending(); n2 > 0; n2-- {
+		m, err := sub2.NextMsg(time.Second)
+		require_NoError(t, err)
+		meta, err := m.Metadata()
+		require_NoError(t, err)
+		seen[meta.Sequence.Stream] = struct{}{}
+		m.AckSync()
+	}
+
+	// Now close the first member without acking anything. The second member
+	// should receive those messages well before AckWait.
+	nc1.Close()
+	for i := 0; i < n1; i++ {
+		m, err := sub2.NextMsg(time.Second)
+		require_NoError(t, err)
+		meta, err := m.Metadata()
+		require_NoError(t, err)
+		if meta.NumDelivered != 2 {
+			t.Fatalf("Expected a redelivery, got %d deliveries", meta.NumDelivered)
+		}
+		seen[meta.Sequence.Stream] = struct{}{}
+		m.AckSync()
+	}
+	if len(seen) != toSend {
+		t.Fatalf("Expected to have seen all %d messages, got %d", toSend, len(seen))
+	}
+}
+
+func TestJetStreamStreamIntakeSpillToDisk(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+
+	// Force everything to spill to disk.
+	old := streamIntakeMaxBytes
+	streamIntakeMaxBytes = 1
+	defer func() { streamIntakeMaxBytes = old }()
+
+	toSend := 1000
+	for i := 0; i < toSend; i++ {
+		mset.queueInboundMsg("foo", _EMPTY_, nil, []byte(strconv.Itoa(i)))
+	}
+
+	checkFor(t, 5*time.Second, 15*time.Millisecond, func() error {
+		if state := mset.state(); state.Msgs != uint64(toSend) {
+			return fmt.Errorf("Expected %d msgs, got %d", toSend, state.Msgs)
+		}
+		return nil
+	})
+
+	// Make sure ordering was preserved.
+	for i := 0; i < toSend; i++ {
+		sm, err := mset.store.LoadMsg(uint64(i+1), nil)
+		require_NoError(t, err)
+		if string(sm.msg) != strconv.Itoa(i) {
+			t.Fatalf("Expected msg %d, got %q", i, sm.msg)
+		}
+	}
+
+	ii := mset.intakeInfo()
+	if ii == nil {
+		t.Fatalf("Expected intake info")
+	}
+	if ii.SpilledMsgs != uint64(toSend) {
+		t.Fatalf("Expected %d spilled msgs, got %d", toSend, ii.SpilledMsgs)
+	}
+	if ii.SpooledBytes != 0 || ii.PendingBytes != 0 {
+		t.Fatalf("Expected intake to be drained, got %+v", ii)
+	}
+	if _, err := os.Stat(mset.spool.fn); !os.IsNotExist(err) {
+		t.Fatalf("Expected spool file to be removed, got %v", err)
+	}
+}
+
+func TestJetStreamStreamIntakeSpillFailure(t *testing.T) {
+	sp := newIntakeSpool(filepath.Join(t.TempDir(), intakeSpoolFile))
+	defer sp.close()
+
+	spilled, err := sp.spill(true, "foo", _EMPTY_, nil, []byte("0"))
+	require_True(t, spilled && err == nil)
+
+	// Make writes fail while keeping what is on disk readable.
+	sp.mu.Lock()
+	fd, err := os.Open(sp.fn)
+	require_NoError(t, err)
+	wfd := sp.fd
+	sp.fd = fd
+	sp.mu.Unlock()
+	wfd.Close()
+
+	// New messages are rejected, not taken ahead of the spilled one.
+	for i := 1; i <= 2; i++ {
+		spilled, err = sp.spill(false, "foo", _EMPTY_, nil, []byte(strconv.Itoa(i)))
+		require_True(t, !spilled && err != nil)
+	}
+
+	ims, err := sp.read()
+	require_NoError(t, err)
+	require_True(t, len(ims) == 1)
+	require_Equal(t, string(ims[0].msg), "0")
+
+	// Once drained we take in messages again.
+	spilled, err = sp.spill(false, "foo", _EMPTY_, nil, []byte("3"))
+	require_True(t, !spilled && err == nil)
+	if _, err := os.Stat(sp.fn); !os.IsNotExist(err) {
+		t.Fatalf("Expected spool file to be removed, got %v", err)
+	}
+}
+
+func TestJetStreamStreamIntakeSpoolReadFailure(t *testing.T) {
+	sp := newIntakeSpool(filepath.Join(t.TempDir(), intakeSpoolFile))
+	defer sp.close()
+
+	for i := 0; i < 3; i++ {
+		spilled, err := sp.spill(true, "foo", _EMPTY_, nil, []byte(strconv.Itoa(i)))
+		require_True(t, spilled && err == nil)
+	}
+	// Drain the kick from the spills.
+	<-sp.ch
+
+	// Make reads fail.
+	sp.mu.Lock()
+	fd, err := os.OpenFile(sp.fn, os.O_WRONLY, defaultFilePerms)
+	require_NoError(t, err)
+	rfd := sp.fd
+	sp.fd = fd
+	sp.mu.Unlock()
+	rfd.Close()
+
+	ims, err := sp.read()
+	require_Error(t, err)
+	require_True(t, len(ims) == 0)
+
+	// What is left is dropped and the flusher is not kicked again.
+	select {
+	case <-sp.ch:
+		t.Fatalf("Expected the flusher to not be kicked again")
+	default:
+	}
+	require_True(t, sp.pending() == 0)
+	if _, err := os.Stat(sp.fn); !os.IsNotExist(err) {
+		t.Fatalf("Expected spool file to be removed, got %v", err)
+	}
+
+	// We take in messages again.
+	spilled, err := sp.spill(false, "foo", _EMPTY_, nil, []byte("3"))
+	require_True(t, !spilled && err == nil)
+
+	// A stream that lost messages from its spool is reported as failed.
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	mset, err := s.GlobalAccount().addStream(&StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	require_True(t, s.healthz(nil).Error == _EMPTY_)
+
+	mset.intakeFailed(errors.New("read failed"))
+	require_True(t, strings.Contains(s.healthz(nil).Error, "read failed"))
+}
+
+func TestJetStreamAccountDiskUsage(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64MB, max_file_store: 64MB, store_dir: %q}
+		accounts: {
+			A: {
+				jetstream: {max_mem: 1MB, max_store: 4MB}
+				users: [ {user: ua, password: pwd} ]
+			},
+		}
+	`, t.TempDir())))
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	acc, err := s.LookupAccount("A")
+	require_NoError(t, err)
+	jsa := acc.js
+	if max := jsa.maxStore(); max != 4*1024*1024 {
+		t.Fatalf("Expected max store of 4MB, got %d", max)
+	}
+	if used := jsa.diskUsage(); used != 0 {
+		t.Fatalf("Expected no disk usage, got %d", used)
+	}
+
+	nc := clientConnectToServerWithUP(t, opts, "ua", "pwd")
+	defer nc.Close()
+	js, err := nc.JetStream()
+	require_NoError(t, err)
+
+	_, err = js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, MaxBytes: 1024 * 1024})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", bytes.Repeat([]byte("Z"), 1024))
+		require_NoError(t, err)
+	}
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+
+	// Everything for the account lives under its own directory.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		if used := jsa.diskUsage(); used < int64(si.State.Bytes) {
+			return fmt.Errorf("Expected disk usage to be at least %d, got %d", si.State.Bytes, used)
+		}
+		return nil
+	})
+}
+
+func TestJetStreamAPIQueueFairness(t *testing.T) {
+	q := newJSAPIQueue(8)
+	a, b, c := NewAccount("A"), NewAccount("B"), NewAccount("C")
+	for i := 0; i < 5; i++ {
+		if !q.push(&jsAPIRoutedReq{acc: a, subject: fmt.Sprintf("A.%d", i)}) {
+			t.Fatalf("Unexpected drop")
+		}
+	}
+	q.push(&jsAPIRoutedReq{acc: b, subject: "B.0"})
+	q.push(&jsAPIRoutedReq{acc: c, subject: "C.0"})
+	q.push(&jsAPIRoutedReq{acc: b, subject: "B.1"})
+	// We are at our limit.
+	if q.push(&jsAPIRoutedReq{acc: c, subject: "C.1"}) {
+		t.Fatalf("Expected request to be dropped")
+	}
+	if n := q.len(); n != 8 {
+		t.Fatalf("Expected 8 pending, got %d", n)
+	}
+
+	var order []string
+	for r := q.pop(); r != nil; r = q.pop() {
+		order = append(order, r.subject)
+	}
+	expected := []string{"A.0", "B.0", "C.0", "A.1", "B.1", "A.2", "A.3", "A.4"}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expected order %v, got %v", expected, order)
+	}
+}
+
+func TestJetStreamAPIQueuePriority(t *testing.T) {
+	q := newJSAPIQueue(0)
+	push := func(acc, subject string) {
+		t.Helper()
+		if !q.push(&jsAPIRoutedReq{reqAcc: acc, subject: subject, low: isInfoAPIRequest(subject)}) {
+			t.Fatalf("Unexpected drop")
+		}
+	}
+	// A floods with consumer info requests before anyone else gets in.
+	for i := 0; i < 3; i++ {
+		push("A", fmt.Sprintf(JSApiConsumerInfoT, "S", "C"))
+	}
+	push("A", fmt.Sprintf(JSApiStreamCreateT, "S1"))
+	push("B", fmt.Sprintf(JSApiStreamInfoT, "S"))
+	push("B", fmt.Sprintf(JSApiStreamCreateT, "S2"))
+	push("A", JSApiAccountInfo)
+
+	var order []string
+	for r := q.pop(); r != nil; r = q.pop() {
+		order = append(order, r.reqAcc+" "+r.subject)
+	}
+	expected := []string{
+		"A $JS.API.STREAM.CREATE.S1",
+		"B $JS.API.STREAM.CREATE.S2",
+		"A $JS.API.CONSUMER.INFO.S.C",
+		"B $JS.API.STREAM.INFO.S",
+		"A $JS.API.CONSUMER.INFO.S.C",
+		"A $JS.API.CONSUMER.INFO.S.C",
+		"A $JS.API.INFO",
+	}
+	if !reflect.DeepEqual(order, expected) {
+		t.Fatalf("Expected order %v, got %v", expected, order)
+	}
+}
+
+func TestJetStreamAPIRateLimit(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, api_rate_limit: 5}
+		accounts: {
+			A: { jetstream: enabled, users: [ {user: a, password: a} ] },
+			B: { jetstream: enabled, users: [ {user: b, password: b} ] },
+		}
+	`, t.TempDir())))
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	require_True(t, opts.JetStreamAPIRateLimit == 5)
+
+	ncA, jsA := jsClientConnect(t, s, nats.UserInfo("a", "a"))
+	defer ncA.Close()
+	ncB, jsB := jsClientConnect(t, s, nats.UserInfo("b", "b"))
+	defer ncB.Close()
+
+	// Use up the burst of account A and then some.
+	var limited int
+	for i := 0; i < 20; i++ {
+		resp, err := ncA.Request(JSApiAccountInfo, nil, time.Second)
+		require_NoError(t, err)
+		var info JSApiAccountInfoResponse
+		require_NoError(t, json.Unmarshal(resp.Data, &info))
+		if info.Error != nil {
+			require_True(t, info.Error.ErrCode == uint16(JSAPIRateLimitExceededErr))
+			limited++
+		}
+	}
+	if limited == 0 {
+		t.Fatalf("Expected some requests to be rate limited")
+	}
+
+	// Account B is not affected.
+	_, err := jsB.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	// And A can make requests again once the bucket refills.
+	time.Sleep(250 * time.Millisecond)
+	_, err = jsA.AccountInfo()
+	require_NoError(t, err)
+
+	// Accounts that have gone idle are forgotten.
+	l := s.jsAPILimiter
+	l.mu.Lock()
+	l.swept = time.Now().Add(-jsAPILimiterSweepInterval)
+	for _, al := range l.accs {
+		al.last = time.Now().Add(-time.Second)
+	}
+	l.mu.Unlock()
+	_, err = jsB.AccountInfo()
+	require_NoError(t, err)
+	l.mu.Lock()
+	_, okA := l.accs["A"]
+	_, okB := l.accs["B"]
+	l.mu.Unlock()
+	require_True(t, !okA && okB)
+
+	// The limit can be lifted with a reload.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, api_rate_limit: 0}
+		accounts: {
+			A: { jetstream: enabled, users: [ {user: a, password: a} ] },
+			B: { jetstream: enabled, users: [ {user: b, password: b} ] },
+		}
+	`, opts.StoreDir))
+	for i := 0; i < 20; i++ {
+		_, err = jsA.AccountInfo()
+		require_NoError(t, err)
+	}
+}
+
+func TestJetStreamBackgroundIOPerServer(t *testing.T) {
+	tmpl := `
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, max_background_io: %s}
+	`
+	conf := createConfFile(t, []byte(fmt.Sprintf(tmpl, t.TempDir(), "1MB")))
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	require_True(t, opts.JetStreamBackgroundIO == 1024*1024)
+
+	// A second server in the same process is not throttled.
+	s2 := RunBasicJetStreamServer(t)
+	defer s2.Shutdown()
+
+	bgIO := func(s *Server) *ioThrottle {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		fs := mset.store.(*fileStore)
+		require_True(t, fs.fcfg.bgIO == s.getJetStream().bgIO)
+		// Re-encryption is throttled per server as well.
+		require_True(t, fs.fcfg.reKeyIO != nil && fs.fcfg.reKeyIO == s.getJetStream().reKeyIO)
+		return fs.fcfg.bgIO
+	}
+	limited := func(t *ioThrottle) bool {
+		t.mu.RLock()
+		defer t.mu.RUnlock()
+		return t.rl != nil
+	}
+	for _, srv := range []*Server{s, s2} {
+		nc, js := jsClientConnect(t, srv)
+		defer nc.Close()
+		_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+		require_NoError(t, err)
+	}
+	require_True(t, limited(bgIO(s)))
+	require_False(t, limited(bgIO(s2)))
+
+	// The limit can be changed with a reload.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, opts.StoreDir, "0"))
+	require_False(t, limited(bgIO(s)))
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, opts.StoreDir, "2MB"))
+	require_True(t, limited(bgIO(s)))
+}
+
+func TestJetStreamMaxOpenFilesPerServer(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, max_open_files: 100}
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	// A second server in the same process is not limited.
+	s2 := RunBasicJetStreamServer(t)
+	defer s2.Shutdown()
+
+	for _, srv := range []*Server{s, s2} {
+		nc, js := jsClientConnect(t, srv)
+		defer nc.Close()
+		_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+		require_NoError(t, err)
+		_, err = js.Publish("foo", []byte("ok"))
+		require_NoError(t, err)
+	}
+	blkFDs := func(s *Server) *fdManager {
+		t.Helper()
+		mset, err := s.GlobalAccount().lookupStream("TEST")
+		require_NoError(t, err)
+		fs := mset.store.(*fileStore)
+		require_True(t, fs.fcfg.blkFDs == s.getJetStream().blkFDs)
+		return fs.fcfg.blkFDs
+	}
+	require_True(t, blkFDs(s) != nil && blkFDs(s).open() > 0)
+	require_True(t, blkFDs(s2) == nil)
+}
+
+func TestJetStreamAPIConcurrency(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, api_concurrency: 2, api_queue_limit: 100}
+	`, t.TempDir())))
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	if opts.JetStreamAPIWorkers != 2 || opts.JetStreamAPIQueueMax != 100 {
+		t.Fatalf("Unexpected api options: %d/%d", opts.JetStreamAPIWorkers, opts.JetStreamAPIQueueMax)
+	}
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// All requests are now processed by the workers.
+	var wg sync.WaitGroup
+	errCh := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, err := js.AddStream(&nats.StreamConfig{Name: fmt.Sprintf("S%d", i), Subjects: []string{fmt.Sprintf("s.%d", i)}})
+			if err != nil {
+				errCh <- err
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if n := s.GlobalAccount().numStreams(); n != 10 {
+		t.Fatalf("Expected 10 streams, got %d", n)
+	}
+
+	// When the queue is full we are told right away instead of timing out.
+	q := s.jsAPIRoutedReqs
+	q.mu.Lock()
+	q.pending = q.limit
+	q.mu.Unlock()
+	_, err := js.StreamInfo("S1")
+	require_Error(t, err)
+	require_Contains(t, err.Error(), "queue limit reached")
+
+	q.mu.Lock()
+	q.pending = 0
+	q.mu.Unlock()
+	_, err = js.StreamInfo("S1")
+	require_NoError(t, err)
+}
+
+func TestJetStreamStreamInfoSubjectsFirstLast(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	getDetail := func(t *testing.T, filter string) map[string]SimpleState {
+		t.Helper()
+		req, err := json.Marshal(&JSApiStreamInfoRequest{SubjectsFilter: filter, SubjectsDetail: true})
+		require_NoError(t, err)
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), req, time.Second)
+		require_NoError(t, err)
+		var si StreamInfo
+		require_NoError(t, json.Unmarshal(resp.Data, &si))
+		return si.State.SubjectsDetail
+	}
+
+	for _, st := range []nats.StorageType{nats.FileStorage, nats.MemoryStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"kv.>"}, Storage: st})
+			require_NoError(t, err)
+			defer js.DeleteStream("TEST")
+
+			// kv.a gets 1, 3, 5 and kv.b gets 2, 4, 6.
+			for i := 0; i < 3; i++ {
+				_, err = js.Publish("kv.a", []byte("ok"))
+				require_NoError(t, err)
+				_, err = js.Publish("kv.b", []byte("ok"))
+				require_NoError(t, err)
+			}
+			// Remove the first and last of kv.b.
+			require_NoError(t, js.DeleteMsg("TEST", 2))
+			require_NoError(t, js.DeleteMsg("TEST", 6))
+
+			expected := map[string]SimpleState{
+				"kv.a": {Msgs: 3, First: 1, Last: 5},
+				"kv.b": {Msgs: 1, First: 4, Last: 4},
+			}
+			if sd := getDetail(t, "kv.*"); !reflect.DeepEqual(sd, expected) {
+				t.Fatalf("Expected %+v, got %+v", expected, sd)
+			}
+			if sd := getDetail(t, "kv.b"); !reflect.DeepEqual(sd, map[string]SimpleState{"kv.b": expected["kv.b"]}) {
+				t.Fatalf("Unexpected detail for kv.b: %+v", sd)
+			}
+		})
+	}
+}
+
+func TestJetStreamRestoreResumeWithOffsets(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 500; i++ {
+		_, err := js.Publish("foo", []byte("Hello World"))
+		require_NoError(t, err)
+	}
+
+	// Grab a snapshot.
+	sreq := &JSApiStreamSnapshotRequest{DeliverSubject: nats.NewInbox(), ChunkSize: 1024}
+	req, _ := json.Marshal(sreq)
+	var snapshot []byte
+	done := make(chan bool)
+	sub, _ := nc.Subscribe(sreq.DeliverSubject, func(m *nats.Msg) {
+		if len(m.Data) == 0 {
+			done <- true
+			return
+		}
+		snapshot = append(snapshot, m.Data...)
+		m.Respond(nil)
+	})
+	defer sub.Unsubscribe()
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamSnapshotT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamSnapshotResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive our snapshot in time")
+	}
+	require_NoError(t, js.DeleteStream("TEST"))
+
+	req, _ = json.Marshal(&JSApiStreamRestoreRequest{Config: *resp.Config, State: *resp.State})
+	rmsg, err = nc.Request(fmt.Sprintf(JSApiStreamRestoreT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var rresp JSApiStreamRestoreResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &rresp))
+	if rresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", rresp.Error)
+	}
+
+	sendChunk := func(offset int, data []byte) *nats.Msg {
+		t.Helper()
+		m := nats.NewMsg(rresp.DeliverSubject)
+		m.Header.Set(JSRestoreOffset, strconv.Itoa(offset))
+		m.Data = data
+		rmsg, err := nc.RequestMsg(m, time.Second)
+		require_NoError(t, err)
+		return rmsg
+	}
+	checkStaged := func(rmsg *nats.Msg, staged int) {
+		t.Helper()
+		if v := rmsg.Header.Get(JSRestoreOffset); v != strconv.Itoa(staged) {
+			t.Fatalf("Expected staged offset %d, got %q", staged, v)
+		}
+	}
+
+	const chunkSize = 512
+	checkStaged(sendChunk(0, snapshot[:chunkSize]), chunkSize)
+	// Resending the same chunk, as if the ack was lost, should be ignored.
+	checkStaged(sendChunk(0, snapshot[:chunkSize]), chunkSize)
+	// An overlapping chunk should only append what is new.
+	checkStaged(sendChunk(chunkSize/2, snapshot[chunkSize/2:2*chunkSize]), 2*chunkSize)
+	// A gap should be rejected with the current staged offset.
+	rmsg = sendChunk(4*chunkSize, snapshot[4*chunkSize:5*chunkSize])
+	if !strings.HasPrefix(string(rmsg.Data), "-ERR") {
+		t.Fatalf("Expected an error, got %q", rmsg.Data)
+	}
+	checkStaged(rmsg, 2*chunkSize)
+
+	// Now resume from where the server is.
+	for offset := 2 * chunkSize; offset < len(snapshot); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(snapshot) {
+			end = len(snapshot)
+		}
+		checkStaged(sendChunk(offset, snapshot[offset:end]), end)
+	}
+	rmsg, err = nc.Request(rresp.DeliverSubject, nil, 5*time.Second)
+	require_NoError(t, err)
+	var cresp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &cresp))
+	if cresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", cresp.Error)
+	}
+	if cresp.State.Msgs != 500 {
+		t.Fatalf("Expected 500 msgs, got %d", cresp.State.Msgs)
+	}
+}
+
+func TestJetStreamSnapshotChunksRestoreAsIs(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 500; i++ {
+		_, err := js.Publish("foo", []byte("Hello World"))
+		require_NoError(t, err)
+	}
+
+	// Grab a snapshot, keeping the chunks as they were sent.
+	sreq := &JSApiStreamSnapshotRequest{DeliverSubject: nats.NewInbox(), ChunkSize: 1024}
+	req, _ := json.Marshal(sreq)
+	var chunks []*nats.Msg
+	done := make(chan bool)
+	sub, _ := nc.Subscribe(sreq.DeliverSubject, func(m *nats.Msg) {
+		chunks = append(chunks, m)
+		if len(m.Data) == 0 {
+			done <- true
+			return
+		}
+		m.Respond(nil)
+	})
+	defer sub.Unsubscribe()
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamSnapshotT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamSnapshotResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive our snapshot in time")
+	}
+	require_NoError(t, js.DeleteStream("TEST"))
+
+	// Each chunk has its offset and the last one the digest of the snapshot.
+	h := sha256.New()
+	var offset int
+	for _, m := range chunks[:len(chunks)-1] {
+		if v := m.Header.Get(JSRestoreOffset); v != strconv.Itoa(offset) {
+			t.Fatalf("Expected offset %d, got %q", offset, v)
+		}
+		h.Write(m.Data)
+		offset += len(m.Data)
+	}
+	eof := chunks[len(chunks)-1]
+	digest := "SHA-256=" + base64.URLEncoding.EncodeToString(h.Sum(nil))
+	if v := eof.Header.Get(JSSnapshotDigest); v != digest {
+		t.Fatalf("Expected digest %q, got %q", digest, v)
+	}
+
+	restore := func(digest string) *JSApiStreamCreateResponse {
+		t.Helper()
+		req, _ := json.Marshal(&JSApiStreamRestoreRequest{Config: *resp.Config, State: *resp.State})
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamRestoreT, "TEST"), req, time.Second)
+		require_NoError(t, err)
+		var rresp JSApiStreamRestoreResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &rresp))
+		if rresp.Error != nil {
+			t.Fatalf("Unexpected error: %+v", rresp.Error)
+		}
+		// Send the chunks back with their headers.
+		for _, m := range chunks[:len(chunks)-1] {
+			cm := &nats.Msg{Subject: rresp.DeliverSubject, Header: m.Header, Data: m.Data}
+			_, err := nc.RequestMsg(cm, time.Second)
+			require_NoError(t, err)
+		}
+		em := nats.NewMsg(rresp.DeliverSubject)
+		em.Header.Set(JSSnapshotDigest, digest)
+		rmsg, err = nc.RequestMsg(em, 5*time.Second)
+		require_NoError(t, err)
+		var cresp JSApiStreamCreateResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &cresp))
+		return &cresp
+	}
+
+	// A digest that does not match what was staged fails the restore.
+	cresp := restore("SHA-256=" + base64.URLEncoding.EncodeToString(make([]byte, sha256.Size)))
+	if cresp.Error == nil || !strings.Contains(cresp.Error.Description, "digest mismatch") {
+		t.Fatalf("Expected a digest mismatch error, got %+v", cresp.Error)
+	}
+	if _, err := js.StreamInfo("TEST"); err == nil {
+		t.Fatalf("Expected the stream to not be restored")
+	}
+
+	cresp = restore(digest)
+	if cresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", cresp.Error)
+	}
+	if cresp.State.Msgs != 500 {
+		t.Fatalf("Expected 500 msgs, got %d", cresp.State.Msgs)
+	}
+}
+
+func TestJetStreamRestoreResumeAfterStall(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 500; i++ {
+		_, err := js.Publish("foo", []byte("Hello World"))
+		require_NoError(t, err)
+	}
+
+	// Grab a snapshot.
+	sreq := &JSApiStreamSnapshotRequest{DeliverSubject: nats.NewInbox(), ChunkSize: 1024}
+	req, _ := json.Marshal(sreq)
+	var snapshot []byte
+	done := make(chan bool)
+	sub, _ := nc.Subscribe(sreq.DeliverSubject, func(m *nats.Msg) {
+		if len(m.Data) == 0 {
+			done <- true
+			return
+		}
+		snapshot = append(snapshot, m.Data...)
+		m.Respond(nil)
+	})
+	defer sub.Unsubscribe()
+
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamSnapshotT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var resp JSApiStreamSnapshotResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+	if resp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", resp.Error)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Did not receive our snapshot in time")
+	}
+	require_NoError(t, js.DeleteStream("TEST"))
+
+	restore := func(resume bool) *JSApiStreamRestoreResponse {
+		t.Helper()
+		req, _ := json.Marshal(&JSApiStreamRestoreRequest{Config: *resp.Config, State: *resp.State, Resume: resume})
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamRestoreT, "TEST"), req, time.Second)
+		require_NoError(t, err)
+		var rresp JSApiStreamRestoreResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &rresp))
+		return &rresp
+	}
+	sendChunk := func(subj string, offset int, data []byte) {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSRestoreOffset, strconv.Itoa(offset))
+		m.Data = data
+		rmsg, err := nc.RequestMsg(m, time.Second)
+		require_NoError(t, err)
+		if v := rmsg.Header.Get(JSRestoreOffset); v != strconv.Itoa(offset+len(data)) {
+			t.Fatalf("Expected staged offset %d, got %q", offset+len(data), v)
+		}
+	}
+
+	// Nothing staged yet, so a resume starts from the beginning.
+	rresp := restore(true)
+	if rresp.Error != nil || rresp.Offset != 0 {
+		t.Fatalf("Unexpected response: %+v", rresp)
+	}
+	// Only one restore of the stream can be staging at a time.
+	if rr := restore(false); rr.Error == nil {
+		t.Fatalf("Expected an error for a concurrent restore")
+	}
+
+	const chunkSize = 512
+	half := (len(snapshot) / 2 / chunkSize) * chunkSize
+	for offset := 0; offset < half; offset += chunkSize {
+		sendChunk(rresp.DeliverSubject, offset, snapshot[offset:offset+chunkSize])
+	}
+
+	// Stop sending, as if the connection dropped, and wait for the restore to stall.
+	sfile := restoreStagingFile(filepath.Join(s.getJetStream().config.StoreDir, snapStagingDir), globalAccountName, "TEST")
+	checkFor(t, 10*time.Second, 250*time.Millisecond, func() error {
+		if !s.getJetStream().startRestore(sfile) {
+			return fmt.Errorf("restore still active")
+		}
+		s.getJetStream().endRestore(sfile)
+		return nil
+	})
+
+	// What was staged survives a restart, anything orphaned and old is cleaned up.
+	snapDir := filepath.Dir(sfile)
+	orphan := filepath.Join(snapDir, "js-restore-orphan")
+	require_NoError(t, os.WriteFile(orphan, []byte("stale"), defaultFilePerms))
+	old := time.Now().Add(-2 * restoreResumeExpire)
+	require_NoError(t, os.Chtimes(orphan, old, old))
+	sd := s.JetStreamConfig().StoreDir
+	nc.Close()
+	s.Shutdown()
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+	nc, _ = jsClientConnect(t, s)
+	defer nc.Close()
+	_, err = os.Stat(orphan)
+	require_True(t, os.IsNotExist(err))
+
+	rresp = restore(true)
+	if rresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", rresp.Error)
+	}
+	if rresp.Offset != int64(half) || rresp.Chunks != half/chunkSize {
+		t.Fatalf("Expected to resume at %d after %d chunks, got %d after %d", half, half/chunkSize, rresp.Offset, rresp.Chunks)
+	}
+	for offset := half; offset < len(snapshot); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(snapshot) {
+			end = len(snapshot)
+		}
+		sendChunk(rresp.DeliverSubject, offset, snapshot[offset:end])
+	}
+	// The digest covers what was staged before the resume as well.
+	sum := sha256.Sum256(snapshot)
+	em := nats.NewMsg(rresp.DeliverSubject)
+	em.Header.Set(JSSnapshotDigest, "SHA-256="+base64.URLEncoding.EncodeToString(sum[:]))
+	rmsg, err = nc.RequestMsg(em, 5*time.Second)
+	require_NoError(t, err)
+	var cresp JSApiStreamCreateResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &cresp))
+	if cresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", cresp.Error)
+	}
+	if cresp.State.Msgs != 500 {
+		t.Fatalf("Expected 500 msgs, got %d", cresp.State.Msgs)
+	}
+	// Staging is cleaned up once restored.
+	checkFor(t, 2*time.Second, 100*time.Millisecond, func() error {
+		if _, err := os.Stat(sfile + restoreProgressExt); !os.IsNotExist(err) {
+			return fmt.Errorf("staged restore progress still present")
+		}
+		return nil
+	})
+}
+
+func TestJetStreamRollupPurgesPriorMessages(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo", "bar"}, AllowRollup: true})
+	require_NoError(t, err)
+
+	rollup := func(subj, value string) {
+		t.Helper()
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSMsgRollup, value)
+		m.Data = []byte("ROLLUP")
+		_, err := js.PublishMsg(m)
+		require_NoError(t, err)
+	}
+
+	// A rollup as the first message should not remove itself.
+	rollup("foo", JSMsgRollupAll)
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 1)
+
+	for i := 0; i < 5; i++ {
+		js.Publish("foo", []byte("OK"))
+		js.Publish("bar", []byte("OK"))
+	}
+	// Subject rollup leaves other subjects alone.
+	rollup("foo", JSMsgRollupSubject)
+	si, err = js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 6)
+	sm, err := js.GetLastMsg("TEST", "foo")
+	require_NoError(t, err)
+	require_True(t, sm.Sequence == 12)
+
+	js.Publish("foo", []byte("OK"))
+	rollup("bar", JSMsgRollupAll)
+	si, err = js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 1)
+	require_True(t, si.State.FirstSeq == 14)
+}
+
+func TestJetStreamMemoryBudgetEvictsBlockCaches(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: { memory_budget: 1GB, store_dir: %q }
+	`, t.TempDir())))
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	budget := uint64(1024 * 1024 * 1024)
+	require_True(t, opts.JetStreamMemoryBudget == int64(budget))
+
+	mset, err := s.GlobalAccount().addStreamWithStore(
+		&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage},
+		&FileStoreConfig{BlockSize: 256})
+	require_NoError(t, err)
+	fs := mset.store.(*fileStore)
+	for i := 0; i < 20; i++ {
+		_, _, err := fs.StoreMsg("foo", nil, []byte("ok"))
+		require_NoError(t, err)
+	}
+	_, err = fs.LoadMsg(1, nil)
+	require_NoError(t, err)
+
+	// Stores that are not part of this server are left alone.
+	other, err := newFileStore(
+		FileStoreConfig{StoreDir: t.TempDir(), BlockSize: 256},
+		StreamConfig{Name: "other", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer other.Stop()
+	for i := 0; i < 20; i++ {
+		_, _, err := other.StoreMsg("foo", nil, []byte("ok"))
+		require_NoError(t, err)
+	}
+	_, err = other.LoadMsg(1, nil)
+	require_NoError(t, err)
+
+	inUse := budget / 2
+	defer func(f func() uint64) { processMemoryInUse = f }(processMemoryInUse)
+	processMemoryInUse = func() uint64 { return inUse }
+
+	// Under our budget nothing should be evicted.
+	require_True(t, s.checkMemoryPressure(budget) == 0)
+	require_True(t, fs.cacheSize() > 0)
+
+	// Approaching our budget should evict.
+	inUse = budget / 100 * 95
+	require_True(t, s.checkMemoryPressure(budget) > 0)
+	fs.mu.RLock()
+	mb := fs.blks[0]
+	fs.mu.RUnlock()
+	mb.mu.RLock()
+	cached := mb.cache != nil && len(mb.cache.buf) > 0
+	mb.mu.RUnlock()
+	require_False(t, cached)
+	other.mu.RLock()
+	omb := other.blks[0]
+	other.mu.RUnlock()
+	omb.mu.RLock()
+	cached = omb.cache != nil && len(omb.cache.buf) > 0
+	omb.mu.RUnlock()
+	require_True(t, cached)
+
+	// Nothing left to evict, so nothing is reported as released.
+	require_True(t, s.checkMemoryPressure(budget) == 0)
+}
+
+func TestJetStreamStreamFirstSeq(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	for _, st := range []StorageType{FileStorage, MemoryStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			cfg := &StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: st, FirstSeq: 1000}
+			req, err := json.Marshal(cfg)
+			require_NoError(t, err)
+			resp, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, time.Second)
+			require_NoError(t, err)
+			var scResp JSApiStreamCreateResponse
+			require_NoError(t, json.Unmarshal(resp.Data, &scResp))
+			if scResp.Error != nil {
+				t.Fatalf("Unexpected error: %+v", scResp.Error)
+			}
+			defer js.DeleteStream("TEST")
+
+			pa, err := js.Publish("foo", []byte("OK"))
+			require_NoError(t, err)
+			require_True(t, pa.Sequence == 1000)
+
+			si, err := js.StreamInfo("TEST")
+			require_NoError(t, err)
+			require_True(t, si.State.FirstSeq == 1000)
+			require_True(t, si.State.Msgs == 1)
+
+			// Can not be changed once created.
+			cfg.FirstSeq = 1
+			req, err = json.Marshal(cfg)
+			require_NoError(t, err)
+			resp, err = nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "TEST"), req, time.Second)
+			require_NoError(t, err)
+			var suResp JSApiStreamUpdateResponse
+			require_NoError(t, json.Unmarshal(resp.Data, &suResp))
+			require_True(t, suResp.Error != nil)
+		})
+	}
+}
+
+func TestJetStreamAccountStorageQuotaRejectsBeforeStore(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: { store_dir: %q }
+		accounts {
+			A {
+				jetstream: { max_file: 1KB, max_mem: 1KB }
+				users [ { user: a, password: pwd } ]
+			}
+		}
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s, nats.UserInfo("a", "pwd"))
+	defer nc.Close()
+
+	for _, st := range []nats.StorageType{nats.FileStorage, nats.MemoryStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: st})
+			require_NoError(t, err)
+			defer js.DeleteStream("TEST")
+
+			msg := make([]byte, 100)
+			var stored uint64
+			for i := 0; i < 20; i++ {
+				pa, err := js.Publish("foo", msg)
+				if err != nil {
+					require_True(t, strings.Contains(err.Error(), "resource limits exceeded"))
+					break
+				}
+				stored++
+				require_True(t, pa.Sequence == stored)
+			}
+			require_True(t, stored > 0 && stored < 20)
+
+			// A rejected write should not use a sequence.
+			si, err := js.StreamInfo("TEST")
+			require_NoError(t, err)
+			require_True(t, si.State.Msgs == stored)
+			require_True(t, si.State.LastSeq == stored)
+		})
+	}
+}
+
+func TestJetStreamStreamConfigHistory(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		key  string
+	}{
+		{"Plaintext", _EMPTY_},
+		{"Encrypted", "key: s3cr3t, "},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			testJetStreamStreamConfigHistory(t, test.key)
+		})
+	}
+}
+
+func testJetStreamStreamConfigHistory(t *testing.T, key string) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {%sstore_dir: %q}
+	`, key, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, _ := jsClientConnect(t, s)
+	defer nc.Close()
+
+	streamInfo := func() *StreamInfo {
+		t.Helper()
+		resp, err := nc.Request(fmt.Sprintf(JSApiStreamInfoT, "TEST"), nil, time.Second)
+		require_NoError(t, err)
+		var si JSApiStreamInfoResponse
+		require_NoError(t, json.Unmarshal(resp.Data, &si))
+		if si.Error != nil {
+			t.Fatalf("Unexpected error: %+v", si.Error)
+		}
+		return si.StreamInfo
+	}
+
+	cfg := &StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage}
+	req, err := json.Marshal(cfg)
+	require_NoError(t, err)
+	_, err = nc.Request(fmt.Sprintf(JSApiStreamCreateT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+
+	hist := streamInfo().History
+	require_True(t, len(hist) == 1)
+	require_True(t, hist[0].Revision == 1)
+	require_True(t, hist[0].Account == globalAccountName)
+	require_True(t, len(hist[0].Changes) == 0)
+
+	cfg.MaxMsgs = 100
+	cfg.Subjects = []string{"foo", "bar"}
+	req, err = json.Marshal(cfg)
+	require_NoError(t, err)
+	resp, err := nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var suResp JSApiStreamUpdateResponse
+	require_NoError(t, json.Unmarshal(resp.Data, &suResp))
+	require_True(t, suResp.Error == nil)
+
+	// An update with no changes should not add a revision.
+	_, err = nc.Request(fmt.Sprintf(JSApiStreamUpdateT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+
+	hist = streamInfo().History
+	require_True(t, len(hist) == 2)
+	require_True(t, hist[1].Revision == 2)
+	require_True(t, reflect.DeepEqual(hist[1].Changes, []string{"max_msgs", "subjects"}))
+
+	// Should be persisted across a restart.
+	s.Shutdown()
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	nc.Close()
+	nc, _ = jsClientConnect(t, s)
+	defer nc.Close()
+
+	hist = streamInfo().History
+	require_True(t, len(hist) == 2)
+	require_True(t, hist[1].Revision == 2)
+}
+
+func TestJetStreamAccountBackupAll(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	for _, cfg := range []*nats.StreamConfig{
+		{Name: "A", Subjects: []string{"a"}, Storage: nats.FileStorage},
+		{Name: "B", Subjects: []string{"b"}, Storage: nats.FileStorage},
+		{Name: "M", Subjects: []string{"m"}, Storage: nats.MemoryStorage},
+	} {
+		_, err := js.AddStream(cfg)
+		require_NoError(t, err)
+		for i := 0; i < 10; i++ {
+			_, err := js.Publish(cfg.Subjects[0], []byte("OK"))
+			require_NoError(t, err)
+		}
+	}
+	_, err := js.AddConsumer("A", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	acc := s.GlobalAccount()
+	_, err = acc.addStreamTemplate(&StreamTemplateConfig{
+		Name:       "T",
+		Config:     &StreamConfig{Subjects: []string{"t.*"}, Storage: FileStorage},
+		MaxStreams: 4,
+	})
+	require_NoError(t, err)
+
+	var buf bytes.Buffer
+	manifest, err := acc.BackupAll(&buf, 5*time.Second, true)
+	require_NoError(t, err)
+	require_True(t, manifest.Account == globalAccountName)
+	require_True(t, len(manifest.Templates) == 1)
+	require_True(t, manifest.Templates[0].Name == "T")
+	require_True(t, len(manifest.Streams) == 3)
+	for i, name := range []string{"A", "B", "M"} {
+		bs := manifest.Streams[i]
+		require_True(t, bs.Config.Name == name)
+		require_True(t, bs.State.Msgs == 10)
+		require_True(t, (bs.File == _EMPTY_) == (name == "M"))
+	}
+
+	// Read the archive back, manifest should be first.
+	entries := make(map[string][]byte)
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require_NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require_NoError(t, err)
+		entries[hdr.Name] = b
+		names = append(names, hdr.Name)
+	}
+	require_True(t, len(names) == 3)
+	require_True(t, names[0] == backupManifest)
+	var rm AccountBackupManifest
+	require_NoError(t, json.Unmarshal(entries[backupManifest], &rm))
+	require_True(t, len(rm.Streams) == 3)
+
+	// Make sure we can restore a stream and its consumer from the backup.
+	require_NoError(t, js.DeleteStream("A"))
+	ascfg := rm.Streams[0].Config
+	mset, err := acc.RestoreStream(&ascfg, bytes.NewReader(entries[rm.Streams[0].File]))
+	require_NoError(t, err)
+	require_True(t, mset.state().Msgs == 10)
+	require_True(t, mset.lookupConsumer("dlc") != nil)
+}
+
+func TestJetStreamAccountBackupRequest(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q}
+		accounts { $SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] } }
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	sysnc := natsConnect(t, s.ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	defer sysnc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	// Regular accounts can not take backups.
+	_, err = nc.Request(fmt.Sprintf(JSApiAccountBackupT, globalAccountName), nil, 250*time.Millisecond)
+	require_Error(t, err)
+
+	backup := func(account string) *JSApiAccountBackupResponse {
+		t.Helper()
+		rmsg, err := sysnc.Request(fmt.Sprintf(JSApiAccountBackupT, account), nil, 5*time.Second)
+		require_NoError(t, err)
+		var resp JSApiAccountBackupResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	resp := backup(globalAccountName)
+	require_True(t, resp.Error == nil)
+	require_True(t, resp.Server == s.Name())
+	require_True(t, resp.Manifest != nil && len(resp.Manifest.Streams) == 1)
+	require_True(t, resp.Manifest.Streams[0].State.Msgs == 10)
+	require_True(t, strings.HasPrefix(resp.File, filepath.Join(s.getJetStream().config.StoreDir, accountBackupsDir)))
+
+	fd, err := os.Open(resp.File)
+	require_NoError(t, err)
+	defer fd.Close()
+	hdr, err := tar.NewReader(fd).Next()
+	require_NoError(t, err)
+	require_True(t, hdr.Name == backupManifest)
+
+	// The backups directory is not mistaken for an account.
+	s.Shutdown()
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+	if _, ok := s.accounts.Load(accountBackupsDir); ok {
+		t.Fatalf("Backups directory should not be loaded as an account")
+	}
+
+	sysnc = natsConnect(t, s.ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	defer sysnc.Close()
+	resp = backup("NOPE")
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSNoAccountErr))
+}
+
+func TestJetStreamStreamRestoreDryRun(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 100; i++ {
+		_, err := js.Publish("foo", []byte("Hello World"))
+		require_NoError(t, err)
+	}
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{Durable: "dlc", AckPolicy: nats.AckExplicitPolicy})
+	require_NoError(t, err)
+
+	acc := s.GlobalAccount()
+	mset, err := acc.lookupStream("TEST")
+	require_NoError(t, err)
+	cfg := mset.config()
+	sr, err := mset.snapshot(5*time.Second, true, true)
+	require_NoError(t, err)
+	snapshot, err := io.ReadAll(sr.Reader)
+	require_NoError(t, err)
+
+	// Stream still exists so this should be flagged.
+	check, err := acc.CheckStreamRestore(&cfg, bytes.NewReader(snapshot))
+	require_NoError(t, err)
+	require_False(t, check.OK())
+
+	require_NoError(t, js.DeleteStream("TEST"))
+
+	check, err = acc.CheckStreamRestore(&cfg, bytes.NewReader(snapshot))
+	require_NoError(t, err)
+	if !check.OK() {
+		t.Fatalf("Unexpected problems: %v", check.Problems)
+	}
+	require_True(t, check.Config.Name == "TEST")
+	require_True(t, check.Msgs == 100)
+	require_True(t, check.FirstSeq == 1)
+	require_True(t, check.LastSeq == 100)
+	require_True(t, check.Blocks > 0)
+	require_True(t, check.RequiredBytes > 0)
+	require_True(t, len(check.Consumers) == 1 && check.Consumers[0] == "dlc")
+
+	// Flip a byte in the message data of the first block.
+	var corrupt bytes.Buffer
+	zw := s2.NewWriter(&corrupt)
+	tw := tar.NewWriter(zw)
+	tr := tar.NewReader(s2.NewReader(bytes.NewReader(snapshot)))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require_NoError(t, err)
+		b, err := io.ReadAll(tr)
+		require_NoError(t, err)
+		if hdr.Name == filepath.Join(msgDir, fmt.Sprintf(blkScan, 1)) {
+			b[msgHdrSize+10] ^= 0xff
+		}
+		require_NoError(t, tw.WriteHeader(hdr))
+		_, err = tw.Write(b)
+		require_NoError(t, err)
+	}
+	require_NoError(t, tw.Close())
+	require_NoError(t, zw.Close())
+
+	check, err = acc.CheckStreamRestore(&cfg, bytes.NewReader(corrupt.Bytes()))
+	require_NoError(t, err)
+	require_False(t, check.OK())
+
+	// Now do a dry run through the API.
+	req, _ := json.Marshal(&JSApiStreamRestoreRequest{Config: cfg, DryRun: true})
+	rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamRestoreT, "TEST"), req, time.Second)
+	require_NoError(t, err)
+	var rresp JSApiStreamRestoreResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &rresp))
+	if rresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", rresp.Error)
+	}
+	const chunkSize = 512
+	for offset := 0; offset < len(snapshot); offset += chunkSize {
+		end := offset + chunkSize
+		if end > len(snapshot) {
+			end = len(snapshot)
+		}
+		_, err := nc.Request(rresp.DeliverSubject, snapshot[offset:end], time.Second)
+		require_NoError(t, err)
+	}
+	rmsg, err = nc.Request(rresp.DeliverSubject, nil, 5*time.Second)
+	require_NoError(t, err)
+	var cresp JSApiStreamRestoreCheckResponse
+	require_NoError(t, json.Unmarshal(rmsg.Data, &cresp))
+	if cresp.Error != nil {
+		t.Fatalf("Unexpected error: %+v", cresp.Error)
+	}
+	require_True(t, cresp.Type == JSApiStreamRestoreCheckResponseType)
+	require_True(t, cresp.Check != nil && cresp.Check.OK())
+	require_True(t, cresp.Check.Msgs == 100)
+
+	// Nothing should have been restored.
+	_, err = acc.lookupStream("TEST")
+	require_Error(t, err)
+}
+
+func TestJetStreamDamagedBlocksHealthzWarning(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("Hello World"))
+		require_NoError(t, err)
+	}
+	require_True(t, len(s.healthz(nil).Warnings) == 0)
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	sdir := mset.store.(*fileStore).fcfg.StoreDir
+	nc.Close()
+	sd := s.JetStreamConfig().StoreDir
+	s.Shutdown()
+
+	// Corrupt the last message and drop the index so we rebuild on restart.
+	mfn := filepath.Join(sdir, msgDir, fmt.Sprintf(blkScan, 1))
+	buf, err := os.ReadFile(mfn)
+	require_NoError(t, err)
+	buf[len(buf)-checksumSize-1] ^= 0xff
+	require_NoError(t, os.WriteFile(mfn, buf, defaultFilePerms))
+	require_NoError(t, os.Remove(filepath.Join(sdir, msgDir, fmt.Sprintf(indexScan, 1))))
+
+	s = RunJetStreamServerOnPort(-1, sd)
+	defer s.Shutdown()
+
+	mset, err = s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	state := mset.stateWithDetail(true)
+	require_True(t, state.Msgs == 9)
+	require_True(t, len(state.Damaged) == 1)
+	require_True(t, state.Damaged[0].FirstSeq == 10)
+
+	hs := s.healthz(nil)
+	require_True(t, hs.Status == "ok")
+	require_True(t, len(hs.Warnings) == 1)
+	require_True(t, strings.Contains(hs.Warnings[0], "'$G > TEST'"))
+}
+
+func TestJetStreamStreamRemovalHook(t *testing.T) {
+	for _, st := range []StorageType{FileStorage, MemoryStorage} {
+		t.Run(st.String(), func(t *testing.T) {
+			s := RunBasicJetStreamServer(t)
+			defer s.Shutdown()
+
+			nc, js := jsClientConnect(t, s)
+			defer nc.Close()
+
+			// Can not hand off into the stream itself.
+			cfg := &StreamConfig{
+				Name:        "RH",
+				Storage:     st,
+				Subjects:    []string{"foo.*"},
+				MaxMsgs:     10,
+				RemovalHook: &RemovalHook{Subject: "foo.removed"},
+			}
+			req, err := json.Marshal(cfg)
+			require_NoError(t, err)
+			rmsg, err := nc.Request(fmt.Sprintf(JSApiStreamCreateT, cfg.Name), req, time.Second)
+			require_NoError(t, err)
+			var resp JSApiStreamCreateResponse
+			require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+			if resp.Error == nil || !strings.Contains(resp.Error.Description, "removal hook subject forms a cycle") {
+				t.Fatalf("Expected cycle error, got %+v", resp.Error)
+			}
+
+			cfg.RemovalHook = &RemovalHook{Subject: "removed", HeadersOnly: true, MaxBatch: 4}
+			addStream(t, nc, cfg)
+
+			sub, err := nc.SubscribeSync("removed")
+			require_NoError(t, err)
+			require_NoError(t, nc.Flush())
+
+			mset, err := s.GlobalAccount().lookupStream("RH")
+			require_NoError(t, err)
+			var mu sync.Mutex
+			var cbSeqs []uint64
+			mset.registerRemovalHandler(func(rm *RemovedMsgs) {
+				mu.Lock()
+				defer mu.Unlock()
+				for _, m := range rm.Msgs {
+					cbSeqs = append(cbSeqs, m.Sequence)
+				}
+			})
+
+			for i := 0; i < 25; i++ {
+				_, err := js.Publish("foo.bar", []byte("OK"))
+				require_NoError(t, err)
+			}
+
+			var seqs []uint64
+			for len(seqs) < 15 {
+				m, err := sub.NextMsg(2 * time.Second)
+				require_NoError(t, err)
+				var rm RemovedMsgs
+				require_NoError(t, json.Unmarshal(m.Data, &rm))
+				require_True(t, rm.Stream == "RH")
+				require_True(t, len(rm.Msgs) <= 4)
+				for _, m := range rm.Msgs {
+					require_True(t, m.Subject == "foo.bar")
+					require_True(t, len(m.Data) == 0)
+					seqs = append(seqs, m.Sequence)
+				}
+			}
+			for i, seq := range seqs {
+				require_True(t, seq == uint64(i+1))
+			}
+
+			// The internal handler gets the same messages.
+			checkFor(t, time.Second, 50*time.Millisecond, func() error {
+				mu.Lock()
+				defer mu.Unlock()
+				if len(cbSeqs) != 15 {
+					return fmt.Errorf("expected 15 removed messages, got %d", len(cbSeqs))
+				}
+				return nil
+			})
+
+			// Removing the hook stops the hand off.
+			cfg.RemovalHook = nil
+			mset.registerRemovalHandler(nil)
+			req, err = json.Marshal(cfg)
+			require_NoError(t, err)
+			_, err = nc.Request(fmt.Sprintf(JSApiStreamUpdateT, cfg.Name), req, time.Second)
+			require_NoError(t, err)
+			_, err = js.Publish("foo.bar", []byte("OK"))
+			require_NoError(t, err)
+			_, err = sub.NextMsg(250 * time.Millisecond)
+			require_Error(t, err, nats.ErrTimeout)
+		})
+	}
+}
+
+func TestJetStreamStreamMaintenance(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q}
+		accounts { $SYS { users = [ { user: "admin", pass: "s3cr3t!" } ] } }
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	sysnc := natsConnect(t, s.ClientURL(), nats.UserInfo("admin", "s3cr3t!"))
+	defer sysnc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "MEM", Subjects: []string{"bar"}, Storage: nats.MemoryStorage})
+	require_NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	maintenance := func(stream string, req *JSApiStreamMaintenanceRequest) *JSApiStreamMaintenanceResponse {
+		t.Helper()
+		var b []byte
+		if req != nil {
+			b, _ = json.Marshal(req)
+		}
+		rmsg, err := sysnc.Request(fmt.Sprintf(JSApiStreamMaintenanceT, globalAccountName, stream), b, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamMaintenanceResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	// Regular accounts can not run maintenance.
+	req, _ := json.Marshal(&JSApiStreamMaintenanceRequest{RollBlock: true})
+	_, err = nc.Request(fmt.Sprintf(JSApiStreamMaintenanceT, globalAccountName, "TEST"), req, 250*time.Millisecond)
+	require_Error(t, err)
+
+	resp := maintenance("TEST", &JSApiStreamMaintenanceRequest{RollBlock: true, ForceSync: true, DropCaches: true})
+	require_True(t, resp.Error == nil)
+	require_True(t, resp.Success)
+	require_True(t, resp.Block == 2)
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	fs := mset.store.(*fileStore)
+	fs.mu.RLock()
+	nblks := len(fs.blks)
+	fs.mu.RUnlock()
+	require_True(t, nblks == 2)
+
+	// Need at least one operation.
+	resp = maintenance("TEST", nil)
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSBadRequestErr))
+
+	// Only for file based streams.
+	resp = maintenance("MEM", &JSApiStreamMaintenanceRequest{ForceSync: true})
+	require_True(t, resp.Error != nil && strings.Contains(resp.Error.Description, "requires file storage"))
+
+	resp = maintenance("NOPE", &JSApiStreamMaintenanceRequest{ForceSync: true})
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSStreamNotFoundErr))
+
+	rmsg, err := sysnc.Request(fmt.Sprintf(JSApiStreamMaintenanceT, "NOPE", "TEST"), req, time.Second)
+	require_NoError(t, err)
+	resp = &JSApiStreamMaintenanceResponse{}
+	require_NoError(t, json.Unmarshal(rmsg.Data, resp))
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSNoAccountErr))
+}
+
+func TestJetStreamConsumerInfoPendingFilters(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"orders.>"}})
+	require_NoError(t, err)
+
+	for i := 0; i < 5; i++ {
+		for _, subj := range []string{"orders.eu.new", "orders.us.new", "orders.us.done"} {
+			_, err := js.Publish(subj, []byte("OK"))
+			require_NoError(t, err)
+		}
+	}
+
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:       "dlc",
+		FilterSubject: "orders.us.>",
+		AckPolicy:     nats.AckExplicitPolicy,
+	})
+	require_NoError(t, err)
+
+	info := func(req *JSApiConsumerInfoRequest) *JSApiConsumerInfoResponse {
+		t.Helper()
+		var b []byte
+		if req != nil {
+			b, _ = json.Marshal(req)
+		}
+		rmsg, err := nc.Request(fmt.Sprintf(JSApiConsumerInfoT, "TEST", "dlc"), b, time.Second)
+		require_NoError(t, err)
+		var resp JSApiConsumerInfoResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+
+	// Nothing extra unless asked for.
+	resp := info(nil)
+	require_True(t, resp.Error == nil)
+	require_True(t, resp.NumPending == 10)
+	require_True(t, resp.NumPendingFiltered == nil)
+
+	resp = info(&JSApiConsumerInfoRequest{PendingFilters: []string{"orders.us.new", "orders.us.*"}})
+	require_True(t, resp.Error == nil)
+	require_True(t, len(resp.NumPendingFiltered) == 2)
+	require_True(t, resp.NumPendingFiltered["orders.us.new"] == 5)
+	require_True(t, resp.NumPendingFiltered["orders.us.*"] == 10)
+
+	// Deliver a few.
+	sub, err := js.PullSubscribe("orders.us.>", "dlc")
+	require_NoError(t, err)
+	msgs, err := sub.Fetch(3)
+	require_NoError(t, err)
+	require_True(t, len(msgs) == 3)
+
+	resp = info(&JSApiConsumerInfoRequest{PendingFilters: []string{"orders.us.new", "orders.us.done"}})
+	require_True(t, resp.Error == nil)
+	require_True(t, resp.NumPendingFiltered["orders.us.new"]+resp.NumPendingFiltered["orders.us.done"] == resp.NumPending)
+	require_True(t, resp.NumPending == 7)
+
+	// Has to be a subset of the consumer's filter.
+	resp = info(&JSApiConsumerInfoRequest{PendingFilters: []string{"orders.eu.new"}})
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSConsumerFilterNotSubsetErr))
+
+	// The number of filters is limited.
+	filters := make([]string, JSMaxPendingFilters+1)
+	for i := range filters {
+		filters[i] = fmt.Sprintf("orders.us.%d", i)
+	}
+	resp = info(&JSApiConsumerInfoRequest{PendingFilters: filters})
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSConsumerTooManyPendingFiltersErrF))
+	require_True(t, resp.ConsumerInfo == nil)
+	resp = info(&JSApiConsumerInfoRequest{PendingFilters: filters[:JSMaxPendingFilters]})
+	require_True(t, resp.Error == nil)
+	require_True(t, len(resp.NumPendingFiltered) == JSMaxPendingFilters)
+}
+
+func TestJetStreamStreamMergeRead(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "A", Subjects: []string{"a.*"}})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "B", Subjects: []string{"b.*"}, Storage: nats.MemoryStorage})
+	require_NoError(t, err)
+
+	// Events partitioned across both streams.
+	var order []string
+	var mid time.Time
+	for i := 0; i < 10; i++ {
+		subj := fmt.Sprintf("a.%d", i)
+		if i%3 == 0 {
+			subj = fmt.Sprintf("b.%d", i)
+		}
+		if i == 5 {
+			mid = time.Now()
+		}
+		_, err := js.Publish(subj, []byte("OK"))
+		require_NoError(t, err)
+		order = append(order, subj)
+		time.Sleep(time.Millisecond)
+	}
+
+	merge := func(req *JSApiStreamMergeRequest) *JSApiStreamMergeResponse {
+		t.Helper()
+		b, _ := json.Marshal(req)
+		rmsg, err := nc.Request(JSApiStreamMerge, b, time.Second)
+		require_NoError(t, err)
+		var resp JSApiStreamMergeResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp
+	}
+	subjects := func(msgs []*JSApiMergedMsg) []string {
+		var subjs []string
+		for _, m := range msgs {
+			require_True(t, m.Stream == strings.ToUpper(m.Message.Subject[:1]))
+			subjs = append(subjs, m.Message.Subject)
+		}
+		return subjs
+	}
+
+	resp := merge(&JSApiStreamMergeRequest{Streams: []string{"A", "B"}})
+	require_True(t, resp.Error == nil)
+	require_True(t, reflect.DeepEqual(subjects(resp.Messages), order))
+	require_True(t, resp.Next["A"] == 7 && resp.Next["B"] == 5)
+
+	// Page through using the returned positions.
+	req := &JSApiStreamMergeRequest{Streams: []string{"B", "A"}, Batch: 4}
+	var paged []string
+	for i := 0; i < 4; i++ {
+		resp = merge(req)
+		require_True(t, resp.Error == nil)
+		paged = append(paged, subjects(resp.Messages)...)
+		req.Next = resp.Next
+	}
+	require_True(t, reflect.DeepEqual(paged, order))
+
+	// New messages are picked up when resuming.
+	_, err = js.Publish("b.new", []byte("OK"))
+	require_NoError(t, err)
+	resp = merge(req)
+	require_True(t, reflect.DeepEqual(subjects(resp.Messages), []string{"b.new"}))
+
+	// Start from a time.
+	resp = merge(&JSApiStreamMergeRequest{Streams: []string{"A", "B"}, StartTime: &mid})
+	require_True(t, reflect.DeepEqual(subjects(resp.Messages), append(order[5:], "b.new")))
+
+	// Filtered.
+	resp = merge(&JSApiStreamMergeRequest{Streams: []string{"A", "B"}, Filter: "b.9"})
+	require_True(t, reflect.DeepEqual(subjects(resp.Messages), []string{"b.9"}))
+
+	// Bytes are limited, but we always get at least one message.
+	resp = merge(&JSApiStreamMergeRequest{Streams: []string{"A", "B"}, MaxBytes: 12})
+	require_True(t, reflect.DeepEqual(subjects(resp.Messages), order[:2]))
+	resp = merge(&JSApiStreamMergeRequest{Streams: []string{"A", "B"}, MaxBytes: 1})
+	require_True(t, reflect.DeepEqual(subjects(resp.Messages), order[:1]))
+
+	resp = merge(&JSApiStreamMergeRequest{Streams: []string{"A", "NOPE"}})
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSStreamNotFoundErr))
+	resp = merge(&JSApiStreamMergeRequest{})
+	require_True(t, resp.Error != nil && resp.Error.ErrCode == uint16(JSBadRequestErr))
+}
+
+func TestJetStreamStreamMergeReadPermissions(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {max_mem_store: 64MB, max_file_store: 64MB, store_dir: %q}
+		accounts: {
+			A: {
+				jetstream: enabled
+				users: [
+					{user: admin, password: pwd}
+					{user: reader, password: pwd, permissions: {publish: {deny: "$JS.API.STREAM.MSG.GET.SECRET"}}}
+				]
+			}
+		}
+	`, t.TempDir())))
+	s, _ := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s, nats.UserInfo("admin", "pwd"))
+	defer nc.Close()
+	for _, name := range []string{"PUBLIC", "SECRET"} {
+		_, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{strings.ToLower(name)}})
+		require_NoError(t, err)
+		_, err = js.Publish(strings.ToLower(name), []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	rnc := natsConnect(t, s.ClientURL(), nats.UserInfo("reader", "pwd"))
+	defer rnc.Close()
+
+	merge := func(streams ...string) (*JSApiStreamMergeResponse, error) {
+		b, _ := json.Marshal(&JSApiStreamMergeRequest{Streams: streams})
+		rmsg, err := rnc.Request(JSApiStreamMerge, b, 250*time.Millisecond)
+		if err != nil {
+			return nil, err
+		}
+		var resp JSApiStreamMergeResponse
+		require_NoError(t, json.Unmarshal(rmsg.Data, &resp))
+		return &resp, nil
+	}
+
+	resp, err := merge("PUBLIC")
+	require_NoError(t, err)
+	require_True(t, resp.Error == nil && len(resp.Messages) == 1)
+
+	// Reading a stream we can not get messages from is rejected.
+	resp, err = merge("PUBLIC", "SECRET")
+	require_NoError(t, err)
+	if resp.Error == nil || resp.Error.ErrCode != uint16(JSStreamMergeNotPermittedErrF) || len(resp.Messages) != 0 {
+		t.Fatalf("Expected a not permitted error, got %+v", resp)
+	}
+	require_True(t, strings.Contains(resp.Error.Description, "SECRET"))
+}
+
+func TestJetStreamSubjectTombstones(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:              "KV",
+		Subjects:          []string{"kv.>"},
+		MaxMsgsPerSubject: 10,
+		AllowRollup:       true,
+		AllowDirect:       true,
+	})
+	require_NoError(t, err)
+	_, err = js.AddStream(&nats.StreamConfig{Name: "M", Mirror: &nats.StreamSource{Name: "KV"}})
+	require_NoError(t, err)
+
+	tombstone := func(subj, kind string) (*nats.PubAck, error) {
+		m := nats.NewMsg(subj)
+		m.Header.Set(JSMsgTombstone, kind)
+		m.Header.Set(JSMsgId, subj+kind)
+		m.Data = []byte("ignored")
+		return js.PublishMsg(m)
+	}
+
+	for _, v := range []string{"1", "2"} {
+		_, err = js.Publish("kv.a", []byte(v))
+		require_NoError(t, err)
+	}
+	_, err = js.Publish("kv.b", []byte("1"))
+	require_NoError(t, err)
+	pa, err := tombstone("kv.a", JSMsgTombstoneDelete)
+	require_NoError(t, err)
+
+	// Stored compactly but history is kept.
+	rm, err := js.GetMsg("KV", pa.Sequence)
+	require_NoError(t, err)
+	require_True(t, len(rm.Data) == 0)
+	require_True(t, rm.Header.Get(JSMsgTombstone) == JSMsgTombstoneDelete)
+	require_True(t, rm.Header.Get(JSMsgId) == "kv.adel")
+	si, err := js.StreamInfo("KV")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 4)
+
+	// Last per subject reads treat the subject as deleted.
+	_, err = js.GetLastMsg("KV", "kv.a")
+	require_Error(t, err, nats.ErrMsgNotFound)
+	_, err = js.GetLastMsg("KV", "kv.a", nats.DirectGet())
+	require_Error(t, err, nats.ErrMsgNotFound)
+	rm, err = js.GetLastMsg("KV", "kv.b", nats.DirectGet())
+	require_NoError(t, err)
+	require_True(t, string(rm.Data) == "1")
+
+	// Purge tombstones remove earlier messages for the subject.
+	_, err = tombstone("kv.a", JSMsgTombstonePurge)
+	require_NoError(t, err)
+	si, err = js.StreamInfo("KV")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 2)
+
+	// The mirror applies the same.
+	checkFor(t, 2*time.Second, 50*time.Millisecond, func() error {
+		si, err := js.StreamInfo("M")
+		if err != nil {
+			return err
+		}
+		if si.State.Msgs != 2 || si.State.LastSeq != 5 {
+			return fmt.Errorf("mirror not caught up: %+v", si.State)
+		}
+		return nil
+	})
+	_, err = js.GetLastMsg("M", "kv.a")
+	require_Error(t, err, nats.ErrMsgNotFound)
+
+	_, err = tombstone("kv.a", "bad")
+	require_Error(t, err)
+
+	// Purge tombstones need rollups allowed.
+	_, err = js.AddStream(&nats.StreamConfig{
+		Name:                 "LIM",
+		Subjects:             []string{"lim.>"},
+		MaxMsgsPerSubject:    1,
+		Discard:              nats.DiscardNew,
+		DiscardNewPerSubject: true,
+	})
+	require_NoError(t, err)
+	_, err = tombstone("lim.a", JSMsgTombstonePurge)
+	require_Error(t, err)
+
+	// Tombstones are accepted at the per subject limit.
+	_, err = js.Publish("lim.a", []byte("1"))
+	require_NoError(t, err)
+	_, err = js.Publish("lim.a", []byte("2"))
+	require_Error(t, err)
+	pa, err = tombstone("lim.a", JSMsgTombstoneDelete)
+	require_NoError(t, err)
+	si, err = js.StreamInfo("LIM")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 1 && si.State.FirstSeq == pa.Sequence)
+}
+
+func TestJetStreamStreamStampOrigin(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s, nats.Name("pub"))
+	defer nc.Close()
+
+	addStream(t, nc, &StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: FileStorage, StampOrigin: true})
+	addStream(t, nc, &StreamConfig{Name: "PLAIN", Subjects: []string{"bar"}, Storage: FileStorage})
+
+	// Publisher supplied values must not survive, whatever their case.
+	m := nats.NewMsg("foo")
+	m.Header.Set("X", "Y")
+	m.Header[JSOriginAccount] = []string{"FAKE"}
+	m.Header["nats-origin-server"] = []string{"FAKE"}
+	m.Data = []byte("OK")
+	_, err := js.PublishMsg(m)
+	require_NoError(t, err)
+
+	rm, err := js.GetMsg("TEST", 1)
+	require_NoError(t, err)
+	require_True(t, string(rm.Data) == "OK")
+	require_True(t, rm.Header.Get("X") == "Y")
+	require_True(t, len(rm.Header.Values(JSOriginAccount)) == 1)
+	require_True(t, rm.Header.Get(JSOriginAccount) == globalAccountName)
+	require_True(t, len(rm.Header.Values(JSOriginServer)) == 1)
+	require_True(t, rm.Header.Get(JSOriginServer) == s.Name())
+	require_True(t, rm.Header.Get(JSOriginClientName) == "pub")
+	require_True(t, rm.Header.Get(JSOriginClientId) != _EMPTY_)
+
+	// Messages without headers get them as well.
+	_, err = js.Publish("foo", []byte("OK"))
+	require_NoError(t, err)
+	rm, err = js.GetMsg("TEST", 2)
+	require_NoError(t, err)
+	require_True(t, rm.Header.Get(JSOriginAccount) == globalAccountName)
+
+	// Client info set by a publisher is not trusted as the origin.
+	sm := nats.NewMsg("foo")
+	sm.Header.Set(ClientInfoHdr, `{"acc":"FAKE","id":22,"name":"spoof","server":"FAKE"}`)
+	_, err = js.PublishMsg(sm)
+	require_NoError(t, err)
+	rm, err = js.GetMsg("TEST", 3)
+	require_NoError(t, err)
+	require_True(t, rm.Header.Get(JSOriginAccount) == globalAccountName)
+	require_True(t, rm.Header.Get(JSOriginServer) == s.Name())
+	require_True(t, rm.Header.Get(JSOriginClientName) == "pub")
+
+	// Streams that do not stamp leave headers alone.
+	m.Subject = "bar"
+	_, err = js.PublishMsg(m)
+	require_NoError(t, err)
+	rm, err = js.GetMsg("PLAIN", 1)
+	require_NoError(t, err)
+	require_True(t, rm.Header.Get(JSOriginAccount) == "FAKE")
+}
+
+func TestJetStreamConcurrentStreamRecovery(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, recovery_concurrency: 4}
+	`, t.TempDir())))
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	require_True(t, opts.JetStreamRecoveryJobs == 4)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("S%d", i)
+		_, err := js.AddStream(&nats.StreamConfig{Name: name, Subjects: []string{name}})
+		require_NoError(t, err)
+		_, err = js.AddConsumer(name, &nats.ConsumerConfig{Durable: "d", AckPolicy: nats.AckExplicitPolicy})
+		require_NoError(t, err)
+		for j := 0; j <= i; j++ {
+			_, err := js.Publish(name, []byte("OK"))
+			require_NoError(t, err)
+		}
+	}
+	nc.Close()
+	s.Shutdown()
+
+	s, _ = RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	nc, js = jsClientConnect(t, s)
+	defer nc.Close()
+	for i := 0; i < n; i++ {
+		name := fmt.Sprintf("S%d", i)
+		si, err := js.StreamInfo(name)
+		require_NoError(t, err)
+		require_True(t, si.State.Msgs == uint64(i+1))
+		_, err = js.ConsumerInfo(name, "d")
+		require_NoError(t, err)
+	}
+
+	// Nothing is being recovered anymore.
+	sr := &s.getJetStream().recovery
+	_, _, _, ok := sr.progress()
+	require_False(t, ok)
+	require_True(t, s.healthz(nil).Status == "ok")
+
+	// Healthz reports progress while recovering.
+	sr.add(10)
+	for i := 0; i < 3; i++ {
+		sr.streamDone()
+	}
+	hs := s.healthz(nil)
+	require_True(t, hs.Status == "unavailable")
+	require_True(t, strings.Contains(hs.Error, "3 of 10 done"))
+	for i := 0; i < 7; i++ {
+		sr.streamDone()
+	}
+	require_True(t, s.healthz(nil).Status == "ok")
+
+	// The concurrency can be changed on reload.
+	changeCurrentConfigContentWithNewContent(t, conf, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, recovery_concurrency: 2}
+	`, opts.StoreDir)))
+	require_NoError(t, s.Reload())
+	require_True(t, s.getOpts().JetStreamRecoveryJobs == 2)
+}
+
+func TestJetStreamConcurrentAddStreamReservations(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	err := acc.UpdateJetStreamLimits(map[string]JetStreamAccountLimits{
+		_EMPTY_: {MaxMemory: -1, MaxStore: 4 * 1024 * 1024},
+	})
+	require_NoError(t, err)
+
+	// Each stream reserves 1MB, so only 4 of them fit no matter how many
+	// are added at the same time.
+	const n = 64
+	var added int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			name := fmt.Sprintf("S%d", i)
+			if _, err := acc.addStream(&StreamConfig{Name: name, Subjects: []string{name}, Storage: FileStorage, MaxBytes: 1024 * 1024}); err == nil {
+				atomic.AddInt32(&added, 1)
+			}
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	if n := atomic.LoadInt32(&added); n != 4 {
+		t.Fatalf("Expected 4 streams to be added, got %d", n)
+	}
+}
+
+type testMsgInterceptor struct {
+	name string
+	fn   func(ctx context.Context, m *InterceptedMsg) error
+}
+
+func (ti *testMsgInterceptor) Name() string { return ti.name }
+func (ti *testMsgInterceptor) Intercept(ctx context.Context, m *InterceptedMsg) error {
+	return ti.fn(ctx, m)
+}
+
+func TestJetStreamObjectStore(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	_, err := acc.CreateObjectStore(&ObjectStoreConfig{Bucket: "bad.name"})
+	require_Error(t, err, ErrBadObjectStoreBucket)
+
+	// Chunks need to fit in a message.
+	_, err = acc.CreateObjectStore(&ObjectStoreConfig{Bucket: "BIG", ChunkSize: int(s.getOpts().MaxPayload) + 1})
+	require_Error(t, err)
+	require_Contains(t, err.Error(), "exceeds max payload")
+
+	obs, err := acc.CreateObjectStore(&ObjectStoreConfig{Bucket: "OBJS", Storage: FileStorage, ChunkSize: 1000})
+	require_NoError(t, err)
+
+	data := make([]byte, 10_500)
+	rand.Read(data)
+	info, err := obs.PutBytes("blob", data)
+	require_NoError(t, err)
+	require_True(t, info.Size == uint64(len(data)))
+	require_True(t, info.Chunks == 11)
+
+	readAll := func(r *ObjectReader) []byte {
+		t.Helper()
+		b, err := io.ReadAll(r)
+		require_NoError(t, err)
+		return b
+	}
+	r, err := obs.Get("blob")
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(readAll(r), data))
+
+	// Resume an interrupted read from the offset we got to.
+	r, err = obs.Get("blob")
+	require_NoError(t, err)
+	buf := make([]byte, 2500)
+	_, err = io.ReadFull(r, buf)
+	require_NoError(t, err)
+	require_True(t, r.Offset() == 2500)
+	r, err = obs.GetAt("blob", r.Offset())
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(readAll(r), data[2500:]))
+	_, err = obs.GetAt("blob", uint64(len(data)+1))
+	require_Error(t, err, ErrBadObjectOffset)
+
+	// Buckets use the same layout as the clients.
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	cobs, err := js.ObjectStore("OBJS")
+	require_NoError(t, err)
+	cdata, err := cobs.GetBytes("blob")
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(cdata, data))
+
+	// Replacing an object drops the chunks of the previous version.
+	_, err = obs.PutBytes("blob", []byte("small"))
+	require_NoError(t, err)
+	_, err = obs.PutBytes("other", []byte("other"))
+	require_NoError(t, err)
+	mset, err := acc.lookupStream("OBJ_OBJS")
+	require_NoError(t, err)
+	require_True(t, mset.state().Msgs == 4)
+
+	r, err = obs.Get("blob")
+	require_NoError(t, err)
+	require_True(t, string(readAll(r)) == "small")
+
+	infos, err := obs.List()
+	require_NoError(t, err)
+	require_True(t, len(infos) == 2)
+
+	require_NoError(t, obs.Delete("blob"))
+	_, err = obs.Get("blob")
+	require_Error(t, err, ErrObjectNotFound)
+	infos, err = obs.List()
+	require_NoError(t, err)
+	require_True(t, len(infos) == 1 && infos[0].Name == "other")
+
+	require_NoError(t, acc.DeleteObjectStore("OBJS"))
+	_, err = acc.ObjectStore("OBJS")
+	require_Error(t, err)
+}
+
+func TestJetStreamMsgInterceptors(t *testing.T) {
+	block := make(chan struct{})
+	defer close(block)
+
+	opts := DefaultTestOptions
+	opts.Port = -1
+	opts.JetStream = true
+	opts.StoreDir = t.TempDir()
+	opts.MsgInterceptTimeout = 50 * time.Millisecond
+	opts.MsgInterceptWorkers = 2
+	opts.MsgInterceptors = []MsgInterceptor{
+		&testMsgInterceptor{name: "schema", fn: func(_ context.Context, m *InterceptedMsg) error {
+			if !json.Valid(m.Data) {
+				return fmt.Errorf("payload is not JSON")
+			}
+			return nil
+		}},
+		&testMsgInterceptor{name: "tagger", fn: func(ctx context.Context, m *InterceptedMsg) error {
+			switch string(m.Data) {
+			case `"slow"`:
+				select {
+				case <-block:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			case `"late"`:
+				time.Sleep(75 * time.Millisecond)
+			case `"panic"`:
+				panic("boom")
+			}
+			if m.GetHeader("Tag") != _EMPTY_ {
+				m.SetHeader("Tag", "replaced")
+			} else {
+				m.SetHeader("Tag", m.Account+"/"+m.Stream+"/"+m.Subject)
+			}
+			return nil
+		}},
+	}
+	s := RunServer(&opts)
+	defer s.Shutdown()
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	// Annotated.
+	_, err = js.Publish("foo", []byte(`{"ok":true}`))
+	require_NoError(t, err)
+	m, err := js.GetMsg("TEST", 1)
+	require_NoError(t, err)
+	require_True(t, m.Header.Get("Tag") == "$G/TEST/foo")
+
+	// Existing headers are kept, replaced ones are not duplicated.
+	msg := nats.NewMsg("foo")
+	msg.Header.Set("Tag", "mine")
+	msg.Header.Set("Other", "kept")
+	msg.Data = []byte(`1`)
+	_, err = js.PublishMsg(msg)
+	require_NoError(t, err)
+	m, err = js.GetMsg("TEST", 2)
+	require_NoError(t, err)
+	require_True(t, len(m.Header.Values("Tag")) == 1)
+	require_True(t, m.Header.Get("Tag") == "replaced")
+	require_True(t, m.Header.Get("Other") == "kept")
+
+	// Rejected, too slow and panics are all errors returned to the publisher.
+	for _, test := range []struct {
+		data   string
+		errTxt string
+	}{
+		{"not json", "rejected by interceptor schema: payload is not JSON"},
+		{`"slow"`, "rejected by interceptor tagger: time budget exceeded"},
+		{`"late"`, "rejected by interceptor tagger: time budget exceeded"},
+		{`"panic"`, "rejected by interceptor tagger: panic: boom"},
+	} {
+		_, err = js.Publish("foo", []byte(test.data))
+		require_Error(t, err)
+		require_Contains(t, err.Error(), test.errTxt)
+	}
+
+	si, err := js.StreamInfo("TEST")
+	require_NoError(t, err)
+	require_True(t, si.State.Msgs == 2)
+
+	stats := s.MsgInterceptorStats()
+	require_True(t, len(stats) == 2)
+	require_True(t, stats[0].Name == "schema" && stats[0].Calls == 6 && stats[0].Rejected == 1)
+	require_True(t, stats[1].Name == "tagger" && stats[1].Calls == 5 && stats[1].Rejected == 3)
+	require_True(t, stats[1].Timeouts == 2 && stats[1].Panics == 1)
+	require_True(t, stats[1].MaxTime >= 50*time.Millisecond)
+
+	jsz, err := s.Jsz(nil)
+	require_NoError(t, err)
+	require_True(t, len(jsz.Interceptors) == 2)
+
+	// Slow interceptors do not cost a Go routine per message.
+	base := runtime.NumGoroutine()
+	var futures []nats.PubAckFuture
+	for i := 0; i < 20; i++ {
+		pf, err := js.PublishAsync("foo", []byte(`"slow"`))
+		require_NoError(t, err)
+		futures = append(futures, pf)
+	}
+	if n := runtime.NumGoroutine(); n > base+opts.MsgInterceptWorkers {
+		t.Fatalf("Expected Go routines to be bounded by the workers, went from %d to %d", base, n)
+	}
+	// The connection is still served while the interceptors are busy.
+	rtt, err := nc.RTT()
+	require_NoError(t, err)
+	require_True(t, rtt < 50*time.Millisecond)
+	for _, pf := range futures {
+		select {
+		case <-pf.Ok():
+			t.Fatalf("Expected slow message to be rejected")
+		case err := <-pf.Err():
+			require_Contains(t, err.Error(), "time budget exceeded")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive a response")
+		}
+	}
+}
+
+func TestJetStreamConsumerSharedDeliveryScheduler(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {store_dir: %q, delivery_workers: 2}
+	`, t.TempDir())))
+
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+	require_True(t, opts.JetStreamSchedWorkers == 2)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+
+	// File stores have a flusher per consumer, which is not about delivery.
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}, Storage: nats.MemoryStorage})
+	require_NoError(t, err)
+
+	const toSend = 200
+	for i := 0; i < toSend; i++ {
+		_, err := js.Publish("foo", []byte("OK"))
+		require_NoError(t, err)
+	}
+
+	base := runtime.NumGoroutine()
+
+	// Many push consumers, each more than a single run quantum behind.
+	const numPush = 50
+	var subs []*nats.Subscription
+	for i := 0; i < numPush; i++ {
+		sub, err := js.SubscribeSync("foo", nats.Durable(fmt.Sprintf("P%d", i)), nats.AckExplicit())
+		require_NoError(t, err)
+		subs = append(subs, sub)
+	}
+	// Consumers do not get their own Go routines, whatever is added is
+	// bounded by the workers and not by the number of consumers.
+	if n := runtime.NumGoroutine(); n > base+2*opts.JetStreamSchedWorkers {
+		t.Fatalf("Expected no Go routines per consumer, went from %d to %d", base, n)
+	}
+	for _, sub := range subs {
+		for i := 0; i < toSend; i++ {
+			m, err := sub.NextMsg(2 * time.Second)
+			require_NoError(t, err)
+			require_NoError(t, m.AckSync())
+		}
+	}
+	for i := 0; i < numPush; i++ {
+		ci, err := js.ConsumerInfo("TEST", fmt.Sprintf("P%d", i))
+		require_NoError(t, err)
+		require_True(t, ci.PushBound)
+		require_True(t, ci.NumAckPending == 0)
+		require_True(t, ci.Delivered.Stream == toSend)
+	}
+
+	// Pull consumers are served as well.
+	psub, err := js.PullSubscribe("foo", "PULL")
+	require_NoError(t, err)
+	for received := 0; received < toSend; {
+		msgs, err := psub.Fetch(50, nats.MaxWait(2*time.Second))
+		require_NoError(t, err)
+		for _, m := range msgs {
+			require_NoError(t, m.Ack())
+		}
+		received += len(msgs)
+	}
+
+	// Redeliveries are driven by the scheduler's timers, not a timer per consumer.
+	rsub, err := js.SubscribeSync("foo", nats.Durable("RD"), nats.AckWait(100*time.Millisecond), nats.DeliverLast())
+	require_NoError(t, err)
+	m, err := rsub.NextMsg(time.Second)
+	require_NoError(t, err)
+	md, err := m.Metadata()
+	require_NoError(t, err)
+	require_True(t, md.NumDelivered == 1)
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	o := mset.lookupConsumer("RD")
+	o.mu.RLock()
+	ptmr := o.ptmr
+	o.mu.RUnlock()
+	require_True(t, ptmr == nil)
+	m, err = rsub.NextMsg(time.Second)
+	require_NoError(t, err)
+	md, err = m.Metadata()
+	require_NoError(t, err)
+	require_True(t, md.NumDelivered == 2)
+	require_NoError(t, m.AckSync())
+
+	// Idle heartbeats are sent from the scheduler's timers.
+	hbsub, err := nc.SubscribeSync("hb.inbox")
+	require_NoError(t, err)
+	_, err = js.AddConsumer("TEST", &nats.ConsumerConfig{
+		Durable:        "HB",
+		DeliverSubject: "hb.inbox",
+		DeliverPolicy:  nats.DeliverNewPolicy,
+		Heartbeat:      100 * time.Millisecond,
+	})
+	require_NoError(t, err)
+	m, err = hbsub.NextMsg(time.Second)
+	require_NoError(t, err)
+	require_True(t, m.Header.Get("Status") == "100")
+
+	st := s.DeliverySchedulerStats()
+	require_True(t, st != nil)
+	require_True(t, st.Workers == 2)
+	require_True(t, st.Consumers == numPush+3)
+	require_True(t, st.Runs > 0)
+	// Every push consumer had more than a quantum of messages to deliver.
+	require_True(t, st.Yields >= numPush)
+
+	jsz, err := s.Jsz(nil)
+	require_NoError(t, err)
+	require_True(t, jsz.Scheduler != nil && jsz.Scheduler.Workers == 2)
+}
+
+func TestJetStreamStreamStoreTuningUpdate(t *testing.T) {
+	s := RunBasicJetStreamServer(t)
+	defer s.Shutdown()
+
+	acc := s.GlobalAccount()
+	cfg := &StreamConfig{
+		Name:        "TEST",
+		Subjects:    []string{"foo"},
+		Storage:     FileStorage,
+		StoreTuning: &StoreTuning{SyncInterval: time.Minute},
+	}
+	mset, err := acc.addStream(cfg)
+	require_NoError(t, err)
+
+	fs := mset.store.(*fileStore)
+	fcfg := func() FileStoreConfig {
+		fs.mu.RLock()
+		defer fs.mu.RUnlock()
+		return fs.fcfg
+	}
+	require_True(t, fcfg().SyncInterval == time.Minute)
+	require_True(t, fcfg().CacheExpire == defaultCacheBufferExpiration)
+
+	// Changes are applied to the live store.
+	cfg.StoreTuning = &StoreTuning{
+		CacheExpire:     5 * time.Second,
+		SyncInterval:    30 * time.Second,
+		CoalesceMinimum: 4096,
+		MaxFlushWait:    10 * time.Millisecond,
+	}
+	require_NoError(t, mset.update(cfg))
+	got := fcfg()
+	require_True(t, got.CacheExpire == 5*time.Second)
+	require_True(t, got.SyncInterval == 30*time.Second)
+	require_True(t, got.CoalesceMinimum == 4096)
+	require_True(t, got.MaxFlushWait == 10*time.Millisecond)
+
+	// Removing the tuning goes back to the defaults.
+	cfg.StoreTuning = nil
+	require_NoError(t, mset.update(cfg))
+	got = fcfg()
+	require_True(t, got.CacheExpire == defaultCacheBufferExpiration)
+	require_True(t, got.SyncInterval == streamSyncInterval)
+	require_True(t, got.CoalesceMinimum == coalesceMinimum)
+	require_True(t, got.MaxFlushWait == maxFlushWait)
+
+	// Only for file storage and no negative values.
+	cfg.StoreTuning = &StoreTuning{SyncInterval: -time.Second}
+	require_Error(t, mset.update(cfg))
+	_, err = acc.addStream(&StreamConfig{Name: "MEM", Subjects: []string{"bar"}, Storage: MemoryStorage, StoreTuning: &StoreTuning{CacheExpire: time.Second}})
+	require_Error(t, err)
+}
@@ -17,9 +17,11 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"math/rand"
 	"net"
 	"net/http"
@@ -75,6 +77,11 @@ type leaf struct {
 	remoteServer string
 	// domain name of remote server
 	remoteDomain string
+	// The account the other side of this connection is bound to.
+	remoteAccName string
+	// Weight of queue members reached through this connection. Set
+	// at creation and not changed after.
+	queueWeight float64
 	// Used to suppress sub and unsub interest. Same as routes but our audience
 	// here is tied to this leaf node. This will hold all subscriptions except this
 	// leaf nodes. This represents all the interest we want to send to the other side.
@@ -88,6 +95,70 @@ type leaf struct {
 	// we would add it a second time in the smap causing later unsub to suppress the LS-.
 	tsub  map[*subscription]struct{}
 	tsubt *time.Timer
+	// Interest updates held when coalescing, with the interest the other
+	// side knew of before the first held update.
+	psubs  map[string]int32
+	psubst *time.Timer
+	// Version of the remote server.
+	remoteVersion string
+	// Features supported by both sides.
+	features uint32
+	// Number of messages that had their headers dropped since the remote does not support them.
+	hdrsDropped uint64
+	// Set once the connection has been added to the server's leafnodes.
+	established bool
+}
+
+// Leafnode features exchanged in the CONNECT and INFO protocols so that
+// deployments with mixed server versions only use what both sides support.
+// Only add a feature here once it is advertised and acted on.
+const (
+	leafFeatureHeaders uint32 = 1 << iota
+)
+
+var leafFeatureNames = []struct {
+	f    uint32
+	name string
+}{
+	{leafFeatureHeaders, "headers"},
+}
+
+// Returns the leafnode features this server supports.
+func (s *Server) leafFeatures() uint32 {
+	var f uint32
+	if s.supportsHeaders() {
+		f |= leafFeatureHeaders
+	}
+	return f
+}
+
+// Returns the features both sides support. Servers that predate the features
+// bitmap will not send one, so derive it from the individual fields instead.
+func negotiateLeafFeatures(local, remote uint32, remoteHeaders bool) uint32 {
+	if remote == 0 && remoteHeaders {
+		remote = leafFeatureHeaders
+	}
+	return local & remote
+}
+
+// Warn if we support headers but the remote does not, since they will be
+// dropped from messages sent across this connection.
+// Lock should be held.
+func (c *client) warnIfLeafHeadersNotSupported() {
+	if !c.headers && c.srv.supportsHeaders() {
+		c.Warnf("Remote leafnode %q does not support headers, headers will be dropped from messages", c.leaf.remoteServer)
+	}
+}
+
+// Returns the names of the given features.
+func leafFeatureList(features uint32) []string {
+	var names []string
+	for _, fn := range leafFeatureNames {
+		if features&fn.f != 0 {
+			names = append(names, fn.name)
+		}
+	}
+	return names
 }
 
 // Used for remote (solicited) leafnodes.
@@ -256,10 +327,31 @@ func validateLeafNode(o *Options) error {
 		}
 	}
 
+	// Only HTTP and SOCKS5 proxies are supported and queue weights can not be negative.
+	for _, rcfg := range o.LeafNode.Remotes {
+		if p := rcfg.Proxy; p != nil && ((p.Scheme != "http" && p.Scheme != "socks5") || p.Host == _EMPTY_) {
+			return fmt.Errorf("remote leaf node proxy %q must be an http or socks5 url", redactURLString(p.String()))
+		}
+		if rcfg.QueueWeight != nil && *rcfg.QueueWeight < 0 {
+			return fmt.Errorf("remote leaf node queue weight can not be negative, got %v", *rcfg.QueueWeight)
+		}
+	}
+
+	if o.LeafNode.WatchInterval < 0 {
+		return fmt.Errorf("leafnode watch interval can not be negative, got %v", o.LeafNode.WatchInterval)
+	}
+	if o.LeafNode.InterestCoalesce < 0 {
+		return fmt.Errorf("leafnode interest coalesce can not be negative, got %v", o.LeafNode.InterestCoalesce)
+	}
+
 	if o.LeafNode.Port == 0 {
 		return nil
 	}
 
+	if o.LeafNode.QueueWeight < 0 {
+		return fmt.Errorf("leafnode queue weight can not be negative, got %v", o.LeafNode.QueueWeight)
+	}
+
 	// If MinVersion is defined, check that it is valid.
 	if mv := o.LeafNode.MinVersion; mv != _EMPTY_ {
 		if err := checkLeafMinVersionConfig(mv); err != nil {
@@ -353,6 +445,168 @@ func (s *Server) reConnectToRemoteLeafNode(remote *leafNodeCfg) {
 	s.connectToRemoteLeafNode(remote, false)
 }
 
+// Returns the TLS configuration for accepted leafnode connections,
+// which is the one reloaded by the files watcher if any.
+func (s *Server) leafNodeTLSConfig(opts *Options) *tls.Config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if tc := s.leafNodeOpts.tlsConfig; tc != nil {
+		return tc
+	}
+	return opts.LeafNode.TLSConfig
+}
+
+// Starts watching the leafnode credentials and TLS files if a watch
+// interval is configured and the watcher is not already running.
+func (s *Server) startLeafNodeWatcher() {
+	opts := s.getOpts()
+	interval := opts.LeafNode.WatchInterval
+	if interval <= 0 || (opts.LeafNode.Port == 0 && len(opts.LeafNode.Remotes) == 0) {
+		return
+	}
+	s.mu.Lock()
+	if s.leafNodeOpts.watching {
+		s.mu.Unlock()
+		return
+	}
+	s.leafNodeOpts.watching = true
+	s.mu.Unlock()
+	s.startGoRoutine(func() { s.leafNodeWatchLoop(interval) })
+}
+
+// A watched file, per owner since the listener and the remotes may share
+// files and each needs to see the change.
+type leafWatchKey struct {
+	remote *leafNodeCfg // nil for the listener
+	path   string
+}
+
+// Periodically checks the leafnode credentials and TLS files for changes.
+// The interval can be changed or set to 0 by a configuration reload, in
+// which case the loop stops.
+func (s *Server) leafNodeWatchLoop(interval time.Duration) {
+	defer s.grWG.Done()
+
+	// Modification times of the watched files, the first check records them.
+	mtimes := make(map[leafWatchKey]time.Time)
+	s.checkLeafNodeFiles(mtimes)
+
+	t := time.NewTimer(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			interval = s.getOpts().LeafNode.WatchInterval
+			if interval <= 0 {
+				s.mu.Lock()
+				s.leafNodeOpts.watching = false
+				s.mu.Unlock()
+				return
+			}
+			s.checkLeafNodeFiles(mtimes)
+			t.Reset(interval)
+		case <-s.quitCh:
+			return
+		}
+	}
+}
+
+// Returns a copy of the TLS configuration with the certificate loaded
+// again from its files. Other settings and hooks are kept.
+func reloadTLSCertificate(config *tls.Config, tc *TLSConfigOpts) (*tls.Config, error) {
+	// With OCSP stapling the certificate is returned by hooks that have
+	// their own copy, so only a configuration reload can replace it.
+	if config.GetCertificate != nil || config.GetClientCertificate != nil {
+		return nil, fmt.Errorf("certificate used for OCSP stapling, a configuration reload is required")
+	}
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing X509 certificate/key pair: %v", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %v", err)
+	}
+	config = config.Clone()
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// Reloads the leafnode listener TLS certificate and reconnects remotes
+// whose credentials or TLS files changed since the last check.
+func (s *Server) checkLeafNodeFiles(mtimes map[leafWatchKey]time.Time) {
+	changed := func(remote *leafNodeCfg, files ...string) bool {
+		var updated bool
+		for _, f := range files {
+			if f == _EMPTY_ {
+				continue
+			}
+			fi, err := os.Stat(f)
+			if err != nil {
+				continue
+			}
+			key := leafWatchKey{remote, f}
+			if mt, ok := mtimes[key]; ok && !mt.Equal(fi.ModTime()) {
+				updated = true
+			}
+			mtimes[key] = fi.ModTime()
+		}
+		return updated
+	}
+
+	opts := s.getOpts()
+	if tc := opts.LeafNode.tlsConfigOpts; tc != nil && changed(nil, tc.CertFile, tc.KeyFile) {
+		if config, err := reloadTLSCertificate(s.leafNodeTLSConfig(opts), tc); err != nil {
+			s.Errorf("Unable to reload leafnode TLS certificate: %v", err)
+		} else {
+			s.mu.Lock()
+			s.leafNodeOpts.tlsConfig = config
+			s.mu.Unlock()
+			s.Noticef("Reloaded leafnode TLS certificate")
+		}
+	}
+
+	s.mu.RLock()
+	remotes := append([]*leafNodeCfg(nil), s.leafRemoteCfgs...)
+	s.mu.RUnlock()
+
+	for _, cfg := range remotes {
+		cfg.RLock()
+		creds, tc, config := cfg.Credentials, cfg.tlsConfigOpts, cfg.TLSConfig
+		cfg.RUnlock()
+
+		credsChanged := changed(cfg, creds)
+		tlsChanged := tc != nil && config != nil && changed(cfg, tc.CertFile, tc.KeyFile)
+		if !credsChanged && !tlsChanged {
+			continue
+		}
+		if tlsChanged {
+			config, err := reloadTLSCertificate(config, tc)
+			if err != nil {
+				s.Errorf("Unable to reload remote leafnode TLS certificate: %v", err)
+				continue
+			}
+			cfg.Lock()
+			cfg.TLSConfig = config
+			cfg.Unlock()
+		}
+		// Credentials are read on connect, so reconnect to use the new files.
+		s.mu.RLock()
+		var lc *client
+		for _, c := range s.leafs {
+			if c.leaf.remote == cfg {
+				lc = c
+				break
+			}
+		}
+		s.mu.RUnlock()
+		if lc != nil {
+			lc.Noticef("Leafnode credentials changed, reconnecting")
+			lc.closeConnection(CredentialsChanged)
+		}
+	}
+}
+
 // Creates a leafNodeCfg object that wraps the RemoteLeafOpts.
 func newLeafNodeCfg(remote *RemoteLeafOpts) *leafNodeCfg {
 	cfg := &leafNodeCfg{
@@ -444,10 +698,174 @@ func (s *Server) setLeafNodeNonExportedOptions() {
 	if s.leafNodeOpts.resolver == nil {
 		s.leafNodeOpts.resolver = net.DefaultResolver
 	}
+	s.leafNodeOpts.queueWeight = opts.LeafNode.QueueWeight
+	s.leafNodeOpts.weighted = opts.LeafNode.QueueWeight > 0
+	s.leafNodeOpts.interestCoalesce = opts.LeafNode.InterestCoalesce
+	for _, r := range opts.LeafNode.Remotes {
+		if r.QueueWeight != nil && *r.QueueWeight > 0 {
+			s.leafNodeOpts.weighted = true
+		}
+	}
 }
 
 const sharedSysAccDelay = 250 * time.Millisecond
 
+// leafNodeProxyDial connects to the proxy and asks it to tunnel to addr.
+// The returned connection is to the remote server.
+func leafNodeProxyDial(proxy *url.URL, addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := natsDialTimeout("tcp", proxy.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	if proxy.Scheme == "socks5" {
+		err = leafNodeSOCKS5Connect(conn, proxy, addr)
+	} else {
+		conn, err = leafNodeHTTPConnect(conn, proxy, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// leafNodeHTTPConnect asks the HTTP proxy to tunnel to addr using a CONNECT request.
+func leafNodeHTTPConnect(conn net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxy.User; u != nil {
+		pass, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("proxy %q refused to connect to %q: %s", proxy.Host, addr, resp.Status)
+	}
+	// The remote may already have sent something, like its INFO, make sure it is not lost.
+	if n := br.Buffered(); n > 0 {
+		pre, _ := br.Peek(n)
+		return &tlsMixConn{conn, bytes.NewBuffer(pre)}, nil
+	}
+	return conn, nil
+}
+
+// SOCKS5 protocol values, see RFC 1928 and RFC 1929.
+const (
+	socks5Version      = 0x05
+	socks5AuthNone     = 0x00
+	socks5AuthUserPass = 0x02
+	socks5CmdConnect   = 0x01
+	socks5AddrIPv4     = 0x01
+	socks5AddrDomain   = 0x03
+	socks5AddrIPv6     = 0x04
+	socks5Succeeded    = 0x00
+)
+
+// leafNodeSOCKS5Connect asks the SOCKS5 proxy to tunnel to addr. The host is
+// sent as a domain name so that the proxy is the one resolving it.
+func leafNodeSOCKS5Connect(conn net.Conn, proxy *url.URL, addr string) error {
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.Atoi(sport)
+	if err != nil || port <= 0 || port > 0xffff {
+		return fmt.Errorf("invalid port in %q", addr)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("host name %q too long", host)
+	}
+
+	// Negotiate the authentication method.
+	methods := []byte{socks5AuthNone}
+	if proxy.User != nil {
+		methods = append(methods, socks5AuthUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socks5Version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var buf [262]byte
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return err
+	}
+	if buf[0] != socks5Version {
+		return fmt.Errorf("proxy %q is not a socks5 proxy", proxy.Host)
+	}
+	switch buf[1] {
+	case socks5AuthNone:
+	case socks5AuthUserPass:
+		if proxy.User == nil {
+			return fmt.Errorf("proxy %q requires credentials", proxy.Host)
+		}
+		user := proxy.User.Username()
+		pass, _ := proxy.User.Password()
+		if len(user) > 255 || len(pass) > 255 {
+			return fmt.Errorf("proxy %q credentials too long", proxy.Host)
+		}
+		req := []byte{0x01, byte(len(user))}
+		req = append(req, user...)
+		req = append(req, byte(len(pass)))
+		req = append(req, pass...)
+		if _, err := conn.Write(req); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+			return err
+		}
+		if buf[1] != socks5Succeeded {
+			return fmt.Errorf("proxy %q authentication failed", proxy.Host)
+		}
+	default:
+		return fmt.Errorf("proxy %q has no acceptable authentication method", proxy.Host)
+	}
+
+	// Now ask for the tunnel.
+	req := []byte{socks5Version, socks5CmdConnect, 0x00, socks5AddrDomain, byte(len(host))}
+	req = append(req, host...)
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return err
+	}
+	if buf[1] != socks5Succeeded {
+		return fmt.Errorf("proxy %q refused to connect to %q: reply code %d", proxy.Host, addr, buf[1])
+	}
+	// Skip the bound address and port.
+	var alen int
+	switch buf[3] {
+	case socks5AddrIPv4:
+		alen = net.IPv4len
+	case socks5AddrIPv6:
+		alen = net.IPv6len
+	case socks5AddrDomain:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return err
+		}
+		alen = int(buf[0])
+	default:
+		return fmt.Errorf("proxy %q replied with unknown address type %d", proxy.Host, buf[3])
+	}
+	_, err = io.ReadFull(conn, buf[:alen+2])
+	return err
+}
+
 func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool) {
 	defer s.grWG.Done()
 
@@ -489,7 +907,14 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 	attempts := 0
 	for s.isRunning() && s.remoteLeafNodeStillValid(remote) {
 		rURL := remote.pickNextURL()
-		url, err := s.getRandomIP(resolver, rURL.Host, nil)
+		var url string
+		var err error
+		// When going through a proxy, the proxy resolves the remote's host.
+		if remote.Proxy != nil {
+			url = rURL.Host
+		} else {
+			url, err = s.getRandomIP(resolver, rURL.Host, nil)
+		}
 		if err == nil {
 			var ipStr string
 			if url != rURL.Host {
@@ -501,7 +926,11 @@ func (s *Server) connectToRemoteLeafNode(remote *leafNodeCfg, firstConnect bool)
 				err = ErrLeafNodeDisabled
 			} else {
 				s.Debugf("Trying to connect as leafnode to remote server on %q%s", rURL.Host, ipStr)
-				conn, err = natsDialTimeout("tcp", url, dialTimeout)
+				if remote.Proxy != nil {
+					conn, err = leafNodeProxyDial(remote.Proxy, url, dialTimeout)
+				} else {
+					conn, err = natsDialTimeout("tcp", url, dialTimeout)
+				}
 			}
 		}
 		if err != nil {
@@ -685,6 +1114,7 @@ func (s *Server) startLeafNodeAcceptLoop() {
 		Domain:        opts.JetStreamDomain,
 		Proto:         1, // Fixed for now.
 		InfoOnConnect: true,
+		LeafFeatures:  s.leafFeatures(),
 	}
 	// If we have selected a random port...
 	if port == 0 {
@@ -744,9 +1174,14 @@ func (c *client) sendLeafConnect(clusterName string, tlsRequired, headers bool)
 		Hub:       c.leaf.remote.Hub,
 		Cluster:   clusterName,
 		Headers:   headers,
+		Features:  c.srv.leafFeatures(),
 		JetStream: c.acc.jetStreamConfigured(),
 		DenyPub:   c.leaf.remote.DenyImports,
 	}
+	// Disclose the local account name unless configured not to.
+	if !c.leaf.remote.HideLocalAccount {
+		cinfo.LocalAcc = c.acc.Name
+	}
 
 	// If a signature callback is specified, this takes precedence over anything else.
 	if cb := c.leaf.remote.SignatureCB; cb != nil {
@@ -890,7 +1325,7 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 
 	c := &client{srv: s, nc: conn, kind: LEAF, opts: defaultOpts, mpay: maxPay, msubs: maxSubs, start: now, last: now}
 	// Do not update the smap here, we need to do it in initLeafNodeSmapAndSendSubs
-	c.leaf = &leaf{}
+	c.leaf = &leaf{queueWeight: s.leafNodeOpts.queueWeight}
 
 	// For accepted LN connections, ws will be != nil if it was accepted
 	// through the Websocket port.
@@ -918,6 +1353,9 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 			remote.LocalAccount = globalAccountName
 		}
 		lacc := remote.LocalAccount
+		if remote.QueueWeight != nil {
+			c.leaf.queueWeight = *remote.QueueWeight
+		}
 		remote.Unlock()
 
 		var err error
@@ -934,6 +1372,12 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 		remoteSuffix = fmt.Sprintf(" for account: %s", acc.traceLabel())
 	}
 
+	// The listener's TLS configuration may have been reloaded by the files watcher.
+	var tlsConfig *tls.Config
+	if remote == nil {
+		tlsConfig = s.leafNodeTLSConfig(opts)
+	}
+
 	c.mu.Lock()
 	c.initClient()
 	c.Noticef("Leafnode connection created%s %s", remoteSuffix, c.opts.Name)
@@ -997,6 +1441,13 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 		// We will process the INFO from the readloop and finish by
 		// sending the CONNECT and finish registration later.
 	} else {
+		// Check the per address connection limits before sending our info.
+		if err := c.acquireConnLimit(s.leafConnLimiter); err != nil {
+			c.mu.Unlock()
+			c.connLimitExceeded(err)
+			return nil
+		}
+
 		// Send our info to the other side.
 		// Remember the nonce we sent here for signatures, etc.
 		c.nonce = make([]byte, nonceLen)
@@ -1022,7 +1473,7 @@ func (s *Server) createLeafNode(conn net.Conn, rURL *url.URL, remote *leafNodeCf
 		// Check to see if we need to spin up TLS.
 		if !c.isWebsocket() && info.TLSRequired {
 			// Perform server-side TLS handshake.
-			if err := c.doTLSServerHandshake("leafnode", opts.LeafNode.TLSConfig, opts.LeafNode.TLSTimeout, opts.LeafNode.TLSPinnedCerts); err != nil {
+			if err := c.doTLSServerHandshake("leafnode", tlsConfig, opts.LeafNode.TLSTimeout, opts.LeafNode.TLSPinnedCerts); err != nil {
 				c.mu.Unlock()
 				return nil
 			}
@@ -1101,8 +1552,9 @@ func (c *client) processLeafnodeInfo(info *Info) {
 		if info.TLSRequired && c.leaf.remote != nil {
 			c.leaf.remote.TLS = true
 		}
-		supportsHeaders := c.srv.supportsHeaders()
-		c.headers = supportsHeaders && info.Headers
+		c.leaf.features = negotiateLeafFeatures(c.srv.leafFeatures(), info.LeafFeatures, info.Headers)
+		c.headers = c.leaf.features&leafFeatureHeaders != 0
+		c.leaf.remoteVersion = info.Version
 
 		// Remember the remote server.
 		// Pre 2.2.0 servers are not sending their server name.
@@ -1115,6 +1567,7 @@ func (c *client) processLeafnodeInfo(info *Info) {
 		}
 		c.leaf.remoteDomain = info.Domain
 		c.leaf.remoteCluster = info.Cluster
+		c.warnIfLeafHeadersNotSupported()
 	}
 
 	// For both initial INFO and async INFO protocols, Possibly
@@ -1162,6 +1615,7 @@ func (c *client) processLeafnodeInfo(info *Info) {
 	// Check if we have the remote account information and if so make sure it's stored.
 	if info.RemoteAccount != _EMPTY_ {
 		s.leafRemoteAccounts.Store(c.acc.Name, info.RemoteAccount)
+		c.leaf.remoteAccName = info.RemoteAccount
 	}
 	c.mu.Unlock()
 
@@ -1291,6 +1745,7 @@ func (s *Server) addLeafNodeConnection(c *client, srvName, clusterName string, c
 	mySrvName := c.leaf.remoteServer
 	myClustName := c.leaf.remoteCluster
 	solicited := c.leaf.remote != nil
+	c.leaf.established = true
 	c.mu.Unlock()
 
 	var old *client
@@ -1332,6 +1787,9 @@ func (s *Server) addLeafNodeConnection(c *client, srvName, clusterName string, c
 		return fmt.Sprintf("%s/%s", mySrvName, myClustName)
 	}
 
+	s.sendWebhookEvent(WebhookLeafNodeConnect, &WebhookEvent{Remote: srvDecorated(), Account: accName})
+	s.leafNodeConnectEvent(c)
+
 	opts := s.getOpts()
 	sysAcc := s.SystemAccount()
 	js := s.getJetStream()
@@ -1442,17 +1900,36 @@ func (s *Server) addLeafNodeConnection(c *client, srvName, clusterName string, c
 }
 
 func (s *Server) removeLeafNodeConnection(c *client) {
+	var remote, accName string
 	c.mu.Lock()
 	cid := c.cid
-	if c.leaf != nil && c.leaf.tsubt != nil {
-		c.leaf.tsubt.Stop()
-		c.leaf.tsubt = nil
+	if c.leaf != nil {
+		if c.leaf.tsubt != nil {
+			c.leaf.tsubt.Stop()
+			c.leaf.tsubt = nil
+		}
+		if c.leaf.psubst != nil {
+			c.leaf.psubst.Stop()
+			c.leaf.psubst = nil
+		}
+		remote = c.leaf.remoteServer
+		if c.leaf.remoteCluster != _EMPTY_ {
+			remote = fmt.Sprintf("%s/%s", remote, c.leaf.remoteCluster)
+		}
+	}
+	if c.acc != nil {
+		accName = c.acc.Name
 	}
 	c.mu.Unlock()
 	s.mu.Lock()
+	_, registered := s.leafs[cid]
 	delete(s.leafs, cid)
 	s.mu.Unlock()
 	s.removeFromTempClients(cid)
+
+	if registered {
+		s.sendWebhookEvent(WebhookLeafNodeDisconnect, &WebhookEvent{Remote: remote, Account: accName})
+	}
 }
 
 // Connect information for solicited leafnodes.
@@ -1470,8 +1947,10 @@ type leafConnectInfo struct {
 	Hub       bool     `json:"is_hub,omitempty"`
 	Cluster   string   `json:"cluster,omitempty"`
 	Headers   bool     `json:"headers,omitempty"`
+	Features  uint32   `json:"features,omitempty"`
 	JetStream bool     `json:"jetstream,omitempty"`
 	DenyPub   []string `json:"deny_pub,omitempty"`
+	LocalAcc  string   `json:"local_account,omitempty"`
 
 	// Just used to detect wrong connection attempts.
 	Gateway string `json:"gateway,omitempty"`
@@ -1531,8 +2010,8 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 		}
 	}
 
-	// Check if this server supports headers.
-	supportHeaders := c.srv.supportsHeaders()
+	// Determine what features both sides support.
+	features := negotiateLeafFeatures(c.srv.leafFeatures(), proto.Features, proto.Headers)
 
 	c.mu.Lock()
 	// Leaf Nodes do not do echo or verbose or pedantic.
@@ -1542,7 +2021,9 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 	// This inbound connection will be marked as supporting headers if this server
 	// support headers and the remote has sent in the CONNECT protocol that it does
 	// support headers too.
-	c.headers = supportHeaders && proto.Headers
+	c.leaf.features = features
+	c.headers = features&leafFeatureHeaders != 0
+	c.leaf.remoteVersion = proto.Version
 
 	// Remember the remote server.
 	c.leaf.remoteServer = proto.Name
@@ -1558,6 +2039,17 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 	}
 
 	c.leaf.remoteDomain = proto.Domain
+	c.leaf.remoteAccName = proto.LocalAcc
+	c.warnIfLeafHeadersNotSupported()
+
+	// Merge the deny permissions configured for all accepted leafnode connections. Like user
+	// permissions these are from the soliciting leafnode's point of view and reversed below.
+	if lo := &s.getOpts().LeafNode; len(lo.DenyImports) > 0 || len(lo.DenyExports) > 0 {
+		c.mergeDenyPermissions(pub, lo.DenyImports)
+		c.mergeDenyPermissions(sub, lo.DenyExports)
+		c.opts.Export = mergeSubjectPermissionDeny(c.opts.Export, lo.DenyImports)
+		c.opts.Import = mergeSubjectPermissionDeny(c.opts.Import, lo.DenyExports)
+	}
 
 	// When a leaf solicits a connection to a hub, the perms that it will use on the soliciting leafnode's
 	// behalf are correct for them, but inside the hub need to be reversed since data is flowing in the opposite direction.
@@ -1597,6 +2089,21 @@ func (c *client) processLeafNodeConnect(s *Server, arg []byte, lang string) erro
 	return nil
 }
 
+// Returns a copy of the subject permission with the deny subjects added.
+// The original is not modified since it may be shared with the user's permissions.
+func mergeSubjectPermissionDeny(sp *SubjectPermission, deny []string) *SubjectPermission {
+	if len(deny) == 0 {
+		return sp
+	}
+	nsp := &SubjectPermission{}
+	if sp != nil {
+		nsp.Allow = append([]string(nil), sp.Allow...)
+		nsp.Deny = append([]string(nil), sp.Deny...)
+	}
+	nsp.Deny = append(nsp.Deny, deny...)
+	return nsp
+}
+
 // Returns the remote cluster name. This is set only once so does not require a lock.
 func (c *client) remoteCluster() string {
 	if c.leaf == nil {
@@ -1865,7 +2372,7 @@ func (c *client) updateSmap(sub *subscription, delta int32) {
 		delete(c.leaf.smap, key)
 	}
 	if update {
-		c.sendLeafNodeSubUpdate(key, n)
+		c.sendLeafNodeSubUpdate(key, n-delta, n, !isLeafReplySubject(key))
 	}
 	c.mu.Unlock()
 }
@@ -1884,12 +2391,22 @@ func (c *client) forceAddToSmap(subj string) {
 	}
 	// Place into the map since it was not there.
 	c.leaf.smap[subj] = 1
-	c.sendLeafNodeSubUpdate(subj, 1)
+	c.sendLeafNodeSubUpdate(subj, 0, 1, false)
+}
+
+// Returns true if the subscription is for replies. Interest in those is
+// needed before the responses come in, so it is never coalesced.
+func isLeafReplySubject(key string) bool {
+	return strings.HasPrefix(key, replyPrefix) ||
+		strings.HasPrefix(key, gwReplyPrefix) ||
+		strings.HasPrefix(key, oldGWReplyPrefix) ||
+		strings.HasPrefix(key, "_INBOX.")
 }
 
-// Send the subscription interest change to the other side.
+// Send the subscription interest change from prev to n to the other side.
+// If coalesce is false the update is sent right away, even when coalescing.
 // Lock should be held.
-func (c *client) sendLeafNodeSubUpdate(key string, n int32) {
+func (c *client) sendLeafNodeSubUpdate(key string, prev, n int32, coalesce bool) {
 	// If we are a spoke, we need to check if we are allowed to send this subscription over to the hub.
 	if c.isSpokeLeafNode() {
 		checkPerms := true
@@ -1904,6 +2421,23 @@ func (c *client) sendLeafNodeSubUpdate(key string, n int32) {
 			return
 		}
 	}
+	// If coalescing, hold the update, the resulting interest is sent when the timer fires.
+	if d := c.srv.leafNodeOpts.interestCoalesce; d > 0 && coalesce {
+		if c.leaf.psubs == nil {
+			c.leaf.psubs = make(map[string]int32)
+		}
+		if _, ok := c.leaf.psubs[key]; !ok {
+			c.leaf.psubs[key] = prev
+		}
+		if c.leaf.psubst == nil {
+			c.leaf.psubst = time.AfterFunc(d, c.flushLeafNodeSubUpdates)
+		}
+		return
+	}
+	// The other side now knows of this interest, a held update is obsolete.
+	if c.leaf.psubs != nil {
+		delete(c.leaf.psubs, key)
+	}
 	// If we are here we can send over to the other side.
 	_b := [64]byte{}
 	b := bytes.NewBuffer(_b[:0])
@@ -1911,6 +2445,31 @@ func (c *client) sendLeafNodeSubUpdate(key string, n int32) {
 	c.enqueueProto(b.Bytes())
 }
 
+// Sends the interest updates held while coalescing. Nothing is sent for
+// subjects whose interest is back to what the other side knew of.
+func (c *client) flushLeafNodeSubUpdates() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	psubs := c.leaf.psubs
+	c.leaf.psubs, c.leaf.psubst = nil, nil
+	if c.isClosed() || c.leaf.smap == nil {
+		return
+	}
+	var b bytes.Buffer
+	for key, prev := range psubs {
+		n := c.leaf.smap[key]
+		// Queue updates carry the weight, others only the presence of interest.
+		if n == prev || (!strings.Contains(key, " ") && (n > 0) == (prev > 0)) {
+			continue
+		}
+		c.writeLeafSub(&b, key, n)
+	}
+	if b.Len() > 0 {
+		c.enqueueProto(b.Bytes())
+	}
+}
+
 // Helper function to build the key.
 func keyFromSub(sub *subscription) string {
 	var _rkey [1024]byte
@@ -2100,7 +2659,7 @@ func (c *client) handleLeafNodeLoop(sendErr bool) {
 	// If we are here with "sendErr" false, it means that this is the server
 	// that received the error. The other side will have closed the connection,
 	// but does not hurt to close here too.
-	c.closeConnection(ProtocolViolation)
+	c.closeConnection(LeafNodeLoopDetected)
 }
 
 // processLeafUnsub will process an inbound unsub request for the remote leaf node.
@@ -2143,6 +2702,11 @@ func (c *client) processLeafUnsub(arg []byte) error {
 }
 
 func (c *client) processLeafHeaderMsgArgs(arg []byte) error {
+	// Headers are only sent over the link if both sides agreed to.
+	if !c.headers {
+		return ErrMsgHeadersNotSupported
+	}
+
 	// Unroll splitArgs to avoid runtime/heap issues
 	a := [MAX_MSG_ARGS][]byte{}
 	args := a[:0]
@@ -16,6 +16,8 @@ package server
 import (
 	"fmt"
 	"math/rand"
+	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 	"time"
@@ -30,8 +32,22 @@ type memStore struct {
 	fss       map[string]*SimpleState
 	maxp      int64
 	scb       StorageUpdateHandler
+	sqc       StorageQuotaChecker
+	rmh       StorageRemovalHandler
+	hist      []StreamConfigRevision
 	ageChk    *time.Timer
+	hlc       hlc
 	consumers int
+
+	// Spill over of the oldest messages to disk once the memory cap is hit.
+	spill   *fileStore
+	spmax   uint64
+	spsz    map[uint64]uint64
+	spbytes uint64
+	spseq   uint64
+	spcb    func(int64)
+	// Serializes writes to the spill store, which are done without our lock.
+	spmu sync.Mutex
 }
 
 func newMemStore(cfg *StreamConfig) (*memStore, error) {
@@ -47,6 +63,11 @@ func newMemStore(cfg *StreamConfig) (*memStore, error) {
 		maxp: cfg.MaxMsgsPer,
 		cfg:  *cfg,
 	}
+	// Start at the configured first sequence.
+	if cfg.FirstSeq > 1 {
+		ms.state.FirstSeq = cfg.FirstSeq
+		ms.state.LastSeq = cfg.FirstSeq - 1
+	}
 
 	return ms, nil
 }
@@ -61,6 +82,15 @@ func (ms *memStore) UpdateConfig(cfg *StreamConfig) error {
 
 	ms.mu.Lock()
 	ms.cfg = *cfg
+	// Sealed streams keep all of their messages, so stop expiring and enforcing limits.
+	if ms.cfg.Sealed {
+		if ms.ageChk != nil {
+			ms.ageChk.Stop()
+			ms.ageChk = nil
+		}
+		ms.mu.Unlock()
+		return nil
+	}
 	// Limits checks and enforcement.
 	ms.enforceMsgLimit()
 	ms.enforceBytesLimit()
@@ -110,7 +140,8 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 
 	// Check if we are discarding new messages when we reach the limit.
 	if ms.cfg.Discard == DiscardNew {
-		if asl && ms.cfg.DiscardNewPer {
+		// Tombstones are always accepted and replace the oldest message instead.
+		if asl && ms.cfg.DiscardNewPer && !isTombstone(hdr) {
 			return ErrMaxMsgsPerSubject
 		}
 		if ms.cfg.MaxMsgs > 0 && ms.state.Msgs >= uint64(ms.cfg.MaxMsgs) {
@@ -119,13 +150,14 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 				return ErrMaxMsgs
 			}
 		}
-		if ms.cfg.MaxBytes > 0 && ms.state.Bytes+uint64(len(msg)+len(hdr)) >= uint64(ms.cfg.MaxBytes) {
+		// Account for the full message size, including subject and overhead, the same way state.Bytes does.
+		if sz := ms.storedMsgSize(subj, hdr, msg); ms.cfg.MaxBytes > 0 && ms.state.Bytes+sz > uint64(ms.cfg.MaxBytes) {
 			if !asl {
 				return ErrMaxBytes
 			}
 			// If we are here we are at a subject maximum, need to determine if dropping last message gives us enough room.
 			sm, ok := ms.msgs[ss.First]
-			if !ok || memStoreMsgSize(sm.subj, sm.hdr, sm.msg) < uint64(len(msg)+len(hdr)) {
+			if !ok || ms.state.Bytes+sz-ms.msgSize(sm) > uint64(ms.cfg.MaxBytes) {
 				return ErrMaxBytes
 			}
 		}
@@ -164,7 +196,7 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 	sm.msg = sm.buf[len(hdr):]
 	ms.msgs[seq] = sm
 	ms.state.Msgs++
-	ms.state.Bytes += memStoreMsgSize(subj, hdr, msg)
+	ms.state.Bytes += ms.storedMsgSize(subj, hdr, msg)
 	ms.state.LastSeq = seq
 	ms.state.LastTime = now
 
@@ -195,14 +227,25 @@ func (ms *memStore) storeRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 }
 
 // StoreRawMsg stores a raw message with expected sequence number and timestamp.
+// The sequence must be the next one for this store, or 0 to have one assigned.
+// If ts is 0 we will assign a timestamp as StoreMsg would.
 func (ms *memStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int64) error {
 	ms.mu.Lock()
+	if ts == 0 {
+		ts = ms.hlc.now()
+	} else {
+		ms.hlc.observe(ts)
+	}
 	err := ms.storeRawMsg(subj, hdr, msg, seq, ts)
-	cb := ms.scb
+	cb, spill := ms.scb, ms.needsSpill()
 	ms.mu.Unlock()
 
 	if err == nil && cb != nil {
-		cb(1, int64(memStoreMsgSize(subj, hdr, msg)), seq, subj)
+		cb(1, int64(ms.storedMsgSize(subj, hdr, msg)), seq, subj)
+	}
+	// Move the oldest messages to disk if we are over our memory cap.
+	if spill {
+		ms.spillMsgs()
 	}
 
 	return err
@@ -210,21 +253,92 @@ func (ms *memStore) StoreRawMsg(subj string, hdr, msg []byte, seq uint64, ts int
 
 // Store stores a message.
 func (ms *memStore) StoreMsg(subj string, hdr, msg []byte) (uint64, int64, error) {
+	return ms.StoreMsgWithExpect(subj, hdr, msg, nil)
+}
+
+// StoreMsgWithExpect will store a message only if the expectations hold.
+func (ms *memStore) StoreMsgWithExpect(subj string, hdr, msg []byte, exp *StoreExpect) (uint64, int64, error) {
 	ms.mu.Lock()
-	seq, ts := ms.state.LastSeq+1, time.Now().UnixNano()
+	if ms.cfg.Sealed {
+		ms.mu.Unlock()
+		return 0, 0, ErrStoreSealed
+	}
+	if err := ms.checkExpect(subj, exp); err != nil {
+		ms.mu.Unlock()
+		return 0, 0, err
+	}
+	if ms.sqc != nil && !ms.sqc(int64(ms.storedMsgSize(subj, hdr, msg))) {
+		ms.mu.Unlock()
+		return 0, 0, ErrStorageQuotaExceeded
+	}
+	seq, ts := ms.state.LastSeq+1, ms.hlc.now()
 	err := ms.storeRawMsg(subj, hdr, msg, seq, ts)
-	cb := ms.scb
+	cb, spill := ms.scb, ms.needsSpill()
 	ms.mu.Unlock()
 
 	if err != nil {
 		seq, ts = 0, 0
 	} else if cb != nil {
-		cb(1, int64(memStoreMsgSize(subj, hdr, msg)), seq, subj)
+		cb(1, int64(ms.storedMsgSize(subj, hdr, msg)), seq, subj)
+	}
+	// Move the oldest messages to disk if we are over our memory cap.
+	if err == nil && spill {
+		ms.spillMsgs()
 	}
 
 	return seq, ts, err
 }
 
+// Returns the sequence of the last message we still hold, which is not our
+// last sequence if that message has been removed.
+// Lock should be held.
+func (ms *memStore) lastMsgSeqLocked() uint64 {
+	if ms.state.Msgs == 0 {
+		return 0
+	}
+	if _, ok := ms.msgs[ms.state.LastSeq]; ok {
+		return ms.state.LastSeq
+	}
+	// Use our per subject state instead of walking back.
+	var seq uint64
+	for _, ss := range ms.fss {
+		if ss.Last > seq {
+			seq = ss.Last
+		}
+	}
+	return seq
+}
+
+// Check store expectations.
+// Lock should be held.
+func (ms *memStore) checkExpect(subj string, exp *StoreExpect) error {
+	if exp == nil {
+		return nil
+	}
+	if exp.LastSeq != nil && *exp.LastSeq != ms.state.LastSeq {
+		return ErrStoreWrongLastSequence
+	}
+	if exp.LastSubjSeq != nil {
+		var lseq uint64
+		if ss := ms.fss[subj]; ss != nil {
+			lseq = ss.Last
+		}
+		if *exp.LastSubjSeq != lseq {
+			return ErrStoreWrongLastSubjectSequence
+		}
+	}
+	if exp.LastMsgId != _EMPTY_ {
+		var id string
+		if sm := ms.msgs[ms.lastMsgSeqLocked()]; sm != nil {
+			id = string(getHeader(JSMsgId, ms.payload(sm).hdr))
+		}
+		if exp.LastMsgId != id {
+			return ErrStoreWrongLastMsgID
+		}
+	}
+	return nil
+}
+
 // SkipMsg will use the next sequence number but not store anything.
 func (ms *memStore) SkipMsg() uint64 {
 	// Grab time.
@@ -243,6 +357,30 @@ func (ms *memStore) SkipMsg() uint64 {
 	return seq
 }
 
+// SkipMsgs will use the next num sequence numbers starting at seq but not store anything.
+func (ms *memStore) SkipMsgs(seq uint64, num uint64) error {
+	// Grab time.
+	now := time.Now().UTC()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if seq != ms.state.LastSeq+1 {
+		return ErrSequenceMismatch
+	}
+	if num == 0 {
+		return nil
+	}
+	lseq := seq + num - 1
+	ms.state.LastSeq = lseq
+	ms.state.LastTime = now
+	if ms.state.Msgs == 0 {
+		ms.state.FirstSeq = lseq + 1
+		ms.state.FirstTime = now
+	}
+	return nil
+}
+
 // RegisterStorageUpdates registers a callback for updates to storage changes.
 // It will present number of messages and bytes as a signed integer and an
 // optional sequence number of the message if a single.
@@ -252,6 +390,51 @@ func (ms *memStore) RegisterStorageUpdates(cb StorageUpdateHandler) {
 	ms.mu.Unlock()
 }
 
+// RecordConfigRevision will add a revision to our config history.
+func (ms *memStore) RecordConfigRevision(rev StreamConfigRevision) error {
+	ms.mu.Lock()
+	ms.hist = addConfigRevision(ms.hist, rev)
+	ms.mu.Unlock()
+	return nil
+}
+
+// ConfigHistory returns the config revisions we have, oldest first.
+func (ms *memStore) ConfigHistory() []StreamConfigRevision {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return append([]StreamConfigRevision(nil), ms.hist...)
+}
+
+// RegisterStorageQuotaCheck registers a check that is consulted before storing a new
+// message. Replicated raw stores are not checked so replicas can not diverge.
+func (ms *memStore) RegisterStorageQuotaCheck(qc StorageQuotaChecker) {
+	ms.mu.Lock()
+	ms.sqc = qc
+	ms.mu.Unlock()
+}
+
+// RegisterStorageRemovals registers a handler that is given each message
+// right before it is removed because of limits or MaxAge.
+func (ms *memStore) RegisterStorageRemovals(rh StorageRemovalHandler) {
+	ms.mu.Lock()
+	ms.rmh = rh
+	ms.mu.Unlock()
+}
+
+// RegisterConsumerOrphanCheck is a no-op, consumer state is never left behind in memory.
+func (ms *memStore) RegisterConsumerOrphanCheck(ConsumerOrphanChecker) {}
+
+// Hands a message about to be removed by limits to the removal handler.
+// Lock should be held.
+func (ms *memStore) limitsRemoval(seq uint64) {
+	if ms.rmh == nil {
+		return
+	}
+	if sm, ok := ms.msgs[seq]; ok && sm != nil {
+		ms.rmh(ms.payload(sm))
+	}
+}
+
 // GetSeqFromTime looks for the first sequence number that has the message
 // with >= timestamp.
 // FIXME(dlc) - inefficient.
@@ -368,6 +551,41 @@ func (ms *memStore) SubjectsState(subject string) map[string]SimpleState {
 	return fss
 }
 
+// LastSeqsPerSubject returns the sequence of the last message for every subject
+// matching the filter in ascending order.
+func (ms *memStore) LastSeqsPerSubject(filterSubject string) []uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	var seqs []uint64
+	isAll := filterSubject == _EMPTY_ || filterSubject == fwcs
+	for subj, ss := range ms.fss {
+		if isAll || subjectIsSubsetMatch(subj, filterSubject) {
+			seqs = append(seqs, ss.Last)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs
+}
+
+// SubjectsTotals returns the message totals for all matching subjects.
+func (ms *memStore) SubjectsTotals(filterSubject string) map[string]uint64 {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	if len(ms.fss) == 0 {
+		return nil
+	}
+	isAll := filterSubject == _EMPTY_ || filterSubject == fwcs
+	fst := make(map[string]uint64)
+	for subj, ss := range ms.fss {
+		if isAll || subjectIsSubsetMatch(subj, filterSubject) {
+			fst[subj] = ss.Msgs
+		}
+	}
+	return fst
+}
+
 // Will check the msg limit for this tracked subject.
 // Lock should be held.
 func (ms *memStore) enforcePerSubjectLimit(ss *SimpleState) {
@@ -375,6 +593,7 @@ func (ms *memStore) enforcePerSubjectLimit(ss *SimpleState) {
 		return
 	}
 	for nmsgs := ss.Msgs; nmsgs > uint64(ms.maxp); nmsgs = ss.Msgs {
+		ms.limitsRemoval(ss.First)
 		if !ms.removeMsg(ss.First, false) {
 			break
 		}
@@ -406,7 +625,7 @@ func (ms *memStore) enforceBytesLimit() {
 // Will start the age check timer.
 // Lock should be held.
 func (ms *memStore) startAgeChk() {
-	if ms.ageChk == nil && ms.cfg.MaxAge != 0 {
+	if ms.ageChk == nil && ms.cfg.MaxAge != 0 && !ms.cfg.Sealed {
 		ms.ageChk = time.AfterFunc(ms.cfg.MaxAge, ms.expireMsgs)
 	}
 }
@@ -416,6 +635,14 @@ func (ms *memStore) expireMsgs() {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
 
+	if ms.cfg.Sealed {
+		if ms.ageChk != nil {
+			ms.ageChk.Stop()
+			ms.ageChk = nil
+		}
+		return
+	}
+
 	now := time.Now().UnixNano()
 	minAge := now - int64(ms.cfg.MaxAge)
 	for {
@@ -446,6 +673,9 @@ func (ms *memStore) PurgeEx(subject string, sequence, keep uint64) (purged uint6
 	if sequence > 1 && keep > 0 {
 		return 0, ErrPurgeArgMismatch
 	}
+	if ms.isSealed() {
+		return 0, ErrStoreSealed
+	}
 
 	if subject == _EMPTY_ || subject == fwcs {
 		if keep == 0 && (sequence == 0 || sequence == 1) {
@@ -496,6 +726,20 @@ func (ms *memStore) PurgeEx(subject string, sequence, keep uint64) (purged uint6
 // Purge will remove all messages from this store.
 // Will return the number of purged messages.
 func (ms *memStore) Purge() (uint64, error) {
+	if ms.isSealed() {
+		return 0, ErrStoreSealed
+	}
+	return ms.purge()
+}
+
+// Returns if the stream has been sealed, meaning no messages can be added or removed.
+func (ms *memStore) isSealed() bool {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.cfg.Sealed
+}
+
+func (ms *memStore) purge() (uint64, error) {
 	ms.mu.Lock()
 	purged := uint64(len(ms.msgs))
 	cb := ms.scb
@@ -506,6 +750,7 @@ func (ms *memStore) Purge() (uint64, error) {
 	ms.state.Msgs = 0
 	ms.msgs = make(map[uint64]*StoreMsg)
 	ms.fss = make(map[string]*SimpleState)
+	ms.purgeSpill()
 	ms.mu.Unlock()
 
 	if cb != nil {
@@ -538,9 +783,10 @@ func (ms *memStore) Compact(seq uint64) (uint64, error) {
 
 		for seq := seq - 1; seq > 0; seq-- {
 			if sm := ms.msgs[seq]; sm != nil {
-				bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+				bytes += ms.msgSize(sm)
 				purged++
 				delete(ms.msgs, seq)
+				ms.unspill(seq, false)
 			}
 		}
 		ms.state.Msgs -= purged
@@ -556,6 +802,7 @@ func (ms *memStore) Compact(seq uint64) (uint64, error) {
 		ms.state.FirstTime = time.Time{}
 		ms.state.LastSeq = seq - 1
 		ms.msgs = make(map[uint64]*StoreMsg)
+		ms.purgeSpill()
 	}
 	ms.mu.Unlock()
 
@@ -580,10 +827,16 @@ func (ms *memStore) Truncate(seq uint64) error {
 	for i := ms.state.LastSeq; i > seq; i-- {
 		if sm := ms.msgs[i]; sm != nil {
 			purged++
-			bytes += memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
-			delete(ms.msgs, seq)
+			bytes += ms.msgSize(sm)
+			delete(ms.msgs, i)
+			ms.unspill(i, false)
 		}
 	}
+	// The spill store needs to be able to take the sequences after seq again.
+	if ms.spill != nil && ms.spseq > seq {
+		ms.spill.Truncate(seq)
+		ms.spseq = seq
+	}
 	// Reset last.
 	ms.state.LastSeq = lsm.seq
 	ms.state.LastTime = time.Unix(0, lsm.ts).UTC()
@@ -600,7 +853,9 @@ func (ms *memStore) Truncate(seq uint64) error {
 	return nil
 }
 
+// Only used when enforcing limits and MaxAge.
 func (ms *memStore) deleteFirstMsgOrPanic() {
+	ms.limitsRemoval(ms.state.FirstSeq)
 	if !ms.deleteFirstMsg() {
 		panic("jetstream memstore has inconsistent state, can't find first seq msg")
 	}
@@ -615,6 +870,10 @@ func (ms *memStore) LoadMsg(seq uint64, smp *StoreMsg) (*StoreMsg, error) {
 	ms.mu.RLock()
 	sm, ok := ms.msgs[seq]
 	last := ms.state.LastSeq
+	var spill *fileStore
+	if ms.isSpilled(seq) {
+		spill = ms.spill
+	}
 	ms.mu.RUnlock()
 
 	if !ok || sm == nil {
@@ -624,6 +883,12 @@ func (ms *memStore) LoadMsg(seq uint64, smp *StoreMsg) (*StoreMsg, error) {
 		}
 		return nil, err
 	}
+	if spill != nil {
+		if sm, err := spill.LoadMsg(seq, smp); err == nil {
+			return sm, nil
+		}
+		return nil, ErrStoreMsgNotFound
+	}
 
 	if smp == nil {
 		smp = new(StoreMsg)
@@ -642,7 +907,7 @@ func (ms *memStore) LoadLastMsg(subject string, smp *StoreMsg) (*StoreMsg, error
 	defer ms.mu.RUnlock()
 
 	if subject == _EMPTY_ || subject == fwcs {
-		sm, ok = ms.msgs[ms.state.LastSeq]
+		sm, ok = ms.msgs[ms.lastMsgSeqLocked()]
 	} else if ss := ms.filteredStateLocked(1, subject); ss.Msgs > 0 {
 		sm, ok = ms.msgs[ss.Last]
 	}
@@ -653,7 +918,7 @@ func (ms *memStore) LoadLastMsg(subject string, smp *StoreMsg) (*StoreMsg, error
 	if smp == nil {
 		smp = new(StoreMsg)
 	}
-	sm.copy(smp)
+	ms.payload(sm).copy(smp)
 	return smp, nil
 }
 
@@ -720,7 +985,7 @@ func (ms *memStore) LoadNextMsg(filter string, wc bool, start uint64, smp *Store
 			if smp == nil {
 				smp = new(StoreMsg)
 			}
-			sm.copy(smp)
+			ms.payload(sm).copy(smp)
 			return smp, nseq, nil
 		}
 	}
@@ -731,6 +996,10 @@ func (ms *memStore) LoadNextMsg(filter string, wc bool, start uint64, smp *Store
 // Will return the number of bytes removed.
 func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
 	ms.mu.Lock()
+	if ms.cfg.Sealed {
+		ms.mu.Unlock()
+		return false, ErrStoreSealed
+	}
 	removed := ms.removeMsg(seq, false)
 	ms.mu.Unlock()
 	return removed, nil
@@ -739,11 +1008,33 @@ func (ms *memStore) RemoveMsg(seq uint64) (bool, error) {
 // EraseMsg will remove the message and rewrite its contents.
 func (ms *memStore) EraseMsg(seq uint64) (bool, error) {
 	ms.mu.Lock()
+	if ms.cfg.Sealed {
+		ms.mu.Unlock()
+		return false, ErrStoreSealed
+	}
 	removed := ms.removeMsg(seq, true)
 	ms.mu.Unlock()
 	return removed, nil
 }
 
+// RemoveMsgs will remove all of the messages for the given sequences.
+// Will return the number of messages removed.
+func (ms *memStore) RemoveMsgs(seqs []uint64) (uint64, error) {
+	var removed uint64
+	ms.mu.Lock()
+	if ms.cfg.Sealed {
+		ms.mu.Unlock()
+		return 0, ErrStoreSealed
+	}
+	for _, seq := range seqs {
+		if ms.removeMsg(seq, false) {
+			removed++
+		}
+	}
+	ms.mu.Unlock()
+	return removed, nil
+}
+
 // Performs logic to update first sequence number.
 // Lock should be held.
 func (ms *memStore) updateFirstSeq(seq uint64) {
@@ -780,12 +1071,36 @@ func (ms *memStore) removeSeqPerSubject(subj string, seq uint64) {
 		return
 	}
 	ss.Msgs--
-	if seq != ss.First {
+	if seq != ss.First && seq != ss.Last {
 		return
 	}
-	// If we know we only have 1 msg left don't need to search for next first.
+	// If we know we only have 1 msg left don't need to search for next first or last.
 	if ss.Msgs == 1 {
-		ss.First = ss.Last
+		if seq == ss.First {
+			ss.First = ss.Last
+		} else {
+			ss.Last = ss.First
+		}
+		return
+	}
+	if seq == ss.Last {
+		// If the gap is larger than what we hold, scan our messages instead.
+		if seq-ss.First > uint64(len(ms.msgs)) {
+			last := ss.First
+			for tseq, sm := range ms.msgs {
+				if tseq < seq && tseq > last && sm.subj == subj {
+					last = tseq
+				}
+			}
+			ss.Last = last
+			return
+		}
+		for tseq := seq - 1; tseq > ss.First; tseq-- {
+			if sm := ms.msgs[tseq]; sm != nil && sm.subj == subj {
+				ss.Last = tseq
+				break
+			}
+		}
 		return
 	}
 	// TODO(dlc) - Might want to optimize this longer term.
@@ -806,9 +1121,10 @@ func (ms *memStore) removeMsg(seq uint64, secure bool) bool {
 		return false
 	}
 
-	ss = memStoreMsgSize(sm.subj, sm.hdr, sm.msg)
+	ss = ms.msgSize(sm)
 
 	delete(ms.msgs, seq)
+	ms.unspill(seq, secure)
 	ms.state.Msgs--
 	ms.state.Bytes -= ss
 	ms.updateFirstSeq(seq)
@@ -877,11 +1193,12 @@ func (ms *memStore) State() StreamState {
 		if state.NumDeleted > 0 {
 			state.Deleted = make([]uint64, 0, state.NumDeleted)
 			// TODO(dlc) - Too Simplistic, once state is updated to allow runs etc redo.
-			for seq := state.FirstSeq + 1; seq < ms.state.LastSeq; seq++ {
+			for seq := state.FirstSeq + 1; seq <= ms.state.LastSeq; seq++ {
 				if _, ok := ms.msgs[seq]; !ok {
 					state.Deleted = append(state.Deleted, seq)
 				}
 			}
+			state.DeletedRanges = deleteRanges(state.Deleted)
 		}
 	}
 
@@ -894,13 +1211,209 @@ func (ms *memStore) Utilization() (total, reported uint64, err error) {
 	return ms.state.Bytes, ms.state.Bytes, nil
 }
 
+// Directory within the stream's store directory that spilled messages are kept in.
+const memSpillDir = "spill"
+
+// enableSpill will have the oldest messages moved to a file store in dir once the
+// messages held in memory exceed maxMem bytes. Spilled messages are encrypted if prf is set.
+func (ms *memStore) enableSpill(dir string, maxMem uint64, prf keyGen, cipher StoreCipher) error {
+	// Spilled messages are never recovered, so start clean.
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	ms.mu.RLock()
+	name := ms.cfg.Name
+	ms.mu.RUnlock()
+
+	fcfg := FileStoreConfig{StoreDir: dir, Cipher: cipher}
+	fs, err := newFileStoreWithKeys(fcfg, StreamConfig{Name: name, Storage: FileStorage}, time.Now().UTC(), prf, nil)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	ms.spill, ms.spmax, ms.spsz = fs, maxMem, make(map[uint64]uint64)
+	ms.mu.Unlock()
+	return nil
+}
+
+// registerSpillUpdates registers a callback for the bytes moved from memory to
+// disk, negative when spilled messages are removed.
+func (ms *memStore) registerSpillUpdates(cb func(int64)) {
+	ms.mu.Lock()
+	ms.spcb = cb
+	ms.mu.Unlock()
+}
+
+// Returns true if we are over our memory cap.
+// Lock should be held.
+func (ms *memStore) needsSpill() bool {
+	return ms.spill != nil && ms.state.Bytes-ms.spbytes > ms.spmax
+}
+
+// How many messages we move to disk at a time.
+const memSpillBatch = 64
+
+// Moves the oldest messages held in memory to the spill store until we are back under
+// our memory cap. Messages are written without holding our lock, so they are only
+// swapped out if they are still present once written.
+func (ms *memStore) spillMsgs() {
+	ms.spmu.Lock()
+	defer ms.spmu.Unlock()
+
+	var state StreamState
+	batch := make([]*StoreMsg, 0, memSpillBatch)
+	for {
+		ms.mu.RLock()
+		fs := ms.spill
+		if !ms.needsSpill() {
+			ms.mu.RUnlock()
+			return
+		}
+		seq := ms.spseq + 1
+		if seq < ms.state.FirstSeq {
+			seq = ms.state.FirstSeq
+		}
+		over := ms.state.Bytes - ms.spbytes - ms.spmax
+		batch = batch[:0]
+		for sz := uint64(0); seq <= ms.state.LastSeq && len(batch) < memSpillBatch && sz < over; seq++ {
+			if sm := ms.msgs[seq]; sm != nil {
+				batch = append(batch, sm)
+				sz += ms.storedMsgSize(sm.subj, sm.hdr, sm.msg)
+			}
+		}
+		ms.mu.RUnlock()
+
+		if len(batch) == 0 {
+			return
+		}
+
+		// Write them out. The spill store needs contiguous sequences, skip over any gaps.
+		stored := batch[:0]
+		for _, sm := range batch {
+			fs.FastState(&state)
+			if sm.seq > state.LastSeq+1 {
+				if err := fs.SkipMsgs(state.LastSeq+1, sm.seq-state.LastSeq-1); err != nil {
+					break
+				}
+			}
+			if err := fs.StoreRawMsg(sm.subj, sm.hdr, sm.msg, sm.seq, sm.ts); err != nil {
+				break
+			}
+			stored = append(stored, sm)
+		}
+
+		var moved int64
+		var gone []uint64
+		ms.mu.Lock()
+		if ms.spill != fs {
+			ms.mu.Unlock()
+			return
+		}
+		for _, sm := range stored {
+			ms.spseq = sm.seq
+			// Removed or replaced while we were writing.
+			if ms.msgs[sm.seq] != sm {
+				gone = append(gone, sm.seq)
+				continue
+			}
+			sz := ms.storedMsgSize(sm.subj, sm.hdr, sm.msg)
+			ms.spsz[sm.seq] = sz
+			ms.spbytes += sz
+			moved += int64(sz)
+			// Replace rather than modify, readers may still be holding onto the original.
+			ms.msgs[sm.seq] = &StoreMsg{subj: sm.subj, seq: sm.seq, ts: sm.ts}
+		}
+		cb := ms.spcb
+		ms.mu.Unlock()
+
+		for _, seq := range gone {
+			fs.RemoveMsg(seq)
+		}
+		if cb != nil && moved > 0 {
+			cb(moved)
+		}
+		// Stop on a write error, the messages stay in memory.
+		if len(stored) < len(batch) {
+			return
+		}
+	}
+}
+
+// Returns if the message for seq has been spilled to disk.
+// Lock should be held.
+func (ms *memStore) isSpilled(seq uint64) bool {
+	_, ok := ms.spsz[seq]
+	return ok
+}
+
+// Returns the size of the message, including any that have been spilled to disk.
+// Lock should be held.
+func (ms *memStore) msgSize(sm *StoreMsg) uint64 {
+	if sz, ok := ms.spsz[sm.seq]; ok {
+		return sz
+	}
+	return ms.storedMsgSize(sm.subj, sm.hdr, sm.msg)
+}
+
+// Returns the message with its headers and payload, loading them from the spill store if needed.
+// Lock should be held.
+func (ms *memStore) payload(sm *StoreMsg) *StoreMsg {
+	if !ms.isSpilled(sm.seq) {
+		return sm
+	}
+	if lsm, err := ms.spill.LoadMsg(sm.seq, nil); err == nil {
+		return lsm
+	}
+	return sm
+}
+
+// Removes a message from the spill store if it had been spilled.
+// Lock should be held.
+func (ms *memStore) unspill(seq uint64, secure bool) {
+	sz, ok := ms.spsz[seq]
+	if !ok {
+		return
+	}
+	delete(ms.spsz, seq)
+	ms.spbytes -= sz
+	if ms.spcb != nil {
+		ms.spcb(-int64(sz))
+	}
+	if secure {
+		ms.spill.EraseMsg(seq)
+	} else {
+		ms.spill.RemoveMsg(seq)
+	}
+}
+
+// Removes all spilled messages.
+// Lock should be held.
+func (ms *memStore) purgeSpill() {
+	if ms.spill == nil {
+		return
+	}
+	ms.spill.Purge()
+	if ms.spcb != nil && ms.spbytes > 0 {
+		ms.spcb(-int64(ms.spbytes))
+	}
+	ms.spsz, ms.spbytes = make(map[uint64]uint64), 0
+}
+
+// Size we account for a message, which will match file storage if asked to.
+func (ms *memStore) storedMsgSize(subj string, hdr, msg []byte) uint64 {
+	if ms.cfg.MsgOverhead {
+		return fileStoreMsgSize(subj, hdr, msg)
+	}
+	return memStoreMsgSize(subj, hdr, msg)
+}
+
 func memStoreMsgSize(subj string, hdr, msg []byte) uint64 {
 	return uint64(len(subj) + len(hdr) + len(msg) + 16) // 8*2 for seq + age
 }
 
 // Delete is same as Stop for memory store.
 func (ms *memStore) Delete() error {
-	ms.Purge()
+	ms.purge()
 	return ms.Stop()
 }
 
@@ -911,6 +1424,14 @@ func (ms *memStore) Stop() error {
 		ms.ageChk = nil
 	}
 	ms.msgs = nil
+	// Spilled messages do not outlive the memory store.
+	if ms.spill != nil {
+		dir := ms.spill.fcfg.StoreDir
+		ms.spill.Delete()
+		// Memory streams have nothing else on disk, so clean up our parent if now empty.
+		os.Remove(filepath.Dir(dir))
+		ms.spill, ms.spsz, ms.spbytes = nil, nil, 0
+	}
 	ms.mu.Unlock()
 	return nil
 }
@@ -1153,6 +1674,29 @@ func (o *consumerMemStore) UpdateConfig(cfg *ConsumerConfig) error {
 	return nil
 }
 
+// Flush is a no-op, there is nothing to write out.
+func (o *consumerMemStore) Flush() error {
+	return nil
+}
+
+// NumPending returns the number of messages matching filter that have not been delivered yet.
+func (o *consumerMemStore) NumPending(filter string) (uint64, error) {
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return 0, ErrStoreClosed
+	}
+	filter, err := consumerPendingFilter(o.cfg.FilterSubject, filter)
+	if err != nil {
+		o.mu.Unlock()
+		return 0, err
+	}
+	sseq, ms := o.state.pendingStart(), o.ms
+	o.mu.Unlock()
+
+	return ms.FilteredState(sseq, filter).Msgs, nil
+}
+
 func (o *consumerMemStore) Stop() error {
 	o.mu.Lock()
 	o.closed = true
@@ -1250,3 +1794,6 @@ func newTemplateMemStore() *templateMemStore {
 // No-ops for memstore.
 func (ts *templateMemStore) Store(t *streamTemplate) error  { return nil }
 func (ts *templateMemStore) Delete(t *streamTemplate) error { return nil }
+
+// Nothing survives a restart for memstore.
+func (ts *templateMemStore) LoadAll() ([]*StreamTemplateConfig, error) { return nil, nil }
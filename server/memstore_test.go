@@ -16,6 +16,8 @@ package server
 import (
 	"bytes"
 	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 	"time"
@@ -89,6 +91,69 @@ func TestMemStoreMsgLimit(t *testing.T) {
 	}
 }
 
+func TestMemStoreBytesLimitDiscardNew(t *testing.T) {
+	subj, hdr, msg := "foo", []byte("NATS/1.0\r\nX: Y\r\n\r\n"), make([]byte, 512)
+	storedMsgSize := memStoreMsgSize(subj, hdr, msg)
+
+	toStore := uint64(10)
+	maxBytes := storedMsgSize * toStore
+
+	ms, err := newMemStore(&StreamConfig{Storage: MemoryStorage, MaxBytes: int64(maxBytes), Discard: DiscardNew})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+
+	// Exactly filling up to the limit is allowed.
+	for i := uint64(0); i < toStore; i++ {
+		if _, _, err := ms.StoreMsg(subj, hdr, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	// The next one must be rejected even though payload and headers alone would fit.
+	if _, _, err := ms.StoreMsg(subj, nil, nil); err != ErrMaxBytes {
+		t.Fatalf("Expected %v, got %v", ErrMaxBytes, err)
+	}
+	if state := ms.State(); state.Msgs != toStore || state.Bytes != maxBytes {
+		t.Fatalf("Expected %d msgs and %d bytes, got %d and %d", toStore, maxBytes, state.Msgs, state.Bytes)
+	}
+}
+
+func TestMemStoreBytesLimitMsgOverhead(t *testing.T) {
+	subj, hdr, msg := "foo", []byte("NATS/1.0\r\nX: Y\r\n\r\n"), make([]byte, 512)
+	toStore := uint64(10)
+	maxBytes := fileStoreMsgSize(subj, hdr, msg) * toStore
+
+	// Limits should hit at the same place for both storage types.
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"foo"}, MaxBytes: int64(maxBytes), Discard: DiscardNew, MsgOverhead: true}
+	cfg.Storage = MemoryStorage
+	ms, err := newMemStore(&cfg)
+	require_NoError(t, err)
+	defer ms.Stop()
+	cfg.Storage = FileStorage
+	fs, err := newFileStore(FileStoreConfig{StoreDir: t.TempDir()}, cfg)
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	for _, store := range []StreamStore{ms, fs} {
+		for i := uint64(0); i < toStore; i++ {
+			_, _, err := store.StoreMsg(subj, hdr, msg)
+			require_NoError(t, err)
+		}
+		_, _, err := store.StoreMsg(subj, nil, nil)
+		require_Error(t, err, ErrMaxBytes)
+	}
+	if mstate, fstate := ms.State(), fs.State(); mstate.Bytes != maxBytes || fstate.Bytes != maxBytes {
+		t.Fatalf("Expected %d bytes for both, got %d and %d", maxBytes, mstate.Bytes, fstate.Bytes)
+	}
+
+	// Removals need to use the same size.
+	_, err = ms.RemoveMsg(1)
+	require_NoError(t, err)
+	if state := ms.State(); state.Bytes != maxBytes-fileStoreMsgSize(subj, hdr, msg) {
+		t.Fatalf("Unexpected bytes after removal: %d", state.Bytes)
+	}
+}
+
 func TestMemStoreBytesLimit(t *testing.T) {
 	subj, msg := "foo", make([]byte, 512)
 	storedMsgSize := memStoreMsgSize(subj, nil, msg)
@@ -375,6 +440,16 @@ func TestMemStoreStreamTruncate(t *testing.T) {
 	if state := ms.State(); state.Msgs != tseq {
 		t.Fatalf("Expected %d msgs, got %d", tseq, state.Msgs)
 	}
+	// Make sure the truncated messages are gone and the target is kept.
+	if _, err := ms.LoadMsg(tseq, nil); err != nil {
+		t.Fatalf("Unexpected error loading %d: %v", tseq, err)
+	}
+	if _, err := ms.LoadMsg(tseq+1, nil); err == nil {
+		t.Fatalf("Expected %d to be removed", tseq+1)
+	}
+	if n := len(ms.msgs); n != int(tseq) {
+		t.Fatalf("Expected %d stored msgs, got %d", tseq, n)
+	}
 
 	// Now make sure we report properly if we have some deleted interior messages.
 	ms.RemoveMsg(10)
@@ -442,3 +517,287 @@ func TestMemStoreUpdateMaxMsgsPerSubject(t *testing.T) {
 		t.Fatalf("Expected to have %d stored, got %d", 10, ss.Msgs)
 	}
 }
+
+func TestMemStoreLoadLastMsg(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo.*"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+
+	msg := []byte("Hello World")
+	for i := 0; i < 30; i++ {
+		subj := "foo.bar"
+		if i%3 == 0 {
+			subj = "foo.baz"
+		}
+		ms.StoreMsg(subj, nil, msg)
+	}
+
+	checkLast := func(subj string, expected uint64) {
+		t.Helper()
+		sm, err := ms.LoadLastMsg(subj, nil)
+		require_NoError(t, err)
+		if sm.seq != expected {
+			t.Fatalf("Expected last for %q to be %d, got %d", subj, expected, sm.seq)
+		}
+	}
+	checkLast(_EMPTY_, 30)
+	checkLast("foo.bar", 30)
+	checkLast("foo.baz", 28)
+
+	// Removing the last message for a subject should fall back to the one before.
+	for _, seq := range []uint64{30, 28} {
+		_, err := ms.RemoveMsg(seq)
+		require_NoError(t, err)
+	}
+	checkLast(_EMPTY_, 29)
+	checkLast("foo.bar", 29)
+	checkLast("foo.baz", 25)
+	checkLast("foo.*", 29)
+
+	// Leave a gap larger than what we hold before removing the last for a subject.
+	for seq := uint64(2); seq <= 29; seq++ {
+		if seq%3 != 1 {
+			ms.RemoveMsg(seq)
+		}
+	}
+	_, err = ms.RemoveMsg(25)
+	require_NoError(t, err)
+	checkLast(_EMPTY_, 22)
+	checkLast("foo.baz", 22)
+
+	if _, err := ms.LoadLastMsg("foo.none", nil); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected not found, got %v", err)
+	}
+}
+
+func TestMemStoreRemoveMsgs(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+
+	for i := 0; i < 10; i++ {
+		_, _, err := ms.StoreMsg("foo", nil, []byte("Hello World"))
+		require_NoError(t, err)
+	}
+	n, err := ms.RemoveMsgs([]uint64{1, 5, 5, 10, 22})
+	require_NoError(t, err)
+	if n != 3 {
+		t.Fatalf("Expected 3 removed, got %d", n)
+	}
+	state := ms.State()
+	if state.Msgs != 7 || state.FirstSeq != 2 || state.LastSeq != 10 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestMemStoreSkipMsgs(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+
+	require_NoError(t, ms.SkipMsgs(1, 10))
+	_, _, err = ms.StoreMsg("foo", nil, []byte("Hello World"))
+	require_NoError(t, err)
+	require_NoError(t, ms.SkipMsgs(12, 100))
+	if err := ms.SkipMsgs(12, 1); err != ErrSequenceMismatch {
+		t.Fatalf("Expected sequence mismatch, got %v", err)
+	}
+	state := ms.State()
+	if state.Msgs != 1 || state.FirstSeq != 11 || state.LastSeq != 111 {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+}
+
+func TestMemStoreStateDeletedRanges(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+
+	for i := 0; i < 20; i++ {
+		_, _, err := ms.StoreMsg("foo", nil, []byte("Hello World"))
+		require_NoError(t, err)
+	}
+	for _, seq := range []uint64{1, 3, 4, 8, 10, 11} {
+		_, err := ms.RemoveMsg(seq)
+		require_NoError(t, err)
+	}
+	state := ms.State()
+	if state.NumDeleted != 5 || len(state.Deleted) != 5 {
+		t.Fatalf("Expected 5 deleted, got %d", state.NumDeleted)
+	}
+	expected := []DeleteRange{{3, 4}, {8, 8}, {10, 11}}
+	if !reflect.DeepEqual(state.DeletedRanges, expected) {
+		t.Fatalf("Expected ranges %+v, got %+v", expected, state.DeletedRanges)
+	}
+}
+
+func TestMemStoreStateDeletedLastSeq(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+
+	for i := 0; i < 10; i++ {
+		_, _, err := ms.StoreMsg("foo", nil, []byte("Hello World"))
+		require_NoError(t, err)
+	}
+	for _, seq := range []uint64{5, 10} {
+		_, err := ms.RemoveMsg(seq)
+		require_NoError(t, err)
+	}
+	// A removed last sequence is still counted, so needs to be listed as well.
+	state := ms.State()
+	if expected := []uint64{5, 10}; state.NumDeleted != 2 || !reflect.DeepEqual(state.Deleted, expected) {
+		t.Fatalf("Expected deleted to be %+v, got %d and %+v", expected, state.NumDeleted, state.Deleted)
+	}
+}
+
+func TestMemStoreStoreMsgWithExpect(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"*"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+	testStoreMsgWithExpect(t, ms)
+}
+
+func TestMemStoreSealed(t *testing.T) {
+	cfg := StreamConfig{Name: "zzz", Subjects: []string{"*"}, Storage: MemoryStorage, MaxAge: 250 * time.Millisecond}
+	ms, err := newMemStore(&cfg)
+	require_NoError(t, err)
+	defer ms.Stop()
+	testStoreSealed(t, ms, cfg)
+}
+
+func TestMemStoreFirstSeqOverride(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage, FirstSeq: 1000})
+	require_NoError(t, err)
+	defer ms.Stop()
+
+	state := ms.State()
+	require_True(t, state.FirstSeq == 1000)
+	require_True(t, state.LastSeq == 999)
+
+	seq, _, err := ms.StoreMsg("foo", nil, []byte("ok"))
+	require_NoError(t, err)
+	require_True(t, seq == 1000)
+	state = ms.State()
+	require_True(t, state.Msgs == 1)
+	require_True(t, state.FirstSeq == 1000)
+}
+
+func TestMemStoreLastSeqsPerSubject(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"kv.>"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+	testLastSeqsPerSubject(t, ms)
+}
+
+func TestMemStoreStorageQuotaCheck(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: MemoryStorage})
+	require_NoError(t, err)
+	defer ms.Stop()
+	testStorageQuotaCheck(t, ms, int64(memStoreMsgSize("foo", nil, []byte("ok"))))
+}
+
+func TestMemStoreSpillOver(t *testing.T) {
+	ms, err := newMemStore(&StreamConfig{Name: "zzz", Storage: MemoryStorage})
+	if err != nil {
+		t.Fatalf("Unexpected error creating store: %v", err)
+	}
+	sd := filepath.Join(t.TempDir(), memSpillDir)
+
+	msg := make([]byte, 100)
+	msgSize := memStoreMsgSize("foo.0", nil, msg)
+	maxMem := 10 * msgSize
+	if err := ms.enableSpill(sd, maxMem, nil, ChaCha); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	toStore := 100
+	for i := 0; i < toStore; i++ {
+		msg[0] = byte(i)
+		if _, _, err := ms.StoreMsg(fmt.Sprintf("foo.%d", i%10), nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	state := ms.State()
+	if state.Msgs != uint64(toStore) || state.Bytes != uint64(toStore)*msgSize {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	ms.mu.RLock()
+	inMem, spilled := ms.state.Bytes-ms.spbytes, len(ms.spsz)
+	ms.mu.RUnlock()
+	if inMem > maxMem || spilled != toStore-10 {
+		t.Fatalf("Expected %d bytes in memory and %d spilled msgs, got %d and %d", maxMem, toStore-10, inMem, spilled)
+	}
+
+	// All messages, spilled or not, load the same.
+	for seq := uint64(1); seq <= uint64(toStore); seq++ {
+		sm, err := ms.LoadMsg(seq, nil)
+		if err != nil {
+			t.Fatalf("Unexpected error loading %d: %v", seq, err)
+		}
+		if sm.subj != fmt.Sprintf("foo.%d", (seq-1)%10) || sm.msg[0] != byte(seq-1) || len(sm.msg) != len(msg) {
+			t.Fatalf("Unexpected message for %d: %q", seq, sm.subj)
+		}
+	}
+	if sm, nseq, err := ms.LoadNextMsg("foo.3", false, 1, nil); err != nil || nseq != 4 || sm.msg[0] != 3 {
+		t.Fatalf("Unexpected next msg: %v %d", err, nseq)
+	}
+
+	// Bytes moved to disk are reported, and reported back when spilled messages are removed.
+	var moved int64
+	ms.registerSpillUpdates(func(bd int64) { moved += bd })
+
+	// Removing spilled messages keeps accounting in order.
+	if removed, err := ms.RemoveMsg(5); err != nil || !removed {
+		t.Fatalf("Unexpected error removing msg: %v", err)
+	}
+	if removed, err := ms.EraseMsg(6); err != nil || !removed {
+		t.Fatalf("Unexpected error erasing msg: %v", err)
+	}
+	if _, err := ms.LoadMsg(5, nil); err != ErrStoreMsgNotFound {
+		t.Fatalf("Expected %v, got %v", ErrStoreMsgNotFound, err)
+	}
+	if _, err := ms.Compact(51); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	state = ms.State()
+	if state.Msgs != 50 || state.Bytes != 50*msgSize {
+		t.Fatalf("Unexpected state: %+v", state)
+	}
+	ms.mu.RLock()
+	spilled, spbytes := len(ms.spsz), ms.spbytes
+	ms.mu.RUnlock()
+	if spilled != 40 || spbytes != 40*msgSize {
+		t.Fatalf("Expected 40 spilled msgs, got %d with %d bytes", spilled, spbytes)
+	}
+	if moved != -50*int64(msgSize) {
+		t.Fatalf("Expected %d spilled bytes to be removed, got %d", 50*msgSize, -moved)
+	}
+	if sm, err := ms.LoadMsg(51, nil); err != nil || sm.msg[0] != 50 {
+		t.Fatalf("Unexpected error loading spilled msg: %v", err)
+	}
+
+	if _, err := ms.Purge(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ms.mu.RLock()
+	spilled = len(ms.spsz)
+	ms.mu.RUnlock()
+	if spilled != 0 {
+		t.Fatalf("Expected no spilled msgs after purge, got %d", spilled)
+	}
+
+	// Spilling continues after a purge.
+	for i := 0; i < 20; i++ {
+		if _, _, err := ms.StoreMsg("foo.0", nil, msg); err != nil {
+			t.Fatalf("Error storing msg: %v", err)
+		}
+	}
+	if sm, err := ms.LoadMsg(101, nil); err != nil || sm.subj != "foo.0" {
+		t.Fatalf("Unexpected error loading spilled msg: %v", err)
+	}
+
+	// Spilled messages are removed with the store.
+	ms.Stop()
+	if _, err := os.Stat(sd); !os.IsNotExist(err) {
+		t.Fatalf("Expected spill directory to be removed, got %v", err)
+	}
+}
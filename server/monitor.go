@@ -19,6 +19,7 @@ import (
 	"crypto/x509"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -127,6 +128,8 @@ type ConnInfo struct {
 	Stop           *time.Time     `json:"stop,omitempty"`
 	Reason         string         `json:"reason,omitempty"`
 	RTT            string         `json:"rtt,omitempty"`
+	RTTVar         string         `json:"rtt_var,omitempty"`
+	PingsMissed    uint64         `json:"pings_missed,omitempty"`
 	Uptime         string         `json:"uptime"`
 	Idle           string         `json:"idle"`
 	Pending        int            `json:"pending_bytes"`
@@ -551,6 +554,10 @@ func (ci *ConnInfo) fill(client *client, nc net.Conn, now time.Time, auth bool)
 	ci.Uptime = myUptime(now.Sub(client.start))
 	ci.Idle = myUptime(now.Sub(client.last))
 	ci.RTT = client.getRTT().String()
+	if client.rttVar > 0 {
+		ci.RTTVar = client.rttVar.String()
+	}
+	ci.PingsMissed = client.ping.missed
 	ci.OutMsgs = client.outMsgs
 	ci.OutBytes = client.outBytes
 	ci.NumSubs = uint32(len(client.subs))
@@ -777,6 +784,8 @@ type RouteInfo struct {
 	Start        time.Time          `json:"start"`
 	LastActivity time.Time          `json:"last_activity"`
 	RTT          string             `json:"rtt,omitempty"`
+	RTTVar       string             `json:"rtt_var,omitempty"`
+	PingsMissed  uint64             `json:"pings_missed,omitempty"`
 	Uptime       string             `json:"uptime"`
 	Idle         string             `json:"idle"`
 	Import       *SubjectPermission `json:"import,omitempty"`
@@ -828,11 +837,15 @@ func (s *Server) Routez(routezOpts *RoutezOptions) (*Routez, error) {
 			Import:       r.opts.Import,
 			Export:       r.opts.Export,
 			RTT:          r.getRTT().String(),
+			PingsMissed:  r.ping.missed,
 			Start:        r.start,
 			LastActivity: r.last,
 			Uptime:       myUptime(rs.Now.Sub(r.start)),
 			Idle:         myUptime(rs.Now.Sub(r.last)),
 		}
+		if r.rttVar > 0 {
+			ri.RTTVar = r.rttVar.String()
+		}
 
 		if len(r.subs) > 0 {
 			if routezOpts.SubscriptionsDetail {
@@ -2091,16 +2104,23 @@ type LeafzOptions struct {
 
 // LeafInfo has detailed information on each remote leafnode connection.
 type LeafInfo struct {
-	Account  string   `json:"account"`
-	IP       string   `json:"ip"`
-	Port     int      `json:"port"`
-	RTT      string   `json:"rtt,omitempty"`
-	InMsgs   int64    `json:"in_msgs"`
-	OutMsgs  int64    `json:"out_msgs"`
-	InBytes  int64    `json:"in_bytes"`
-	OutBytes int64    `json:"out_bytes"`
-	NumSubs  uint32   `json:"subscriptions"`
-	Subs     []string `json:"subscriptions_list,omitempty"`
+	Account       string    `json:"account"`
+	RemoteAccount string    `json:"remote_account,omitempty"`
+	IP            string    `json:"ip"`
+	Port          int       `json:"port"`
+	RTT           string    `json:"rtt,omitempty"`
+	RTTVar        string    `json:"rtt_var,omitempty"`
+	PingsMissed   uint64    `json:"pings_missed,omitempty"`
+	LastActivity  time.Time `json:"last_activity"`
+	Version       string    `json:"version,omitempty"`
+	Features      []string  `json:"features,omitempty"`
+	HdrsDropped   uint64    `json:"headers_dropped,omitempty"`
+	InMsgs        int64     `json:"in_msgs"`
+	OutMsgs       int64     `json:"out_msgs"`
+	InBytes       int64     `json:"in_bytes"`
+	OutBytes      int64     `json:"out_bytes"`
+	NumSubs       uint32    `json:"subscriptions"`
+	Subs          []string  `json:"subscriptions_list,omitempty"`
 }
 
 // Leafz returns a Leafz structure containing information about leafnodes.
@@ -2130,15 +2150,24 @@ func (s *Server) Leafz(opts *LeafzOptions) (*Leafz, error) {
 		for _, ln := range lconns {
 			ln.mu.Lock()
 			lni := &LeafInfo{
-				Account:  ln.acc.Name,
-				IP:       ln.host,
-				Port:     int(ln.port),
-				RTT:      ln.getRTT().String(),
-				InMsgs:   atomic.LoadInt64(&ln.inMsgs),
-				OutMsgs:  ln.outMsgs,
-				InBytes:  atomic.LoadInt64(&ln.inBytes),
-				OutBytes: ln.outBytes,
-				NumSubs:  uint32(len(ln.subs)),
+				Account:       ln.acc.Name,
+				RemoteAccount: ln.leaf.remoteAccName,
+				IP:            ln.host,
+				Port:          int(ln.port),
+				RTT:           ln.getRTT().String(),
+				PingsMissed:   ln.ping.missed,
+				LastActivity:  ln.last,
+				Version:       ln.leaf.remoteVersion,
+				Features:      leafFeatureList(ln.leaf.features),
+				HdrsDropped:   ln.leaf.hdrsDropped,
+				InMsgs:        atomic.LoadInt64(&ln.inMsgs),
+				OutMsgs:       ln.outMsgs,
+				InBytes:       atomic.LoadInt64(&ln.inBytes),
+				OutBytes:      ln.outBytes,
+				NumSubs:       uint32(len(ln.subs)),
+			}
+			if ln.rttVar > 0 {
+				lni.RTTVar = ln.rttVar.String()
 			}
 			if opts != nil && opts.Subscriptions {
 				lni.Subs = make([]string, 0, len(ln.subs))
@@ -2213,15 +2242,25 @@ func (s *Server) AccountStatz(opts *AccountStatzOptions) (*AccountStatz, error)
 			acc.mu.RUnlock()
 			return true
 		})
+		for _, stat := range stz.Accounts {
+			if acc, ok := s.accounts.Load(stat.Account); ok {
+				stat.JetStream = acc.(*Account).jetStreamStat()
+			}
+		}
 	} else {
 		for _, a := range opts.Accounts {
 			if acc, ok := s.accounts.Load(a); ok {
 				acc := acc.(*Account)
 				acc.mu.RLock()
+				var stat *AccountStat
 				if opts.IncludeUnused || acc.numLocalConnections() != 0 {
-					stz.Accounts = append(stz.Accounts, acc.statz())
+					stat = acc.statz()
 				}
 				acc.mu.RUnlock()
+				if stat != nil {
+					stat.JetStream = acc.jetStreamStat()
+					stz.Accounts = append(stz.Accounts, stat)
+				}
 			}
 		}
 	}
@@ -2341,6 +2380,12 @@ func (reason ClosedState) String() string {
 		return "Minimum Version Required"
 	case ClusterNamesIdentical:
 		return "Cluster Names Identical"
+	case ConnectionAddrNotAllowed:
+		return "Connection Address Not Allowed"
+	case CredentialsChanged:
+		return "Credentials Changed"
+	case LeafNodeLoopDetected:
+		return "Leafnode Loop Detected"
 	}
 
 	return "Unknown State"
@@ -2633,6 +2678,7 @@ type JSzOptions struct {
 	LeaderOnly bool   `json:"leader_only,omitempty"`
 	Offset     int    `json:"offset,omitempty"`
 	Limit      int    `json:"limit,omitempty"`
+	StoreStats bool   `json:"store_stats,omitempty"`
 }
 
 // HealthzOptions are options passed to Healthz
@@ -2644,14 +2690,15 @@ type HealthzOptions struct {
 }
 
 type StreamDetail struct {
-	Name     string              `json:"name"`
-	Created  time.Time           `json:"created"`
-	Cluster  *ClusterInfo        `json:"cluster,omitempty"`
-	Config   *StreamConfig       `json:"config,omitempty"`
-	State    StreamState         `json:"state,omitempty"`
-	Consumer []*ConsumerInfo     `json:"consumer_detail,omitempty"`
-	Mirror   *StreamSourceInfo   `json:"mirror,omitempty"`
-	Sources  []*StreamSourceInfo `json:"sources,omitempty"`
+	Name       string              `json:"name"`
+	Created    time.Time           `json:"created"`
+	Cluster    *ClusterInfo        `json:"cluster,omitempty"`
+	Config     *StreamConfig       `json:"config,omitempty"`
+	State      StreamState         `json:"state,omitempty"`
+	Consumer   []*ConsumerInfo     `json:"consumer_detail,omitempty"`
+	Mirror     *StreamSourceInfo   `json:"mirror,omitempty"`
+	Sources    []*StreamSourceInfo `json:"sources,omitempty"`
+	StoreStats *FileStoreStats     `json:"store_stats,omitempty"`
 }
 
 type AccountDetail struct {
@@ -2683,11 +2730,17 @@ type JSInfo struct {
 	Bytes     uint64           `json:"bytes"`
 	Meta      *MetaClusterInfo `json:"meta_cluster,omitempty"`
 
+	// Statistics of configured message interceptors.
+	Interceptors []*MsgInterceptorStats `json:"interceptors,omitempty"`
+
+	// Statistics of the shared consumer delivery scheduler, if configured.
+	Scheduler *DeliverySchedulerStats `json:"delivery_scheduler,omitempty"`
+
 	// aggregate raft info
 	AccountDetails []*AccountDetail `json:"account_details,omitempty"`
 }
 
-func (s *Server) accountDetail(jsa *jsAccount, optStreams, optConsumers, optCfg bool) *AccountDetail {
+func (s *Server) accountDetail(jsa *jsAccount, optStreams, optConsumers, optCfg, optStoreStats bool) *AccountDetail {
 	jsa.mu.RLock()
 	acc := jsa.account
 	name := acc.GetName()
@@ -2741,6 +2794,11 @@ func (s *Server) accountDetail(jsa *jsAccount, optStreams, optConsumers, optCfg
 				Mirror:  stream.mirrorInfo(),
 				Sources: stream.sourcesInfo(),
 			}
+			if optStoreStats {
+				if fs, ok := stream.Store().(*fileStore); ok {
+					sdet.StoreStats = fs.Stats()
+				}
+			}
 			if optConsumers {
 				for _, consumer := range stream.getPublicConsumers() {
 					cInfo := consumer.info()
@@ -2775,7 +2833,7 @@ func (s *Server) JszAccount(opts *JSzOptions) (*AccountDetail, error) {
 	if !ok {
 		return nil, fmt.Errorf("account %q not jetstream enabled", acc)
 	}
-	return s.accountDetail(jsa, opts.Streams, opts.Consumer, opts.Config), nil
+	return s.accountDetail(jsa, opts.Streams, opts.Consumer, opts.Config, opts.StoreStats), nil
 }
 
 // helper to get cluster info from node via dummy group
@@ -2796,6 +2854,8 @@ func (s *Server) raftNodeToClusterInfo(node RaftNode) *ClusterInfo {
 	return s.js.clusterInfo(group)
 }
 
+var errJszStoreStatsNoAccount = errors.New("store stats require an account filter")
+
 // Jsz returns a Jsz structure containing information about JetStream.
 func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 	// set option defaults
@@ -2805,7 +2865,11 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 	if opts.Limit == 0 {
 		opts.Limit = 1024
 	}
-	if opts.Consumer {
+	// Store stats include every block, so only allow them for a single account.
+	if opts.StoreStats && opts.Account == _EMPTY_ {
+		return nil, errJszStoreStatsNoAccount
+	}
+	if opts.Consumer || opts.StoreStats {
 		opts.Streams = true
 	}
 	if opts.Streams {
@@ -2854,6 +2918,8 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 	}
 
 	jsi.JetStreamStats = *js.usageStats()
+	jsi.Interceptors = s.MsgInterceptorStats()
+	jsi.Scheduler = js.dsched.stats()
 
 	filterIdx := -1
 	for i, jsa := range accounts {
@@ -2878,6 +2944,8 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 	// filter logic
 	if filterIdx != -1 {
 		accounts = []*jsAccount{accounts[filterIdx]}
+	} else if opts.StoreStats {
+		accounts = []*jsAccount{}
 	} else if opts.Accounts {
 		if opts.Offset != 0 {
 			sort.Slice(accounts, func(i, j int) bool {
@@ -2902,7 +2970,7 @@ func (s *Server) Jsz(opts *JSzOptions) (*JSInfo, error) {
 	}
 	// if wanted, obtain accounts/streams/consumer
 	for _, jsa := range accounts {
-		detail := s.accountDetail(jsa, opts.Streams, opts.Consumer, opts.Config)
+		detail := s.accountDetail(jsa, opts.Streams, opts.Consumer, opts.Config, opts.StoreStats)
 		jsi.AccountDetails = append(jsi.AccountDetails, detail)
 	}
 	return jsi, nil
@@ -2941,6 +3009,10 @@ func (s *Server) HandleJsz(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	storeStats, err := decodeBool(w, r, "store-stats")
+	if err != nil {
+		return
+	}
 
 	l, err := s.Jsz(&JSzOptions{
 		r.URL.Query().Get("acc"),
@@ -2950,7 +3022,8 @@ func (s *Server) HandleJsz(w http.ResponseWriter, r *http.Request) {
 		config,
 		leader,
 		offset,
-		limit})
+		limit,
+		storeStats})
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		w.Write([]byte(err.Error()))
@@ -2966,8 +3039,9 @@ func (s *Server) HandleJsz(w http.ResponseWriter, r *http.Request) {
 }
 
 type HealthStatus struct {
-	Status string `json:"status"`
-	Error  string `json:"error,omitempty"`
+	Status   string   `json:"status"`
+	Error    string   `json:"error,omitempty"`
+	Warnings []string `json:"warnings,omitempty"`
 }
 
 // https://tools.ietf.org/id/draft-inadarei-api-health-check-05.html
@@ -3009,6 +3083,42 @@ func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
 	ResponseHandler(w, r, b)
 }
 
+// Returns a warning for each stream that has message blocks that could not be recovered.
+func (js *jetStream) damagedStreamWarnings() []string {
+	js.mu.RLock()
+	jsas := make([]*jsAccount, 0, len(js.accounts))
+	for _, jsa := range js.accounts {
+		jsas = append(jsas, jsa)
+	}
+	js.mu.RUnlock()
+
+	var warnings []string
+	for _, jsa := range jsas {
+		jsa.mu.RLock()
+		msets := make([]*stream, 0, len(jsa.streams))
+		for _, mset := range jsa.streams {
+			msets = append(msets, mset)
+		}
+		jsa.mu.RUnlock()
+
+		for _, mset := range msets {
+			mset.mu.RLock()
+			fs, ok := mset.store.(*fileStore)
+			name := mset.cfg.Name
+			mset.mu.RUnlock()
+			if !ok {
+				continue
+			}
+			if damaged := fs.damagedBlocks(); len(damaged) > 0 {
+				warnings = append(warnings, fmt.Sprintf("JetStream stream '%s > %s' has %d damaged message block(s)",
+					jsa.acc(), name, len(damaged)))
+			}
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
 // Generate health status.
 func (s *Server) healthz(opts *HealthzOptions) *HealthStatus {
 	var health = &HealthStatus{Status: "ok"}
@@ -3018,6 +3128,15 @@ func (s *Server) healthz(opts *HealthzOptions) *HealthStatus {
 		opts = &HealthzOptions{}
 	}
 
+	// While recovering streams on startup report how far along we are.
+	if js := s.getJetStream(); js != nil {
+		if done, total, eta, ok := js.recovery.progress(); ok {
+			health.Status = "unavailable"
+			health.Error = fmt.Sprintf("JetStream is recovering streams, %d of %d done, estimated %v remaining", done, total, eta)
+			return health
+		}
+	}
+
 	if err := s.readyForConnections(time.Millisecond); err != nil {
 		health.Status = "error"
 		health.Error = err.Error()
@@ -3044,6 +3163,9 @@ func (s *Server) healthz(opts *HealthzOptions) *HealthStatus {
 		return health
 	}
 
+	// Streams with damaged blocks are still served, so only warn.
+	health.Warnings = js.damagedStreamWarnings()
+
 	// Clustered JetStream
 	js.mu.RLock()
 	defer js.mu.RUnlock()
@@ -3067,11 +3189,17 @@ func (s *Server) healthz(opts *HealthzOptions) *HealthStatus {
 			sfis, _ := os.ReadDir(filepath.Join(sdir, fi.Name(), "streams"))
 			for _, sfi := range sfis {
 				stream := sfi.Name()
-				if _, err := acc.lookupStream(stream); err != nil {
+				mset, err := acc.lookupStream(stream)
+				if err != nil {
 					health.Status = na
 					health.Error = fmt.Sprintf("JetStream stream '%s > %s' could not be recovered", acc, stream)
 					return health
 				}
+				if err := mset.failure(); err != nil {
+					health.Status = na
+					health.Error = fmt.Sprintf("JetStream stream '%s > %s' failed: %v", acc, stream, err)
+					return health
+				}
 			}
 		}
 		return health
@@ -3127,3 +3255,96 @@ func (s *Server) healthz(opts *HealthzOptions) *HealthStatus {
 	// Success.
 	return health
 }
+
+// SubjectStatzOptions are options passed to SubjectStatz
+type SubjectStatzOptions struct {
+	Accounts []string `json:"accounts"`
+	// Limit is the maximum number of top subjects to return per account.
+	Limit int `json:"limit"`
+}
+
+// SubjectStatz has approximate subject statistics per account.
+type SubjectStatz struct {
+	ID       string                `json:"server_id"`
+	Now      time.Time             `json:"now"`
+	Accounts []*AccountSubjectStat `json:"accounts"`
+}
+
+// AccountSubjectStat has the estimated number of distinct subjects and
+// the top subjects by volume for an account.
+type AccountSubjectStat struct {
+	Account     string        `json:"account"`
+	Cardinality uint64        `json:"cardinality"`
+	Top         []SubjectStat `json:"top"`
+}
+
+// SubjectStatz returns approximate subject statistics for messages published by local connections.
+// Requires subject_stats to be configured.
+func (s *Server) SubjectStatz(opts *SubjectStatzOptions) (*SubjectStatz, error) {
+	if s.getOpts().SubjectStats <= 0 {
+		return nil, fmt.Errorf("subject stats are not enabled")
+	}
+	var limit int
+	var filter []string
+	if opts != nil {
+		limit, filter = opts.Limit, opts.Accounts
+	}
+	sz := &SubjectStatz{
+		ID:       s.ID(),
+		Now:      time.Now().UTC(),
+		Accounts: []*AccountSubjectStat{},
+	}
+	add := func(acc *Account) {
+		if ss := acc.sstats; ss != nil {
+			sz.Accounts = append(sz.Accounts, &AccountSubjectStat{
+				Account:     acc.Name,
+				Cardinality: ss.cardinality(),
+				Top:         ss.topSubjects(limit),
+			})
+		}
+	}
+	if len(filter) == 0 {
+		s.accounts.Range(func(_, a interface{}) bool {
+			add(a.(*Account))
+			return true
+		})
+		sort.Slice(sz.Accounts, func(i, j int) bool {
+			return sz.Accounts[i].Account < sz.Accounts[j].Account
+		})
+	} else {
+		for _, name := range filter {
+			if a, ok := s.accounts.Load(name); ok {
+				add(a.(*Account))
+			}
+		}
+	}
+	return sz, nil
+}
+
+// HandleSubjectStatz process HTTP requests for subject statistics of accounts.
+func (s *Server) HandleSubjectStatz(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.httpReqStats[SubjectStatzPath]++
+	s.mu.Unlock()
+
+	limit, err := decodeInt(w, r, "limit")
+	if err != nil {
+		return
+	}
+	opts := &SubjectStatzOptions{Limit: limit}
+	if acc := r.URL.Query().Get("acc"); acc != _EMPTY_ {
+		opts.Accounts = []string{acc}
+	}
+	sz, err := s.SubjectStatz(opts)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	b, err := json.MarshalIndent(sz, "", "  ")
+	if err != nil {
+		s.Errorf("Error marshaling response to %s request: %v", SubjectStatzPath, err)
+		return
+	}
+	ResponseHandler(w, r, b)
+}
@@ -3925,7 +3925,7 @@ func TestMonitorAccountz(t *testing.T) {
 	body = string(readBody(t, fmt.Sprintf("http://127.0.0.1:%d%s?acc=$SYS", s.MonitorAddr().Port, AccountzPath)))
 	require_Contains(t, body, `"account_detail": {`)
 	require_Contains(t, body, `"account_name": "$SYS",`)
-	require_Contains(t, body, `"subscriptions": 40,`)
+	require_Contains(t, body, `"subscriptions": 43,`)
 	require_Contains(t, body, `"is_system": true,`)
 	require_Contains(t, body, `"system_account": "$SYS"`)
 
@@ -4195,6 +4195,37 @@ func TestMonitorJsz(t *testing.T) {
 			}
 		}
 	})
+	t.Run("store-stats", func(t *testing.T) {
+		for _, url := range []string{monUrl1, monUrl2} {
+			info := readJsInfo(url + "?acc=ACC&store-stats=true")
+			if len(info.AccountDetails) != 1 {
+				t.Fatalf("expected single account")
+			}
+			for _, sd := range info.AccountDetails[0].Streams {
+				if sd.StoreStats == nil || sd.StoreStats.Blocks == 0 || len(sd.StoreStats.BlockStats) != sd.StoreStats.Blocks {
+					t.Fatalf("expected store stats for stream %q but got %+v", sd.Name, sd.StoreStats)
+				}
+			}
+			info = readJsInfo(url + "?acc=ACC&streams=true")
+			for _, sd := range info.AccountDetails[0].Streams {
+				if sd.StoreStats != nil {
+					t.Fatalf("expected no store stats for stream %q", sd.Name)
+				}
+			}
+			// Store stats are not allowed across all accounts.
+			resp, err := http.Get(url + "?store-stats=true")
+			require_NoError(t, err)
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			require_NoError(t, err)
+			if resp.StatusCode != http.StatusBadRequest || string(body) != errJszStoreStatsNoAccount.Error() {
+				t.Fatalf("expected bad request, got %d: %q", resp.StatusCode, body)
+			}
+			if info = readJsInfo(url + "?acc=NONE&store-stats=true"); len(info.AccountDetails) != 0 {
+				t.Fatalf("expected no accounts, got %d", len(info.AccountDetails))
+			}
+		}
+	})
 	t.Run("accounts reserved metrics", func(t *testing.T) {
 		for _, url := range []string{monUrl1, monUrl2} {
 			info := readJsInfo(url + "?accounts=true&acc=ACC")
@@ -4548,3 +4579,73 @@ func TestMonitorWebsocket(t *testing.T) {
 		}
 	}
 }
+
+func TestMonitorSubjectStatz(t *testing.T) {
+	resetPreviousHTTPConnections()
+	opts := DefaultMonitorOptions()
+	opts.SubjectStats = 3
+	s := RunServer(opts)
+	defer s.Shutdown()
+
+	nc := natsConnect(t, s.ClientURL())
+	defer nc.Close()
+
+	for _, p := range []struct {
+		subj string
+		n    int
+	}{{"foo", 10}, {"bar", 5}, {"baz", 2}, {"qux", 1}} {
+		for i := 0; i < p.n; i++ {
+			natsPub(t, nc, p.subj, []byte("hello"))
+		}
+	}
+	natsFlush(t, nc)
+
+	url := fmt.Sprintf("http://127.0.0.1:%d%s?acc=%s&limit=2", s.MonitorAddr().Port, SubjectStatzPath, globalAccountName)
+	var sz SubjectStatz
+	require_NoError(t, json.Unmarshal(readBody(t, url), &sz))
+	if len(sz.Accounts) != 1 {
+		t.Fatalf("Expected 1 account, got %d", len(sz.Accounts))
+	}
+	as := sz.Accounts[0]
+	if as.Account != globalAccountName || as.Cardinality != 4 {
+		t.Fatalf("Unexpected account stats: %+v", as)
+	}
+	if len(as.Top) != 2 {
+		t.Fatalf("Expected 2 top subjects, got %+v", as.Top)
+	}
+	if top := as.Top[0]; top.Subject != "foo" || top.Msgs != 10 || top.Bytes != 50 || top.Error != 0 {
+		t.Fatalf("Unexpected top subject: %+v", top)
+	}
+	if top := as.Top[1]; top.Subject != "bar" || top.Msgs != 5 {
+		t.Fatalf("Unexpected second subject: %+v", top)
+	}
+
+	// Not enabled.
+	s.Shutdown()
+	opts = DefaultMonitorOptions()
+	s = RunServer(opts)
+	defer s.Shutdown()
+	_, err := s.SubjectStatz(nil)
+	require_Error(t, err)
+}
+
+func TestSubjectStatsSpaceSaving(t *testing.T) {
+	ss := newSubjectStats(2)
+	for i := 0; i < 5; i++ {
+		ss.track([]byte("foo"), 1)
+	}
+	ss.track([]byte("bar"), 1)
+	// This should replace bar, inheriting its count as error.
+	ss.track([]byte("baz"), 1)
+
+	top := ss.topSubjects(0)
+	if len(top) != 2 || top[0].Subject != "foo" || top[0].Msgs != 5 {
+		t.Fatalf("Unexpected top subjects: %+v", top)
+	}
+	if top[1].Subject != "baz" || top[1].Msgs != 2 || top[1].Error != 1 {
+		t.Fatalf("Unexpected replaced subject: %+v", top[1])
+	}
+	if c := ss.cardinality(); c != 3 {
+		t.Fatalf("Expected cardinality of 3, got %d", c)
+	}
+}
@@ -442,6 +442,11 @@ func (s *Server) createMQTTClient(conn net.Conn, ws *websocket) *client {
 	}
 	c.initClient()
 	c.Debugf("Client connection created")
+	if err := c.acquireConnLimit(s.clientConnLimiter); err != nil {
+		c.mu.Unlock()
+		c.connLimitExceeded(err)
+		return nil
+	}
 	c.mu.Unlock()
 
 	s.mu.Lock()
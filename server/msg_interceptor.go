@@ -0,0 +1,276 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MsgInterceptor can be set in Options.MsgInterceptors by applications that
+// embed the server to inspect, annotate or reject messages published to
+// JetStream streams before they are stored.
+type MsgInterceptor interface {
+	// Name identifies the interceptor in errors, logs and statistics.
+	Name() string
+	// Intercept is called for every message published to a stream, in the
+	// order the interceptors were configured. Headers set on the message are
+	// stored with it. Returning an error rejects the message and the error is
+	// returned to the publisher. The context is done once the time budget is
+	// exceeded or the server shuts down, anything that can block should
+	// return then since messages for the stream wait on it.
+	Intercept(ctx context.Context, m *InterceptedMsg) error
+}
+
+// InterceptedMsg is a message on its way to be stored in a stream.
+type InterceptedMsg struct {
+	Account string
+	Stream  string
+	Subject string
+	// Header holds the raw headers of the message, if any.
+	Header []byte
+	// Data is the payload of the message. It must not be modified.
+	Data []byte
+}
+
+// GetHeader returns the value of the given header, or an empty string.
+func (m *InterceptedMsg) GetHeader(key string) string {
+	return string(getHeader(key, m.Header))
+}
+
+// SetHeader adds the given header to the message, replacing any previous value.
+func (m *InterceptedMsg) SetHeader(key, value string) {
+	m.Header = genHeader(stripHeaders(m.Header, key), key, value)
+}
+
+// MsgInterceptorStats are the statistics of a configured message interceptor.
+type MsgInterceptorStats struct {
+	Name      string        `json:"name"`
+	Calls     uint64        `json:"calls"`
+	Rejected  uint64        `json:"rejected"`
+	Timeouts  uint64        `json:"timeouts"`
+	Panics    uint64        `json:"panics"`
+	TotalTime time.Duration `json:"total_time"`
+	MaxTime   time.Duration `json:"max_time"`
+}
+
+var errMsgInterceptTimeout = errors.New("time budget exceeded")
+
+// Most messages each interceptor worker will hold before rejecting new ones.
+const msgInterceptMaxPending = 1024
+
+type msgInterceptor struct {
+	mi       MsgInterceptor
+	name     string
+	calls    uint64
+	rejected uint64
+	timeouts uint64
+	panics   uint64
+	total    int64
+	max      int64
+}
+
+// msgInterceptors runs the configured interceptors, each within the time budget.
+// Messages are handed to a fixed number of workers so the connections they
+// arrived on are never held up. All messages for a stream go to the same
+// worker to keep them in order.
+type msgInterceptors struct {
+	srv     *Server
+	timeout time.Duration
+	list    []*msgInterceptor
+	ctx     context.Context
+	cancel  context.CancelFunc
+	once    sync.Once
+	workers []*ipQueue // of *interceptedMsg
+}
+
+// A message waiting on the interceptors along with the stream it is for.
+type interceptedMsg struct {
+	mset  *stream
+	subj  string
+	reply string
+	hdr   []byte
+	msg   []byte
+}
+
+func newMsgInterceptors(s *Server, o *Options) *msgInterceptors {
+	if len(o.MsgInterceptors) == 0 {
+		return nil
+	}
+	mis := &msgInterceptors{srv: s, timeout: o.MsgInterceptTimeout}
+	if mis.timeout <= 0 {
+		mis.timeout = DEFAULT_MSG_INTERCEPT_TIMEOUT
+	}
+	for _, mi := range o.MsgInterceptors {
+		mis.list = append(mis.list, &msgInterceptor{mi: mi, name: mi.Name()})
+	}
+	n := o.MsgInterceptWorkers
+	if n <= 0 {
+		n = DEFAULT_MSG_INTERCEPT_WORKERS
+	}
+	mis.ctx, mis.cancel = context.WithCancel(context.Background())
+	for i := 0; i < n; i++ {
+		mis.workers = append(mis.workers, s.newIPQueue(fmt.Sprintf("Message interceptor %d", i))) // of *interceptedMsg
+	}
+	return mis
+}
+
+// queue hands the message to the worker for its stream. The message is rejected
+// right away if that worker is too far behind.
+func (mis *msgInterceptors) queue(mset *stream, subj, reply string, hdr, msg []byte) {
+	mis.once.Do(func() {
+		for _, q := range mis.workers {
+			q := q
+			mis.srv.startGoRoutine(func() { mis.processMsgs(q) })
+		}
+	})
+
+	h := fnv.New32a()
+	h.Write([]byte(mset.accName()))
+	h.Write([]byte(mset.name()))
+	q := mis.workers[h.Sum32()%uint32(len(mis.workers))]
+	if q.len() >= msgInterceptMaxPending {
+		mis.reject(mset, reply, NewJSInsufficientResourcesError())
+		return
+	}
+	q.push(&interceptedMsg{mset, subj, reply, copyBytes(hdr), copyBytes(msg)})
+}
+
+func (mis *msgInterceptors) processMsgs(q *ipQueue) {
+	s := mis.srv
+	defer s.grWG.Done()
+	defer q.unregister()
+
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-q.ch:
+			ims := q.pop()
+			for _, im := range ims {
+				m := im.(*interceptedMsg)
+				hdr, mi, err := mis.intercept(m.mset.accName(), m.mset.name(), m.subj, m.hdr, m.msg)
+				if err != nil {
+					mis.reject(m.mset, m.reply, NewJSMessageRejectedByInterceptorError(err, mi.name))
+					continue
+				}
+				m.mset.queueInboundMsg(m.subj, m.reply, hdr, m.msg)
+			}
+			q.recycle(&ims)
+		}
+	}
+}
+
+// Lets the publisher know its message was not stored.
+func (mis *msgInterceptors) reject(mset *stream, reply string, apiErr *ApiError) {
+	if reply == _EMPTY_ {
+		return
+	}
+	resp := &JSPubAckResponse{PubAck: &PubAck{Stream: mset.name()}, Error: apiErr}
+	b, _ := json.Marshal(resp)
+	mset.outq.sendMsg(reply, b)
+}
+
+// Cancels any interceptor still running so our workers can exit.
+func (mis *msgInterceptors) stop() {
+	if mis != nil {
+		mis.cancel()
+	}
+}
+
+// intercept passes the message through all interceptors and returns the
+// headers to store.
+func (mis *msgInterceptors) intercept(acc, stream, subject string, hdr, msg []byte) ([]byte, *msgInterceptor, error) {
+	m := &InterceptedMsg{Account: acc, Stream: stream, Subject: subject, Data: msg}
+	for _, mi := range mis.list {
+		// Each interceptor works on its own copy of the headers.
+		m.Header = copyBytes(hdr)
+		nhdr, err := mi.run(mis.ctx, m, mis.timeout)
+		if err != nil {
+			return nil, mi, err
+		}
+		hdr = nhdr
+	}
+	return hdr, nil, nil
+}
+
+func (mi *msgInterceptor) run(ctx context.Context, m *InterceptedMsg, timeout time.Duration) (hdr []byte, err error) {
+	atomic.AddUint64(&mi.calls, 1)
+	start := time.Now()
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&mi.panics, 1)
+			err = fmt.Errorf("panic: %v", r)
+		}
+		// Anything that took longer than the budget is rejected, even if it was fine.
+		if err == nil && ctx.Err() != nil {
+			err = errMsgInterceptTimeout
+		}
+		if errors.Is(err, context.DeadlineExceeded) || err == errMsgInterceptTimeout {
+			atomic.AddUint64(&mi.timeouts, 1)
+			err = errMsgInterceptTimeout
+		}
+
+		elapsed := int64(time.Since(start))
+		atomic.AddInt64(&mi.total, elapsed)
+		for max := atomic.LoadInt64(&mi.max); elapsed > max; max = atomic.LoadInt64(&mi.max) {
+			if atomic.CompareAndSwapInt64(&mi.max, max, elapsed) {
+				break
+			}
+		}
+		if err != nil {
+			atomic.AddUint64(&mi.rejected, 1)
+			hdr = nil
+		}
+	}()
+
+	if err = mi.mi.Intercept(ctx, m); err != nil {
+		return nil, err
+	}
+	return m.Header, nil
+}
+
+func (mis *msgInterceptors) stats() []*MsgInterceptorStats {
+	if mis == nil {
+		return nil
+	}
+	stats := make([]*MsgInterceptorStats, 0, len(mis.list))
+	for _, mi := range mis.list {
+		stats = append(stats, &MsgInterceptorStats{
+			Name:      mi.name,
+			Calls:     atomic.LoadUint64(&mi.calls),
+			Rejected:  atomic.LoadUint64(&mi.rejected),
+			Timeouts:  atomic.LoadUint64(&mi.timeouts),
+			Panics:    atomic.LoadUint64(&mi.panics),
+			TotalTime: time.Duration(atomic.LoadInt64(&mi.total)),
+			MaxTime:   time.Duration(atomic.LoadInt64(&mi.max)),
+		})
+	}
+	return stats
+}
+
+// MsgInterceptorStats returns the statistics of the configured message interceptors.
+func (s *Server) MsgInterceptorStats() []*MsgInterceptorStats {
+	return s.msgInterceptors.stats()
+}
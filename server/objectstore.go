@@ -0,0 +1,469 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// The layout of object store buckets matches the one used by the clients,
+// so buckets can be shared between embedded applications and clients.
+const (
+	objStreamPrefix = "OBJ_"
+	objChunkSubj    = "$O.%s.C.%s"
+	objMetaSubj     = "$O.%s.M.%s"
+	objAllChunks    = "$O.%s.C.>"
+	objAllMeta      = "$O.%s.M.>"
+	objDigestPrefix = "SHA-256="
+
+	// Default size of the chunks objects are split into.
+	defaultObjChunkSize = 128 * 1024
+)
+
+var (
+	// ErrObjectStoreClustered is returned when using an object store in clustered mode.
+	ErrObjectStoreClustered = errors.New("object store not supported in clustered mode")
+	// ErrBadObjectStoreBucket is returned for an invalid bucket name.
+	ErrBadObjectStoreBucket = errors.New("object store bucket name is not valid")
+	// ErrObjectNameRequired is returned when an object name is empty.
+	ErrObjectNameRequired = errors.New("object name required")
+	// ErrObjectNotFound is returned when an object does not exist or has been deleted.
+	ErrObjectNotFound = errors.New("object not found")
+	// ErrObjectIncomplete is returned when chunks of an object are missing.
+	ErrObjectIncomplete = errors.New("object is missing chunks")
+	// ErrObjectDigestMismatch is returned when an object does not match its digest.
+	ErrObjectDigestMismatch = errors.New("object digest does not match")
+	// ErrBadObjectOffset is returned when reading past the end of an object.
+	ErrBadObjectOffset = errors.New("object offset is past the end of the object")
+)
+
+// ObjectStoreConfig is the configuration of an object store bucket.
+type ObjectStoreConfig struct {
+	Bucket      string        `json:"bucket"`
+	Description string        `json:"description,omitempty"`
+	TTL         time.Duration `json:"max_age,omitempty"`
+	MaxBytes    int64         `json:"max_bytes,omitempty"`
+	Storage     StorageType   `json:"storage"`
+	// ChunkSize is the largest payload stored in a single message.
+	// Defaults to 128KB.
+	ChunkSize int `json:"chunk_size,omitempty"`
+}
+
+// ObjectInfo is the metadata record kept for each object.
+type ObjectInfo struct {
+	Name        string             `json:"name"`
+	Description string             `json:"description,omitempty"`
+	Bucket      string             `json:"bucket"`
+	NUID        string             `json:"nuid"`
+	Size        uint64             `json:"size"`
+	ModTime     time.Time          `json:"mtime"`
+	Chunks      uint32             `json:"chunks"`
+	Digest      string             `json:"digest,omitempty"`
+	Deleted     bool               `json:"deleted,omitempty"`
+	Options     *ObjectMetaOptions `json:"options,omitempty"`
+}
+
+// ObjectMetaOptions are options recorded with an object.
+type ObjectMetaOptions struct {
+	MaxChunkSize uint32 `json:"max_chunk_size,omitempty"`
+}
+
+// ObjectStore stores large payloads in a stream by splitting them into
+// chunks, with a metadata record per object.
+type ObjectStore struct {
+	mset      *stream
+	bucket    string
+	chunkSize int
+}
+
+func validObjectStoreBucket(bucket string) bool {
+	if bucket == _EMPTY_ {
+		return false
+	}
+	for _, c := range bucket {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+// Object stores write to the stream directly, which is only correct when
+// this server is the only one holding the stream.
+func (a *Account) checkObjectStore(bucket string) error {
+	if !validObjectStoreBucket(bucket) {
+		return ErrBadObjectStoreBucket
+	}
+	if s := a.srv; s != nil && s.JetStreamIsClustered() {
+		return ErrObjectStoreClustered
+	}
+	return nil
+}
+
+// CreateObjectStore will create an object store bucket, or return the
+// existing one if the bucket already exists.
+func (a *Account) CreateObjectStore(cfg *ObjectStoreConfig) (*ObjectStore, error) {
+	if cfg == nil {
+		return nil, ErrBadObjectStoreBucket
+	}
+	if err := a.checkObjectStore(cfg.Bucket); err != nil {
+		return nil, err
+	}
+	if cfg.ChunkSize < 0 {
+		return nil, fmt.Errorf("object store chunk size can not be negative")
+	}
+	chunkSize, maxPayload := cfg.ChunkSize, a.maxObjectChunkSize()
+	if chunkSize > maxPayload {
+		return nil, fmt.Errorf("object store chunk size %d exceeds max payload of %d", chunkSize, maxPayload)
+	}
+	if chunkSize == 0 {
+		chunkSize = defaultObjChunkSize
+		if chunkSize > maxPayload {
+			chunkSize = maxPayload
+		}
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = -1
+	}
+	mset, err := a.addStream(&StreamConfig{
+		Name:        objStreamPrefix + cfg.Bucket,
+		Description: cfg.Description,
+		Subjects:    []string{fmt.Sprintf(objAllChunks, cfg.Bucket), fmt.Sprintf(objAllMeta, cfg.Bucket)},
+		MaxAge:      cfg.TTL,
+		MaxBytes:    maxBytes,
+		Storage:     cfg.Storage,
+		Replicas:    1,
+		Discard:     DiscardNew,
+		AllowRollup: true,
+		AllowDirect: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectStore{mset: mset, bucket: cfg.Bucket, chunkSize: chunkSize}, nil
+}
+
+// Returns the largest chunk we can store, which is bound by the max payload
+// of the server and the account.
+func (a *Account) maxObjectChunkSize() int {
+	max := MAX_PAYLOAD_SIZE
+	if s := a.srv; s != nil {
+		if mp := int(s.getOpts().MaxPayload); mp > 0 {
+			max = mp
+		}
+	}
+	a.mu.RLock()
+	if a.mpay > 0 && int(a.mpay) < max {
+		max = int(a.mpay)
+	}
+	a.mu.RUnlock()
+	return max
+}
+
+// ObjectStore returns an existing object store bucket.
+func (a *Account) ObjectStore(bucket string) (*ObjectStore, error) {
+	if err := a.checkObjectStore(bucket); err != nil {
+		return nil, err
+	}
+	mset, err := a.lookupStream(objStreamPrefix + bucket)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := defaultObjChunkSize
+	if max := a.maxObjectChunkSize(); chunkSize > max {
+		chunkSize = max
+	}
+	return &ObjectStore{mset: mset, bucket: bucket, chunkSize: chunkSize}, nil
+}
+
+// DeleteObjectStore will delete an object store bucket and all of its objects.
+func (a *Account) DeleteObjectStore(bucket string) error {
+	if err := a.checkObjectStore(bucket); err != nil {
+		return err
+	}
+	mset, err := a.lookupStream(objStreamPrefix + bucket)
+	if err != nil {
+		return err
+	}
+	return mset.delete()
+}
+
+// Bucket returns the name of the bucket.
+func (obs *ObjectStore) Bucket() string {
+	return obs.bucket
+}
+
+func (obs *ObjectStore) metaSubject(name string) string {
+	return fmt.Sprintf(objMetaSubj, obs.bucket, base64.URLEncoding.EncodeToString([]byte(name)))
+}
+
+func (obs *ObjectStore) chunkSubject(nuid string) string {
+	return fmt.Sprintf(objChunkSubj, obs.bucket, nuid)
+}
+
+func (obs *ObjectStore) purgeChunks(nuid string) error {
+	_, err := obs.mset.purge(&JSApiStreamPurgeRequest{Subject: obs.chunkSubject(nuid)})
+	return err
+}
+
+// Will store the metadata record, replacing the previous one for the object.
+func (obs *ObjectStore) putMeta(info *ObjectInfo) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	hdr := genHeader(nil, JSMsgRollup, JSMsgRollupSubject)
+	return obs.mset.processJetStreamMsg(obs.metaSubject(info.Name), _EMPTY_, hdr, b, 0, 0)
+}
+
+// Put will store the contents of r as the named object, replacing any
+// previous version once it has been completely written.
+func (obs *ObjectStore) Put(name string, r io.Reader) (*ObjectInfo, error) {
+	if name == _EMPTY_ {
+		return nil, ErrObjectNameRequired
+	}
+	prev, err := obs.GetInfo(name)
+	if err != nil && err != ErrObjectNotFound {
+		return nil, err
+	}
+
+	info := &ObjectInfo{
+		Name:    name,
+		Bucket:  obs.bucket,
+		NUID:    nuid.Next(),
+		Options: &ObjectMetaOptions{MaxChunkSize: uint32(obs.chunkSize)},
+	}
+	subj := obs.chunkSubject(info.NUID)
+	h := sha256.New()
+	buf := make([]byte, obs.chunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := obs.mset.processJetStreamMsg(subj, _EMPTY_, nil, copyBytes(buf[:n]), 0, 0); err != nil {
+				obs.purgeChunks(info.NUID)
+				return nil, err
+			}
+			h.Write(buf[:n])
+			info.Size += uint64(n)
+			info.Chunks++
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			obs.purgeChunks(info.NUID)
+			return nil, rerr
+		}
+	}
+	info.ModTime = time.Now().UTC()
+	info.Digest = objDigestPrefix + base64.URLEncoding.EncodeToString(h.Sum(nil))
+	if err := obs.putMeta(info); err != nil {
+		obs.purgeChunks(info.NUID)
+		return nil, err
+	}
+	// The new version is in place so drop the chunks of the previous one.
+	if prev != nil {
+		obs.purgeChunks(prev.NUID)
+	}
+	return info, nil
+}
+
+// PutBytes will store data as the named object.
+func (obs *ObjectStore) PutBytes(name string, data []byte) (*ObjectInfo, error) {
+	return obs.Put(name, bytes.NewReader(data))
+}
+
+// GetInfo returns the metadata of the named object.
+func (obs *ObjectStore) GetInfo(name string) (*ObjectInfo, error) {
+	if name == _EMPTY_ {
+		return nil, ErrObjectNameRequired
+	}
+	var smv StoreMsg
+	sm, err := obs.mset.store.LoadLastMsg(obs.metaSubject(name), &smv)
+	if err != nil {
+		if err == ErrStoreMsgNotFound {
+			return nil, ErrObjectNotFound
+		}
+		return nil, err
+	}
+	var info ObjectInfo
+	if err := json.Unmarshal(sm.msg, &info); err != nil {
+		return nil, err
+	}
+	if info.Deleted {
+		return nil, ErrObjectNotFound
+	}
+	return &info, nil
+}
+
+// Delete will remove the named object. A deleted marker is kept in place
+// of the metadata record.
+func (obs *ObjectStore) Delete(name string) error {
+	info, err := obs.GetInfo(name)
+	if err != nil {
+		return err
+	}
+	if err := obs.purgeChunks(info.NUID); err != nil {
+		return err
+	}
+	info.Deleted, info.Size, info.Chunks, info.Digest = true, 0, 0, _EMPTY_
+	info.ModTime = time.Now().UTC()
+	return obs.putMeta(info)
+}
+
+// List returns the metadata of all objects in the bucket.
+func (obs *ObjectStore) List() ([]*ObjectInfo, error) {
+	var infos []*ObjectInfo
+	var smv StoreMsg
+	filter := fmt.Sprintf(objAllMeta, obs.bucket)
+	for seq := uint64(0); ; seq++ {
+		sm, nseq, err := obs.mset.store.LoadNextMsg(filter, true, seq, &smv)
+		if err != nil {
+			if err == ErrStoreEOF {
+				break
+			}
+			return nil, err
+		}
+		var info ObjectInfo
+		if err := json.Unmarshal(sm.msg, &info); err == nil && !info.Deleted {
+			infos = append(infos, &info)
+		}
+		seq = nseq
+	}
+	return infos, nil
+}
+
+// Get returns a reader for the contents of the named object.
+func (obs *ObjectStore) Get(name string) (*ObjectReader, error) {
+	return obs.GetAt(name, 0)
+}
+
+// GetAt returns a reader for the contents of the named object starting at
+// the given offset. This allows resuming an interrupted read using the
+// offset reported by the reader.
+func (obs *ObjectStore) GetAt(name string, off uint64) (*ObjectReader, error) {
+	info, err := obs.GetInfo(name)
+	if err != nil {
+		return nil, err
+	}
+	if off > info.Size {
+		return nil, ErrBadObjectOffset
+	}
+	r := &ObjectReader{obs: obs, info: info, subj: obs.chunkSubject(info.NUID), off: off}
+	if off == 0 {
+		// We can only check the digest when reading the whole object.
+		r.h = sha256.New()
+		return r, nil
+	}
+
+	// Skip over the chunks before our offset.
+	var skip uint64
+	for skip+r.chunkLen() <= off && skip < info.Size {
+		n, err := r.loadChunk(false)
+		if err != nil {
+			return nil, err
+		}
+		skip += uint64(n)
+	}
+	if skip < off {
+		if _, err := r.loadChunk(true); err != nil {
+			return nil, err
+		}
+		r.buf = r.buf[off-skip:]
+	}
+	return r, nil
+}
+
+// ObjectReader reads the contents of an object.
+type ObjectReader struct {
+	obs  *ObjectStore
+	info *ObjectInfo
+	subj string
+	seq  uint64
+	off  uint64
+	buf  []byte
+	h    hash.Hash
+}
+
+// Info returns the metadata of the object being read.
+func (r *ObjectReader) Info() *ObjectInfo {
+	return r.info
+}
+
+// Offset returns the number of bytes of the object read so far, which can be
+// passed to GetAt to resume reading.
+func (r *ObjectReader) Offset() uint64 {
+	return r.off
+}
+
+// Size of the chunks of this object, used to skip ahead when resuming.
+func (r *ObjectReader) chunkLen() uint64 {
+	if o := r.info.Options; o != nil && o.MaxChunkSize > 0 {
+		return uint64(o.MaxChunkSize)
+	}
+	return defaultObjChunkSize
+}
+
+// Will load the next chunk, keeping its contents if asked to.
+func (r *ObjectReader) loadChunk(keep bool) (int, error) {
+	var smv StoreMsg
+	sm, nseq, err := r.obs.mset.store.LoadNextMsg(r.subj, false, r.seq, &smv)
+	if err != nil {
+		if err == ErrStoreEOF {
+			return 0, ErrObjectIncomplete
+		}
+		return 0, err
+	}
+	r.seq = nseq + 1
+	if keep {
+		r.buf = copyBytes(sm.msg)
+	}
+	return len(sm.msg), nil
+}
+
+// Read implements io.Reader.
+func (r *ObjectReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.off >= r.info.Size {
+			if r.h != nil {
+				digest := objDigestPrefix + base64.URLEncoding.EncodeToString(r.h.Sum(nil))
+				if digest != r.info.Digest {
+					return 0, ErrObjectDigestMismatch
+				}
+			}
+			return 0, io.EOF
+		}
+		if _, err := r.loadChunk(true); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	if r.h != nil {
+		r.h.Write(r.buf[:n])
+	}
+	r.buf = r.buf[n:]
+	r.off += uint64(n)
+	return n, nil
+}
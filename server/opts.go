@@ -139,6 +139,35 @@ type LeafNodeOpts struct {
 	NoAdvertise       bool          `json:"-"`
 	ReconnectInterval time.Duration `json:"-"`
 
+	// Override the server's ping settings for leafnode connections.
+	PingInterval time.Duration `json:"ping_interval,omitempty"`
+	MaxPingsOut  int           `json:"ping_max,omitempty"`
+
+	// Weight of queue members reached through leafnode connections relative to
+	// local and routed members. The default of zero only delivers to leafnode
+	// members when no other member is available, 1 distributes by member count.
+	QueueWeight float64 `json:"queue_weight,omitempty"`
+
+	// Limits on accepted leafnode connections per remote address.
+	ConnLimits *ConnLimitOpts `json:"connection_limits,omitempty"`
+
+	// When set, the TLS certificate and key files of the leafnode listener and
+	// the credentials, certificate and key files of the remotes are checked at
+	// this interval. Changed TLS material is reloaded and remotes reconnect
+	// with the new files, without the need for a configuration reload.
+	WatchInterval time.Duration `json:"-"`
+
+	// When set, subscription interest updates sent over leafnode connections
+	// are held for this long and coalesced, so that only the resulting interest
+	// is sent. This reduces protocol traffic for applications with a lot of
+	// subscription churn, at the expense of interest propagating later.
+	InterestCoalesce time.Duration `json:"-"`
+
+	// Subjects accepted leafnode connections can not send to us (imports)
+	// or receive from us (exports), on top of any user permissions.
+	DenyImports []string `json:"-"`
+	DenyExports []string `json:"-"`
+
 	// For solicited connections to other clusters/superclusters.
 	Remotes []*RemoteLeafOpts `json:"remotes,omitempty"`
 
@@ -186,6 +215,22 @@ type RemoteLeafOpts struct {
 		NoMasking   bool `json:"-"`
 	}
 
+	// Weight of queue members reached through this connection. When not set, the
+	// leafnode QueueWeight applies, while zero opts this connection out of weighting.
+	// This allows to prefer local delivery over one link while distributing over another.
+	QueueWeight *float64 `json:"queue_weight,omitempty"`
+
+	// Proxy is an optional HTTP or SOCKS5 proxy the connection to the remote is
+	// tunneled through, for servers behind restrictive firewalls. The URL scheme
+	// selects the protocol, "http" uses a CONNECT request and "socks5" a SOCKS5
+	// CONNECT command. Credentials for the proxy can be set as the URL's user information.
+	Proxy *url.URL `json:"-"`
+
+	// HideLocalAccount prevents reporting the name of the local account this remote
+	// is bound to in the CONNECT, for when local naming should not be disclosed
+	// to the remote side.
+	HideLocalAccount bool `json:"hide_local_account,omitempty"`
+
 	tlsConfigOpts *TLSConfigOpts
 
 	// If we are clustered and our local account has JetStream, if apps are accessing
@@ -202,6 +247,19 @@ type JSLimitOpts struct {
 	Duplicates      time.Duration
 }
 
+// JSArchiveOpts configures archiving of cold message blocks for file based
+// streams to S3 compatible object storage.
+type JSArchiveOpts struct {
+	Endpoint      string
+	Bucket        string
+	Region        string
+	AccessKey     string
+	SecretKey     string
+	Prefix        string
+	MaxAge        time.Duration
+	MaxLocalBytes int64
+}
+
 // Options block for nats-server.
 // NOTE: This structure is no longer used for monitoring endpoints
 // and json tags are deprecated and may be removed in the future.
@@ -253,13 +311,28 @@ type Options struct {
 	JetStreamExtHint      string        `json:"-"`
 	JetStreamKey          string        `json:"-"`
 	JetStreamCipher       StoreCipher   `json:"-"`
+	JetStreamPrevKey      string        `json:"-"`
+	JetStreamReKeyRate    int64
 	JetStreamUniqueTag    string
 	JetStreamLimits       JSLimitOpts
 	JetStreamMaxCatchup   int64
+	JetStreamMaxOpenFiles int64
+	JetStreamMemoryBudget int64
+	JetStreamBackgroundIO int64
+	JetStreamArchive      *JSArchiveOpts `json:"-"`
+	JetStreamAPIWorkers   int
+	JetStreamAPIQueueMax  int
+	JetStreamAPIRateLimit int
+	JetStreamRecoveryJobs int
+	JetStreamMaxClockSkew time.Duration
+	JetStreamSchedWorkers int
+	JetStreamRebuildState bool              `json:"-"`
 	StoreDir              string            `json:"-"`
 	JsAccDefaultDomain    map[string]string `json:"-"` // account to domain name mapping
 	Websocket             WebsocketOpts     `json:"-"`
 	MQTT                  MQTTOpts          `json:"-"`
+	Webhook               WebhookOpts       `json:"-"`
+	Statsz                StatszOpts        `json:"-"`
 	ProfPort              int               `json:"-"`
 	PidFile               string            `json:"-"`
 	PortsFileDir          string            `json:"-"`
@@ -288,6 +361,12 @@ type Options struct {
 	// MaxTracedMsgLen is the maximum printable length for traced messages.
 	MaxTracedMsgLen int `json:"-"`
 
+	// SubjectStats is the number of top subjects tracked per account. 0 disables tracking.
+	SubjectStats int `json:"-"`
+
+	// ConnLimits limits accepted client connections per remote IP or CIDR block.
+	ConnLimits *ConnLimitOpts `json:"connection_limits,omitempty"`
+
 	// Operating a trusted NATS server
 	TrustedKeys              []string              `json:"-"`
 	TrustedOperators         []*jwt.OperatorClaims `json:"-"`
@@ -302,6 +381,14 @@ type Options struct {
 	CustomClientAuthentication Authentication `json:"-"`
 	CustomRouterAuthentication Authentication `json:"-"`
 
+	// MsgInterceptors are run, in order, on messages published to JetStream
+	// streams before they are stored. Each has MsgInterceptTimeout to decide,
+	// after which the message is rejected. They are run by MsgInterceptWorkers
+	// Go routines.
+	MsgInterceptors     []MsgInterceptor `json:"-"`
+	MsgInterceptTimeout time.Duration    `json:"-"`
+	MsgInterceptWorkers int              `json:"-"`
+
 	// CheckConfig configuration file syntax test was successful and exit.
 	CheckConfig bool `json:"-"`
 
@@ -405,6 +492,35 @@ type WebsocketOpts struct {
 	HandshakeTimeout time.Duration
 }
 
+// WebhookOpts are options for posting server events to an HTTP endpoint.
+type WebhookOpts struct {
+	// URL the events will be posted to.
+	URL string
+	// Secret, if set, is used to sign the body with HMAC-SHA256.
+	Secret string
+	// Events to send. If empty all events are sent.
+	Events []string
+	// MaxRetries is the number of times a failed post is retried.
+	MaxRetries int
+	// Timeout for each post.
+	Timeout time.Duration
+}
+
+// StatszOpts are options for the periodic server stats (statsz) events
+// sent to the system account.
+type StatszOpts struct {
+	// Interval is the maximum time between two statsz events.
+	// Defaults to 30 seconds.
+	Interval time.Duration
+	// JetStreamStorage includes the number of streams, consumers,
+	// messages and bytes stored by this server.
+	JetStreamStorage bool
+	// Leafnodes includes the number of leafnode connections.
+	Leafnodes bool
+	// RouteRTT includes the round trip time of each route.
+	RouteRTT bool
+}
+
 // MQTTOpts are options for MQTT
 type MQTTOpts struct {
 	// The server will accept MQTT client connections on this hostname/IP.
@@ -951,8 +1067,17 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 		o.MaxPending = v.(int64)
 	case "max_connections", "max_conn":
 		o.MaxConn = int(v.(int64))
+	case "connection_limits":
+		cl, err := parseConnLimits(tk, errors, warnings)
+		if err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+		o.ConnLimits = cl
 	case "max_traced_msg_len":
 		o.MaxTracedMsgLen = int(v.(int64))
+	case "subject_stats":
+		o.SubjectStats = int(v.(int64))
 	case "max_subscriptions", "max_subs":
 		o.MaxSubs = int(v.(int64))
 	case "max_sub_tokens", "max_subscription_tokens":
@@ -1332,6 +1457,16 @@ func (o *Options) processConfigFileLine(k string, v interface{}, errors *[]error
 			*errors = append(*errors, err)
 			return
 		}
+	case "webhook":
+		if err := parseWebhook(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
+	case "statsz":
+		if err := parseStatsz(tk, o, errors, warnings); err != nil {
+			*errors = append(*errors, err)
+			return
+		}
 	case "server_tags":
 		var err error
 		switch v := v.(type) {
@@ -1885,6 +2020,64 @@ func parseJetStreamLimits(v interface{}, opts *Options, errors *[]error, warning
 	return nil
 }
 
+func parseJetStreamArchive(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	tk, v := unwrapValue(v, &lt)
+
+	ao := &JSArchiveOpts{}
+
+	vv, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected a map to define the JetStream archive, got %T", v)}
+	}
+	for mk, mv := range vv {
+		tk, mv = unwrapValue(mv, &lt)
+		var sv *string
+		switch strings.ToLower(mk) {
+		case "endpoint", "url":
+			sv = &ao.Endpoint
+		case "bucket":
+			sv = &ao.Bucket
+		case "region":
+			sv = &ao.Region
+		case "access_key":
+			sv = &ao.AccessKey
+		case "secret_key":
+			sv = &ao.SecretKey
+		case "prefix":
+			sv = &ao.Prefix
+		case "max_age":
+			ao.MaxAge = parseDuration(mk, tk, mv, errors, warnings)
+		case "max_local_bytes", "max_local":
+			s, err := getStorageSize(mv)
+			if err != nil {
+				return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+			}
+			ao.MaxLocalBytes = s
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+		if sv != nil {
+			str, ok := mv.(string)
+			if !ok {
+				return &configErr{tk, fmt.Sprintf("Expected %s to be a string, got %T", strings.ToLower(mk), mv)}
+			}
+			*sv = str
+		}
+	}
+	opts.JetStreamArchive = ao
+	return nil
+}
+
 // Parse enablement of jetstream for a server.
 func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]error) error {
 	var lt token
@@ -1935,6 +2128,14 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				doEnable = mv.(bool)
 			case "key", "ek", "encryption_key":
 				opts.JetStreamKey = mv.(string)
+			case "prev_key", "previous_key", "prev_encryption_key":
+				opts.JetStreamPrevKey = mv.(string)
+			case "rekey_rate", "max_rekey_io":
+				s, err := getStorageSize(mv)
+				if err != nil {
+					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+				}
+				opts.JetStreamReKeyRate = s
 			case "cipher":
 				switch strings.ToLower(mv.(string)) {
 				case "chacha", "chachapoly":
@@ -1950,6 +2151,10 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				if err := parseJetStreamLimits(tk, opts, errors, warnings); err != nil {
 					return err
 				}
+			case "archive":
+				if err := parseJetStreamArchive(tk, opts, errors, warnings); err != nil {
+					return err
+				}
 			case "unique_tag":
 				opts.JetStreamUniqueTag = strings.ToLower(strings.TrimSpace(mv.(string)))
 			case "max_outstanding_catchup":
@@ -1958,6 +2163,58 @@ func parseJetStream(v interface{}, opts *Options, errors *[]error, warnings *[]e
 					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
 				}
 				opts.JetStreamMaxCatchup = s
+			case "max_open_files":
+				v, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				opts.JetStreamMaxOpenFiles = v
+			case "rebuild_state":
+				opts.JetStreamRebuildState = mv.(bool)
+			case "memory_budget", "max_process_memory":
+				s, err := getStorageSize(mv)
+				if err != nil {
+					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+				}
+				opts.JetStreamMemoryBudget = s
+			case "max_background_io":
+				s, err := getStorageSize(mv)
+				if err != nil {
+					return &configErr{tk, fmt.Sprintf("%s %s", strings.ToLower(mk), err)}
+				}
+				opts.JetStreamBackgroundIO = s
+			case "api_concurrency":
+				v, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				opts.JetStreamAPIWorkers = int(v)
+			case "api_queue_limit":
+				v, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				opts.JetStreamAPIQueueMax = int(v)
+			case "api_rate_limit":
+				v, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				opts.JetStreamAPIRateLimit = int(v)
+			case "delivery_workers":
+				v, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				opts.JetStreamSchedWorkers = int(v)
+			case "recovery_concurrency":
+				v, ok := mv.(int64)
+				if !ok {
+					return &configErr{tk, fmt.Sprintf("Expected an integer for %q, got %v", mk, mv)}
+				}
+				opts.JetStreamRecoveryJobs = int(v)
+			case "max_clock_skew":
+				opts.JetStreamMaxClockSkew = parseDuration(mk, tk, mv, errors, warnings)
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -2031,8 +2288,40 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 				continue
 			}
 			opts.LeafNode.Remotes = remotes
+		case "connection_limits":
+			cl, err := parseConnLimits(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.ConnLimits = cl
 		case "reconnect", "reconnect_delay", "reconnect_interval":
 			opts.LeafNode.ReconnectInterval = time.Duration(int(mv.(int64))) * time.Second
+		case "ping_interval":
+			if d := parseDuration("ping_interval", tk, mv, errors, warnings); d < 0 {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("%s value can not be negative", mk)})
+			} else {
+				opts.LeafNode.PingInterval = d
+			}
+		case "ping_max":
+			if n := mv.(int64); n < 0 {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("%s value can not be negative", mk)})
+			} else {
+				opts.LeafNode.MaxPingsOut = int(n)
+			}
+		case "watch_interval":
+			opts.LeafNode.WatchInterval = parseDuration("watch_interval", tk, mv, errors, warnings)
+		case "interest_coalesce":
+			opts.LeafNode.InterestCoalesce = parseDuration("interest_coalesce", tk, mv, errors, warnings)
+		case "queue_weight":
+			switch v := mv.(type) {
+			case int64:
+				opts.LeafNode.QueueWeight = float64(v)
+			case float64:
+				opts.LeafNode.QueueWeight = v
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("queue_weight should be a number, got %T", mv)})
+			}
 		case "tls":
 			tc, err := parseTLS(tk, true)
 			if err != nil {
@@ -2053,6 +2342,20 @@ func parseLeafNodes(v interface{}, opts *Options, errors *[]error, warnings *[]e
 		case "no_advertise":
 			opts.LeafNode.NoAdvertise = mv.(bool)
 			trackExplicitVal(opts, &opts.inConfig, "LeafNode.NoAdvertise", opts.LeafNode.NoAdvertise)
+		case "deny_imports", "deny_import":
+			subjects, err := parsePermSubjects(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.DenyImports = subjects
+		case "deny_exports", "deny_export":
+			subjects, err := parsePermSubjects(tk, errors, warnings)
+			if err != nil {
+				*errors = append(*errors, err)
+				continue
+			}
+			opts.LeafNode.DenyExports = subjects
 		case "min_version", "minimum_version":
 			version := mv.(string)
 			if err := checkLeafMinVersionConfig(version); err != nil {
@@ -2173,6 +2476,19 @@ func parseLeafUsers(mv interface{}, errors *[]error, warnings *[]error) ([]*User
 				// we need to create internal objects to store u/p and account
 				// name and have a server structure to hold that.
 				user.Account = NewAccount(v.(string))
+			case "permission", "permissions", "authorization":
+				perms, err := parseUserPermissions(tk, errors, warnings)
+				if err != nil {
+					*errors = append(*errors, err)
+					continue
+				}
+				// Dynamic response permissions do not make sense here.
+				if perms.Response != nil {
+					err := &configErr{tk, "Leafnode user permissions do not support dynamic responses"}
+					*errors = append(*errors, err)
+					continue
+				}
+				user.Permissions = perms
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -2283,8 +2599,27 @@ func parseRemoteLeafNodes(v interface{}, errors *[]error, warnings *[]error) ([]
 				remote.Websocket.Compression = v.(bool)
 			case "ws_no_masking", "websocket_no_masking":
 				remote.Websocket.NoMasking = v.(bool)
+			case "proxy":
+				url, err := parseURL(v.(string), "leafnode proxy")
+				if err != nil {
+					*errors = append(*errors, &configErr{tk, err.Error()})
+					continue
+				}
+				remote.Proxy = url
+			case "queue_weight":
+				switch qw := v.(type) {
+				case int64:
+					w := float64(qw)
+					remote.QueueWeight = &w
+				case float64:
+					remote.QueueWeight = &qw
+				default:
+					*errors = append(*errors, &configErr{tk, fmt.Sprintf("queue_weight should be a number, got %T", v)})
+				}
 			case "jetstream_cluster_migrate", "js_cluster_migrate":
 				remote.JetStreamClusterMigrate = true
+			case "hide_local_account":
+				remote.HideLocalAccount = v.(bool)
 			default:
 				if !tk.IsUsedVariable() {
 					err := &unknownConfigFieldErr{
@@ -4070,6 +4405,56 @@ func parseStringArray(fieldName string, tk token, lt *token, mv interface{}, err
 	}
 }
 
+// parseConnLimits parses the per address connection limits of a listener.
+func parseConnLimits(v interface{}, errors *[]error, warnings *[]error) (*ConnLimitOpts, error) {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	cm, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, &configErr{tk, fmt.Sprintf("Expected connection_limits to be a map, got %T", v)}
+	}
+	cl := &ConnLimitOpts{}
+	for mk, mv := range cm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "per_ip", "max_per_ip":
+			cl.PerIP = int(mv.(int64))
+		case "per_cidr", "max_per_cidr":
+			pm, ok := mv.(map[string]interface{})
+			if !ok {
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected per_cidr to be a map, got %T", mv)})
+				continue
+			}
+			cl.PerCIDR = make(map[string]int, len(pm))
+			for cidr, max := range pm {
+				_, max = unwrapValue(max, &lt)
+				cl.PerCIDR[cidr] = int(max.(int64))
+			}
+		case "allow":
+			cl.Allow, _ = parseStringArray("allow", tk, &lt, mv, errors, warnings)
+		case "deny":
+			cl.Deny, _ = parseStringArray("deny", tk, &lt, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	if _, err := newConnLimiter(cl); err != nil {
+		return nil, &configErr{tk, err.Error()}
+	}
+	return cl, nil
+}
+
 func parseWebsocket(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
@@ -4163,6 +4548,90 @@ func parseWebsocket(v interface{}, o *Options, errors *[]error, warnings *[]erro
 	return nil
 }
 
+func parseWebhook(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	wm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected webhook to be a map, got %T", v)}
+	}
+	for mk, mv := range wm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "url":
+			o.Webhook.URL = mv.(string)
+		case "secret":
+			o.Webhook.Secret = mv.(string)
+		case "events":
+			switch ev := mv.(type) {
+			case string:
+				o.Webhook.Events = append(o.Webhook.Events, ev)
+			case []interface{}:
+				for _, e := range ev {
+					_, e = unwrapValue(e, &lt)
+					o.Webhook.Events = append(o.Webhook.Events, e.(string))
+				}
+			default:
+				*errors = append(*errors, &configErr{tk, fmt.Sprintf("Expected events to be a string or an array, got %T", mv)})
+			}
+		case "max_retries":
+			o.Webhook.MaxRetries = int(mv.(int64))
+		case "timeout":
+			o.Webhook.Timeout = parseDuration("timeout", tk, mv, errors, warnings)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
+func parseStatsz(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
+	var lt token
+	defer convertPanicToErrorList(&lt, errors)
+
+	tk, v := unwrapValue(v, &lt)
+	sm, ok := v.(map[string]interface{})
+	if !ok {
+		return &configErr{tk, fmt.Sprintf("Expected statsz to be a map, got %T", v)}
+	}
+	for mk, mv := range sm {
+		tk, mv = unwrapValue(mv, &lt)
+		switch strings.ToLower(mk) {
+		case "interval":
+			o.Statsz.Interval = parseDuration("interval", tk, mv, errors, warnings)
+		case "jetstream_storage", "js_storage":
+			o.Statsz.JetStreamStorage = mv.(bool)
+		case "leafnodes", "leafs":
+			o.Statsz.Leafnodes = mv.(bool)
+		case "route_rtt", "routes_rtt":
+			o.Statsz.RouteRTT = mv.(bool)
+		default:
+			if !tk.IsUsedVariable() {
+				err := &unknownConfigFieldErr{
+					field: mk,
+					configErr: configErr{
+						token: tk,
+					},
+				}
+				*errors = append(*errors, err)
+				continue
+			}
+		}
+	}
+	return nil
+}
+
 func parseMQTT(v interface{}, o *Options, errors *[]error, warnings *[]error) error {
 	var lt token
 	defer convertPanicToErrorList(&lt, errors)
@@ -4385,6 +4854,9 @@ func MergeOptions(fileOpts, flagOpts *Options) *Options {
 	if flagOpts.JetStream {
 		fileOpts.JetStream = flagOpts.JetStream
 	}
+	if flagOpts.JetStreamRebuildState {
+		opts.JetStreamRebuildState = true
+	}
 	return &opts
 }
 
@@ -4712,6 +5184,7 @@ func ConfigureOptions(fs *flag.FlagSet, args []string, printVersion, printHelp,
 	fs.BoolVar(&opts.JetStream, "jetstream", false, "Enable JetStream.")
 	fs.StringVar(&opts.StoreDir, "sd", "", "Storage directory.")
 	fs.StringVar(&opts.StoreDir, "store_dir", "", "Storage directory.")
+	fs.BoolVar(&opts.JetStreamRebuildState, "js_rebuild_state", false, "Rebuild stream state from message block files on startup.")
 
 	// The flags definition above set "default" values to some of the options.
 	// Calling Parse() here will override the default options with any value
@@ -1521,6 +1521,19 @@ func TestConfigureOptions(t *testing.T) {
 		t.Fatal("Debug and Trace should have been set to true")
 	}
 
+	// Rebuilding stream state from the command line applies along with a config file.
+	opts = mustNotFail([]string{"-c", "./configs/test.conf", "--js_rebuild_state"})
+	if !opts.JetStreamRebuildState {
+		t.Fatal("JetStreamRebuildState should have been set to true")
+	}
+
+	// Or can be set in the config file.
+	conf := createConfFile(t, []byte(`jetstream { rebuild_state: true }`))
+	opts = mustNotFail([]string{"-c", conf})
+	if !opts.JetStreamRebuildState {
+		t.Fatal("JetStreamRebuildState should have been set to true")
+	}
+
 	// This should fail since -cluster is missing
 	expectedURL, _ := url.Parse("nats://127.0.0.1:6223")
 	expectToFail([]string{"-routes", expectedURL.String()}, "solicited routes")
@@ -539,6 +539,29 @@ func (p *pingIntervalOption) Apply(server *Server) {
 	server.Noticef("Reloaded: ping_interval = %s", p.newValue)
 }
 
+// statszOption implements the option interface for the `statsz` setting.
+type statszOption struct {
+	noopOption
+	newValue StatszOpts
+}
+
+// Apply the new statsz interval. Content settings are picked up on the
+// next statsz event.
+func (o *statszOption) Apply(server *Server) {
+	server.mu.Lock()
+	if server.sys != nil {
+		server.sys.statsz = statszInterval(o.newValue.Interval)
+		if server.sys.cstatsz > server.sys.statsz {
+			server.sys.cstatsz = server.sys.statsz
+			if server.sys.stmr != nil {
+				server.sys.stmr.Reset(server.sys.cstatsz)
+			}
+		}
+	}
+	server.mu.Unlock()
+	server.Noticef("Reloaded: statsz")
+}
+
 // maxPingsOutOption implements the option interface for the `ping_max`
 // setting.
 type maxPingsOutOption struct {
@@ -655,6 +678,80 @@ func (m *maxTracedMsgLenOption) Apply(server *Server) {
 	server.Noticef("Reloaded: max_traced_msg_len = %d", m.newValue)
 }
 
+// jsAPIRateLimitOption implements the option interface for the JetStream
+// `api_rate_limit` setting.
+type jsAPIRateLimitOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply the new per account JetStream API rate limit.
+func (o *jsAPIRateLimitOption) Apply(s *Server) {
+	s.jsAPILimiter.setLimit(o.newValue)
+	s.Noticef("Reloaded: JetStream api_rate_limit = %v", o.newValue)
+}
+
+// jsRecoveryConcurrencyOption implements the option interface for the
+// JetStream `recovery_concurrency` setting.
+type jsRecoveryConcurrencyOption struct {
+	noopOption
+	newValue int
+}
+
+// Apply is a no-op, the setting is read each time streams are recovered.
+func (o *jsRecoveryConcurrencyOption) Apply(s *Server) {
+	s.Noticef("Reloaded: JetStream recovery_concurrency = %v", o.newValue)
+}
+
+// jsBackgroundIOOption implements the option interface for the JetStream
+// `max_background_io` setting.
+type jsBackgroundIOOption struct {
+	noopOption
+	newValue int64
+}
+
+// Apply the new background disk I/O rate to our file based streams.
+func (o *jsBackgroundIOOption) Apply(s *Server) {
+	if js := s.getJetStream(); js != nil {
+		js.bgIO.setRate(o.newValue)
+	}
+	s.Noticef("Reloaded: JetStream max_background_io = %v", o.newValue)
+}
+
+// leafNodeWatchIntervalOption implements the option interface for the
+// leafnode `watch_interval` setting.
+type leafNodeWatchIntervalOption struct {
+	noopOption
+	newValue time.Duration
+}
+
+// Apply the new interval. A running watcher picks it up on its next check,
+// or stops if it was set to 0.
+func (o *leafNodeWatchIntervalOption) Apply(s *Server) {
+	s.startLeafNodeWatcher()
+	s.Noticef("Reloaded: leafnode watch_interval = %v", o.newValue)
+}
+
+// connLimitsOption implements the option interface for the per address
+// connection limits of the client or leafnode listener.
+type connLimitsOption struct {
+	noopOption
+	leaf     bool
+	newValue *ConnLimitOpts
+}
+
+// Apply the new limits to connections accepted from now on. Existing
+// connections still count against the limits but are not closed.
+func (o *connLimitsOption) Apply(s *Server) {
+	cl, name := s.clientConnLimiter, "connection_limits"
+	if o.leaf {
+		cl, name = s.leafConnLimiter, "leafnode connection_limits"
+	}
+	// Options have been validated, so this can not fail.
+	cl.setLimits(o.newValue)
+	s.Noticef("Reloaded: %s", name)
+}
+
 type mqttAckWaitReload struct {
 	noopOption
 	newValue time.Duration
@@ -889,6 +986,9 @@ func (s *Server) reloadOptions(curOpts, newOpts *Options) error {
 	// applications starting NATS Server programmatically).
 	newOpts.CustomClientAuthentication = curOpts.CustomClientAuthentication
 	newOpts.CustomRouterAuthentication = curOpts.CustomRouterAuthentication
+	newOpts.MsgInterceptors = curOpts.MsgInterceptors
+	newOpts.MsgInterceptTimeout = curOpts.MsgInterceptTimeout
+	newOpts.MsgInterceptWorkers = curOpts.MsgInterceptWorkers
 
 	changed, err := s.diffOptions(newOpts)
 	if err != nil {
@@ -945,9 +1045,16 @@ func imposeOrder(value interface{}) error {
 		})
 	case WebsocketOpts:
 		sort.Strings(value.AllowedOrigins)
-	case string, bool, uint8, int, int32, int64, time.Duration, float64, nil, LeafNodeOpts, ClusterOpts, *tls.Config, PinnedCertSet,
+	case WebhookOpts:
+		sort.Strings(value.Events)
+	case *ConnLimitOpts:
+		if value != nil {
+			sort.Strings(value.Allow)
+			sort.Strings(value.Deny)
+		}
+	case string, bool, uint8, int, int32, int64, time.Duration, float64, nil, LeafNodeOpts, ClusterOpts, *tls.Config, PinnedCertSet, StatszOpts,
 		*URLAccResolver, *MemAccResolver, *DirAccResolver, *CacheDirAccResolver, Authentication, MQTTOpts, jwt.TagList,
-		*OCSPConfig, map[string]string, JSLimitOpts, StoreCipher:
+		*OCSPConfig, map[string]string, JSLimitOpts, StoreCipher, *JSArchiveOpts, []MsgInterceptor:
 		// explicitly skipped types
 	default:
 		// this will fail during unit tests
@@ -1055,6 +1162,8 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &routesOption{add: add, remove: remove})
 		case "maxconn":
 			diffOpts = append(diffOpts, &maxConnOption{newValue: newValue.(int)})
+		case "connlimits":
+			diffOpts = append(diffOpts, &connLimitsOption{newValue: newValue.(*ConnLimitOpts)})
 		case "pidfile":
 			diffOpts = append(diffOpts, &pidFileOption{newValue: newValue.(string)})
 		case "portsfiledir":
@@ -1065,6 +1174,8 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			diffOpts = append(diffOpts, &maxPayloadOption{newValue: newValue.(int32)})
 		case "pinginterval":
 			diffOpts = append(diffOpts, &pingIntervalOption{newValue: newValue.(time.Duration)})
+		case "statsz":
+			diffOpts = append(diffOpts, &statszOption{newValue: newValue.(StatszOpts)})
 		case "maxpingsout":
 			diffOpts = append(diffOpts, &maxPingsOutOption{newValue: newValue.(int)})
 		case "writedeadline":
@@ -1129,6 +1240,15 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			tmpOld.Remotes = copyRemoteLNConfigForReloadCompare(tmpOld.Remotes)
 			tmpNew.Remotes = copyRemoteLNConfigForReloadCompare(tmpNew.Remotes)
 
+			if tmpOld.WatchInterval != tmpNew.WatchInterval {
+				diffOpts = append(diffOpts, &leafNodeWatchIntervalOption{newValue: tmpNew.WatchInterval})
+				tmpOld.WatchInterval, tmpNew.WatchInterval = 0, 0
+			}
+			if !reflect.DeepEqual(tmpOld.ConnLimits, tmpNew.ConnLimits) {
+				diffOpts = append(diffOpts, &connLimitsOption{leaf: true, newValue: tmpNew.ConnLimits})
+			}
+			tmpOld.ConnLimits, tmpNew.ConnLimits = nil, nil
+
 			// Special check for leafnode remotes changes which are not supported right now.
 			leafRemotesChanged := func(a, b LeafNodeOpts) bool {
 				if len(a.Remotes) != len(b.Remotes) {
@@ -1320,6 +1440,12 @@ func (s *Server) diffOptions(newOpts *Options) ([]option, error) {
 			continue
 		case "maxtracedmsglen":
 			diffOpts = append(diffOpts, &maxTracedMsgLenOption{newValue: newValue.(int)})
+		case "jetstreamapiratelimit":
+			diffOpts = append(diffOpts, &jsAPIRateLimitOption{newValue: newValue.(int)})
+		case "jetstreambackgroundio":
+			diffOpts = append(diffOpts, &jsBackgroundIOOption{newValue: newValue.(int64)})
+		case "jetstreamrecoveryjobs":
+			diffOpts = append(diffOpts, &jsRecoveryConcurrencyOption{newValue: newValue.(int)})
 		case "port":
 			// check to see if newValue == 0 and continue if so.
 			if newValue == 0 {
@@ -1482,6 +1608,10 @@ func (s *Server) applyOptions(ctx *reloadContext, opts []option) {
 	if len(newOpts.LeafNode.Remotes) > 0 {
 		s.updateRemoteLeafNodesTLSConfig(newOpts)
 	}
+	// The listener TLS configuration from the new options is up to date.
+	s.mu.Lock()
+	s.leafNodeOpts.tlsConfig = nil
+	s.mu.Unlock()
 
 	if reloadTLS {
 		// Restart OCSP monitoring.
@@ -1605,6 +1605,59 @@ func reloadUpdateConfig(t *testing.T, s *Server, conf, content string) {
 	}
 }
 
+func TestConfigReloadConnectionLimits(t *testing.T) {
+	tmpl := `
+		listen: "127.0.0.1:-1"
+		%s
+		leafnodes {
+			listen: "127.0.0.1:-1"
+			%s
+		}
+	`
+	s, _, conf := runReloadServerWithContent(t, []byte(fmt.Sprintf(tmpl, "connection_limits { per_ip: 2 }", "")))
+	defer s.Shutdown()
+
+	addr := s.ClientURL()
+	nc1 := natsConnect(t, addr)
+	defer nc1.Close()
+	nc2 := natsConnect(t, addr)
+	defer nc2.Close()
+	if nc, err := nats.Connect(addr); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+
+	// Lowering the limit keeps the existing connections, but they count against it.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, "connection_limits { per_ip: 1 }", ""))
+	if n := s.NumClients(); n != 2 {
+		t.Fatalf("Expected 2 clients, got %d", n)
+	}
+	nc2.Close()
+	checkClientsCount(t, s, 1)
+	if nc, err := nats.Connect(addr); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+
+	// Limits added on reload account for the existing connections.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, "", ""))
+	nc3 := natsConnect(t, addr)
+	defer nc3.Close()
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, `connection_limits { per_cidr: {"127.0.0.0/8": 2} }`, ""))
+	if nc, err := nats.Connect(addr); err == nil {
+		nc.Close()
+		t.Fatal("Expected connection to fail")
+	}
+
+	// Leafnode limits can be changed too.
+	reloadUpdateConfig(t, s, conf, fmt.Sprintf(tmpl, "", `connection_limits { deny: ["127.0.0.0/8"] }`))
+	if _, err := s.leafConnLimiter.acquire(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}); err != ErrConnectionAddrNotAllowed {
+		t.Fatalf("Expected leafnode connection to be denied, got %v", err)
+	}
+	nc4 := natsConnect(t, addr)
+	defer nc4.Close()
+}
+
 func TestConfigReloadClusterAdvertise(t *testing.T) {
 	s, _, conf := runReloadServerWithContent(t, []byte(`
 		listen: "0.0.0.0:-1"
@@ -0,0 +1,182 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	s3DefaultRegion  = "us-east-1"
+	s3RequestTimeout = 30 * time.Second
+	s3Algorithm      = "AWS4-HMAC-SHA256"
+	s3SignedHeaders  = "host;x-amz-content-sha256;x-amz-date"
+	s3AmzDateFormat  = "20060102T150405Z"
+)
+
+// s3Archive is a BlockArchive backed by an S3 compatible object store.
+// Requests use path style addressing and are signed with AWS signature version 4.
+type s3Archive struct {
+	endpoint *url.URL
+	bucket   string
+	region   string
+	akey     string
+	skey     string
+	prefix   string
+	hc       *http.Client
+}
+
+func newS3Archive(o *JSArchiveOpts) (*s3Archive, error) {
+	if o.Endpoint == _EMPTY_ || o.Bucket == _EMPTY_ {
+		return nil, errors.New("jetstream archive requires an endpoint and a bucket")
+	}
+	u, err := url.Parse(o.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("jetstream archive endpoint: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == _EMPTY_ {
+		return nil, fmt.Errorf("jetstream archive endpoint %q is not a valid url", o.Endpoint)
+	}
+	region := o.Region
+	if region == _EMPTY_ {
+		region = s3DefaultRegion
+	}
+	prefix := strings.Trim(o.Prefix, "/")
+	if prefix != _EMPTY_ {
+		prefix += "/"
+	}
+	return &s3Archive{
+		endpoint: u,
+		bucket:   o.Bucket,
+		region:   region,
+		akey:     o.AccessKey,
+		skey:     o.SecretKey,
+		prefix:   prefix,
+		hc:       &http.Client{Timeout: s3RequestTimeout},
+	}, nil
+}
+
+// Put will store the data under key.
+func (a *s3Archive) Put(key string, data []byte) error {
+	_, err := a.do(http.MethodPut, key, data)
+	return err
+}
+
+// Get will return the data stored under key.
+func (a *s3Archive) Get(key string) ([]byte, error) {
+	return a.do(http.MethodGet, key, nil)
+}
+
+// Delete will remove key. Removing a key that does not exist is not an error.
+func (a *s3Archive) Delete(key string) error {
+	_, err := a.do(http.MethodDelete, key, nil)
+	return err
+}
+
+func (a *s3Archive) do(method, key string, body []byte) ([]byte, error) {
+	path := "/" + s3URIEscape(a.bucket) + "/" + s3URIEscape(a.prefix+key)
+	u := *a.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	u.RawPath = strings.TrimSuffix(a.endpoint.EscapedPath(), "/") + path
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	a.sign(req, body, time.Now())
+
+	resp, err := a.hc.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	rbody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return rbody, nil
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodDelete:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("jetstream archive %s %q failed: %s", strings.ToLower(method), key, resp.Status)
+}
+
+// Will sign the request with AWS signature version 4.
+func (a *s3Archive) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate := now.UTC().Format(s3AmzDateFormat)
+	date := amzDate[:8]
+	phash := sha256.Sum256(body)
+	ph := hex.EncodeToString(phash[:])
+
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", ph)
+
+	creq := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + ph + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		s3SignedHeaders,
+		ph,
+	}, "\n")
+	chash := sha256.Sum256([]byte(creq))
+
+	scope := date + "/" + a.region + "/s3/aws4_request"
+	sts := s3Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(chash[:])
+
+	k := s3HMAC([]byte("AWS4"+a.skey), date)
+	k = s3HMAC(k, a.region)
+	k = s3HMAC(k, "s3")
+	k = s3HMAC(k, "aws4_request")
+	sig := hex.EncodeToString(s3HMAC(k, sts))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, a.akey, scope, s3SignedHeaders, sig))
+}
+
+func s3HMAC(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// Escapes an object path the way S3 expects, everything but unreserved characters and '/'.
+func s3URIEscape(s string) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,216 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// Minimal S3 compatible server for testing.
+type testS3Server struct {
+	sync.Mutex
+	objs map[string][]byte
+	errs []string
+}
+
+func (ts *testS3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.Lock()
+	defer ts.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	ph := sha256.Sum256(body)
+	if r.Header.Get("x-amz-content-sha256") != hex.EncodeToString(ph[:]) {
+		ts.errs = append(ts.errs, "bad payload hash")
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AK/") ||
+		!strings.Contains(auth, "/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=") {
+		ts.errs = append(ts.errs, fmt.Sprintf("bad authorization %q", auth))
+	}
+	if r.Header.Get("x-amz-date") == _EMPTY_ {
+		ts.errs = append(ts.errs, "missing date")
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		ts.objs[r.URL.Path] = body
+	case http.MethodGet:
+		data, ok := ts.objs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(data)
+	case http.MethodDelete:
+		if _, ok := ts.objs[r.URL.Path]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(ts.objs, r.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (ts *testS3Server) count() int {
+	ts.Lock()
+	defer ts.Unlock()
+	return len(ts.objs)
+}
+
+func newTestS3Archive(t *testing.T) (*s3Archive, *testS3Server, func()) {
+	t.Helper()
+	ts := &testS3Server{objs: make(map[string][]byte)}
+	hs := httptest.NewServer(ts)
+	arc, err := newS3Archive(&JSArchiveOpts{
+		Endpoint:  hs.URL,
+		Bucket:    "nats",
+		Region:    "eu-west-1",
+		AccessKey: "AK",
+		SecretKey: "SK",
+		Prefix:    "/cold/",
+	})
+	require_NoError(t, err)
+	return arc, ts, func() {
+		hs.Close()
+		ts.Lock()
+		defer ts.Unlock()
+		for _, err := range ts.errs {
+			t.Errorf("S3 request error: %s", err)
+		}
+	}
+}
+
+func TestS3ArchiveBasics(t *testing.T) {
+	arc, ts, done := newTestS3Archive(t)
+	defer done()
+
+	data := []byte("HELLO WORLD")
+	require_NoError(t, arc.Put("ORDERS/1-abc.blk", data))
+	ts.Lock()
+	_, ok := ts.objs["/nats/cold/ORDERS/1-abc.blk"]
+	ts.Unlock()
+	require_True(t, ok)
+
+	got, err := arc.Get("ORDERS/1-abc.blk")
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(got, data))
+
+	// Keys should be escaped.
+	require_NoError(t, arc.Put("A B/1+2.blk", data))
+	got, err = arc.Get("A B/1+2.blk")
+	require_NoError(t, err)
+	require_True(t, bytes.Equal(got, data))
+
+	require_NoError(t, arc.Delete("ORDERS/1-abc.blk"))
+	_, err = arc.Get("ORDERS/1-abc.blk")
+	require_Error(t, err)
+	// Deleting a missing key is ok.
+	require_NoError(t, arc.Delete("ORDERS/1-abc.blk"))
+
+	_, err = newS3Archive(&JSArchiveOpts{Endpoint: "localhost:9000", Bucket: "nats"})
+	require_Error(t, err)
+	_, err = newS3Archive(&JSArchiveOpts{Endpoint: "http://localhost:9000"})
+	require_Error(t, err)
+}
+
+func TestS3ArchiveFileStore(t *testing.T) {
+	arc, ts, done := newTestS3Archive(t)
+	defer done()
+
+	fcfg := FileStoreConfig{StoreDir: t.TempDir(), BlockSize: 256, Archive: arc, ArchiveBytes: 256}
+	fs, err := newFileStore(fcfg, StreamConfig{Name: "zzz", Subjects: []string{"foo"}, Storage: FileStorage})
+	require_NoError(t, err)
+	defer fs.Stop()
+
+	msg := bytes.Repeat([]byte("Z"), 64)
+	for i := 0; i < 20; i++ {
+		_, _, err := fs.StoreMsg("foo", nil, msg)
+		require_NoError(t, err)
+	}
+	require_NoError(t, fs.archiveBlocks())
+	require_True(t, ts.count() == fs.numMsgBlocks()-1)
+
+	// Drop any caches so we read from the archive.
+	fs.mu.RLock()
+	for _, mb := range fs.blks {
+		mb.mu.Lock()
+		mb.clearCacheAndOffset()
+		mb.mu.Unlock()
+	}
+	fs.mu.RUnlock()
+
+	for seq := uint64(1); seq <= 20; seq++ {
+		sm, err := fs.LoadMsg(seq, nil)
+		require_NoError(t, err)
+		require_True(t, bytes.Equal(sm.msg, msg))
+	}
+}
+
+func TestS3ArchiveConfig(t *testing.T) {
+	conf := createConfFile(t, []byte(fmt.Sprintf(`
+		listen: 127.0.0.1:-1
+		jetstream: {
+			store_dir: %q
+			archive: {
+				endpoint: "http://127.0.0.1:9000"
+				bucket: "nats"
+				region: "eu-west-1"
+				access_key: "AK"
+				secret_key: "SK"
+				max_age: "24h"
+				max_local_bytes: 10GB
+			}
+		}
+	`, t.TempDir())))
+	s, opts := RunServerWithConfig(conf)
+	defer s.Shutdown()
+
+	ao := opts.JetStreamArchive
+	require_True(t, ao != nil)
+	require_True(t, ao.Bucket == "nats")
+	require_True(t, ao.MaxAge == 24*time.Hour)
+	require_True(t, ao.MaxLocalBytes == 10*1024*1024*1024)
+
+	nc, js := jsClientConnect(t, s)
+	defer nc.Close()
+	_, err := js.AddStream(&nats.StreamConfig{Name: "TEST", Subjects: []string{"foo"}})
+	require_NoError(t, err)
+
+	mset, err := s.GlobalAccount().lookupStream("TEST")
+	require_NoError(t, err)
+	fs := mset.store.(*fileStore)
+	fcfg := fs.fileStoreConfig()
+	require_True(t, fcfg.Archive != nil)
+	require_True(t, fcfg.ArchiveAge == 24*time.Hour)
+	require_True(t, fcfg.ArchiveBytes == 10*1024*1024*1024)
+
+	conf = createConfFile(t, []byte(`jetstream: {archive: {bucket: 22}}`))
+	_, err = ProcessConfigFile(conf)
+	require_Error(t, err)
+	require_True(t, strings.Contains(err.Error(), "Expected bucket to be a string"))
+}
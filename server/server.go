@@ -103,6 +103,7 @@ type Info struct {
 	// LeafNode Specific
 	LeafNodeURLs  []string `json:"leafnode_urls,omitempty"`  // LeafNode URLs that the server can reconnect to.
 	RemoteAccount string   `json:"remote_account,omitempty"` // Lets the other side know the remote account that they bind to.
+	LeafFeatures  uint32   `json:"leaf_features,omitempty"`  // Bitmap of leafnode features this server supports.
 }
 
 // Server is our main struct.
@@ -111,6 +112,8 @@ type Server struct {
 	gcid uint64
 	// How often user logon fails due to the issuer account not being pinned.
 	pinnedAccFail uint64
+	// Webhook events dropped since the last one was queued.
+	whDropped uint64
 	stats
 	mu                  sync.RWMutex
 	kp                  nkeys.KeyPair
@@ -161,6 +164,15 @@ type Server struct {
 	leafNodeOpts        struct {
 		resolver    netResolver
 		dialTimeout time.Duration
+		queueWeight float64
+		// Set if any leafnode connection can have a queue weight.
+		weighted bool
+		// TLS configuration of the listener reloaded by the files watcher.
+		tlsConfig *tls.Config
+		// Set while the files watcher is running.
+		watching bool
+		// Delay to coalesce subscription interest updates.
+		interestCoalesce time.Duration
 	}
 	leafRemoteCfgs     []*leafNodeCfg
 	leafRemoteAccounts sync.Map
@@ -168,6 +180,8 @@ type Server struct {
 	leafDisableConnect bool // Used in test only
 
 	quitCh           chan struct{}
+	whq              *ipQueue // of *WebhookEvent
+	whEvents         map[string]struct{}
 	startupComplete  chan struct{}
 	shutdownComplete chan struct{}
 
@@ -267,6 +281,13 @@ type Server struct {
 
 	connRateCounter *rateCounter
 
+	// Limits on accepted client and leafnode connections per remote address.
+	clientConnLimiter *connLimiter
+	leafConnLimiter   *connLimiter
+
+	// Interceptors for messages published to streams.
+	msgInterceptors *msgInterceptors
+
 	// If there is a system account configured, to still support the $G account,
 	// the server will create a fake user and add it to the list of users.
 	// Keep track of what that user name is for config reload purposes.
@@ -279,6 +300,11 @@ type Server struct {
 	rateLimitLogging   sync.Map
 	rateLimitLoggingCh chan time.Duration
 
+	// To limit permission violation events across all clients.
+	pviolMu    sync.Mutex
+	pviolStart time.Time
+	pviolSent  int
+
 	// Total outstanding catchup bytes in flight.
 	gcbMu     sync.RWMutex
 	gcbOut    int64
@@ -290,7 +316,10 @@ type Server struct {
 	syncOutSem chan struct{}
 
 	// Queue to process JS API requests that come from routes (or gateways)
-	jsAPIRoutedReqs *ipQueue
+	jsAPIRoutedReqs *jsAPIQueue
+	jsAPIWorkers    int
+	// Per account rate limits for JS API requests, nil if not configured.
+	jsAPILimiter *jsAPILimiter
 }
 
 // For tracking JS nodes.
@@ -404,6 +433,12 @@ func NewServer(opts *Options) (*Server, error) {
 		s.connRateCounter = newRateCounter(opts.tlsConfigOpts.RateLimit)
 	}
 
+	// Options have been validated, so these can not fail.
+	s.clientConnLimiter, _ = newConnLimiter(opts.ConnLimits)
+	s.leafConnLimiter, _ = newConnLimiter(opts.LeafNode.ConnLimits)
+
+	s.msgInterceptors = newMsgInterceptors(s, opts)
+
 	// Trusted root operator keys.
 	if !s.processTrustedKeys() {
 		return nil, fmt.Errorf("Error processing trusted operator keys")
@@ -715,6 +750,18 @@ func validateOptions(o *Options) error {
 	if err := validateJetStreamOptions(o); err != nil {
 		return err
 	}
+	if err := validateWebhookOptions(o); err != nil {
+		return err
+	}
+	if err := validateStatszOptions(o); err != nil {
+		return err
+	}
+	if _, err := newConnLimiter(o.ConnLimits); err != nil {
+		return fmt.Errorf("connection_limits: %v", err)
+	}
+	if _, err := newConnLimiter(o.LeafNode.ConnLimits); err != nil {
+		return fmt.Errorf("leafnode connection_limits: %v", err)
+	}
 	// Finally check websocket options.
 	return validateWebsocketOptions(o)
 }
@@ -1262,7 +1309,7 @@ func (s *Server) setSystemAccount(acc *Account) error {
 		sendq:   s.newIPQueue("System sendQ"), // of *pubMsg
 		resetCh: make(chan struct{}),
 		sq:      s.newSendQ(),
-		statsz:  eventsHBInterval,
+		statsz:  statszInterval(s.getOpts().Statsz.Interval),
 		orphMax: 5 * eventsHBInterval,
 		chkOrph: 3 * eventsHBInterval,
 	}
@@ -1390,6 +1437,9 @@ func (s *Server) registerAccountNoLock(acc *Account) *Account {
 	}
 	acc.srv = s
 	acc.updated = time.Now().UTC()
+	if n := s.opts.SubjectStats; n > 0 && acc.sstats == nil {
+		acc.sstats = newSubjectStats(n)
+	}
 	accName := acc.Name
 	jsEnabled := len(acc.jsLimits) > 0
 	acc.mu.Unlock()
@@ -1648,6 +1698,9 @@ func (s *Server) Start() {
 
 	s.startRateLimitLogExpiration()
 
+	// Start posting events to the webhook if configured.
+	s.startWebhooks()
+
 	// Pprof http endpoint for the profiler.
 	if opts.ProfPort != 0 {
 		s.StartProfiler()
@@ -1840,6 +1893,9 @@ func (s *Server) Start() {
 		s.solicitLeafNodeRemotes(opts.LeafNode.Remotes)
 	}
 
+	// Watch leafnode credentials and TLS files for changes.
+	s.startLeafNodeWatcher()
+
 	// TODO (ik): I wanted to refactor this by starting the client
 	// accept loop first, that is, it would resolve listen spec
 	// in place, but start the accept-for-loop in a different go
@@ -2019,6 +2075,8 @@ func (s *Server) Shutdown() {
 
 	// Release go routines that wait on that channel
 	close(s.quitCh)
+	// Interceptors may be holding up their workers.
+	s.msgInterceptors.stop()
 
 	// Close client and route connections
 	for _, c := range conns {
@@ -2302,6 +2360,7 @@ const (
 	JszPath          = "/jsz"
 	HealthzPath      = "/healthz"
 	IPQueuesPath     = "/ipqueuesz"
+	SubjectStatzPath = "/subjstatz"
 )
 
 func (s *Server) basePath(p string) string {
@@ -2412,6 +2471,8 @@ func (s *Server) startMonitoring(secure bool) error {
 	mux.HandleFunc(s.basePath(HealthzPath), s.HandleHealthz)
 	// IPQueuesz
 	mux.HandleFunc(s.basePath(IPQueuesPath), s.HandleIPQueuesz)
+	// Subjstatz
+	mux.HandleFunc(s.basePath(SubjectStatzPath), s.HandleSubjectStatz)
 
 	// Do not set a WriteTimeout because it could cause cURL/browser
 	// to return empty response or unable to display page if the
@@ -2545,6 +2606,14 @@ func (s *Server) createClient(conn net.Conn) *client {
 
 	c.Debugf("Client connection created")
 
+	// Check the per address connection limits before telling
+	// anything about us to the other side.
+	if err := c.acquireConnLimit(s.clientConnLimiter); err != nil {
+		c.mu.Unlock()
+		c.connLimitExceeded(err)
+		return nil
+	}
+
 	// Send our information.
 	// Need to be sent in place since writeLoop cannot be started until
 	// TLS handshake is done (if applicable).
@@ -2673,6 +2742,9 @@ func (s *Server) saveClosedClient(c *client, nc net.Conn, reason ClosedState) {
 	now := time.Now().UTC()
 
 	s.accountDisconnectEvent(c, now, reason.String())
+	if c.kind == LEAF {
+		s.leafNodeDisconnectEvent(c, now, reason.String())
+	}
 
 	c.mu.Lock()
 
@@ -2811,6 +2883,7 @@ func tlsCipher(cs uint16) string {
 
 // Remove a client or route from our internal accounting.
 func (s *Server) removeClient(c *client) {
+	c.releaseConnLimit()
 	// kind is immutable, so can check without lock
 	switch c.kind {
 	case CLIENT:
@@ -499,6 +499,110 @@ func TestMaxConnections(t *testing.T) {
 	}
 }
 
+func TestConnectionLimitsPerAddress(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		limits *ConnLimitOpts
+		max    int
+		reason ClosedState
+	}{
+		{"per ip", &ConnLimitOpts{PerIP: 2}, 2, MaxConnectionsExceeded},
+		{"per cidr", &ConnLimitOpts{PerCIDR: map[string]int{"127.0.0.0/8": 1, "10.0.0.0/8": 5}}, 1, MaxConnectionsExceeded},
+		{"deny", &ConnLimitOpts{Deny: []string{"127.0.0.0/8"}}, 0, ConnectionAddrNotAllowed},
+		{"not allowed", &ConnLimitOpts{Allow: []string{"10.0.0.0/8"}}, 0, ConnectionAddrNotAllowed},
+		{"deny wins", &ConnLimitOpts{Allow: []string{"127.0.0.0/8"}, Deny: []string{"127.0.0.1/32"}}, 0, ConnectionAddrNotAllowed},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := DefaultOptions()
+			opts.ConnLimits = test.limits
+			s := RunServer(opts)
+			defer s.Shutdown()
+
+			addr := fmt.Sprintf("nats://%s:%d", opts.Host, opts.Port)
+			var conns []*nats.Conn
+			for i := 0; i < test.max; i++ {
+				nc, err := nats.Connect(addr)
+				require_NoError(t, err)
+				defer nc.Close()
+				conns = append(conns, nc)
+			}
+			nc, err := nats.Connect(addr)
+			if err == nil {
+				nc.Close()
+				t.Fatal("Expected connection to fail")
+			}
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				connz, err := s.Connz(&ConnzOptions{State: ConnClosed})
+				if err != nil {
+					return err
+				}
+				if len(connz.Conns) != 1 || connz.Conns[0].Reason != test.reason.String() {
+					return fmt.Errorf("expected one connection closed with %q, got %+v", test.reason, connz.Conns)
+				}
+				return nil
+			})
+			if test.max == 0 {
+				return
+			}
+			// Once a connection goes away a new one is accepted.
+			conns[0].Close()
+			checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+				if n := s.clientConnLimiter.count("127.0.0.1"); n != test.max-1 {
+					return fmt.Errorf("expected %d tracked connections, got %d", test.max-1, n)
+				}
+				return nil
+			})
+			nc, err = nats.Connect(addr)
+			require_NoError(t, err)
+			nc.Close()
+		})
+	}
+
+	// Invalid options are rejected.
+	opts := DefaultOptions()
+	opts.ConnLimits = &ConnLimitOpts{Deny: []string{"not.a.cidr"}}
+	if s, err := NewServer(opts); err == nil {
+		s.Shutdown()
+		t.Fatal("Expected invalid CIDR to be rejected")
+	}
+}
+
+func TestConnectionLimitsWebsocketAndMQTT(t *testing.T) {
+	o := testMQTTDefaultOptions()
+	o.Websocket.Host = "127.0.0.1"
+	o.Websocket.Port = -1
+	o.Websocket.NoTLS = true
+	o.ConnLimits = &ConnLimitOpts{Deny: []string{"127.0.0.0/8"}}
+	s := testMQTTRunServer(t, o)
+	defer testMQTTShutdownServer(s)
+
+	if wsc, _, _, err := testNewWSClientWithError(t, testWSClientOptions{host: o.Websocket.Host, port: o.Websocket.Port, noTLS: true}); err == nil {
+		defer wsc.Close()
+	}
+	mc, err := net.Dial("tcp", fmt.Sprintf("%s:%d", o.MQTT.Host, o.MQTT.Port))
+	require_NoError(t, err)
+	defer mc.Close()
+
+	checkFor(t, 2*time.Second, 15*time.Millisecond, func() error {
+		connz, err := s.Connz(&ConnzOptions{State: ConnClosed})
+		if err != nil {
+			return err
+		}
+		if len(connz.Conns) != 2 {
+			return fmt.Errorf("expected 2 closed connections, got %d", len(connz.Conns))
+		}
+		for _, ci := range connz.Conns {
+			if ci.Reason != ConnectionAddrNotAllowed.String() {
+				return fmt.Errorf("unexpected close reason %q", ci.Reason)
+			}
+		}
+		return nil
+	})
+	if n := s.clientConnLimiter.count("127.0.0.1"); n != 0 {
+		t.Fatalf("Expected no tracked connections, got %d", n)
+	}
+}
+
 func TestMaxSubscriptions(t *testing.T) {
 	opts := DefaultOptions()
 	opts.MaxSubs = 10
@@ -20,6 +20,8 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -51,6 +53,8 @@ var (
 	// ErrStoreSnapshotInProgress is returned when RemoveMsg or EraseMsg is called
 	// while a snapshot is in progress.
 	ErrStoreSnapshotInProgress = errors.New("snapshot in progress")
+	// ErrStoreSnapshotCanceled is returned when a snapshot was canceled before it completed.
+	ErrStoreSnapshotCanceled = errors.New("snapshot canceled")
 	// ErrMsgTooLarge is returned when a message is considered too large.
 	ErrMsgTooLarge = errors.New("message to large")
 	// ErrStoreWrongType is for when you access the wrong storage type.
@@ -63,8 +67,31 @@ var (
 	ErrSequenceMismatch = errors.New("expected sequence does not match store")
 	// ErrPurgeArgMismatch is returned when PurgeEx is called with sequence > 1 and keep > 0.
 	ErrPurgeArgMismatch = errors.New("sequence > 1 && keep > 0 not allowed")
+	// ErrStoreSealed is returned when trying to add or remove messages from a sealed store.
+	ErrStoreSealed = errors.New("store is sealed")
+	// ErrStorageQuotaExceeded is returned when storing a message would exceed the storage quota.
+	ErrStorageQuotaExceeded = errors.New("storage quota exceeded")
+	// ErrStoreWrongLastSequence is returned when the expected last sequence does not match.
+	ErrStoreWrongLastSequence = errors.New("wrong last sequence")
+	// ErrStoreWrongLastSubjectSequence is returned when the expected last sequence for the subject does not match.
+	ErrStoreWrongLastSubjectSequence = errors.New("wrong last sequence for subject")
+	// ErrStoreWrongLastMsgID is returned when the expected last msg ID does not match.
+	ErrStoreWrongLastMsgID = errors.New("wrong last msg ID")
+	// ErrConsumerFilterNotSubset is returned when a pending filter is not a subset of the consumer's filter.
+	ErrConsumerFilterNotSubset = errors.New("filter is not a subset of the consumer filter")
 )
 
+// StoreExpect holds optional expectations that must hold for StoreMsgWithExpect to store a message.
+// These are checked atomically with the append.
+type StoreExpect struct {
+	// LastSeq is the expected last sequence of the stream.
+	LastSeq *uint64
+	// LastSubjSeq is the expected last sequence for the message's subject, 0 meaning none.
+	LastSubjSeq *uint64
+	// LastMsgId is the expected msg ID header of the last message.
+	LastMsgId string
+}
+
 // StoreMsg is the stored message format for messages that are retained by the Store layer.
 type StoreMsg struct {
 	subj string
@@ -75,18 +102,126 @@ type StoreMsg struct {
 	ts   int64
 }
 
+// ClockSource returns the current wall clock time in nanoseconds since the epoch.
+type ClockSource func() int64
+
+// hlc is a hybrid logical clock used to timestamp stored messages.
+// Timestamps track the clock source but are guaranteed to be strictly increasing,
+// even if the local clock moves backwards or is behind timestamps we have observed
+// from other servers, e.g. a prior leader or an upstream for a mirror.
+// The logical component is folded into the low order nanoseconds.
+// Observed timestamps further than maxDrift ahead of the clock source are clamped,
+// so a single bad timestamp can not drag all future ones into the future.
+type hlc struct {
+	mu       sync.Mutex
+	last     int64
+	maxDrift int64
+	clock    ClockSource
+}
+
+// Sets the maximum an observed timestamp can be ahead of our clock source.
+// Zero means no limit.
+func (h *hlc) setMaxDrift(d time.Duration) {
+	h.mu.Lock()
+	h.maxDrift = int64(d)
+	h.mu.Unlock()
+}
+
+// Returns the current time from our clock source.
+func (h *hlc) wall() int64 {
+	if h.clock != nil {
+		return h.clock()
+	}
+	return time.Now().UnixNano()
+}
+
+// now returns the next timestamp from the clock.
+func (h *hlc) now() int64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ts := h.wall()
+	if ts <= h.last {
+		ts = h.last + 1
+	}
+	h.last = ts
+	return ts
+}
+
+// observe will move the clock forward to ts if needed.
+// Returns false if ts was beyond our max drift and was clamped.
+func (h *hlc) observe(ts int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ok := true
+	if h.maxDrift > 0 {
+		if max := h.wall() + h.maxDrift; ts > max {
+			ts, ok = max, false
+		}
+	}
+	if ts > h.last {
+		h.last = ts
+	}
+	return ok
+}
+
 // Used to call back into the upper layers to report on changes in storage resources.
 // For the cases where its a single message we will also supply sequence number and subject.
 type StorageUpdateHandler func(msgs, bytes int64, seq uint64, subj string)
 
+// StreamConfigRevision records who changed a stream's configuration, when and
+// the names of the fields that changed. No changes means the stream was created.
+type StreamConfigRevision struct {
+	Revision uint64    `json:"revision"`
+	Time     time.Time `json:"time"`
+	Account  string    `json:"account,omitempty"`
+	User     string    `json:"user,omitempty"`
+	Changes  []string  `json:"changes,omitempty"`
+}
+
+// Maximum number of config revisions a store will keep.
+const maxConfigRevisions = 32
+
+// Will add a revision to the history, numbering it and trimming old revisions.
+func addConfigRevision(hist []StreamConfigRevision, rev StreamConfigRevision) []StreamConfigRevision {
+	if n := len(hist); n > 0 {
+		rev.Revision = hist[n-1].Revision + 1
+	} else {
+		rev.Revision = 1
+	}
+	if rev.Time.IsZero() {
+		rev.Time = time.Now().UTC()
+	}
+	hist = append(hist, rev)
+	if len(hist) > maxConfigRevisions {
+		hist = append(hist[:0:0], hist[len(hist)-maxConfigRevisions:]...)
+	}
+	return hist
+}
+
+// Used to ask the upper layers if storing bytes more would exceed a storage quota.
+// This is called with the store lock held so it must not call back into the store.
+type StorageQuotaChecker func(bytes int64) bool
+
+// Used to hand messages to the upper layers right before they are removed because of
+// the stream's limits or MaxAge. This is called with the store lock held so it must not
+// block or call back into the store. The message is only valid for the duration of the call.
+type StorageRemovalHandler func(sm *StoreMsg)
+
+// Used to ask the upper layers to confirm a consumer whose state was left behind in the
+// store is really gone, so its state can be removed. This is called without the store lock held.
+type ConsumerOrphanChecker func(name string) bool
+
 type StreamStore interface {
 	StoreMsg(subject string, hdr, msg []byte) (uint64, int64, error)
+	StoreMsgWithExpect(subject string, hdr, msg []byte, exp *StoreExpect) (uint64, int64, error)
 	StoreRawMsg(subject string, hdr, msg []byte, seq uint64, ts int64) error
 	SkipMsg() uint64
+	SkipMsgs(seq uint64, num uint64) error
 	LoadMsg(seq uint64, sm *StoreMsg) (*StoreMsg, error)
 	LoadNextMsg(filter string, wc bool, start uint64, smp *StoreMsg) (sm *StoreMsg, skip uint64, err error)
 	LoadLastMsg(subject string, sm *StoreMsg) (*StoreMsg, error)
 	RemoveMsg(seq uint64) (bool, error)
+	RemoveMsgs(seqs []uint64) (uint64, error)
 	EraseMsg(seq uint64) (bool, error)
 	Purge() (uint64, error)
 	PurgeEx(subject string, seq, keep uint64) (uint64, error)
@@ -95,10 +230,17 @@ type StreamStore interface {
 	GetSeqFromTime(t time.Time) uint64
 	FilteredState(seq uint64, subject string) SimpleState
 	SubjectsState(filterSubject string) map[string]SimpleState
+	SubjectsTotals(filterSubject string) map[string]uint64
+	LastSeqsPerSubject(filterSubject string) []uint64
 	State() StreamState
 	FastState(*StreamState)
 	Type() StorageType
 	RegisterStorageUpdates(StorageUpdateHandler)
+	RegisterStorageQuotaCheck(StorageQuotaChecker)
+	RegisterStorageRemovals(StorageRemovalHandler)
+	RegisterConsumerOrphanCheck(ConsumerOrphanChecker)
+	RecordConfigRevision(rev StreamConfigRevision) error
+	ConfigHistory() []StreamConfigRevision
 	UpdateConfig(cfg *StreamConfig) error
 	Delete() error
 	Stop() error
@@ -146,7 +288,35 @@ type StreamState struct {
 	NumDeleted  int               `json:"num_deleted,omitempty"`
 	Deleted     []uint64          `json:"deleted,omitempty"`
 	Lost        *LostStreamData   `json:"lost,omitempty"`
+	Damaged     []DamagedBlock    `json:"damaged,omitempty"`
 	Consumers   int               `json:"consumer_count"`
+
+	// SubjectsDetail holds the first and last sequence for subjects when requested.
+	SubjectsDetail map[string]SimpleState `json:"subjects_detail,omitempty"`
+	// DeletedRanges is a compact form of Deleted, coalesced into contiguous runs.
+	DeletedRanges []DeleteRange `json:"deleted_ranges,omitempty"`
+}
+
+// DeleteRange is a contiguous run of deleted sequences, inclusive.
+type DeleteRange struct {
+	First uint64 `json:"first_seq"`
+	Last  uint64 `json:"last_seq"`
+}
+
+// Will coalesce sorted deleted sequences into contiguous ranges.
+func deleteRanges(deleted []uint64) []DeleteRange {
+	if len(deleted) == 0 {
+		return nil
+	}
+	dr := []DeleteRange{{First: deleted[0], Last: deleted[0]}}
+	for _, seq := range deleted[1:] {
+		if lr := &dr[len(dr)-1]; seq == lr.Last+1 {
+			lr.Last = seq
+		} else if seq > lr.Last {
+			dr = append(dr, DeleteRange{First: seq, Last: seq})
+		}
+	}
+	return dr
 }
 
 // SimpleState for filtered subject specific state.
@@ -162,10 +332,105 @@ type LostStreamData struct {
 	Bytes uint64   `json:"bytes"`
 }
 
+// DamagedBlock describes a message block that could not be fully recovered.
+// The original files are kept in the store's damaged directory for inspection.
+type DamagedBlock struct {
+	Index    uint32    `json:"index"`
+	FirstSeq uint64    `json:"first_seq,omitempty"`
+	LastSeq  uint64    `json:"last_seq,omitempty"`
+	Msgs     uint64    `json:"msgs,omitempty"`
+	Bytes    uint64    `json:"bytes,omitempty"`
+	Files    []string  `json:"files"`
+	Reason   string    `json:"reason"`
+	Time     time.Time `json:"time"`
+}
+
 // SnapshotResult contains information about the snapshot.
 type SnapshotResult struct {
 	Reader io.ReadCloser
 	State  StreamState
+	Handle *SnapshotHandle
+}
+
+// SnapshotProgress is how far along a snapshot is.
+type SnapshotProgress struct {
+	NumBlks  int    `json:"num_blocks"`
+	BlksDone int    `json:"blocks_done"`
+	Bytes    uint64 `json:"bytes"`
+}
+
+// SnapshotHandle allows monitoring and canceling a snapshot in progress.
+type SnapshotHandle struct {
+	// These are updated atomically.
+	nblks int64
+	blks  int64
+	bytes uint64
+
+	mu   sync.Mutex
+	err  error
+	w    io.Closer
+	done chan struct{}
+}
+
+func newSnapshotHandle(w io.Closer) *SnapshotHandle {
+	return &SnapshotHandle{w: w, done: make(chan struct{})}
+}
+
+// Progress returns the blocks done and bytes written so far.
+func (h *SnapshotHandle) Progress() SnapshotProgress {
+	return SnapshotProgress{
+		NumBlks:  int(atomic.LoadInt64(&h.nblks)),
+		BlksDone: int(atomic.LoadInt64(&h.blks)),
+		Bytes:    atomic.LoadUint64(&h.bytes),
+	}
+}
+
+// Cancel will stop the snapshot and wait for it to unwind.
+func (h *SnapshotHandle) Cancel() {
+	select {
+	case <-h.done:
+		return
+	default:
+	}
+	h.setErr(ErrStoreSnapshotCanceled)
+	h.w.Close()
+	<-h.done
+}
+
+// Done is closed when the snapshot has finished, successfully or not.
+func (h *SnapshotHandle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Err returns why the snapshot failed, if it did.
+func (h *SnapshotHandle) Err() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.err
+}
+
+// Will only record the first error.
+func (h *SnapshotHandle) setErr(err error) {
+	h.mu.Lock()
+	if h.err == nil {
+		h.err = err
+	}
+	h.mu.Unlock()
+}
+
+// Write will track bytes written to the underlying writer.
+type snapshotWriter struct {
+	io.WriteCloser
+	h *SnapshotHandle
+}
+
+func (sw *snapshotWriter) Write(p []byte) (int, error) {
+	n, err := sw.WriteCloser.Write(p)
+	atomic.AddUint64(&sw.h.bytes, uint64(n))
+	if err != nil {
+		sw.h.setErr(err)
+	}
+	return n, err
 }
 
 // ConsumerStore stores state on consumers for streams.
@@ -179,12 +444,34 @@ type ConsumerStore interface {
 	State() (*ConsumerState, error)
 	BorrowState() (*ConsumerState, error)
 	EncodedState() ([]byte, error)
+	NumPending(filter string) (uint64, error)
+	Flush() error
 	Type() StorageType
 	Stop() error
 	Delete() error
 	StreamDelete() error
 }
 
+// Returns the filter to count pending messages for, which defaults to the
+// consumer's filter and otherwise has to be a subset of it.
+func consumerPendingFilter(cfilter, filter string) (string, error) {
+	if filter == _EMPTY_ {
+		return cfilter, nil
+	}
+	if !IsValidSubject(filter) || cfilter != _EMPTY_ && !subjectIsSubsetMatch(filter, cfilter) {
+		return _EMPTY_, ErrConsumerFilterNotSubset
+	}
+	return filter, nil
+}
+
+// Returns the stream sequence to start counting pending messages from.
+func (state *ConsumerState) pendingStart() uint64 {
+	if state.AckFloor.Stream > state.Delivered.Stream {
+		return state.AckFloor.Stream + 1
+	}
+	return state.Delivered.Stream + 1
+}
+
 // SequencePair has both the consumer and the stream sequence. They point to same message.
 type SequencePair struct {
 	Consumer uint64 `json:"consumer_seq"`
@@ -225,7 +512,7 @@ func encodeConsumerState(state *ConsumerState) []byte {
 
 	// Write header
 	buf[0] = magic
-	buf[1] = 2
+	buf[1] = consumerStateVersion
 
 	n := hdrLen
 	n += binary.PutUvarint(buf[n:], state.AckFloor.Consumer)
@@ -279,6 +566,8 @@ type Pending struct {
 type TemplateStore interface {
 	Store(*streamTemplate) error
 	Delete(*streamTemplate) error
+	// LoadAll returns the configs of all persisted templates.
+	LoadAll() ([]*StreamTemplateConfig, error)
 }
 
 func jsonString(s string) string {
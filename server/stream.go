@@ -16,6 +16,7 @@ package server
 import (
 	"archive/tar"
 	"bytes"
+	"container/heap"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
@@ -26,9 +27,11 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/klauspost/compress/s2"
@@ -61,6 +64,22 @@ type StreamConfig struct {
 	// Allow republish of the message after being sequenced and stored.
 	RePublish *RePublish `json:"republish,omitempty"`
 
+	// Hand off messages about to be removed by limits or MaxAge.
+	RemovalHook *RemovalHook `json:"removal_hook,omitempty"`
+
+	// Rewrite the subject of messages published to the stream before they are stored.
+	SubjectTransform *SubjectTransformConfig `json:"subject_transform,omitempty"`
+
+	// Move the oldest messages of a memory stream to disk once a memory cap is hit.
+	SpillOver *SpillOver `json:"spill_over,omitempty"`
+
+	// Adjust caching and flushing of a file based stream. Can be changed on update.
+	StoreTuning *StoreTuning `json:"store_tuning,omitempty"`
+
+	// Account for each message with the same per message overhead as file storage,
+	// so MaxBytes and account limits behave the same for both storage types.
+	MsgOverhead bool `json:"msg_overhead,omitempty"`
+
 	// Allow higher performance, direct access to get individual messages. E.g. KeyValue
 	AllowDirect bool `json:"allow_direct"`
 	// Allow higher performance and unified direct access for mirrors as well.
@@ -69,6 +88,22 @@ type StreamConfig struct {
 	// Allow KV like semantics to also discard new on a per subject basis
 	DiscardNewPer bool `json:"discard_new_per_subject,omitempty"`
 
+	// SyncAlways will sync each message to disk before it is acknowledged.
+	// This trades throughput for durability and only applies to file storage.
+	SyncAlways bool `json:"sync_always,omitempty"`
+
+	// AdaptiveBlockSize will size new message blocks based on the observed ingest
+	// rate and average message size. This only applies to file storage.
+	AdaptiveBlockSize bool `json:"adaptive_block_size,omitempty"`
+
+	// FirstSeq is the sequence a new stream will start numbering at. This allows
+	// streams migrated from other systems to keep their sequences.
+	FirstSeq uint64 `json:"first_seq,omitempty"`
+
+	// StampOrigin adds headers to stored messages recording the account, client and
+	// server they were received from. Any such headers set by publishers are replaced.
+	StampOrigin bool `json:"stamp_origin,omitempty"`
+
 	// Optional qualifiers. These can not be modified after set to true.
 
 	// Sealed will seal a stream so no messages can get out or in.
@@ -89,6 +124,81 @@ type RePublish struct {
 	HeadersOnly bool   `json:"headers_only,omitempty"`
 }
 
+// SubjectTransformConfig is for rewriting the subject of inbound messages before they are
+// stored, e.g. mapping "orders.*" to "orders.{{partition(10,1)}}".
+type SubjectTransformConfig struct {
+	Source      string `json:"src,omitempty"`
+	Destination string `json:"dest"`
+}
+
+// SpillOver is for memory streams that should hold at most MaxMem bytes of messages
+// in memory. Once that is exceeded the oldest messages are moved to a file store and
+// loaded from disk when needed. Spilled messages are not kept across restarts.
+type SpillOver struct {
+	MaxMem int64 `json:"max_mem"`
+}
+
+// StoreTuning adjusts how a file based stream caches and flushes its messages.
+// Zero values select the defaults.
+type StoreTuning struct {
+	// CacheExpire is how long an unused message block cache is kept.
+	CacheExpire time.Duration `json:"cache_expire,omitempty"`
+	// SyncInterval is how often message blocks are synced to disk.
+	SyncInterval time.Duration `json:"sync_interval,omitempty"`
+	// CoalesceMinimum is the number of pending bytes to gather before writing.
+	CoalesceMinimum int `json:"coalesce_minimum,omitempty"`
+	// MaxFlushWait is the maximum time to wait to gather pending bytes.
+	MaxFlushWait time.Duration `json:"max_flush_wait,omitempty"`
+}
+
+// How often file based streams sync by default.
+const streamSyncInterval = 2 * time.Minute
+
+// Returns the file store config for the tuning, with our defaults for any
+// value not set.
+func (st *StoreTuning) fileStoreConfig() FileStoreConfig {
+	fcfg := FileStoreConfig{SyncInterval: streamSyncInterval}
+	if st != nil {
+		fcfg.CacheExpire, fcfg.CoalesceMinimum, fcfg.MaxFlushWait = st.CacheExpire, st.CoalesceMinimum, st.MaxFlushWait
+		if st.SyncInterval > 0 {
+			fcfg.SyncInterval = st.SyncInterval
+		}
+	}
+	return fcfg
+}
+
+// RemovalHook is for handing off messages that are about to be removed because of
+// the stream's limits or MaxAge, giving applications a chance to archive them elsewhere.
+// Messages are published in batches. Retention never waits on the hook, if it falls
+// behind messages are removed without being handed off and reported as dropped.
+type RemovalHook struct {
+	// Subject the batches of removed messages are published to.
+	Subject string `json:"subject"`
+	// HeadersOnly will leave the message data out of the batches.
+	HeadersOnly bool `json:"headers_only,omitempty"`
+	// MaxBatch is the maximum number of messages in a batch.
+	MaxBatch int `json:"max_batch,omitempty"`
+	// MaxPending is the maximum number of messages waiting to be handed off.
+	MaxPending int `json:"max_pending,omitempty"`
+}
+
+// RemovedMsgs is a batch of messages removed by limits or MaxAge.
+type RemovedMsgs struct {
+	Stream string        `json:"stream"`
+	Msgs   []*RemovedMsg `json:"msgs,omitempty"`
+	// Dropped is the number of messages removed since the last batch that could not be handed off.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+// RemovedMsg is a message removed by limits or MaxAge.
+type RemovedMsg struct {
+	Sequence uint64    `json:"seq"`
+	Subject  string    `json:"subject"`
+	Time     time.Time `json:"time"`
+	Header   []byte    `json:"hdrs,omitempty"`
+	Data     []byte    `json:"data,omitempty"`
+}
+
 // JSPubAckResponse is a formal response to a publish operation.
 type JSPubAckResponse struct {
 	Error *ApiError `json:"error,omitempty"`
@@ -115,14 +225,25 @@ type PubAck struct {
 
 // StreamInfo shows config and current state for this stream.
 type StreamInfo struct {
-	Config     StreamConfig        `json:"config"`
-	Created    time.Time           `json:"created"`
-	State      StreamState         `json:"state"`
-	Domain     string              `json:"domain,omitempty"`
-	Cluster    *ClusterInfo        `json:"cluster,omitempty"`
-	Mirror     *StreamSourceInfo   `json:"mirror,omitempty"`
-	Sources    []*StreamSourceInfo `json:"sources,omitempty"`
-	Alternates []StreamAlternate   `json:"alternates,omitempty"`
+	Config     StreamConfig           `json:"config"`
+	Created    time.Time              `json:"created"`
+	State      StreamState            `json:"state"`
+	Domain     string                 `json:"domain,omitempty"`
+	Cluster    *ClusterInfo           `json:"cluster,omitempty"`
+	Mirror     *StreamSourceInfo      `json:"mirror,omitempty"`
+	Sources    []*StreamSourceInfo    `json:"sources,omitempty"`
+	Alternates []StreamAlternate      `json:"alternates,omitempty"`
+	Intake     *StreamIntakeInfo      `json:"intake,omitempty"`
+	History    []StreamConfigRevision `json:"config_history,omitempty"`
+}
+
+// StreamIntakeInfo shows information about inbound messages that have been
+// queued for a stream but not yet processed, including any spilled to disk.
+type StreamIntakeInfo struct {
+	PendingBytes uint64 `json:"pending_bytes"`
+	SpooledBytes uint64 `json:"spooled_bytes"`
+	SpilledMsgs  uint64 `json:"spilled_msgs"`
+	SpilledBytes uint64 `json:"spilled_bytes"`
 }
 
 type StreamAlternate struct {
@@ -168,6 +289,9 @@ type StreamSource struct {
 	OptStartTime  *time.Time      `json:"opt_start_time,omitempty"`
 	FilterSubject string          `json:"filter_subject,omitempty"`
 	External      *ExternalStream `json:"external,omitempty"`
+	// Domain is the JetStream domain the origin stream lives in. It is resolved
+	// into the external API prefix of that domain when the stream is created.
+	Domain string `json:"domain,omitempty"`
 
 	// Internal
 	iname string // For indexing when stream names are the same for multiple sources.
@@ -179,9 +303,34 @@ type ExternalStream struct {
 	DeliverPrefix string `json:"deliver"`
 }
 
+// resolveDomain returns a copy of the stream source with its domain converted into
+// the external API prefix for that domain. Sources without a domain are returned as is.
+func (ss *StreamSource) resolveDomain() (*StreamSource, *ApiError) {
+	if ss == nil || ss.Domain == _EMPTY_ {
+		return ss, nil
+	}
+	if !isValidName(ss.Domain) {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream source domain %q is not valid", ss.Domain))
+	}
+	apiPfx := fmt.Sprintf(jsDomainAPIPrefix, ss.Domain)
+	ext := ExternalStream{ApiPrefix: apiPfx}
+	if ss.External != nil {
+		if ss.External.ApiPrefix != _EMPTY_ && ss.External.ApiPrefix != apiPfx {
+			return nil, NewJSStreamInvalidConfigError(
+				fmt.Errorf("stream source domain %q conflicts with external api prefix %q", ss.Domain, ss.External.ApiPrefix))
+		}
+		ext.DeliverPrefix = ss.External.DeliverPrefix
+	}
+	nss := *ss
+	nss.External, nss.Domain = &ext, _EMPTY_
+	return &nss, nil
+}
+
 // Stream is a jetstream stream of messages. When we receive a message internally destined
 // for a Stream we will direct link from the client to this structure.
 type stream struct {
+	// Atomic, in memory bytes queued for our intake. Keep first for alignment.
+	inb       int64
 	mu        sync.RWMutex
 	js        *jetStream
 	jsa       *jsAccount
@@ -193,6 +342,10 @@ type stream struct {
 	pubAck    []byte
 	outq      *jsOutQ
 	msgs      *ipQueue // of *inMsg
+	dgq       *ipQueue // of *directGetReq
+	spool     *intakeSpool
+	failed    error
+	scur      *sourceCursors
 	store     StreamStore
 	ackq      *ipQueue // of uint64
 	lseq      uint64
@@ -220,9 +373,19 @@ type stream struct {
 	// Indicates we have direct consumers.
 	directs int
 
+	// Clock for timestamps when proposing messages.
+	hlc hlc
+
 	// For republishing.
 	tr *transform
 
+	// For transforming subjects of inbound messages.
+	itr *transform
+
+	// For handing off messages removed by limits.
+	rmh  *removalHook
+	rmcb func(*RemovedMsgs)
+
 	// For processing consumers without main stream lock.
 	clsMu sync.RWMutex
 	cList []*consumer
@@ -291,6 +454,7 @@ const (
 	JSLastStreamSeq       = "Nats-Last-Stream"
 	JSConsumerStalled     = "Nats-Consumer-Stalled"
 	JSMsgRollup           = "Nats-Rollup"
+	JSMsgTombstone        = "Nats-Tombstone"
 	JSMsgSize             = "Nats-Msg-Size"
 	JSResponseType        = "Nats-Response-Type"
 )
@@ -302,6 +466,15 @@ const (
 	JSTimeStamp    = "Nats-Time-Stamp"
 	JSSubject      = "Nats-Subject"
 	JSLastSequence = "Nats-Last-Sequence"
+	JSNumPending   = "Nats-Num-Pending"
+)
+
+// Headers for the origin of stored messages.
+const (
+	JSOriginAccount    = "Nats-Origin-Account"
+	JSOriginClientId   = "Nats-Origin-Client-Id"
+	JSOriginClientName = "Nats-Origin-Client-Name"
+	JSOriginServer     = "Nats-Origin-Server"
 )
 
 // Rollups, can be subject only or all messages.
@@ -310,6 +483,12 @@ const (
 	JSMsgRollupAll     = "all"
 )
 
+// Tombstones mark a subject as deleted, or as purged of all its earlier messages.
+const (
+	JSMsgTombstoneDelete = "del"
+	JSMsgTombstonePurge  = "purge"
+)
+
 const (
 	jsCreateResponse = "create"
 )
@@ -328,15 +507,16 @@ const (
 
 // AddStream adds a stream for the given account.
 func (a *Account) addStream(config *StreamConfig) (*stream, error) {
-	return a.addStreamWithAssignment(config, nil, nil)
+	return a.addStreamWithAssignment(config, nil, nil, nil)
 }
 
 // AddStreamWithStore adds a stream for the given account with custome store config options.
 func (a *Account) addStreamWithStore(config *StreamConfig, fsConfig *FileStoreConfig) (*stream, error) {
-	return a.addStreamWithAssignment(config, fsConfig, nil)
+	return a.addStreamWithAssignment(config, fsConfig, nil, nil)
 }
 
-func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment) (*stream, error) {
+// The client info, if any, is the client that requested the stream and is reported in the create advisory.
+func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileStoreConfig, sa *streamAssignment, ci *ClientInfo) (*stream, error) {
 	s, jsa, err := a.checkForJetStream()
 	if err != nil {
 		return nil, err
@@ -361,6 +541,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	}
 
 	js, isClustered := jsa.jetStreamAndClustered()
+	jsa.addMu.Lock()
 	jsa.mu.RLock()
 	if mset, ok := jsa.streams[cfg.Name]; ok {
 		jsa.mu.RUnlock()
@@ -370,8 +551,10 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 			if sa != nil {
 				mset.setStreamAssignment(sa)
 			}
+			jsa.addMu.Unlock()
 			return mset, nil
 		} else {
+			jsa.addMu.Unlock()
 			return nil, ApiErrors[JSStreamNameExistErr]
 		}
 	}
@@ -384,6 +567,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	}
 	jsa.mu.RUnlock()
 	if !hasTier {
+		jsa.addMu.Unlock()
 		return nil, NewJSNoLimitsError()
 	}
 	js.mu.RLock()
@@ -392,6 +576,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	}
 	if err := js.checkAllLimits(&selected, &cfg, reserved, 0); err != nil {
 		js.mu.RUnlock()
+		jsa.addMu.Unlock()
 		return nil, err
 	}
 	js.mu.RUnlock()
@@ -400,6 +585,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	if cfg.Template != _EMPTY_ && jsa.account != nil {
 		if !jsa.checkTemplateOwnership(cfg.Template, cfg.Name) {
 			jsa.mu.Unlock()
+			jsa.addMu.Unlock()
 			return nil, fmt.Errorf("stream not owned by template")
 		}
 	}
@@ -415,11 +601,13 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	// These are not allowed for now.
 	if jsa.subjectsOverlap(cfg.Subjects, nil) {
 		jsa.mu.Unlock()
+		jsa.addMu.Unlock()
 		return nil, NewJSStreamSubjectOverlapError()
 	}
 
 	if !hasTier {
 		jsa.mu.Unlock()
+		jsa.addMu.Unlock()
 		return nil, fmt.Errorf("no applicable tier found")
 	}
 
@@ -463,15 +651,40 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 		tr, err := newTransform(cfg.RePublish.Source, cfg.RePublish.Destination)
 		if err != nil {
 			jsa.mu.Unlock()
+			jsa.addMu.Unlock()
 			return nil, fmt.Errorf("stream configuration for republish not valid")
 		}
 		// Assign our transform for republishing.
 		mset.tr = tr
 	}
 
+	// Check for a subject transform on ingestion.
+	if cfg.SubjectTransform != nil {
+		tr, err := newTransform(cfg.SubjectTransform.Source, cfg.SubjectTransform.Destination)
+		if err != nil {
+			jsa.mu.Unlock()
+			jsa.addMu.Unlock()
+			return nil, fmt.Errorf("stream configuration for subject transform not valid")
+		}
+		mset.itr = tr
+	}
+
+	if _, ok := jsa.streams[cfg.Name]; !ok {
+		atomic.AddInt64(&jsa.nstreams, 1)
+	}
 	jsa.streams[cfg.Name] = mset
 	storeDir := filepath.Join(jsa.storeDir, streamsDir, cfg.Name)
 	jsa.mu.Unlock()
+	jsa.addMu.Unlock()
+
+	// For file based streams we will spill our intake to disk under pressure,
+	// and persist the upstream positions of our sources.
+	if cfg.Storage == FileStorage {
+		mset.spool = newIntakeSpool(filepath.Join(storeDir, intakeSpoolFile))
+		mset.scur = newSourceCursors(filepath.Join(storeDir, sourceCursorsFile))
+	} else {
+		mset.scur = newSourceCursors(_EMPTY_)
+	}
 
 	// Bind to the user account.
 	c.registerWithAccount(a)
@@ -490,12 +703,35 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	}
 	fsCfg.StoreDir = storeDir
 	fsCfg.AsyncFlush = false
-	fsCfg.SyncInterval = 2 * time.Minute
+	tcfg := cfg.StoreTuning.fileStoreConfig()
+	fsCfg.SyncInterval = tcfg.SyncInterval
+	if cfg.StoreTuning != nil {
+		fsCfg.CacheExpire, fsCfg.CoalesceMinimum, fsCfg.MaxFlushWait = tcfg.CacheExpire, tcfg.CoalesceMinimum, tcfg.MaxFlushWait
+	}
+	fsCfg.SyncAlways = cfg.SyncAlways
+	fsCfg.AdaptiveBlockSize = cfg.AdaptiveBlockSize
+	fsCfg.RebuildState = s.getOpts().JetStreamRebuildState
+	fsCfg.MaxClockSkew = s.jsMaxClockSkew()
+	mset.hlc.setMaxDrift(fsCfg.MaxClockSkew)
+	if js := s.getJetStream(); js != nil {
+		fsCfg.bgIO, fsCfg.reKeyIO, fsCfg.blkFDs = js.bgIO, js.reKeyIO, js.blkFDs
+	}
+	// Archive cold message blocks if configured.
+	if ao := s.getOpts().JetStreamArchive; ao != nil && fsCfg.Archive == nil {
+		if js := s.getJetStream(); js != nil && js.archive != nil {
+			fsCfg.Archive = js.archive
+			fsCfg.ArchiveAge, fsCfg.ArchiveBytes = ao.MaxAge, uint64(ao.MaxLocalBytes)
+		}
+	}
 
 	if err := mset.setupStore(fsCfg); err != nil {
-		mset.stop(true, false)
+		mset.stop(true, false, nil)
 		return nil, NewJSStreamStoreFailedError(err)
 	}
+	// In clustered mode record who created us if this is a new stream.
+	if sa != nil && len(mset.store.ConfigHistory()) == 0 {
+		mset.recordConfigRevision(sa.Client, nil)
+	}
 
 	// Create our pubAck template here. Better than json marshal each time on success.
 	if domain := s.getOpts().JetStreamDomain; domain != _EMPTY_ {
@@ -515,6 +751,12 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	mset.lseq = state.LastSeq
 	mset.mu.Unlock()
 
+	// Make sure our clock is ahead of anything already stored.
+	if !state.LastTime.IsZero() && !mset.hlc.observe(state.LastTime.UnixNano()) {
+		s.Warnf("Stream '%s > %s' last message time %v is more than %v ahead of our clock",
+			a.Name, cfg.Name, state.LastTime, fsCfg.MaxClockSkew)
+	}
+
 	// If no msgs (new stream), set dedupe state loaded to true.
 	if state.Msgs == 0 {
 		mset.ddloaded = true
@@ -535,7 +777,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 	// This can be called though before we actually setup clustering, so check both.
 	if singleServerMode {
 		if err := mset.setLeader(true); err != nil {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, err
 		}
 	}
@@ -556,7 +798,7 @@ func (a *Account) addStreamWithAssignment(config *StreamConfig, fsConfig *FileSt
 			suppress = sa.responded
 		}
 		if !suppress {
-			mset.sendCreateAdvisory()
+			mset.sendCreateAdvisory(ci)
 		}
 	}
 
@@ -814,7 +1056,7 @@ func (mset *stream) setLastSeq(lseq uint64) {
 	mset.mu.Unlock()
 }
 
-func (mset *stream) sendCreateAdvisory() {
+func (mset *stream) sendCreateAdvisory(ci *ClientInfo) {
 	mset.mu.RLock()
 	name := mset.cfg.Name
 	template := mset.cfg.Template
@@ -837,6 +1079,7 @@ func (mset *stream) sendCreateAdvisory() {
 		Action:   CreateEvent,
 		Template: template,
 		Domain:   srv.getOpts().JetStreamDomain,
+		Client:   ci,
 	}
 
 	j, err := json.Marshal(m)
@@ -848,7 +1091,7 @@ func (mset *stream) sendCreateAdvisory() {
 	outq.sendMsg(subj, j)
 }
 
-func (mset *stream) sendDeleteAdvisoryLocked() {
+func (mset *stream) sendDeleteAdvisoryLocked(ci *ClientInfo) {
 	if mset.outq == nil {
 		return
 	}
@@ -863,6 +1106,7 @@ func (mset *stream) sendDeleteAdvisoryLocked() {
 		Action:   DeleteEvent,
 		Template: mset.cfg.Template,
 		Domain:   mset.srv.getOpts().JetStreamDomain,
+		Client:   ci,
 	}
 
 	j, err := json.Marshal(m)
@@ -872,7 +1116,7 @@ func (mset *stream) sendDeleteAdvisoryLocked() {
 	}
 }
 
-func (mset *stream) sendUpdateAdvisoryLocked() {
+func (mset *stream) sendUpdateAdvisoryLocked(ci *ClientInfo) {
 	if mset.outq == nil {
 		return
 	}
@@ -886,6 +1130,7 @@ func (mset *stream) sendUpdateAdvisoryLocked() {
 		Stream: mset.cfg.Name,
 		Action: ModifyEvent,
 		Domain: mset.srv.getOpts().JetStreamDomain,
+		Client: ci,
 	}
 
 	j, err := json.Marshal(m)
@@ -1066,12 +1311,35 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		isRecovering = js.isMetaRecovering()
 	}
 
+	// Resolve any source domains into the external API prefix of that domain.
+	if cfg.Mirror != nil {
+		m, apiErr := cfg.Mirror.resolveDomain()
+		if apiErr != nil {
+			return StreamConfig{}, apiErr
+		}
+		cfg.Mirror = m
+	}
+	if len(cfg.Sources) > 0 {
+		sources := make([]*StreamSource, 0, len(cfg.Sources))
+		for _, src := range cfg.Sources {
+			src, apiErr := src.resolveDomain()
+			if apiErr != nil {
+				return StreamConfig{}, apiErr
+			}
+			sources = append(sources, src)
+		}
+		cfg.Sources = sources
+	}
+
 	// Do some pre-checking for mirror config to avoid cycles in clustered mode.
 	if cfg.Mirror != nil {
 		if len(cfg.Subjects) > 0 {
 			return StreamConfig{}, NewJSMirrorWithSubjectsError()
 
 		}
+		if cfg.FirstSeq > 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream mirrors can not set first sequence"))
+		}
 		if len(cfg.Sources) > 0 {
 			return StreamConfig{}, NewJSMirrorWithSourcesError()
 		}
@@ -1295,6 +1563,87 @@ func (s *Server) checkStreamCfg(config *StreamConfig, acc *Account) (StreamConfi
 		}
 	}
 
+	// If we have a subject transform check if we can create a transform here.
+	if cfg.SubjectTransform != nil {
+		if cfg.Mirror != nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream mirrors can not have a subject transform"))
+		}
+		// Copy since we may default the source.
+		st := *cfg.SubjectTransform
+		cfg.SubjectTransform = &st
+		// Empty same as all.
+		if st.Source == _EMPTY_ {
+			st.Source = fwcs
+		}
+		if !IsValidSubject(st.Source) {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for subject transform source is not valid"))
+		}
+		if len(cfg.Subjects) > 0 {
+			var srcValid bool
+			for _, subj := range cfg.Subjects {
+				if SubjectsCollide(st.Source, subj) {
+					srcValid = true
+					break
+				}
+			}
+			if !srcValid {
+				return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for subject transform source is not valid subset of subjects"))
+			}
+		}
+		if st.Destination == _EMPTY_ {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for subject transform destination is required"))
+		}
+		if _, err := newTransform(st.Source, st.Destination); err != nil {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for subject transform not valid"))
+		}
+		// Transformed subjects need to stay within the stream's subjects.
+		if len(cfg.Subjects) > 0 {
+			dest := transformDestCoverage(st.Destination)
+			var destValid bool
+			for _, subj := range cfg.Subjects {
+				if subjectIsSubsetMatch(dest, subj) {
+					destValid = true
+					break
+				}
+			}
+			if !destValid {
+				return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for subject transform destination is not valid subset of subjects"))
+			}
+		}
+	}
+
+	if st := cfg.StoreTuning; st != nil {
+		if cfg.Storage != FileStorage {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream store tuning requires file storage"))
+		}
+		if st.CacheExpire < 0 || st.SyncInterval < 0 || st.CoalesceMinimum < 0 || st.MaxFlushWait < 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream store tuning values can not be negative"))
+		}
+	}
+
+	if so := cfg.SpillOver; so != nil {
+		if cfg.Storage != MemoryStorage {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream spill over requires memory storage"))
+		}
+		if so.MaxMem <= 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream spill over max memory must be greater than zero"))
+		}
+	}
+
+	if rh := cfg.RemovalHook; rh != nil {
+		if !IsValidPublishSubject(rh.Subject) {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for removal hook subject is not valid"))
+		}
+		for _, subj := range cfg.Subjects {
+			if SubjectsCollide(rh.Subject, subj) {
+				return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for removal hook subject forms a cycle"))
+			}
+		}
+		if rh.MaxBatch < 0 || rh.MaxPending < 0 {
+			return StreamConfig{}, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration for removal hook limits can not be negative"))
+		}
+	}
+
 	return cfg, nil
 }
 
@@ -1315,6 +1664,33 @@ func (mset *stream) fileStoreConfig() (FileStoreConfig, error) {
 	return fs.fileStoreConfig(), nil
 }
 
+// isMirrorPromotion returns true if the update removes the mirror from a stream,
+// turning it into a regular stream that keeps the messages mirrored so far.
+func isMirrorPromotion(old, new *StreamConfig) bool {
+	return old.Mirror != nil && new.Mirror == nil
+}
+
+// Returns a subject covering all the subjects the transform destination can
+// produce, with the mapping functions replaced by wildcards.
+func transformDestCoverage(dest string) string {
+	tokens := strings.Split(dest, tsep)
+	for i, token := range tokens {
+		mt, _, _, _, err := indexPlaceHolders(token)
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case NoTransform:
+		case SplitFromLeft, SplitFromRight, SliceFromLeft, SliceFromRight, Split:
+			// These can produce any number of tokens.
+			return strings.Join(append(tokens[:i], fwcs), tsep)
+		default:
+			tokens[i] = pwcs
+		}
+	}
+	return strings.Join(tokens, tsep)
+}
+
 // Do not hold jsAccount or jetStream lock
 func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*StreamConfig, error) {
 	cfg, apiErr := s.checkStreamCfg(new, jsa.acc())
@@ -1358,13 +1734,33 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*Str
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not cancel deny purge"))
 	}
 	// Check for mirror changes which are not allowed.
-	if !reflect.DeepEqual(cfg.Mirror, old.Mirror) {
+	// The only exception is removing the mirror, which promotes it to a regular stream.
+	if !reflect.DeepEqual(cfg.Mirror, old.Mirror) && !isMirrorPromotion(old, &cfg) {
 		return nil, NewJSStreamMirrorNotUpdatableError()
 	}
+	if cfg.Mirror == nil {
+		cfg.MirrorDirect = false
+	}
 	// Can't change RePublish
 	if !reflect.DeepEqual(cfg.RePublish, old.RePublish) {
 		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change RePublish"))
 	}
+	// Can't change SubjectTransform
+	if !reflect.DeepEqual(cfg.SubjectTransform, old.SubjectTransform) {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change subject transform"))
+	}
+	// Can't change SpillOver
+	if !reflect.DeepEqual(cfg.SpillOver, old.SpillOver) {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change spill over"))
+	}
+	// Can't change how we account for stored messages.
+	if cfg.MsgOverhead != old.MsgOverhead {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change msg overhead"))
+	}
+	// First sequence only applies when the stream is created.
+	if cfg.FirstSeq != old.FirstSeq {
+		return nil, NewJSStreamInvalidConfigError(fmt.Errorf("stream configuration update can not change first sequence"))
+	}
 
 	// Check on new discard new per subject.
 	if cfg.DiscardNewPer {
@@ -1447,11 +1843,12 @@ func (jsa *jsAccount) configUpdateCheck(old, new *StreamConfig, s *Server) (*Str
 
 // Update will allow certain configuration properties of an existing stream to be updated.
 func (mset *stream) update(config *StreamConfig) error {
-	return mset.updateWithAdvisory(config, true)
+	return mset.updateWithAdvisory(config, true, nil)
 }
 
 // Update will allow certain configuration properties of an existing stream to be updated.
-func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool) error {
+// The client info, if present, is recorded in the config history.
+func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool, ci *ClientInfo) error {
 	_, jsa, err := mset.acc.checkForJetStream()
 	if err != nil {
 		return err
@@ -1475,6 +1872,12 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 	jsa.mu.RUnlock()
 
 	mset.mu.Lock()
+	// If the mirror was removed stop mirroring. This runs on all members
+	// since followers may be answering mirror direct gets.
+	if isMirrorPromotion(&ocfg, cfg) && mset.mirror != nil {
+		mset.cancelSourceInfo(mset.mirror)
+		mset.mirror = nil
+	}
 	if mset.isLeader() {
 		// Now check for subject interest differences.
 		current := make(map[string]struct{}, len(ocfg.Subjects))
@@ -1553,6 +1956,9 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 			for iname := range current {
 				mset.cancelSourceConsumer(iname)
 				delete(mset.sources, iname)
+				if mset.scur != nil {
+					mset.scur.remove(iname)
+				}
 			}
 		}
 	}
@@ -1586,12 +1992,17 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 		// a subsequent update to an existing tier will then move from existing past tier to existing new tier
 	}
 
+	// Reconfigure the removal hook before the store enforces any new limits.
+	if !reflect.DeepEqual(cfg.RemovalHook, ocfg.RemovalHook) {
+		mset.setupRemovalHookLocked(cfg.RemovalHook)
+	}
+
 	// Now update config and store's version of our config.
 	mset.cfg = *cfg
 
 	// If we are the leader never suppress update advisory, simply send.
 	if mset.isLeader() && sendAdvisory {
-		mset.sendUpdateAdvisoryLocked()
+		mset.sendUpdateAdvisoryLocked(ci)
 	}
 	mset.mu.Unlock()
 
@@ -1614,9 +2025,73 @@ func (mset *stream) updateWithAdvisory(config *StreamConfig, sendAdvisory bool)
 
 	mset.store.UpdateConfig(cfg)
 
+	// Apply any change to the caching and flushing of our file store.
+	if !reflect.DeepEqual(cfg.StoreTuning, ocfg.StoreTuning) {
+		if fs, ok := mset.store.(*fileStore); ok {
+			if err := fs.UpdateFileStoreConfig(cfg.StoreTuning.fileStoreConfig()); err != nil {
+				s.Warnf("Error updating store tuning for stream '%s > %s': %v", mset.accName(), mset.name(), err)
+			}
+		}
+	}
+
+	if changes := streamConfigChanges(&ocfg, cfg); len(changes) > 0 {
+		mset.recordConfigRevision(ci, changes)
+	}
+
 	return nil
 }
 
+// Will record a config revision in our store. No changes means a create.
+func (mset *stream) recordConfigRevision(ci *ClientInfo, changes []string) {
+	mset.mu.RLock()
+	store, s := mset.store, mset.srv
+	mset.mu.RUnlock()
+	if store == nil {
+		return
+	}
+	rev := StreamConfigRevision{Changes: changes}
+	if ci != nil {
+		rev.Account, rev.User = ci.serviceAccount(), ci.User
+	}
+	if err := store.RecordConfigRevision(rev); err != nil && s != nil {
+		s.Warnf("Error recording config revision for stream '%s > %s': %v", mset.accName(), mset.name(), err)
+	}
+}
+
+// Returns the config revision history for this stream.
+func (mset *stream) configHistory() []StreamConfigRevision {
+	mset.mu.RLock()
+	store := mset.store
+	mset.mu.RUnlock()
+	if store == nil {
+		return nil
+	}
+	return store.ConfigHistory()
+}
+
+// Returns the names of the top level config fields that differ, sorted.
+func streamConfigChanges(ocfg, cfg *StreamConfig) []string {
+	var om, nm map[string]json.RawMessage
+	ob, _ := json.Marshal(ocfg)
+	nb, _ := json.Marshal(cfg)
+	if json.Unmarshal(ob, &om) != nil || json.Unmarshal(nb, &nm) != nil {
+		return nil
+	}
+	var changes []string
+	for k, v := range nm {
+		if ov, ok := om[k]; !ok || !bytes.Equal(ov, v) {
+			changes = append(changes, k)
+		}
+	}
+	for k := range om {
+		if _, ok := nm[k]; !ok {
+			changes = append(changes, k)
+		}
+	}
+	sort.Strings(changes)
+	return changes
+}
+
 // Purge will remove all messages from the stream and underlying store based on the request.
 func (mset *stream) purge(preq *JSApiStreamPurgeRequest) (purged uint64, err error) {
 	mset.mu.RLock()
@@ -2108,6 +2583,11 @@ func (mset *stream) retryMirrorConsumer() error {
 // Lock should be held.
 func (mset *stream) skipMsgs(start, end uint64) {
 	node, store := mset.node, mset.store
+	// If we are not clustered we can record the whole gap at once.
+	if node == nil && start <= end && store.SkipMsgs(start, end-start+1) == nil {
+		mset.lseq = end
+		return
+	}
 	var entries []*Entry
 	for seq := start; seq <= end; seq++ {
 		if node != nil {
@@ -2431,6 +2911,10 @@ func (mset *stream) cancelSourceInfo(si *sourceInfo) {
 		mset.unsubscribe(si.dsub)
 		si.dsub = nil
 	}
+	if si.lbsub != nil {
+		mset.unsubscribe(si.lbsub)
+		si.lbsub = nil
+	}
 	mset.removeInternalConsumer(si)
 	if si.qch != nil {
 		close(si.qch)
@@ -2927,6 +3411,13 @@ func (mset *stream) setStartingSequenceForSource(sname string) {
 	var state StreamState
 	mset.store.FastState(&state)
 
+	// Our tracked cursor survives purge/expiration of our messages.
+	if mset.scur != nil {
+		if seq := mset.scur.get(sname); seq > si.sseq {
+			si.sseq = seq
+		}
+	}
+
 	// Do not reset sseq here so we can remember when purge/expiration happens.
 	if state.Msgs == 0 {
 		si.dseq = 0
@@ -2945,7 +3436,9 @@ func (mset *stream) setStartingSequenceForSource(sname string) {
 		}
 		iname, sseq := streamAndSeq(string(ss))
 		if iname == sname {
-			si.sseq = sseq
+			if sseq > si.sseq {
+				si.sseq = sseq
+			}
 			si.dseq = 0
 			return
 		}
@@ -2969,6 +3462,10 @@ func (mset *stream) startingSequenceForSources() {
 			ssi.setIndexName()
 		}
 		si := &sourceInfo{name: ssi.Name, iname: ssi.iname}
+		// Start with our tracked cursor, this survives our messages being removed.
+		if mset.scur != nil {
+			si.sseq = mset.scur.get(ssi.iname)
+		}
 		mset.sources[ssi.iname] = si
 	}
 
@@ -2994,11 +3491,11 @@ func (mset *stream) startingSequenceForSources() {
 	// Stamp our si seq records on the way out.
 	defer func() {
 		for sname, seq := range seqs {
-			// Ignore if not set.
+			// Ignore if not set, or if our persisted cursor is further along.
 			if seq == 0 {
 				continue
 			}
-			if si := mset.sources[sname]; si != nil {
+			if si := mset.sources[sname]; si != nil && seq > si.sseq {
 				si.sseq = seq
 				si.dseq = 0
 			}
@@ -3283,6 +3780,19 @@ func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 			mset.mu.Unlock()
 			return err
 		}
+		ms.hlc.setMaxDrift(fsCfg.MaxClockSkew)
+		if so := mset.cfg.SpillOver; so != nil {
+			// Spilled messages are encrypted like any other stream's.
+			s := mset.srv
+			prf := s.jsKeyGen(mset.acc.Name)
+			dir := filepath.Join(fsCfg.StoreDir, memSpillDir)
+			if err := ms.enableSpill(dir, uint64(so.MaxMem), prf, s.getOpts().JetStreamCipher); err != nil {
+				mset.mu.Unlock()
+				return err
+			}
+			// Spilled bytes count against file storage and no longer memory.
+			ms.registerSpillUpdates(mset.spillUpdates)
+		}
 		mset.store = ms
 	case FileStorage:
 		s := mset.srv
@@ -3291,70 +3801,309 @@ func (mset *stream) setupStore(fsCfg *FileStoreConfig) error {
 			// We are encrypted here, fill in correct cipher selection.
 			fsCfg.Cipher = s.getOpts().JetStreamCipher
 		}
-		fs, err := newFileStoreWithCreated(*fsCfg, mset.cfg, mset.created, prf)
+		fs, err := newFileStoreWithKeys(*fsCfg, mset.cfg, mset.created, prf, s.jsPrevKeyGen(mset.acc.Name))
 		if err != nil {
 			mset.mu.Unlock()
 			return err
 		}
 		mset.store = fs
+		if n := fs.reKeyPending(); n > 0 {
+			s.Noticef("Stream '%s > %s' re-encrypting %d message blocks with the new key", mset.acc.Name, mset.cfg.Name, n)
+		}
+		for _, db := range fs.damagedBlocks() {
+			s.Warnf("Stream '%s > %s' message block %d is damaged (%s), kept %v in %q, sequences [%d-%d] (%d msgs) are not available",
+				mset.acc.Name, mset.cfg.Name, db.Index, db.Reason, db.Files,
+				filepath.Join(fsCfg.StoreDir, corruptDir), db.FirstSeq, db.LastSeq, db.Msgs)
+		}
 	}
 	mset.mu.Unlock()
 
 	mset.store.RegisterStorageUpdates(mset.storeUpdates)
+	mset.store.RegisterStorageQuotaCheck(mset.storeQuotaCheck)
+	mset.store.RegisterConsumerOrphanCheck(mset.isOrphanConsumer)
+
+	mset.mu.Lock()
+	mset.setupRemovalHookLocked(mset.cfg.RemovalHook)
+	mset.mu.Unlock()
 
 	return nil
 }
 
-// Called for any updates to the underlying stream. We pass through the bytes to the
-// jetstream account. We do local processing for stream pending for consumers, but only
-// for removals.
-// Lock should not be held.
-func (mset *stream) storeUpdates(md, bd int64, seq uint64, subj string) {
-	// If we have a single negative update then we will process our consumers for stream pending.
-	// Purge and Store handled separately inside individual calls.
-	if md == -1 && seq > 0 {
-		// We use our consumer list mutex here instead of the main stream lock since it may be held already.
-		mset.clsMu.RLock()
-		for _, o := range mset.cList {
-			o.decStreamPending(seq, subj)
+const (
+	// Defaults for handing off messages removed by limits.
+	defaultRemovalHookMaxBatch   = 100
+	defaultRemovalHookMaxPending = 10_000
+	removalHookFlushInterval     = 100 * time.Millisecond
+)
+
+// removalHook collects messages removed by limits and hands them off in
+// batches from its own Go routine, so retention never waits on the hook.
+type removalHook struct {
+	mu       sync.Mutex
+	cfg      RemovalHook
+	pending  []*RemovedMsg
+	dropped  uint64
+	kch      chan struct{}
+	qch      chan struct{}
+	hdrsOnly bool
+}
+
+// Called by the store with its lock held, so this must not block.
+func (rh *removalHook) add(sm *StoreMsg) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if len(rh.pending) >= rh.cfg.MaxPending {
+		rh.dropped++
+		return
+	}
+	rm := &RemovedMsg{
+		Sequence: sm.seq,
+		Subject:  sm.subj,
+		Time:     time.Unix(0, sm.ts).UTC(),
+		Header:   copyBytes(sm.hdr),
+	}
+	if !rh.hdrsOnly {
+		rm.Data = copyBytes(sm.msg)
+	}
+	rh.pending = append(rh.pending, rm)
+	if len(rh.pending) >= rh.cfg.MaxBatch {
+		select {
+		case rh.kch <- struct{}{}:
+		default:
 		}
-		mset.clsMu.RUnlock()
 	}
+}
 
-	if mset.jsa != nil {
-		mset.jsa.updateUsage(mset.tier, mset.stype, bd)
+// Takes the next batch, limited in count and approximate encoded size.
+func (rh *removalHook) next(maxBytes int) ([]*RemovedMsg, uint64) {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	var n, size int
+	for n < len(rh.pending) && n < rh.cfg.MaxBatch {
+		rm := rh.pending[n]
+		// Header and data are base64 encoded.
+		sz := len(rm.Subject) + (len(rm.Header)+len(rm.Data))*4/3 + 96
+		if n > 0 && size+sz > maxBytes {
+			break
+		}
+		size += sz
+		n++
+	}
+	batch := rh.pending[:n:n]
+	rh.pending = rh.pending[n:]
+	if len(rh.pending) == 0 {
+		rh.pending = nil
 	}
+	dropped := rh.dropped
+	rh.dropped = 0
+	return batch, dropped
 }
 
-// NumMsgIds returns the number of message ids being tracked for duplicate suppression.
-func (mset *stream) numMsgIds() int {
-	mset.mu.Lock()
-	defer mset.mu.Unlock()
-	if !mset.ddloaded {
-		mset.rebuildDedupe()
+// Sets up, replaces or removes the removal hook.
+// Lock should be held.
+func (mset *stream) setupRemovalHookLocked(cfg *RemovalHook) {
+	if mset.rmh != nil {
+		close(mset.rmh.qch)
+		mset.rmh = nil
 	}
-	return len(mset.ddmap)
+	if cfg == nil && mset.rmcb == nil {
+		if mset.store != nil {
+			mset.store.RegisterStorageRemovals(nil)
+		}
+		return
+	}
+	rh := &removalHook{kch: make(chan struct{}, 1), qch: make(chan struct{})}
+	if cfg != nil {
+		rh.cfg = *cfg
+		rh.hdrsOnly = cfg.HeadersOnly && mset.rmcb == nil
+	}
+	if rh.cfg.MaxBatch == 0 {
+		rh.cfg.MaxBatch = defaultRemovalHookMaxBatch
+	}
+	if rh.cfg.MaxPending == 0 {
+		rh.cfg.MaxPending = defaultRemovalHookMaxPending
+	}
+	mset.rmh = rh
+	if mset.store != nil {
+		mset.store.RegisterStorageRemovals(rh.add)
+	}
+	go mset.removalHookLoop(rh)
 }
 
-// checkMsgId will process and check for duplicates.
-// Lock should be held.
-func (mset *stream) checkMsgId(id string) *ddentry {
-	if !mset.ddloaded {
-		mset.rebuildDedupe()
+// Confirms a consumer that left its state behind in our store is gone.
+// This is called by the store without its lock held.
+func (mset *stream) isOrphanConsumer(name string) bool {
+	if mset.lookupConsumer(name) != nil {
+		return false
 	}
-	if id == _EMPTY_ || len(mset.ddmap) == 0 {
-		return nil
+	// In clustered mode the consumer may be assigned but not running here yet.
+	if js := mset.srv.getJetStream(); js != nil {
+		accName, stream := mset.accName(), mset.name()
+		js.mu.RLock()
+		ca := js.consumerAssignment(accName, stream, name)
+		js.mu.RUnlock()
+		if ca != nil {
+			return false
+		}
 	}
-	return mset.ddmap[id]
+	return true
 }
 
-// Will purge the entries that are past the window.
-// Should be called from a timer.
-func (mset *stream) purgeMsgIds() {
+// Runs the requested storage maintenance on our own store.
+// Returns the block taking writes and the number of caches dropped.
+func (mset *stream) storeMaintenance(req *JSApiStreamMaintenanceRequest) (uint32, int, error) {
+	mset.mu.RLock()
+	fs, ok := mset.store.(*fileStore)
+	mset.mu.RUnlock()
+	if !ok {
+		return 0, 0, errMaintenanceFileOnly
+	}
+
+	var block uint32
+	var dropped int
+	// Roll first so a sync covers the block we rolled from.
+	if req.RollBlock {
+		var err error
+		if block, err = fs.RollBlock(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if req.ForceSync {
+		if err := fs.ForceSync(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if req.DropCaches {
+		dropped = fs.DropCaches()
+	}
+	return block, dropped, nil
+}
+
+// Registers an internal handler for batches of messages removed by limits.
+func (mset *stream) registerRemovalHandler(cb func(*RemovedMsgs)) {
 	mset.mu.Lock()
 	defer mset.mu.Unlock()
+	mset.rmcb = cb
+	mset.setupRemovalHookLocked(mset.cfg.RemovalHook)
+}
 
-	now := time.Now().UnixNano()
+// Hands off batches of removed messages.
+func (mset *stream) removalHookLoop(rh *removalHook) {
+	t := time.NewTicker(removalHookFlushInterval)
+	defer t.Stop()
+
+	maxBytes := int(mset.srv.getOpts().MaxPayload) * 3 / 4
+
+	for {
+		select {
+		case <-rh.qch:
+			return
+		case <-rh.kch:
+		case <-t.C:
+		}
+		for {
+			batch, dropped := rh.next(maxBytes)
+			if len(batch) == 0 && dropped == 0 {
+				break
+			}
+			mset.mu.RLock()
+			name, cb, outq := mset.cfg.Name, mset.rmcb, mset.outq
+			mset.mu.RUnlock()
+			if dropped > 0 {
+				mset.srv.RateLimitWarnf("Stream '%s > %s' removal hook fell behind, %d removed messages were not handed off",
+					mset.accName(), name, dropped)
+			}
+			// Only the leader hands off, all replicas remove the same messages.
+			if !mset.isLeader() {
+				continue
+			}
+			rm := &RemovedMsgs{Stream: name, Msgs: batch, Dropped: dropped}
+			if cb != nil {
+				cb(rm)
+			}
+			if rh.cfg.Subject != _EMPTY_ && outq != nil {
+				if rh.cfg.HeadersOnly {
+					for _, m := range rm.Msgs {
+						m.Data = nil
+					}
+				}
+				if b, err := json.Marshal(rm); err == nil {
+					outq.send(newJSPubMsg(rh.cfg.Subject, _EMPTY_, _EMPTY_, nil, b, nil, 0))
+				}
+			}
+		}
+	}
+}
+
+// Called by the store before storing a new message so writes that would
+// exceed the account's reserved storage are rejected before they happen.
+// Store lock will be held, and the stream lock when called from processJetStreamMsg.
+func (mset *stream) storeQuotaCheck(bytes int64) bool {
+	if mset.jsa == nil {
+		return true
+	}
+	return !mset.jsa.wouldExceedLimits(mset.stype, mset.tier, bytes)
+}
+
+// Called for any updates to the underlying stream. We pass through the bytes to the
+// jetstream account. We do local processing for stream pending for consumers, but only
+// for removals.
+// Lock should not be held.
+func (mset *stream) storeUpdates(md, bd int64, seq uint64, subj string) {
+	// If we have a single negative update then we will process our consumers for stream pending.
+	// Purge and Store handled separately inside individual calls.
+	if md == -1 && seq > 0 {
+		// We use our consumer list mutex here instead of the main stream lock since it may be held already.
+		mset.clsMu.RLock()
+		for _, o := range mset.cList {
+			o.decStreamPending(seq, subj)
+		}
+		mset.clsMu.RUnlock()
+	}
+
+	if mset.jsa != nil {
+		mset.jsa.updateUsage(mset.tier, mset.stype, bd)
+	}
+}
+
+// spillUpdates moves usage between memory and file storage for memory streams
+// that spill messages to disk.
+func (mset *stream) spillUpdates(bd int64) {
+	if mset.jsa != nil {
+		mset.jsa.updateUsage(mset.tier, MemoryStorage, -bd)
+		mset.jsa.updateUsage(mset.tier, FileStorage, bd)
+	}
+}
+
+// NumMsgIds returns the number of message ids being tracked for duplicate suppression.
+func (mset *stream) numMsgIds() int {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+	if !mset.ddloaded {
+		mset.rebuildDedupe()
+	}
+	return len(mset.ddmap)
+}
+
+// checkMsgId will process and check for duplicates.
+// Lock should be held.
+func (mset *stream) checkMsgId(id string) *ddentry {
+	if !mset.ddloaded {
+		mset.rebuildDedupe()
+	}
+	if id == _EMPTY_ || len(mset.ddmap) == 0 {
+		return nil
+	}
+	return mset.ddmap[id]
+}
+
+// Will purge the entries that are past the window.
+// Should be called from a timer.
+func (mset *stream) purgeMsgIds() {
+	mset.mu.Lock()
+	defer mset.mu.Unlock()
+
+	now := time.Now().UnixNano()
 	tmrNext := mset.cfg.Duplicates
 	window := int64(tmrNext)
 
@@ -3447,6 +4196,64 @@ func getRollup(hdr []byte) string {
 	return strings.ToLower(string(r))
 }
 
+// Fast lookup of tombstones.
+func getTombstone(hdr []byte) string {
+	t := getHeader(JSMsgTombstone, hdr)
+	if len(t) == 0 {
+		return _EMPTY_
+	}
+	return strings.ToLower(string(t))
+}
+
+// Returns true if this message is a tombstone for its subject.
+func isTombstone(hdr []byte) bool {
+	return len(hdr) > 0 && len(getHeader(JSMsgTombstone, hdr)) > 0
+}
+
+// Tombstones are stored without a body, only keeping the headers
+// needed to recover dedupe and source state.
+func compactTombstone(tombstone string, hdr []byte) []byte {
+	nhdr := genHeader(nil, JSMsgTombstone, tombstone)
+	for _, key := range []string{JSMsgId, JSStreamSource} {
+		if v := getHeader(key, hdr); len(v) > 0 {
+			nhdr = genHeader(nhdr, key, string(v))
+		}
+	}
+	return nhdr
+}
+
+// Returns a copy of the header with all lines for the keys removed. Keys are matched
+// case insensitively so publishers can not sneak in a variant clients would read first.
+func stripHeaders(hdr []byte, keys ...string) []byte {
+	i := bytes.Index(hdr, []byte(_CRLF_))
+	if i < 0 {
+		return copyBytes(hdr)
+	}
+	// Keep the status line.
+	nhdr := append(make([]byte, 0, len(hdr)), hdr[:i+LEN_CR_LF]...)
+	for rest := hdr[i+LEN_CR_LF:]; len(rest) > 0; {
+		line := rest
+		if j := bytes.Index(rest, []byte(_CRLF_)); j >= 0 {
+			line = rest[:j+LEN_CR_LF]
+		}
+		rest = rest[len(line):]
+		if k := bytes.IndexByte(line, ':'); k > 0 {
+			name, drop := string(bytes.TrimSpace(line[:k])), false
+			for _, key := range keys {
+				if strings.EqualFold(name, key) {
+					drop = true
+					break
+				}
+			}
+			if drop {
+				continue
+			}
+		}
+		nhdr = append(nhdr, line...)
+	}
+	return nhdr
+}
+
 // Fast lookup of expected stream sequence per subject.
 func getExpectedLastSeqPerSubject(hdr []byte) (uint64, bool) {
 	bseq := getHeader(JSExpectedLastSubjSeq, hdr)
@@ -3481,6 +4288,28 @@ func (mset *stream) queueInbound(ib *ipQueue, subj, rply string, hdr, msg []byte
 }
 
 func (mset *stream) queueInboundMsg(subj, rply string, hdr, msg []byte) {
+	// Check if we should be spilling to disk.
+	if sp := mset.spool; sp != nil {
+		sz := inMsgSize(subj, rply, hdr, msg)
+		spilled, err := sp.spill(atomic.LoadInt64(&mset.inb)+sz > streamIntakeMaxBytes, subj, rply, hdr, msg)
+		if err != nil {
+			// Messages are on disk that need to be processed first, so we
+			// can not take this one in memory.
+			if rply != _EMPTY_ {
+				var resp = JSPubAckResponse{
+					PubAck: &PubAck{Stream: mset.name()},
+					Error:  NewJSStreamStoreFailedError(err),
+				}
+				b, _ := json.Marshal(resp)
+				mset.outq.sendMsg(rply, b)
+			}
+			return
+		}
+		if spilled {
+			return
+		}
+		atomic.AddInt64(&mset.inb, sz)
+	}
 	// Copy these.
 	if len(hdr) > 0 {
 		hdr = copyBytes(hdr)
@@ -3491,6 +4320,360 @@ func (mset *stream) queueInboundMsg(subj, rply string, hdr, msg []byte) {
 	mset.queueInbound(mset.msgs, subj, rply, hdr, msg)
 }
 
+// Size we account for an inbound message on our intake.
+func inMsgSize(subj, rply string, hdr, msg []byte) int64 {
+	return int64(len(subj) + len(rply) + len(hdr) + len(msg))
+}
+
+// Maximum number of bytes we will hold in memory for inbound messages
+// queued for a file based stream before spilling them to disk.
+var streamIntakeMaxBytes = int64(64 * 1024 * 1024)
+
+const (
+	// Where we persist the upstream positions of a stream's sources.
+	sourceCursorsFile = "sources.json"
+	// How long we batch up source cursor changes before writing them out.
+	sourceCursorsFlushInterval = 2 * time.Second
+)
+
+// sourceCursors tracks the last upstream sequence stored for each source of a
+// stream, keyed by the source's index name. Unlike scanning our messages for the
+// source header on recovery, these survive purges, limits and retention removing
+// the sourced messages. For memory based streams nothing is written to disk.
+type sourceCursors struct {
+	mu     sync.Mutex
+	fn     string
+	seqs   map[string]uint64
+	tmr    *time.Timer
+	dirty  bool
+	closed bool
+}
+
+func newSourceCursors(fn string) *sourceCursors {
+	sc := &sourceCursors{fn: fn, seqs: make(map[string]uint64)}
+	if fn == _EMPTY_ {
+		return sc
+	}
+	if b, err := os.ReadFile(fn); err == nil {
+		// A corrupt file just means we fall back to scanning our messages.
+		if err := json.Unmarshal(b, &sc.seqs); err != nil || sc.seqs == nil {
+			sc.seqs = make(map[string]uint64)
+		}
+	}
+	return sc
+}
+
+// Returns the last upstream sequence we stored for the given source.
+func (sc *sourceCursors) get(iname string) uint64 {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.seqs[iname]
+}
+
+// record will move the cursor for the given source forward.
+func (sc *sourceCursors) record(iname string, seq uint64) {
+	if iname == _EMPTY_ || seq == 0 {
+		return
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if seq <= sc.seqs[iname] {
+		return
+	}
+	sc.seqs[iname] = seq
+	sc.markDirty()
+}
+
+func (sc *sourceCursors) remove(iname string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if _, ok := sc.seqs[iname]; ok {
+		delete(sc.seqs, iname)
+		sc.markDirty()
+	}
+}
+
+// Lock should be held.
+func (sc *sourceCursors) markDirty() {
+	if sc.fn == _EMPTY_ || sc.closed || sc.dirty {
+		return
+	}
+	sc.dirty = true
+	if sc.tmr == nil {
+		sc.tmr = time.AfterFunc(sourceCursorsFlushInterval, sc.flush)
+	} else {
+		sc.tmr.Reset(sourceCursorsFlushInterval)
+	}
+}
+
+func (sc *sourceCursors) flush() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.flushLocked()
+}
+
+// Lock should be held.
+func (sc *sourceCursors) flushLocked() error {
+	if !sc.dirty || sc.fn == _EMPTY_ {
+		return nil
+	}
+	b, err := json.Marshal(sc.seqs)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(sc.fn, b); err != nil {
+		return err
+	}
+	sc.dirty = false
+	return nil
+}
+
+// close stops any pending write, optionally writing out our state first.
+func (sc *sourceCursors) close(flush bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.tmr != nil {
+		sc.tmr.Stop()
+		sc.tmr = nil
+	}
+	if flush {
+		sc.flushLocked()
+	}
+	sc.closed = true
+}
+
+const (
+	// Where we spill our intake for a stream.
+	intakeSpoolFile = "intake.spl"
+	// Record header, lengths for subject, reply, header and msg.
+	intakeRecHdrSize = 16
+	// Maximum we will read back from the spool at one time.
+	intakeReadBatch = 256
+)
+
+// intakeSpool holds inbound messages on disk once the in memory intake for
+// a stream is over its limit. Once we start spilling all new messages go to
+// the spool until it has been fully drained to preserve ordering. If writing
+// to the spool fails, new messages are rejected until it has been drained.
+// File I/O is done outside of mu, writers are serialized by wmu and there is
+// a single reader, the stream's internal loop.
+type intakeSpool struct {
+	mu      sync.Mutex
+	wmu     sync.Mutex
+	fn      string
+	fd      *os.File
+	woff    int64
+	roff    int64
+	writing bool
+	err     error
+	ch      chan struct{}
+	smsgs   uint64
+	sbytes  uint64
+}
+
+func newIntakeSpool(fn string) *intakeSpool {
+	// Anything left over from a previous run was never acknowledged.
+	os.Remove(fn)
+	return &intakeSpool{fn: fn, ch: make(chan struct{}, 1)}
+}
+
+// Returns true if we are actively spilling.
+// Lock should be held.
+func (sp *intakeSpool) active() bool {
+	return sp.fd != nil
+}
+
+// spill will write the message to the spool if we are already spilling or force is set.
+// Returns true if the message is now on the spool. An error is returned if the
+// message could not be spilled while others are still waiting on disk.
+func (sp *intakeSpool) spill(force bool, subj, rply string, hdr, msg []byte) (bool, error) {
+	sp.wmu.Lock()
+	defer sp.wmu.Unlock()
+
+	sp.mu.Lock()
+	if sp.err != nil {
+		err := sp.err
+		sp.mu.Unlock()
+		return false, err
+	}
+	if !sp.active() {
+		if !force {
+			sp.mu.Unlock()
+			return false, nil
+		}
+		fd, err := os.OpenFile(sp.fn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, defaultFilePerms)
+		if err != nil {
+			sp.mu.Unlock()
+			return false, nil
+		}
+		sp.fd, sp.woff, sp.roff = fd, 0, 0
+	}
+	fd, off := sp.fd, sp.woff
+	sp.writing = true
+	sp.mu.Unlock()
+
+	var le = binary.LittleEndian
+	buf := make([]byte, intakeRecHdrSize, intakeRecHdrSize+len(subj)+len(rply)+len(hdr)+len(msg))
+	le.PutUint32(buf[0:], uint32(len(subj)))
+	le.PutUint32(buf[4:], uint32(len(rply)))
+	le.PutUint32(buf[8:], uint32(len(hdr)))
+	le.PutUint32(buf[12:], uint32(len(msg)))
+	buf = append(buf, subj...)
+	buf = append(buf, rply...)
+	buf = append(buf, hdr...)
+	buf = append(buf, msg...)
+
+	n, err := fd.WriteAt(buf, off)
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	sp.writing = false
+	if err != nil {
+		// If nothing is pending on disk we can stop spilling and fallback to memory.
+		if sp.roff == sp.woff {
+			sp.resetLocked()
+			return false, nil
+		}
+		// Otherwise stop taking in messages until what is on disk is processed.
+		sp.err = fmt.Errorf("intake spool write failed: %v", err)
+		return false, sp.err
+	}
+	sp.woff += int64(n)
+	sp.smsgs++
+	sp.sbytes += uint64(len(buf) - intakeRecHdrSize)
+	kickFlusher(sp.ch)
+	return true, nil
+}
+
+// read will return the next batch of messages from the spool.
+// Once drained the spool is removed and we go back to in memory intake.
+// If the spool can not be read, what is left on disk is dropped and an error
+// is returned along with the messages read so far.
+func (sp *intakeSpool) read() ([]*inMsg, error) {
+	sp.mu.Lock()
+	if !sp.active() {
+		sp.mu.Unlock()
+		return nil, nil
+	}
+	fd, roff, woff := sp.fd, sp.roff, sp.woff
+	sp.mu.Unlock()
+
+	var le = binary.LittleEndian
+	var hdr [intakeRecHdrSize]byte
+	var ims []*inMsg
+	var rerr error
+
+	for len(ims) < intakeReadBatch && roff < woff {
+		if _, rerr = fd.ReadAt(hdr[:], roff); rerr != nil {
+			break
+		}
+		sl, rl := int(le.Uint32(hdr[0:])), int(le.Uint32(hdr[4:]))
+		hl, ml := int(le.Uint32(hdr[8:])), int(le.Uint32(hdr[12:]))
+		buf := make([]byte, sl+rl+hl+ml)
+		if _, rerr = fd.ReadAt(buf, roff+intakeRecHdrSize); rerr != nil {
+			break
+		}
+		roff += int64(intakeRecHdrSize + len(buf))
+
+		im := &inMsg{subj: string(buf[:sl]), rply: string(buf[sl : sl+rl])}
+		if hl > 0 {
+			im.hdr = buf[sl+rl : sl+rl+hl]
+		}
+		if ml > 0 {
+			im.msg = buf[sl+rl+hl:]
+		}
+		ims = append(ims, im)
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	// We may have been closed while reading.
+	if sp.fd != fd {
+		return ims, nil
+	}
+	sp.roff = roff
+	if rerr != nil {
+		// Retrying would fail the same way, so drop what is left and go back to in memory intake.
+		lost := sp.woff - sp.roff
+		sp.resetLocked()
+		sp.err = nil
+		return ims, fmt.Errorf("intake spool read failed, dropped %d bytes: %v", lost, rerr)
+	}
+	if sp.roff >= sp.woff && !sp.writing {
+		// Drained, we can take in messages again.
+		sp.resetLocked()
+		sp.err = nil
+	} else {
+		// More to process.
+		kickFlusher(sp.ch)
+	}
+	return ims, nil
+}
+
+// Number of bytes currently on disk waiting to be processed.
+func (sp *intakeSpool) pending() uint64 {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return uint64(sp.woff - sp.roff)
+}
+
+// Will close and remove the spool file.
+// Lock should be held.
+func (sp *intakeSpool) resetLocked() {
+	if sp.fd != nil {
+		sp.fd.Close()
+		sp.fd = nil
+	}
+	sp.woff, sp.roff = 0, 0
+	os.Remove(sp.fn)
+}
+
+func (sp *intakeSpool) close() {
+	sp.mu.Lock()
+	sp.resetLocked()
+	sp.mu.Unlock()
+}
+
+// intakeFailed will mark the stream as failed after messages were lost from
+// the intake spool. This is reported by healthz.
+func (mset *stream) intakeFailed(err error) {
+	mset.mu.Lock()
+	mset.failed = err
+	s, accName, name := mset.srv, mset.acc.Name, mset.cfg.Name
+	mset.mu.Unlock()
+
+	s.Errorf("JetStream stream '%s > %s' failed: %v", accName, name, err)
+	s.sendWebhookEvent(WebhookJetStreamStorageFault, &WebhookEvent{Account: accName, Stream: name, Reason: err.Error()})
+}
+
+// Returns the error the stream failed with, if any.
+func (mset *stream) failure() error {
+	mset.mu.RLock()
+	defer mset.mu.RUnlock()
+	return mset.failed
+}
+
+// intakeInfo returns information about our intake if we have spilled to disk.
+func (mset *stream) intakeInfo() *StreamIntakeInfo {
+	sp := mset.spool
+	if sp == nil {
+		return nil
+	}
+	pending := sp.pending()
+	sp.mu.Lock()
+	smsgs, sbytes := sp.smsgs, sp.sbytes
+	sp.mu.Unlock()
+	if smsgs == 0 {
+		return nil
+	}
+	return &StreamIntakeInfo{
+		PendingBytes: uint64(atomic.LoadInt64(&mset.inb)),
+		SpooledBytes: pending,
+		SpilledMsgs:  smsgs,
+		SpilledBytes: sbytes,
+	}
+}
+
 // processDirectGetRequest handles direct get request for stream messages.
 func (mset *stream) processDirectGetRequest(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	_, msg := c.msgParts(rmsg)
@@ -3510,20 +4693,21 @@ func (mset *stream) processDirectGetRequest(_ *subscription, c *client, _ *Accou
 		return
 	}
 	// Check if nothing set.
-	if req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ {
+	if req.Seq == 0 && req.LastFor == _EMPTY_ && req.NextFor == _EMPTY_ && req.StartTime == nil && req.Batch == 0 {
 		hdr := []byte("NATS/1.0 408 Empty Request\r\n\r\n")
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 		return
 	}
-	// Check that we do not have both options set.
-	if req.Seq > 0 && req.LastFor != _EMPTY_ {
+	// Check that we do not have conflicting options set.
+	if !req.isValid() {
 		hdr := []byte("NATS/1.0 408 Bad Request\r\n\r\n")
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 		return
 	}
-	if req.LastFor != _EMPTY_ && req.NextFor != _EMPTY_ {
-		hdr := []byte("NATS/1.0 408 Bad Request\r\n\r\n")
-		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+
+	// Batches are handed to a single Go routine per stream so they never hold up the readloop.
+	if req.Batch > 0 {
+		mset.queueDirectBatch(&req, reply)
 		return
 	}
 
@@ -3594,46 +4778,190 @@ func (mset *stream) processDirectGetLastBySubjectRequest(_ *subscription, c *cli
 // This could be called in a Go routine if we are inline for a non-client connection.
 func (mset *stream) getDirectRequest(req *JSApiMsgGetRequest, reply string) {
 	var svp StoreMsg
-	var sm *StoreMsg
-	var err error
 
 	mset.mu.RLock()
 	store, name := mset.store, mset.cfg.Name
 	mset.mu.RUnlock()
 
-	if req.Seq > 0 && req.NextFor == _EMPTY_ {
-		sm, err = store.LoadMsg(req.Seq, &svp)
-	} else if req.NextFor != _EMPTY_ {
-		sm, _, err = store.LoadNextMsg(req.NextFor, subjectHasWildcard(req.NextFor), req.Seq, &svp)
-	} else {
-		sm, err = store.LoadLastMsg(req.LastFor, &svp)
-	}
+	sm, err := loadMsgForGet(store, req, &svp)
 	if err != nil {
 		hdr := []byte("NATS/1.0 404 Message Not Found\r\n\r\n")
 		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
 		return
 	}
+	mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, directGetHdr(name, sm), sm.msg, nil, 0))
+}
+
+// A batched direct get request waiting to be processed.
+type directGetReq struct {
+	req   *JSApiMsgGetRequest
+	reply string
+}
+
+const (
+	// Most messages in a batch when the server has no pull request batch limit.
+	directGetMaxBatch = 1000
+	// Most message bytes sent for a single batch.
+	directGetMaxBytes = 8 * 1024 * 1024
+	// Most batches we will hold per stream before turning requests away.
+	directGetMaxPending = 1024
+)
+
+// Queues a batched direct get, starting the Go routine that processes them if needed.
+func (mset *stream) queueDirectBatch(req *JSApiMsgGetRequest, reply string) {
+	mset.mu.Lock()
+	q, qch := mset.dgq, mset.qch
+	if q == nil && qch != nil {
+		q = mset.srv.newIPQueue(fmt.Sprintf("[ACC:%s] stream '%s' direct gets", mset.acc.Name, mset.cfg.Name)) // of *directGetReq
+		if !mset.srv.startGoRoutine(func() { mset.processDirectBatches(q, qch) }) {
+			q.unregister()
+			q = nil
+		}
+		mset.dgq = q
+	}
+	mset.mu.Unlock()
+
+	if q == nil {
+		return
+	}
+	if q.len() >= directGetMaxPending {
+		hdr := []byte("NATS/1.0 429 Too Many Requests\r\n\r\n")
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+		return
+	}
+	q.push(&directGetReq{req, reply})
+}
+
+// Processes batched direct gets until the stream is stopped.
+func (mset *stream) processDirectBatches(q *ipQueue, qch chan struct{}) {
+	s := mset.srv
+	defer s.grWG.Done()
+	defer q.unregister()
+
+	// Lets readers paging through the stream avoid a full count of pending messages for each batch.
+	var dbc directBatchCursor
+	for {
+		select {
+		case <-s.quitCh:
+			return
+		case <-qch:
+			return
+		case <-q.ch:
+			reqs := q.pop()
+			for _, r := range reqs {
+				dr := r.(*directGetReq)
+				mset.getDirectBatch(dr.req, dr.reply, &dbc)
+			}
+			q.recycle(&reqs)
+		}
+	}
+}
+
+// directBatchCursor remembers where the last batch ended and how many matching
+// messages were pending then. A batch starting there only needs to count the
+// messages that have been stored since, as long as nothing has been removed.
+type directBatchCursor struct {
+	filter  string
+	next    uint64
+	last    uint64
+	msgs    uint64
+	pending uint64
+}
+
+// Returns the number of messages matching filter at or after seq.
+func (dbc *directBatchCursor) numPending(store StreamStore, state *StreamState, seq uint64, filter string) uint64 {
+	if dbc.next > 0 && seq == dbc.next && filter == dbc.filter && state.LastSeq >= dbc.last &&
+		state.Msgs-dbc.msgs == state.LastSeq-dbc.last {
+		return dbc.pending + store.FilteredState(dbc.last+1, filter).Msgs
+	}
+	return store.FilteredState(seq, filter).Msgs
+}
+
+// Sends up to the requested batch of messages, followed by an end of batch
+// status with the last sequence sent and how many matching messages are left.
+// Batches are limited to the pull request batch limit and max bytes.
+func (mset *stream) getDirectBatch(req *JSApiMsgGetRequest, reply string, dbc *directBatchCursor) {
+	mset.mu.RLock()
+	store, name := mset.store, mset.cfg.Name
+	mset.mu.RUnlock()
+
+	batch, maxBytes := req.Batch, req.MaxBytes
+	maxBatch := mset.srv.getOpts().JetStreamLimits.MaxRequestBatch
+	if maxBatch <= 0 {
+		maxBatch = directGetMaxBatch
+	}
+	if batch > maxBatch {
+		batch = maxBatch
+	}
+	if maxBytes <= 0 || maxBytes > directGetMaxBytes {
+		maxBytes = directGetMaxBytes
+	}
+
+	seq := req.Seq
+	if req.StartTime != nil {
+		if seq = store.GetSeqFromTime(*req.StartTime); seq == 0 {
+			seq = math.MaxUint64
+		}
+	}
+	filter, wc := req.NextFor, subjectHasWildcard(req.NextFor)
+	var state StreamState
+	store.FastState(&state)
+	pending := dbc.numPending(store, &state, seq, filter)
+
+	var svp StoreMsg
+	var sent, bytes int
+	var lseq uint64
+	for sent < batch {
+		sm, _, err := store.LoadNextMsg(filter, wc, seq, &svp)
+		if err != nil {
+			break
+		}
+		// Always send at least one message.
+		sz := len(sm.hdr) + len(sm.msg)
+		if sent > 0 && bytes+sz > maxBytes {
+			break
+		}
+		bytes += sz
+		if pending > 0 {
+			pending--
+		}
+		hdr := genHeader(directGetHdr(name, sm), JSNumPending, strconv.FormatUint(pending, 10))
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, copyBytes(sm.msg), nil, 0))
+		sent++
+		lseq, seq = sm.seq, sm.seq+1
+	}
+	if sent == 0 {
+		hdr := []byte("NATS/1.0 404 Message Not Found\r\n\r\n")
+		mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, nil, nil, 0))
+		return
+	}
+	*dbc = directBatchCursor{filter, lseq + 1, state.LastSeq, state.Msgs, pending}
 
+	const eobt = "NATS/1.0 204 EOB\r\nNats-Last-Sequence: %d\r\nNats-Num-Pending: %d\r\n\r\n"
+	mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, []byte(fmt.Sprintf(eobt, lseq, pending)), nil, nil, 0))
+}
+
+// Returns the headers for a message returned by a direct get.
+func directGetHdr(name string, sm *StoreMsg) []byte {
 	hdr := sm.hdr
 	ts := time.Unix(0, sm.ts).UTC()
 
 	if len(hdr) == 0 {
 		const ht = "NATS/1.0\r\nNats-Stream: %s\r\nNats-Subject: %s\r\nNats-Sequence: %d\r\nNats-Time-Stamp: %s\r\n\r\n"
-		hdr = []byte(fmt.Sprintf(ht, name, sm.subj, sm.seq, ts.Format(time.RFC3339Nano)))
-	} else {
-		hdr = copyBytes(hdr)
-		hdr = genHeader(hdr, JSStream, name)
-		hdr = genHeader(hdr, JSSubject, sm.subj)
-		hdr = genHeader(hdr, JSSequence, strconv.FormatUint(sm.seq, 10))
-		hdr = genHeader(hdr, JSTimeStamp, ts.Format(time.RFC3339Nano))
+		return []byte(fmt.Sprintf(ht, name, sm.subj, sm.seq, ts.Format(time.RFC3339Nano)))
 	}
-	mset.outq.send(newJSPubMsg(reply, _EMPTY_, _EMPTY_, hdr, sm.msg, nil, 0))
+	hdr = copyBytes(hdr)
+	hdr = genHeader(hdr, JSStream, name)
+	hdr = genHeader(hdr, JSSubject, sm.subj)
+	hdr = genHeader(hdr, JSSequence, strconv.FormatUint(sm.seq, 10))
+	return genHeader(hdr, JSTimeStamp, ts.Format(time.RFC3339Nano))
 }
 
 // processInboundJetStreamMsg handles processing messages bound for a stream.
 func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, _ *Account, subject, reply string, rmsg []byte) {
 	mset.mu.RLock()
 	isLeader, isClustered, isSealed := mset.isLeader(), mset.isClustered(), mset.cfg.Sealed
+	stampOrigin, itr := mset.cfg.StampOrigin, mset.itr
 	mset.mu.RUnlock()
 
 	// If we are not the leader just ignore.
@@ -3651,8 +4979,39 @@ func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, _ *Ac
 		return
 	}
 
+	// Rewrite the subject we will store the message under if configured.
+	// Subjects not matching the transform source are stored as is.
+	if itr != nil {
+		tsubj, err := itr.Match(subject)
+		if err == nil {
+			subject = tsubj
+		} else if err != ErrNoTransforms {
+			if reply != _EMPTY_ {
+				var resp = JSPubAckResponse{
+					PubAck: &PubAck{Stream: mset.name()},
+					Error:  NewJSStreamStoreFailedError(fmt.Errorf("subject transform failed: %v", err)),
+				}
+				b, _ := json.Marshal(resp)
+				mset.outq.sendMsg(reply, b)
+			}
+			return
+		}
+	}
+
 	hdr, msg := c.msgParts(rmsg)
 
+	// Do this before queueing since we need the connection the message arrived on.
+	if stampOrigin {
+		hdr = mset.stampOrigin(c, hdr)
+	}
+
+	// Let any configured interceptors inspect, annotate or reject the message.
+	// This is done off of the connection's Go routine.
+	if mis := mset.srv.msgInterceptors; mis != nil {
+		mis.queue(mset, subject, reply, hdr, msg)
+		return
+	}
+
 	// If we are not receiving directly from a client we should move this to another Go routine.
 	if c.kind != CLIENT {
 		mset.queueInboundMsg(subject, reply, hdr, msg)
@@ -3667,9 +5026,64 @@ func (mset *stream) processInboundJetStreamMsg(_ *subscription, c *client, _ *Ac
 	}
 }
 
+// stampOrigin returns the headers with the origin of the message set. When the message
+// reached us through a service import or from another server we use the attached client
+// info, otherwise the connection it arrived on. For routed messages without client info
+// we only know the account and the server the client is connected to.
+func (mset *stream) stampOrigin(c *client, hdr []byte) []byte {
+	var ci *ClientInfo
+	if len(hdr) > 0 {
+		// Client info is only set by servers, so when it comes straight from a client
+		// or leafnode connection it could be anything.
+		trusted := len(c.pa.psi) > 0 || (c.kind != CLIENT && c.kind != LEAF)
+		// This copies so the inbound buffer is not modified.
+		if trusted {
+			hdr = stripHeaders(hdr, JSOriginAccount, JSOriginClientId, JSOriginClientName, JSOriginServer)
+		} else {
+			hdr = stripHeaders(hdr, JSOriginAccount, JSOriginClientId, JSOriginClientName, JSOriginServer, ClientInfoHdr)
+		}
+		if cis := getHeader(ClientInfoHdr, hdr); len(cis) > 0 {
+			var rci ClientInfo
+			if err := json.Unmarshal(cis, &rci); err == nil {
+				ci = &rci
+			}
+		}
+	}
+	if ci == nil {
+		switch c.kind {
+		case CLIENT, LEAF:
+			ci = c.getClientInfo(true)
+		default:
+			ci = &ClientInfo{Account: mset.accName(), Server: mset.srv.Name()}
+			if c.kind == ROUTER {
+				c.mu.Lock()
+				if c.route != nil {
+					ci.Server = c.route.remoteName
+				}
+				c.mu.Unlock()
+			}
+		}
+	}
+	if ci.Account == _EMPTY_ {
+		ci.Account = mset.accName()
+	}
+	hdr = genHeader(hdr, JSOriginAccount, ci.Account)
+	if ci.ID > 0 {
+		hdr = genHeader(hdr, JSOriginClientId, strconv.FormatUint(ci.ID, 10))
+	}
+	if ci.Name != _EMPTY_ {
+		hdr = genHeader(hdr, JSOriginClientName, ci.Name)
+	}
+	if ci.Server != _EMPTY_ {
+		hdr = genHeader(hdr, JSOriginServer, ci.Server)
+	}
+	return hdr
+}
+
 var (
-	errLastSeqMismatch = errors.New("last sequence mismatch")
-	errMsgIdDuplicate  = errors.New("msgid is duplicate")
+	errLastSeqMismatch     = errors.New("last sequence mismatch")
+	errMaintenanceFileOnly = errors.New("stream maintenance requires file storage")
+	errMsgIdDuplicate      = errors.New("msgid is duplicate")
 )
 
 // processJetStreamMsg is where we try to actually process the stream msg.
@@ -3743,6 +5157,7 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 	// Process additional msg headers if still present.
 	var msgId string
 	var rollupSub, rollupAll bool
+	var exp *StoreExpect
 
 	if len(hdr) > 0 {
 		outq := mset.outq
@@ -3779,8 +5194,10 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		}
 		// Expected last sequence per subject.
 		// If we are clustered we have prechecked seq > 0.
-		if seq, exists := getExpectedLastSeqPerSubject(hdr); exists && (!isClustered || seq == 0) {
-			// TODO(dlc) - We could make a new store func that does this all in one.
+		if seq, exists := getExpectedLastSeqPerSubject(hdr); exists && lseq == 0 && ts == 0 {
+			// Not clustered, let the store check this atomically with the write below.
+			exp = &StoreExpect{LastSubjSeq: &seq}
+		} else if exists && (!isClustered || seq == 0) {
 			var smv StoreMsg
 			var fseq uint64
 			sm, err := store.LoadLastMsg(subject, &smv)
@@ -3857,6 +5274,37 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 				return fmt.Errorf("rollup value invalid: %q", rollup)
 			}
 		}
+		// Check for tombstones. Mirrors always honor them to stay in sync with their origin.
+		if tombstone := getTombstone(hdr); tombstone != _EMPTY_ {
+			switch tombstone {
+			case JSMsgTombstoneDelete:
+			case JSMsgTombstonePurge:
+				if (!mset.cfg.AllowRollup || mset.cfg.DenyPurge) && mset.cfg.Mirror == nil {
+					mset.clfs++
+					mset.mu.Unlock()
+					if canRespond {
+						resp.PubAck = &PubAck{Stream: name}
+						resp.Error = NewJSStreamRollupFailedError(errors.New("purge tombstone not permitted"))
+						b, _ := json.Marshal(resp)
+						outq.sendMsg(reply, b)
+					}
+					return errors.New("purge tombstone not permitted")
+				}
+				rollupSub = true
+			default:
+				err := fmt.Errorf("tombstone value invalid: %q", tombstone)
+				mset.clfs++
+				mset.mu.Unlock()
+				if canRespond {
+					resp.PubAck = &PubAck{Stream: name}
+					resp.Error = NewJSStreamGeneralError(err, Unless(err))
+					b, _ := json.Marshal(resp)
+					outq.sendMsg(reply, b)
+				}
+				return err
+			}
+			hdr, msg = compactTombstone(tombstone, hdr), nil
+		}
 	}
 
 	// Response Ack.
@@ -3929,9 +5377,11 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		}
 	}
 
-	// Grab timestamp if not already set.
+	// Grab timestamp if not already set, otherwise make sure our clock is caught up.
 	if ts == 0 && lseq > 0 {
-		ts = time.Now().UnixNano()
+		ts = mset.hlc.now()
+	} else if ts > 0 {
+		mset.hlc.observe(ts)
 	}
 
 	// Skip msg here.
@@ -3981,7 +5431,8 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 
 	// Store actual msg.
 	if lseq == 0 && ts == 0 {
-		seq, ts, err = store.StoreMsg(subject, hdr, msg)
+		seq, ts, err = store.StoreMsgWithExpect(subject, hdr, msg, exp)
+		mset.hlc.observe(ts)
 	} else {
 		// Make sure to take into account any message assignments that we had to skip (clfs).
 		seq = lseq + 1 - clfs
@@ -3998,11 +5449,34 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		mset.mu.Unlock()
 
 		switch err {
+		case ErrStoreWrongLastSubjectSequence:
+			var smv StoreMsg
+			var fseq uint64
+			if sm, _ := store.LoadLastMsg(subject, &smv); sm != nil {
+				fseq = sm.seq
+			}
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = NewJSStreamWrongLastSequenceError(fseq)
+				response, _ = json.Marshal(resp)
+				mset.outq.sendMsg(reply, response)
+			}
+			return fmt.Errorf("last sequence by subject mismatch: %d vs %d", *exp.LastSubjSeq, fseq)
 		case ErrMaxMsgs, ErrMaxBytes, ErrMaxMsgsPerSubject, ErrMsgTooLarge:
 			s.Debugf("JetStream failed to store a msg on stream '%s > %s': %v", accName, name, err)
+		case ErrStorageQuotaExceeded:
+			s.RateLimitWarnf("JetStream resource limits exceeded for account: %q", accName)
+			if canRespond {
+				resp.PubAck = &PubAck{Stream: name}
+				resp.Error = NewJSAccountResourcesExceededError()
+				response, _ = json.Marshal(resp)
+				mset.outq.sendMsg(reply, response)
+			}
+			return nil
 		case ErrStoreClosed:
 		default:
 			s.Errorf("JetStream failed to store a msg on stream '%s > %s': %v", accName, name, err)
+			s.sendWebhookEvent(WebhookJetStreamStorageFault, &WebhookEvent{Account: accName, Stream: name, Reason: err.Error()})
 		}
 
 		if canRespond {
@@ -4041,33 +5515,47 @@ func (mset *stream) processJetStreamMsg(subject, reply string, hdr, msg []byte,
 		mset.storeMsgIdLocked(&ddentry{msgId, seq, ts})
 	}
 
+	// Remember the upstream position for sourced messages. This runs on all
+	// replicas so any of them can resume the sources when becoming leader.
+	if len(mset.cfg.Sources) > 0 && len(hdr) > 0 && mset.scur != nil {
+		if ss := getHeader(JSStreamSource, hdr); len(ss) > 0 {
+			mset.scur.record(streamAndSeq(string(ss)))
+		}
+	}
+
 	// If here we succeeded in storing the message.
 	mset.mu.Unlock()
 
 	// No errors, this is the normal path.
-	if rollupSub {
-		mset.purge(&JSApiStreamPurgeRequest{Subject: subject, Keep: 1})
-	} else if rollupAll {
-		mset.purge(&JSApiStreamPurgeRequest{Keep: 1})
+	// Purge everything before the rollup message itself, since we have released the lock and
+	// newer messages may have been stored already.
+	if seq > 1 {
+		if rollupSub {
+			mset.purge(&JSApiStreamPurgeRequest{Subject: subject, Sequence: seq})
+		} else if rollupAll {
+			mset.purge(&JSApiStreamPurgeRequest{Sequence: seq})
+		}
 	}
 
 	// Check for republish.
 	if republish {
 		var rpMsg []byte
+		tss := time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
 		if len(hdr) == 0 {
-			const ht = "NATS/1.0\r\nNats-Stream: %s\r\nNats-Subject: %s\r\nNats-Sequence: %d\r\nNats-Last-Sequence: %d\r\n\r\n"
-			const htho = "NATS/1.0\r\nNats-Stream: %s\r\nNats-Subject: %s\r\nNats-Sequence: %d\r\nNats-Last-Sequence: %d\r\nNats-Msg-Size: %d\r\n\r\n"
+			const ht = "NATS/1.0\r\nNats-Stream: %s\r\nNats-Subject: %s\r\nNats-Sequence: %d\r\nNats-Time-Stamp: %s\r\nNats-Last-Sequence: %d\r\n\r\n"
+			const htho = "NATS/1.0\r\nNats-Stream: %s\r\nNats-Subject: %s\r\nNats-Sequence: %d\r\nNats-Time-Stamp: %s\r\nNats-Last-Sequence: %d\r\nNats-Msg-Size: %d\r\n\r\n"
 			if !thdrsOnly {
-				hdr = []byte(fmt.Sprintf(ht, name, subject, seq, tlseq))
+				hdr = []byte(fmt.Sprintf(ht, name, subject, seq, tss, tlseq))
 				rpMsg = copyBytes(msg)
 			} else {
-				hdr = []byte(fmt.Sprintf(htho, name, subject, seq, tlseq, len(msg)))
+				hdr = []byte(fmt.Sprintf(htho, name, subject, seq, tss, tlseq, len(msg)))
 			}
 		} else {
 			// Slow path.
 			hdr = genHeader(hdr, JSStream, name)
 			hdr = genHeader(hdr, JSSubject, subject)
 			hdr = genHeader(hdr, JSSequence, strconv.FormatUint(seq, 10))
+			hdr = genHeader(hdr, JSTimeStamp, tss)
 			hdr = genHeader(hdr, JSLastSequence, strconv.FormatUint(tlseq, 10))
 			if !thdrsOnly {
 				rpMsg = copyBytes(msg)
@@ -4267,6 +5755,115 @@ type StoredMsg struct {
 	Time     time.Time `json:"time"`
 }
 
+// mergeIter walks the messages of a single stream for mergeStreamMsgs.
+type mergeIter struct {
+	mset *stream
+	name string
+	pos  int
+	sm   *StoreMsg
+	svp  StoreMsg
+	next uint64
+}
+
+// mergeHeap orders stream iterators by the timestamp of their current message.
+// Ties are broken by the order the streams were requested in.
+type mergeHeap []*mergeIter
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if h[i].sm.ts != h[j].sm.ts {
+		return h[i].sm.ts < h[j].sm.ts
+	}
+	return h[i].pos < h[j].pos
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(*mergeIter)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	n := len(old)
+	it := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return it
+}
+
+// Loads the next message for the iterator, returns false when there are no more.
+func (it *mergeIter) load(filter string, wc bool) bool {
+	sm, seq, err := it.mset.store.LoadNextMsg(filter, wc, it.next, &it.svp)
+	if err != nil || sm == nil {
+		it.sm = nil
+		// On EOF we are handed the last sequence of the stream.
+		if seq >= it.next {
+			it.next = seq + 1
+		}
+		return false
+	}
+	it.sm, it.next = sm, sm.seq+1
+	return true
+}
+
+// mergeStreamMsgs does a k-way merge of the messages in msets ordered by timestamp.
+// Each stream resumes at its sequence in start, or at the first message at or
+// after startTime when it has none. Returns up to batch messages, and no more than
+// maxBytes unless a single message is bigger, and the sequence each stream should
+// resume from.
+func mergeStreamMsgs(msets []*stream, filter string, startTime time.Time, start map[string]uint64, batch, maxBytes int) ([]*JSApiMergedMsg, map[string]uint64) {
+	wc := subjectHasWildcard(filter)
+	iters := make([]*mergeIter, 0, len(msets))
+	h := make(mergeHeap, 0, len(msets))
+	for i, mset := range msets {
+		it := &mergeIter{mset: mset, name: mset.name(), pos: i}
+		if seq, ok := start[it.name]; ok {
+			it.next = seq
+		} else if !startTime.IsZero() {
+			it.next = mset.store.GetSeqFromTime(startTime)
+		}
+		iters = append(iters, it)
+		if it.load(filter, wc) {
+			h = append(h, it)
+		}
+	}
+	heap.Init(&h)
+
+	var msgs []*JSApiMergedMsg
+	var total int
+	for len(h) > 0 && len(msgs) < batch {
+		it := h[0]
+		sm := it.sm
+		// Always return at least one message so a reader can make progress.
+		sz := len(sm.subj) + len(sm.hdr) + len(sm.msg)
+		if total += sz; len(msgs) > 0 && total > maxBytes {
+			break
+		}
+		msgs = append(msgs, &JSApiMergedMsg{
+			Stream: it.name,
+			Message: &StoredMsg{
+				Subject:  sm.subj,
+				Sequence: sm.seq,
+				Header:   copyBytes(sm.hdr),
+				Data:     copyBytes(sm.msg),
+				Time:     time.Unix(0, sm.ts).UTC(),
+			},
+		})
+		if it.load(filter, wc) {
+			heap.Fix(&h, 0)
+		} else {
+			heap.Pop(&h)
+		}
+	}
+
+	// Streams with a pending message resume from it.
+	next := make(map[string]uint64, len(iters))
+	for _, it := range iters {
+		if it.sm != nil {
+			next[it.name] = it.sm.seq
+		} else {
+			next[it.name] = it.next
+		}
+	}
+	return msgs, next
+}
+
 // This is similar to system semantics but did not want to overload the single system sendq,
 // or require system account when doing simple setup with jetstream.
 func (mset *stream) setupSendCapabilities() {
@@ -4323,6 +5920,35 @@ func (mset *stream) internalLoop() {
 	// This should be rarely used now so can be smaller.
 	var _r [1024]byte
 
+	// For intake spilled to disk.
+	var spch chan struct{}
+	if mset.spool != nil {
+		spch = mset.spool.ch
+	}
+
+	processInboundMsg := func(isClustered bool, im *inMsg) {
+		// If we are clustered we need to propose this message to the underlying raft group.
+		if isClustered {
+			mset.processClusteredInboundMsg(im.subj, im.rply, im.hdr, im.msg)
+		} else {
+			mset.processJetStreamMsg(im.subj, im.rply, im.hdr, im.msg, 0, 0)
+		}
+	}
+
+	processInbound := func() {
+		// This can possibly change now so needs to be checked here.
+		isClustered := mset.IsClustered()
+		ims := msgs.pop()
+		for _, imi := range ims {
+			im := imi.(*inMsg)
+			processInboundMsg(isClustered, im)
+			if spch != nil {
+				atomic.AddInt64(&mset.inb, -inMsgSize(im.subj, im.rply, im.hdr, im.msg))
+			}
+		}
+		msgs.recycle(&ims)
+	}
+
 	for {
 		select {
 		case <-outq.ch:
@@ -4363,6 +5989,7 @@ func (mset *stream) internalLoop() {
 
 				msg = append(msg, _CRLF_...)
 
+				c.in.qcid = 0
 				didDeliver, _ := c.processInboundClientMsg(msg)
 				c.pa.szb, c.pa.subject, c.pa.deliver = nil, nil, nil
 
@@ -4370,6 +5997,9 @@ func (mset *stream) internalLoop() {
 				// we failed to deliver the message. If so alert the consumer.
 				if pm.o != nil && pm.seq > 0 && !didDeliver {
 					pm.o.didNotDeliver(pm.seq)
+				} else if pm.o != nil && pm.seq > 0 && c.in.qcid > 0 {
+					// Delivered to a local queue member, remember who has it.
+					pm.o.trackQueueDelivery(pm.seq, c.in.qcid)
 				}
 				pm.returnToPool()
 			}
@@ -4377,20 +6007,19 @@ func (mset *stream) internalLoop() {
 			c.flushClients(0)
 			outq.recycle(&pms)
 		case <-msgs.ch:
+			processInbound()
+		case <-spch:
+			// Anything in memory was queued before we started spilling.
+			processInbound()
 			// This can possibly change now so needs to be checked here.
 			isClustered := mset.IsClustered()
-			ims := msgs.pop()
-			for _, imi := range ims {
-				im := imi.(*inMsg)
-
-				// If we are clustered we need to propose this message to the underlying raft group.
-				if isClustered {
-					mset.processClusteredInboundMsg(im.subj, im.rply, im.hdr, im.msg)
-				} else {
-					mset.processJetStreamMsg(im.subj, im.rply, im.hdr, im.msg, 0, 0)
-				}
+			ims, err := mset.spool.read()
+			for _, im := range ims {
+				processInboundMsg(isClustered, im)
+			}
+			if err != nil {
+				mset.intakeFailed(err)
 			}
-			msgs.recycle(&ims)
 		case <-amch:
 			seqs := ackq.pop()
 			for _, seq := range seqs {
@@ -4407,14 +6036,20 @@ func (mset *stream) internalLoop() {
 
 // Internal function to delete a stream.
 func (mset *stream) delete() error {
+	return mset.deleteByClient(nil)
+}
+
+// Internal function to delete a stream on behalf of the given client.
+func (mset *stream) deleteByClient(ci *ClientInfo) error {
 	if mset == nil {
 		return nil
 	}
-	return mset.stop(true, true)
+	return mset.stop(true, true, ci)
 }
 
 // Internal function to stop or delete the stream.
-func (mset *stream) stop(deleteFlag, advisory bool) error {
+// The client info, if any, is reported in the delete advisory.
+func (mset *stream) stop(deleteFlag, advisory bool, ci *ClientInfo) error {
 	mset.mu.RLock()
 	js, jsa := mset.js, mset.jsa
 	mset.mu.RUnlock()
@@ -4425,7 +6060,10 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 
 	// Remove from our account map.
 	jsa.mu.Lock()
-	delete(jsa.streams, mset.cfg.Name)
+	if _, ok := jsa.streams[mset.cfg.Name]; ok {
+		delete(jsa.streams, mset.cfg.Name)
+		atomic.AddInt64(&jsa.nstreams, -1)
+	}
 	accName := jsa.account.Name
 	jsa.mu.Unlock()
 
@@ -4435,6 +6073,7 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 	for _, o := range mset.consumers {
 		obs = append(obs, o)
 	}
+	atomic.AddInt64(&jsa.nconsumers, -int64(len(mset.consumers)))
 	mset.clsMu.Lock()
 	mset.consumers, mset.cList, mset.csl = nil, nil, nil
 	mset.clsMu.Unlock()
@@ -4457,7 +6096,7 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		// Third flag says do not broadcast a signal.
 		// TODO(dlc) - If we have an err here we don't want to stop
 		// but should we log?
-		o.stopWithFlags(deleteFlag, deleteFlag, false, advisory)
+		o.stopWithFlags(deleteFlag, deleteFlag, false, advisory, ci)
 	}
 	mset.mu.Lock()
 
@@ -4487,7 +6126,7 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 
 	// Send stream delete advisory after the consumers.
 	if deleteFlag && advisory {
-		mset.sendDeleteAdvisoryLocked()
+		mset.sendDeleteAdvisoryLocked(ci)
 	}
 
 	// Quit channel, do this after sending the delete advisory
@@ -4496,6 +6135,12 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 		mset.qch = nil
 	}
 
+	// Stop handing off removed messages.
+	if mset.rmh != nil {
+		close(mset.rmh.qch)
+		mset.rmh = nil
+	}
+
 	c := mset.client
 	mset.client = nil
 	if c == nil {
@@ -4515,6 +6160,15 @@ func (mset *stream) stop(deleteFlag, advisory bool) error {
 	sysc := mset.sysc
 	mset.sysc = nil
 
+	// Anything left on our intake spool was never processed or acknowledged.
+	if mset.spool != nil {
+		mset.spool.close()
+	}
+	// Write out our source positions unless we are going away.
+	if mset.scur != nil {
+		mset.scur.close(!deleteFlag)
+	}
+
 	if deleteFlag {
 		// Unregistering ipQueues do not prevent them from push/pop
 		// just will remove them from the central monitoring map
@@ -4619,6 +6273,9 @@ func (mset *stream) numConsumers() int {
 
 // Lock should be held.
 func (mset *stream) setConsumer(o *consumer) {
+	if _, ok := mset.consumers[o.name]; !ok && mset.jsa != nil {
+		atomic.AddInt64(&mset.jsa.nconsumers, 1)
+	}
 	mset.consumers[o.name] = o
 	if o.cfg.FilterSubject != _EMPTY_ {
 		mset.numFilter++
@@ -4641,6 +6298,9 @@ func (mset *stream) removeConsumer(o *consumer) {
 		mset.directs--
 	}
 	if mset.consumers != nil {
+		if _, ok := mset.consumers[o.name]; ok && mset.jsa != nil {
+			atomic.AddInt64(&mset.jsa.nconsumers, -1)
+		}
 		delete(mset.consumers, o.name)
 		// Now update consumers list as well
 		mset.clsMu.Lock()
@@ -4963,21 +6623,21 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 		metafile := filepath.Join(odir, ofi.Name(), JetStreamMetaFile)
 		metasum := filepath.Join(odir, ofi.Name(), JetStreamMetaFileSum)
 		if _, err := os.Stat(metafile); os.IsNotExist(err) {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
 		buf, err := os.ReadFile(metafile)
 		if err != nil {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
 		if _, err := os.Stat(metasum); os.IsNotExist(err) {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
 		var cfg FileConsumerInfo
 		if err := json.Unmarshal(buf, &cfg); err != nil {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
 		isEphemeral := !isDurableConsumer(&cfg.ConsumerConfig)
@@ -4988,7 +6648,7 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 		}
 		obs, err := mset.addConsumer(&cfg.ConsumerConfig)
 		if err != nil {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
 		if isEphemeral {
@@ -5001,13 +6661,283 @@ func (a *Account) RestoreStream(ncfg *StreamConfig, r io.Reader) (*stream, error
 		err = obs.readStoredState(lseq)
 		obs.mu.Unlock()
 		if err != nil {
-			mset.stop(true, false)
+			mset.stop(true, false, nil)
 			return nil, fmt.Errorf("error restoring consumer [%q]: %v", ofi.Name(), err)
 		}
 	}
 	return mset, nil
 }
 
+// StreamRestoreCheck is the result of validating a stream snapshot without restoring it.
+type StreamRestoreCheck struct {
+	Config         StreamConfig `json:"config"`
+	Created        time.Time    `json:"created"`
+	Blocks         int          `json:"blocks"`
+	Msgs           uint64       `json:"messages"`
+	FirstSeq       uint64       `json:"first_seq"`
+	LastSeq        uint64       `json:"last_seq"`
+	MaxBlockSize   uint64       `json:"max_block_size"`
+	Consumers      []string     `json:"consumers,omitempty"`
+	RequiredBytes  uint64       `json:"required_bytes"`
+	AvailableBytes int64        `json:"available_bytes"`
+	Problems       []string     `json:"problems,omitempty"`
+}
+
+// OK returns true if no problems were found and the snapshot can be restored.
+func (sc *StreamRestoreCheck) OK() bool {
+	return len(sc.Problems) == 0
+}
+
+// CheckStreamRestore will read a stream snapshot and verify it could be restored into this account.
+// Meta data and message checksums, block versions and sizes are validated and the disk space needed
+// is compared against the account limits and what is available. Nothing is written to disk.
+func (a *Account) CheckStreamRestore(ncfg *StreamConfig, r io.Reader) (*StreamRestoreCheck, error) {
+	if ncfg == nil {
+		return nil, errors.New("nil config on stream restore check")
+	}
+
+	s, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, apiErr := s.checkStreamCfg(ncfg, a)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	var sc StreamRestoreCheck
+	if err := checkStreamSnapshot(r, &sc); err != nil {
+		return nil, err
+	}
+	problem := func(format string, args ...interface{}) {
+		sc.Problems = append(sc.Problems, fmt.Sprintf(format, args...))
+	}
+
+	if sc.Config.Name != _EMPTY_ && sc.Config.Name != cfg.Name {
+		problem("stream names do not match")
+	}
+	if _, err := a.lookupStream(cfg.Name); err == nil {
+		problem("stream %q already exists", cfg.Name)
+	}
+	if sc.MaxBlockSize > maxBlockSize {
+		problem("message block size %s exceeds maximum of %s",
+			friendlyBytes(int64(sc.MaxBlockSize)), friendlyBytes(maxBlockSize))
+	}
+
+	required := int64(sc.RequiredBytes)
+	if jsa.wouldExceedLimits(FileStorage, tierName(&cfg), required) {
+		problem("restore of %s would exceed account storage limits", friendlyBytes(required))
+	}
+	if js := s.getJetStream(); js != nil {
+		if max := js.config.MaxStore; max > 0 && atomic.LoadInt64(&js.storeUsed)+required > max {
+			problem("restore of %s would exceed server storage limits", friendlyBytes(required))
+		}
+	}
+	if sc.AvailableBytes = diskAvailable(jsa.storeDir); sc.AvailableBytes < required {
+		problem("restore of %s exceeds available disk space of %s",
+			friendlyBytes(required), friendlyBytes(sc.AvailableBytes))
+	}
+
+	return &sc, nil
+}
+
+// Name of the manifest within an account backup archive.
+const backupManifest = "manifest.json"
+
+// AccountBackupManifest describes the contents of an account backup archive.
+type AccountBackupManifest struct {
+	Account   string                  `json:"account"`
+	Created   time.Time               `json:"created"`
+	Streams   []AccountBackupStream   `json:"streams,omitempty"`
+	Templates []*StreamTemplateConfig `json:"templates,omitempty"`
+}
+
+// AccountBackupStream describes a single stream within an account backup.
+// File is the archive entry holding the stream snapshot, which can be handed to
+// RestoreStream. Streams that do not support snapshots, e.g. memory based, have
+// their config and state recorded but no file.
+type AccountBackupStream struct {
+	Config StreamConfig `json:"config"`
+	State  StreamState  `json:"state"`
+	File   string       `json:"file,omitempty"`
+}
+
+// BackupAll will snapshot all streams of the account, including their consumers,
+// and all stream templates into a single tar archive written to w. The archive
+// starts with a manifest describing its contents. All stream snapshots are
+// started together so the backup represents a roughly consistent point in time.
+func (a *Account) BackupAll(w io.Writer, deadline time.Duration, checkMsgs bool) (*AccountBackupManifest, error) {
+	_, jsa, err := a.checkForJetStream()
+	if err != nil {
+		return nil, err
+	}
+
+	sd := filepath.Join(jsa.storeDir, snapsDir)
+	if err := os.MkdirAll(sd, defaultDirPerms); err != nil {
+		return nil, fmt.Errorf("could not create snapshots directory - %v", err)
+	}
+	bdir, err := os.MkdirTemp(sd, "backup-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(bdir)
+
+	manifest := &AccountBackupManifest{Account: a.GetName(), Created: time.Now().UTC()}
+	for _, t := range a.templates() {
+		t.mu.Lock()
+		manifest.Templates = append(manifest.Templates, t.StreamTemplateConfig.deepCopy())
+		t.mu.Unlock()
+	}
+	sort.Slice(manifest.Templates, func(i, j int) bool { return manifest.Templates[i].Name < manifest.Templates[j].Name })
+
+	msets := a.streams()
+	sort.Slice(msets, func(i, j int) bool { return msets[i].name() < msets[j].name() })
+
+	// Start all snapshots first to get as close to a single point in time as we can.
+	srs := make([]*SnapshotResult, len(msets))
+	cancel := func() {
+		for _, sr := range srs {
+			if sr != nil {
+				sr.Handle.Cancel()
+			}
+		}
+	}
+	for i, mset := range msets {
+		cfg := mset.config()
+		bs := AccountBackupStream{Config: cfg, State: mset.state()}
+		if cfg.Storage == FileStorage {
+			sr, err := mset.snapshot(deadline, checkMsgs, true)
+			if err != nil {
+				cancel()
+				return nil, fmt.Errorf("error snapshotting stream %q: %v", cfg.Name, err)
+			}
+			srs[i] = sr
+			bs.State, bs.File = sr.State, fmt.Sprintf("streams/%s.snp", cfg.Name)
+		}
+		manifest.Streams = append(manifest.Streams, bs)
+	}
+
+	// Drain them all in parallel so none holds up the others.
+	var wg sync.WaitGroup
+	errs := make([]error, len(srs))
+	for i, sr := range srs {
+		if sr == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, sr *SnapshotResult) {
+			defer wg.Done()
+			defer sr.Reader.Close()
+			fd, err := os.Create(filepath.Join(bdir, strconv.Itoa(i)))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			_, err = io.Copy(fd, sr.Reader)
+			if cerr := fd.Close(); err == nil {
+				err = cerr
+			}
+			<-sr.Handle.Done()
+			if herr := sr.Handle.Err(); herr != nil {
+				err = herr
+			}
+			errs[i] = err
+		}(i, sr)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return nil, fmt.Errorf("error snapshotting stream %q: %v", msets[i].name(), err)
+		}
+	}
+
+	// Now write out the archive, manifest first.
+	b, err := json.MarshalIndent(manifest, _EMPTY_, "  ")
+	if err != nil {
+		return nil, err
+	}
+	tw := tar.NewWriter(w)
+	writeHeader := func(name string, size int64) error {
+		return tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			ModTime: manifest.Created,
+			Uname:   "nats",
+			Gname:   "nats",
+			Size:    size,
+			Format:  tar.FormatPAX,
+		})
+	}
+	if err := writeHeader(backupManifest, int64(len(b))); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(b); err != nil {
+		return nil, err
+	}
+	for i, bs := range manifest.Streams {
+		if bs.File == _EMPTY_ {
+			continue
+		}
+		if err := func() error {
+			fd, err := os.Open(filepath.Join(bdir, strconv.Itoa(i)))
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			fi, err := fd.Stat()
+			if err != nil {
+				return err
+			}
+			if err := writeHeader(bs.File, fi.Size()); err != nil {
+				return err
+			}
+			_, err = io.Copy(tw, fd)
+			return err
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// backupAccount writes a backup of all streams of the account to a new archive
+// in our store directory and returns its path.
+func (s *Server) backupAccount(a *Account, checkMsgs bool) (string, *AccountBackupManifest, error) {
+	js := s.getJetStream()
+	if js == nil {
+		return _EMPTY_, nil, NewJSNotEnabledError()
+	}
+	dir := filepath.Join(js.config.StoreDir, accountBackupsDir)
+	if err := os.MkdirAll(dir, defaultDirPerms); err != nil {
+		return _EMPTY_, nil, fmt.Errorf("could not create backups directory - %v", err)
+	}
+	file := filepath.Join(dir, fmt.Sprintf("%s-%d.tar", a.GetName(), time.Now().UnixNano()))
+	tmp := file + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_EXCL|os.O_WRONLY, defaultFilePerms)
+	if err != nil {
+		return _EMPTY_, nil, err
+	}
+	manifest, err := a.BackupAll(fd, 0, checkMsgs)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return _EMPTY_, nil, err
+	}
+	return file, manifest, nil
+}
+
 // This is to check for dangling messages.
 // Issue https://github.com/nats-io/nats-server/issues/3612
 func (mset *stream) checkForOrphanMsgs() {
@@ -0,0 +1,165 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"container/heap"
+	"math"
+	"sort"
+	"sync"
+)
+
+// Number of bits used to estimate subject cardinality, 8KB per account.
+const subjectStatsBits = 1 << 16
+
+// subjectStats tracks approximate per account subject statistics in bounded memory.
+// Top subjects are tracked with the space saving algorithm, so counts may be over
+// estimated by at most the reported error. Cardinality uses linear counting.
+// Each account has its own, so tracking never contends on the account lock.
+type subjectStats struct {
+	mu   sync.Mutex
+	max  int
+	top  map[string]*subjectCount
+	low  subjectHeap
+	bits []uint64
+	set  int
+}
+
+type subjectCount struct {
+	subj  string
+	msgs  uint64
+	bytes uint64
+	err   uint64
+	// Index in the min heap.
+	i int
+}
+
+// subjectHeap is a min heap of tracked subjects by message count,
+// so the one to replace is always at the root.
+type subjectHeap []*subjectCount
+
+func (h subjectHeap) Len() int           { return len(h) }
+func (h subjectHeap) Less(i, j int) bool { return h[i].msgs < h[j].msgs }
+func (h subjectHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].i, h[j].i = i, j
+}
+
+func (h *subjectHeap) Push(x interface{}) {
+	sc := x.(*subjectCount)
+	sc.i = len(*h)
+	*h = append(*h, sc)
+}
+
+func (h *subjectHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	sc := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return sc
+}
+
+// SubjectStat is the approximate volume for a single subject.
+type SubjectStat struct {
+	Subject string `json:"subject"`
+	Msgs    uint64 `json:"msgs"`
+	Bytes   uint64 `json:"bytes"`
+	// Error is the maximum the counts may be over estimated by.
+	Error uint64 `json:"error,omitempty"`
+}
+
+func newSubjectStats(max int) *subjectStats {
+	return &subjectStats{
+		max:  max,
+		top:  make(map[string]*subjectCount, max),
+		low:  make(subjectHeap, 0, max),
+		bits: make([]uint64, subjectStatsBits/64),
+	}
+}
+
+// Will account for a message published to subject.
+func (ss *subjectStats) track(subject []byte, size int) {
+	// FNV-1a, inline to avoid allocations.
+	h := uint64(14695981039346656037)
+	for _, c := range subject {
+		h ^= uint64(c)
+		h *= 1099511628211
+	}
+	bit := h % subjectStatsBits
+
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+
+	if w, m := bit/64, uint64(1)<<(bit%64); ss.bits[w]&m == 0 {
+		ss.bits[w] |= m
+		ss.set++
+	}
+	if sc := ss.top[string(subject)]; sc != nil {
+		sc.msgs++
+		sc.bytes += uint64(size)
+		heap.Fix(&ss.low, sc.i)
+		return
+	}
+	if len(ss.top) < ss.max {
+		sc := &subjectCount{subj: string(subject), msgs: 1, bytes: uint64(size)}
+		ss.top[sc.subj] = sc
+		heap.Push(&ss.low, sc)
+		return
+	}
+	// Replace the subject with the lowest count, inheriting its count as our error.
+	min := ss.low[0]
+	delete(ss.top, min.subj)
+	min.subj = string(subject)
+	min.err = min.msgs
+	min.msgs++
+	min.bytes += uint64(size)
+	ss.top[min.subj] = min
+	heap.Fix(&ss.low, 0)
+}
+
+// Returns the estimated number of distinct subjects.
+func (ss *subjectStats) cardinality() uint64 {
+	ss.mu.Lock()
+	set := ss.set
+	ss.mu.Unlock()
+
+	const m = float64(subjectStatsBits)
+	if set >= subjectStatsBits {
+		// Saturated, this is the best we can say.
+		return uint64(m * math.Log(m))
+	}
+	return uint64(math.Round(-m * math.Log((m-float64(set))/m)))
+}
+
+// Returns up to limit subjects ordered by message volume.
+func (ss *subjectStats) topSubjects(limit int) []SubjectStat {
+	ss.mu.Lock()
+	top := make([]SubjectStat, 0, len(ss.top))
+	for subj, sc := range ss.top {
+		top = append(top, SubjectStat{Subject: subj, Msgs: sc.msgs, Bytes: sc.bytes, Error: sc.err})
+	}
+	ss.mu.Unlock()
+
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Msgs == top[j].Msgs {
+			return top[i].Subject < top[j].Subject
+		}
+		return top[i].Msgs > top[j].Msgs
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
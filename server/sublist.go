@@ -71,6 +71,7 @@ type Sublist struct {
 	cache     map[string]*SublistResult
 	ccSweep   int32
 	notify    *notifyMaps
+	nwake     map[chan<- bool]func()
 	count     uint32
 }
 
@@ -202,6 +203,12 @@ func (s *Sublist) registerNotification(subject, queue string, notify chan<- bool
 
 	if err == nil {
 		sendNotification(notify, hasInterest)
+		s.RLock()
+		wake := s.nwake[notify]
+		s.RUnlock()
+		if wake != nil {
+			wake()
+		}
 	}
 	return err
 }
@@ -255,6 +262,31 @@ func sendNotification(ch chan<- bool, hasInterest bool) {
 	}
 }
 
+// setNotificationWake sets a function called after an interest change was
+// sent to the notification channel, for readers that do not wait on it.
+// A nil function clears it.
+func (s *Sublist) setNotificationWake(notify chan<- bool, wake func()) {
+	s.Lock()
+	if wake == nil {
+		delete(s.nwake, notify)
+	} else {
+		if s.nwake == nil {
+			s.nwake = make(map[chan<- bool]func())
+		}
+		s.nwake[notify] = wake
+	}
+	s.Unlock()
+}
+
+// Sends the notification and wakes up its reader if needed.
+// Write lock should be held.
+func (s *Sublist) sendNotificationLocked(ch chan<- bool, hasInterest bool) {
+	sendNotification(ch, hasInterest)
+	if wake := s.nwake[ch]; wake != nil {
+		wake()
+	}
+}
+
 // Add a new channel for notification in insert map.
 // Write lock should be held.
 func (s *Sublist) addInsertNotify(subject string, notify chan<- bool) error {
@@ -304,7 +336,7 @@ func (s *Sublist) chkForInsertNotification(subject, queue string) {
 	// All notify subjects are also literal so just do a hash lookup here.
 	if chs := s.notify.insert[key]; len(chs) > 0 {
 		for _, ch := range chs {
-			sendNotification(ch, true)
+			s.sendNotificationLocked(ch, true)
 		}
 		// Move from the insert map to the remove map.
 		s.notify.remove[key] = append(s.notify.remove[key], chs...)
@@ -341,7 +373,7 @@ func (s *Sublist) chkForRemoveNotification(subject, queue string) {
 		}
 		if !hasInterest {
 			for _, ch := range chs {
-				sendNotification(ch, false)
+				s.sendNotificationLocked(ch, false)
 			}
 			// Move from the remove map to the insert map.
 			s.notify.insert[key] = append(s.notify.insert[key], chs...)
@@ -77,6 +77,82 @@ func versionAtLeast(version string, emajor, eminor, epatch int) bool {
 	return res
 }
 
+// versionAtLeastPre is like versionAtLeast but takes pre-releases into account,
+// so 2.9.12-RC.1 is newer than 2.9.12-RC.0 and older than 2.9.12.
+func versionAtLeastPre(version, min string) bool {
+	major, minor, patch, err := versionComponents(version)
+	if err != nil {
+		return false
+	}
+	emajor, eminor, epatch, err := versionComponents(min)
+	if err != nil {
+		return false
+	}
+	if major != emajor {
+		return major > emajor
+	}
+	if minor != eminor {
+		return minor > eminor
+	}
+	if patch != epatch {
+		return patch > epatch
+	}
+	return comparePreRelease(preRelease(version), preRelease(min)) >= 0
+}
+
+// Returns the pre-release part of a version, without any build metadata.
+func preRelease(version string) string {
+	if i := strings.IndexByte(version, '+'); i >= 0 {
+		version = version[:i]
+	}
+	if i := strings.IndexByte(version, '-'); i >= 0 {
+		return version[i+1:]
+	}
+	return _EMPTY_
+}
+
+// Compares pre-releases following semver precedence, where no pre-release
+// is newer than any pre-release.
+func comparePreRelease(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == _EMPTY_ {
+		return 1
+	}
+	if b == _EMPTY_ {
+		return -1
+	}
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if as[i] == bs[i] {
+			continue
+		}
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case aerr == nil:
+			// Numeric identifiers are older than alphanumeric ones.
+			return -1
+		case berr == nil:
+			return 1
+		case as[i] < bs[i]:
+			return -1
+		default:
+			return 1
+		}
+	}
+	if len(as) < len(bs) {
+		return -1
+	}
+	return 1
+}
+
 // parseSize expects decimal positive numbers. We
 // return -1 to signal error.
 func parseSize(d []byte) (n int) {
@@ -220,6 +220,34 @@ func TestVersionAtLeast(t *testing.T) {
 	}
 }
 
+func TestVersionAtLeastPre(t *testing.T) {
+	for _, test := range []struct {
+		version string
+		min     string
+		result  bool
+	}{
+		{"2.9.12-RC.1", "2.9.12-RC.1", true},
+		{"2.9.12-RC.2", "2.9.12-RC.1", true},
+		{"2.9.12-RC.10", "2.9.12-RC.9", true},
+		{"2.9.12", "2.9.12-RC.1", true},
+		{"2.9.13-beta", "2.9.12-RC.1", true},
+		{"2.9.12-RC.0", "2.9.12-RC.1", false},
+		{"2.9.12-RC", "2.9.12-RC.1", false},
+		{"2.9.12-beta.1", "2.9.12-RC.1", true},
+		{"2.9.11", "2.9.12-RC.1", false},
+		{"2.9.12-RC.1", "2.9.12", false},
+		{"2.9.12+build", "2.9.12", true},
+		{"bad.version", "2.9.12", false},
+	} {
+		t.Run(_EMPTY_, func(t *testing.T) {
+			if res := versionAtLeastPre(test.version, test.min); res != test.result {
+				t.Fatalf("For check version %q at least %q result should have been %v, got %v",
+					test.version, test.min, test.result, res)
+			}
+		})
+	}
+}
+
 func BenchmarkParseInt(b *testing.B) {
 	b.SetBytes(1)
 	n := "12345678"
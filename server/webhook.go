@@ -0,0 +1,211 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/nats-io/nuid"
+)
+
+// Events that can be sent to a webhook.
+const (
+	WebhookLeafNodeConnect       = "leafnode_connect"
+	WebhookLeafNodeDisconnect    = "leafnode_disconnect"
+	WebhookGatewayOutage         = "gateway_outage"
+	WebhookJetStreamStorageFault = "jetstream_storage_fault"
+)
+
+// WebhookEventType is the schema type for webhook events.
+const WebhookEventType = "io.nats.server.webhook.v1.event"
+
+// Header that will hold the HMAC-SHA256 signature of the body when a secret is configured.
+const WebhookSignatureHeader = "Nats-Webhook-Signature"
+
+const (
+	defaultWebhookTimeout    = 2 * time.Second
+	defaultWebhookMaxRetries = 3
+	webhookRetryWait         = 250 * time.Millisecond
+	// Events beyond this are dropped, since a slow or down endpoint should not grow our memory.
+	maxWebhookPending = 1024
+)
+
+// WebhookEvent is the body posted to a webhook.
+type WebhookEvent struct {
+	TypedEvent
+	Event    string `json:"event"`
+	Server   string `json:"server"`
+	ServerID string `json:"server_id"`
+	Cluster  string `json:"cluster,omitempty"`
+	Remote   string `json:"remote,omitempty"`
+	Account  string `json:"account,omitempty"`
+	Stream   string `json:"stream,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+	Dropped  uint64 `json:"dropped,omitempty"`
+}
+
+func validateWebhookOptions(o *Options) error {
+	wo := &o.Webhook
+	if wo.URL == _EMPTY_ {
+		if len(wo.Events) > 0 || wo.Secret != _EMPTY_ {
+			return fmt.Errorf("webhook url is required")
+		}
+		return nil
+	}
+	u, err := url.Parse(wo.URL)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %v", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("webhook url scheme must be http or https, got %q", u.Scheme)
+	}
+	for _, e := range wo.Events {
+		switch e {
+		case WebhookLeafNodeConnect, WebhookLeafNodeDisconnect, WebhookGatewayOutage, WebhookJetStreamStorageFault:
+		default:
+			return fmt.Errorf("unknown webhook event %q", e)
+		}
+	}
+	if wo.MaxRetries < 0 {
+		return fmt.Errorf("webhook max retries cannot be negative")
+	}
+	return nil
+}
+
+// Will start the go routine that posts webhook events if configured.
+func (s *Server) startWebhooks() {
+	opts := s.getOpts()
+	if opts.Webhook.URL == _EMPTY_ {
+		return
+	}
+	wo := opts.Webhook
+	if wo.Timeout <= 0 {
+		wo.Timeout = defaultWebhookTimeout
+	}
+	if wo.MaxRetries == 0 {
+		wo.MaxRetries = defaultWebhookMaxRetries
+	}
+	events := make(map[string]struct{}, len(wo.Events))
+	for _, e := range wo.Events {
+		events[e] = struct{}{}
+	}
+
+	s.mu.Lock()
+	s.whq = s.newIPQueue("Webhook events")
+	s.whEvents = events
+	whq := s.whq
+	s.mu.Unlock()
+
+	hc := &http.Client{Timeout: wo.Timeout}
+
+	s.startGoRoutine(func() {
+		defer s.grWG.Done()
+		for {
+			select {
+			case <-s.quitCh:
+				return
+			case <-whq.ch:
+				es := whq.pop()
+				for _, e := range es {
+					s.postWebhook(hc, &wo, e.(*WebhookEvent))
+				}
+				whq.recycle(&es)
+			}
+		}
+	})
+}
+
+// Will post the event, retrying on failures.
+func (s *Server) postWebhook(hc *http.Client, wo *WebhookOpts, e *WebhookEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	var sig string
+	if wo.Secret != _EMPTY_ {
+		mac := hmac.New(sha256.New, []byte(wo.Secret))
+		mac.Write(body)
+		sig = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	wait := webhookRetryWait
+	for attempt := 0; attempt <= wo.MaxRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-s.quitCh:
+				return
+			case <-time.After(wait):
+			}
+			wait *= 2
+		}
+		req, err := http.NewRequest(http.MethodPost, wo.URL, bytes.NewReader(body))
+		if err != nil {
+			s.Warnf("Error creating webhook request: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if sig != _EMPTY_ {
+			req.Header.Set(WebhookSignatureHeader, sig)
+		}
+		resp, err := hc.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 300 {
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		s.Debugf("Error posting %q webhook event (attempt %d): %v", e.Event, attempt+1, err)
+	}
+	s.RateLimitWarnf("Unable to deliver %q webhook event to %q", e.Event, wo.URL)
+}
+
+// Will queue the event to be sent to the webhook if configured and selected.
+func (s *Server) sendWebhookEvent(event string, e *WebhookEvent) {
+	s.mu.RLock()
+	whq := s.whq
+	_, selected := s.whEvents[event]
+	selected = selected || len(s.whEvents) == 0
+	s.mu.RUnlock()
+
+	if whq == nil || !selected {
+		return
+	}
+	if whq.len() >= maxWebhookPending {
+		atomic.AddUint64(&s.whDropped, 1)
+		s.RateLimitWarnf("Dropping webhook events, more than %d pending", maxWebhookPending)
+		return
+	}
+	e.TypedEvent = TypedEvent{
+		Type: WebhookEventType,
+		ID:   nuid.Next(),
+		Time: time.Now().UTC(),
+	}
+	e.Event = event
+	e.Server = s.Name()
+	e.ServerID = s.ID()
+	e.Cluster = s.cachedClusterName()
+	// Let the receiver know about any events dropped before this one.
+	e.Dropped = atomic.SwapUint64(&s.whDropped, 0)
+	whq.push(e)
+}
@@ -0,0 +1,178 @@
+// Copyright 2023 The NATS Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookOptions(t *testing.T) {
+	conf := createConfFile(t, []byte(`
+		webhook {
+			url: "http://127.0.0.1:8080/events"
+			secret: "s3cr3t"
+			events: ["leafnode_connect", "gateway_outage"]
+			max_retries: 5
+			timeout: "500ms"
+		}
+	`))
+	opts, err := ProcessConfigFile(conf)
+	require_NoError(t, err)
+	wo := opts.Webhook
+	if wo.URL != "http://127.0.0.1:8080/events" || wo.Secret != "s3cr3t" || wo.MaxRetries != 5 || wo.Timeout != 500*time.Millisecond {
+		t.Fatalf("Unexpected webhook options: %+v", wo)
+	}
+	if len(wo.Events) != 2 || wo.Events[0] != WebhookLeafNodeConnect || wo.Events[1] != WebhookGatewayOutage {
+		t.Fatalf("Unexpected webhook events: %+v", wo.Events)
+	}
+	require_NoError(t, validateWebhookOptions(opts))
+
+	for _, test := range []struct {
+		name string
+		wo   WebhookOpts
+		err  string
+	}{
+		{"no url", WebhookOpts{Secret: "s3cr3t"}, "url is required"},
+		{"bad scheme", WebhookOpts{URL: "nats://127.0.0.1:4222"}, "scheme"},
+		{"unknown event", WebhookOpts{URL: "http://127.0.0.1", Events: []string{"foo"}}, "unknown webhook event"},
+		{"negative retries", WebhookOpts{URL: "http://127.0.0.1", MaxRetries: -1}, "cannot be negative"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			o := DefaultOptions()
+			o.Webhook = test.wo
+			if err := validateWebhookOptions(o); err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("Expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestWebhookLeafNodeEvents(t *testing.T) {
+	secret := "s3cr3t"
+	var posts int32
+	events := make(chan *WebhookEvent, 10)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Fail the first attempt to make sure we retry.
+		if atomic.AddInt32(&posts, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		if sig := "sha256=" + hex.EncodeToString(mac.Sum(nil)); r.Header.Get(WebhookSignatureHeader) != sig {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var e WebhookEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		events <- &e
+	}))
+	defer ts.Close()
+
+	ob := DefaultOptions()
+	ob.ServerName = "HUB"
+	ob.LeafNode.Host = "127.0.0.1"
+	ob.LeafNode.Port = -1
+	ob.Webhook = WebhookOpts{
+		URL:    ts.URL,
+		Secret: secret,
+		Events: []string{WebhookLeafNodeConnect, WebhookLeafNodeDisconnect},
+	}
+	sb := RunServer(ob)
+	defer sb.Shutdown()
+
+	lnBURL, _ := url.Parse(fmt.Sprintf("nats://127.0.0.1:%d", ob.LeafNode.Port))
+	oa := DefaultOptions()
+	oa.ServerName = "SPOKE"
+	oa.Cluster.Name = "xyz"
+	oa.LeafNode.Remotes = []*RemoteLeafOpts{{URLs: []*url.URL{lnBURL}}}
+	sa := RunServer(oa)
+	defer sa.Shutdown()
+
+	checkLeafNodeConnected(t, sb)
+
+	expect := func(event string) {
+		t.Helper()
+		select {
+		case e := <-events:
+			if e.Event != event || e.Type != WebhookEventType || e.Server != "HUB" || e.Remote != "SPOKE/xyz" || e.Account != globalAccountName {
+				t.Fatalf("Unexpected webhook event: %+v", e)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Did not receive %q webhook event", event)
+		}
+	}
+	expect(WebhookLeafNodeConnect)
+
+	sa.Shutdown()
+	expect(WebhookLeafNodeDisconnect)
+
+	if n := atomic.LoadInt32(&posts); n != 3 {
+		t.Fatalf("Expected 3 posts, got %d", n)
+	}
+}
+
+func TestWebhookPendingLimit(t *testing.T) {
+	s := RunServer(DefaultOptions())
+	defer s.Shutdown()
+
+	// Do not start the poster so nothing drains the queue.
+	s.mu.Lock()
+	s.whq = s.newIPQueue("Webhook events")
+	whq := s.whq
+	s.mu.Unlock()
+
+	for i := 0; i < maxWebhookPending+5; i++ {
+		s.sendWebhookEvent(WebhookGatewayOutage, &WebhookEvent{Remote: "B"})
+	}
+	if n := whq.len(); n != maxWebhookPending {
+		t.Fatalf("Expected %d pending events, got %d", maxWebhookPending, n)
+	}
+	if n := atomic.LoadUint64(&s.whDropped); n != 5 {
+		t.Fatalf("Expected 5 dropped events, got %d", n)
+	}
+
+	// The next queued event should report what was dropped.
+	es := whq.pop()
+	whq.recycle(&es)
+	s.sendWebhookEvent(WebhookGatewayOutage, &WebhookEvent{Remote: "B"})
+	es = whq.pop()
+	if len(es) != 1 || es[0].(*WebhookEvent).Dropped != 5 {
+		t.Fatalf("Expected the event to report 5 dropped, got %+v", es)
+	}
+	if n := atomic.LoadUint64(&s.whDropped); n != 0 {
+		t.Fatalf("Expected dropped count to be reset, got %d", n)
+	}
+}
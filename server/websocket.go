@@ -1209,6 +1209,11 @@ func (s *Server) createWSClient(conn net.Conn, ws *websocket) *client {
 	}
 	c.initClient()
 	c.Debugf("Client connection created")
+	if err := c.acquireConnLimit(s.clientConnLimiter); err != nil {
+		c.mu.Unlock()
+		c.connLimitExceeded(err)
+		return nil
+	}
 	c.sendProtoNow(c.generateClientInfoJSON(info))
 	c.mu.Unlock()
 